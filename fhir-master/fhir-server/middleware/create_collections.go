@@ -8,6 +8,7 @@ import (
 	"github.com/golang/glog"
 
 	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/server"
 	"github.com/gin-gonic/gin"
 	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
 	"github.com/pkg/errors"
@@ -16,8 +17,9 @@ import (
 	"go.opencensus.io/trace"
 )
 
-// Pre-create collections as required by MongoDB transactions
-func PrecreateCollectionsMiddleware(mongoDBuri string) gin.HandlerFunc {
+// Pre-create collections as required by MongoDB transactions, sharding new collections
+// using shardKey if it's set
+func PrecreateCollectionsMiddleware(mongoDBuri string, shardKey server.ShardKey) gin.HandlerFunc {
 
 	client, err := mongowrapper.Connect(context.Background(), options.Client().ApplyURI(mongoDBuri))
 	if err != nil {
@@ -43,7 +45,7 @@ func PrecreateCollectionsMiddleware(mongoDBuri string) gin.HandlerFunc {
 			span.AddAttributes(trace.StringAttribute("db", dbName))
 			defer span.End()
 
-			err := CreateCollections(ctx, collectionsToCreate, dbName, client)
+			err := CreateCollections(ctx, collectionsToCreate, dbName, client, shardKey)
 			if err != nil {
 				panic(errors.Wrap(err, "PrecreateCollectionsMiddleware failed"))
 			}
@@ -54,7 +56,7 @@ func PrecreateCollectionsMiddleware(mongoDBuri string) gin.HandlerFunc {
 	}
 }
 
-func CreateCollections(ctx context.Context, collectionsToCreate []string, dbName string, client *mongowrapper.WrappedClient) error {
+func CreateCollections(ctx context.Context, collectionsToCreate []string, dbName string, client *mongowrapper.WrappedClient, shardKey server.ShardKey) error {
 
 	db := client.Database(dbName)
 
@@ -81,6 +83,7 @@ func CreateCollections(ctx context.Context, collectionsToCreate []string, dbName
 		return errors.Wrap(err, "ListCollections cursor failed")
 	}
 
+	var createdCollections []string
 	createIfDoesntExist := func(name string) error {
 		_, exists := existingCollections[name]
 		if !exists {
@@ -89,6 +92,7 @@ func CreateCollections(ctx context.Context, collectionsToCreate []string, dbName
 			if res.Err() != nil && !strings.Contains(res.Err().Error(), "already exists") {
 				return errors.Wrap(res.Err(), "failed to create collection "+name)
 			}
+			createdCollections = append(createdCollections, name)
 		}
 		return nil
 	}
@@ -105,5 +109,12 @@ func CreateCollections(ctx context.Context, collectionsToCreate []string, dbName
 		}
 	}
 
+	if len(createdCollections) > 0 {
+		err = server.ShardCollections(ctx, db, createdCollections, shardKey)
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
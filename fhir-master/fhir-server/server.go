@@ -31,17 +31,45 @@ func main() {
 	mongodbURI := flag.String("mongodbURI", "mongodb://localhost:27017/fhir?replicaSet=rs0", "MongoDB connection URI - a replica set is required for transactions support")
 	databaseName := flag.String("databaseName", "fhir", "MongoDB database name to use by default")
 	enableMultiDB := flag.Bool("enableMultiDB", false, "Allow request to specify a specific Mongo database instead of the default, e.g. http://fhir-server/db/test4_fhir/Patient?name=alex")
+	allowClientAssignedStringIds := flag.Bool("allowClientAssignedStringIds", false, "Allow resources to be created with ids that aren't BSON ObjectIds (e.g. PUT /Patient/my-custom-id)")
 	enableHistory := flag.Bool("enableHistory", true, "Keep previous versions of every resource")
 	tokenParametersCaseSensitive := flag.Bool("tokenParametersCaseSensitive", false, "Whether token-type search parameters should be case sensitive (faster and R4 leans towards case-sensitive, whereas STU3 text suggests case-insensitive)")
+	transactionRetries := flag.Int("transactionRetries", 2, "Number of times a transaction failing with a write conflict is retried")
+	transactionRetryDelay := flag.Duration("transactionRetryDelay", 50*time.Millisecond, "Delay before the first retry of a conflicting transaction, doubling with each further retry")
+	allowConditionalReferencesInBatch := flag.Bool("allowConditionalReferencesInBatch", false, "Resolve conditional references in batches against existing resources, as in transactions")
 	batchConcurrency := flag.Int("batchConcurrency", 1, "Number of concurrent database operations to do during batch bundle processing (1 to disable)")
+	shardKey := flag.String("shardKey", "", "Field to shard new resource collections on when using a sharded MongoDB cluster (e.g. _id)")
+	hashedShardKey := flag.Bool("hashedShardKey", false, "Use hashed rather than ranged sharding for shardKey")
 	databaseSuffix := flag.String("databaseSuffix", "", "Request-specific MongoDB database name has to end with this (optional, e.g. '_fhir')")
 	dontCreateIndexes := flag.Bool("dontCreateIndexes", false, "Don't create indexes for the 'fhr' database on startup")
 	disableSearchTotals := flag.Bool("disableSearchTotals", false, "Don't query for all results of a search to return Bundle.total, only do paging")
 	enableXML := flag.Bool("enableXML", false, "Enable support for the FHIR XML encoding")
+	defaultResponseFormat := flag.String("defaultResponseFormat", "json", "Format of responses to requests that don't specify one with Accept or _format (json or xml, which requires --enableXML)")
+	formatParamHandling := flag.String("formatParamHandling", "lenient", "How to handle requests with an unknown _format: lenient (ignore it) or strict (reject with a 400)")
 	validatorURL := flag.String("validatorURL", "", "A FHIR validation endpoint to proxy validation requests to")
 	failedRequestsDir := flag.String("failedRequestsDir", "", "Directory where to dump failed requests (e.g. with malformed json)")
+	bulkExportDir := flag.String("bulkExportDir", "", "Directory where $export jobs write their ndjson files (enables $export)")
+	bulkExportExpiry := flag.Duration("bulkExportExpiry", 24*time.Hour, "How long the status and files of an $export remain available after it's kicked off")
+	captureFailedRequests := flag.Bool("captureFailedRequests", false, "Save the body and OperationOutcome of failed create/update/batch requests to failedRequestsDir")
+	storeDocumentBundles := flag.Bool("storeDocumentBundles", false, "Store document Bundles POSTed to the base URL as Bundle resources instead of rejecting them")
+	summarizeBatchOutcomes := flag.Bool("summarizeBatchOutcomes", false, "Add an entry to batch responses with an OperationOutcome collecting the warnings and errors of all other entries")
+	enableCursorPaging := flag.Bool("enableCursorPaging", false, "Page searches with _searchafter links that continue after the last result instead of _offset, where the sort allows it")
+	missingValuesSortOrder := flag.String("missingValuesSortOrder", "", "Where searches sort resources without a value of a _sort parameter: first or last (default: first when ascending, last when descending)")
+	caseInsensitiveResourceTypes := flag.Bool("caseInsensitiveResourceTypes", false, "Route requests whose resource type differs only in case (e.g. /patient) to that resource type")
+	maxResourceDepth := flag.Int("maxResourceDepth", 64, "Maximum nesting depth of objects and arrays within a stored resource")
+	maxSearchParameters := flag.Int("maxSearchParameters", 100, "Maximum number of parameters in a single search")
+	maxSearchValuesPerParameter := flag.Int("maxSearchValuesPerParameter", 1000, "Maximum number of comma-separated values of a single search parameter")
+	maxResultCount := flag.Int("maxResultCount", 1000, "Maximum number of results of a single page of a search, history or $everything (larger _count values are reduced to it)")
+	maxTransactionReferences := flag.Int("maxTransactionReferences", 1000, "Maximum number of conditional references in a single transaction (0 for no limit)")
+	readFromSecondaries := flag.Bool("readFromSecondaries", false, "Let searches read from secondary members of the replica set, whose results may lag behind recent writes")
+	requireIndexedSearch := flag.Bool("requireIndexedSearch", false, "Reject searches that none of the indexes in config/indexes.conf can serve, as they scan the whole collection")
+	enableFhirVersionConversion := flag.Bool("enableFhirVersionConversion", false, "Let requests for other FHIR versions (Accept: ...; fhirVersion=x) through to a conversion layer instead of rejecting them with a 406")
+	requireExistingDb := flag.Bool("requireExistingDb", false, "With enableMultiDB, reject requests for databases that don't already exist instead of creating them")
+	countCacheTTL := flag.Duration("countCacheTTL", 10*time.Minute, "How long a read-only server reuses the cached total of a search before counting it again")
+	metaLessResources := flag.String("metaLessResources", "inject", "How to handle resources created or updated without a meta: inject (a default one) or reject (with a 400)")
 	requestsDumpDir := flag.String("requestsDumpDir", "", "Directory where to dump all requests and responses")
 	requestsDumpGET := flag.Bool("requestsDumpGET", true, "Whether to dump HTTP GET requests")
+	enableMetrics := flag.Bool("enableMetrics", false, "Serve Prometheus metrics of the count, duration and errors of database operations at /metrics")
 	enableStackdriverTracing := flag.Bool("enableStackdriverTracing", false, "Enable OpenCensus tracing to StackDriver")
 	enableJaegerTracing := flag.Bool("enableJaegerTracing", false, "Enable OpenCensus tracing to Jaeger")
 	startMongod := flag.Bool("startMongod", false, "Run mongod (for 'getting started' docker images - development only)")
@@ -65,6 +93,17 @@ func main() {
 		fmt.Println("XML support is disabled (use --enableXML to enable)")
 	}
 
+	if *defaultResponseFormat != "json" && (*defaultResponseFormat != "xml" || !*enableXML) {
+		log.Fatal("--defaultResponseFormat must be json, or xml when --enableXML is set")
+	}
+
+	if *formatParamHandling != "lenient" && *formatParamHandling != "strict" {
+		log.Fatal("--formatParamHandling must be lenient or strict")
+	}
+	if *missingValuesSortOrder != "" && *missingValuesSortOrder != "first" && *missingValuesSortOrder != "last" {
+		log.Fatal("--missingValuesSortOrder must be first or last")
+	}
+
 	if gitCommit != "" {
 		fmt.Printf("GoFHIR version %s\n", gitCommit)
 	}
@@ -103,26 +142,53 @@ func main() {
 	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
 	var MyConfig = server.Config{
-		CreateIndexes:                !*dontCreateIndexes,
-		IndexConfigPath:              "config/indexes.conf",
-		DatabaseURI:                  *mongodbURI,
-		DefaultDatabaseName:          *databaseName,
-		EnableMultiDB:                *enableMultiDB,
-		DatabaseSuffix:               *databaseSuffix,
-		DatabaseSocketTimeout:        2 * time.Minute,
-		DatabaseOpTimeout:            90 * time.Second,
-		DatabaseKillOpPeriod:         10 * time.Second,
-		Auth:                         auth.None(),
-		EnableCISearches:             true,
-		TokenParametersCaseSensitive: *tokenParametersCaseSensitive,
-		CountTotalResults:            *disableSearchTotals == false,
-		ReadOnly:                     false,
-		EnableXML:                    *enableXML,
-		EnableHistory:                *enableHistory,
-		BatchConcurrency:             *batchConcurrency,
-		Debug:                        true,
-		ValidatorURL:                 *validatorURL,
-		FailedRequestsDir:            *failedRequestsDir,
+		CreateIndexes:                     !*dontCreateIndexes,
+		IndexConfigPath:                   "config/indexes.conf",
+		DatabaseURI:                       *mongodbURI,
+		DefaultDatabaseName:               *databaseName,
+		EnableMultiDB:                     *enableMultiDB,
+		RequireExistingDb:                 *requireExistingDb,
+		DatabaseSuffix:                    *databaseSuffix,
+		ShardKey:                          server.ShardKey{Field: *shardKey, Hashed: *hashedShardKey},
+		DatabaseSocketTimeout:             2 * time.Minute,
+		DatabaseOpTimeout:                 90 * time.Second,
+		DatabaseKillOpPeriod:              10 * time.Second,
+		Auth:                              auth.None(),
+		EnableCISearches:                  true,
+		TokenParametersCaseSensitive:      *tokenParametersCaseSensitive,
+		CountTotalResults:                 *disableSearchTotals == false,
+		ReadOnly:                          false,
+		CountCacheTTL:                     *countCacheTTL,
+		EnableXML:                         *enableXML,
+		DefaultResponseFormat:             *defaultResponseFormat,
+		FormatParamHandling:               *formatParamHandling,
+		EnableHistory:                     *enableHistory,
+		AllowClientAssignedStringIds:      *allowClientAssignedStringIds,
+		MetaLessResources:                 *metaLessResources,
+		BatchConcurrency:                  *batchConcurrency,
+		AllowConditionalReferencesInBatch: *allowConditionalReferencesInBatch,
+		TransactionRetries:                *transactionRetries,
+		TransactionRetryDelay:             *transactionRetryDelay,
+		Debug:                             true,
+		ValidatorURL:                      *validatorURL,
+		FailedRequestsDir:                 *failedRequestsDir,
+		BulkExportDir:                     *bulkExportDir,
+		BulkExportExpiry:                  *bulkExportExpiry,
+		CaptureFailedRequests:             *captureFailedRequests,
+		StoreDocumentBundles:              *storeDocumentBundles,
+		SummarizeBatchOutcomes:            *summarizeBatchOutcomes,
+		EnableCursorPaging:                *enableCursorPaging,
+		MissingValuesSortOrder:            *missingValuesSortOrder,
+		CaseInsensitiveResourceTypes:      *caseInsensitiveResourceTypes,
+		MaxResourceDepth:                  *maxResourceDepth,
+		MaxSearchParameters:               *maxSearchParameters,
+		MaxSearchValuesPerParameter:       *maxSearchValuesPerParameter,
+		MaxResultCount:                    *maxResultCount,
+		MaxTransactionReferences:          *maxTransactionReferences,
+		RequireIndexedSearch:              *requireIndexedSearch,
+		ReadFromSecondaries:               *readFromSecondaries,
+		EnableMetrics:                     *enableMetrics,
+		EnableFhirVersionConversion:       *enableFhirVersionConversion,
 	}
 	s := server.NewServer(MyConfig)
 	if *reqLog {
@@ -140,7 +206,7 @@ func main() {
 	s.Engine.Use(middleware.ClientSpecifiedMutexesMiddleware())
 
 	// Pre-create collections as required by MongoDB transactions
-	s.Engine.Use(middleware.PrecreateCollectionsMiddleware(*mongodbURI))
+	s.Engine.Use(middleware.PrecreateCollectionsMiddleware(*mongodbURI, MyConfig.ShardKey))
 
 	s.InitEngine()
 
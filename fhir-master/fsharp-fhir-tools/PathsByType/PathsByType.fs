@@ -42,6 +42,24 @@ let getPathTypes (filename: string) =
     
     pathTypes
 
+// Top-level elements of each resource (with choice types expanded) for which the predicate holds
+let getTopLevelElements (filename: string) (predicate: Elements.Element -> bool) =
+
+    let file = Elements.Load(filename)
+    let snapshots = file.Entry |> Array.collect (fun e -> e.Resource.Snapshot |> Option.toArray)
+    let elements = snapshots |> Array.collect (fun s -> s.Element)
+
+    seq {
+        for element in elements do
+            if element.Id.Split('.').Length = 2 && predicate element then
+                if element.Id.EndsWith("[x]") then
+                    let prefix = element.Id.Substring(0, element.Id.Length - 3)
+                    for code in element.Type |> Array.map (fun t -> t.Code) |> Array.distinct do
+                        yield prefix + (string code.[0]).ToUpper() + code.Substring(1)
+                else
+                    yield element.Id
+    }
+
 [<EntryPoint>]
 let main argv =
 
@@ -62,4 +80,20 @@ let main argv =
         printfn """    "%s": "%s",""" path t
     printfn "}"
 
+    // Elements returned with _summary=true and _summary=text
+    let resourcesPath = Path.Combine(fhirSpecDir, "profiles-resources.json")
+    let summaryElements = getTopLevelElements resourcesPath (fun e -> e.IsSummary = Some true) |> Seq.sort
+    let mandatoryElements = getTopLevelElements resourcesPath (fun e -> e.Min > 0) |> Seq.sort
+
+    printfn ""
+    printfn """var fhirSummaryElements = map[string]bool {"""
+    for path in summaryElements do
+        printfn """    "%s": true,""" path
+    printfn "}"
+    printfn ""
+    printfn """var fhirMandatoryElements = map[string]bool {"""
+    for path in mandatoryElements do
+        printfn """    "%s": true,""" path
+    printfn "}"
+
     0 // exit code
@@ -66,7 +66,7 @@ func (b *ShallowBundle) GetAllReferences() (references []string, err error) {
 
 	for _, e := range b.Entry {
 		if e.Resource != nil {
-			err = WalkFHIRjson(e.Resource.JsonBytes(), visitor)
+			err = WalkFHIRjson(e.Resource.JsonBytes(), visitor, e.Resource.maxDepth)
 			if err != nil {
 				return nil, errors.Wrap(err, "WalkFHIRjson error")
 			}
@@ -8,8 +8,10 @@ import (
 	"os"
 	"testing"
 
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestConversion(t *testing.T) {
@@ -26,7 +28,7 @@ func TestConversion(t *testing.T) {
 			assert.Nil(t, err)
 
 			transformReferencesMap := map[string]string{}
-			bson, err := ConvertJsonToGoFhirBSON(jsonBytes, encryptionEnable, transformReferencesMap)
+			bson, err := ConvertJsonToGoFhirBSON(jsonBytes, encryptionEnable, transformReferencesMap, 0)
 			assert.Nil(t, err)
 
 			if encrypt {
@@ -76,7 +78,7 @@ func TestEncryptionOfMedicareIdentifier(t *testing.T) {
 			assert.Nil(t, err)
 
 			transformReferencesMap := map[string]string{}
-			bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, encryptionEnable, transformReferencesMap)
+			bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, encryptionEnable, transformReferencesMap, 0)
 			assert.Nil(t, err)
 
 			for _, field := range bsonDoc {
@@ -123,3 +125,95 @@ func printBSON(bsonDoc *bson.D) {
 
 	ioutil.WriteFile("/tmp/tst2.bson", bsonBytes, 0777)
 }
+
+func nestedExtensionPatient(levels int) []byte {
+	extension := `{"url": "http://example.org/leaf", "valueString": "leaf"}`
+	for i := 0; i < levels; i++ {
+		extension = fmt.Sprintf(`{"url": "http://example.org/level%d", "extension": [%s]}`, i, extension)
+	}
+	return []byte(`{"resourceType": "Patient", "extension": [` + extension + `]}`)
+}
+
+func TestConversionDepthLimit(t *testing.T) {
+
+	_, err := ConvertJsonToGoFhirBSON(nestedExtensionPatient(10), WhatToEncrypt{}, nil, 0)
+	assert.Nil(t, err)
+
+	_, err = ConvertJsonToGoFhirBSON(nestedExtensionPatient(DefaultMaxConversionDepth+1), WhatToEncrypt{}, nil, 0)
+	assert.NotNil(t, err)
+	assert.IsType(t, FhirSchemaError{}, errors.Cause(err))
+	assert.Contains(t, errors.Cause(err).Error(), "nested too deeply (maximum depth is 64)")
+
+	err = WalkFHIRjson(nestedExtensionPatient(DefaultMaxConversionDepth+1), NewFhirVisitorCollectReferences(), 0)
+	assert.IsType(t, FhirSchemaError{}, errors.Cause(err))
+
+	// with a maximum depth of its own
+	_, err = ConvertJsonToGoFhirBSON(nestedExtensionPatient(DefaultMaxConversionDepth+1), WhatToEncrypt{}, nil, 200)
+	assert.Nil(t, err)
+	err = WalkFHIRjson(nestedExtensionPatient(DefaultMaxConversionDepth+1), NewFhirVisitorCollectReferences(), 200)
+	assert.Nil(t, err)
+
+	resource, err := NewResourceFromJsonBytes(nestedExtensionPatient(10))
+	assert.Nil(t, err)
+	resource.SetMaxDepth(5)
+	_, err = resource.GetBSON()
+	assert.Contains(t, errors.Cause(err).Error(), "nested too deeply (maximum depth is 5)")
+}
+
+func TestBundleInternalReferences(t *testing.T) {
+	jsonBytes, err := ioutil.ReadFile("../fixtures/document_bundle.json")
+	assert.Nil(t, err)
+
+	bsonDoc, err := ConvertJsonToGoFhirBSON(jsonBytes, WhatToEncrypt{}, nil, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, Gofhir__fullUrls, bsonDoc[len(bsonDoc)-1].Key)
+
+	// as loaded from MongoDB
+	raw, err := bson.Marshal(bsonDoc)
+	assert.Nil(t, err)
+	var loaded bson.D
+	assert.Nil(t, bson.Unmarshal(raw, &loaded))
+
+	// the map isn't returned to clients and references are left alone by default
+	resource, err := NewResourceFromBSON(loaded)
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(jsonBytes), string(resource.JsonBytes()))
+
+	resource.ResolveInternalReferences()
+	resolved, err := resource.MarshalJSON()
+	assert.Nil(t, err)
+
+	var bundle map[string]interface{}
+	assert.Nil(t, json.Unmarshal(resolved, &bundle))
+	entries := bundle["entry"].([]interface{})
+	composition := entries[0].(map[string]interface{})["resource"].(map[string]interface{})
+	encounter := entries[2].(map[string]interface{})["resource"].(map[string]interface{})
+	assert.Equal(t, "Patient/d1", composition["subject"].(map[string]interface{})["reference"])
+	assert.Equal(t, "Encounter/d2", composition["encounter"].(map[string]interface{})["reference"])
+	assert.Equal(t, "Practitioner/123", composition["author"].([]interface{})[0].(map[string]interface{})["reference"])
+	assert.Equal(t, "Patient/d1", encounter["subject"].(map[string]interface{})["reference"])
+	assert.Equal(t, "urn:uuid:ae2eb9c2-5e26-4ee4-9bd1-3ce3f8e9d1f4", entries[1].(map[string]interface{})["fullUrl"])
+}
+
+func TestUnloadableIncludedResourcesAreSkipped(t *testing.T) {
+	var condition, patient bson.D
+	assert.Nil(t, bson.UnmarshalExtJSON([]byte(`{"_id": "c1", "resourceType": "Condition", "subject": {"reference": "Patient/p1"}}`), false, &condition))
+	assert.Nil(t, bson.UnmarshalExtJSON([]byte(`{"_id": "p1", "resourceType": "Patient", "gender": "male"}`), false, &patient))
+
+	withIncludes := append(condition, bson.E{Key: "_includedPatientResourcesReferencedByPatient", Value: primitive.A{
+		patient,
+		bson.D{{Key: "_id", Value: "p2"}}, // without a resourceType
+		"not a document",
+	}})
+	resource, err := NewResourceFromBSON(withIncludes)
+	assert.Nil(t, err)
+	assert.Equal(t, "c1", resource.Id())
+	assert.Len(t, resource.SearchIncludes(), 1)
+	assert.Equal(t, "p1", resource.SearchIncludes()[0].Id())
+
+	// and an empty $lookup for a missing resource
+	withoutIncludes := append(condition, bson.E{Key: "_includedPatientResourcesReferencedByPatient", Value: primitive.A{}})
+	resource, err = NewResourceFromBSON(withoutIncludes)
+	assert.Nil(t, err)
+	assert.Len(t, resource.SearchIncludes(), 0)
+}
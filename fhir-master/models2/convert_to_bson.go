@@ -20,6 +20,12 @@ const Gofhir__strDate = "__strDate"
 const Gofhir__num = "__num"
 const Gofhir__from = "__from"
 const Gofhir__to = "__to"
+const Gofhir__fullUrls = "__fullUrls"
+
+// DefaultMaxConversionDepth is the deepest that objects and arrays can be nested within a resource
+// when no other maximum depth is given. Deeper resources are rejected with a FhirSchemaError rather
+// than risking the stack.
+const DefaultMaxConversionDepth = 64
 
 // Converts a FHIR JSON Resource into BSON for storage in MongoDB
 // Does several transformations:
@@ -28,8 +34,11 @@ const Gofhir__to = "__to"
 //   - converts extensions from { url, value } to { url: { value } } to enable better MongoDB queries
 //   - converts decimal numbers to { __from, __to, __num, __strNum } for FHIR conformance
 //   - converts dates to { __from, __to, __strDate } for FHIR conformance
+//   - for Bundles stores what the urn:uuid: fullUrls of entries refer to in __fullUrls
 //   - optionally encrypts certain fields
-func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, transformReferencesMap map[string]string) (out bson.D, err error) {
+//
+// Objects and arrays may be nested maxDepth deep (DefaultMaxConversionDepth if it's zero)
+func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, transformReferencesMap map[string]string, maxDepth int) (out bson.D, err error) {
 
 	debug("=== ConvertJsonToGoFhirBSON ===")
 
@@ -41,7 +50,7 @@ func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, tran
 	}
 
 	if err == nil {
-		pos := positionInfo{pathHere: resourceType, element: resourceType}
+		pos := positionInfo{pathHere: resourceType, element: resourceType, maxDepth: maxDepth}
 		err = jsonparser.ObjectEach(jsonBytes, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 			err4 := addToBSONdoc(&bsonRoot, pos, key, value, dataType, offset, refsMap)
 			if err4 != nil {
@@ -51,6 +60,13 @@ func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, tran
 		})
 	}
 
+	if err == nil && resourceType == "Bundle" {
+		err = addBundleFullUrls(&bsonRoot, jsonBytes)
+		if err != nil {
+			err = errors.Wrapf(err, "addBundleFullUrls failed")
+		}
+	}
+
 	if err == nil {
 		err = encryptBSON(&bsonRoot, resourceType, whatToEncrypt)
 		if err != nil {
@@ -65,6 +81,37 @@ func ConvertJsonToGoFhirBSON(jsonBytes []byte, whatToEncrypt WhatToEncrypt, tran
 	}
 }
 
+// Entries of document and collection Bundles often refer to each other using their urn:uuid: fullUrls.
+// Since these Bundles are stored as-is, we keep a map from these fullUrls to the entry resources
+// so that the references can optionally be resolved when reading (see Resource.ResolveInternalReferences)
+func addBundleFullUrls(output *[]bson.E, jsonBytes []byte) error {
+	fullUrls := make([]interface{}, 0, 4)
+	_, err := jsonparser.ArrayEach(jsonBytes, func(entry []byte, dataType jsonparser.ValueType, offset int, err3 error) {
+		if err3 != nil || dataType != jsonparser.Object {
+			return
+		}
+		fullUrl, _ := jsonparser.GetString(entry, "fullUrl")
+		resourceType, _ := jsonparser.GetString(entry, "resource", "resourceType")
+		id, _ := jsonparser.GetString(entry, "resource", "id")
+		if strings.HasPrefix(fullUrl, "urn:uuid:") && resourceType != "" && id != "" {
+			fullUrls = append(fullUrls, []bson.E{
+				bson.E{Key: "fullUrl", Value: fullUrl},
+				bson.E{Key: "reference", Value: resourceType + "/" + id},
+			})
+		}
+	}, "entry")
+	if err == jsonparser.KeyPathNotFoundError {
+		return nil // no entries
+	} else if err != nil {
+		return errors.Wrap(err, "ArrayEach failed")
+	}
+
+	if len(fullUrls) > 0 {
+		*output = append(*output, bson.E{Key: Gofhir__fullUrls, Value: fullUrls})
+	}
+	return nil
+}
+
 func addToBSONdoc(output *[]bson.E, pos positionInfo, key []byte, value []byte, dataType jsonparser.ValueType, offset int, refsMap refsMap) error {
 	strKey := string(key)
 	nextPos := pos.downTo(strKey, value)
@@ -158,6 +205,10 @@ func addToBSONarray(output *[]interface{}, pos positionInfo, value []byte, dataT
 
 func convertValue(pos positionInfo, value []byte, dataType jsonparser.ValueType, refsMap refsMap) (out interface{}, err error) {
 
+	if err = pos.checkDepth(); err != nil {
+		return nil, err
+	}
+
 	switch dataType {
 	case jsonparser.Object:
 		subDoc := make([]bson.E, 0, 4)
@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/golang/glog"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -46,9 +47,16 @@ func processIncludedDocuments(bsonDoc []bson.E) (includedDocsJsons [][]byte, err
 		if docIncluded(elem.Key) {
 			// included by a search with _include or _revinclude
 
+			// An included resource that can't be loaded is skipped (and logged) rather than failing the
+			// whole search, in the same way that references to missing resources are simply not included
+
 			// includedFieldRegex := regexp.MustCompile(`^_included([[:alpha:]]+)ResourcesReferencedBy([[:alpha:]]+)$`)
 			// arr := elem.Value.([]interface{})
-			arr := elem.Value.(primitive.A)
+			arr, isArray := elem.Value.(primitive.A)
+			if !isArray {
+				glog.Warningf("processIncludedDocuments: skipping %s as it isn't an array (%T)", elem.Key, elem.Value)
+				continue
+			}
 			for _, elt := range arr {
 
 				var includedDoc bson.D
@@ -57,11 +65,15 @@ func processIncludedDocuments(bsonDoc []bson.E) (includedDocsJsons [][]byte, err
 					includedDoc = eltV
 				case bson.D:
 					includedDoc = eltV
+				default:
+					glog.Warningf("processIncludedDocuments: skipping element of %s that isn't a document (%T)", elem.Key, elt)
+					continue
 				}
 
 				jsonBytes, nestedIncluded, err := ConvertGoFhirBSONToJSON(includedDoc)
 				if err != nil {
-					return nil, errors.Wrapf(err, "processIncludedDocuments: ConvertGoFhirBSONToJSON failed at %s", elem.Key)
+					glog.Warningf("processIncludedDocuments: skipping resource in %s: ConvertGoFhirBSONToJSON failed: %+v", elem.Key, err)
+					continue
 				}
 				if len(nestedIncluded) > 0 {
 					return nil, errors.Wrapf(err, "processIncludedDocuments: unexpected nested _included at %s", elem.Key)
@@ -143,7 +155,7 @@ func processDocument(out *bytes.Buffer, bsonDoc []bson.E) (err error) {
 		debug("processDocument: %s", elem.Key)
 
 		switch elem.Key {
-		case "reference__id", "reference__type", "reference__external":
+		case "reference__id", "reference__type", "reference__external", Gofhir__fullUrls:
 			continue // i.e. skip
 		}
 
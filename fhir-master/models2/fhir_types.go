@@ -6161,3 +6161,1775 @@ var fhirTypes = map[string]string {
     "xhtml.id": "string",
     "xhtml.value": "",
 }
+
+var fhirSummaryElements = map[string]bool {
+    "Account.active": true,
+    "Account.coverage": true,
+    "Account.description": true,
+    "Account.id": true,
+    "Account.identifier": true,
+    "Account.implicitRules": true,
+    "Account.meta": true,
+    "Account.name": true,
+    "Account.owner": true,
+    "Account.period": true,
+    "Account.status": true,
+    "Account.subject": true,
+    "Account.type": true,
+    "ActivityDefinition.contact": true,
+    "ActivityDefinition.date": true,
+    "ActivityDefinition.description": true,
+    "ActivityDefinition.effectivePeriod": true,
+    "ActivityDefinition.experimental": true,
+    "ActivityDefinition.id": true,
+    "ActivityDefinition.identifier": true,
+    "ActivityDefinition.implicitRules": true,
+    "ActivityDefinition.jurisdiction": true,
+    "ActivityDefinition.meta": true,
+    "ActivityDefinition.name": true,
+    "ActivityDefinition.publisher": true,
+    "ActivityDefinition.status": true,
+    "ActivityDefinition.title": true,
+    "ActivityDefinition.url": true,
+    "ActivityDefinition.useContext": true,
+    "ActivityDefinition.version": true,
+    "AdverseEvent.category": true,
+    "AdverseEvent.date": true,
+    "AdverseEvent.description": true,
+    "AdverseEvent.eventParticipant": true,
+    "AdverseEvent.id": true,
+    "AdverseEvent.identifier": true,
+    "AdverseEvent.implicitRules": true,
+    "AdverseEvent.location": true,
+    "AdverseEvent.meta": true,
+    "AdverseEvent.outcome": true,
+    "AdverseEvent.reaction": true,
+    "AdverseEvent.recorder": true,
+    "AdverseEvent.referenceDocument": true,
+    "AdverseEvent.seriousness": true,
+    "AdverseEvent.study": true,
+    "AdverseEvent.subject": true,
+    "AdverseEvent.subjectMedicalHistory": true,
+    "AdverseEvent.suspectEntity": true,
+    "AdverseEvent.type": true,
+    "AllergyIntolerance.asserter": true,
+    "AllergyIntolerance.category": true,
+    "AllergyIntolerance.clinicalStatus": true,
+    "AllergyIntolerance.code": true,
+    "AllergyIntolerance.criticality": true,
+    "AllergyIntolerance.id": true,
+    "AllergyIntolerance.identifier": true,
+    "AllergyIntolerance.implicitRules": true,
+    "AllergyIntolerance.meta": true,
+    "AllergyIntolerance.patient": true,
+    "AllergyIntolerance.type": true,
+    "AllergyIntolerance.verificationStatus": true,
+    "Appointment.appointmentType": true,
+    "Appointment.end": true,
+    "Appointment.id": true,
+    "Appointment.identifier": true,
+    "Appointment.implicitRules": true,
+    "Appointment.meta": true,
+    "Appointment.reason": true,
+    "Appointment.serviceCategory": true,
+    "Appointment.serviceType": true,
+    "Appointment.specialty": true,
+    "Appointment.start": true,
+    "Appointment.status": true,
+    "AppointmentResponse.actor": true,
+    "AppointmentResponse.appointment": true,
+    "AppointmentResponse.id": true,
+    "AppointmentResponse.identifier": true,
+    "AppointmentResponse.implicitRules": true,
+    "AppointmentResponse.meta": true,
+    "AppointmentResponse.participantStatus": true,
+    "AppointmentResponse.participantType": true,
+    "AuditEvent.action": true,
+    "AuditEvent.id": true,
+    "AuditEvent.implicitRules": true,
+    "AuditEvent.meta": true,
+    "AuditEvent.outcome": true,
+    "AuditEvent.outcomeDesc": true,
+    "AuditEvent.purposeOfEvent": true,
+    "AuditEvent.recorded": true,
+    "AuditEvent.subtype": true,
+    "AuditEvent.type": true,
+    "Basic.author": true,
+    "Basic.code": true,
+    "Basic.created": true,
+    "Basic.id": true,
+    "Basic.identifier": true,
+    "Basic.implicitRules": true,
+    "Basic.meta": true,
+    "Basic.subject": true,
+    "Binary.contentType": true,
+    "Binary.id": true,
+    "Binary.implicitRules": true,
+    "Binary.meta": true,
+    "Binary.securityContext": true,
+    "BodySite.active": true,
+    "BodySite.code": true,
+    "BodySite.description": true,
+    "BodySite.id": true,
+    "BodySite.identifier": true,
+    "BodySite.implicitRules": true,
+    "BodySite.meta": true,
+    "BodySite.patient": true,
+    "Bundle.entry": true,
+    "Bundle.id": true,
+    "Bundle.identifier": true,
+    "Bundle.implicitRules": true,
+    "Bundle.link": true,
+    "Bundle.meta": true,
+    "Bundle.signature": true,
+    "Bundle.total": true,
+    "Bundle.type": true,
+    "CapabilityStatement.acceptUnknown": true,
+    "CapabilityStatement.contact": true,
+    "CapabilityStatement.date": true,
+    "CapabilityStatement.document": true,
+    "CapabilityStatement.experimental": true,
+    "CapabilityStatement.fhirVersion": true,
+    "CapabilityStatement.format": true,
+    "CapabilityStatement.id": true,
+    "CapabilityStatement.implementation": true,
+    "CapabilityStatement.implementationGuide": true,
+    "CapabilityStatement.implicitRules": true,
+    "CapabilityStatement.instantiates": true,
+    "CapabilityStatement.jurisdiction": true,
+    "CapabilityStatement.kind": true,
+    "CapabilityStatement.messaging": true,
+    "CapabilityStatement.meta": true,
+    "CapabilityStatement.name": true,
+    "CapabilityStatement.patchFormat": true,
+    "CapabilityStatement.profile": true,
+    "CapabilityStatement.publisher": true,
+    "CapabilityStatement.rest": true,
+    "CapabilityStatement.software": true,
+    "CapabilityStatement.status": true,
+    "CapabilityStatement.title": true,
+    "CapabilityStatement.url": true,
+    "CapabilityStatement.useContext": true,
+    "CapabilityStatement.version": true,
+    "CarePlan.addresses": true,
+    "CarePlan.author": true,
+    "CarePlan.basedOn": true,
+    "CarePlan.category": true,
+    "CarePlan.context": true,
+    "CarePlan.definition": true,
+    "CarePlan.description": true,
+    "CarePlan.id": true,
+    "CarePlan.identifier": true,
+    "CarePlan.implicitRules": true,
+    "CarePlan.intent": true,
+    "CarePlan.meta": true,
+    "CarePlan.partOf": true,
+    "CarePlan.period": true,
+    "CarePlan.replaces": true,
+    "CarePlan.status": true,
+    "CarePlan.subject": true,
+    "CarePlan.title": true,
+    "CareTeam.category": true,
+    "CareTeam.context": true,
+    "CareTeam.id": true,
+    "CareTeam.identifier": true,
+    "CareTeam.implicitRules": true,
+    "CareTeam.managingOrganization": true,
+    "CareTeam.meta": true,
+    "CareTeam.name": true,
+    "CareTeam.period": true,
+    "CareTeam.status": true,
+    "CareTeam.subject": true,
+    "ChargeItem.account": true,
+    "ChargeItem.bodysite": true,
+    "ChargeItem.code": true,
+    "ChargeItem.context": true,
+    "ChargeItem.enteredDate": true,
+    "ChargeItem.enterer": true,
+    "ChargeItem.id": true,
+    "ChargeItem.identifier": true,
+    "ChargeItem.implicitRules": true,
+    "ChargeItem.meta": true,
+    "ChargeItem.occurrenceDateTime": true,
+    "ChargeItem.occurrencePeriod": true,
+    "ChargeItem.occurrenceTiming": true,
+    "ChargeItem.quantity": true,
+    "ChargeItem.status": true,
+    "ChargeItem.subject": true,
+    "Claim.id": true,
+    "Claim.implicitRules": true,
+    "Claim.meta": true,
+    "Claim.status": true,
+    "ClaimResponse.id": true,
+    "ClaimResponse.implicitRules": true,
+    "ClaimResponse.meta": true,
+    "ClaimResponse.status": true,
+    "ClinicalImpression.assessor": true,
+    "ClinicalImpression.code": true,
+    "ClinicalImpression.context": true,
+    "ClinicalImpression.date": true,
+    "ClinicalImpression.description": true,
+    "ClinicalImpression.effectiveDateTime": true,
+    "ClinicalImpression.effectivePeriod": true,
+    "ClinicalImpression.id": true,
+    "ClinicalImpression.identifier": true,
+    "ClinicalImpression.implicitRules": true,
+    "ClinicalImpression.meta": true,
+    "ClinicalImpression.problem": true,
+    "ClinicalImpression.status": true,
+    "ClinicalImpression.subject": true,
+    "CodeSystem.caseSensitive": true,
+    "CodeSystem.compositional": true,
+    "CodeSystem.contact": true,
+    "CodeSystem.content": true,
+    "CodeSystem.count": true,
+    "CodeSystem.date": true,
+    "CodeSystem.experimental": true,
+    "CodeSystem.filter": true,
+    "CodeSystem.hierarchyMeaning": true,
+    "CodeSystem.id": true,
+    "CodeSystem.identifier": true,
+    "CodeSystem.implicitRules": true,
+    "CodeSystem.jurisdiction": true,
+    "CodeSystem.meta": true,
+    "CodeSystem.name": true,
+    "CodeSystem.property": true,
+    "CodeSystem.publisher": true,
+    "CodeSystem.status": true,
+    "CodeSystem.title": true,
+    "CodeSystem.url": true,
+    "CodeSystem.useContext": true,
+    "CodeSystem.valueSet": true,
+    "CodeSystem.version": true,
+    "CodeSystem.versionNeeded": true,
+    "Communication.basedOn": true,
+    "Communication.context": true,
+    "Communication.definition": true,
+    "Communication.id": true,
+    "Communication.identifier": true,
+    "Communication.implicitRules": true,
+    "Communication.meta": true,
+    "Communication.notDone": true,
+    "Communication.notDoneReason": true,
+    "Communication.partOf": true,
+    "Communication.reasonCode": true,
+    "Communication.reasonReference": true,
+    "Communication.status": true,
+    "Communication.subject": true,
+    "CommunicationRequest.authoredOn": true,
+    "CommunicationRequest.basedOn": true,
+    "CommunicationRequest.context": true,
+    "CommunicationRequest.groupIdentifier": true,
+    "CommunicationRequest.id": true,
+    "CommunicationRequest.identifier": true,
+    "CommunicationRequest.implicitRules": true,
+    "CommunicationRequest.meta": true,
+    "CommunicationRequest.occurrenceDateTime": true,
+    "CommunicationRequest.occurrencePeriod": true,
+    "CommunicationRequest.priority": true,
+    "CommunicationRequest.reasonCode": true,
+    "CommunicationRequest.reasonReference": true,
+    "CommunicationRequest.replaces": true,
+    "CommunicationRequest.requester": true,
+    "CommunicationRequest.status": true,
+    "CompartmentDefinition.code": true,
+    "CompartmentDefinition.contact": true,
+    "CompartmentDefinition.date": true,
+    "CompartmentDefinition.experimental": true,
+    "CompartmentDefinition.id": true,
+    "CompartmentDefinition.implicitRules": true,
+    "CompartmentDefinition.jurisdiction": true,
+    "CompartmentDefinition.meta": true,
+    "CompartmentDefinition.name": true,
+    "CompartmentDefinition.publisher": true,
+    "CompartmentDefinition.resource": true,
+    "CompartmentDefinition.search": true,
+    "CompartmentDefinition.status": true,
+    "CompartmentDefinition.title": true,
+    "CompartmentDefinition.url": true,
+    "CompartmentDefinition.useContext": true,
+    "Composition.attester": true,
+    "Composition.author": true,
+    "Composition.class": true,
+    "Composition.confidentiality": true,
+    "Composition.custodian": true,
+    "Composition.date": true,
+    "Composition.encounter": true,
+    "Composition.event": true,
+    "Composition.id": true,
+    "Composition.identifier": true,
+    "Composition.implicitRules": true,
+    "Composition.meta": true,
+    "Composition.relatesTo": true,
+    "Composition.status": true,
+    "Composition.subject": true,
+    "Composition.title": true,
+    "Composition.type": true,
+    "ConceptMap.contact": true,
+    "ConceptMap.date": true,
+    "ConceptMap.experimental": true,
+    "ConceptMap.id": true,
+    "ConceptMap.identifier": true,
+    "ConceptMap.implicitRules": true,
+    "ConceptMap.jurisdiction": true,
+    "ConceptMap.meta": true,
+    "ConceptMap.name": true,
+    "ConceptMap.publisher": true,
+    "ConceptMap.sourceReference": true,
+    "ConceptMap.sourceUri": true,
+    "ConceptMap.status": true,
+    "ConceptMap.targetReference": true,
+    "ConceptMap.targetUri": true,
+    "ConceptMap.title": true,
+    "ConceptMap.url": true,
+    "ConceptMap.useContext": true,
+    "ConceptMap.version": true,
+    "Condition.assertedDate": true,
+    "Condition.asserter": true,
+    "Condition.bodySite": true,
+    "Condition.clinicalStatus": true,
+    "Condition.code": true,
+    "Condition.context": true,
+    "Condition.id": true,
+    "Condition.identifier": true,
+    "Condition.implicitRules": true,
+    "Condition.meta": true,
+    "Condition.onsetAge": true,
+    "Condition.onsetDateTime": true,
+    "Condition.onsetPeriod": true,
+    "Condition.onsetRange": true,
+    "Condition.onsetString": true,
+    "Condition.subject": true,
+    "Condition.verificationStatus": true,
+    "Consent.action": true,
+    "Consent.actor": true,
+    "Consent.category": true,
+    "Consent.consentingParty": true,
+    "Consent.data": true,
+    "Consent.dataPeriod": true,
+    "Consent.dateTime": true,
+    "Consent.except": true,
+    "Consent.id": true,
+    "Consent.identifier": true,
+    "Consent.implicitRules": true,
+    "Consent.meta": true,
+    "Consent.organization": true,
+    "Consent.patient": true,
+    "Consent.period": true,
+    "Consent.policyRule": true,
+    "Consent.purpose": true,
+    "Consent.securityLabel": true,
+    "Consent.sourceAttachment": true,
+    "Consent.sourceIdentifier": true,
+    "Consent.sourceReference": true,
+    "Consent.status": true,
+    "Contract.applies": true,
+    "Contract.id": true,
+    "Contract.identifier": true,
+    "Contract.implicitRules": true,
+    "Contract.issued": true,
+    "Contract.meta": true,
+    "Contract.securityLabel": true,
+    "Contract.status": true,
+    "Contract.subType": true,
+    "Contract.subject": true,
+    "Contract.topic": true,
+    "Contract.type": true,
+    "Coverage.beneficiary": true,
+    "Coverage.dependent": true,
+    "Coverage.id": true,
+    "Coverage.identifier": true,
+    "Coverage.implicitRules": true,
+    "Coverage.meta": true,
+    "Coverage.network": true,
+    "Coverage.order": true,
+    "Coverage.payor": true,
+    "Coverage.period": true,
+    "Coverage.policyHolder": true,
+    "Coverage.sequence": true,
+    "Coverage.status": true,
+    "Coverage.subscriber": true,
+    "Coverage.subscriberId": true,
+    "Coverage.type": true,
+    "DataElement.contact": true,
+    "DataElement.date": true,
+    "DataElement.element": true,
+    "DataElement.experimental": true,
+    "DataElement.id": true,
+    "DataElement.identifier": true,
+    "DataElement.implicitRules": true,
+    "DataElement.jurisdiction": true,
+    "DataElement.meta": true,
+    "DataElement.name": true,
+    "DataElement.publisher": true,
+    "DataElement.status": true,
+    "DataElement.stringency": true,
+    "DataElement.title": true,
+    "DataElement.url": true,
+    "DataElement.useContext": true,
+    "DataElement.version": true,
+    "DetectedIssue.author": true,
+    "DetectedIssue.category": true,
+    "DetectedIssue.date": true,
+    "DetectedIssue.id": true,
+    "DetectedIssue.identifier": true,
+    "DetectedIssue.implicated": true,
+    "DetectedIssue.implicitRules": true,
+    "DetectedIssue.meta": true,
+    "DetectedIssue.patient": true,
+    "DetectedIssue.severity": true,
+    "DetectedIssue.status": true,
+    "Device.id": true,
+    "Device.implicitRules": true,
+    "Device.meta": true,
+    "Device.safety": true,
+    "Device.status": true,
+    "Device.udi": true,
+    "DeviceComponent.id": true,
+    "DeviceComponent.identifier": true,
+    "DeviceComponent.implicitRules": true,
+    "DeviceComponent.languageCode": true,
+    "DeviceComponent.lastSystemChange": true,
+    "DeviceComponent.measurementPrinciple": true,
+    "DeviceComponent.meta": true,
+    "DeviceComponent.operationalStatus": true,
+    "DeviceComponent.parameterGroup": true,
+    "DeviceComponent.parent": true,
+    "DeviceComponent.productionSpecification": true,
+    "DeviceComponent.source": true,
+    "DeviceComponent.type": true,
+    "DeviceMetric.calibration": true,
+    "DeviceMetric.category": true,
+    "DeviceMetric.color": true,
+    "DeviceMetric.id": true,
+    "DeviceMetric.identifier": true,
+    "DeviceMetric.implicitRules": true,
+    "DeviceMetric.measurementPeriod": true,
+    "DeviceMetric.meta": true,
+    "DeviceMetric.operationalStatus": true,
+    "DeviceMetric.parent": true,
+    "DeviceMetric.source": true,
+    "DeviceMetric.type": true,
+    "DeviceMetric.unit": true,
+    "DeviceRequest.authoredOn": true,
+    "DeviceRequest.basedOn": true,
+    "DeviceRequest.codeCodeableConcept": true,
+    "DeviceRequest.codeReference": true,
+    "DeviceRequest.context": true,
+    "DeviceRequest.definition": true,
+    "DeviceRequest.groupIdentifier": true,
+    "DeviceRequest.id": true,
+    "DeviceRequest.identifier": true,
+    "DeviceRequest.implicitRules": true,
+    "DeviceRequest.intent": true,
+    "DeviceRequest.meta": true,
+    "DeviceRequest.occurrenceDateTime": true,
+    "DeviceRequest.occurrencePeriod": true,
+    "DeviceRequest.occurrenceTiming": true,
+    "DeviceRequest.performer": true,
+    "DeviceRequest.performerType": true,
+    "DeviceRequest.priorRequest": true,
+    "DeviceRequest.priority": true,
+    "DeviceRequest.reasonCode": true,
+    "DeviceRequest.reasonReference": true,
+    "DeviceRequest.requester": true,
+    "DeviceRequest.status": true,
+    "DeviceRequest.subject": true,
+    "DeviceUseStatement.id": true,
+    "DeviceUseStatement.implicitRules": true,
+    "DeviceUseStatement.meta": true,
+    "DeviceUseStatement.status": true,
+    "DiagnosticReport.category": true,
+    "DiagnosticReport.code": true,
+    "DiagnosticReport.context": true,
+    "DiagnosticReport.effectiveDateTime": true,
+    "DiagnosticReport.effectivePeriod": true,
+    "DiagnosticReport.id": true,
+    "DiagnosticReport.identifier": true,
+    "DiagnosticReport.image": true,
+    "DiagnosticReport.implicitRules": true,
+    "DiagnosticReport.issued": true,
+    "DiagnosticReport.meta": true,
+    "DiagnosticReport.performer": true,
+    "DiagnosticReport.status": true,
+    "DiagnosticReport.subject": true,
+    "DocumentManifest.author": true,
+    "DocumentManifest.content": true,
+    "DocumentManifest.created": true,
+    "DocumentManifest.description": true,
+    "DocumentManifest.id": true,
+    "DocumentManifest.identifier": true,
+    "DocumentManifest.implicitRules": true,
+    "DocumentManifest.masterIdentifier": true,
+    "DocumentManifest.meta": true,
+    "DocumentManifest.recipient": true,
+    "DocumentManifest.related": true,
+    "DocumentManifest.source": true,
+    "DocumentManifest.status": true,
+    "DocumentManifest.subject": true,
+    "DocumentManifest.type": true,
+    "DocumentReference.authenticator": true,
+    "DocumentReference.author": true,
+    "DocumentReference.class": true,
+    "DocumentReference.content": true,
+    "DocumentReference.context": true,
+    "DocumentReference.created": true,
+    "DocumentReference.custodian": true,
+    "DocumentReference.description": true,
+    "DocumentReference.docStatus": true,
+    "DocumentReference.id": true,
+    "DocumentReference.identifier": true,
+    "DocumentReference.implicitRules": true,
+    "DocumentReference.indexed": true,
+    "DocumentReference.masterIdentifier": true,
+    "DocumentReference.meta": true,
+    "DocumentReference.relatesTo": true,
+    "DocumentReference.securityLabel": true,
+    "DocumentReference.status": true,
+    "DocumentReference.subject": true,
+    "DocumentReference.type": true,
+    "DomainResource.id": true,
+    "DomainResource.implicitRules": true,
+    "DomainResource.meta": true,
+    "EligibilityRequest.id": true,
+    "EligibilityRequest.implicitRules": true,
+    "EligibilityRequest.meta": true,
+    "EligibilityRequest.status": true,
+    "EligibilityResponse.id": true,
+    "EligibilityResponse.implicitRules": true,
+    "EligibilityResponse.meta": true,
+    "EligibilityResponse.status": true,
+    "Encounter.appointment": true,
+    "Encounter.class": true,
+    "Encounter.diagnosis": true,
+    "Encounter.episodeOfCare": true,
+    "Encounter.id": true,
+    "Encounter.identifier": true,
+    "Encounter.implicitRules": true,
+    "Encounter.meta": true,
+    "Encounter.participant": true,
+    "Encounter.reason": true,
+    "Encounter.status": true,
+    "Encounter.subject": true,
+    "Encounter.type": true,
+    "Endpoint.address": true,
+    "Endpoint.connectionType": true,
+    "Endpoint.id": true,
+    "Endpoint.identifier": true,
+    "Endpoint.implicitRules": true,
+    "Endpoint.managingOrganization": true,
+    "Endpoint.meta": true,
+    "Endpoint.name": true,
+    "Endpoint.payloadMimeType": true,
+    "Endpoint.payloadType": true,
+    "Endpoint.period": true,
+    "Endpoint.status": true,
+    "EnrollmentRequest.id": true,
+    "EnrollmentRequest.implicitRules": true,
+    "EnrollmentRequest.meta": true,
+    "EnrollmentRequest.status": true,
+    "EnrollmentResponse.id": true,
+    "EnrollmentResponse.implicitRules": true,
+    "EnrollmentResponse.meta": true,
+    "EnrollmentResponse.status": true,
+    "EpisodeOfCare.diagnosis": true,
+    "EpisodeOfCare.id": true,
+    "EpisodeOfCare.implicitRules": true,
+    "EpisodeOfCare.managingOrganization": true,
+    "EpisodeOfCare.meta": true,
+    "EpisodeOfCare.patient": true,
+    "EpisodeOfCare.period": true,
+    "EpisodeOfCare.status": true,
+    "EpisodeOfCare.type": true,
+    "ExpansionProfile.activeOnly": true,
+    "ExpansionProfile.contact": true,
+    "ExpansionProfile.date": true,
+    "ExpansionProfile.designation": true,
+    "ExpansionProfile.displayLanguage": true,
+    "ExpansionProfile.excludeNested": true,
+    "ExpansionProfile.excludeNotForUI": true,
+    "ExpansionProfile.excludePostCoordinated": true,
+    "ExpansionProfile.excludedSystem": true,
+    "ExpansionProfile.experimental": true,
+    "ExpansionProfile.fixedVersion": true,
+    "ExpansionProfile.id": true,
+    "ExpansionProfile.identifier": true,
+    "ExpansionProfile.implicitRules": true,
+    "ExpansionProfile.includeDefinition": true,
+    "ExpansionProfile.includeDesignations": true,
+    "ExpansionProfile.jurisdiction": true,
+    "ExpansionProfile.limitedExpansion": true,
+    "ExpansionProfile.meta": true,
+    "ExpansionProfile.name": true,
+    "ExpansionProfile.publisher": true,
+    "ExpansionProfile.status": true,
+    "ExpansionProfile.url": true,
+    "ExpansionProfile.useContext": true,
+    "ExpansionProfile.version": true,
+    "ExplanationOfBenefit.id": true,
+    "ExplanationOfBenefit.implicitRules": true,
+    "ExplanationOfBenefit.meta": true,
+    "ExplanationOfBenefit.status": true,
+    "FamilyMemberHistory.ageAge": true,
+    "FamilyMemberHistory.ageRange": true,
+    "FamilyMemberHistory.ageString": true,
+    "FamilyMemberHistory.date": true,
+    "FamilyMemberHistory.deceasedAge": true,
+    "FamilyMemberHistory.deceasedBoolean": true,
+    "FamilyMemberHistory.deceasedDate": true,
+    "FamilyMemberHistory.deceasedRange": true,
+    "FamilyMemberHistory.deceasedString": true,
+    "FamilyMemberHistory.definition": true,
+    "FamilyMemberHistory.estimatedAge": true,
+    "FamilyMemberHistory.gender": true,
+    "FamilyMemberHistory.id": true,
+    "FamilyMemberHistory.identifier": true,
+    "FamilyMemberHistory.implicitRules": true,
+    "FamilyMemberHistory.meta": true,
+    "FamilyMemberHistory.name": true,
+    "FamilyMemberHistory.notDone": true,
+    "FamilyMemberHistory.notDoneReason": true,
+    "FamilyMemberHistory.patient": true,
+    "FamilyMemberHistory.reasonCode": true,
+    "FamilyMemberHistory.reasonReference": true,
+    "FamilyMemberHistory.relationship": true,
+    "FamilyMemberHistory.status": true,
+    "Flag.author": true,
+    "Flag.category": true,
+    "Flag.code": true,
+    "Flag.encounter": true,
+    "Flag.id": true,
+    "Flag.identifier": true,
+    "Flag.implicitRules": true,
+    "Flag.meta": true,
+    "Flag.period": true,
+    "Flag.status": true,
+    "Flag.subject": true,
+    "Goal.category": true,
+    "Goal.description": true,
+    "Goal.expressedBy": true,
+    "Goal.id": true,
+    "Goal.implicitRules": true,
+    "Goal.meta": true,
+    "Goal.priority": true,
+    "Goal.startCodeableConcept": true,
+    "Goal.startDate": true,
+    "Goal.status": true,
+    "Goal.statusDate": true,
+    "Goal.subject": true,
+    "GraphDefinition.contact": true,
+    "GraphDefinition.date": true,
+    "GraphDefinition.experimental": true,
+    "GraphDefinition.id": true,
+    "GraphDefinition.implicitRules": true,
+    "GraphDefinition.jurisdiction": true,
+    "GraphDefinition.meta": true,
+    "GraphDefinition.name": true,
+    "GraphDefinition.publisher": true,
+    "GraphDefinition.status": true,
+    "GraphDefinition.url": true,
+    "GraphDefinition.useContext": true,
+    "GraphDefinition.version": true,
+    "Group.active": true,
+    "Group.actual": true,
+    "Group.code": true,
+    "Group.id": true,
+    "Group.identifier": true,
+    "Group.implicitRules": true,
+    "Group.meta": true,
+    "Group.name": true,
+    "Group.quantity": true,
+    "Group.type": true,
+    "GuidanceResponse.id": true,
+    "GuidanceResponse.identifier": true,
+    "GuidanceResponse.implicitRules": true,
+    "GuidanceResponse.meta": true,
+    "GuidanceResponse.module": true,
+    "GuidanceResponse.requestId": true,
+    "GuidanceResponse.status": true,
+    "HealthcareService.active": true,
+    "HealthcareService.category": true,
+    "HealthcareService.comment": true,
+    "HealthcareService.id": true,
+    "HealthcareService.identifier": true,
+    "HealthcareService.implicitRules": true,
+    "HealthcareService.location": true,
+    "HealthcareService.meta": true,
+    "HealthcareService.name": true,
+    "HealthcareService.photo": true,
+    "HealthcareService.providedBy": true,
+    "HealthcareService.specialty": true,
+    "HealthcareService.type": true,
+    "ImagingManifest.author": true,
+    "ImagingManifest.authoringTime": true,
+    "ImagingManifest.description": true,
+    "ImagingManifest.id": true,
+    "ImagingManifest.identifier": true,
+    "ImagingManifest.implicitRules": true,
+    "ImagingManifest.meta": true,
+    "ImagingManifest.patient": true,
+    "ImagingManifest.study": true,
+    "ImagingStudy.accession": true,
+    "ImagingStudy.availability": true,
+    "ImagingStudy.basedOn": true,
+    "ImagingStudy.context": true,
+    "ImagingStudy.description": true,
+    "ImagingStudy.endpoint": true,
+    "ImagingStudy.id": true,
+    "ImagingStudy.identifier": true,
+    "ImagingStudy.implicitRules": true,
+    "ImagingStudy.interpreter": true,
+    "ImagingStudy.meta": true,
+    "ImagingStudy.modalityList": true,
+    "ImagingStudy.numberOfInstances": true,
+    "ImagingStudy.numberOfSeries": true,
+    "ImagingStudy.patient": true,
+    "ImagingStudy.procedureCode": true,
+    "ImagingStudy.procedureReference": true,
+    "ImagingStudy.reason": true,
+    "ImagingStudy.referrer": true,
+    "ImagingStudy.series": true,
+    "ImagingStudy.started": true,
+    "ImagingStudy.uid": true,
+    "Immunization.id": true,
+    "Immunization.implicitRules": true,
+    "Immunization.meta": true,
+    "Immunization.notGiven": true,
+    "Immunization.note": true,
+    "Immunization.practitioner": true,
+    "Immunization.status": true,
+    "ImmunizationRecommendation.id": true,
+    "ImmunizationRecommendation.identifier": true,
+    "ImmunizationRecommendation.implicitRules": true,
+    "ImmunizationRecommendation.meta": true,
+    "ImmunizationRecommendation.patient": true,
+    "ImmunizationRecommendation.recommendation": true,
+    "ImplementationGuide.contact": true,
+    "ImplementationGuide.date": true,
+    "ImplementationGuide.dependency": true,
+    "ImplementationGuide.experimental": true,
+    "ImplementationGuide.fhirVersion": true,
+    "ImplementationGuide.global": true,
+    "ImplementationGuide.id": true,
+    "ImplementationGuide.implicitRules": true,
+    "ImplementationGuide.jurisdiction": true,
+    "ImplementationGuide.meta": true,
+    "ImplementationGuide.name": true,
+    "ImplementationGuide.package": true,
+    "ImplementationGuide.page": true,
+    "ImplementationGuide.publisher": true,
+    "ImplementationGuide.status": true,
+    "ImplementationGuide.url": true,
+    "ImplementationGuide.useContext": true,
+    "ImplementationGuide.version": true,
+    "Library.contact": true,
+    "Library.date": true,
+    "Library.description": true,
+    "Library.effectivePeriod": true,
+    "Library.experimental": true,
+    "Library.id": true,
+    "Library.identifier": true,
+    "Library.implicitRules": true,
+    "Library.jurisdiction": true,
+    "Library.meta": true,
+    "Library.name": true,
+    "Library.publisher": true,
+    "Library.status": true,
+    "Library.title": true,
+    "Library.type": true,
+    "Library.url": true,
+    "Library.useContext": true,
+    "Library.version": true,
+    "Linkage.active": true,
+    "Linkage.author": true,
+    "Linkage.id": true,
+    "Linkage.implicitRules": true,
+    "Linkage.item": true,
+    "Linkage.meta": true,
+    "List.code": true,
+    "List.date": true,
+    "List.id": true,
+    "List.implicitRules": true,
+    "List.meta": true,
+    "List.mode": true,
+    "List.source": true,
+    "List.status": true,
+    "List.subject": true,
+    "List.title": true,
+    "Location.description": true,
+    "Location.id": true,
+    "Location.identifier": true,
+    "Location.implicitRules": true,
+    "Location.managingOrganization": true,
+    "Location.meta": true,
+    "Location.mode": true,
+    "Location.name": true,
+    "Location.operationalStatus": true,
+    "Location.physicalType": true,
+    "Location.status": true,
+    "Location.type": true,
+    "Measure.clinicalRecommendationStatement": true,
+    "Measure.compositeScoring": true,
+    "Measure.contact": true,
+    "Measure.date": true,
+    "Measure.definition": true,
+    "Measure.description": true,
+    "Measure.disclaimer": true,
+    "Measure.effectivePeriod": true,
+    "Measure.experimental": true,
+    "Measure.guidance": true,
+    "Measure.id": true,
+    "Measure.identifier": true,
+    "Measure.implicitRules": true,
+    "Measure.improvementNotation": true,
+    "Measure.jurisdiction": true,
+    "Measure.meta": true,
+    "Measure.name": true,
+    "Measure.publisher": true,
+    "Measure.rateAggregation": true,
+    "Measure.rationale": true,
+    "Measure.riskAdjustment": true,
+    "Measure.scoring": true,
+    "Measure.set": true,
+    "Measure.status": true,
+    "Measure.title": true,
+    "Measure.type": true,
+    "Measure.url": true,
+    "Measure.useContext": true,
+    "Measure.version": true,
+    "MeasureReport.date": true,
+    "MeasureReport.id": true,
+    "MeasureReport.identifier": true,
+    "MeasureReport.implicitRules": true,
+    "MeasureReport.measure": true,
+    "MeasureReport.meta": true,
+    "MeasureReport.patient": true,
+    "MeasureReport.period": true,
+    "MeasureReport.reportingOrganization": true,
+    "MeasureReport.status": true,
+    "MeasureReport.type": true,
+    "Media.basedOn": true,
+    "Media.bodySite": true,
+    "Media.context": true,
+    "Media.device": true,
+    "Media.duration": true,
+    "Media.frames": true,
+    "Media.height": true,
+    "Media.id": true,
+    "Media.identifier": true,
+    "Media.implicitRules": true,
+    "Media.meta": true,
+    "Media.occurrenceDateTime": true,
+    "Media.occurrencePeriod": true,
+    "Media.operator": true,
+    "Media.reasonCode": true,
+    "Media.subject": true,
+    "Media.subtype": true,
+    "Media.type": true,
+    "Media.view": true,
+    "Media.width": true,
+    "Medication.code": true,
+    "Medication.id": true,
+    "Medication.implicitRules": true,
+    "Medication.isBrand": true,
+    "Medication.isOverTheCounter": true,
+    "Medication.manufacturer": true,
+    "Medication.meta": true,
+    "Medication.status": true,
+    "MedicationAdministration.definition": true,
+    "MedicationAdministration.effectiveDateTime": true,
+    "MedicationAdministration.effectivePeriod": true,
+    "MedicationAdministration.id": true,
+    "MedicationAdministration.implicitRules": true,
+    "MedicationAdministration.medicationCodeableConcept": true,
+    "MedicationAdministration.medicationReference": true,
+    "MedicationAdministration.meta": true,
+    "MedicationAdministration.notGiven": true,
+    "MedicationAdministration.partOf": true,
+    "MedicationAdministration.performer": true,
+    "MedicationAdministration.status": true,
+    "MedicationAdministration.subject": true,
+    "MedicationDispense.id": true,
+    "MedicationDispense.implicitRules": true,
+    "MedicationDispense.medicationCodeableConcept": true,
+    "MedicationDispense.medicationReference": true,
+    "MedicationDispense.meta": true,
+    "MedicationDispense.status": true,
+    "MedicationDispense.subject": true,
+    "MedicationDispense.whenPrepared": true,
+    "MedicationRequest.authoredOn": true,
+    "MedicationRequest.basedOn": true,
+    "MedicationRequest.definition": true,
+    "MedicationRequest.groupIdentifier": true,
+    "MedicationRequest.id": true,
+    "MedicationRequest.implicitRules": true,
+    "MedicationRequest.intent": true,
+    "MedicationRequest.medicationCodeableConcept": true,
+    "MedicationRequest.medicationReference": true,
+    "MedicationRequest.meta": true,
+    "MedicationRequest.priority": true,
+    "MedicationRequest.requester": true,
+    "MedicationRequest.status": true,
+    "MedicationRequest.subject": true,
+    "MedicationStatement.basedOn": true,
+    "MedicationStatement.category": true,
+    "MedicationStatement.context": true,
+    "MedicationStatement.dateAsserted": true,
+    "MedicationStatement.effectiveDateTime": true,
+    "MedicationStatement.effectivePeriod": true,
+    "MedicationStatement.id": true,
+    "MedicationStatement.identifier": true,
+    "MedicationStatement.implicitRules": true,
+    "MedicationStatement.medicationCodeableConcept": true,
+    "MedicationStatement.medicationReference": true,
+    "MedicationStatement.meta": true,
+    "MedicationStatement.partOf": true,
+    "MedicationStatement.status": true,
+    "MedicationStatement.subject": true,
+    "MedicationStatement.taken": true,
+    "MessageDefinition.base": true,
+    "MessageDefinition.category": true,
+    "MessageDefinition.contact": true,
+    "MessageDefinition.date": true,
+    "MessageDefinition.description": true,
+    "MessageDefinition.event": true,
+    "MessageDefinition.experimental": true,
+    "MessageDefinition.focus": true,
+    "MessageDefinition.id": true,
+    "MessageDefinition.identifier": true,
+    "MessageDefinition.implicitRules": true,
+    "MessageDefinition.jurisdiction": true,
+    "MessageDefinition.meta": true,
+    "MessageDefinition.name": true,
+    "MessageDefinition.parent": true,
+    "MessageDefinition.publisher": true,
+    "MessageDefinition.purpose": true,
+    "MessageDefinition.replaces": true,
+    "MessageDefinition.status": true,
+    "MessageDefinition.title": true,
+    "MessageDefinition.url": true,
+    "MessageDefinition.useContext": true,
+    "MessageDefinition.version": true,
+    "MessageHeader.author": true,
+    "MessageHeader.destination": true,
+    "MessageHeader.enterer": true,
+    "MessageHeader.event": true,
+    "MessageHeader.focus": true,
+    "MessageHeader.id": true,
+    "MessageHeader.implicitRules": true,
+    "MessageHeader.meta": true,
+    "MessageHeader.reason": true,
+    "MessageHeader.receiver": true,
+    "MessageHeader.response": true,
+    "MessageHeader.responsible": true,
+    "MessageHeader.sender": true,
+    "MessageHeader.source": true,
+    "MessageHeader.timestamp": true,
+    "MetadataResource.contact": true,
+    "MetadataResource.date": true,
+    "MetadataResource.experimental": true,
+    "MetadataResource.id": true,
+    "MetadataResource.implicitRules": true,
+    "MetadataResource.jurisdiction": true,
+    "MetadataResource.meta": true,
+    "MetadataResource.name": true,
+    "MetadataResource.publisher": true,
+    "MetadataResource.status": true,
+    "MetadataResource.title": true,
+    "MetadataResource.url": true,
+    "MetadataResource.useContext": true,
+    "MetadataResource.version": true,
+    "NamingSystem.contact": true,
+    "NamingSystem.date": true,
+    "NamingSystem.id": true,
+    "NamingSystem.implicitRules": true,
+    "NamingSystem.jurisdiction": true,
+    "NamingSystem.meta": true,
+    "NamingSystem.name": true,
+    "NamingSystem.publisher": true,
+    "NamingSystem.status": true,
+    "NamingSystem.useContext": true,
+    "NutritionOrder.dateTime": true,
+    "NutritionOrder.id": true,
+    "NutritionOrder.implicitRules": true,
+    "NutritionOrder.meta": true,
+    "NutritionOrder.orderer": true,
+    "NutritionOrder.patient": true,
+    "NutritionOrder.status": true,
+    "Observation.basedOn": true,
+    "Observation.code": true,
+    "Observation.component": true,
+    "Observation.effectiveDateTime": true,
+    "Observation.effectivePeriod": true,
+    "Observation.id": true,
+    "Observation.identifier": true,
+    "Observation.implicitRules": true,
+    "Observation.issued": true,
+    "Observation.meta": true,
+    "Observation.performer": true,
+    "Observation.related": true,
+    "Observation.status": true,
+    "Observation.subject": true,
+    "Observation.valueAttachment": true,
+    "Observation.valueBoolean": true,
+    "Observation.valueCodeableConcept": true,
+    "Observation.valueDateTime": true,
+    "Observation.valuePeriod": true,
+    "Observation.valueQuantity": true,
+    "Observation.valueRange": true,
+    "Observation.valueRatio": true,
+    "Observation.valueSampledData": true,
+    "Observation.valueString": true,
+    "Observation.valueTime": true,
+    "OperationDefinition.base": true,
+    "OperationDefinition.code": true,
+    "OperationDefinition.contact": true,
+    "OperationDefinition.date": true,
+    "OperationDefinition.experimental": true,
+    "OperationDefinition.id": true,
+    "OperationDefinition.idempotent": true,
+    "OperationDefinition.implicitRules": true,
+    "OperationDefinition.instance": true,
+    "OperationDefinition.jurisdiction": true,
+    "OperationDefinition.meta": true,
+    "OperationDefinition.name": true,
+    "OperationDefinition.publisher": true,
+    "OperationDefinition.resource": true,
+    "OperationDefinition.status": true,
+    "OperationDefinition.system": true,
+    "OperationDefinition.type": true,
+    "OperationDefinition.url": true,
+    "OperationDefinition.useContext": true,
+    "OperationDefinition.version": true,
+    "OperationOutcome.id": true,
+    "OperationOutcome.implicitRules": true,
+    "OperationOutcome.issue": true,
+    "OperationOutcome.meta": true,
+    "Organization.active": true,
+    "Organization.id": true,
+    "Organization.identifier": true,
+    "Organization.implicitRules": true,
+    "Organization.meta": true,
+    "Organization.name": true,
+    "Organization.partOf": true,
+    "Organization.type": true,
+    "Parameters.id": true,
+    "Parameters.implicitRules": true,
+    "Parameters.meta": true,
+    "Parameters.parameter": true,
+    "Patient.active": true,
+    "Patient.address": true,
+    "Patient.animal": true,
+    "Patient.birthDate": true,
+    "Patient.deceasedBoolean": true,
+    "Patient.deceasedDateTime": true,
+    "Patient.gender": true,
+    "Patient.id": true,
+    "Patient.identifier": true,
+    "Patient.implicitRules": true,
+    "Patient.link": true,
+    "Patient.managingOrganization": true,
+    "Patient.meta": true,
+    "Patient.name": true,
+    "Patient.telecom": true,
+    "PaymentNotice.id": true,
+    "PaymentNotice.implicitRules": true,
+    "PaymentNotice.meta": true,
+    "PaymentNotice.status": true,
+    "PaymentReconciliation.id": true,
+    "PaymentReconciliation.implicitRules": true,
+    "PaymentReconciliation.meta": true,
+    "PaymentReconciliation.status": true,
+    "Person.active": true,
+    "Person.birthDate": true,
+    "Person.gender": true,
+    "Person.id": true,
+    "Person.implicitRules": true,
+    "Person.managingOrganization": true,
+    "Person.meta": true,
+    "Person.name": true,
+    "Person.telecom": true,
+    "PlanDefinition.contact": true,
+    "PlanDefinition.date": true,
+    "PlanDefinition.description": true,
+    "PlanDefinition.effectivePeriod": true,
+    "PlanDefinition.experimental": true,
+    "PlanDefinition.id": true,
+    "PlanDefinition.identifier": true,
+    "PlanDefinition.implicitRules": true,
+    "PlanDefinition.jurisdiction": true,
+    "PlanDefinition.meta": true,
+    "PlanDefinition.name": true,
+    "PlanDefinition.publisher": true,
+    "PlanDefinition.status": true,
+    "PlanDefinition.title": true,
+    "PlanDefinition.type": true,
+    "PlanDefinition.url": true,
+    "PlanDefinition.useContext": true,
+    "PlanDefinition.version": true,
+    "Practitioner.active": true,
+    "Practitioner.address": true,
+    "Practitioner.birthDate": true,
+    "Practitioner.gender": true,
+    "Practitioner.id": true,
+    "Practitioner.identifier": true,
+    "Practitioner.implicitRules": true,
+    "Practitioner.meta": true,
+    "Practitioner.name": true,
+    "Practitioner.telecom": true,
+    "PractitionerRole.active": true,
+    "PractitionerRole.code": true,
+    "PractitionerRole.id": true,
+    "PractitionerRole.identifier": true,
+    "PractitionerRole.implicitRules": true,
+    "PractitionerRole.location": true,
+    "PractitionerRole.meta": true,
+    "PractitionerRole.organization": true,
+    "PractitionerRole.period": true,
+    "PractitionerRole.practitioner": true,
+    "PractitionerRole.specialty": true,
+    "PractitionerRole.telecom": true,
+    "Procedure.basedOn": true,
+    "Procedure.bodySite": true,
+    "Procedure.category": true,
+    "Procedure.code": true,
+    "Procedure.context": true,
+    "Procedure.definition": true,
+    "Procedure.id": true,
+    "Procedure.identifier": true,
+    "Procedure.implicitRules": true,
+    "Procedure.location": true,
+    "Procedure.meta": true,
+    "Procedure.notDone": true,
+    "Procedure.notDoneReason": true,
+    "Procedure.outcome": true,
+    "Procedure.partOf": true,
+    "Procedure.performedDateTime": true,
+    "Procedure.performedPeriod": true,
+    "Procedure.performer": true,
+    "Procedure.reasonCode": true,
+    "Procedure.reasonReference": true,
+    "Procedure.status": true,
+    "Procedure.subject": true,
+    "ProcedureRequest.asNeededBoolean": true,
+    "ProcedureRequest.asNeededCodeableConcept": true,
+    "ProcedureRequest.authoredOn": true,
+    "ProcedureRequest.basedOn": true,
+    "ProcedureRequest.bodySite": true,
+    "ProcedureRequest.category": true,
+    "ProcedureRequest.code": true,
+    "ProcedureRequest.context": true,
+    "ProcedureRequest.definition": true,
+    "ProcedureRequest.doNotPerform": true,
+    "ProcedureRequest.id": true,
+    "ProcedureRequest.identifier": true,
+    "ProcedureRequest.implicitRules": true,
+    "ProcedureRequest.intent": true,
+    "ProcedureRequest.meta": true,
+    "ProcedureRequest.occurrenceDateTime": true,
+    "ProcedureRequest.occurrencePeriod": true,
+    "ProcedureRequest.occurrenceTiming": true,
+    "ProcedureRequest.performer": true,
+    "ProcedureRequest.performerType": true,
+    "ProcedureRequest.priority": true,
+    "ProcedureRequest.reasonCode": true,
+    "ProcedureRequest.reasonReference": true,
+    "ProcedureRequest.replaces": true,
+    "ProcedureRequest.requester": true,
+    "ProcedureRequest.requisition": true,
+    "ProcedureRequest.specimen": true,
+    "ProcedureRequest.status": true,
+    "ProcedureRequest.subject": true,
+    "ProcessRequest.id": true,
+    "ProcessRequest.implicitRules": true,
+    "ProcessRequest.meta": true,
+    "ProcessRequest.status": true,
+    "ProcessResponse.id": true,
+    "ProcessResponse.implicitRules": true,
+    "ProcessResponse.meta": true,
+    "ProcessResponse.status": true,
+    "Provenance.id": true,
+    "Provenance.implicitRules": true,
+    "Provenance.meta": true,
+    "Provenance.recorded": true,
+    "Provenance.target": true,
+    "Questionnaire.code": true,
+    "Questionnaire.contact": true,
+    "Questionnaire.date": true,
+    "Questionnaire.effectivePeriod": true,
+    "Questionnaire.experimental": true,
+    "Questionnaire.id": true,
+    "Questionnaire.identifier": true,
+    "Questionnaire.implicitRules": true,
+    "Questionnaire.jurisdiction": true,
+    "Questionnaire.meta": true,
+    "Questionnaire.name": true,
+    "Questionnaire.publisher": true,
+    "Questionnaire.status": true,
+    "Questionnaire.subjectType": true,
+    "Questionnaire.title": true,
+    "Questionnaire.url": true,
+    "Questionnaire.useContext": true,
+    "Questionnaire.version": true,
+    "QuestionnaireResponse.author": true,
+    "QuestionnaireResponse.authored": true,
+    "QuestionnaireResponse.basedOn": true,
+    "QuestionnaireResponse.context": true,
+    "QuestionnaireResponse.id": true,
+    "QuestionnaireResponse.identifier": true,
+    "QuestionnaireResponse.implicitRules": true,
+    "QuestionnaireResponse.meta": true,
+    "QuestionnaireResponse.parent": true,
+    "QuestionnaireResponse.questionnaire": true,
+    "QuestionnaireResponse.source": true,
+    "QuestionnaireResponse.status": true,
+    "QuestionnaireResponse.subject": true,
+    "ReferralRequest.authoredOn": true,
+    "ReferralRequest.basedOn": true,
+    "ReferralRequest.context": true,
+    "ReferralRequest.definition": true,
+    "ReferralRequest.groupIdentifier": true,
+    "ReferralRequest.id": true,
+    "ReferralRequest.identifier": true,
+    "ReferralRequest.implicitRules": true,
+    "ReferralRequest.intent": true,
+    "ReferralRequest.meta": true,
+    "ReferralRequest.occurrenceDateTime": true,
+    "ReferralRequest.occurrencePeriod": true,
+    "ReferralRequest.priority": true,
+    "ReferralRequest.reasonCode": true,
+    "ReferralRequest.reasonReference": true,
+    "ReferralRequest.recipient": true,
+    "ReferralRequest.replaces": true,
+    "ReferralRequest.requester": true,
+    "ReferralRequest.serviceRequested": true,
+    "ReferralRequest.status": true,
+    "ReferralRequest.subject": true,
+    "ReferralRequest.type": true,
+    "RelatedPerson.active": true,
+    "RelatedPerson.address": true,
+    "RelatedPerson.birthDate": true,
+    "RelatedPerson.gender": true,
+    "RelatedPerson.id": true,
+    "RelatedPerson.identifier": true,
+    "RelatedPerson.implicitRules": true,
+    "RelatedPerson.meta": true,
+    "RelatedPerson.name": true,
+    "RelatedPerson.patient": true,
+    "RelatedPerson.relationship": true,
+    "RelatedPerson.telecom": true,
+    "RequestGroup.groupIdentifier": true,
+    "RequestGroup.id": true,
+    "RequestGroup.identifier": true,
+    "RequestGroup.implicitRules": true,
+    "RequestGroup.intent": true,
+    "RequestGroup.meta": true,
+    "RequestGroup.priority": true,
+    "RequestGroup.status": true,
+    "ResearchStudy.category": true,
+    "ResearchStudy.contact": true,
+    "ResearchStudy.enrollment": true,
+    "ResearchStudy.focus": true,
+    "ResearchStudy.id": true,
+    "ResearchStudy.identifier": true,
+    "ResearchStudy.implicitRules": true,
+    "ResearchStudy.jurisdiction": true,
+    "ResearchStudy.keyword": true,
+    "ResearchStudy.meta": true,
+    "ResearchStudy.partOf": true,
+    "ResearchStudy.period": true,
+    "ResearchStudy.principalInvestigator": true,
+    "ResearchStudy.protocol": true,
+    "ResearchStudy.reasonStopped": true,
+    "ResearchStudy.site": true,
+    "ResearchStudy.sponsor": true,
+    "ResearchStudy.status": true,
+    "ResearchStudy.title": true,
+    "ResearchSubject.id": true,
+    "ResearchSubject.identifier": true,
+    "ResearchSubject.implicitRules": true,
+    "ResearchSubject.individual": true,
+    "ResearchSubject.meta": true,
+    "ResearchSubject.period": true,
+    "ResearchSubject.status": true,
+    "ResearchSubject.study": true,
+    "Resource.id": true,
+    "Resource.implicitRules": true,
+    "Resource.meta": true,
+    "RiskAssessment.code": true,
+    "RiskAssessment.condition": true,
+    "RiskAssessment.context": true,
+    "RiskAssessment.id": true,
+    "RiskAssessment.identifier": true,
+    "RiskAssessment.implicitRules": true,
+    "RiskAssessment.meta": true,
+    "RiskAssessment.method": true,
+    "RiskAssessment.occurrenceDateTime": true,
+    "RiskAssessment.occurrencePeriod": true,
+    "RiskAssessment.performer": true,
+    "RiskAssessment.subject": true,
+    "Schedule.active": true,
+    "Schedule.actor": true,
+    "Schedule.id": true,
+    "Schedule.identifier": true,
+    "Schedule.implicitRules": true,
+    "Schedule.meta": true,
+    "Schedule.planningHorizon": true,
+    "Schedule.serviceCategory": true,
+    "Schedule.serviceType": true,
+    "Schedule.specialty": true,
+    "SearchParameter.base": true,
+    "SearchParameter.code": true,
+    "SearchParameter.contact": true,
+    "SearchParameter.date": true,
+    "SearchParameter.description": true,
+    "SearchParameter.experimental": true,
+    "SearchParameter.id": true,
+    "SearchParameter.implicitRules": true,
+    "SearchParameter.jurisdiction": true,
+    "SearchParameter.meta": true,
+    "SearchParameter.name": true,
+    "SearchParameter.publisher": true,
+    "SearchParameter.status": true,
+    "SearchParameter.type": true,
+    "SearchParameter.url": true,
+    "SearchParameter.useContext": true,
+    "SearchParameter.version": true,
+    "Sequence.coordinateSystem": true,
+    "Sequence.device": true,
+    "Sequence.id": true,
+    "Sequence.identifier": true,
+    "Sequence.implicitRules": true,
+    "Sequence.meta": true,
+    "Sequence.observedSeq": true,
+    "Sequence.patient": true,
+    "Sequence.performer": true,
+    "Sequence.pointer": true,
+    "Sequence.quality": true,
+    "Sequence.quantity": true,
+    "Sequence.readCoverage": true,
+    "Sequence.referenceSeq": true,
+    "Sequence.repository": true,
+    "Sequence.specimen": true,
+    "Sequence.type": true,
+    "Sequence.variant": true,
+    "ServiceDefinition.contact": true,
+    "ServiceDefinition.date": true,
+    "ServiceDefinition.effectivePeriod": true,
+    "ServiceDefinition.experimental": true,
+    "ServiceDefinition.id": true,
+    "ServiceDefinition.identifier": true,
+    "ServiceDefinition.implicitRules": true,
+    "ServiceDefinition.jurisdiction": true,
+    "ServiceDefinition.meta": true,
+    "ServiceDefinition.name": true,
+    "ServiceDefinition.publisher": true,
+    "ServiceDefinition.status": true,
+    "ServiceDefinition.title": true,
+    "ServiceDefinition.url": true,
+    "ServiceDefinition.useContext": true,
+    "ServiceDefinition.version": true,
+    "Slot.appointmentType": true,
+    "Slot.end": true,
+    "Slot.id": true,
+    "Slot.identifier": true,
+    "Slot.implicitRules": true,
+    "Slot.meta": true,
+    "Slot.schedule": true,
+    "Slot.serviceCategory": true,
+    "Slot.serviceType": true,
+    "Slot.specialty": true,
+    "Slot.start": true,
+    "Slot.status": true,
+    "Specimen.accessionIdentifier": true,
+    "Specimen.id": true,
+    "Specimen.identifier": true,
+    "Specimen.implicitRules": true,
+    "Specimen.meta": true,
+    "Specimen.receivedTime": true,
+    "Specimen.status": true,
+    "Specimen.subject": true,
+    "Specimen.type": true,
+    "StructureDefinition.abstract": true,
+    "StructureDefinition.baseDefinition": true,
+    "StructureDefinition.contact": true,
+    "StructureDefinition.context": true,
+    "StructureDefinition.contextInvariant": true,
+    "StructureDefinition.contextType": true,
+    "StructureDefinition.date": true,
+    "StructureDefinition.derivation": true,
+    "StructureDefinition.experimental": true,
+    "StructureDefinition.fhirVersion": true,
+    "StructureDefinition.id": true,
+    "StructureDefinition.identifier": true,
+    "StructureDefinition.implicitRules": true,
+    "StructureDefinition.jurisdiction": true,
+    "StructureDefinition.keyword": true,
+    "StructureDefinition.kind": true,
+    "StructureDefinition.meta": true,
+    "StructureDefinition.name": true,
+    "StructureDefinition.publisher": true,
+    "StructureDefinition.status": true,
+    "StructureDefinition.title": true,
+    "StructureDefinition.type": true,
+    "StructureDefinition.url": true,
+    "StructureDefinition.useContext": true,
+    "StructureDefinition.version": true,
+    "StructureMap.contact": true,
+    "StructureMap.date": true,
+    "StructureMap.experimental": true,
+    "StructureMap.group": true,
+    "StructureMap.id": true,
+    "StructureMap.identifier": true,
+    "StructureMap.implicitRules": true,
+    "StructureMap.import": true,
+    "StructureMap.jurisdiction": true,
+    "StructureMap.meta": true,
+    "StructureMap.name": true,
+    "StructureMap.publisher": true,
+    "StructureMap.status": true,
+    "StructureMap.structure": true,
+    "StructureMap.title": true,
+    "StructureMap.url": true,
+    "StructureMap.useContext": true,
+    "StructureMap.version": true,
+    "Subscription.channel": true,
+    "Subscription.contact": true,
+    "Subscription.criteria": true,
+    "Subscription.end": true,
+    "Subscription.error": true,
+    "Subscription.id": true,
+    "Subscription.implicitRules": true,
+    "Subscription.meta": true,
+    "Subscription.reason": true,
+    "Subscription.status": true,
+    "Subscription.tag": true,
+    "Substance.category": true,
+    "Substance.code": true,
+    "Substance.description": true,
+    "Substance.id": true,
+    "Substance.identifier": true,
+    "Substance.implicitRules": true,
+    "Substance.ingredient": true,
+    "Substance.instance": true,
+    "Substance.meta": true,
+    "Substance.status": true,
+    "SupplyDelivery.basedOn": true,
+    "SupplyDelivery.id": true,
+    "SupplyDelivery.implicitRules": true,
+    "SupplyDelivery.meta": true,
+    "SupplyDelivery.occurrenceDateTime": true,
+    "SupplyDelivery.occurrencePeriod": true,
+    "SupplyDelivery.occurrenceTiming": true,
+    "SupplyDelivery.partOf": true,
+    "SupplyDelivery.status": true,
+    "SupplyRequest.authoredOn": true,
+    "SupplyRequest.category": true,
+    "SupplyRequest.id": true,
+    "SupplyRequest.identifier": true,
+    "SupplyRequest.implicitRules": true,
+    "SupplyRequest.meta": true,
+    "SupplyRequest.occurrenceDateTime": true,
+    "SupplyRequest.occurrencePeriod": true,
+    "SupplyRequest.occurrenceTiming": true,
+    "SupplyRequest.orderedItem": true,
+    "SupplyRequest.priority": true,
+    "SupplyRequest.requester": true,
+    "SupplyRequest.status": true,
+    "SupplyRequest.supplier": true,
+    "Task.basedOn": true,
+    "Task.businessStatus": true,
+    "Task.code": true,
+    "Task.context": true,
+    "Task.definitionReference": true,
+    "Task.definitionUri": true,
+    "Task.description": true,
+    "Task.executionPeriod": true,
+    "Task.focus": true,
+    "Task.for": true,
+    "Task.groupIdentifier": true,
+    "Task.id": true,
+    "Task.implicitRules": true,
+    "Task.intent": true,
+    "Task.lastModified": true,
+    "Task.meta": true,
+    "Task.owner": true,
+    "Task.partOf": true,
+    "Task.requester": true,
+    "Task.status": true,
+    "Task.statusReason": true,
+    "TestReport.id": true,
+    "TestReport.identifier": true,
+    "TestReport.implicitRules": true,
+    "TestReport.issued": true,
+    "TestReport.meta": true,
+    "TestReport.name": true,
+    "TestReport.result": true,
+    "TestReport.score": true,
+    "TestReport.status": true,
+    "TestReport.testScript": true,
+    "TestReport.tester": true,
+    "TestScript.contact": true,
+    "TestScript.date": true,
+    "TestScript.experimental": true,
+    "TestScript.id": true,
+    "TestScript.identifier": true,
+    "TestScript.implicitRules": true,
+    "TestScript.jurisdiction": true,
+    "TestScript.meta": true,
+    "TestScript.name": true,
+    "TestScript.publisher": true,
+    "TestScript.status": true,
+    "TestScript.title": true,
+    "TestScript.url": true,
+    "TestScript.useContext": true,
+    "TestScript.version": true,
+    "ValueSet.contact": true,
+    "ValueSet.date": true,
+    "ValueSet.experimental": true,
+    "ValueSet.extensible": true,
+    "ValueSet.id": true,
+    "ValueSet.identifier": true,
+    "ValueSet.immutable": true,
+    "ValueSet.implicitRules": true,
+    "ValueSet.jurisdiction": true,
+    "ValueSet.meta": true,
+    "ValueSet.name": true,
+    "ValueSet.publisher": true,
+    "ValueSet.status": true,
+    "ValueSet.title": true,
+    "ValueSet.url": true,
+    "ValueSet.useContext": true,
+    "ValueSet.version": true,
+    "VisionPrescription.id": true,
+    "VisionPrescription.implicitRules": true,
+    "VisionPrescription.meta": true,
+    "VisionPrescription.status": true,
+}
+
+var fhirMandatoryElements = map[string]bool {
+    "ActivityDefinition.status": true,
+    "AllergyIntolerance.patient": true,
+    "AllergyIntolerance.verificationStatus": true,
+    "Appointment.participant": true,
+    "Appointment.status": true,
+    "AppointmentResponse.appointment": true,
+    "AppointmentResponse.participantStatus": true,
+    "AuditEvent.agent": true,
+    "AuditEvent.recorded": true,
+    "AuditEvent.source": true,
+    "AuditEvent.type": true,
+    "Basic.code": true,
+    "Binary.content": true,
+    "Binary.contentType": true,
+    "BodySite.patient": true,
+    "Bundle.type": true,
+    "CapabilityStatement.acceptUnknown": true,
+    "CapabilityStatement.date": true,
+    "CapabilityStatement.fhirVersion": true,
+    "CapabilityStatement.format": true,
+    "CapabilityStatement.kind": true,
+    "CapabilityStatement.status": true,
+    "CarePlan.intent": true,
+    "CarePlan.status": true,
+    "CarePlan.subject": true,
+    "ChargeItem.code": true,
+    "ChargeItem.status": true,
+    "ChargeItem.subject": true,
+    "ClinicalImpression.status": true,
+    "ClinicalImpression.subject": true,
+    "CodeSystem.content": true,
+    "CodeSystem.status": true,
+    "Communication.status": true,
+    "CommunicationRequest.status": true,
+    "CompartmentDefinition.code": true,
+    "CompartmentDefinition.name": true,
+    "CompartmentDefinition.search": true,
+    "CompartmentDefinition.status": true,
+    "CompartmentDefinition.url": true,
+    "Composition.author": true,
+    "Composition.date": true,
+    "Composition.status": true,
+    "Composition.subject": true,
+    "Composition.title": true,
+    "Composition.type": true,
+    "ConceptMap.status": true,
+    "Condition.subject": true,
+    "Consent.patient": true,
+    "Consent.status": true,
+    "DataElement.element": true,
+    "DataElement.status": true,
+    "DetectedIssue.status": true,
+    "DeviceComponent.identifier": true,
+    "DeviceComponent.type": true,
+    "DeviceMetric.category": true,
+    "DeviceMetric.identifier": true,
+    "DeviceMetric.type": true,
+    "DeviceRequest.codeCodeableConcept": true,
+    "DeviceRequest.codeReference": true,
+    "DeviceRequest.intent": true,
+    "DeviceRequest.subject": true,
+    "DeviceUseStatement.device": true,
+    "DeviceUseStatement.status": true,
+    "DeviceUseStatement.subject": true,
+    "DiagnosticReport.code": true,
+    "DiagnosticReport.status": true,
+    "DocumentManifest.content": true,
+    "DocumentManifest.status": true,
+    "DocumentReference.content": true,
+    "DocumentReference.indexed": true,
+    "DocumentReference.status": true,
+    "DocumentReference.type": true,
+    "Encounter.status": true,
+    "Endpoint.address": true,
+    "Endpoint.connectionType": true,
+    "Endpoint.payloadType": true,
+    "Endpoint.status": true,
+    "EpisodeOfCare.patient": true,
+    "EpisodeOfCare.status": true,
+    "ExpansionProfile.status": true,
+    "FamilyMemberHistory.patient": true,
+    "FamilyMemberHistory.relationship": true,
+    "FamilyMemberHistory.status": true,
+    "Flag.code": true,
+    "Flag.status": true,
+    "Flag.subject": true,
+    "Goal.description": true,
+    "Goal.status": true,
+    "GraphDefinition.name": true,
+    "GraphDefinition.start": true,
+    "GraphDefinition.status": true,
+    "Group.actual": true,
+    "Group.type": true,
+    "GuidanceResponse.module": true,
+    "GuidanceResponse.status": true,
+    "ImagingManifest.patient": true,
+    "ImagingManifest.study": true,
+    "ImagingStudy.patient": true,
+    "ImagingStudy.uid": true,
+    "Immunization.notGiven": true,
+    "Immunization.patient": true,
+    "Immunization.primarySource": true,
+    "Immunization.status": true,
+    "Immunization.vaccineCode": true,
+    "ImmunizationRecommendation.patient": true,
+    "ImmunizationRecommendation.recommendation": true,
+    "ImplementationGuide.name": true,
+    "ImplementationGuide.status": true,
+    "ImplementationGuide.url": true,
+    "Library.status": true,
+    "Library.type": true,
+    "Linkage.item": true,
+    "List.mode": true,
+    "List.status": true,
+    "Measure.status": true,
+    "MeasureReport.measure": true,
+    "MeasureReport.period": true,
+    "MeasureReport.status": true,
+    "MeasureReport.type": true,
+    "Media.content": true,
+    "Media.type": true,
+    "MedicationAdministration.effectiveDateTime": true,
+    "MedicationAdministration.effectivePeriod": true,
+    "MedicationAdministration.medicationCodeableConcept": true,
+    "MedicationAdministration.medicationReference": true,
+    "MedicationAdministration.status": true,
+    "MedicationAdministration.subject": true,
+    "MedicationDispense.medicationCodeableConcept": true,
+    "MedicationDispense.medicationReference": true,
+    "MedicationRequest.intent": true,
+    "MedicationRequest.medicationCodeableConcept": true,
+    "MedicationRequest.medicationReference": true,
+    "MedicationRequest.subject": true,
+    "MedicationStatement.medicationCodeableConcept": true,
+    "MedicationStatement.medicationReference": true,
+    "MedicationStatement.status": true,
+    "MedicationStatement.subject": true,
+    "MedicationStatement.taken": true,
+    "MessageDefinition.date": true,
+    "MessageDefinition.event": true,
+    "MessageDefinition.status": true,
+    "MessageHeader.event": true,
+    "MessageHeader.source": true,
+    "MessageHeader.timestamp": true,
+    "MetadataResource.status": true,
+    "NamingSystem.date": true,
+    "NamingSystem.kind": true,
+    "NamingSystem.name": true,
+    "NamingSystem.status": true,
+    "NamingSystem.uniqueId": true,
+    "NutritionOrder.dateTime": true,
+    "NutritionOrder.patient": true,
+    "Observation.code": true,
+    "Observation.status": true,
+    "OperationDefinition.code": true,
+    "OperationDefinition.instance": true,
+    "OperationDefinition.kind": true,
+    "OperationDefinition.name": true,
+    "OperationDefinition.status": true,
+    "OperationDefinition.system": true,
+    "OperationDefinition.type": true,
+    "OperationOutcome.issue": true,
+    "PlanDefinition.status": true,
+    "Procedure.status": true,
+    "Procedure.subject": true,
+    "ProcedureRequest.code": true,
+    "ProcedureRequest.intent": true,
+    "ProcedureRequest.status": true,
+    "ProcedureRequest.subject": true,
+    "Provenance.agent": true,
+    "Provenance.recorded": true,
+    "Provenance.target": true,
+    "Questionnaire.status": true,
+    "QuestionnaireResponse.status": true,
+    "ReferralRequest.intent": true,
+    "ReferralRequest.status": true,
+    "ReferralRequest.subject": true,
+    "RelatedPerson.patient": true,
+    "RequestGroup.intent": true,
+    "RequestGroup.status": true,
+    "ResearchStudy.status": true,
+    "ResearchSubject.individual": true,
+    "ResearchSubject.status": true,
+    "ResearchSubject.study": true,
+    "RiskAssessment.status": true,
+    "Schedule.actor": true,
+    "SearchParameter.base": true,
+    "SearchParameter.code": true,
+    "SearchParameter.description": true,
+    "SearchParameter.name": true,
+    "SearchParameter.status": true,
+    "SearchParameter.type": true,
+    "SearchParameter.url": true,
+    "Sequence.coordinateSystem": true,
+    "ServiceDefinition.status": true,
+    "Slot.end": true,
+    "Slot.schedule": true,
+    "Slot.start": true,
+    "Slot.status": true,
+    "Specimen.subject": true,
+    "StructureDefinition.abstract": true,
+    "StructureDefinition.kind": true,
+    "StructureDefinition.name": true,
+    "StructureDefinition.status": true,
+    "StructureDefinition.type": true,
+    "StructureDefinition.url": true,
+    "StructureMap.group": true,
+    "StructureMap.name": true,
+    "StructureMap.status": true,
+    "StructureMap.url": true,
+    "Subscription.channel": true,
+    "Subscription.criteria": true,
+    "Subscription.reason": true,
+    "Subscription.status": true,
+    "Substance.code": true,
+    "Task.intent": true,
+    "Task.status": true,
+    "TestReport.result": true,
+    "TestReport.status": true,
+    "TestReport.testScript": true,
+    "TestScript.name": true,
+    "TestScript.status": true,
+    "TestScript.url": true,
+    "ValueSet.status": true,
+}
@@ -20,7 +20,9 @@ type FhirVisitor interface {
 	Extension(pos positionInfo, url string) error
 }
 
-func WalkFHIRjson(jsonBytes []byte, visitor FhirVisitor) (err error) {
+// WalkFHIRjson visits the elements of a resource, whose objects and arrays may be nested
+// maxDepth deep (DefaultMaxConversionDepth if it's zero)
+func WalkFHIRjson(jsonBytes []byte, visitor FhirVisitor, maxDepth int) (err error) {
 
 	debug("=== WalkFHIRjson ===")
 
@@ -30,7 +32,7 @@ func WalkFHIRjson(jsonBytes []byte, visitor FhirVisitor) (err error) {
 	}
 
 	if err == nil {
-		pos := positionInfo{pathHere: resourceType, element: resourceType}
+		pos := positionInfo{pathHere: resourceType, element: resourceType, maxDepth: maxDepth}
 		err = jsonparser.ObjectEach(jsonBytes, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
 			err4 := walkObjectKV(visitor, pos, key, value, dataType, offset)
 			return err4
@@ -70,6 +72,10 @@ func walkArray(visitor FhirVisitor, pos positionInfo, value []byte, dataType jso
 
 func walkValue(visitor FhirVisitor, pos positionInfo, value []byte, dataType jsonparser.ValueType) (err error) {
 
+	if err = pos.checkDepth(); err != nil {
+		return err
+	}
+
 	switch dataType {
 	case jsonparser.Object:
 
@@ -24,6 +24,10 @@ type positionInfo struct {
 
 	// Current path through the JSON - only for debugging
 	pathHere               string
+
+	// Number of objects and arrays we're nested in - limited by maxDepth (DefaultMaxConversionDepth if zero)
+	depth                  int
+	maxDepth               int
 }
 func (p *positionInfo) atReference() bool {
 	return p.element == "Reference"
@@ -42,6 +46,8 @@ func (p *positionInfo) atInstant() bool {
 }
 func (p *positionInfo) downTo(key string, valueJson []byte) positionInfo {
 	result := p.__downTo(key, valueJson)
+	result.depth = p.depth + 1
+	result.maxDepth = p.maxDepth
 	debug("downTo %s --> %#v", key, result)
 	return result
 }
@@ -119,6 +125,8 @@ func (p *positionInfo) __downTo(key string, valueJson []byte) positionInfo {
 }
 func (p *positionInfo) intoArray(valueJson []byte) positionInfo {
 	result := p.__intoArray(valueJson)
+	result.depth = p.depth + 1
+	result.maxDepth = p.maxDepth
 	debug("intoArray --> %#v", result)
 	return result
 }
@@ -148,6 +156,18 @@ func (p *positionInfo) __intoArray(valueJson []byte) positionInfo {
 	}
 }
 
+// checkDepth guards against stack exhaustion from pathologically nested resources
+func (p *positionInfo) checkDepth() error {
+	maxDepth := p.maxDepth
+	if maxDepth <= 0 {
+		maxDepth = DefaultMaxConversionDepth
+	}
+	if p.depth > maxDepth {
+		return p.schemaError("resource is nested too deeply (maximum depth is %d)", maxDepth)
+	}
+	return nil
+}
+
 func (p *positionInfo) schemaError(format string, a ...interface{}) FhirSchemaError {
 	return FhirSchemaError{
 		at: p.pathHere,
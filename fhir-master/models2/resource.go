@@ -1,16 +1,22 @@
 package models2
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 
 	"github.com/buger/jsonparser"
+	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
@@ -27,8 +33,10 @@ type Resource struct {
 	versionIdChanged       bool
 	lastUpdatedChanged     bool
 	transformReferencesMap map[string]string
+	internalReferences     map[string]string
 	cachedBson             *[]bson.E
 	whatToEncrypt          WhatToEncrypt
+	maxDepth               int
 }
 
 func (r *Resource) JsonBytes() []byte {
@@ -57,6 +65,11 @@ func (r *Resource) LastUpdatedTime() time.Time {
 func (r *Resource) SearchIncludes() []*Resource {
 	return r.searchIncludes
 }
+
+// AddSearchIncludes adds to the resources included with this one in search results
+func (r *Resource) AddSearchIncludes(included ...*Resource) {
+	r.searchIncludes = append(r.searchIncludes, included...)
+}
 func (r *Resource) SearchIncludesOfType(resourceType string) []*Resource {
 	var out []*Resource
 	for _, included := range r.searchIncludes {
@@ -97,10 +110,214 @@ func (r *Resource) SetTransformReferencesMap(transformReferencesMap map[string]s
 	r.cachedBson = nil
 }
 
+// ResolveInternalReferences rewrites references between the entries of a stored Bundle
+// from their urn:uuid: fullUrls to the entry resources (e.g. Patient/123)
+func (r *Resource) ResolveInternalReferences() {
+	if len(r.internalReferences) > 0 {
+		r.SetTransformReferencesMap(r.internalReferences)
+	}
+}
+
+// HasMeta returns whether the resource has a meta element
+func (r *Resource) HasMeta() bool {
+	_, _, _, err := jsonparser.Get(r.jsonBytes, "meta")
+	return err == nil
+}
+
+// SetDefaultMeta gives a resource without a meta one with these profiles (if any)
+func (r *Resource) SetDefaultMeta(profiles []string) error {
+	meta := []byte(`{}`)
+	if len(profiles) > 0 {
+		profilesJson, err := json.Marshal(profiles)
+		if err != nil {
+			return errors.Wrap(err, "SetDefaultMeta: failed to marshal profiles")
+		}
+		meta = []byte(`{"profile":` + string(profilesJson) + `}`)
+	}
+	jsonBytes, err := jsonparser.Set(r.jsonBytes, meta, "meta")
+	if err != nil {
+		return errors.Wrap(err, "SetDefaultMeta: jsonparser.Set failed")
+	}
+	r.jsonBytes = jsonBytes
+	r.cachedBson = nil
+	return nil
+}
+
+// SubsettedTag is added to meta.tag of resources with elements left out, e.g. by _elements
+const SubsettedTag = `{"system":"http://hl7.org/fhir/v3/ObservationValue","code":"SUBSETTED"}`
+
+// RetainElements removes the top-level elements that aren't listed, apart from the mandatory
+// resourceType, id and meta, and tags the resource as SUBSETTED. Primitive extensions
+// (e.g. _birthDate) are kept along with their element.
+func (r *Resource) RetainElements(elements []string) error {
+	listed := make(map[string]bool)
+	for _, element := range elements {
+		listed[element] = true
+	}
+	err := r.retainTopLevelElements(func(element string) bool { return listed[element] })
+	if err != nil {
+		return errors.Wrap(err, "RetainElements failed")
+	}
+	return nil
+}
+
+// ApplySummary removes the elements left out by a _summary mode: "true" keeps the summary
+// elements of the resource, "text" keeps text and the mandatory elements, and "data" removes
+// text. As with RetainElements only top-level elements are considered and the resource is
+// tagged as SUBSETTED. Other modes ("false" and "count") leave the resource unchanged.
+func (r *Resource) ApplySummary(mode string) error {
+	resourceType := r.ResourceType()
+	var keep func(element string) bool
+	switch mode {
+	case "true":
+		keep = func(element string) bool { return fhirSummaryElements[resourceType+"."+element] }
+	case "text":
+		keep = func(element string) bool { return element == "text" || fhirMandatoryElements[resourceType+"."+element] }
+	case "data":
+		keep = func(element string) bool { return element != "text" }
+	default:
+		return nil
+	}
+	err := r.retainTopLevelElements(keep)
+	if err != nil {
+		return errors.Wrapf(err, "ApplySummary (%s) failed", mode)
+	}
+	return nil
+}
+
+// retainTopLevelElements removes the elements for which keep returns false, apart from
+// resourceType, id and meta, and tags the resource as SUBSETTED
+func (r *Resource) retainTopLevelElements(keep func(element string) bool) error {
+	var out bytes.Buffer
+	hasMeta := false
+	writeElement := func(key string, value []byte) {
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		out.WriteString(`"` + key + `":`)
+		out.Write(value)
+	}
+
+	out.WriteByte('{')
+	err := jsonparser.ObjectEach(r.jsonBytes, func(key []byte, value []byte, dataType jsonparser.ValueType, offset int) error {
+		switch element := string(key); element {
+		case "resourceType", "id", "meta":
+		default:
+			if !keep(strings.TrimPrefix(element, "_")) {
+				return nil
+			}
+		}
+		if string(key) == "meta" {
+			hasMeta = true
+			meta, err := addSubsettedTag(value)
+			if err != nil {
+				return err
+			}
+			value = meta
+		} else if dataType == jsonparser.String {
+			// ObjectEach strips the quotes but leaves escapes alone
+			value = []byte(`"` + string(value) + `"`)
+		}
+		writeElement(string(key), value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !hasMeta {
+		meta, err := addSubsettedTag([]byte(`{}`))
+		if err != nil {
+			return err
+		}
+		writeElement("meta", meta)
+	}
+	out.WriteByte('}')
+
+	r.jsonBytes = out.Bytes()
+	r.cachedBson = nil
+	return nil
+}
+
+// addSubsettedTag appends SubsettedTag to the tags of a meta element
+func addSubsettedTag(meta []byte) ([]byte, error) {
+	var tags []json.RawMessage
+	if existing, dataType, _, err := jsonparser.Get(meta, "tag"); err == nil && dataType == jsonparser.Array {
+		if err := json.Unmarshal(existing, &tags); err != nil {
+			return nil, errors.Wrap(err, "failed to parse meta.tag")
+		}
+	}
+	tags = append(tags, json.RawMessage(SubsettedTag))
+	tagsJson, err := json.Marshal(tags)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal meta.tag")
+	}
+	return jsonparser.Set(meta, tagsJson, "tag")
+}
+
+// Diff returns the top-level elements (e.g. "name", "_birthDate") that differ between this resource
+// and another, in alphabetical order. The id and the versionId and lastUpdated of meta are left out as
+// the server assigns them, but other changes to meta (e.g. tags) are reported as "meta".
+func (r *Resource) Diff(other *Resource) ([]string, error) {
+	elements, err := r.comparableElements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Resource.Diff failed")
+	}
+	otherElements, err := other.comparableElements()
+	if err != nil {
+		return nil, errors.Wrap(err, "Resource.Diff failed")
+	}
+
+	var changed []string
+	for element, value := range elements {
+		if otherValue, found := otherElements[element]; !found || !reflect.DeepEqual(value, otherValue) {
+			changed = append(changed, element)
+		}
+	}
+	for element := range otherElements {
+		if _, found := elements[element]; !found {
+			changed = append(changed, element)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// Equals returns whether two resources have the same elements, ignoring those assigned by the server (see Diff)
+func (r *Resource) Equals(other *Resource) (bool, error) {
+	changed, err := r.Diff(other)
+	return len(changed) == 0, err
+}
+
+// comparableElements returns the parsed top-level elements of the resource for Diff
+func (r *Resource) comparableElements() (map[string]interface{}, error) {
+	var elements map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(r.jsonBytes))
+	decoder.UseNumber() // so that e.g. 1.50 and 1.5 differ
+	if err := decoder.Decode(&elements); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s/%s", r.resourceType, r.id)
+	}
+
+	delete(elements, "id")
+	if meta, isObject := elements["meta"].(map[string]interface{}); isObject {
+		delete(meta, "versionId")
+		delete(meta, "lastUpdated")
+		if len(meta) == 0 {
+			delete(elements, "meta")
+		}
+	}
+	return elements, nil
+}
+
 func (r *Resource) SetWhatToEncrypt(whatToEncrypt WhatToEncrypt) {
 	r.whatToEncrypt = whatToEncrypt
 }
 
+// SetMaxDepth sets how deeply objects and arrays may be nested within the resource when it's
+// converted to BSON (DefaultMaxConversionDepth if it's zero)
+func (r *Resource) SetMaxDepth(maxDepth int) {
+	r.maxDepth = maxDepth
+}
+
 func dumpMalformedJson(jsonBytes []byte, jsonError error, failedRequestsDir string) error {
 	currentTime := time.Now()
 	timestamp := currentTime.Format("2006-01-02-15-04-05.000000")
@@ -160,6 +377,7 @@ func (r *Resource) AsShallowBundle(failedRequestsDir string) (bundle *ShallowBun
 	for _, entry := range bundle.Entry {
 		if entry.Resource != nil {
 			entry.Resource.SetWhatToEncrypt(r.whatToEncrypt)
+			entry.Resource.SetMaxDepth(r.maxDepth)
 		}
 	}
 	return
@@ -235,7 +453,7 @@ func (r *Resource) MarshalBSON() ([]byte, error) {
 
 func (r *Resource) GetBSON() (interface{}, error) {
 	// debug("GetBSON: transformReferencesMap: %#v", r.transformReferencesMap)
-	bsonDoc, err := ConvertJsonToGoFhirBSON(r.jsonBytes, r.whatToEncrypt, r.transformReferencesMap)
+	bsonDoc, err := ConvertJsonToGoFhirBSON(r.jsonBytes, r.whatToEncrypt, r.transformReferencesMap, r.maxDepth)
 	bsonDoc2 := []bson.E(bsonDoc)
 	if err != nil {
 		return nil, errors.Wrap(err, "ConvertJsonToGoFhirBSON failed")
@@ -333,11 +551,18 @@ func NewResourceFromBSON(bsonDoc []bson.E) (resource *Resource, err error) {
 		return nil, errors.Wrap(err, "NewResourceFromBSON: NewResourceFromJsonBytes failed on output of ConvertGoFhirBSONToJSON")
 	}
 
+	resource.internalReferences, err = loadBundleFullUrls(bsonDoc)
+	if err != nil {
+		return nil, errors.Wrap(err, "NewResourceFromBSON: loadBundleFullUrls failed")
+	}
+
 	if includedJsons != nil && len(includedJsons) > 0 {
 		for _, includedJson := range includedJsons {
 			included, err := NewResourceFromJsonBytes(includedJson)
 			if err != nil {
-				return nil, errors.Wrap(err, "NewResourceFromBSON: NewResourceFromJsonBytes failed on included resource")
+				// skipped rather than failing the search (see processIncludedDocuments)
+				glog.Warningf("NewResourceFromBSON: skipping included resource: NewResourceFromJsonBytes failed: %+v", err)
+				continue
 			}
 			resource.searchIncludes = append(resource.searchIncludes, included)
 		}
@@ -346,6 +571,50 @@ func NewResourceFromBSON(bsonDoc []bson.E) (resource *Resource, err error) {
 	return
 }
 
+// loadBundleFullUrls reads the map stored by addBundleFullUrls
+func loadBundleFullUrls(bsonDoc []bson.E) (map[string]string, error) {
+	for _, elem := range bsonDoc {
+		if elem.Key != Gofhir__fullUrls {
+			continue
+		}
+
+		var array []interface{}
+		switch v := elem.Value.(type) {
+		case []interface{}:
+			array = v
+		case primitive.A:
+			array = v
+		default:
+			return nil, fmt.Errorf("%s of unexpected type %T", Gofhir__fullUrls, elem.Value)
+		}
+
+		fullUrls := make(map[string]string, len(array))
+		for _, elt := range array {
+			var doc []bson.E
+			switch eltV := elt.(type) {
+			case []bson.E:
+				doc = eltV
+			case bson.D:
+				doc = eltV
+			default:
+				return nil, fmt.Errorf("%s element of unexpected type %T", Gofhir__fullUrls, elt)
+			}
+			var fullUrl, reference string
+			for _, field := range doc {
+				switch field.Key {
+				case "fullUrl":
+					fullUrl, _ = field.Value.(string)
+				case "reference":
+					reference, _ = field.Value.(string)
+				}
+			}
+			fullUrls[fullUrl] = reference
+		}
+		return fullUrls, nil
+	}
+	return nil, nil
+}
+
 func NewResourceFromJsonBytes(jsonBytes []byte) (resource *Resource, err error) {
 
 	// debug("NewResourceFromJsonBytes: %s", string(jsonBytes))
@@ -0,0 +1,177 @@
+package models2
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetainElements(t *testing.T) {
+	resource, err := NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": {"versionId": "1", "tag": [{"system": "http://example.com", "code": "test"}]},
+		"name": [{"family": "O\"Neill", "given": ["Peter"]}],
+		"gender": "male",
+		"birthDate": "1974-12-25",
+		"_birthDate": {"extension": [{"url": "http://example.com/time", "valueDateTime": "1974-12-25T14:35:45-05:00"}]},
+		"active": true
+	}`))
+	assert.Nil(t, err)
+
+	err = resource.RetainElements([]string{"name", "birthDate"})
+	assert.Nil(t, err)
+
+	var patient map[string]interface{}
+	assert.Nil(t, json.Unmarshal(resource.JsonBytes(), &patient))
+	assert.Equal(t, "Patient", patient["resourceType"])
+	assert.Equal(t, "123", patient["id"])
+	assert.Equal(t, "O\"Neill", patient["name"].([]interface{})[0].(map[string]interface{})["family"])
+	assert.Equal(t, "1974-12-25", patient["birthDate"])
+	assert.Contains(t, patient, "_birthDate")
+	assert.NotContains(t, patient, "gender")
+	assert.NotContains(t, patient, "active")
+
+	meta := patient["meta"].(map[string]interface{})
+	assert.Equal(t, "1", meta["versionId"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"system": "http://example.com", "code": "test"},
+		map[string]interface{}{"system": "http://hl7.org/fhir/v3/ObservationValue", "code": "SUBSETTED"},
+	}, meta["tag"])
+
+	// also survives the conversion to BSON used when rendering
+	jsonBytes, err := resource.MarshalJSON()
+	assert.Nil(t, err)
+	assert.JSONEq(t, string(resource.JsonBytes()), string(jsonBytes))
+}
+
+func TestRetainElementsWithoutMeta(t *testing.T) {
+	resource, err := NewResourceFromJsonBytes([]byte(`{"resourceType": "Patient", "id": "123", "gender": "male"}`))
+	assert.Nil(t, err)
+
+	err = resource.RetainElements([]string{"name"})
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": {"tag": [{"system": "http://hl7.org/fhir/v3/ObservationValue", "code": "SUBSETTED"}]}
+	}`, string(resource.JsonBytes()))
+}
+
+func TestSetDefaultMeta(t *testing.T) {
+	resource, err := NewResourceFromJsonBytes([]byte(`{"resourceType": "Patient", "id": "123"}`))
+	assert.Nil(t, err)
+	assert.False(t, resource.HasMeta())
+
+	err = resource.SetDefaultMeta([]string{"http://example.com/StructureDefinition/patient"})
+	assert.Nil(t, err)
+	assert.True(t, resource.HasMeta())
+	assert.JSONEq(t, `{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": {"profile": ["http://example.com/StructureDefinition/patient"]}
+	}`, string(resource.JsonBytes()))
+}
+
+func TestApplySummary(t *testing.T) {
+	observation := func() *Resource {
+		resource, err := NewResourceFromJsonBytes([]byte(`{
+			"resourceType": "Observation",
+			"id": "123",
+			"text": {"status": "generated", "div": "<div xmlns=\"http://www.w3.org/1999/xhtml\">Weight 70 kg</div>"},
+			"status": "final",
+			"code": {"text": "Weight"},
+			"valueQuantity": {"value": 70, "unit": "kg"},
+			"comment": "after breakfast"
+		}`))
+		assert.Nil(t, err)
+		return resource
+	}
+	elementsAfter := func(mode string) map[string]interface{} {
+		resource := observation()
+		assert.Nil(t, resource.ApplySummary(mode))
+		var elements map[string]interface{}
+		assert.Nil(t, json.Unmarshal(resource.JsonBytes(), &elements))
+		return elements
+	}
+
+	// summary elements only
+	summary := elementsAfter("true")
+	assert.Contains(t, summary, "status")
+	assert.Contains(t, summary, "code")
+	assert.Contains(t, summary, "valueQuantity")
+	assert.NotContains(t, summary, "text")
+	assert.NotContains(t, summary, "comment")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"system": "http://hl7.org/fhir/v3/ObservationValue", "code": "SUBSETTED"},
+	}, summary["meta"].(map[string]interface{})["tag"])
+
+	// text and mandatory elements
+	text := elementsAfter("text")
+	assert.Contains(t, text, "text")
+	assert.Contains(t, text, "status")
+	assert.Contains(t, text, "code")
+	assert.NotContains(t, text, "valueQuantity")
+	assert.NotContains(t, text, "comment")
+
+	// everything but text
+	data := elementsAfter("data")
+	assert.NotContains(t, data, "text")
+	assert.Contains(t, data, "valueQuantity")
+	assert.Contains(t, data, "comment")
+	assert.Contains(t, data["meta"], "tag")
+
+	// unchanged
+	for _, mode := range []string{"false", ""} {
+		resource := observation()
+		original := string(resource.JsonBytes())
+		assert.Nil(t, resource.ApplySummary(mode))
+		assert.Equal(t, original, string(resource.JsonBytes()))
+	}
+}
+
+func TestDiff(t *testing.T) {
+	patient, err := NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": {"versionId": "1", "lastUpdated": "2019-01-01T10:00:00Z"},
+		"name": [{"family": "Smith", "given": ["Jane"]}],
+		"gender": "female",
+		"birthDate": "1974-12-25"
+	}`))
+	assert.Nil(t, err)
+	updated, err := NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"id": "123",
+		"meta": {"versionId": "2", "lastUpdated": "2019-02-01T10:00:00Z"},
+		"name": [{"family": "Smith", "given": ["Jane"]}],
+		"gender": "female",
+		"birthDate": "1974-12-26"
+	}`))
+	assert.Nil(t, err)
+
+	changed, err := patient.Diff(updated)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"birthDate"}, changed)
+	equal, err := patient.Equals(updated)
+	assert.Nil(t, err)
+	assert.False(t, equal)
+
+	// added and removed elements and meta changes other than the version
+	tagged, err := NewResourceFromJsonBytes([]byte(`{
+		"resourceType": "Patient",
+		"meta": {"tag": [{"system": "http://example.com", "code": "test"}]},
+		"name": [{"family": "Smith", "given": ["Jane"]}],
+		"birthDate": "1974-12-25",
+		"active": true
+	}`))
+	assert.Nil(t, err)
+	changed, err = patient.Diff(tagged)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"active", "gender", "meta"}, changed)
+
+	equal, err = patient.Equals(patient)
+	assert.Nil(t, err)
+	assert.True(t, equal)
+}
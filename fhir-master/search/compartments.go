@@ -0,0 +1,117 @@
+package search
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CompartmentDefinitions maps each supported compartment type (e.g. Patient) to the resource types
+// in its compartments and, for each of those, the reference search parameters that link a resource
+// to the compartment.  For example, a Condition is in the compartment of Patient/123 if its
+// patient or asserter parameter refers to Patient/123.
+var CompartmentDefinitions = map[string]map[string][]string{
+	"Patient": PatientCompartment,
+}
+
+// PatientCompartment is based on the STU3 Patient CompartmentDefinition
+// (http://hl7.org/fhir/STU3/compartmentdefinition-patient.html)
+var PatientCompartment = map[string][]string{
+	"Account":                    {"subject"},
+	"AdverseEvent":               {"subject"},
+	"AllergyIntolerance":         {"patient", "recorder", "asserter"},
+	"Appointment":                {"actor"},
+	"AppointmentResponse":        {"actor"},
+	"AuditEvent":                 {"patient"},
+	"Basic":                      {"patient", "author"},
+	"BodySite":                   {"patient"},
+	"CarePlan":                   {"patient", "performer"},
+	"CareTeam":                   {"patient", "participant"},
+	"ChargeItem":                 {"subject"},
+	"Claim":                      {"patient", "payee"},
+	"ClaimResponse":              {"patient"},
+	"ClinicalImpression":         {"subject"},
+	"Communication":              {"subject", "sender", "recipient"},
+	"CommunicationRequest":       {"subject", "sender", "recipient", "requester"},
+	"Composition":                {"subject", "author", "attester"},
+	"Condition":                  {"patient", "asserter"},
+	"Consent":                    {"patient"},
+	"Coverage":                   {"policy-holder", "subscriber", "beneficiary"},
+	"DetectedIssue":              {"patient"},
+	"DeviceRequest":              {"subject", "performer"},
+	"DeviceUseStatement":         {"subject"},
+	"DiagnosticReport":           {"subject"},
+	"DocumentManifest":           {"subject", "author", "recipient"},
+	"DocumentReference":          {"subject", "author"},
+	"EligibilityRequest":         {"patient"},
+	"Encounter":                  {"patient"},
+	"EnrollmentRequest":          {"subject"},
+	"EpisodeOfCare":              {"patient"},
+	"ExplanationOfBenefit":       {"patient", "payee"},
+	"FamilyMemberHistory":        {"patient"},
+	"Flag":                       {"patient"},
+	"Goal":                       {"patient"},
+	"Group":                      {"member"},
+	"ImagingManifest":            {"patient", "author"},
+	"ImagingStudy":               {"patient"},
+	"Immunization":               {"patient"},
+	"ImmunizationRecommendation": {"patient"},
+	"List":                       {"subject", "source"},
+	"MeasureReport":              {"patient"},
+	"Media":                      {"subject"},
+	"MedicationAdministration":   {"patient", "performer", "subject"},
+	"MedicationDispense":         {"subject", "patient", "receiver"},
+	"MedicationRequest":          {"subject"},
+	"MedicationStatement":        {"subject"},
+	"NutritionOrder":             {"patient"},
+	"Observation":                {"subject", "performer"},
+	"Person":                     {"patient"},
+	"Procedure":                  {"patient", "performer"},
+	"ProcedureRequest":           {"subject", "performer"},
+	"Provenance":                 {"target", "patient"},
+	"QuestionnaireResponse":      {"subject", "author"},
+	"ReferralRequest":            {"patient", "requester"},
+	"RelatedPerson":              {"patient"},
+	"RequestGroup":               {"subject", "participant"},
+	"ResearchSubject":            {"individual"},
+	"RiskAssessment":             {"subject"},
+	"Schedule":                   {"actor"},
+	"Specimen":                   {"subject"},
+	"SupplyDelivery":             {"patient"},
+	"SupplyRequest":              {"requester"},
+	"VisionPrescription":         {"patient"},
+}
+
+// IsCompartmentType returns true if resources of the given type have compartments
+func IsCompartmentType(compartmentType string) bool {
+	_, ok := CompartmentDefinitions[compartmentType]
+	return ok
+}
+
+// CompartmentQuery restricts a search of resourceType to the compartment of compartmentType/id
+// (e.g. a search for Condition in the compartment of Patient/123), by prepending the compartment's
+// parameters to the query. ok is false if resourceType isn't in the compartment.
+func CompartmentQuery(compartmentType, id, resourceType, query string) (compartmentQuery Query, ok bool) {
+	params, ok := CompartmentDefinitions[compartmentType][resourceType]
+	if !ok {
+		return Query{}, false
+	}
+
+	reference := compartmentType + "/" + id
+	var constraint string
+	if len(params) == 1 {
+		constraint = params[0] + "=" + url.QueryEscape(reference)
+	} else {
+		// a resource is in the compartment if any of the parameters refer to it
+		comparisons := make([]string, len(params))
+		for i, param := range params {
+			comparisons[i] = fmt.Sprintf("%s eq %s", param, reference)
+		}
+		constraint = FilterParam + "=" + url.QueryEscape(strings.Join(comparisons, " or "))
+	}
+
+	if query != "" {
+		constraint += "&" + query
+	}
+	return Query{Resource: resourceType, Query: constraint}, true
+}
@@ -0,0 +1,55 @@
+package search
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+type CompartmentSuite struct{}
+
+var _ = Suite(&CompartmentSuite{})
+
+func (s *CompartmentSuite) TestPatientCompartmentParameters(c *C) {
+	for resourceType, params := range PatientCompartment {
+		for _, param := range params {
+			info, ok := SearchParameterDictionary[resourceType][param]
+			c.Assert(ok, Equals, true, Commentf("%s.%s", resourceType, param))
+			c.Assert(info.Type, Equals, "reference", Commentf("%s.%s", resourceType, param))
+			c.Assert(contains(info.Targets, "Patient") || contains(info.Targets, "Any"), Equals, true, Commentf("%s.%s", resourceType, param))
+		}
+	}
+}
+
+func (s *CompartmentSuite) TestCompartmentQuerySingleParameter(c *C) {
+	q, ok := CompartmentQuery("Patient", "123", "Encounter", "status=finished")
+	c.Assert(ok, Equals, true)
+	c.Assert(q, DeepEquals, Query{Resource: "Encounter", Query: "patient=Patient%2F123&status=finished"})
+
+	params := q.Params()
+	c.Assert(params, HasLen, 2)
+	ref := params[0].(*ReferenceParam)
+	c.Assert(ref.Name, Equals, "patient")
+	c.Assert(ref.Reference, DeepEquals, LocalReference{ID: "123", Type: "Patient"})
+}
+
+func (s *CompartmentSuite) TestCompartmentQueryMultipleParameters(c *C) {
+	q, ok := CompartmentQuery("Patient", "123", "Condition", "")
+	c.Assert(ok, Equals, true)
+	c.Assert(q.Resource, Equals, "Condition")
+
+	params := q.Params()
+	c.Assert(params, HasLen, 1)
+	filter := params[0].(*FilterExpressionParam)
+	c.Assert(filter.Expression, Equals, "patient eq Patient/123 or asserter eq Patient/123")
+	or := filter.Root.(*OrParam)
+	c.Assert(or.Items, HasLen, 2)
+	c.Assert(or.Items[0].(*ReferenceParam).Reference, DeepEquals, LocalReference{ID: "123", Type: "Patient"})
+	c.Assert(or.Items[1].(*ReferenceParam).Name, Equals, "asserter")
+}
+
+func (s *CompartmentSuite) TestCompartmentQueryOutsideCompartment(c *C) {
+	_, ok := CompartmentQuery("Patient", "123", "Organization", "")
+	c.Assert(ok, Equals, false)
+
+	_, ok = CompartmentQuery("Organization", "123", "Condition", "")
+	c.Assert(ok, Equals, false)
+}
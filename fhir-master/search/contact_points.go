@@ -0,0 +1,31 @@
+package search
+
+// ContactPointSystemParams are the parameters that search the telecoms of a resource with a particular
+// ContactPoint.system (e.g. Patient?email=... searches Patient.telecom.where(system='email')).  These
+// aren't in the generated SearchParameterDictionary so are registered alongside each resource's
+// telecom parameter.
+var ContactPointSystemParams = map[string][]string{
+	"Patient":          {"email", "phone"},
+	"Person":           {"email", "phone"},
+	"Practitioner":     {"email", "phone"},
+	"PractitionerRole": {"email", "phone"},
+	"RelatedPerson":    {"email", "phone"},
+}
+
+func init() {
+	for resource, systems := range ContactPointSystemParams {
+		telecom := SearchParameterDictionary[resource]["telecom"]
+		for _, system := range systems {
+			paths := make([]SearchParamPath, len(telecom.Paths))
+			for i, path := range telecom.Paths {
+				paths[i] = SearchParamPath{Path: path.Path, Type: path.Type, System: system}
+			}
+			GlobalRegistry().RegisterParameterInfo(SearchParamInfo{
+				Resource: resource,
+				Name:     system,
+				Type:     "token",
+				Paths:    paths,
+			})
+		}
+	}
+}
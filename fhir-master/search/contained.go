@@ -0,0 +1,147 @@
+package search
+
+import (
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	moptions "go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// containerField holds the "Type/id" of the container of a contained resource found by
+// a _containedType=contained search, and is removed before the resource is loaded
+const containerField = "_container"
+
+// containedSource is a collection searched by a _contained search, with the filter or pipeline that searches it
+type containedSource struct {
+	collection string
+	filter     bson.M   // finds resources in the collection
+	pipeline   []bson.M // or, for _containedType=contained, finds the contained resources
+}
+
+// searchContained carries out a search with _contained=true or _contained=both. Resources of the searched
+// type contained in resources of any type are matched against the criteria, so every collection is searched.
+// Collections are paged through in order (by _id), skipping whole collections that fall before the offset.
+func (m *MongoSearcher) searchContained(query Query, options *QueryOptions) (resources []*models2.Resource, total uint32, err error) {
+	if len(options.Sort) > 0 || len(options.Include) > 0 || len(options.RevInclude) > 0 || options.SearchAfter != "" {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_contained\" can't be combined with _sort, _include, _revinclude or _searchafter"))
+	}
+	bsonQuery := m.convertToBSON(query)
+	if bsonQuery.usesPipeline() {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_contained\" isn't supported for this search"))
+	}
+
+	var count int64
+	skip := int64(options.Offset)
+	for _, source := range containedSources(bsonQuery, options) {
+		c := m.db.Collection(source.collection)
+
+		var sourceCount int64
+		if source.pipeline == nil {
+			sourceCount, err = c.CountDocuments(m.ctx, source.filter)
+		} else {
+			var aggregateCount uint32
+			aggregateCount, err = m.aggregateCount(c, &BSONQuery{Pipeline: source.pipeline})
+			sourceCount = int64(aggregateCount)
+		}
+		if err != nil {
+			return nil, 0, errors.Wrapf(err, "Search: count of contained resources in %s failed", source.collection)
+		}
+		count += sourceCount
+
+		if skip >= sourceCount {
+			skip -= sourceCount
+			continue
+		}
+		remaining := int64(options.Count - len(resources))
+		if remaining == 0 || options.Summary == "count" {
+			continue // only counting
+		}
+
+		var documents []bson.D
+		if source.pipeline == nil {
+			findOptions := moptions.Find().SetSort(bson.D{{Key: "_id", Value: 1}}).SetSkip(skip).SetLimit(remaining)
+			cursor, err := c.Find(m.ctx, source.filter, findOptions)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "Search: find in %s failed", source.collection)
+			}
+			err = cursor.All(m.ctx, &documents)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "Search: cursor for %s failed", source.collection)
+			}
+		} else {
+			pipeline := append(source.pipeline, bson.M{"$skip": skip}, bson.M{"$limit": remaining})
+			cursor, err := c.Aggregate(m.ctx, pipeline, moptions.Aggregate().SetAllowDiskUse(true))
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "Search: aggregate in %s failed", source.collection)
+			}
+			err = cursor.All(m.ctx, &documents)
+			if err != nil {
+				return nil, 0, errors.Wrapf(err, "Search: cursor for %s failed", source.collection)
+			}
+		}
+		skip = 0
+
+		for _, document := range documents {
+			container := ""
+			for i, elem := range document {
+				if elem.Key == containerField {
+					container, _ = elem.Value.(string)
+					document = append(document[:i:i], document[i+1:]...)
+					break
+				}
+			}
+			resource, err := loadSearchResult(document, options)
+			if err != nil {
+				return nil, 0, err
+			}
+			if container != "" {
+				if m.containers == nil {
+					m.containers = make(map[*models2.Resource]string)
+				}
+				m.containers[resource] = container
+			}
+			resources = append(resources, resource)
+		}
+	}
+
+	if !options.CountsTotal(m.countTotalResults) {
+		return resources, 0, nil
+	}
+	return resources, uint32(count), nil
+}
+
+// containedSources returns the collections to search for the contained resources (and, for _contained=both,
+// the resources that aren't contained) matching a query, with the filter or pipeline used for each
+func containedSources(bsonQuery *BSONQuery, options *QueryOptions) []containedSource {
+	var sources []containedSource
+	if options.Contained == "both" {
+		sources = append(sources, containedSource{
+			collection: models.PluralizeLowerResourceName(bsonQuery.Resource),
+			filter:     bsonQuery.Query,
+		})
+	}
+
+	// the criteria apply to the contained resources of the searched type
+	criteria := bson.M{"resourceType": bsonQuery.Resource}
+	merge(criteria, bsonQuery.Query)
+	filter := buildBSON("[]contained", criteria)
+
+	for _, collection := range models2.AllFhirResourceCollectionNames() {
+		source := containedSource{collection: collection, filter: filter}
+		if options.ContainedType == "contained" {
+			source.pipeline = []bson.M{
+				{"$match": filter},
+				{"$sort": bson.M{"_id": 1}},
+				{"$unwind": "$contained"},
+				{"$replaceRoot": bson.M{"newRoot": bson.M{"$mergeObjects": bson.A{
+					"$contained",
+					bson.M{containerField: bson.M{"$concat": bson.A{"$resourceType", "/", "$_id"}}},
+				}}}},
+				{"$match": criteria},
+			}
+		}
+		sources = append(sources, source)
+	}
+	return sources
+}
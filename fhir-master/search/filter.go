@@ -0,0 +1,260 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// FilterExpressionParam represents the _filter parameter, which uses the FHIR
+// filter expression language to combine comparisons with "and", "or", "not"
+// and parentheses.  For example:
+//
+//	Patient?_filter=given eq "John" and birthdate ge 1970-01-01
+//
+// Each comparison is delegated to the resource's ordinary search parameter, so
+// Root is a tree of OrParam, AndParam and NotParam nodes whose leaves are the
+// same SearchParam types that the equivalent URL parameters would produce.
+type FilterExpressionParam struct {
+	SearchParamInfo
+	Expression string
+	Root       SearchParam
+}
+
+func (f *FilterExpressionParam) getInfo() SearchParamInfo {
+	return f.SearchParamInfo
+}
+
+func (f *FilterExpressionParam) setInfo(info SearchParamInfo) {
+	f.SearchParamInfo = info
+}
+
+func (f *FilterExpressionParam) getQueryParamAndValue() (string, string) {
+	return FilterParam, f.Expression
+}
+
+// AndParam represents the "and" of a _filter expression, matching resources
+// that match all of its items.
+type AndParam struct {
+	SearchParamInfo
+	Items []SearchParam
+}
+
+func (a *AndParam) getInfo() SearchParamInfo {
+	return a.SearchParamInfo
+}
+
+func (a *AndParam) setInfo(info SearchParamInfo) {
+	a.SearchParamInfo = info
+}
+
+func (a *AndParam) getQueryParamAndValue() (string, string) {
+	// only used within a FilterExpressionParam, which is serialized from its expression
+	return FilterParam, ""
+}
+
+// NotParam represents the "not" (and "ne") of a _filter expression, matching
+// resources that do not match its item.
+type NotParam struct {
+	SearchParamInfo
+	Item SearchParam
+}
+
+func (n *NotParam) getInfo() SearchParamInfo {
+	return n.SearchParamInfo
+}
+
+func (n *NotParam) setInfo(info SearchParamInfo) {
+	n.SearchParamInfo = info
+}
+
+func (n *NotParam) getQueryParamAndValue() (string, string) {
+	// only used within a FilterExpressionParam, which is serialized from its expression
+	return FilterParam, ""
+}
+
+// ParseFilterParam parses a _filter expression for a resource and returns a
+// pointer to a FilterExpressionParam.  "and" binds more tightly than "or".
+func ParseFilterParam(expression string, resource string) *FilterExpressionParam {
+	p := &filterParser{resource: resource, tokens: tokenizeFilter(expression)}
+	root := p.parseOr()
+	if !p.atEnd() {
+		panic(invalidFilterError(fmt.Sprintf("unexpected %q", p.peek().text)))
+	}
+	return &FilterExpressionParam{SearchParamInfo{Name: FilterParam, Type: "filter"}, expression, root}
+}
+
+func invalidFilterError(reason string) *Error {
+	return createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %s", FilterParam, reason))
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeFilter splits a filter expression into parentheses, quoted strings
+// (with \" and \\ escapes) and whitespace-separated words
+func tokenizeFilter(expression string) []filterToken {
+	var tokens []filterToken
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')':
+			tokens = append(tokens, filterToken{text: string(r)})
+			i++
+		case r == '"':
+			var value strings.Builder
+			i++
+			for ; i < len(runes) && runes[i] != '"'; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value.WriteRune(runes[i])
+			}
+			if i == len(runes) {
+				panic(invalidFilterError("unterminated string"))
+			}
+			tokens = append(tokens, filterToken{text: value.String(), quoted: true})
+			i++
+		default:
+			start := i
+			for i < len(runes) && !unicode.IsSpace(runes[i]) && runes[i] != '(' && runes[i] != ')' && runes[i] != '"' {
+				i++
+			}
+			tokens = append(tokens, filterToken{text: string(runes[start:i])})
+		}
+	}
+	return tokens
+}
+
+type filterParser struct {
+	resource string
+	tokens   []filterToken
+	pos      int
+}
+
+func (p *filterParser) atEnd() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.atEnd() {
+		panic(invalidFilterError("unexpected end of expression"))
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+// peekKeyword tests if the next token is the given (unquoted, case-insensitive) keyword
+func (p *filterParser) peekKeyword(keyword string) bool {
+	return !p.atEnd() && !p.tokens[p.pos].quoted && strings.EqualFold(p.tokens[p.pos].text, keyword)
+}
+
+func (p *filterParser) parseOr() SearchParam {
+	items := []SearchParam{p.parseAnd()}
+	for p.peekKeyword("or") {
+		p.pos++
+		items = append(items, p.parseAnd())
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &OrParam{SearchParamInfo{Name: FilterParam, Type: "or"}, items}
+}
+
+func (p *filterParser) parseAnd() SearchParam {
+	items := []SearchParam{p.parseUnary()}
+	for p.peekKeyword("and") {
+		p.pos++
+		items = append(items, p.parseUnary())
+	}
+	if len(items) == 1 {
+		return items[0]
+	}
+	return &AndParam{SearchParamInfo{Name: FilterParam, Type: "and"}, items}
+}
+
+func (p *filterParser) parseUnary() SearchParam {
+	if p.peekKeyword("not") {
+		p.pos++
+		return &NotParam{SearchParamInfo{Name: FilterParam, Type: "not"}, p.parseUnary()}
+	}
+
+	if token := p.peek(); token.text == "(" && !token.quoted {
+		p.pos++
+		inner := p.parseOr()
+		if closing := p.next(); closing.text != ")" || closing.quoted {
+			panic(invalidFilterError(fmt.Sprintf("expected \")\" but found %q", closing.text)))
+		}
+		return inner
+	}
+
+	return p.parseComparison()
+}
+
+// parseComparison parses a "parameter operator value" comparison, creating
+// the SearchParam for the parameter as if it had been given in the URL
+func (p *filterParser) parseComparison() SearchParam {
+	name := p.next()
+	operator := p.next()
+	value := p.next()
+	if name.quoted || operator.quoted {
+		panic(invalidFilterError(fmt.Sprintf("expected a comparison but found %q", name.text)))
+	}
+
+	info, ok := SearchParameterDictionary[p.resource][name.text]
+	if !ok {
+		panic(createInvalidSearchError("SEARCH_NONE", fmt.Sprintf("Error: no processable search found for %s search parameters \"%s\"", p.resource, name.text)))
+	}
+	if info.Type == "composite" {
+		panic(invalidFilterError(fmt.Sprintf("composite parameter %s is not supported", name.text)))
+	}
+
+	// commas are literal within a filter value, rather than separating OR values
+	paramValue := strings.Replace(value.text, ",", "\\,", -1)
+	if info.Type == "string" {
+		paramValue = escape(value.text)
+	}
+
+	switch op := strings.ToLower(operator.text); op {
+	case "eq":
+		return createFilterComparison(info, paramValue, "eq")
+	case "ne":
+		return &NotParam{SearchParamInfo{Name: FilterParam, Type: "not"}, createFilterComparison(info, paramValue, "eq")}
+	case "gt", "lt", "ge", "le":
+		if info.Type != "date" && info.Type != "number" && info.Type != "quantity" {
+			panic(invalidFilterError(fmt.Sprintf("operator %s cannot be used with %s parameter %s", op, info.Type, name.text)))
+		}
+		return createFilterComparison(info, paramValue, op)
+	case "co", "sw", "ew":
+		if info.Type != "string" {
+			panic(invalidFilterError(fmt.Sprintf("operator %s cannot be used with %s parameter %s", op, info.Type, name.text)))
+		}
+		return createFilterComparison(info, paramValue, op)
+	default:
+		panic(invalidFilterError(fmt.Sprintf("unsupported operator %q", operator.text)))
+	}
+}
+
+func createFilterComparison(info SearchParamInfo, value string, operator string) SearchParam {
+	switch info.Type {
+	case "date", "number", "quantity":
+		// these parameters take the comparison as a prefix of the value
+		return info.CreateSearchParam(operator + value)
+	case "string":
+		param := info.CreateSearchParam(value).(*StringParam)
+		param.Match = StringMatch(operator)
+		return param
+	default:
+		return info.CreateSearchParam(value)
+	}
+}
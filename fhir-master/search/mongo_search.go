@@ -69,10 +69,20 @@ func (b *BSONQuery) DebugString() string {
 }
 
 // CountCache is used to cache the total count of results for a specific query.
-// The Id is the md5 hash of the query string.
+// The Id is the md5 hash of the query string. Resource is the query's resource type,
+// so that the counts for a type can be invalidated when its resources change.
 type CountCache struct {
-	Id    string `bson:"_id"`
-	Count uint32 `bson:"count"`
+	Id       string    `bson:"_id"`
+	Resource string    `bson:"resource"`
+	Count    uint32    `bson:"count"`
+	Created  time.Time `bson:"created"`
+}
+
+// InvalidateCountCache removes the cached counts of searches for a resource type, which
+// are out of date once a resource of that type has been created, updated or deleted.
+func InvalidateCountCache(ctx context.Context, db *mongowrapper.WrappedDatabase, resourceType string) error {
+	_, err := db.Collection("countcache").DeleteMany(ctx, bson.D{{Key: "resource", Value: resourceType}})
+	return err
 }
 
 // MongoSearcher implements FHIR searches using the Mongo database.
@@ -85,8 +95,27 @@ type MongoSearcher struct {
 	enableCISearches             bool
 	tokenParametersCaseSensitive bool
 	readonly                     bool
+	serverBase                   string // root URL of this server, if known
+	cursorPaging                 bool
+	cursorPaged                  bool   // whether the last search was paged with _searchafter
+	nextSearchAfter              string // _searchafter for the page following the last search
+	warnings                     []string
+	indexedFields                map[string][]string          // by collection, when searches have to use an index
+	caseSensitiveParams          map[string]bool              // by "Resource.param", overriding enableCISearches etc.
+	containers                   map[*models2.Resource]string // "Type/id" of the container of each contained match
+	missingValuesOrder           string                       // MissingValuesFirst, MissingValuesLast or "" for MongoDB's order
+	maxParameters                int                          // zero for no limit
+	maxValuesPerParameter        int                          // zero for no limit
+	countCacheTTL                time.Duration                // zero for cached counts that don't expire
 }
 
+// Where SetMissingValuesOrder puts resources without a value of a sort parameter.
+// By default MongoDB sorts missing values before any others, so first when ascending and last when descending.
+const (
+	MissingValuesFirst = "first"
+	MissingValuesLast  = "last"
+)
+
 // NewMongoSearcher creates a new instance of a MongoSearcher for an already open session
 func NewMongoSearcher(db *mongowrapper.WrappedDatabase, ctx context.Context, countTotalResults, enableCISearches, tokenParametersCaseSensitive, readonly bool) *MongoSearcher {
 	return &MongoSearcher{
@@ -126,6 +155,85 @@ func NewMongoSearcherForUri(mongoUri string, mongoDatabaseName string, countTota
 	}
 }
 
+// SetServerBase sets the root URL of this server (e.g. http://example.com/fhir/) so that reference
+// searches by an absolute URL on this server also match references stored as Type/id
+func (m *MongoSearcher) SetServerBase(serverBase string) {
+	if serverBase != "" && !strings.HasSuffix(serverBase, "/") {
+		serverBase = serverBase + "/"
+	}
+	m.serverBase = serverBase
+}
+
+// EnableCursorPaging sorts searches that don't ask for an offset so that they can be paged
+// with _searchafter (see NextSearchAfter) rather than _offset, where their sort allows it
+func (m *MongoSearcher) EnableCursorPaging() {
+	m.cursorPaging = true
+}
+
+// RequireIndexes makes searches with criteria fail with a 400 unless one of their parameters can
+// use an index, given the first keys of the indexes of each collection (e.g. "subject.reference__id")
+func (m *MongoSearcher) RequireIndexes(indexedFields map[string][]string) {
+	m.indexedFields = indexedFields
+}
+
+// SetCaseSensitivity overrides whether string and token parameters match case-sensitively (true) or
+// case-insensitively (false), keyed by resource type and parameter name, e.g. "Patient.identifier"
+func (m *MongoSearcher) SetCaseSensitivity(caseSensitiveParams map[string]bool) {
+	m.caseSensitiveParams = caseSensitiveParams
+}
+
+// SetMissingValuesOrder puts resources without a value of a sort parameter first or last (MissingValuesFirst
+// or MissingValuesLast) whatever the direction of the sort. Sorts where this differs from MongoDB's order
+// then use an aggregation pipeline, so can't be paged with _searchafter.
+func (m *MongoSearcher) SetMissingValuesOrder(order string) {
+	m.missingValuesOrder = order
+}
+
+// SetLimits makes searches with more than maxParameters search parameters, or with a parameter
+// with more than maxValuesPerParameter comma-separated values, fail with a 400. Zero means no limit.
+func (m *MongoSearcher) SetLimits(maxParameters int, maxValuesPerParameter int) {
+	m.maxParameters = maxParameters
+	m.maxValuesPerParameter = maxValuesPerParameter
+}
+
+// SetCountCacheTTL sets how long a count cached in read-only mode is used before the search is counted
+// again. It's a safeguard against counts that writes didn't invalidate, e.g. counts of chained searches
+// that depend on other resource types. By default (or with zero) cached counts don't expire.
+func (m *MongoSearcher) SetCountCacheTTL(ttl time.Duration) {
+	m.countCacheTTL = ttl
+}
+
+// withCaseSensitivityOf returns the searcher to build the criteria of a string or token parameter
+// with, which is a copy of m if the case-sensitivity of the parameter is overridden
+func (m *MongoSearcher) withCaseSensitivityOf(info SearchParamInfo) *MongoSearcher {
+	caseSensitive, overridden := m.caseSensitiveParams[info.Resource+"."+info.Name]
+	if !overridden {
+		return m
+	}
+	searcher := *m
+	searcher.enableCISearches = !caseSensitive
+	searcher.tokenParametersCaseSensitive = caseSensitive
+	return &searcher
+}
+
+// NextSearchAfter returns whether the last search was paged with _searchafter and, if so,
+// the _searchafter value for the following page (empty if the search had no results)
+func (m *MongoSearcher) NextSearchAfter() (searchAfter string, cursorPaged bool) {
+	return m.nextSearchAfter, m.cursorPaged
+}
+
+// Warnings returns the warnings of the last search, such as adjusted parameters and _include
+// references that couldn't be resolved, which don't stop the search but leave its results partial
+func (m *MongoSearcher) Warnings() []string {
+	return m.warnings
+}
+
+// Container returns the resource containing a result of the last search (as "Type/id") if the
+// result is a contained resource (found with _contained and _containedType=contained), otherwise ""
+func (m *MongoSearcher) Container(result *models2.Resource) string {
+	return m.containers[result]
+}
+
 // Close a MongoDB session opened by NewMongoSearcherForUri
 func (m *MongoSearcher) Close() {
 	if m.client != nil {
@@ -144,42 +252,75 @@ func (m *MongoSearcher) GetDB() *mongowrapper.WrappedDatabase {
 // If an error occurs during the search the corresponding mongo error
 // is returned and results will be nil.
 func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, total uint32, err error) {
+	m.cursorPaged, m.nextSearchAfter, m.containers = false, "", nil
+	query.CheckLimits(m.maxParameters, m.maxValuesPerParameter)
+
+	options := query.Options()
+	m.warnings = options.Warnings
+	if m.indexedFields != nil {
+		m.checkIndexed(query)
+	}
+	if options.SearchesContained() {
+		return m.searchContained(query, options)
+	}
+
+	// Only count the total if the server is configured to, unless _total or _summary=count ask otherwise.
+	doCount := options.CountsTotal(m.countTotalResults)
+	var queryHash string
+
+	// An estimated total for a search without criteria is taken from the collection's
+	// metadata rather than counting its documents
+	estimateTotal := options.Total == "estimate" && options.Summary != "count" && len(query.Params()) == 0
+	if estimateTotal {
+		doCount = false
+	}
 
 	// Check to see if we already have a count cached for this query. If so, use it
 	// and tell the searcher to skip doing the count. This can only be done reliably if
 	// the server is in -readonly mode.
-	doCount := true
-	var queryHash string
-
-	if m.readonly && m.countTotalResults {
+	if m.readonly && doCount {
 		queryHash = fmt.Sprintf("%x", md5.Sum([]byte(query.Resource+"?"+query.Query)))
 		countcacheQuery := bson.D{{Key: "_id", Value: queryHash}}
 		countcache := &CountCache{}
 		err = m.db.Collection("countcache").FindOne(m.ctx, countcacheQuery).Decode(&countcache)
+		if err == nil && m.countCacheTTL > 0 && time.Since(countcache.Created) > m.countCacheTTL {
+			err = mongo.ErrNoDocuments
+		}
 		if err == nil {
 			// Use the cached total and don't bother recomputing it.
 			total = countcache.Count
 			doCount = false
-		}
-	}
-
-	// There's no point in running the query if we already know it will return 0 results.
-	if m.readonly && !doCount && total == 0 {
-		return resources, 0, nil
-	}
 
-	// Don't do the count at all if m.countTotalResults is disabled.
-	if !m.countTotalResults {
-		doCount = false
+			// There's no point in running the query if we already know it will return 0 results.
+			if total == 0 {
+				return resources, 0, nil
+			}
+		}
 	}
 
 	var computedTotal uint32
 	var cursor *mongo.Cursor
+	var documents []bson.D
 	var start time.Time
-	options := query.Options()
 	bsonQuery := m.convertToBSON(query) // build the BSON query (without any options)
 	usesPipeline := bsonQuery.usesPipeline()
 
+	// Deep pages are slow to reach by skipping results, so if possible continue after the previous page instead
+	var page *cursorPage
+	if options.SearchAfter != "" || (m.cursorPaging && options.Offset == 0) {
+		if !usesPipeline {
+			page = newCursorPage(options)
+		}
+		if options.SearchAfter != "" {
+			if page == nil {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_searchafter\" isn't supported for this search and sort"))
+			}
+			page.continueAfter(options.SearchAfter)
+			options.Offset = 0
+		}
+		m.cursorPaged = page != nil
+	}
+
 	// Execute the query
 	if usesPipeline {
 		// The (slower) aggregation pipeline is used if the query contains includes or revincludes
@@ -189,10 +330,10 @@ func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, tota
 			glog.V(5).Infof("aggregate (%s) %#v count=%t", bsonQuery.DebugString(), options, doCount)
 		}
 
-		cursor, computedTotal, err = m.aggregate(bsonQuery, options, doCount)
+		documents, computedTotal, err = m.aggregate(bsonQuery, options, doCount)
 
 		if glog.V(5) {
-			glog.V(5).Infof("   cursor  %+v, total %d, err %+v took %v", cursor, computedTotal, err, time.Since(start))
+			glog.V(5).Infof("   documents %d, total %d, err %+v took %v", len(documents), computedTotal, err, time.Since(start))
 		}
 
 	} else {
@@ -202,7 +343,7 @@ func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, tota
 			start = time.Now()
 			glog.V(5).Infof("find (%s) %#v count=%t", bsonQuery.DebugString(), options, doCount)
 		}
-		cursor, computedTotal, err = m.find(bsonQuery, options, doCount)
+		cursor, computedTotal, err = m.find(bsonQuery, options, doCount, page)
 
 		if glog.V(5) {
 			glog.V(5).Infof("   cursor  %+v, total %d, err %+v took %v", cursor, computedTotal, err, time.Since(start))
@@ -236,90 +377,398 @@ func (m *MongoSearcher) Search(query Query) (resources []*models2.Resource, tota
 			if err != nil {
 				return nil, 0, errors.Wrap(err, "Search result decoding error")
 			}
-
-			resource, err := models2.NewResourceFromBSON(document)
-			if err != nil {
-				return nil, 0, errors.Wrap(err, "Search: NewResourceFromBSON failed")
-			}
-			resources = append(resources, resource)
+			documents = append(documents, document)
 		}
 		if err := cursor.Err(); err != nil {
 			return nil, 0, errors.Wrap(err, "Search cursor error")
 		}
 	}
+	if page != nil && len(documents) > 0 {
+		m.nextSearchAfter = page.searchAfter(documents[len(documents)-1])
+	}
+
+	for _, document := range documents {
+		m.warnings = append(m.warnings, unresolvedIncludes(document, options)...)
+		resource, err := loadSearchResult(document, options)
+		if err != nil {
+			return nil, 0, err
+		}
+		resources = append(resources, resource)
+	}
+
+	if options.IsIncludeAll || options.IsRevincludeAll {
+		err = m.resolveWildcardIncludes(query.Resource, documents, resources, options)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: resolveWildcardIncludes failed")
+		}
+	}
+
+	if options.UsesIterativeIncludes() {
+		err = m.resolveIterativeIncludes(resources, options)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: resolveIterativeIncludes failed")
+		}
+	}
 
 	// If the count wasn't already in cache, add it to cache.
-	if m.readonly && m.countTotalResults && doCount {
+	if m.readonly && doCount {
 		countcache := &CountCache{
-			Id:    queryHash,
-			Count: computedTotal,
+			Id:       queryHash,
+			Resource: query.Resource,
+			Count:    computedTotal,
+			Created:  time.Now(),
 		}
 		// Don't collect the error here since this should fail silently.
-		m.db.Collection("countcache").InsertOne(m.ctx, countcache)
+		// Replacing rather than inserting also refreshes an expired count.
+		m.db.Collection("countcache").ReplaceOne(m.ctx, bson.D{{Key: "_id", Value: queryHash}}, countcache, moptions.Replace().SetUpsert(true))
 	}
 
 	// The computed total will only be used if the server had no cached
-	// count for this search and countTotalResults is true.
+	// count for this search and the total is being counted.
 	if doCount {
 		total = computedTotal
 	}
 
+	if estimateTotal {
+		estimate, err := m.db.Collection(models.PluralizeLowerResourceName(query.Resource)).EstimatedDocumentCount(m.ctx)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "Search: estimated count failed")
+		}
+		total = uint32(estimate)
+	}
+
 	return resources, total, nil
 }
 
-// aggregate takes a BSONQuery and runs its Pipeline through the mongo aggregation framework. Any query options
-// will be added to the end of the pipeline.
-func (m *MongoSearcher) aggregate(bsonQuery *BSONQuery, options *QueryOptions, doCount bool) (cursor *mongo.Cursor, total uint32, err error) {
-	c := m.db.Collection(models.PluralizeLowerResourceName(bsonQuery.Resource))
+// loadSearchResult loads a resource found by a search, applying _elements and _summary
+func loadSearchResult(document bson.D, options *QueryOptions) (*models2.Resource, error) {
+	resource, err := models2.NewResourceFromBSON(document)
+	if err != nil {
+		return nil, errors.Wrap(err, "Search: NewResourceFromBSON failed")
+	}
+	if len(options.Elements) > 0 {
+		// done after loading rather than with a projection as encrypted elements
+		// are only available once the whole document has been decrypted
+		err = resource.RetainElements(options.Elements)
+		if err != nil {
+			return nil, errors.Wrap(err, "Search: RetainElements failed")
+		}
+	}
+	// likewise for _summary
+	err = resource.ApplySummary(options.Summary)
+	if err != nil {
+		return nil, errors.Wrap(err, "Search: ApplySummary failed")
+	}
+	return resource, nil
+}
 
-	// First get a count of the total results (doesn't apply any options)
-	if doCount || options.Summary == "count" {
-		if len(bsonQuery.Pipeline) == 1 {
-			// The pipeline is only being used for includes/revincludes, meaning the entire
-			// collection is being searched. It's faster just to get a total count from the
-			// collection after a find operation. The first stage in the Pipeline will
-			// always be a $match stage.
-			match := bsonQuery.Pipeline[0]["$match"]
-			intTotal, err := c.CountDocuments(m.ctx, match)
-			if err != nil {
-				return nil, 0, err
+// maxIncludeIterations limits how many times _include:iterate and _revinclude:iterate are applied
+const maxIncludeIterations = 5
+
+// resolveIterativeIncludes applies the _include:iterate and _revinclude:iterate options to the matches and
+// the resources included with them, then to the resources this adds and so on until no new resources are
+// found or maxIncludeIterations is reached. Each resource is only included once (by type and id), added to
+// the includes of the resource that led to it.
+func (m *MongoSearcher) resolveIterativeIncludes(resources []*models2.Resource, options *QueryOptions) error {
+	seen := make(map[string]bool)
+	var frontier []*models2.Resource
+	addToFrontier := func(resource *models2.Resource) bool {
+		key := resource.ResourceType() + "/" + resource.Id()
+		if seen[key] {
+			return false
+		}
+		seen[key] = true
+		frontier = append(frontier, resource)
+		return true
+	}
+	for _, resource := range resources {
+		addToFrontier(resource)
+		for _, included := range resource.SearchIncludes() {
+			addToFrontier(included)
+		}
+	}
+
+	for i := 0; i < maxIncludeIterations && len(frontier) > 0; i++ {
+		byType := make(map[string]map[string]*models2.Resource)
+		for _, resource := range frontier {
+			if byType[resource.ResourceType()] == nil {
+				byType[resource.ResourceType()] = make(map[string]*models2.Resource)
 			}
-			total = uint32(intTotal)
-		} else {
-			// Do the count in the aggregation framework
-			countStage := bson.M{"$group": bson.M{
-				"_id":   nil,
-				"total": bson.M{"$sum": 1},
-			}}
-			countPipeline := make([]bson.M, len(bsonQuery.Pipeline)+1)
-			copy(countPipeline, bsonQuery.Pipeline)
-			countPipeline[len(countPipeline)-1] = countStage
-
-			cursor, err := c.Aggregate(m.ctx, countPipeline)
+			byType[resource.ResourceType()][resource.Id()] = resource
+		}
+		frontier = nil
+
+		for resourceType, byID := range byType {
+			// the same $lookup stages as non-iterative includes, applied to this type's new resources
+			stageOptions := &QueryOptions{Count: len(byID)}
+			for _, incl := range options.Include {
+				if incl.Iterate && incl.Resource == resourceType {
+					stageOptions.Include = append(stageOptions.Include, IncludeOption{Resource: incl.Resource, Parameter: incl.Parameter})
+				}
+			}
+			for _, incl := range options.RevInclude {
+				if incl.Iterate && isValidTarget(resourceType, incl.Parameter) {
+					stageOptions.RevInclude = append(stageOptions.RevInclude, RevIncludeOption{Resource: incl.Resource, Parameter: incl.Parameter})
+				}
+			}
+			if len(stageOptions.Include) == 0 && len(stageOptions.RevInclude) == 0 {
+				continue
+			}
+
+			ids := make([]string, 0, len(byID))
+			for id := range byID {
+				ids = append(ids, id)
+			}
+			pipeline := []bson.M{{"$match": bson.M{"_id": bson.M{"$in": ids}}}}
+			pipeline = append(pipeline, m.convertOptionsToPipelineStages(resourceType, stageOptions)...)
+
+			c := m.db.Collection(models.PluralizeLowerResourceName(resourceType))
+			cursor, err := c.Aggregate(m.ctx, pipeline)
 			if err != nil {
-				return nil, 0, errors.Wrap(err, "aggregate count failed")
+				return errors.Wrapf(err, "aggregate for %s includes failed", resourceType)
 			}
-			if cursor.Next(m.ctx) {
-				result := struct {
-					Total float64 `bson:"total"`
-				}{}
-				err = cursor.Decode(&result)
+			for cursor.Next(m.ctx) {
+				var document bson.D
+				if err := cursor.Decode(&document); err != nil {
+					cursor.Close(m.ctx)
+					return errors.Wrap(err, "iterative include decoding error")
+				}
+				withIncludes, err := models2.NewResourceFromBSON(document)
 				if err != nil {
-					return nil, 0, errors.Wrap(err, "aggregate count decode failed")
+					cursor.Close(m.ctx)
+					return errors.Wrap(err, "iterative include: NewResourceFromBSON failed")
 				}
-				if err := cursor.Err(); err != nil {
-					return nil, 0, errors.Wrap(err, "aggregate count cursor has an error")
+
+				var added []*models2.Resource
+				for _, included := range withIncludes.SearchIncludes() {
+					if addToFrontier(included) {
+						added = append(added, included)
+					}
 				}
-				total = uint32(result.Total)
-			} else {
-				glog.V(3).Infof("aggregate count --> cursor Next returned false")
-				err = cursor.Err()
-				if err != nil {
-					return nil, 0, errors.Wrap(err, "aggregate count cursor --> next failed")
+				byID[withIncludes.Id()].AddSearchIncludes(added...)
+			}
+			err = cursor.Err()
+			cursor.Close(m.ctx)
+			if err != nil {
+				return errors.Wrapf(err, "cursor for %s includes failed", resourceType)
+			}
+		}
+	}
+	return nil
+}
+
+// unresolvedIncludes returns warnings for the references of a search result that its (non-iterative)
+// _include parameters should have included but didn't, as the referenced resources weren't found
+func unresolvedIncludes(document bson.D, options *QueryOptions) (warnings []string) {
+	if options.IsIncludeAll {
+		return nil // see resolveWildcardIncludes
+	}
+	for _, incl := range options.Include {
+		if incl.Iterate {
+			continue
+		}
+
+		// the resources the $lookup stages of the parameter found, by type and id
+		included := make(map[string]bool)
+		suffix := "ResourcesReferencedBy" + strings.Title(incl.Parameter.Name)
+		for _, element := range document {
+			pos := strings.Index(element.Key, suffix)
+			if !strings.HasPrefix(element.Key, "_included") || pos < 0 {
+				continue
+			}
+			if rest := element.Key[pos+len(suffix):]; rest != "" && !strings.HasPrefix(rest, "Path") {
+				continue
+			}
+			target := strings.TrimPrefix(element.Key[:pos], "_included")
+			lookedUp, _ := element.Value.(bson.A)
+			for _, value := range lookedUp {
+				if doc, ok := value.(bson.D); ok {
+					id, _ := lookupField(doc, "_id").(string)
+					included[target+"/"+id] = true
+				}
+			}
+		}
+
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, value := range valuesAtPath(document, strings.Split(strings.Replace(inclPath.Path, "[]", "", -1), ".")) {
+				reference, ok := value.(bson.D)
+				if !ok || lookupField(reference, "reference__external") == true {
+					continue
+				}
+				referenceType, _ := lookupField(reference, "reference__type").(string)
+				referenceID, _ := lookupField(reference, "reference__id").(string)
+				if referenceID == "" || !includesTarget(incl.Parameter, referenceType) {
+					continue
+				}
+				if !included[referenceType+"/"+referenceID] {
+					id, _ := lookupField(document, "_id").(string)
+					warnings = append(warnings, fmt.Sprintf("The %s/%s referenced by %s/%s couldn't be included (_include=%s:%s)",
+						referenceType, referenceID, incl.Resource, id, incl.Resource, incl.Parameter.Name))
 				}
 			}
 		}
 	}
+	return warnings
+}
+
+// includesTarget returns true if _include looks up the references of param to resources of this type,
+// which it does for the param's targets other than "Any"
+func includesTarget(param SearchParamInfo, resourceType string) bool {
+	for _, target := range param.Targets {
+		if target == resourceType && target != "Any" {
+			return true
+		}
+	}
+	return false
+}
+
+// valuesAtPath returns the values of a field within a value, following each element of any arrays along the way
+func valuesAtPath(value interface{}, keys []string) []interface{} {
+	switch v := value.(type) {
+	case bson.A:
+		var values []interface{}
+		for _, element := range v {
+			values = append(values, valuesAtPath(element, keys)...)
+		}
+		return values
+	case bson.D:
+		if len(keys) == 0 {
+			return []interface{}{v}
+		}
+		return valuesAtPath(lookupField(v, keys[0]), keys[1:])
+	case nil:
+		return nil
+	default:
+		if len(keys) == 0 {
+			return []interface{}{v}
+		}
+		return nil
+	}
+}
+
+// GroupCount is the number of matching resources that share a value of a field
+type GroupCount struct {
+	// Value is nil for resources without the field
+	Value interface{} `bson:"_id"`
+	Count int         `bson:"count"`
+}
+
+// GroupCounts counts the resources matching the query grouped by the value of field, a dot-separated
+// path into the stored resources (e.g. status or class.code). This is done with a $group stage at the
+// end of the query's pipeline, so fields within arrays are grouped by the whole array. Query options
+// such as _count and _sort are ignored. The largest groups come first.
+func (m *MongoSearcher) GroupCounts(query Query, field string) ([]GroupCount, error) {
+	query.CheckLimits(m.maxParameters, m.maxValuesPerParameter)
+	bsonQuery := m.convertToBSON(query)
+
+	pipeline := bsonQuery.Pipeline
+	if !bsonQuery.usesPipeline() {
+		pipeline = []bson.M{{"$match": bsonQuery.Query}}
+	}
+	pipeline = append(pipeline,
+		bson.M{"$group": bson.M{
+			"_id":   "$" + field,
+			"count": bson.M{"$sum": 1},
+		}},
+		bson.M{"$sort": bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}},
+	)
+
+	c := m.db.Collection(models.PluralizeLowerResourceName(bsonQuery.Resource))
+	cursor, err := c.Aggregate(m.ctx, pipeline)
+	if err != nil {
+		return nil, errors.Wrap(err, "GroupCounts aggregate failed")
+	}
+	defer cursor.Close(m.ctx)
+
+	var counts []GroupCount
+	for cursor.Next(m.ctx) {
+		var count GroupCount
+		if err := cursor.Decode(&count); err != nil {
+			return nil, errors.Wrap(err, "GroupCounts decoding error")
+		}
+		counts = append(counts, count)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "GroupCounts cursor error")
+	}
+	return counts, nil
+}
+
+// LastN returns the max most recent Observations matching the query for each code (and patient), newest
+// first within each group, for the $lastn operation. Observations are dated by their effective[x] (the
+// start of an effectivePeriod) and grouped by the systems and codes of their code. Query options are ignored.
+func (m *MongoSearcher) LastN(query Query, max int) ([]*models2.Resource, error) {
+	query.CheckLimits(m.maxParameters, m.maxValuesPerParameter)
+	bsonQuery := m.convertToBSON(query)
+
+	pipeline := bsonQuery.Pipeline
+	if !bsonQuery.usesPipeline() {
+		pipeline = []bson.M{{"$match": bsonQuery.Query}}
+	}
+	pipeline = append(pipeline,
+		bson.M{"$addFields": bson.M{
+			"_lastnDate": bson.M{"$ifNull": bson.A{"$effectiveDateTime.__from", "$effectivePeriod.start.__from"}},
+		}},
+		bson.M{"$sort": bson.D{{Key: "_lastnDate", Value: -1}, {Key: "_id", Value: -1}}},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"patient": "$subject.reference__id",
+				"system":  "$code.coding.system",
+				"code":    "$code.coding.code",
+			},
+			"observations": bson.M{"$push": "$$ROOT"},
+		}},
+		bson.M{"$sort": bson.D{{Key: "_id.patient", Value: 1}, {Key: "_id.code", Value: 1}, {Key: "_id.system", Value: 1}}},
+		bson.M{"$project": bson.M{"observations": bson.M{"$slice": bson.A{"$observations", max}}}},
+		bson.M{"$unwind": "$observations"},
+		bson.M{"$replaceRoot": bson.M{"newRoot": "$observations"}},
+		bson.M{"$project": bson.M{"_lastnDate": 0}},
+	)
+
+	c := m.db.Collection(models.PluralizeLowerResourceName(bsonQuery.Resource))
+	cursor, err := c.Aggregate(m.ctx, pipeline, moptions.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, errors.Wrap(err, "LastN aggregate failed")
+	}
+	defer cursor.Close(m.ctx)
+
+	var resources []*models2.Resource
+	for cursor.Next(m.ctx) {
+		var document bson.D
+		if err := cursor.Decode(&document); err != nil {
+			return nil, errors.Wrap(err, "LastN decoding error")
+		}
+		resource, err := models2.NewResourceFromBSON(document)
+		if err != nil {
+			return nil, errors.Wrap(err, "LastN: NewResourceFromBSON failed")
+		}
+		resources = append(resources, resource)
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, errors.Wrap(err, "LastN cursor error")
+	}
+	return resources, nil
+}
+
+// aggregate takes a BSONQuery and runs its Pipeline through the mongo aggregation framework. Any query options
+// will be added to the end of the pipeline.
+func (m *MongoSearcher) aggregate(bsonQuery *BSONQuery, options *QueryOptions, doCount bool) (documents []bson.D, total uint32, err error) {
+	c := m.db.Collection(models.PluralizeLowerResourceName(bsonQuery.Resource))
+
+	// The pipeline is only being used for includes/revincludes if it has a single stage, meaning the entire
+	// collection is being searched. Otherwise the total is counted alongside the results using a $facet.
+	countWithFacet := doCount && len(bsonQuery.Pipeline) > 1 && options.Summary != "count"
+
+	// First get a count of the total results (doesn't apply any options)
+	if (doCount || options.Summary == "count") && !countWithFacet {
+		total, err = m.aggregateCount(c, bsonQuery)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
 
 	if options.Summary == "count" {
 		// Just return the count and don't do the search.
@@ -327,17 +776,104 @@ func (m *MongoSearcher) aggregate(bsonQuery *BSONQuery, options *QueryOptions, d
 		return nil, total, nil
 	}
 
-	// Now setup the search pipeline (applying options, if any)
-	searchPipeline := bsonQuery.Pipeline
-	if options != nil {
-		searchPipeline = append(searchPipeline, m.convertOptionsToPipelineStages(bsonQuery.Resource, options)...)
+	if countWithFacet {
+		return m.aggregateWithTotal(c, bsonQuery, options)
+	}
+
+	cursor, err := c.Aggregate(m.ctx, m.createSearchPipeline(bsonQuery, options), moptions.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "aggregate operation failed")
+	}
+	err = cursor.All(m.ctx, &documents)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "aggregate cursor failed")
+	}
+	glog.V(3).Infof("returning %d documents", len(documents))
+	return documents, total, nil
+}
+
+// aggregateCount counts the results of a BSONQuery's Pipeline (without applying any options)
+func (m *MongoSearcher) aggregateCount(c *mongowrapper.WrappedCollection, bsonQuery *BSONQuery) (total uint32, err error) {
+	if len(bsonQuery.Pipeline) == 1 {
+		// The pipeline is only being used for includes/revincludes, meaning the entire
+		// collection is being searched. It's faster just to get a total count from the
+		// collection after a find operation. The first stage in the Pipeline will
+		// always be a $match stage.
+		match := bsonQuery.Pipeline[0]["$match"]
+		intTotal, err := c.CountDocuments(m.ctx, match)
+		if err != nil {
+			return 0, err
+		}
+		return uint32(intTotal), nil
+	}
+
+	// Do the count in the aggregation framework
+	countStage := bson.M{"$group": bson.M{
+		"_id":   nil,
+		"total": bson.M{"$sum": 1},
+	}}
+	countPipeline := make([]bson.M, len(bsonQuery.Pipeline)+1)
+	copy(countPipeline, bsonQuery.Pipeline)
+	countPipeline[len(countPipeline)-1] = countStage
+
+	cursor, err := c.Aggregate(m.ctx, countPipeline)
+	if err != nil {
+		return 0, errors.Wrap(err, "aggregate count failed")
+	}
+	defer cursor.Close(m.ctx)
+	if cursor.Next(m.ctx) {
+		result := struct {
+			Total float64 `bson:"total"`
+		}{}
+		err = cursor.Decode(&result)
+		if err != nil {
+			return 0, errors.Wrap(err, "aggregate count decode failed")
+		}
+		if err := cursor.Err(); err != nil {
+			return 0, errors.Wrap(err, "aggregate count cursor has an error")
+		}
+		total = uint32(result.Total)
+	} else {
+		glog.V(3).Infof("aggregate count --> cursor Next returned false")
+		err = cursor.Err()
+		if err != nil {
+			return 0, errors.Wrap(err, "aggregate count cursor --> next failed")
+		}
 	}
-	cursor, err = c.Aggregate(m.ctx, searchPipeline, moptions.Aggregate().SetAllowDiskUse(true))
+	return total, nil
+}
+
+// aggregateWithTotal runs the pipeline from createFacetSearchPipeline, returning a page of results
+// together with the total number of matches from a single aggregation
+func (m *MongoSearcher) aggregateWithTotal(c *mongowrapper.WrappedCollection, bsonQuery *BSONQuery, options *QueryOptions) (documents []bson.D, total uint32, err error) {
+	cursor, err := c.Aggregate(m.ctx, m.createFacetSearchPipeline(bsonQuery, options), moptions.Aggregate().SetAllowDiskUse(true))
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "aggregate operation failed")
 	}
-	glog.V(3).Infof("returning cursor")
-	return cursor, total, nil
+	defer cursor.Close(m.ctx)
+
+	result := struct {
+		Results []bson.D `bson:"results"`
+		Total   []struct {
+			Total int64 `bson:"total"`
+		} `bson:"total"`
+	}{}
+	if cursor.Next(m.ctx) {
+		err = cursor.Decode(&result)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "aggregate facet decode failed")
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, 0, errors.Wrap(err, "aggregate facet cursor has an error")
+	}
+
+	// $count doesn't output a document when there are no matches
+	if len(result.Total) > 0 {
+		total = uint32(result.Total[0].Total)
+	}
+	glog.V(3).Infof("returning %d documents (total %d)", len(result.Results), total)
+	return result.Results, total, nil
 }
 
 func bson1ArrayToBytes(bson1 []bson.M) []byte {
@@ -356,8 +892,8 @@ func bson1ToBytes(bson1 bson.M) []byte {
 }
 
 // find takes a BSONQuery and runs a standard mongo search on that query. Any query options are applied
-// after the initial search is performed.
-func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, doCount bool) (cursor *mongo.Cursor, total uint32, err error) {
+// after the initial search is performed, as is the page's sort and position if it's paged with _searchafter.
+func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, doCount bool, page *cursorPage) (cursor *mongo.Cursor, total uint32, err error) {
 	c := m.db.Collection(models.PluralizeLowerResourceName(bsonQuery.Resource))
 
 	// First get a count of the total results (doesn't apply any options)
@@ -377,19 +913,8 @@ func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, d
 
 	optionsBundle := moptions.Find()
 	if queryOptions != nil {
-		removeParallelArraySorts(queryOptions)
 		if len(queryOptions.Sort) > 0 {
-			fields := bson.D{}
-			for i := range queryOptions.Sort {
-				// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
-				field := convertSearchPathToMongoField(queryOptions.Sort[i].Parameter.Paths[0].Path)
-				if queryOptions.Sort[i].Descending {
-					fields = append(fields, bson.E{Key: field, Value: -1})
-				} else {
-					fields = append(fields, bson.E{Key: field, Value: 1})
-				}
-			}
-			optionsBundle = optionsBundle.SetSort(fields)
+			optionsBundle = optionsBundle.SetSort(findSort(queryOptions.Sort))
 		}
 		if queryOptions.Offset > 0 {
 			optionsBundle = optionsBundle.SetSkip(int64(queryOptions.Offset))
@@ -397,17 +922,54 @@ func (m *MongoSearcher) find(bsonQuery *BSONQuery, queryOptions *QueryOptions, d
 		optionsBundle = optionsBundle.SetLimit(int64(queryOptions.Count))
 	}
 
-	searchCursor, err := c.Find(m.ctx, bsonQuery.Query, optionsBundle)
+	filter := bsonQuery.Query
+	if page != nil {
+		optionsBundle = optionsBundle.SetSort(page.sort())
+		if page.after != nil {
+			filter = bson.M{"$and": []bson.M{bsonQuery.Query, page.after}}
+		}
+	}
+
+	searchCursor, err := c.Find(m.ctx, filter, optionsBundle)
 	if err != nil {
 		return nil, 0, errors.Wrap(err, "search find operation failed")
 	}
 	return searchCursor, total, nil
 }
 
+// findSort returns the MongoDB sort of a find for the _sort keys, each in its own direction and in the
+// order of the URL
+func findSort(sorts []SortOption) bson.D {
+	fields := bson.D{}
+	for _, sort := range sorts {
+		// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
+		field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
+		if sort.Descending {
+			fields = append(fields, bson.E{Key: field, Value: -1})
+		} else {
+			fields = append(fields, bson.E{Key: field, Value: 1})
+		}
+	}
+	return withIDTieBreak(fields)
+}
+
+// withIDTieBreak returns a sort followed by _id (ascending) unless it already sorts on it. Sort keys that
+// aren't unique would otherwise leave resources with equal values in any order, which can differ from
+// page to page so that paging with _offset repeats some resources and skips others.
+func withIDTieBreak(sort bson.D) bson.D {
+	for _, field := range sort {
+		if field.Key == "_id" {
+			return sort
+		}
+	}
+	return append(sort, bson.E{Key: "_id", Value: 1})
+}
+
 func (m *MongoSearcher) convertToBSON(query Query) *BSONQuery {
 	bsonQuery := NewBSONQuery(query.Resource)
+	panicOnInvalidChains(query)
 
-	if query.UsesPipeline() {
+	if query.UsesPipeline() || hasChainedSorts(query.Options()) || hasParallelArraySorts(query.Options()) || m.hasMissingValuesSorts(query.Options()) {
 		bsonQuery.Pipeline = m.createPipelineObject(query)
 	} else {
 		bsonQuery.Query = m.createQueryObject(query)
@@ -450,6 +1012,12 @@ func (m *MongoSearcher) createParamObjects(params []SearchParam) []bson.M {
 			results[i] = m.createURIQueryObject(p)
 		case *OrParam:
 			results[i] = m.createOrQueryObject(p)
+		case *AndParam:
+			results[i] = m.createAndQueryObject(p)
+		case *NotParam:
+			results[i] = m.createNotQueryObject(p)
+		case *FilterExpressionParam:
+			results[i] = m.createParamObjects([]SearchParam{p.Root})[0]
 		default:
 			// Check for custom search parameter implementations
 			builder, err := GlobalMongoRegistry().LookupBSONBuilder(p.getInfo().Type)
@@ -501,23 +1069,115 @@ func (m *MongoSearcher) createPipelineObject(query Query) []bson.M {
 	return pipeline
 }
 
+// createSearchPipeline appends the stages for the query options (sorting, paging and includes)
+// after the $match and $lookup stages of a pipeline-based search (i.e. chained, reverse chained or include searches).
+// The count is done on bsonQuery.Pipeline alone.
+func (m *MongoSearcher) createSearchPipeline(bsonQuery *BSONQuery, options *QueryOptions) []bson.M {
+	pipeline := make([]bson.M, len(bsonQuery.Pipeline), len(bsonQuery.Pipeline)+1)
+	copy(pipeline, bsonQuery.Pipeline)
+	if options != nil {
+		pipeline = append(pipeline, m.optionsPipelineStages(bsonQuery, options)...)
+	}
+	return pipeline
+}
+
+// createFacetSearchPipeline is like createSearchPipeline but also counts the total number of matches.
+// A $facet stage splits the query's results into a "results" sub-pipeline with the options' stages
+// (e.g. sort, paging and includes) and a "total" sub-pipeline with a $count stage, producing a
+// single document. As with any document this is limited to 16MB, including any included resources.
+func (m *MongoSearcher) createFacetSearchPipeline(bsonQuery *BSONQuery, options *QueryOptions) []bson.M {
+	pipeline := make([]bson.M, len(bsonQuery.Pipeline), len(bsonQuery.Pipeline)+1)
+	copy(pipeline, bsonQuery.Pipeline)
+	return append(pipeline, bson.M{"$facet": bson.M{
+		"results": m.optionsPipelineStages(bsonQuery, options),
+		"total":   []bson.M{{"$count": "total"}},
+	}})
+}
+
+// optionsPipelineStages returns the stages following a query's pipeline for its options. When resources are
+// included, the resources looked up for chained and reverse chained (_has) parameters are removed first: they
+// have done their job and would otherwise take up room in the results next to the included resources, which
+// for a _revinclude of the reference a _has goes through are the same resources.
+func (m *MongoSearcher) optionsPipelineStages(bsonQuery *BSONQuery, options *QueryOptions) []bson.M {
+	stages := m.convertOptionsToPipelineStages(bsonQuery.Resource, options)
+	if len(options.Include) == 0 && len(options.RevInclude) == 0 {
+		return stages
+	}
+	exclusions := bson.M{}
+	for _, stage := range bsonQuery.Pipeline {
+		if lookup, isLookup := stage["$lookup"].(bson.M); isLookup {
+			if as, _ := lookup["as"].(string); strings.HasPrefix(as, "_lookup") {
+				exclusions[as] = 0
+			}
+		}
+	}
+	if len(exclusions) == 0 {
+		return stages
+	}
+	return append([]bson.M{{"$project": exclusions}}, stages...)
+}
+
 func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *QueryOptions) []bson.M {
 	p := []bson.M{}
 
 	// support for _sort
-	removeParallelArraySorts(o)
 	if len(o.Sort) > 0 {
+		// MongoDB can't sort on parallel arrays, so then arrays are sorted by a key
+		// added for the purpose, the element MongoDB would have sorted the array by
+		parallel := hasParallelArraySorts(o)
+		sortKeys := bson.M{}
+		var lookups []string
 		var sortBSOND bson.D
-		for _, sort := range o.Sort {
-			// Note: If there are multiple paths, we only look at the first one -- not ideal, but otherwise it gets tricky
-			field := convertSearchPathToMongoField(sort.Parameter.Paths[0].Path)
+		for i, sort := range o.Sort {
+			if sort.Reference != nil {
+				// chained sorts are on the referenced resources, looked up as for chained searches
+				p = append(p, bson.M{"$lookup": bson.M{
+					"from":         models.PluralizeLowerResourceName(sort.Parameter.Resource),
+					"localField":   convertSearchPathToMongoField(sort.Reference.Paths[0].Path) + ".reference__id",
+					"foreignField": "_id",
+					"as":           sortLookup(i),
+				}})
+				lookups = append(lookups, sortLookup(i))
+			}
+			path := sortPath(o, i)
+			field := convertSearchPathToMongoField(path)
+			if m.sortsMissingValues(sort) {
+				// resources without a value are put first or last by sorting on whether they have one
+				key := fmt.Sprintf("_missingKey%d", i)
+				sortKeys[key] = missingValueKey(field)
+				missingOrder := 1
+				if m.missingValuesOrder == MissingValuesFirst {
+					missingOrder = -1
+				}
+				sortBSOND = append(sortBSOND, bson.E{Key: key, Value: missingOrder})
+			}
+			if parallel && strings.Contains(path, "[]") {
+				key := fmt.Sprintf("_sortKey%d", i)
+				sortKeys[key] = arraySortKey(field, strings.Count(path, "[]"), sort.Descending)
+				field = key
+			}
 			order := 1
 			if sort.Descending {
 				order = -1
 			}
 			sortBSOND = append(sortBSOND, bson.E{Key: field, Value: order})
 		}
+		// The sort follows any $lookup stages so can't use an index anyway
+		sortBSOND = withIDTieBreak(sortBSOND)
+		if len(sortKeys) > 0 {
+			p = append(p, bson.M{"$addFields": sortKeys})
+		}
 		p = append(p, bson.M{"$sort": sortBSOND})
+		if len(sortKeys) > 0 || len(lookups) > 0 {
+			exclusions := bson.M{}
+			for key := range sortKeys {
+				exclusions[key] = 0
+			}
+			for _, lookup := range lookups {
+				exclusions[lookup] = 0
+			}
+			p = append(p, bson.M{"$project": exclusions})
+		}
 	}
 
 	// support for _offset
@@ -527,9 +1187,12 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 	// support for _count
 	p = append(p, bson.M{"$limit": o.Count})
 
-	// support for _include
-	if len(o.Include) > 0 {
+	// support for _include (except _include=*, see resolveWildcardIncludes)
+	if len(o.Include) > 0 && !o.IsIncludeAll {
 		for _, incl := range o.Include {
+			if incl.Iterate {
+				continue // see resolveIterativeIncludes
+			}
 			for _, inclPath := range incl.Parameter.Paths {
 				if inclPath.Type != "Reference" {
 					continue
@@ -558,9 +1221,12 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 		}
 	}
 
-	// support for _revinclude
-	if len(o.RevInclude) > 0 {
+	// support for _revinclude (except _revinclude=*)
+	if len(o.RevInclude) > 0 && !o.IsRevincludeAll {
 		for _, incl := range o.RevInclude {
+			if incl.Iterate {
+				continue // see resolveIterativeIncludes
+			}
 			// we only want parameters that have the search resource as their target
 			targetsSearchResource := false
 			for _, inclTarget := range incl.Parameter.Targets {
@@ -604,29 +1270,52 @@ func (m *MongoSearcher) convertOptionsToPipelineStages(resource string, o *Query
 func (m *MongoSearcher) createChainedSearchPipelineStages(searchParam SearchParam) []bson.M {
 	// This returns stages in the pipeline that represent a chained query reference:
 	// 1. One or more $lookup stages for the foreign Resource being referenced (one for each search path)
-	// 2. A $match on that foreign Resource
+	//    and, for multi-level chains (e.g. patient.organization.name), further $lookup stages for each hop
+	// 2. A $match on the last Resource in the chain
 
 	// Build the $lookups. We need to get a ReferenceParam (of type ChainedQueryReference)
 	// that we can use to populate the $lookup. If it's an OR, any one of its Items
 	// should do.
 	lookupRef, isOr := getLookupReference(searchParam)
 
-	chainedRef, ok := lookupRef.Reference.(ChainedQueryReference)
-	if !ok {
-		panic(createInternalServerError("", "ReferenceParam is not of type ChainedQueryReference"))
-	}
+	var stages []bson.M
+	parentLookups := []string{""}
 
-	// We need a $lookup stage for each path, followed by one $match stage
-	stages := make([]bson.M, len(lookupRef.getInfo().Paths)+1)
-	collectionName := models.PluralizeLowerResourceName(chainedRef.Type)
+	for {
+		chainedRef, ok := lookupRef.Reference.(ChainedQueryReference)
+		if !ok {
+			panic(createInternalServerError("", "ReferenceParam is not of type ChainedQueryReference"))
+		}
 
-	for i, path := range lookupRef.Paths {
-		stages[i] = bson.M{"$lookup": bson.M{
-			"from":         collectionName,
-			"localField":   convertSearchPathToMongoField(path.Path) + ".reference__id",
-			"foreignField": "_id",
-			"as":           "_lookup" + strconv.Itoa(i),
-		}}
+		// We need a $lookup stage for each path of each $lookup done for the previous hop
+		collectionName := models.PluralizeLowerResourceName(chainedRef.Type)
+		var lookups []string
+
+		for _, parent := range parentLookups {
+			for i, path := range lookupRef.Paths {
+				localField := convertSearchPathToMongoField(path.Path) + ".reference__id"
+				as := "_lookup" + strconv.Itoa(i)
+				if parent != "" {
+					localField = parent + "." + localField
+					as = parent + "_" + strconv.Itoa(i)
+				}
+				stages = append(stages, bson.M{"$lookup": bson.M{
+					"from":         collectionName,
+					"localField":   localField,
+					"foreignField": "_id",
+					"as":           as,
+				}})
+				lookups = append(lookups, as)
+			}
+		}
+		parentLookups = lookups
+
+		// Keep going while the chained query is itself a chain (e.g. organization.name)
+		chainedParams := chainedRef.ChainedQuery.Params()
+		if len(chainedParams) != 1 || !usesChainedSearch(chainedParams[0]) {
+			break
+		}
+		lookupRef, _ = getLookupReference(chainedParams[0])
 	}
 
 	// Build the $match. This is based on each ReferenceParam's ChainedQuery, so we'll
@@ -639,18 +1328,38 @@ func (m *MongoSearcher) createChainedSearchPipelineStages(searchParam SearchPara
 		// ChainedQuery.Params() results. So let's do that.
 		orParam, _ := searchParam.(*OrParam)
 		searchableOrParam := buildSearchableOrFromChainedReferenceOr(orParam)
-		matchableParams = prependLookupKeyToSearchPaths([]SearchParam{searchableOrParam}, len(lookupRef.Paths))
+		matchableParams = prependLookupKeyToSearchPaths([]SearchParam{searchableOrParam}, parentLookups)
 
 	} else {
-		matchableParams = prependLookupKeyToSearchPaths(chainedRef.ChainedQuery.Params(), len(lookupRef.Paths))
+		chainedRef, _ := searchParam.(*ReferenceParam).Reference.(ChainedQueryReference)
+		var leafParams []SearchParam
+		for _, p := range chainedRef.ChainedQuery.Params() {
+			leafParams = append(leafParams, chainedSearchLeaf(p))
+		}
+		matchableParams = prependLookupKeyToSearchPaths(leafParams, parentLookups)
 	}
 
-	stages[len(stages)-1] = bson.M{"$match": m.createQueryObjectFromParams(matchableParams)}
+	stages = append(stages, bson.M{"$match": m.createQueryObjectFromParams(matchableParams)})
 
 	// TODO: Add a $project stage to remove the field after the $match (need Mongo 3.4)
 	return stages
 }
 
+// chainedSearchLeaf follows a multi-level chained search parameter down to the
+// parameter on the last resource in the chain. Given the "organization" parameter
+// from Patient?organization.name=Acme this returns the Organization "name" parameter.
+// Anything that isn't a chained search is returned as is.
+func chainedSearchLeaf(searchParam SearchParam) SearchParam {
+	if !usesChainedSearch(searchParam) {
+		return searchParam
+	}
+	if orParam, isOr := searchParam.(*OrParam); isOr {
+		return buildSearchableOrFromChainedReferenceOr(orParam)
+	}
+	chainedRef, _ := searchParam.(*ReferenceParam).Reference.(ChainedQueryReference)
+	return chainedSearchLeaf(chainedRef.ChainedQuery.Params()[0]) // There should only ever be 1 SearchParam here
+}
+
 func (m *MongoSearcher) createReverseChainedSearchPipelineStages(searchParam SearchParam) []bson.M {
 	// This returns stages in the pipeline that represent a chained query reference:
 	// 1. One or more $lookup stages for the foreign Resource being referenced (one for each search path)
@@ -670,12 +1379,15 @@ func (m *MongoSearcher) createReverseChainedSearchPipelineStages(searchParam Sea
 	stages := make([]bson.M, len(lookupRef.getInfo().Paths)+1)
 	collectionName := models.PluralizeLowerResourceName(revChainedRef.Type)
 
+	lookups := make([]string, len(lookupRef.Paths))
+
 	for i, path := range lookupRef.Paths {
+		lookups[i] = "_lookup" + strconv.Itoa(i)
 		stages[i] = bson.M{"$lookup": bson.M{
 			"from":         collectionName,
 			"localField":   "_id",
 			"foreignField": convertSearchPathToMongoField(path.Path) + ".reference__id",
-			"as":           "_lookup" + strconv.Itoa(i),
+			"as":           lookups[i],
 		}}
 	}
 
@@ -689,10 +1401,10 @@ func (m *MongoSearcher) createReverseChainedSearchPipelineStages(searchParam Sea
 		// Query.Params() results. So let's do that.
 		orParam, _ := searchParam.(*OrParam)
 		searchableOrParam := buildSearchableOrFromChainedReferenceOr(orParam)
-		matchableParams = prependLookupKeyToSearchPaths([]SearchParam{searchableOrParam}, len(lookupRef.Paths))
+		matchableParams = prependLookupKeyToSearchPaths([]SearchParam{searchableOrParam}, lookups)
 
 	} else {
-		matchableParams = prependLookupKeyToSearchPaths(revChainedRef.Query.Params(), len(lookupRef.Paths))
+		matchableParams = prependLookupKeyToSearchPaths(revChainedRef.Query.Params(), lookups)
 	}
 
 	stages[len(stages)-1] = bson.M{"$match": m.createQueryObjectFromParams(matchableParams)}
@@ -720,13 +1432,14 @@ func getLookupReference(searchParam SearchParam) (lookupRef *ReferenceParam, isO
 	return
 }
 
-// Prepends "_lookup[i]." to the search path(s), where [i] >= 0. This mutates
+// Prepends the name of a $lookup (e.g. "_lookup0.") to the search path(s). When there are
+// several lookups the paths are duplicated so each one is tested. This mutates
 // the SearchParams by altering the paths in their SearchParamInfos. To prevent
 // modifying the SearchParameterDictionary each SearchParamInfo is cloned before
 // being mutated.
-func prependLookupKeyToSearchPaths(searchParams []SearchParam, numReferencePaths int) []SearchParam {
+func prependLookupKeyToSearchPaths(searchParams []SearchParam, lookups []string) []SearchParam {
 
-	prependStr := "_lookup"
+	numLookups := len(lookups)
 
 	// Make a copy first so we can safely mutate the params
 	matchParams := make([]SearchParam, len(searchParams))
@@ -740,27 +1453,27 @@ func prependLookupKeyToSearchPaths(searchParams []SearchParam, numReferencePaths
 			for _, item := range param.Items {
 				searchInfo := item.getInfo().clone()
 
-				if numReferencePaths > 1 {
-					// If we have multiple reference paths we need to duplicate the SearchParamPaths
+				if numLookups > 1 {
+					// If we have multiple lookups we need to duplicate the SearchParamPaths
 					// for each matchable SearchParam so we can test against each $lookup in one $or
 					// clause.
-					duplicatePaths(&searchInfo, numReferencePaths)
+					duplicatePaths(&searchInfo, numLookups)
 				}
 
 				for i, searchPath := range searchInfo.Paths {
-					searchInfo.Paths[i].Path = prependStr + strconv.Itoa(i%numReferencePaths) + "." + searchPath.Path
+					searchInfo.Paths[i].Path = lookups[i%numLookups] + "." + searchPath.Path
 				}
 				item.setInfo(searchInfo)
 			}
 		default:
 			searchInfo := matchParam.getInfo().clone()
 
-			if numReferencePaths > 1 {
-				duplicatePaths(&searchInfo, numReferencePaths)
+			if numLookups > 1 {
+				duplicatePaths(&searchInfo, numLookups)
 			}
 
 			for i, searchPath := range searchInfo.Paths {
-				searchInfo.Paths[i].Path = prependStr + strconv.Itoa(i%numReferencePaths) + "." + searchPath.Path
+				searchInfo.Paths[i].Path = lookups[i%numLookups] + "." + searchPath.Path
 			}
 			matchParam.setInfo(searchInfo)
 		}
@@ -799,7 +1512,7 @@ func buildSearchableOrFromChainedReferenceOr(referenceOr *OrParam) *OrParam {
 
 		switch ref := refParam.Reference.(type) {
 		case ChainedQueryReference:
-			searchParam = ref.ChainedQuery.Params()[0] // There should only ever be 1 SearchParam here
+			searchParam = chainedSearchLeaf(ref.ChainedQuery.Params()[0]) // There should only ever be 1 SearchParam here
 		case ReverseChainedQueryReference:
 			searchParam = ref.Query.Params()[0]
 		}
@@ -808,7 +1521,30 @@ func buildSearchableOrFromChainedReferenceOr(referenceOr *OrParam) *OrParam {
 	return newOr
 }
 
+// panicOnInvalidChains rejects chained searches through parameters that aren't references
+// (e.g. Condition?code.foo=bar), which would otherwise be treated as a search on the parameter itself
+func panicOnInvalidChains(query Query) {
+	for _, p := range query.Params() {
+		params := []SearchParam{p}
+		if orParam, isOr := p.(*OrParam); isOr {
+			params = orParam.Items
+		}
+		for _, p := range params {
+			info := p.getInfo()
+			if info.Postfix != "" && info.Type != "reference" {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: only reference parameters can be chained", info.Name)))
+			}
+		}
+	}
+}
+
 func panicOnUnsupportedFeatures(p SearchParam) {
+	// The items of an OR (or of a _filter expression) are checked individually when they're converted
+	switch p.(type) {
+	case *OrParam, *AndParam, *NotParam, *FilterExpressionParam:
+		return
+	}
+
 	// No prefixes are supported except EQ (the default) and number, date, and quantity prefixes
 	_, isDate := p.(*DateParam)
 	_, isNumber := p.(*NumberParam)
@@ -819,18 +1555,133 @@ func panicOnUnsupportedFeatures(p SearchParam) {
 		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", p.getInfo().Name)))
 	}
 
-	// No modifiers are supported except for resource types in reference parameters
+	// No modifiers are supported except for resource types and :identifier in reference
+	// parameters and :text, :above and :below on token parameters
 	_, isRef := p.(*ReferenceParam)
+	_, isToken := p.(*TokenParam)
 	modifier := p.getInfo().Modifier
 	if modifier != "" {
-		if _, ok := SearchParameterDictionary[modifier]; !isRef || !ok {
+		_, isResourceType := SearchParameterDictionary[modifier]
+		if !(isRef && (isResourceType || modifier == "identifier")) && !(isToken && (modifier == "text" || modifier == "above" || modifier == "below")) {
 			panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", p.getInfo().Name)))
 		}
 	}
 }
 
+// SupportedModifiers returns the modifiers that panicOnUnsupportedFeatures allows for a search parameter
+func SupportedModifiers(info SearchParamInfo) []string {
+	switch info.Type {
+	case "reference":
+		var modifiers []string
+		for _, target := range info.Targets {
+			if _, isResourceType := SearchParameterDictionary[target]; isResourceType {
+				modifiers = append(modifiers, target)
+			}
+		}
+		return append(modifiers, "identifier")
+	case "token":
+		return []string{"text", "above", "below"}
+	default:
+		return nil
+	}
+}
+
+// checkIndexed panics if none of the parameters of a search with criteria can use an index,
+// as MongoDB would have to scan the whole collection
+func (m *MongoSearcher) checkIndexed(query Query) {
+	params := query.Params()
+	if len(params) == 0 {
+		return
+	}
+	indexedFields := m.indexedFields[models.PluralizeLowerResourceName(query.Resource)]
+	for _, param := range params {
+		info := param.getInfo()
+		if info.Name == "_has" {
+			// matched by _id, after searching the other resource
+			return
+		}
+		for _, path := range info.Paths {
+			field := convertSearchPathToMongoField(path.Path)
+			if field == "_id" {
+				return
+			}
+			for _, indexedField := range indexedFields {
+				if indexedField == field || strings.HasPrefix(indexedField, field+".") {
+					return
+				}
+			}
+		}
+	}
+	panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("None of the parameters of this %s search can use an index; please narrow the search with an indexed parameter (e.g. a reference)", query.Resource)))
+}
+
+// createCompositeQueryObject supports composites of a token and a date (e.g. Observation
+// code-value-date=http://loinc.org|1234$ge2018-01-01). When the components are on the same element
+// of an array, both criteria are put in one $elemMatch so that they have to match that element.
 func (m *MongoSearcher) createCompositeQueryObject(c *CompositeParam) bson.M {
-	panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	components := compositeComponents(c)
+	token, isToken := components[0].(*TokenParam)
+	date, isDate := components[len(components)-1].(*DateParam)
+	if len(components) != 2 || !isToken || !isDate {
+		panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", c.Name)))
+	}
+
+	var results []bson.M
+	for _, tokenPath := range token.Paths {
+		for _, datePath := range date.Paths {
+			element, relTokenPath, relDatePath := commonArrayElement(tokenPath.Path, datePath.Path)
+
+			t := *token
+			t.Paths = []SearchParamPath{{Path: relTokenPath, Type: tokenPath.Type}}
+			d := *date
+			d.Paths = []SearchParamPath{{Path: relDatePath, Type: datePath.Type}}
+
+			criteria := m.createTokenQueryObject(&t)
+			merge(criteria, m.createDateQueryObject(&d))
+			if element != "" {
+				criteria = bson.M{convertSearchPathToMongoField(element): bson.M{"$elemMatch": criteria}}
+			}
+			results = append(results, criteria)
+		}
+	}
+
+	if len(results) == 1 {
+		return results[0]
+	}
+	return bson.M{"$or": results}
+}
+
+// compositeComponents parses the values of a composite parameter using the parameters it is composed of
+func compositeComponents(c *CompositeParam) []SearchParam {
+	if len(c.CompositeValues) != len(c.Composites) {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", c.Name)))
+	}
+	components := make([]SearchParam, len(c.Composites))
+	for i, name := range c.Composites {
+		info, ok := SearchParameterDictionary[c.Resource][name]
+		if !ok {
+			panic(createInternalServerError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", name)))
+		}
+		components[i] = info.CreateSearchParam(c.CompositeValues[i])
+	}
+	return components
+}
+
+// commonArrayElement returns the deepest array element (e.g. "[]component") containing both paths
+// and the paths relative to it, or an empty element if the paths are not within the same array
+func commonArrayElement(path1, path2 string) (element, rel1, rel2 string) {
+	parts1 := strings.Split(path1, ".")
+	parts2 := strings.Split(path2, ".")
+	common := 0
+	for i := 0; i < len(parts1)-1 && i < len(parts2)-1 && parts1[i] == parts2[i]; i++ {
+		if strings.HasPrefix(parts1[i], "[]") {
+			common = i + 1
+		}
+	}
+	if common == 0 {
+		return "", path1, path2
+	}
+	return strings.Join(parts1[:common], "."), strings.Join(parts1[common:], "."), strings.Join(parts2[common:], ".")
 }
 
 func (m *MongoSearcher) createDateQueryObject(d *DateParam) bson.M {
@@ -843,7 +1694,8 @@ func (m *MongoSearcher) createDateQueryObject(d *DateParam) bson.M {
 		case "Period":
 			return buildBSON(p.Path, periodSelector(d))
 		case "Timing":
-			return buildBSON(p.Path+".event", dateSelector(d))
+			// Timing.event is a repeating dateTime so the range of a single event has to match
+			return buildBSON(p.Path+".[]event", dateSelector(d))
 		default:
 			return bson.M{}
 		}
@@ -865,6 +1717,22 @@ func dateSelector(d *DateParam) bson.M {
 				"$lte": d.Date.RangeHighExcl(),
 			},
 		}
+	case NE:
+		return bson.M{
+			// "the range of the search value does not fully contain the range of the target value"
+			"$or": []bson.M{
+				bson.M{
+					"__from": bson.M{
+						"$lt": d.Date.RangeLowIncl(),
+					},
+				},
+				bson.M{
+					"__to": bson.M{
+						"$gt": d.Date.RangeHighExcl(),
+					},
+				},
+			},
+		}
 	case GT:
 		return bson.M{
 			// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
@@ -941,6 +1809,13 @@ func instantSelector(p *DateParam) bson.M {
 			"$gte": p.Date.RangeLowIncl(),
 			"$lt":  p.Date.RangeHighExcl(),
 		}
+	case NE:
+		timestamp = bson.M{
+			"$or": []bson.M{
+				bson.M{"$lt": p.Date.RangeLowIncl()},
+				bson.M{"$gte": p.Date.RangeHighExcl()},
+			},
+		}
 	case GT:
 		timestamp = bson.M{
 			"$gt": p.Date.RangeLowIncl(),
@@ -980,6 +1855,31 @@ func periodSelector(d *DateParam) bson.M {
 				"$lte": d.Date.RangeHighExcl(),
 			},
 		}
+	case NE:
+		// "the range of the search value does not fully contain the range of the target value"
+		return bson.M{
+			"$or": []bson.M{
+				bson.M{
+					"start.__from": bson.M{
+						"$lt": d.Date.RangeLowIncl(),
+					},
+				},
+				bson.M{
+					"end.__to": bson.M{
+						"$gt": d.Date.RangeHighExcl(),
+					},
+				},
+				// Also support instances where period exists, but start or end is null (open-ended)
+				bson.M{
+					"$ne":   nil,
+					"start": nil,
+				},
+				bson.M{
+					"$ne": nil,
+					"end": nil,
+				},
+			},
+		}
 	case GT:
 		// "the range above the search value intersects (i.e. overlaps) with the range of the target value"
 		return bson.M{
@@ -1084,9 +1984,16 @@ func (m *MongoSearcher) createNumberQueryObject(n *NumberParam) bson.M {
 
 		var criteria bson.M
 
+		// The range [l, h) is implied by the number of decimal places in the search value (e.g. 0.25 is
+		// [0.245, 0.255) while 100 is [99.5, 100.5)). Integer types are stored as plain numbers whereas
+		// decimals are stored as { __from, __to, __num, __strNum } (see models2.ConvertJsonToGoFhirBSON)
+		// so are compared by their __num value.
+		path := p.Path
 		if p.Type == "decimal" {
-			// TODO
-			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" (decimal type) is not yet supported", n.Name)))
+			path += "." + models2.Gofhir__num
+		} else if isQuantityType(p.Type) {
+			// e.g. Encounter.length is a Duration, compared by its decimal value
+			path += ".value." + models2.Gofhir__num
 		}
 
 		switch n.Prefix {
@@ -1124,12 +2031,22 @@ func (m *MongoSearcher) createNumberQueryObject(n *NumberParam) bson.M {
 			// SA, EB are not supported for Number queries
 			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", n.Name)))
 		}
-		return buildBSON(p.Path, criteria)
+		return buildBSON(path, criteria)
 	}
 
 	return orPaths(single, n.Paths)
 }
 
+// isQuantityType tests if elements of a FHIR type share the structure of a Quantity
+// (i.e. value, comparator, unit, system and code), as its profiles do in STU3
+func isQuantityType(fhirType string) bool {
+	switch fhirType {
+	case "Quantity", "SimpleQuantity", "Age", "Count", "Distance", "Duration", "Money":
+		return true
+	}
+	return false
+}
+
 func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 	single := func(p SearchParamPath) bson.M {
 		l, _ := q.Number.RangeLowIncl().Float64()
@@ -1196,8 +2113,17 @@ func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 			panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", q.Name)))
 		}
 
-		if q.System == "" {
+		switch {
+		case q.System != "":
+			criteria["code"] = m.ciToken(q.Code)
+			criteria["system"] = m.ciToken(q.System)
+
+		case p.Type == "Money" && q.Code != "":
+			// In STU3 Money is a Quantity whose code is an ISO 4217 currency (e.g. 100||USD), so
+			// unlike other quantities there's no need to also search its unit
+			criteria["code"] = m.ciToken(q.Code)
 
+		default:
 			// FIXME: need to search by both the 'units' and 'code' field...............
 			// (http://build.fhir.org/search.html#quantity)
 			// however query with $and is not working since the $and seems to need to be at the
@@ -1217,10 +2143,6 @@ func (m *MongoSearcher) createQuantityQueryObject(q *QuantityParam) bson.M {
 			// } else {
 			// 	criteria["$or"] = orClause
 			// }
-
-		} else {
-			criteria["code"] = m.ciToken(q.Code)
-			criteria["system"] = m.ciToken(q.System)
 		}
 		return buildBSON(p.Path, criteria)
 	}
@@ -1241,7 +2163,22 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 				criteria["reference__type"] = ref.Type
 			}
 		case ExternalReference:
-			criteria["reference"] = m.ci(ref.URL)
+			if local, ok := m.serverLocalReference(ref); ok {
+				criteria["reference__id"] = local.ID
+				criteria["reference__type"] = local.Type
+			} else {
+				criteria["reference"] = m.ci(ref.URL)
+			}
+		case IdentifierReference:
+			if ref.Value != "" {
+				criteria["identifier.value"] = m.ciToken(ref.Value)
+			}
+			if ref.System != "" {
+				criteria["identifier.system"] = m.ciToken(ref.System)
+			} else if !ref.AnySystem {
+				// [parameter]:identifier=|[value]
+				criteria["identifier.system"] = bson.M{"$exists": false}
+			}
 
 		case ChainedQueryReference:
 			// This should be handled exclusively by the createPipelineObject
@@ -1257,6 +2194,19 @@ func (m *MongoSearcher) createReferenceQueryObject(r *ReferenceParam) bson.M {
 	return orPaths(single, r.Paths)
 }
 
+// serverLocalReference converts an absolute URL reference to a resource on this server
+// (e.g. http://example.com/fhir/Patient/123) to the equivalent local reference
+func (m *MongoSearcher) serverLocalReference(ref ExternalReference) (LocalReference, bool) {
+	if m.serverBase == "" || len(ref.URL) <= len(m.serverBase) || !strings.EqualFold(ref.URL[:len(m.serverBase)], m.serverBase) {
+		return LocalReference{}, false
+	}
+	parts := strings.Split(ref.URL[len(m.serverBase):], "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" || (ref.Type != "" && parts[0] != ref.Type) {
+		return LocalReference{}, false
+	}
+	return LocalReference{Type: parts[0], ID: parts[1]}, true
+}
+
 func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p SearchParamPath) bson.M {
 	criteria := bson.M{}
 	switch ref := r.Reference.(type) {
@@ -1270,47 +2220,93 @@ func (m *MongoSearcher) createInlinedReferenceQueryObject(r *ReferenceParam, p S
 		if ref.Type != "" {
 			criteria["resourceType"] = ref.Type
 		}
-	case ExternalReference:
+	case ExternalReference, IdentifierReference:
 		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
 	}
 	return buildBSON(p.Path, criteria)
 }
 
 func (m *MongoSearcher) createStringQueryObject(s *StringParam) bson.M {
+	m = m.withCaseSensitivityOf(s.SearchParamInfo)
+	partMatch, fullMatch := m.cisw, m.ci
+	if s.Match != "" {
+		partMatch = func(str string) interface{} { return m.ciMatch(str, s.Match) }
+		fullMatch = partMatch
+	}
+
 	single := func(p SearchParamPath) bson.M {
 		switch p.Type {
 		case "HumanName":
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"family": m.cisw(s.String)},
-					bson.M{"given": m.cisw(s.String)},
+					bson.M{"text": partMatch(s.String)},
+					bson.M{"family": partMatch(s.String)},
+					bson.M{"given": partMatch(s.String)},
 				},
 			})
 		case "Address":
 			return buildBSON(p.Path, bson.M{
 				"$or": []bson.M{
-					bson.M{"text": m.cisw(s.String)},
-					bson.M{"line": m.cisw(s.String)},
-					bson.M{"city": m.cisw(s.String)},
-					bson.M{"state": m.cisw(s.String)},
-					bson.M{"postalCode": m.cisw(s.String)},
-					bson.M{"country": m.cisw(s.String)},
+					bson.M{"text": partMatch(s.String)},
+					bson.M{"line": partMatch(s.String)},
+					bson.M{"city": partMatch(s.String)},
+					bson.M{"state": partMatch(s.String)},
+					bson.M{"postalCode": partMatch(s.String)},
+					bson.M{"country": partMatch(s.String)},
 				},
 			})
 		default:
-			if s.Name == "_id" {
+			if s.Name == "_id" && s.Match == "" {
 				return buildBSON(p.Path, s.String)
 			}
 
-			return buildBSON(p.Path, m.ci(s.String))
+			return buildBSON(p.Path, fullMatch(s.String))
 		}
 	}
 
 	return orPaths(single, s.Paths)
 }
 
+// createTokenSubsumptionQueryObject matches the code of an :above or :below search as well as
+// the codes the registered SubsumptionResolver expands it into
+func (m *MongoSearcher) createTokenSubsumptionQueryObject(t *TokenParam) bson.M {
+	codes := []string{t.Code}
+	if t.Code != "" {
+		for _, code := range GlobalSubsumptionResolver().ResolveSubsumption(t.System, t.Code, t.Modifier) {
+			if !contains(codes, code) {
+				codes = append(codes, code)
+			}
+		}
+	}
+
+	var results []bson.M
+	for _, code := range codes {
+		expanded := *t
+		expanded.Modifier = ""
+		expanded.Code = code
+		result := m.createTokenQueryObject(&expanded)
+		// As in orPaths, bring the components of an $or up to the top-level $or
+		if nestedOrs, ok := result["$or"].([]bson.M); ok && len(result) == 1 {
+			results = append(results, nestedOrs...)
+		} else {
+			results = append(results, result)
+		}
+	}
+
+	if len(results) == 1 {
+		return results[0]
+	}
+	return bson.M{"$or": results}
+}
+
 func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
+	m = m.withCaseSensitivityOf(t.SearchParamInfo)
+	if t.Modifier == "text" {
+		return m.createTokenTextQueryObject(t)
+	}
+	if t.Modifier == "above" || t.Modifier == "below" {
+		return m.createTokenSubsumptionQueryObject(t)
+	}
 
 	var systemCriteria interface{}
 	var codeCriteria interface{}
@@ -1362,9 +2358,14 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 				criteria["value"] = codeCriteria
 			}
 		case "ContactPoint":
-			criteria["value"] = m.ci(t.Code)
-			if !t.AnySystem {
-				criteria["use"] = m.ciToken(t.System)
+			// [parameter]=[system]|[value] where the system is phone, email etc.
+			if p.System != "" {
+				criteria["system"] = p.System
+			} else if systemCriteria != nil {
+				criteria["system"] = systemCriteria
+			}
+			if t.Code != "" {
+				criteria["value"] = m.ci(t.Code)
 			}
 		case "boolean":
 			switch t.Code {
@@ -1390,6 +2391,30 @@ func (m *MongoSearcher) createTokenQueryObject(t *TokenParam) bson.M {
 	return orPaths(single, t.Paths)
 }
 
+// createTokenTextQueryObject handles the :text modifier, which searches the text
+// associated with a code (e.g. _tag:text searches meta.tag.display) instead of the code itself
+func (m *MongoSearcher) createTokenTextQueryObject(t *TokenParam) bson.M {
+	text := m.cisw(t.Code)
+
+	single := func(p SearchParamPath) bson.M {
+		switch p.Type {
+		case "Coding":
+			return buildBSON(p.Path+".display", text)
+		case "CodeableConcept":
+			return buildBSON(p.Path, bson.M{"$or": []bson.M{
+				bson.M{"text": text},
+				bson.M{"coding.display": text},
+			}})
+		case "Identifier":
+			return buildBSON(p.Path+".type.text", text)
+		default:
+			panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", t.Name)))
+		}
+	}
+
+	return orPaths(single, t.Paths)
+}
+
 func (m *MongoSearcher) createURIQueryObject(u *URIParam) bson.M {
 	single := func(p SearchParamPath) bson.M {
 		return buildBSON(p.Path, u.URI)
@@ -1404,6 +2429,19 @@ func (m *MongoSearcher) createOrQueryObject(o *OrParam) bson.M {
 	}
 }
 
+func (m *MongoSearcher) createAndQueryObject(a *AndParam) bson.M {
+	return bson.M{
+		"$and": m.createParamObjects(a.Items),
+	}
+}
+
+func (m *MongoSearcher) createNotQueryObject(n *NotParam) bson.M {
+	// $not only applies to a single field, so the whole item is negated with $nor
+	return bson.M{
+		"$nor": m.createParamObjects([]SearchParam{n.Item}),
+	}
+}
+
 // Error is an interface for search errors, providing an HTTP status and operation outcome
 type Error struct {
 	HTTPStatus       int
@@ -1504,28 +2542,92 @@ func convertBracketIndexesToDotIndexes(path string) string {
 	return re.ReplaceAllString(path, "$2.$1")
 }
 
+// sortsMissingValues returns true if a sort has to put resources without a value of its parameter
+// elsewhere than MongoDB would (see SetMissingValuesOrder)
+func (m *MongoSearcher) sortsMissingValues(sort SortOption) bool {
+	if sort.Parameter.Paths[0].Path == "_id" {
+		return false // every resource has one
+	}
+	switch m.missingValuesOrder {
+	case MissingValuesFirst:
+		return sort.Descending
+	case MissingValuesLast:
+		return !sort.Descending
+	}
+	return false
+}
+
+func (m *MongoSearcher) hasMissingValuesSorts(o *QueryOptions) bool {
+	for _, sort := range o.Sort {
+		if m.sortsMissingValues(sort) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasChainedSorts(o *QueryOptions) bool {
+	for _, sort := range o.Sort {
+		if sort.Reference != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sortLookup returns the field that the referenced resources of the i'th sort, if chained, are looked up into
+func sortLookup(i int) string {
+	return fmt.Sprintf("_sortLookup%d", i)
+}
+
+// sortPath returns the search path of the i'th sort, which for a chained sort is within the array of
+// resources looked up. If there are multiple paths only the first one is sorted by.
+func sortPath(o *QueryOptions, i int) string {
+	path := o.Sort[i].Parameter.Paths[0].Path
+	if o.Sort[i].Reference != nil {
+		path = "[]" + sortLookup(i) + "." + path
+	}
+	return path
+}
+
+// missingValueKey returns an expression that's true for documents without a value at a field,
+// including those where it's null or, for a path through arrays, an empty array
+func missingValueKey(field string) bson.M {
+	return bson.M{"$in": bson.A{bson.M{"$ifNull": bson.A{"$" + field, nil}}, bson.A{nil, bson.A{}}}}
+}
+
 // MongoDB does not properly sort when keys are in parallel arrays ("Executor error: BadValue cannot sort with keys
-// that are parallel arrays"), so... remove any sort options that have parallel arrays (and log it)
-func removeParallelArraySorts(o *QueryOptions) {
-	npSorts := make([]SortOption, 0, len(o.Sort))
+// that are parallel arrays"), so such searches are sorted in a pipeline by keys computed with arraySortKey
+func hasParallelArraySorts(o *QueryOptions) bool {
 	for i := range o.Sort {
-		sort := o.Sort[i]
-		isParallel := false
-		for _, npSort := range npSorts {
-			isParallel = isParallelArrayPath(sort.Parameter.Paths[0].Path, npSort.Parameter.Paths[0].Path)
-			if isParallel {
-				fmt.Printf("Cannot sub-sort on param '%s' because its path has parallel arrays with previous sort param '%s' (due to limitation in MongoDB)\n.", sort.Parameter.Name, npSort.Parameter.Name)
-				break
+		for j := 0; j < i; j++ {
+			if isParallelArrayPath(sortPath(o, i), sortPath(o, j)) {
+				return true
 			}
 		}
-		if !isParallel {
-			npSorts = append(npSorts, sort)
-		}
 	}
-	// If we ended up removing sort options, update the Options object to reflect that
-	if len(o.Sort) != len(npSorts) {
-		o.Sort = npSorts
+	return false
+}
+
+// arraySortKey returns an expression for the element of an array field (within arrayDepth nested arrays)
+// that MongoDB sorts the array by: the smallest when ascending and the largest when descending
+func arraySortKey(field string, arrayDepth int, descending bool) bson.M {
+	var values interface{} = "$" + field
+	for i := 1; i < arrayDepth; i++ {
+		// e.g. name.given is an array of the given arrays of each name
+		values = bson.M{"$reduce": bson.M{
+			"input":        bson.M{"$ifNull": bson.A{values, bson.A{}}},
+			"initialValue": bson.A{},
+			"in": bson.M{"$concatArrays": bson.A{
+				"$$value",
+				bson.M{"$cond": bson.A{bson.M{"$isArray": "$$this"}, "$$this", bson.A{"$$this"}}},
+			}},
+		}}
+	}
+	if descending {
+		return bson.M{"$max": values}
 	}
+	return bson.M{"$min": values}
 }
 
 func isParallelArrayPath(path1 string, path2 string) bool {
@@ -1610,6 +2712,28 @@ func (m *MongoSearcher) cisw(s string) interface{} {
 	return s
 }
 
+// Case-insensitive equals, contains, starts-with or ends-with match for a _filter comparison
+func (m *MongoSearcher) ciMatch(s string, match StringMatch) interface{} {
+	pattern := regexp.QuoteMeta(s)
+	switch match {
+	case StringMatchEquals:
+		if !m.enableCISearches {
+			return s
+		}
+		pattern = "^" + pattern + "$"
+	case StringMatchStartsWith:
+		pattern = "^" + pattern
+	case StringMatchEndsWith:
+		pattern = pattern + "$"
+	}
+
+	options := ""
+	if m.enableCISearches {
+		options = "i"
+	}
+	return primitive.Regex{Pattern: pattern, Options: options}
+}
+
 // When multiple paths are present, they should be represented as an OR.
 // objFunc is a function that generates a single query for a path
 func orPaths(objFunc func(SearchParamPath) bson.M, paths []SearchParamPath) bson.M {
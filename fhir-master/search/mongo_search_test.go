@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
 	"github.com/pebbe/util"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -139,6 +140,87 @@ func (m *MongoSearchSuite) TestConditionCodeQueryByWrongCodeSystem(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
+// stubSubsumptionResolver knows that 123641001 is subsumed by 73211009 and subsumes 999000001
+type stubSubsumptionResolver struct{}
+
+func (stubSubsumptionResolver) ResolveSubsumption(system, code, modifier string) []string {
+	if system != "http://snomed.info/sct" {
+		return nil
+	}
+	switch {
+	case code == "73211009" && modifier == "below":
+		return []string{"123641001", "999000001"}
+	case code == "123641001" && modifier == "above":
+		return []string{"73211009"}
+	}
+	return nil
+}
+
+func (m *MongoSearchSuite) TestConditionCodeQueryObjectBelow(c *C) {
+	RegisterSubsumptionResolver(stubSubsumptionResolver{})
+	defer RegisterSubsumptionResolver(nil)
+
+	q := Query{"Condition", "code:below=http://snomed.info/sct|73211009"}
+	o := m.MongoSearcher.createQueryObject(q)
+
+	var expected []bson.M
+	for _, code := range []string{"73211009", "123641001", "999000001"} {
+		expected = append(expected, bson.M{
+			"code.coding": bson.M{
+				"$elemMatch": bson.M{
+					"system": primitive.Regex{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+					"code":   primitive.Regex{Pattern: "^" + code + "$", Options: "i"},
+				},
+			},
+		})
+	}
+	c.Assert(o, DeepEquals, bson.M{"$or": expected})
+}
+
+func (m *MongoSearchSuite) TestConditionCodeQueryObjectAbove(c *C) {
+	RegisterSubsumptionResolver(stubSubsumptionResolver{})
+	defer RegisterSubsumptionResolver(nil)
+
+	q := Query{"Condition", "code:above=http://snomed.info/sct|123641001"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"code.coding": bson.M{"$elemMatch": bson.M{
+				"system": primitive.Regex{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+				"code":   primitive.Regex{Pattern: "^123641001$", Options: "i"},
+			}}},
+			bson.M{"code.coding": bson.M{"$elemMatch": bson.M{
+				"system": primitive.Regex{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+				"code":   primitive.Regex{Pattern: "^73211009$", Options: "i"},
+			}}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionCodeQueryObjectBelowWithoutResolver(c *C) {
+	// Without a resolver only the code itself matches
+	q := Query{"Condition", "code:below=http://snomed.info/sct|123641001"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"code.coding": bson.M{
+			"$elemMatch": bson.M{
+				"system": primitive.Regex{Pattern: "^http://snomed\\.info/sct$", Options: "i"},
+				"code":   primitive.Regex{Pattern: "^123641001$", Options: "i"},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionCodeQueryBelow(c *C) {
+	RegisterSubsumptionResolver(stubSubsumptionResolver{})
+	defer RegisterSubsumptionResolver(nil)
+
+	q := Query{"Condition", "code:below=http://snomed.info/sct|73211009"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+}
+
 func (m *MongoSearchSuite) TestConditionCodeQueryObjectByCode(c *C) {
 	q := Query{"Condition", "code=123641001"}
 
@@ -388,7 +470,88 @@ func (m *MongoSearchSuite) TestInvalidBooleanValuePanics(c *C) {
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"notgiven\" content is invalid"))
 }
 
-// TODO: Test token searches on code, string, and ContactPoint
+// Tests token searches on ContactPoint
+
+func (m *MongoSearchSuite) TestPatientTelecomQueryObjectBySystemAndValue(c *C) {
+	q := Query{"Patient", "telecom=phone|555-1234"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom": bson.M{
+			"$elemMatch": bson.M{
+				"system": primitive.Regex{Pattern: "^phone$", Options: "i"},
+				"value":  primitive.Regex{Pattern: "^555-1234$", Options: "i"},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestPatientTelecomQueryObjectByValue(c *C) {
+	q := Query{"Patient", "telecom=555-1234"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom.value": primitive.Regex{Pattern: "^555-1234$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestPatientEmailQueryObject(c *C) {
+	q := Query{"Patient", "email=john.peters@example.com"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"telecom": bson.M{
+			"$elemMatch": bson.M{
+				"system": "email",
+				"value":  primitive.Regex{Pattern: "^john\\.peters@example\\.com$", Options: "i"},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestPatientTelecomQuery(c *C) {
+	q := Query{"Patient", "telecom=phone|555-1234"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "telecom=555-1234"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "telecom=phone|"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+}
+
+func (m *MongoSearchSuite) TestPatientTelecomQueryMatchesSystemAndValueOfSameContactPoint(c *C) {
+	// the patient has this phone number and an email, but not as the same telecom
+	q := Query{"Patient", "telecom=email|555-1234"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestPatientEmailAndPhoneQuery(c *C) {
+	q := Query{"Patient", "email=JOHN.PETERS@example.com"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "phone=555-5678"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "phone=john.peters@example.com"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+// TODO: Test token searches on code and string
 
 // Tests reference searches by reference id
 
@@ -455,6 +618,52 @@ func (m *MongoSearchSuite) TestConditionSortByPatientAscending(c *C) {
 	}
 }
 
+func (m *MongoSearchSuite) TestConditionSortByPatientFamily(c *C) {
+	patients := m.Session.DB("fhir-test").C("patients")
+	conditions := m.Session.DB("fhir-test").C("conditions")
+	for i, family := range []string{"Zimmerman", "Adams", "Miller"} {
+		patientID := fmt.Sprintf("5d3a0e5b9a2b1c0001f2%04x", i)
+		patient, err := models.MapToResource(map[string]interface{}{
+			"resourceType": "Patient",
+			"id":           patientID,
+			"name":         []interface{}{map[string]interface{}{"family": family}},
+		}, true)
+		util.CheckErr(err)
+		util.CheckErr(patients.Insert(patient))
+		defer patients.RemoveId(patientID)
+
+		conditionID := fmt.Sprintf("5d3a0e5b9a2b1c0001f3%04x", i)
+		condition, err := models.MapToResource(map[string]interface{}{
+			"resourceType": "Condition",
+			"id":           conditionID,
+			"code":         map[string]interface{}{"coding": []interface{}{map[string]interface{}{"system": "http://example.com", "code": "chained-sort"}}},
+			"subject":      map[string]interface{}{"reference": "Patient/" + patientID},
+		}, true)
+		util.CheckErr(err)
+		util.CheckErr(conditions.Insert(condition))
+		defer conditions.RemoveId(conditionID)
+	}
+
+	sortedSubjects := func(query string) []string {
+		results, _, err := m.MongoSearcher.Search(Query{"Condition", query})
+		util.CheckErr(err)
+		var subjects []string
+		for _, result := range results {
+			var condition models.Condition
+			util.CheckErr(result.Unmarshal(&condition))
+			subjects = append(subjects, condition.Subject.Reference)
+		}
+		return subjects
+	}
+	// Adams, Miller and Zimmerman
+	c.Assert(sortedSubjects("code=chained-sort&_sort=patient.family"), DeepEquals, []string{
+		"Patient/5d3a0e5b9a2b1c0001f20001", "Patient/5d3a0e5b9a2b1c0001f20002", "Patient/5d3a0e5b9a2b1c0001f20000",
+	})
+	c.Assert(sortedSubjects("code=chained-sort&_sort:desc=subject:Patient.family"), DeepEquals, []string{
+		"Patient/5d3a0e5b9a2b1c0001f20000", "Patient/5d3a0e5b9a2b1c0001f20002", "Patient/5d3a0e5b9a2b1c0001f20001",
+	})
+}
+
 func (m *MongoSearchSuite) TestConditionSortByPatientDescending(c *C) {
 	q := Query{"Condition", "_sort:desc=patient"}
 
@@ -512,7 +721,95 @@ func (m *MongoSearchSuite) TestBundleReferenceQueryByMessageId(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
-// TODO: Test execution of reference search on PatientURL (as above)
+func (m *MongoSearchSuite) TestConditionReferenceQueryObjectByPatientURLOnServerBase(c *C) {
+	searcher := NewMongoSearcher(nil, nil, true, true, false, false) // countTotalResults = true, enableCISearches = true, tokenParametersCaseSensitive = false, readonly = false
+	searcher.SetServerBase("http://localhost:3001")
+
+	q := Query{"Condition", "patient=http://localhost:3001/Patient/123456789"}
+	o := searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"subject.reference__id": "123456789", "subject.reference__type": "Patient"})
+
+	// URLs on other servers are still matched by the full URL
+	q = Query{"Condition", "patient=http://acme.com/Patient/123456789"}
+	o = searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{"subject.reference": primitive.Regex{Pattern: "^http://acme\\.com/Patient/123456789$", Options: "i"}})
+}
+
+func (m *MongoSearchSuite) TestConditionReferenceQueryByPatientURL(c *C) {
+	var conditionMap map[string]interface{}
+	util.CheckErr(json.Unmarshal([]byte(`{
+		"resourceType": "Condition",
+		"id": "5d3a0e5b9a2b1c0001f0c0de",
+		"subject": {"reference": "http://acme.com/Patient/123456789"}
+	}`), &conditionMap))
+	condition, err := models.MapToResource(conditionMap, true)
+	util.CheckErr(err)
+	conditions := m.Session.DB("fhir-test").C("conditions")
+	util.CheckErr(conditions.Insert(condition))
+	defer conditions.RemoveId("5d3a0e5b9a2b1c0001f0c0de")
+
+	q := Query{"Condition", "patient=http://acme.com/Patient/123456789"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "5d3a0e5b9a2b1c0001f0c0de")
+}
+
+func (m *MongoSearchSuite) TestConditionReferenceQueryByPatientURLOnServerBase(c *C) {
+	searcher := NewMongoSearcherForUri(m.MongoUri, "fhir-test", true, true, false, false) // countTotalResults = true, enableCISearches = true, readonly = false
+	defer searcher.Close()
+	searcher.SetServerBase("http://localhost:3001/")
+
+	// The fixtures reference their patients as Patient/id
+	q := Query{"Condition", "patient=http://localhost:3001/Patient/4954037118555241963"}
+	results, _, err := searcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+}
+
+func (m *MongoSearchSuite) TestObservationReferenceQueryObjectByIdentifier(c *C) {
+	q := Query{"Observation", "subject:identifier=http://acme.com|1234"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"subject.identifier.system": primitive.Regex{Pattern: "^http://acme\\.com$", Options: "i"},
+		"subject.identifier.value":  primitive.Regex{Pattern: "^1234$", Options: "i"},
+	})
+
+	q = Query{"Observation", "subject:identifier=1234"}
+
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"subject.identifier.value": primitive.Regex{Pattern: "^1234$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestObservationReferenceQueryByIdentifier(c *C) {
+	var observationMap map[string]interface{}
+	util.CheckErr(json.Unmarshal([]byte(`{
+		"resourceType": "Observation",
+		"id": "5d3a0e5b9a2b1c0001f0c0df",
+		"status": "final",
+		"code": {"text": "Weight"},
+		"subject": {"identifier": {"system": "http://acme.com", "value": "1234"}}
+	}`), &observationMap))
+	observation, err := models.MapToResource(observationMap, true)
+	util.CheckErr(err)
+	observations := m.Session.DB("fhir-test").C("observations")
+	util.CheckErr(observations.Insert(observation))
+	defer observations.RemoveId("5d3a0e5b9a2b1c0001f0c0df")
+
+	q := Query{"Observation", "subject:identifier=http://acme.com|1234"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "5d3a0e5b9a2b1c0001f0c0df")
+
+	q = Query{"Observation", "subject:identifier=http://other.com|1234"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
 
 // These tests validate chained search using the mongo Pipeline
 func (m *MongoSearchSuite) TestConditionChainedSearchPipelineObject(c *C) {
@@ -537,6 +834,109 @@ func (m *MongoSearchSuite) TestConditionChainedSearchPipelineObject(c *C) {
 	})
 }
 
+func (m *MongoSearchSuite) TestConditionChainedSearchPipelineWithSortAndPaging(c *C) {
+	q := Query{"Condition", "patient.gender=male&_sort=-onset-date&_offset=10&_count=5"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	pipeline := m.MongoSearcher.createSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$match": bson.M{
+			"_lookup0.gender": primitive.Regex{Pattern: "^male$", Options: "i"},
+		}},
+		bson.M{"$sort": bson.D{
+			{Key: "onsetDateTime", Value: -1},
+			{Key: "_id", Value: 1},
+		}},
+		bson.M{"$skip": 10},
+		bson.M{"$limit": 5},
+	})
+
+	// the count is done without the sort and paging stages
+	c.Assert(bsonQuery.Pipeline, HasLen, 3)
+}
+
+func (m *MongoSearchSuite) TestConditionChainedSearchWithSort(c *C) {
+	q := Query{"Condition", "patient.gender=male&_sort=onset-date"}
+
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+
+	var lastOnset time.Time
+	for _, result := range results {
+		var condition models.Condition
+		util.CheckErr(result.Unmarshal(&condition))
+		if condition.OnsetDateTime == nil {
+			continue
+		}
+		c.Assert(condition.OnsetDateTime.Time.Before(lastOnset), Equals, false)
+		lastOnset = condition.OnsetDateTime.Time
+	}
+}
+
+func (m *MongoSearchSuite) TestConditionChainedSearchFacetPipeline(c *C) {
+	q := Query{"Condition", "patient.gender=male&_offset=10&_count=5"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	pipeline := m.MongoSearcher.createFacetSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$match": bson.M{
+			"_lookup0.gender": primitive.Regex{Pattern: "^male$", Options: "i"},
+		}},
+		bson.M{"$facet": bson.M{
+			"results": []bson.M{
+				bson.M{"$skip": 10},
+				bson.M{"$limit": 5},
+			},
+			"total": []bson.M{
+				bson.M{"$count": "total"},
+			},
+		}},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionChainedSearchTotal(c *C) {
+	q := Query{"Condition", "patient.gender=male&_count=2"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+	c.Assert(total, Equals, uint32(5))
+
+	// the total isn't affected by the page
+	q = Query{"Condition", "patient.gender=male&_offset=4&_count=2"}
+	results, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(total, Equals, uint32(5))
+
+	q = Query{"Condition", "patient.gender=foo"}
+	results, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+	c.Assert(total, Equals, uint32(0))
+
+	q = Query{"Condition", "patient.gender=male&_summary=count"}
+	_, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(5))
+}
+
 func (m *MongoSearchSuite) TestChainedSearchPipelineObjectWithOr(c *C) {
 	q := Query{"Condition", "patient.gender=foo,bar"}
 
@@ -562,6 +962,14 @@ func (m *MongoSearchSuite) TestChainedSearchPipelineObjectWithOr(c *C) {
 	})
 }
 
+func (m *MongoSearchSuite) TestChainedSearchThroughNonReferenceParameter(c *C) {
+	q := Query{"Condition", "code.foo=bar"}
+	c.Assert(func() { m.MongoSearcher.convertToBSON(q) }, PanicMatches, `HTTP 400: .*Parameter "code" content is invalid: only reference parameters can be chained.*`)
+
+	q = Query{"Condition", "code.foo=bar,baz"}
+	c.Assert(func() { m.MongoSearcher.convertToBSON(q) }, PanicMatches, `HTTP 400: .*only reference parameters can be chained.*`)
+}
+
 func (m *MongoSearchSuite) TestChainedSearchPipelineObjectWithMultipleReferencePaths(c *C) {
 	q := Query{"AuditEvent", "patient.gender=male"}
 
@@ -630,6 +1038,115 @@ func (m *MongoSearchSuite) TestChainedSearchPipelineObjectWithMultipleReferenceP
 	})
 }
 
+func (m *MongoSearchSuite) TestMultiLevelChainedSearchPipelineObject(c *C) {
+	q := Query{"Condition", "patient.organization.name=Acme"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.Resource, Equals, "Condition")
+	c.Assert(bsonQuery.Query, IsNil)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	c.Assert(bsonQuery.Pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "organizations",
+			"localField":   "_lookup0.managingOrganization.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0_0",
+		}},
+		bson.M{"$match": bson.M{
+			"$or": []bson.M{
+				bson.M{"_lookup0_0.alias": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+				bson.M{"_lookup0_0.name": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+			},
+		}},
+	})
+}
+
+func (m *MongoSearchSuite) TestMultiLevelChainedSearchPipelineObjectWithOr(c *C) {
+	q := Query{"Condition", "patient.organization.name=Acme,Foo"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	c.Assert(bsonQuery.Pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "organizations",
+			"localField":   "_lookup0.managingOrganization.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0_0",
+		}},
+		bson.M{"$match": bson.M{
+			"$or": []bson.M{
+				bson.M{"$or": []bson.M{
+					bson.M{"_lookup0_0.alias": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+					bson.M{"_lookup0_0.name": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+				}},
+				bson.M{"$or": []bson.M{
+					bson.M{"_lookup0_0.alias": primitive.Regex{Pattern: "^Foo$", Options: "i"}},
+					bson.M{"_lookup0_0.name": primitive.Regex{Pattern: "^Foo$", Options: "i"}},
+				}},
+			},
+		}},
+	})
+}
+
+func (m *MongoSearchSuite) TestMultiLevelChainedSearchPipelineObjectWithMultipleReferencePaths(c *C) {
+	q := Query{"AuditEvent", "patient.organization.name=Acme"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	c.Assert(bsonQuery.Pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "agent.reference.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "entity.reference.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup1",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "organizations",
+			"localField":   "_lookup0.managingOrganization.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup0_0",
+		}},
+		bson.M{"$lookup": bson.M{
+			"from":         "organizations",
+			"localField":   "_lookup1.managingOrganization.reference__id",
+			"foreignField": "_id",
+			"as":           "_lookup1_0",
+		}},
+		bson.M{"$match": bson.M{
+			"$or": []bson.M{
+				bson.M{"_lookup0_0.alias": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+				bson.M{"_lookup1_0.alias": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+				bson.M{"_lookup0_0.name": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+				bson.M{"_lookup1_0.name": primitive.Regex{Pattern: "^Acme$", Options: "i"}},
+			},
+		}},
+	})
+}
+
 func (m *MongoSearchSuite) TestConditionReferenceQueryByPatientGender(c *C) {
 	q := Query{"Condition", "patient.gender=male"}
 	results, _, err := m.MongoSearcher.Search(q)
@@ -720,32 +1237,77 @@ func (m *MongoSearchSuite) TestReverseChainedSearchPipelineObjectWithMultipleRef
 			"as":           "_lookup0",
 		}},
 		bson.M{"$lookup": bson.M{
-			"from":         "auditevents",
+			"from":         "auditevents",
+			"localField":   "_id",
+			"foreignField": "entity.reference.reference__id",
+			"as":           "_lookup1",
+		}},
+		bson.M{"$match": bson.M{
+			"$or": []bson.M{
+				bson.M{"_lookup0.outcome": primitive.Regex{Pattern: "^foo$", Options: "i"}},
+				bson.M{"_lookup1.outcome": primitive.Regex{Pattern: "^foo$", Options: "i"}},
+			},
+		}},
+	})
+}
+
+func (m *MongoSearchSuite) TestPatientReferenceQueryByObservationCode(c *C) {
+	q := Query{"Patient", "_has:Observation:subject:code=1234-5"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(1))
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "_has:Observation:subject:code=0000-0"}
+	results, total, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(total, Equals, uint32(0))
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestPatientReverseChainedSearchWithRevIncludePipeline(c *C) {
+	q := Query{"Patient", "_has:Observation:subject:code=1234-5&_revinclude=Observation:subject"}
+
+	// the observations looked up for _has are dropped before the revincluded ones are looked up
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	pipeline := m.MongoSearcher.createSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{}},
+		bson.M{"$lookup": bson.M{
+			"from":         "observations",
+			"localField":   "_id",
+			"foreignField": "subject.reference__id",
+			"as":           "_lookup0",
+		}},
+		bson.M{"$match": bson.M{"_lookup0.code.coding.code": primitive.Regex{Pattern: "^1234-5$", Options: "i"}}},
+		bson.M{"$project": bson.M{"_lookup0": 0}},
+		bson.M{"$limit": 100},
+		bson.M{"$lookup": bson.M{
+			"from":         "observations",
 			"localField":   "_id",
-			"foreignField": "entity.reference.reference__id",
-			"as":           "_lookup1",
-		}},
-		bson.M{"$match": bson.M{
-			"$or": []bson.M{
-				bson.M{"_lookup0.outcome": primitive.Regex{Pattern: "^foo$", Options: "i"}},
-				bson.M{"_lookup1.outcome": primitive.Regex{Pattern: "^foo$", Options: "i"}},
-			},
+			"foreignField": "subject.reference__id",
+			"as":           "_revIncludedObservationResourcesReferencingSubject",
 		}},
 	})
 }
 
-func (m *MongoSearchSuite) TestPatientReferenceQueryByObservationCode(c *C) {
-	q := Query{"Patient", "_has:Observation:subject:code=1234-5"}
+func (m *MongoSearchSuite) TestPatientReverseChainedSearchWithRevInclude(c *C) {
+	q := Query{"Patient", "_has:Observation:subject:code=1234-5&_revinclude=Observation:subject"}
 	results, total, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
 	c.Assert(total, Equals, uint32(1))
-	c.Assert(len(results), Equals, 1)
-
-	q = Query{"Patient", "_has:Observation:subject:code=0000-0"}
-	results, total, err = m.MongoSearcher.Search(q)
-	util.CheckErr(err)
-	c.Assert(total, Equals, uint32(0))
-	c.Assert(len(results), Equals, 0)
+	c.Assert(results, HasLen, 1)
+	c.Assert(results[0].Id(), Equals, "4954037118555241963")
+
+	// every observation of the patient is revincluded once, including the one matching _has
+	observations := results[0].SearchIncludesOfType("Observation")
+	c.Assert(observations, HasLen, 5)
+	ids := make(map[string]bool)
+	for _, observation := range observations {
+		ids[observation.Id()] = true
+	}
+	c.Assert(ids, HasLen, 5)
+	c.Assert(ids["7045604479745586371"], Equals, true)
 }
 
 func (m *MongoSearchSuite) TestPatientReferenceQueryByObservationCodeOr(c *C) {
@@ -867,6 +1429,73 @@ func (m *MongoSearchSuite) TestConditionOnsetQueryWrongTime(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
+func (m *MongoSearchSuite) TestConditionOnsetEQQueryObject(c *C) {
+	// an explicit eq is the same as no prefix
+	q := Query{"Condition", "onset-date=eq2012-03-01T07:00"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, m.MongoSearcher.createQueryObject(Query{"Condition", "onset-date=2012-03-01T07:00"}))
+}
+
+func (m *MongoSearchSuite) TestConditionOnsetEQQuery(c *C) {
+	q := Query{"Condition", "onset-date=eq2012-03-01"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 5)
+}
+
+func (m *MongoSearchSuite) TestConditionOnsetNEQueryObject(c *C) {
+	q := Query{"Condition", "onset-date=ne2012-03-01T07:00"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				"onsetDateTime.__from": bson.M{
+					"$lt": time.Date(2012, time.March, 1, 7, 0, 0, 0, m.Local),
+				},
+			},
+			bson.M{
+				"onsetDateTime.__to": bson.M{
+					"$gt": time.Date(2012, time.March, 1, 7, 1, 0, 0, m.Local),
+				},
+			},
+			bson.M{
+				"onsetPeriod.start.__from": bson.M{
+					"$lt": time.Date(2012, time.March, 1, 7, 0, 0, 0, m.Local),
+				},
+			},
+			bson.M{
+				"onsetPeriod.end.__to": bson.M{
+					"$gt": time.Date(2012, time.March, 1, 7, 1, 0, 0, m.Local),
+				},
+			},
+			bson.M{
+				"onsetPeriod":       bson.M{"$ne": nil},
+				"onsetPeriod.start": nil,
+			},
+			bson.M{
+				"onsetPeriod":     bson.M{"$ne": nil},
+				"onsetPeriod.end": nil,
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionOnsetNEQuery(c *C) {
+	// all but the condition with an onset in 2011
+	q := Query{"Condition", "onset-date=ne2012-03-01"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "8664777288161038467")
+
+	// all but the three conditions with an onset at 07:05
+	q = Query{"Condition", "onset-date=ne2012-03-01T07:05-05:00"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 3)
+}
+
 func (m *MongoSearchSuite) TestConditionOnsetGTQueryObject(c *C) {
 	q := Query{"Condition", "onset-date=gt2012-03-01T07:00"}
 
@@ -1108,6 +1737,87 @@ func (m *MongoSearchSuite) TestConditionSortByOnsetDescending(c *C) {
 	}
 }
 
+func (m *MongoSearchSuite) TestConditionSortWithMissingValuesLast(c *C) {
+	conditions := m.Session.DB("fhir-test").C("conditions")
+	for _, id := range []string{"5d3a0e5b9a2b1c0001f0c0e1", "5d3a0e5b9a2b1c0001f0c0e2"} {
+		var conditionMap map[string]interface{}
+		util.CheckErr(json.Unmarshal([]byte(`{
+			"resourceType": "Condition",
+			"id": "`+id+`",
+			"subject": {"reference": "Patient/4954037118555241963"}
+		}`), &conditionMap))
+		condition, err := models.MapToResource(conditionMap, true)
+		util.CheckErr(err)
+		util.CheckErr(conditions.Insert(condition))
+		defer conditions.RemoveId(id)
+	}
+
+	searcher := NewMongoSearcherForUri(m.MongoUri, "fhir-test", true, true, false, false) // countTotalResults = true, enableCISearches = true, readonly = false
+	defer searcher.Close()
+
+	// MongoDB puts the conditions without an onset first when ascending
+	assertMissingOnsets := func(sort string, first bool) {
+		results, _, err := searcher.Search(Query{"Condition", sort})
+		util.CheckErr(err)
+		c.Assert(len(results), Equals, 8)
+		for i, result := range results {
+			var condition models.Condition
+			util.CheckErr(result.Unmarshal(&condition))
+			missing := i < 2
+			if !first {
+				missing = i >= 6
+			}
+			c.Assert(condition.OnsetDateTime == nil, Equals, missing, Commentf("%s: result %d", sort, i))
+		}
+	}
+	assertMissingOnsets("_sort=onset-date", true)
+	assertMissingOnsets("_sort:desc=onset-date", false)
+
+	searcher.SetMissingValuesOrder(MissingValuesLast)
+	assertMissingOnsets("_sort=onset-date", false)
+	assertMissingOnsets("_sort:desc=onset-date", false)
+
+	searcher.SetMissingValuesOrder(MissingValuesFirst)
+	assertMissingOnsets("_sort=onset-date", true)
+	assertMissingOnsets("_sort:desc=onset-date", true)
+}
+
+func (m *MongoSearchSuite) TestSortPagesWithTiesDontOverlap(c *C) {
+	patients := m.Session.DB("fhir-test").C("patients")
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("5d3a0e5b9a2b1c0001f1%04x", i)
+		gender := "female"
+		if i%2 == 0 {
+			gender = "male"
+		}
+		patient, err := models.MapToResource(map[string]interface{}{"resourceType": "Patient", "id": id, "gender": gender}, true)
+		util.CheckErr(err)
+		util.CheckErr(patients.Insert(patient))
+		defer patients.RemoveId(id)
+	}
+
+	// the genders have many ties, which _id breaks
+	seen := make(map[string]bool)
+	for offset := 0; offset < 30; offset += 10 {
+		results, _, err := m.MongoSearcher.Search(Query{"Patient", fmt.Sprintf("_sort=gender&_count=10&_offset=%d", offset)})
+		util.CheckErr(err)
+		c.Assert(results, HasLen, 10)
+		for _, result := range results {
+			c.Assert(seen[result.Id()], Equals, false, Commentf("%s on more than one page", result.Id()))
+			seen[result.Id()] = true
+		}
+	}
+}
+
+func (m *MongoSearchSuite) TestSortTieBreak(c *C) {
+	sort := withIDTieBreak(bson.D{{Key: "gender", Value: -1}})
+	c.Assert(sort, DeepEquals, bson.D{{Key: "gender", Value: -1}, {Key: "_id", Value: 1}})
+
+	// sorts on _id are already in a total order
+	sort = withIDTieBreak(bson.D{{Key: "_id", Value: -1}})
+	c.Assert(sort, DeepEquals, bson.D{{Key: "_id", Value: -1}})
+}
+
 // Test date searches on Period
 
 func (m *MongoSearchSuite) TestEncounterPeriodQueryObject(c *C) {
@@ -1343,7 +2053,95 @@ func (m *MongoSearchSuite) TestEncounterSortByPeriodDescending(c *C) {
 	}
 }
 
-// TODO: Test date searches on date, instant, and Timing
+// Test date searches on Timing
+
+func (m *MongoSearchSuite) TestChargeItemTimingEventQueryObject(c *C) {
+	q := Query{"ChargeItem", "occurrence=2012-06"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o["$or"], HasLen, 3)
+	c.Assert(o["$or"].([]bson.M)[2], DeepEquals, bson.M{
+		"occurrenceTiming.event": bson.M{
+			"$elemMatch": bson.M{
+				"__from": bson.M{
+					"$gte": time.Date(2012, time.June, 1, 0, 0, 0, 0, m.Local),
+				},
+				"__to": bson.M{
+					"$lte": time.Date(2012, time.July, 1, 0, 0, 0, 0, m.Local),
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestCarePlanTimingEventQueryObject(c *C) {
+	q := Query{"CarePlan", "activity-date=2012-06"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o["$or"], HasLen, 2)
+	c.Assert(o["$or"].([]bson.M)[1], DeepEquals, bson.M{
+		"activity.detail.scheduledTiming.event": bson.M{
+			"$elemMatch": bson.M{
+				"__from": bson.M{
+					"$gte": time.Date(2012, time.June, 1, 0, 0, 0, 0, m.Local),
+				},
+				"__to": bson.M{
+					"$lte": time.Date(2012, time.July, 1, 0, 0, 0, 0, m.Local),
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestChargeItemTimingEventGTQueryObject(c *C) {
+	q := Query{"ChargeItem", "occurrence=gt2012-07"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o["$or"], HasLen, 4)
+	c.Assert(o["$or"].([]bson.M)[3], DeepEquals, bson.M{
+		"occurrenceTiming.event.__to": bson.M{
+			"$gt": time.Date(2012, time.August, 1, 0, 0, 0, 0, m.Local),
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestChargeItemTimingEventQuery(c *C) {
+	q := Query{"ChargeItem", "occurrence=2012-06"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"ChargeItem", "occurrence=2012-07"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestChargeItemTimingEventGTQuery(c *C) {
+	q := Query{"ChargeItem", "occurrence=gt2012-07"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"ChargeItem", "occurrence=gt2012-08"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+func (m *MongoSearchSuite) TestChargeItemTimingEventLTQuery(c *C) {
+	q := Query{"ChargeItem", "occurrence=lt2012-07"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"ChargeItem", "occurrence=lt2012-06"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+// TODO: Test date searches on date and instant
 
 // Test number searches on positiveInt
 
@@ -1483,7 +2281,99 @@ func (m *MongoSearchSuite) TestNumberQueryNE(c *C) {
 	c.Assert(len(results), Equals, 0)
 }
 
-// TODO: Test number searches on decimal, integer, and unsignedInt
+// Test number searches on decimal and integer
+
+func (m *MongoSearchSuite) TestRiskAssessmentProbabilityDecimalQueryObject(c *C) {
+	q := Query{"RiskAssessment", "probability=0.25"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction": bson.M{
+			"$elemMatch": bson.M{
+				"probabilityDecimal.__num": bson.M{
+					"$gte": float64(0.245),
+					"$lt":  float64(0.255),
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestDecimalQueryPrecision(c *C) {
+	// the range is implied by the number of decimal places in the search value
+	q := Query{"RiskAssessment", "probability=0.3"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction": bson.M{
+			"$elemMatch": bson.M{
+				"probabilityDecimal.__num": bson.M{
+					"$gte": float64(0.25),
+					"$lt":  float64(0.35),
+				},
+			},
+		},
+	})
+
+	q = Query{"RiskAssessment", "probability=0.250"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction": bson.M{
+			"$elemMatch": bson.M{
+				"probabilityDecimal.__num": bson.M{
+					"$gte": float64(0.2495),
+					"$lt":  float64(0.2505),
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestDecimalQueryPrefixes(c *C) {
+	q := Query{"RiskAssessment", "probability=gt0.25"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction.probabilityDecimal.__num": bson.M{"$gt": float64(0.25)},
+	})
+
+	q = Query{"RiskAssessment", "probability=lt0.25"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction.probabilityDecimal.__num": bson.M{"$lt": float64(0.25)},
+	})
+
+	q = Query{"RiskAssessment", "probability=ge0.25"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction.probabilityDecimal.__num": bson.M{"$gte": float64(0.245)},
+	})
+
+	q = Query{"RiskAssessment", "probability=le0.5"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"prediction.probabilityDecimal.__num": bson.M{"$lte": float64(0.55)},
+	})
+
+	q = Query{"RiskAssessment", "probability=ne0.25"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"prediction.probabilityDecimal.__num": bson.M{"$lt": float64(0.245)}},
+			bson.M{"prediction.probabilityDecimal.__num": bson.M{"$gte": float64(0.255)}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestSequenceStartIntegerQueryObject(c *C) {
+	q := Query{"Sequence", "start=100"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"referenceSeq.windowStart": bson.M{
+			"$gte": float64(99.5),
+			"$lt":  float64(100.5),
+		},
+	})
+}
 
 // Test string searches on string
 
@@ -1562,6 +2452,39 @@ func (m *MongoSearchSuite) TestPatientSortByGivenDescending(c *C) {
 	}
 }
 
+// Test _filter expressions
+
+func (m *MongoSearchSuite) TestFilterNestedOrAndQueryObject(c *C) {
+	q := Query{"Patient", `_filter=(given eq "John" or family sw "Smi") and gender ne male`}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$and": []bson.M{
+			bson.M{
+				"$or": []bson.M{
+					bson.M{"name.given": primitive.Regex{Pattern: "^John$", Options: "i"}},
+					bson.M{"name.family": primitive.Regex{Pattern: "^Smi", Options: "i"}},
+				},
+			},
+			bson.M{
+				"$nor": []bson.M{
+					bson.M{"gender": primitive.Regex{Pattern: "^male$", Options: "i"}},
+				},
+			},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestFilterStringMatchQueryObject(c *C) {
+	q := Query{"Patient", `_filter=family co "mit" or family ew "th"`}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"name.family": primitive.Regex{Pattern: "mit", Options: "i"}},
+			bson.M{"name.family": primitive.Regex{Pattern: "th$", Options: "i"}},
+		},
+	})
+}
+
 // Test string searches on HumanName
 
 func (m *MongoSearchSuite) TestPatientNameStringQueryObject(c *C) {
@@ -1577,16 +2500,60 @@ func (m *MongoSearchSuite) TestPatientNameStringQueryObject(c *C) {
 	})
 }
 
-func (m *MongoSearchSuite) TestPatientNameStringQuery(c *C) {
-	q := Query{"Patient", "name=Peters"}
+func (m *MongoSearchSuite) TestPatientNameStringQuery(c *C) {
+	q := Query{"Patient", "name=Peters"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
+
+	q = Query{"Patient", "name=John"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+}
+
+func (m *MongoSearchSuite) TestPatientRepeatedNameStringQueryObject(c *C) {
+	// repeated parameters are AND'd, so the second can't overwrite the first
+	q := Query{"Patient", "name=Peters&name=John"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"name.text": primitive.Regex{Pattern: "^Peters", Options: "i"}},
+			bson.M{"name.family": primitive.Regex{Pattern: "^Peters", Options: "i"}},
+			bson.M{"name.given": primitive.Regex{Pattern: "^Peters", Options: "i"}},
+		},
+		"$and": []bson.M{
+			bson.M{"$or": []bson.M{
+				bson.M{"name.text": primitive.Regex{Pattern: "^John", Options: "i"}},
+				bson.M{"name.family": primitive.Regex{Pattern: "^John", Options: "i"}},
+				bson.M{"name.given": primitive.Regex{Pattern: "^John", Options: "i"}},
+			}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestPatientRepeatedNameStringQuery(c *C) {
+	q := Query{"Patient", "name=Peters&name=John"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
-	c.Assert(len(results), Equals, 2)
+	c.Assert(len(results), Equals, 1)
 
-	q = Query{"Patient", "name=John"}
+	q = Query{"Patient", "name=John&name=Peters"}
 	results, _, err = m.MongoSearcher.Search(q)
 	util.CheckErr(err)
 	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Patient", "name=John&name=Sally"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	// whereas comma-separated values are OR'd
+	q = Query{"Patient", "name=John,Sally"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 2)
 }
 
 func (m *MongoSearchSuite) TestNonMatchingPatientNameStringQuery(c *C) {
@@ -2002,7 +2969,100 @@ func getQuantityComparisonValue(q *models.Quantity) string {
 	return fmt.Sprintf("%s%s%s%s%s", q.Code, q.Comparator, q.System, q.Unit, value)
 }
 
-// TODO: Test quantity searches on Money, SimpleQuantity, Duration, Count, Distance, and Age
+// Test quantity searches on Money
+
+func (m *MongoSearchSuite) TestChargeItemPriceOverrideMoneyQueryObjectByValueAndCurrency(c *C) {
+	q := Query{"ChargeItem", "price-override=40||USD"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"priceOverride.value.__from": bson.M{"$gte": 39.5},
+		"priceOverride.value.__to":   bson.M{"$lte": 40.5},
+		"priceOverride.code":         primitive.Regex{Pattern: "^USD$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestChargeItemPriceOverrideMoneyQueryObjectByValueAndSystemAndCurrency(c *C) {
+	q := Query{"ChargeItem", "price-override=40|urn:iso:std:iso:4217|USD"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"priceOverride.value.__from": bson.M{"$gte": 39.5},
+		"priceOverride.value.__to":   bson.M{"$lte": 40.5},
+		"priceOverride.code":         primitive.Regex{Pattern: "^USD$", Options: "i"},
+		"priceOverride.system":       primitive.Regex{Pattern: "^urn:iso:std:iso:4217$", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestChargeItemPriceOverrideMoneyQuery(c *C) {
+	q := Query{"ChargeItem", "price-override=40||USD"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"ChargeItem", "price-override=40|urn:iso:std:iso:4217|USD"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"ChargeItem", "price-override=gt30||USD"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+}
+
+func (m *MongoSearchSuite) TestChargeItemPriceOverrideMoneyQueryByWrongValueOrCurrency(c *C) {
+	q := Query{"ChargeItem", "price-override=40||EUR"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	q = Query{"ChargeItem", "price-override=50||USD"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+// Test number searches on Duration
+
+func (m *MongoSearchSuite) TestEncounterLengthDurationQueryObject(c *C) {
+	q := Query{"Encounter", "length=60"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"length.value.__num": bson.M{
+			"$gte": float64(59.5),
+			"$lt":  float64(60.5),
+		},
+	})
+
+	q = Query{"Encounter", "length=gt45"}
+	o = m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"length.value.__num": bson.M{"$gt": float64(45)},
+	})
+}
+
+func (m *MongoSearchSuite) TestEncounterLengthDurationQuery(c *C) {
+	q := Query{"Encounter", "length=60"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Encounter", "length=le60"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+
+	q = Query{"Encounter", "length=30"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+
+	q = Query{"Encounter", "length=gt60"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+// TODO: Test quantity searches on SimpleQuantity, Count, Distance, and Age
 
 // Test URI searches on URI
 
@@ -2103,6 +3163,76 @@ func (m *MongoSearchSuite) TestBroCustomQuery(c *C) {
 	c.Assert(len(results), Equals, 1)
 }
 
+// Test composite searches
+
+func (m *MongoSearchSuite) TestObservationCodeValueDateQueryObject(c *C) {
+	q := Query{"Observation", "code-value-date=http://loinc.org|21112-8$sa2012-03-01T07:00"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	coding := bson.M{
+		"$elemMatch": bson.M{
+			"system": primitive.Regex{Pattern: "^http://loinc\\.org$", Options: "i"},
+			"code":   primitive.Regex{Pattern: "^21112-8$", Options: "i"},
+		},
+	}
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{
+				"code.coding": coding,
+				"valueDateTime.__from": bson.M{
+					"$gt": time.Date(2012, time.March, 1, 7, 1, 0, 0, m.Local),
+				},
+			},
+			bson.M{
+				"code.coding": coding,
+				"valuePeriod.start.__from": bson.M{
+					"$gt": time.Date(2012, time.March, 1, 7, 1, 0, 0, m.Local),
+				},
+			},
+		},
+	})
+}
+
+var componentValueDateSearchParamInfo = SearchParamInfo{
+	Resource: "Observation",
+	Name:     "test-component-value-date",
+	Type:     "date",
+	Paths: []SearchParamPath{
+		SearchParamPath{Path: "[]component.valueDateTime", Type: "dateTime"},
+	},
+}
+
+var componentCodeValueDateSearchParamInfo = SearchParamInfo{
+	Resource:   "Observation",
+	Name:       "test-component-code-value-date",
+	Type:       "composite",
+	Composites: []string{"component-code", "test-component-value-date"},
+}
+
+func (m *MongoSearchSuite) TestObservationComponentCodeValueDateQueryObject(c *C) {
+	GlobalRegistry().RegisterParameterInfo(componentValueDateSearchParamInfo)
+	GlobalRegistry().RegisterParameterInfo(componentCodeValueDateSearchParamInfo)
+
+	// Both criteria have to match the same component
+	q := Query{"Observation", "test-component-code-value-date=http://loinc.org|21112-8$sa2012-03-01T07:00"}
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"component": bson.M{
+			"$elemMatch": bson.M{
+				"code.coding": bson.M{
+					"$elemMatch": bson.M{
+						"system": primitive.Regex{Pattern: "^http://loinc\\.org$", Options: "i"},
+						"code":   primitive.Regex{Pattern: "^21112-8$", Options: "i"},
+					},
+				},
+				"valueDateTime.__from": bson.M{
+					"$gt": time.Date(2012, time.March, 1, 7, 1, 0, 0, m.Local),
+				},
+			},
+		},
+	})
+}
+
 // Tests special searches on _id
 
 func (m *MongoSearchSuite) TestConditionIdQueryObject(c *C) {
@@ -2206,7 +3336,51 @@ func (m *MongoSearchSuite) TestConditionTagQuery(c *C) {
 	c.Assert(cond, DeepEquals, cond2)
 }
 
-// TODO: Test special searches: _content, _lastUpdated, _profile, _query, _security, _text
+func (m *MongoSearchSuite) TestConditionTagTextQueryObject(c *C) {
+	q := Query{"Condition", "_tag:text=foo"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"meta.tag.display": primitive.Regex{Pattern: "^foo", Options: "i"},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionTagTextQuery(c *C) {
+	q := Query{"Condition", "_tag:text=foo bar"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "4072118967138896162")
+
+	q = Query{"Condition", "_tag:text=bar"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+}
+
+// Tests special searches on _security
+
+func (m *MongoSearchSuite) TestConditionSecurityTextQueryObject(c *C) {
+	q := Query{"Condition", "_security:text=restricted,normal"}
+
+	o := m.MongoSearcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"$or": []bson.M{
+			bson.M{"meta.security.display": primitive.Regex{Pattern: "^restricted", Options: "i"}},
+			bson.M{"meta.security.display": primitive.Regex{Pattern: "^normal", Options: "i"}},
+		},
+	})
+}
+
+func (m *MongoSearchSuite) TestConditionSecurityTextQuery(c *C) {
+	q := Query{"Condition", "_security:text=restr"}
+	results, _, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(results[0].Id(), Equals, "4072118967138896162")
+}
+
+// TODO: Test special searches: _content, _lastUpdated, _profile, _query, _text
 
 // Test searches with multiple values
 func (m *MongoSearchSuite) TestConditionMultipleCodesQueryObject(c *C) {
@@ -2587,13 +3761,154 @@ func (m *MongoSearchSuite) TestConditionSortWithMultipleSortParamsDescending(c *
 	}
 }
 
+func (m *MongoSearchSuite) TestConditionSortWithMixedSortDirections(c *C) {
+	for _, query := range []string{"_sort=patient&_sort:desc=onset-date&_sort=code", "_sort=patient,-onset-date,code"} {
+		q := Query{"Condition", query}
+
+		// each key keeps its own direction, in the order of the URL, whether sorted by a find or in a pipeline
+		sort := bson.D{{Key: "subject", Value: 1}, {Key: "onsetDateTime", Value: -1}, {Key: "code", Value: 1}, {Key: "_id", Value: 1}}
+		c.Assert(findSort(q.Options().Sort), DeepEquals, sort, Commentf(query))
+		c.Assert(m.MongoSearcher.convertOptionsToPipelineStages(q.Resource, q.Options())[0], DeepEquals, bson.M{"$sort": sort}, Commentf(query))
+
+		results, _, err := m.MongoSearcher.Search(q)
+		util.CheckErr(err)
+		c.Assert(len(results), Equals, 6)
+
+		var lastPatient string
+		var lastOnset time.Time
+		var lastCode string
+		for i, result := range results {
+			var cond models.Condition
+			util.CheckErr(result.Unmarshal(&cond))
+			thisPatient := getReferenceComparisonValue(cond.Subject)
+			thisOnset := cond.OnsetDateTime.Time
+			thisCode := getCodeableConceptComparisonValue(cond.Code)
+			if i > 0 {
+				c.Assert(strings.Compare(lastPatient, thisPatient), Not(Equals), 1, Commentf(query))
+				if thisPatient == lastPatient {
+					c.Assert(thisOnset.After(lastOnset), Equals, false, Commentf(query))
+					if thisOnset.Equal(lastOnset) {
+						c.Assert(strings.Compare(lastCode, thisCode), Not(Equals), 1, Commentf(query))
+					}
+				}
+			}
+			lastPatient = thisPatient
+			lastOnset = thisOnset
+			lastCode = thisCode
+		}
+	}
+}
+
 func (m *MongoSearchSuite) TestSortingOnParallelArrayPathsDoesntPanic(c *C) {
-	// NOTE: Sorting on family and patient normally causes MongoDB to balk because they have "parallel arrays", but we
-	// should just drop the second sort param instead of panicing
+	// NOTE: Sorting on family and given normally causes MongoDB to balk because they have "parallel arrays", so
+	// the names are sorted by keys computed in a pipeline instead
 	q := Query{"Patient", "_sort=family&_sort=given"}
 	results, _, err := m.MongoSearcher.Search(q)
 	util.CheckErr(err)
 	c.Assert(len(results), Equals, 2)
+	c.Assert(sortedPatientNames(results), DeepEquals, []string{"PetersJohn", "PetersSally"})
+
+	// both patients are Peters, so the given names decide
+	q = Query{"Patient", "_sort=family&_sort=-given"}
+	results, _, err = m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(sortedPatientNames(results), DeepEquals, []string{"PetersSally", "PetersJohn"})
+}
+
+// sortedPatientNames returns the getHumanNamesComparisonValue of each patient
+func sortedPatientNames(results []*models2.Resource) []string {
+	var names []string
+	for _, result := range results {
+		var patient models.Patient
+		util.CheckErr(result.Unmarshal(&patient))
+		names = append(names, getHumanNamesComparisonValue(patient.Name, false))
+	}
+	return names
+}
+
+func (m *MongoSearchSuite) TestSortingOnParallelArrayPathsPipeline(c *C) {
+	q := Query{"Patient", "gender=female&_sort=family&_sort:desc=given"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	// the smallest family name and largest given name of all the names of each patient
+	pipeline := m.MongoSearcher.createSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{"gender": primitive.Regex{Pattern: "^female$", Options: "i"}}},
+		bson.M{"$addFields": bson.M{
+			"_sortKey0": bson.M{"$min": "$name.family"},
+			"_sortKey1": bson.M{"$max": bson.M{"$reduce": bson.M{
+				"input":        bson.M{"$ifNull": bson.A{"$name.given", bson.A{}}},
+				"initialValue": bson.A{},
+				"in": bson.M{"$concatArrays": bson.A{
+					"$$value",
+					bson.M{"$cond": bson.A{bson.M{"$isArray": "$$this"}, "$$this", bson.A{"$$this"}}},
+				}},
+			}}},
+		}},
+		bson.M{"$sort": bson.D{
+			{Key: "_sortKey0", Value: 1},
+			{Key: "_sortKey1", Value: -1},
+			{Key: "_id", Value: 1},
+		}},
+		bson.M{"$project": bson.M{"_sortKey0": 0, "_sortKey1": 0}},
+		bson.M{"$limit": 100},
+	})
+}
+
+func (m *MongoSearchSuite) TestSortingWithMissingValuesLastPipeline(c *C) {
+	searcher := NewMongoSearcher(nil, nil, true, true, false, false) // countTotalResults = true, enableCISearches = true, tokenParametersCaseSensitive = false, readonly = false
+	searcher.SetMissingValuesOrder(MissingValuesLast)
+
+	// descending sorts already put missing values last, as does sorting on _id
+	q := Query{"Patient", "gender=female&_sort:desc=birthdate"}
+	c.Assert(searcher.convertToBSON(q).usesPipeline(), Equals, false)
+	q = Query{"Patient", "gender=female&_sort=_id"}
+	c.Assert(searcher.convertToBSON(q).usesPipeline(), Equals, false)
+
+	q = Query{"Patient", "gender=female&_sort=birthdate&_sort:desc=family"}
+	bsonQuery := searcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+	pipeline := searcher.createSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{"gender": primitive.Regex{Pattern: "^female$", Options: "i"}}},
+		bson.M{"$addFields": bson.M{
+			"_missingKey0": bson.M{"$in": bson.A{bson.M{"$ifNull": bson.A{"$birthDate", nil}}, bson.A{nil, bson.A{}}}},
+		}},
+		bson.M{"$sort": bson.D{
+			{Key: "_missingKey0", Value: 1},
+			{Key: "birthDate", Value: 1},
+			{Key: "name.family", Value: -1},
+			{Key: "_id", Value: 1},
+		}},
+		bson.M{"$project": bson.M{"_missingKey0": 0}},
+		bson.M{"$limit": 100},
+	})
+}
+
+func (m *MongoSearchSuite) TestChainedSortPipeline(c *C) {
+	q := Query{"Condition", "code=1234-5&_sort=patient.family"}
+
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	c.Assert(bsonQuery.usesPipeline(), Equals, true)
+
+	pipeline := m.MongoSearcher.createSearchPipeline(bsonQuery, q.Options())
+	c.Assert(pipeline, DeepEquals, []bson.M{
+		bson.M{"$match": bson.M{"code.coding.code": primitive.Regex{Pattern: "^1234-5$", Options: "i"}}},
+		bson.M{"$lookup": bson.M{
+			"from":         "patients",
+			"localField":   "subject.reference__id",
+			"foreignField": "_id",
+			"as":           "_sortLookup0",
+		}},
+		bson.M{"$sort": bson.D{
+			{Key: "_sortLookup0.name.family", Value: 1},
+			{Key: "_id", Value: 1},
+		}},
+		bson.M{"$project": bson.M{"_sortLookup0": 0}},
+		bson.M{"$limit": 100},
+	})
 }
 
 func (m *MongoSearchSuite) TestObservationCodeQueryOptionsForInclude(c *C) {
@@ -2729,12 +4044,81 @@ func (m *MongoSearchSuite) TestPatientGenderQueryForRevInclude(c *C) {
 	}
 }
 
+func (m *MongoSearchSuite) TestWildcardIncludesMatchExplicitIncludes(c *C) {
+	// the resources included with each match, by type and id
+	includesByMatch := func(q Query) map[string][]string {
+		results, _, err := m.MongoSearcher.Search(q)
+		util.CheckErr(err)
+		byMatch := make(map[string][]string)
+		for _, result := range results {
+			keys := []string{}
+			seen := make(map[string]bool)
+			for _, included := range result.SearchIncludes() {
+				key := included.ResourceType() + "/" + included.Id()
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			byMatch[result.Id()] = keys
+		}
+		return byMatch
+	}
+
+	for _, q := range []Query{
+		{"Patient", "gender=male&_revinclude=*"},
+		{"Condition", "_include=*"},
+		{"Encounter", "_include=*&_revinclude=*"},
+	} {
+		// the same search with an explicit _include or _revinclude for each parameter, done with $lookup stages
+		options := q.Options()
+		explicit := Query{q.Resource, strings.NewReplacer("_include=*", "", "_revinclude=*", "").Replace(q.Query)}
+		for _, incl := range options.Include {
+			explicit.Query += "&_include=" + incl.Resource + ":" + incl.Parameter.Name
+		}
+		for _, incl := range options.RevInclude {
+			explicit.Query += "&_revinclude=" + incl.Resource + ":" + incl.Parameter.Name
+		}
+		c.Assert(m.MongoSearcher.convertOptionsToPipelineStages(q.Resource, options), DeepEquals, []bson.M{{"$limit": 100}})
+
+		start := time.Now()
+		wildcard := includesByMatch(q)
+		wildcardTime := time.Since(start)
+		start = time.Now()
+		lookedUp := includesByMatch(explicit)
+		c.Logf("%s?%s took %v, with %d parameters as $lookup stages %v", q.Resource, q.Query, wildcardTime,
+			len(options.Include)+len(options.RevInclude), time.Since(start))
+
+		c.Assert(wildcard, DeepEquals, lookedUp)
+	}
+
+	// such as the conditions and encounters of the patient
+	c.Assert(includesByMatch(Query{"Patient", "gender=male&_revinclude=*"})["4954037118555241963"], Not(HasLen), 0)
+}
+
 // Test that invalid search parameters PANIC (to ensure people know they are broken)
 func (m *MongoSearchSuite) TestInvalidSearchParameterPanics(c *C) {
 	q := Query{"Condition", "abatement=2012"}
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createInvalidSearchError("SEARCH_NONE", "Error: no processable search found for Condition search parameters \"abatement\""))
 }
 
+func (m *MongoSearchSuite) TestSearchResourceTypeWithoutSearchParameters(c *C) {
+	// pretend that Device has no search parameters
+	deviceParams := SearchParameterDictionary["Device"]
+	SearchParameterDictionary["Device"] = map[string]SearchParamInfo{}
+	defer func() { SearchParameterDictionary["Device"] = deviceParams }()
+
+	// a search without criteria still returns every device
+	results, total, err := m.MongoSearcher.Search(Query{"Device", ""})
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 1)
+	c.Assert(total, Equals, uint32(1))
+
+	q := Query{"Device", "manufacturer=Acme"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, PanicMatches, `.*Device resources have no search parameters \(found "manufacturer"\).*`)
+}
+
 // Test that unimplemented features PANIC (to ensure people know they are broken)
 func (m *MongoSearchSuite) TestCompositeSearchPanics(c *C) {
 	q := Query{"Group", "characteristic-value=gender$male"}
@@ -2764,9 +4148,45 @@ func (m *MongoSearchSuite) TestModifierSearchPanics(c *C) {
 	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", "Parameter \"code\" modifier is invalid"))
 }
 
-func (m *MongoSearchSuite) TestUnsupportedSearchResultParameterPanics(c *C) {
-	q := Query{"Condition", "_contained=true"}
-	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_UNKNOWN", "Parameter \"_contained\" not understood"))
+func (m *MongoSearchSuite) TestUnsupportedContainedSearchPanics(c *C) {
+	q := Query{"Condition", "_contained=true&_sort=onset-date"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_contained\" can't be combined with _sort, _include, _revinclude or _searchafter"))
+	q = Query{"Condition", "_contained=true&patient.gender=male"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_contained\" isn't supported for this search"))
+}
+
+func (m *MongoSearchSuite) TestContainedSources(c *C) {
+	q := Query{"Patient", "family=Abbott&_contained=both&_containedType=contained"}
+	bsonQuery := m.MongoSearcher.convertToBSON(q)
+	sources := containedSources(bsonQuery, q.Options())
+	c.Assert(len(sources), Equals, len(models2.AllFhirResourceCollectionNames())+1)
+
+	// patients that aren't contained are searched as usual
+	family := primitive.Regex{Pattern: "^Abbott$", Options: "i"}
+	c.Assert(sources[0].collection, Equals, "patients")
+	c.Assert(sources[0].filter, DeepEquals, bson.M{"name.family": family})
+	c.Assert(sources[0].pipeline, IsNil)
+
+	// contained patients are matched with an $elemMatch, then unwound with their containers
+	criteria := bson.M{"resourceType": "Patient", "name.family": family}
+	filter := bson.M{"contained": bson.M{"$elemMatch": criteria}}
+	c.Assert(sources[1].filter, DeepEquals, filter)
+	c.Assert(sources[1].pipeline, DeepEquals, []bson.M{
+		{"$match": filter},
+		{"$sort": bson.M{"_id": 1}},
+		{"$unwind": "$contained"},
+		{"$replaceRoot": bson.M{"newRoot": bson.M{"$mergeObjects": bson.A{
+			"$contained",
+			bson.M{"_container": bson.M{"$concat": bson.A{"$resourceType", "/", "$_id"}}},
+		}}}},
+		{"$match": criteria},
+	})
+
+	// containers are returned by default
+	q = Query{"Patient", "family=Abbott&_contained=true"}
+	sources = containedSources(m.MongoSearcher.convertToBSON(q), q.Options())
+	c.Assert(sources[0].filter, DeepEquals, filter)
+	c.Assert(sources[0].pipeline, IsNil)
 }
 
 func (m *MongoSearchSuite) TestUsupportedGlobalSearchParameterPanics(c *C) {
@@ -2826,6 +4246,42 @@ func (m *MongoSearchSuite) TestDisableCISearch(c *C) {
 	})
 }
 
+func (m *MongoSearchSuite) TestCaseSensitivityOverrides(c *C) {
+	db := m.Session.DB("fhir-test")
+	searcher := NewMongoSearcherForUri(m.MongoUri, db.Name, true, true, false, false) // countTotalResults = true, enableCISearches = true, readonly = false
+	defer searcher.Close()
+	searcher.SetCaseSensitivity(map[string]bool{
+		"Patient.identifier": true,
+		"Patient.gender":     false,
+	})
+
+	// identifiers such as MRNs are matched exactly while names stay case-insensitive
+	q := Query{"Patient", "identifier=http://example.org/mrn|AB123&name=peters"}
+	o := searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"identifier": bson.M{
+			"$elemMatch": bson.M{
+				"system": "http://example.org/mrn", // not a regex
+				"value":  "AB123",                  // not a regex
+			},
+		},
+		"$or": []bson.M{
+			bson.M{"name.text": primitive.Regex{Pattern: "^peters", Options: "i"}},
+			bson.M{"name.family": primitive.Regex{Pattern: "^peters", Options: "i"}},
+			bson.M{"name.given": primitive.Regex{Pattern: "^peters", Options: "i"}},
+		},
+	})
+
+	// an override of false keeps a token case-insensitive even if tokens are case-sensitive
+	searcher.tokenParametersCaseSensitive = true
+	q = Query{"Patient", "gender=Female&_id=123"}
+	o = searcher.createQueryObject(q)
+	c.Assert(o, DeepEquals, bson.M{
+		"gender": primitive.Regex{Pattern: "^Female$", Options: "i"},
+		"_id":    "123",
+	})
+}
+
 func (m *MongoSearchSuite) TestCacheSearchCount(c *C) {
 	db := m.Session.DB("fhir-test")
 	searcher := NewMongoSearcherForUri(m.MongoUri, db.Name, true, true, false, true) // countTotalResults = true, enableCISearches = true, readonly = true
@@ -2855,6 +4311,116 @@ func (m *MongoSearchSuite) TestSummaryCount(c *C) {
 	c.Assert(total, Equals, uint32(2))
 }
 
+func (m *MongoSearchSuite) TestCountZero(c *C) {
+	q := Query{"Patient", "_count=0"}
+	results, total, err := m.MongoSearcher.Search(q)
+	util.CheckErr(err)
+	c.Assert(len(results), Equals, 0)
+	c.Assert(total, Equals, uint32(2))
+}
+
+func (m *MongoSearchSuite) TestSearchAfter(c *C) {
+	searcher := NewMongoSearcherForUri(m.MongoUri, "fhir-test", true, true, false, false)
+	defer searcher.Close()
+	searcher.EnableCursorPaging()
+
+	var ids, searchAfters []string
+	searchAfter := ""
+	for page := 0; page < 3; page++ {
+		q := Query{"Patient", "_count=1"}
+		if searchAfter != "" {
+			q.Query += "&_searchafter=" + searchAfter
+		}
+		results, total, err := searcher.Search(q)
+		util.CheckErr(err)
+		c.Assert(total, Equals, uint32(2))
+
+		var cursorPaged bool
+		searchAfter, cursorPaged = searcher.NextSearchAfter()
+		c.Assert(cursorPaged, Equals, true)
+		if page == 2 {
+			c.Assert(results, HasLen, 0)
+			c.Assert(searchAfter, Equals, "")
+		} else {
+			c.Assert(results, HasLen, 1)
+			c.Assert(searchAfter, Not(Equals), "")
+			ids = append(ids, results[0].Id())
+			searchAfters = append(searchAfters, searchAfter)
+		}
+	}
+	// ordered by _id
+	c.Assert(ids, HasLen, 2)
+	c.Assert(ids[0] < ids[1], Equals, true)
+
+	// an offset is left to offset paging
+	_, _, err := searcher.Search(Query{"Patient", "_count=1&_offset=1"})
+	util.CheckErr(err)
+	_, cursorPaged := searcher.NextSearchAfter()
+	c.Assert(cursorPaged, Equals, false)
+
+	// as are sorts by repeating elements
+	_, _, err = searcher.Search(Query{"Patient", "_sort=family"})
+	util.CheckErr(err)
+	_, cursorPaged = searcher.NextSearchAfter()
+	c.Assert(cursorPaged, Equals, false)
+	q := Query{"Patient", "_sort=family&_searchafter=" + searchAfters[0]}
+	c.Assert(func() { searcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_searchafter\" isn't supported for this search and sort"))
+
+	q = Query{"Patient", "_searchafter=bogus"}
+	c.Assert(func() { searcher.Search(q) }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_searchafter\" content is invalid"))
+}
+
+func (m *MongoSearchSuite) TestSummaryModes(c *C) {
+	var observationMap map[string]interface{}
+	util.CheckErr(json.Unmarshal([]byte(`{
+		"resourceType": "Observation",
+		"id": "5d3a0e5b9a2b1c0001f0c0e1",
+		"text": {"status": "generated", "div": "<div xmlns=\"http://www.w3.org/1999/xhtml\">Weight 70 kg</div>"},
+		"status": "final",
+		"code": {"text": "Weight"},
+		"valueQuantity": {"value": 70, "unit": "kg"},
+		"comment": "after breakfast"
+	}`), &observationMap))
+	observation, err := models.MapToResource(observationMap, true)
+	util.CheckErr(err)
+	observations := m.Session.DB("fhir-test").C("observations")
+	util.CheckErr(observations.Insert(observation))
+	defer observations.RemoveId("5d3a0e5b9a2b1c0001f0c0e1")
+
+	search := func(summary string) map[string]interface{} {
+		q := Query{"Observation", "_id=5d3a0e5b9a2b1c0001f0c0e1&_summary=" + summary}
+		results, _, err := m.MongoSearcher.Search(q)
+		util.CheckErr(err)
+		c.Assert(results, HasLen, 1)
+		var elements map[string]interface{}
+		util.CheckErr(json.Unmarshal(results[0].JsonBytes(), &elements))
+		return elements
+	}
+
+	elements := search("true")
+	c.Assert(elements["text"], IsNil)
+	c.Assert(elements["valueQuantity"], NotNil)
+	c.Assert(elements["comment"], IsNil)
+
+	elements = search("text")
+	c.Assert(elements["text"], NotNil)
+	c.Assert(elements["status"], Equals, "final")
+	c.Assert(elements["valueQuantity"], IsNil)
+
+	elements = search("data")
+	c.Assert(elements["text"], IsNil)
+	c.Assert(elements["comment"], Equals, "after breakfast")
+
+	elements = search("false")
+	c.Assert(elements["text"], NotNil)
+	c.Assert(elements["comment"], Equals, "after breakfast")
+}
+
+func (m *MongoSearchSuite) TestSummaryInvalid(c *C) {
+	q := Query{"Observation", "_summary=everything"}
+	c.Assert(func() { m.MongoSearcher.Search(q) }, Panics, createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
+}
+
 func (m *MongoSearchSuite) TestSummaryCountWithCountsDisabled(c *C) {
 	// The count should still be returned when requesting _summary=count, even if counts are disabled.
 	db := m.Session.DB("fhir-test")
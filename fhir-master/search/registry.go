@@ -2,6 +2,7 @@ package search
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -61,6 +62,33 @@ func (r *Registry) LookupParameterInfo(resource, name string) (param SearchParam
 	return param, nil
 }
 
+// ResourceNames returns the names of all resources that have search parameters, in alphabetical order.
+func (r *Registry) ResourceNames() []string {
+	r.infosLock.RLock()
+	defer r.infosLock.RUnlock()
+	names := make([]string, 0, len(SearchParameterDictionary))
+	for resource := range SearchParameterDictionary {
+		names = append(names, resource)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ParameterInfos returns both the standard and custom search parameters of a resource, sorted by name.
+func (r *Registry) ParameterInfos(resource string) []SearchParamInfo {
+	r.infosLock.RLock()
+	defer r.infosLock.RUnlock()
+	// custom parameters are also added to SearchParameterDictionary
+	infos := make([]SearchParamInfo, 0, len(SearchParameterDictionary[resource]))
+	for _, info := range SearchParameterDictionary[resource] {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
+
 // RegisterParameterParser registers a parameter parser for a given type name.
 func (r *Registry) RegisterParameterParser(paramType string, parser ParameterParser) {
 	r.parsersLock.Lock()
@@ -54,3 +54,26 @@ func (s *RegistrySuite) TestLookupNonExistingParameterParser(c *C) {
 	c.Assert(err, Not(IsNil))
 	c.Assert(obtained, IsNil)
 }
+
+func (s *RegistrySuite) TestParameterInfos(c *C) {
+	c.Assert(GlobalRegistry().ResourceNames(), Not(HasLen), 0)
+	c.Assert(GlobalRegistry().ResourceNames()[0], Equals, "Account")
+
+	infos := GlobalRegistry().ParameterInfos("Patient")
+	c.Assert(infos, HasLen, len(SearchParameterDictionary["Patient"]))
+	c.Assert(infos[0].Name, Equals, "_id")
+
+	var name SearchParamInfo
+	for _, info := range infos {
+		if info.Name == "name" {
+			name = info
+		}
+	}
+	c.Assert(name.Type, Equals, "string")
+}
+
+func (s *RegistrySuite) TestSupportedModifiers(c *C) {
+	c.Assert(SupportedModifiers(SearchParameterDictionary["Patient"]["organization"]), DeepEquals, []string{"Organization", "identifier"})
+	c.Assert(SupportedModifiers(SearchParameterDictionary["Patient"]["gender"]), DeepEquals, []string{"text", "above", "below"})
+	c.Assert(SupportedModifiers(SearchParameterDictionary["Patient"]["name"]), IsNil)
+}
@@ -0,0 +1,130 @@
+package search
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// cursorPage describes a search paged by continuing after the last result of the previous page
+// (_searchafter) rather than by skipping results (_offset), which gets slow for deep pages.
+// Results are sorted by field and then _id, both in the same direction, so that the last
+// result's values identify where the next page starts.
+type cursorPage struct {
+	field      string
+	descending bool
+	after      bson.M // condition selecting results after the previous page, if any
+}
+
+// searchAfterToken is what's encoded in a _searchafter value: the sort field's value
+// and the _id of the last result of a page
+type searchAfterToken struct {
+	Value interface{} `bson:"v"`
+	ID    string      `bson:"id"`
+}
+
+// newCursorPage returns a cursorPage for a search with these options, or nil if the sort isn't
+// suitable. That requires sorting by at most one parameter with a single, non-repeating path,
+// which isn't chained.
+func newCursorPage(options *QueryOptions) *cursorPage {
+	switch len(options.Sort) {
+	case 0:
+		return &cursorPage{field: "_id"}
+	case 1:
+		sort := options.Sort[0]
+		if sort.Reference != nil || len(sort.Parameter.Paths) != 1 || strings.Contains(sort.Parameter.Paths[0].Path, "[]") {
+			return nil
+		}
+		return &cursorPage{field: convertSearchPathToMongoField(sort.Parameter.Paths[0].Path), descending: sort.Descending}
+	default:
+		return nil
+	}
+}
+
+// direction returns the MongoDB sort direction for the page
+func (p *cursorPage) direction() int {
+	if p.descending {
+		return -1
+	}
+	return 1
+}
+
+// sort returns the MongoDB sort for the page, with _id breaking any ties
+func (p *cursorPage) sort() bson.D {
+	fields := bson.D{}
+	if p.field != "_id" {
+		fields = append(fields, bson.E{Key: p.field, Value: p.direction()})
+	}
+	return append(fields, bson.E{Key: "_id", Value: p.direction()})
+}
+
+// continueAfter sets the condition selecting the results after those of a _searchafter value
+func (p *cursorPage) continueAfter(searchAfter string) {
+	var token searchAfterToken
+	data, err := base64.RawURLEncoding.DecodeString(searchAfter)
+	if err == nil {
+		err = bson.Unmarshal(data, &token)
+	}
+	if err != nil || token.ID == "" {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_searchafter\" content is invalid"))
+	}
+
+	after := "$gt"
+	if p.descending {
+		after = "$lt"
+	}
+
+	switch {
+	case p.field == "_id":
+		p.after = bson.M{"_id": bson.M{after: token.ID}}
+	case token.Value == nil && !p.descending:
+		// missing values sort first
+		p.after = bson.M{"$or": []bson.M{
+			{p.field: bson.M{"$ne": nil}},
+			{p.field: nil, "_id": bson.M{after: token.ID}},
+		}}
+	case token.Value == nil:
+		// missing values sort last
+		p.after = bson.M{p.field: nil, "_id": bson.M{after: token.ID}}
+	default:
+		conditions := []bson.M{
+			{p.field: bson.M{after: token.Value}},
+			{p.field: token.Value, "_id": bson.M{after: token.ID}},
+		}
+		if p.descending {
+			conditions = append(conditions, bson.M{p.field: nil})
+		}
+		p.after = bson.M{"$or": conditions}
+	}
+}
+
+// searchAfter returns the _searchafter value for continuing after a document
+func (p *cursorPage) searchAfter(document bson.D) string {
+	token := searchAfterToken{Value: lookupField(document, p.field)}
+	token.ID, _ = lookupField(document, "_id").(string)
+	data, err := bson.Marshal(token)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// lookupField returns the value of a dotted field (e.g. meta.lastUpdated) in a document, or nil
+func lookupField(document bson.D, field string) interface{} {
+	var value interface{} = document
+	for _, key := range strings.Split(field, ".") {
+		doc, ok := value.(bson.D)
+		if !ok {
+			return nil
+		}
+		value = nil
+		for _, element := range doc {
+			if element.Key == key {
+				value = element.Value
+				break
+			}
+		}
+	}
+	return value
+}
@@ -30,12 +30,16 @@ const (
 	ContainedParam     = "_contained"
 	ContainedTypeParam = "_containedType"
 	OffsetParam        = "_offset" // Custom param, not in FHIR spec
+	FilterParam        = "_filter"
 	FormatParam        = "_format"
+	TotalParam         = "_total"
+	SearchAfterParam   = "_searchafter" // Custom param, not in FHIR spec
+	ScoreSort          = "_score"       // _sort value ordering text search results by relevance
 )
 
 var globalSearchParams = map[string]bool{IDParam: true, LastUpdatedParam: true, TagParam: true,
 	ProfileParam: true, SecurityParam: true, TextParam: true, ContentParam: true, ListParam: true,
-	QueryParam: true, HasParam: true}
+	QueryParam: true, HasParam: true, FilterParam: true}
 
 func isGlobalSearchParam(param string) bool {
 	_, found := globalSearchParams[param]
@@ -44,7 +48,8 @@ func isGlobalSearchParam(param string) bool {
 
 var searchResultParams = map[string]bool{SortParam: true, CountParam: true, IncludeParam: true,
 	RevIncludeParam: true, SummaryParam: true, ElementsParam: true, ContainedParam: true,
-	ContainedTypeParam: true, OffsetParam: true, FormatParam: true}
+	ContainedTypeParam: true, OffsetParam: true, FormatParam: true, TotalParam: true,
+	SearchAfterParam: true}
 
 func isSearchResultParam(param string) bool {
 	_, found := searchResultParams[param]
@@ -73,6 +78,14 @@ func (q *Query) Params() []SearchParam {
 			continue
 		}
 
+		if param == FilterParam {
+			if modifier != "" || postfix != "" {
+				panic(createUnsupportedSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", FilterParam)))
+			}
+			results = append(results, ParseFilterParam(queryParam.Value, q.Resource))
+			continue
+		}
+
 		var info SearchParamInfo
 		ok := true
 
@@ -93,7 +106,10 @@ func (q *Query) Params() []SearchParam {
 			results = append(results, info.CreateSearchParam(queryParam.Value))
 		} else {
 
-			if isGlobalSearchParam(param) {
+			if len(SearchParameterDictionary[q.Resource]) == 0 {
+				// only a search without criteria (returning every resource) is possible
+				panic(createInvalidSearchError("SEARCH_NONE", fmt.Sprintf("Error: %s resources have no search parameters (found \"%s\")", q.Resource, param)))
+			} else if isGlobalSearchParam(param) {
 				panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param)))
 			} else {
 				panic(createInvalidSearchError("SEARCH_NONE", fmt.Sprintf("Error: no processable search found for %s search parameters \"%s\"", q.Resource, param)))
@@ -103,6 +119,47 @@ func (q *Query) Params() []SearchParam {
 	return results
 }
 
+// CheckLimits panics with a 400 if the query has more than maxParameters search parameters (not
+// counting search result parameters like _count) or if one of them has more than maxValuesPerParameter
+// comma-separated (OR'd) values. Zero means no limit.
+func (q *Query) CheckLimits(maxParameters int, maxValuesPerParameter int) {
+	queryParams, _ := ParseQuery(q.Query)
+	numParams := 0
+	for _, queryParam := range queryParams.All() {
+		param, _, _ := ParseParamNameModifierAndPostFix(queryParam.Key)
+		if isSearchResultParam(param) {
+			continue
+		}
+
+		numParams++
+		if maxParameters > 0 && numParams > maxParameters {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Too many search parameters (maximum is %d)", maxParameters)))
+		}
+		if maxValuesPerParameter > 0 && len(escapeFriendlySplit(queryParam.Value, ',')) > maxValuesPerParameter {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" has too many values (maximum is %d)", param, maxValuesPerParameter)))
+		}
+	}
+}
+
+// LimitCount reduces the _count of the query to maxCount if it asks for more results, returning
+// a warning saying so (or "" if it doesn't). Zero means no limit.
+func (q *Query) LimitCount(maxCount int) (warning string) {
+	if maxCount <= 0 {
+		return ""
+	}
+	queryParams, err := ParseQuery(q.Query)
+	if err != nil {
+		return ""
+	}
+	count, err := strconv.Atoi(queryParams.Get(CountParam))
+	if err != nil || count <= maxCount {
+		return ""
+	}
+	queryParams.Set(CountParam, strconv.Itoa(maxCount))
+	q.Query = queryParams.Encode()
+	return fmt.Sprintf("Parameter \"_count\" was reduced from %d to the maximum of %d", count, maxCount)
+}
+
 // Options parses the query string and returns the QueryOptions.
 func (q *Query) Options() *QueryOptions {
 	options := NewQueryOptions()
@@ -129,8 +186,13 @@ func (q *Query) Options() *QueryOptions {
 			if err != nil {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_count\" content is invalid"))
 			}
-			if count >= 0 {
+			if count == 0 {
+				// _count=0 only asks for the total, just like _summary=count
+				options.Summary = "count"
+			} else if count > 0 {
 				options.Count = count
+			} else {
+				options.Warnings = append(options.Warnings, fmt.Sprintf("Parameter \"_count\" was ignored as it is negative (%d)", count))
 			}
 
 		case OffsetParam:
@@ -140,6 +202,8 @@ func (q *Query) Options() *QueryOptions {
 			}
 			if offset >= 0 {
 				options.Offset = offset
+			} else {
+				options.Warnings = append(options.Warnings, fmt.Sprintf("Parameter \"_offset\" was ignored as it is negative (%d)", offset))
 			}
 
 		case SortParam:
@@ -147,11 +211,11 @@ func (q *Query) Options() *QueryOptions {
 			keys := strings.Split(queryParam.Value, ",")
 			for _, key := range keys {
 				desc := strings.HasPrefix(key, "-") || modifier == "desc"
-				sortParam, ok := SearchParameterDictionary[q.Resource][strings.TrimPrefix(key, "-")]
-				if !ok {
-					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+				if strings.TrimPrefix(key, "-") == ScoreSort {
+					// relevance only exists for text searches, which aren't supported
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" can't be _score as _text and _content searches aren't supported"))
 				}
-				options.Sort = append(options.Sort, SortOption{Descending: desc, Parameter: sortParam})
+				options.Sort = append(options.Sort, parseSortOption(q.Resource, strings.TrimPrefix(key, "-"), desc))
 			}
 			// If this was an STU3-style sort, remember that so we reconstruct the query URL correctly
 			if len(keys) > 1 || strings.HasPrefix(queryParam.Value, "-") {
@@ -164,6 +228,11 @@ func (q *Query) Options() *QueryOptions {
 				continue
 			}
 
+			iterate := isIterateModifier(modifier)
+			if modifier != "" && !iterate {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
+			}
+
 			incls := strings.Split(queryParam.Value, ":")
 			if len(incls) < 2 || len(incls) > 3 {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
@@ -184,7 +253,7 @@ func (q *Query) Options() *QueryOptions {
 					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_include\" content is invalid"))
 				}
 			}
-			options.Include = append(options.Include, IncludeOption{Resource: incls[0], Parameter: inclParam})
+			options.Include = append(options.Include, IncludeOption{Resource: incls[0], Parameter: inclParam, Iterate: iterate})
 
 		case RevIncludeParam:
 
@@ -192,6 +261,11 @@ func (q *Query) Options() *QueryOptions {
 				continue
 			}
 
+			iterate := isIterateModifier(modifier)
+			if modifier != "" && !iterate {
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
+			}
+
 			incls := strings.Split(queryParam.Value, ":")
 			if len(incls) < 2 || len(incls) > 3 {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
@@ -204,6 +278,17 @@ func (q *Query) Options() *QueryOptions {
 			if revInclParam.Type != "reference" {
 				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
 			}
+			if iterate {
+				// Iterated revincludes can target any of the parameter's targets
+				if len(incls) == 3 {
+					if !isValidTarget(incls[2], revInclParam) {
+						panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_revinclude\" content is invalid"))
+					}
+					revInclParam.Targets = []string{incls[2]}
+				}
+				options.RevInclude = append(options.RevInclude, RevIncludeOption{Resource: incls[0], Parameter: revInclParam, Iterate: true})
+				continue
+			}
 			// Only the currently searched on resource is a valid target (or "Any")
 			target := q.Resource
 			if len(incls) == 3 && incls[2] != target && incls[2] != "Any" {
@@ -222,24 +307,67 @@ func (q *Query) Options() *QueryOptions {
 			switch (queryParam.Value) {
 			// Currently we only support JSON and (if enabled) XML
 			// _format is processed closer to the HTTP code rather than here
-			case "json", "application/json", "application/json+fhir", "application/fhir+json":
-			case "xml", "application/xml", "application/xml+fhir", "application/fhir+xml":
+			case "json", "text/json", "application/json", "application/json+fhir", "application/fhir+json":
+			case "xml", "text/xml", "application/xml", "application/xml+fhir", "application/fhir+xml":
 			default:
 				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_format\" content is invalid"))
 			}
 
+		case ElementsParam:
+			for _, element := range strings.Split(queryParam.Value, ",") {
+				element = strings.TrimSpace(element)
+				if !elementNameRegex.MatchString(element) {
+					panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_elements\" content is invalid"))
+				}
+				options.Elements = append(options.Elements, element)
+			}
+
 		case SummaryParam:
-			if queryParam.Value != "count" && queryParam.Value != "false" {
-				// We only support "count", and the default (implicit) setting is "false".
+			switch queryParam.Value {
+			case "true", "text", "data", "count", "false":
+				options.Summary = queryParam.Value
+			default:
 				panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_summary\" content is invalid"))
 			}
-			options.Summary = queryParam.Value
+
+		case SearchAfterParam:
+			options.SearchAfter = queryParam.Value
+
+		case ContainedParam:
+			switch queryParam.Value {
+			case "true", "false", "both":
+				options.Contained = queryParam.Value
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_contained\" content is invalid"))
+			}
+
+		case ContainedTypeParam:
+			switch queryParam.Value {
+			case "container", "contained":
+				options.ContainedType = queryParam.Value
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_containedType\" content is invalid"))
+			}
+
+		case TotalParam:
+			switch queryParam.Value {
+			case "none", "estimate", "accurate":
+				options.Total = queryParam.Value
+			default:
+				panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_total\" content is invalid"))
+			}
 
 		default:
 			panic(createUnsupportedSearchError("MSG_PARAM_UNKNOWN", fmt.Sprintf("Parameter \"%s\" not understood", param)))
 		}
 	}
 
+	if options.Summary == "count" {
+		// no entries are returned so _count and _offset are meaningless
+		options.Count = NewQueryOptions().Count
+		options.Offset = 0
+	}
+
 	if options.IsIncludeAll {
 		// check if this resource has any includes
 		inclParams := SearchParameterDictionary[q.Resource]
@@ -390,8 +518,49 @@ type QueryOptions struct {
 	IsIncludeAll    bool
 	IsRevincludeAll bool
 	Summary         string
+	// Elements lists the top-level elements to return (_elements), in addition to
+	// the mandatory id, meta and resourceType. Empty for whole resources.
+	Elements []string
+	// Total is how the total number of matches is wanted (_total): "none", "estimate"
+	// or "accurate", or empty to leave it to the server's configuration
+	Total string
+	// SearchAfter continues a search after the last result of a previous page (_searchafter),
+	// as an alternative to Offset for deep pages
+	SearchAfter string
+	// Contained is whether resources contained in other resources are searched (_contained):
+	// "false" (or empty) for only resources that aren't contained, "true" for only contained ones or "both"
+	Contained string
+	// ContainedType is how contained matches are returned (_containedType): as the resources that
+	// contain them ("container", or empty) or as the contained resources themselves ("contained")
+	ContainedType string
+	// Warnings describe parameters that were adjusted rather than applied as is,
+	// such as a negative _count
+	Warnings []string
+}
+
+// CountsTotal returns true if the total number of matches should be computed for these options,
+// given whether the server counts totals by default
+func (o *QueryOptions) CountsTotal(countTotalResults bool) bool {
+	if o.Summary == "count" {
+		return true
+	}
+	switch o.Total {
+	case "none":
+		return false
+	case "estimate", "accurate":
+		return true
+	}
+	return countTotalResults
+}
+
+// SearchesContained returns true if resources contained in other resources are searched (_contained=true or both)
+func (o *QueryOptions) SearchesContained() bool {
+	return o.Contained == "true" || o.Contained == "both"
 }
 
+// elementNameRegex matches the top-level element names accepted by _elements
+var elementNameRegex = regexp.MustCompile(`^[a-z][A-Za-z0-9]*$`)
+
 // NewQueryOptions constructs a new QueryOptions with default values (offset = 0, Count = 100)
 func NewQueryOptions() *QueryOptions {
 	return &QueryOptions{Offset: 0, Count: 100}
@@ -404,9 +573,9 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 		keys := make([]string, len(o.Sort))
 		for i := range o.Sort {
 			if o.Sort[i].Descending {
-				keys[i] = fmt.Sprintf("-%s", o.Sort[i].Parameter.Name)
+				keys[i] = fmt.Sprintf("-%s", o.Sort[i].Name())
 			} else {
-				keys[i] = o.Sort[i].Parameter.Name
+				keys[i] = o.Sort[i].Name()
 			}
 		}
 		queryParams.Add(SortParam, strings.Join(keys, ","))
@@ -416,16 +585,42 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 			if sort.Descending {
 				sortParamKey += ":desc"
 			}
-			queryParams.Add(sortParamKey, sort.Parameter.Name)
+			queryParams.Add(sortParamKey, sort.Name())
 		}
 	}
 	queryParams.Set(OffsetParam, strconv.Itoa(o.Offset))
 	queryParams.Set(CountParam, strconv.Itoa(o.Count))
 	for _, incl := range o.Include {
-		queryParams.Add(IncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+		key := IncludeParam
+		if incl.Iterate {
+			key += ":iterate"
+		}
+		queryParams.Add(key, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
 	}
 	for _, incl := range o.RevInclude {
-		queryParams.Add(RevIncludeParam, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+		key := RevIncludeParam
+		if incl.Iterate {
+			key += ":iterate"
+		}
+		queryParams.Add(key, fmt.Sprintf("%s:%s", incl.Resource, incl.Parameter.Name))
+	}
+	if len(o.Elements) > 0 {
+		queryParams.Set(ElementsParam, strings.Join(o.Elements, ","))
+	}
+	if o.Summary != "" && o.Summary != "false" && o.Summary != "count" {
+		queryParams.Set(SummaryParam, o.Summary)
+	}
+	if o.Total != "" {
+		queryParams.Set(TotalParam, o.Total)
+	}
+	if o.Contained != "" {
+		queryParams.Set(ContainedParam, o.Contained)
+	}
+	if o.ContainedType != "" {
+		queryParams.Set(ContainedTypeParam, o.ContainedType)
+	}
+	if o.SearchAfter != "" {
+		queryParams.Set(SearchAfterParam, o.SearchAfter)
 	}
 	return queryParams
 }
@@ -434,18 +629,100 @@ func (o *QueryOptions) URLQueryParameters() URLQueryParameters {
 type IncludeOption struct {
 	Resource  string
 	Parameter SearchParamInfo
+	// Iterate is set for _include:iterate, which also applies to included resources
+	Iterate bool
 }
 
 // RevIncludeOption describes the data that should be included in query results
 type RevIncludeOption struct {
 	Resource  string
 	Parameter SearchParamInfo
+	// Iterate is set for _revinclude:iterate, which also applies to included resources
+	Iterate bool
+}
+
+// isIterateModifier returns true for the :iterate modifier of _include and _revinclude
+// (called :recurse in STU3)
+func isIterateModifier(modifier string) bool {
+	return modifier == "iterate" || modifier == "recurse"
+}
+
+// UsesIterativeIncludes returns true if there are any _include:iterate or _revinclude:iterate options
+func (o *QueryOptions) UsesIterativeIncludes() bool {
+	for _, incl := range o.Include {
+		if incl.Iterate {
+			return true
+		}
+	}
+	for _, incl := range o.RevInclude {
+		if incl.Iterate {
+			return true
+		}
+	}
+	return false
 }
 
 // SortOption indicates what parameter to sort on and the sort order
 type SortOption struct {
 	Descending bool
 	Parameter  SearchParamInfo
+
+	// Reference is the reference parameter of a chained sort (e.g. patient in _sort=patient.family),
+	// in which case Parameter is one of the referenced resources (of type Parameter.Resource)
+	Reference *SearchParamInfo
+}
+
+// Name returns the _sort value of the sort (without any "-"), e.g. family or patient.family
+func (s SortOption) Name() string {
+	if s.Reference == nil {
+		return s.Parameter.Name
+	}
+	name := s.Reference.Name
+	if s.Reference.Modifier != "" {
+		name += ":" + s.Reference.Modifier
+	}
+	return name + "." + s.Parameter.Name
+}
+
+// parseSortOption parses a _sort value (without any "-"). This is either a search parameter of the resource
+// or, for a chained sort (e.g. patient.family or subject:Patient.family), a parameter of the resources
+// referenced by one of its reference parameters. Without a type, references that can have several are
+// sorted by their first target type having the parameter, so that the choice doesn't vary.
+func parseSortOption(resource string, key string, desc bool) SortOption {
+	param, modifier, postfix := ParseParamNameModifierAndPostFix(key)
+	if postfix == "" && modifier == "" {
+		sortParam, ok := SearchParameterDictionary[resource][param]
+		if !ok {
+			panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+		}
+		return SortOption{Descending: desc, Parameter: sortParam}
+	}
+
+	reference, ok := SearchParameterDictionary[resource][param]
+	if !ok || reference.Type != "reference" || postfix == "" {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+	}
+	if strings.Contains(postfix, ".") {
+		panic(createUnsupportedSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" can only be chained through a single reference"))
+	}
+	reference.Modifier = modifier
+
+	var target string
+	if modifier == "" && len(reference.Targets) > 1 {
+		for _, t := range reference.Targets {
+			if _, found := SearchParameterDictionary[t][postfix]; found {
+				target = t
+				break
+			}
+		}
+	} else {
+		target = findReferencedType("", reference)
+	}
+	sortParam, ok := SearchParameterDictionary[target][postfix]
+	if !ok {
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
+	}
+	return SortOption{Descending: desc, Parameter: sortParam, Reference: &reference}
 }
 
 // SearchParam is an interface for all search parameter classes that exposes
@@ -612,6 +889,8 @@ func (s SearchParamInfo) CreateSearchParam(paramStr string) SearchParam {
 type SearchParamPath struct {
 	Path string
 	Type string
+	// System restricts a ContactPoint path to contact points with this system (e.g. email)
+	System string
 }
 
 // CompositeParam represents a composite-flavored search parameter.  The
@@ -684,7 +963,7 @@ func ParseDateParam(paramStr string, info SearchParamInfo) *DateParam {
 	var err error
 	date.Date, err = utils.ParseDate(value)
 	if err != nil {
-		panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %v", info.Name, err)))
+		panic(createInvalidSearchError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid: %q isn't a valid date (e.g. 2019, 2019-03, 2019-03-31 or 2019-03-31T14:30:00Z)", info.Name, paramStr)))
 	}
 
 	return date
@@ -815,6 +1094,12 @@ func (r *ReferenceParam) getQueryParamAndValue() (string, string) {
 		return r.Name, escape(t.URL)
 	case LocalReference:
 		return r.Name, fmt.Sprintf("%s/%s", t.Type, escape(t.ID))
+	case IdentifierReference:
+		value := escape(t.Value)
+		if !t.AnySystem || t.System != "" {
+			value = fmt.Sprintf("%s|%s", escape(t.System), escape(t.Value))
+		}
+		return queryParamAndValue(r.SearchParamInfo, value)
 	}
 	panic(createInternalServerError("MSG_PARAM_INVALID", fmt.Sprintf("Parameter \"%s\" content is invalid", r.Name)))
 }
@@ -864,6 +1149,14 @@ func ParseReferenceParam(paramStr string, info SearchParamInfo) *ReferenceParam
 		q := Query{Resource: parts[0], Query: parts[2] + "=" + paramStr}
 		return &ReferenceParam{info, ReverseChainedQueryReference{ReferenceName: parts[1], Type: parts[0], Query: q}}
 	}
+	if info.Modifier == "identifier" {
+		// [parameter]:identifier=[system]|[value] matches the identifier within the reference
+		if info.Postfix != "" {
+			panic(createInvalidSearchError("MSG_PARAM_MODIFIER_INVALID", fmt.Sprintf("Parameter \"%s\" modifier is invalid", info.Name)))
+		}
+		t := ParseTokenParam(paramStr, info)
+		return &ReferenceParam{info, IdentifierReference{System: t.System, Value: t.Code, AnySystem: t.AnySystem}}
+	}
 	if info.Postfix != "" {
 		typ := findReferencedType("", info)
 		q := Query{Resource: typ, Query: info.Postfix + "=" + paramStr}
@@ -936,6 +1229,14 @@ type ExternalReference struct {
 	URL  string
 }
 
+// IdentifierReference represents a reference by the logical identifier of its target
+// (e.g. subject:identifier=http://acme.com|1234)
+type IdentifierReference struct {
+	System    string
+	Value     string
+	AnySystem bool
+}
+
 // ChainedQueryReference represents a chained query
 type ChainedQueryReference struct {
 	Type         string // The type of resource being searched
@@ -960,8 +1261,22 @@ type ReverseChainedQueryReference struct {
 type StringParam struct {
 	SearchParamInfo
 	String string
+	Match  StringMatch
 }
 
+// StringMatch overrides the default matching of a StringParam, for the
+// comparisons of a _filter expression.
+type StringMatch string
+
+// Constant values for the StringMatch enum.  The default (an empty
+// StringMatch) is the equals-or-starts-with matching described above.
+const (
+	StringMatchEquals     StringMatch = "eq"
+	StringMatchContains   StringMatch = "co"
+	StringMatchStartsWith StringMatch = "sw"
+	StringMatchEndsWith   StringMatch = "ew"
+)
+
 func (s *StringParam) getInfo() SearchParamInfo {
 	return s.SearchParamInfo
 }
@@ -977,7 +1292,7 @@ func (s *StringParam) getQueryParamAndValue() (string, string) {
 // ParseStringParam parses a string-based query string and returns a pointer to
 // a StringParam based on the query and the parameter definition.
 func ParseStringParam(paramString string, info SearchParamInfo) *StringParam {
-	return &StringParam{info, unescape(paramString)}
+	return &StringParam{SearchParamInfo: info, String: unescape(paramString)}
 }
 
 // TokenParam represents a token-flavored search parameter.  The
@@ -1019,6 +1334,13 @@ func ParseTokenParam(paramString string, info SearchParamInfo) *TokenParam {
 
 	t := &TokenParam{SearchParamInfo: info}
 
+	if info.Modifier == "text" {
+		// [parameter]:text=[text] - the whole value is the text to search for
+		t.AnySystem = true
+		t.Code = unescape(paramString)
+		return t
+	}
+
 	splitCode := escapeFriendlySplit(paramString, '|')
 	if len(splitCode) == 2 {
 		t.System = unescape(splitCode[0])
@@ -4,6 +4,7 @@ import (
 	"github.com/eug48/fhir/utils"
 	. "github.com/eug48/fhir/utils"
 	"fmt"
+	"regexp"
 	"time"
 
 	. "gopkg.in/check.v1"
@@ -283,6 +284,17 @@ func (s *SearchPTSuite) TestDatesToYears(c *C) {
 	c.Assert(d.RangeHighExcl().UnixNano(), Equals, time.Date(2014, time.January, 1, 0, 0, 0, 0, time.Local).UnixNano())
 }
 
+func (s *SearchPTSuite) TestMalformedDates(c *C) {
+	for _, value := range []string{"notadate", "2019-13", "2019-02-30", "2019-01-01T25:00", "2019-01-01T10", "2019x", "gt", "ge2019/01/01"} {
+		q := Query{"Condition", "onset-date=" + value}
+		c.Assert(func() { q.Params() }, PanicMatches, `HTTP 400: .*Parameter "onset-date" content is invalid: "`+regexp.QuoteMeta(value)+`" isn't a valid date .*`, Commentf(value))
+	}
+
+	// a date's timezone can still be given without a time
+	_, err := utils.ParseDate("2019-03-31+10:00")
+	c.Assert(err, IsNil)
+}
+
 func (s *SearchPTSuite) TestLeapAndNonLeapYears(c *C) {
 
 	// Non-Leap Year
@@ -1183,6 +1195,36 @@ func (s *SearchPTSuite) TestReferenceAbsolutURLReconstitution(c *C) {
 	c.Assert(v, Equals, "http://acme.org/fhir/Patient/23\\$45")
 }
 
+func (s *SearchPTSuite) TestReferenceIdentifier(c *C) {
+	modInfo := referenceParamInfo
+	modInfo.Modifier = "identifier"
+	r := ParseReferenceParam("http://acme.com|1234", modInfo)
+
+	c.Assert(r.Name, Equals, "foo")
+	c.Assert(r.Modifier, Equals, "identifier")
+	c.Assert(r.Reference, DeepEquals, IdentifierReference{System: "http://acme.com", Value: "1234"})
+
+	r = ParseReferenceParam("1234", modInfo)
+	c.Assert(r.Reference, DeepEquals, IdentifierReference{Value: "1234", AnySystem: true})
+
+	r = ParseReferenceParam("|1234", modInfo)
+	c.Assert(r.Reference, DeepEquals, IdentifierReference{Value: "1234"})
+}
+
+func (s *SearchPTSuite) TestReferenceIdentifierReconstitution(c *C) {
+	modInfo := referenceParamInfo
+	modInfo.Modifier = "identifier"
+	r := ParseReferenceParam("http://acme.com|1234", modInfo)
+	p, v := r.getQueryParamAndValue()
+	c.Assert(p, Equals, "foo:identifier")
+	c.Assert(v, Equals, "http://acme.com|1234")
+
+	r = ParseReferenceParam("1234", modInfo)
+	p, v = r.getQueryParamAndValue()
+	c.Assert(p, Equals, "foo:identifier")
+	c.Assert(v, Equals, "1234")
+}
+
 func (s *SearchPTSuite) TestReferenceChainedQuery(c *C) {
 	modInfo := referenceParamInfo
 	modInfo.Postfix = "name"
@@ -1388,6 +1430,18 @@ func (s *SearchPTSuite) TestTokenParamSystemlessCode(c *C) {
 	c.Assert(t.System, Equals, "")
 }
 
+func (s *SearchPTSuite) TestTokenParamTextModifier(c *C) {
+	modInfo := tokenParamInfo
+	modInfo.Modifier = "text"
+	t := ParseTokenParam("Heart failure|acute", modInfo)
+
+	c.Assert(t.Name, Equals, "foo")
+	c.Assert(t.Modifier, Equals, "text")
+	c.Assert(t.AnySystem, Equals, true)
+	c.Assert(t.Code, Equals, "Heart failure|acute")
+	c.Assert(t.System, Equals, "")
+}
+
 func (s *SearchPTSuite) TestTokenParamsWithEscapedPipesAndSlashes(c *C) {
 	t := ParseTokenParam("foo\\|bar", tokenParamInfo)
 
@@ -1410,6 +1464,75 @@ func (s *SearchPTSuite) TestTokenParamsWithEscapedPipesAndSlashes(c *C) {
 	c.Assert(t.System, Equals, "foo|bar")
 }
 
+func (s *SearchPTSuite) TestParamsForResourceTypeWithoutSearchParameters(c *C) {
+	// Parameters resources can't be searched by anything
+	c.Assert(SearchParameterDictionary["Parameters"], HasLen, 0)
+
+	q := Query{"Parameters", ""}
+	c.Assert(q.Params(), HasLen, 0)
+
+	q = Query{"Parameters", "_count=10&_sort=_id"}
+	c.Assert(q.Params(), HasLen, 0)
+
+	q = Query{"Parameters", "foo=bar"}
+	c.Assert(func() { q.Params() }, PanicMatches, `.*Parameters resources have no search parameters \(found "foo"\).*`)
+
+	// including the parameters that are usually global
+	q = Query{"Parameters", "_id=123"}
+	c.Assert(func() { q.Params() }, PanicMatches, `.*Parameters resources have no search parameters \(found "_id"\).*`)
+}
+
+func (s *SearchPTSuite) TestParamsWithinLimits(c *C) {
+	// search result parameters don't count towards the limit
+	q := Query{"Patient", "gender=male,female,unknown&name=Peter&_count=10&_sort=family"}
+	q.CheckLimits(2, 3)
+
+	// an escaped comma doesn't separate values
+	q = Query{"Patient", "name=a,b,c\\,d"}
+	q.CheckLimits(2, 3)
+}
+
+func (s *SearchPTSuite) TestParamsOverLimits(c *C) {
+	q := Query{"Patient", "gender=male&name=Peter&family=Smith"}
+	c.Assert(func() { q.CheckLimits(2, 3) }, PanicMatches, `.*Too many search parameters \(maximum is 2\).*`)
+
+	q = Query{"Patient", "gender=male,female,unknown,other"}
+	c.Assert(func() { q.CheckLimits(2, 3) }, PanicMatches, `.*Parameter "gender" has too many values \(maximum is 3\).*`)
+
+	// a limit of zero disables the check
+	q = Query{"Patient", "gender=male,female,unknown,other&name=Peter&family=Smith"}
+	q.CheckLimits(0, 0)
+	c.Assert(q.Params(), HasLen, 3)
+
+	// searchers check their limits before searching
+	searcher := NewMongoSearcher(nil, nil, false, false, false, false)
+	searcher.SetLimits(2, 3)
+	c.Assert(func() { searcher.Search(Query{"Patient", "gender=male&name=Peter&family=Smith"}) }, PanicMatches,
+		`.*Too many search parameters \(maximum is 2\).*`)
+}
+
+func (s *SearchPTSuite) TestContactPointSystemParams(c *C) {
+	q := Query{"Patient", "email=john@example.com&phone=555-1234"}
+	params := q.Params()
+	c.Assert(params, HasLen, 2)
+
+	email, ok := params[0].(*TokenParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(email.Name, Equals, "email")
+	c.Assert(email.Paths, DeepEquals, []SearchParamPath{{Path: "[]telecom", Type: "ContactPoint", System: "email"}})
+	c.Assert(email.AnySystem, Equals, true)
+	c.Assert(email.Code, Equals, "john@example.com")
+
+	phone, ok := params[1].(*TokenParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(phone.Name, Equals, "phone")
+	c.Assert(phone.Paths, DeepEquals, []SearchParamPath{{Path: "[]telecom", Type: "ContactPoint", System: "phone"}})
+	c.Assert(phone.Code, Equals, "555-1234")
+
+	// the telecom parameter itself isn't restricted to a system
+	c.Assert(SearchParameterDictionary["Patient"]["telecom"].Paths[0].System, Equals, "")
+}
+
 func (s *SearchPTSuite) TestTokenParamReconstitution(c *C) {
 	t := ParseTokenParam("http://hl7.org/fhir/v2/0001|M", tokenParamInfo)
 	p, v := t.getQueryParamAndValue()
@@ -1733,11 +1856,81 @@ func (s *SearchPTSuite) TestQueryOptionsWithSTU3Sort(c *C) {
 	c.Assert(o.Sort[2].Parameter.Name, Equals, "birthdate")
 }
 
+func (s *SearchPTSuite) TestQueryOptionsWithMixedSortDirections(c *C) {
+	q := Query{Resource: "Condition", Query: "_sort=patient&_sort:desc=onset-date&_sort=code&_sort:desc=asserted-date"}
+	o := q.Options()
+	c.Assert(o.Sort, HasLen, 4)
+	c.Assert(o.Sort[0].Descending, Equals, false)
+	c.Assert(o.Sort[0].Parameter.Name, Equals, "patient")
+	c.Assert(o.Sort[1].Descending, Equals, true)
+	c.Assert(o.Sort[1].Parameter.Name, Equals, "onset-date")
+	c.Assert(o.Sort[2].Descending, Equals, false)
+	c.Assert(o.Sort[2].Parameter.Name, Equals, "code")
+	c.Assert(o.Sort[3].Descending, Equals, true)
+	c.Assert(o.Sort[3].Parameter.Name, Equals, "asserted-date")
+
+	// the paging links repeat the keys with their directions in the same order
+	queryParams := o.URLQueryParameters()
+	c.Assert(queryParams.All()[:4], DeepEquals, []URLQueryParameter{
+		{Key: "_sort", Value: "patient"},
+		{Key: "_sort:desc", Value: "onset-date"},
+		{Key: "_sort", Value: "code"},
+		{Key: "_sort:desc", Value: "asserted-date"},
+	})
+
+	q = Query{Resource: "Condition", Query: "_sort=patient,-onset-date,code,-asserted-date"}
+	o = q.Options()
+	c.Assert(o.Sort, HasLen, 4)
+	for i, desc := range []bool{false, true, false, true} {
+		c.Assert(o.Sort[i].Descending, Equals, desc)
+	}
+	queryParams = o.URLQueryParameters()
+	c.Assert(queryParams.Get("_sort"), Equals, "patient,-onset-date,code,-asserted-date")
+}
+
+func (s *SearchPTSuite) TestQueryOptionsWithChainedSort(c *C) {
+	q := Query{Resource: "Condition", Query: "_sort=patient.family&_sort:desc=subject:Patient.birthdate&_sort=subject.identifier"}
+	o := q.Options()
+	c.Assert(o.Sort, HasLen, 3)
+	c.Assert(o.Sort[0].Descending, Equals, false)
+	c.Assert(o.Sort[0].Reference.Name, Equals, "patient")
+	c.Assert(o.Sort[0].Parameter.Resource, Equals, "Patient")
+	c.Assert(o.Sort[0].Parameter.Name, Equals, "family")
+	c.Assert(o.Sort[1].Descending, Equals, true)
+	c.Assert(o.Sort[1].Reference.Name, Equals, "subject")
+	c.Assert(o.Sort[1].Parameter.Resource, Equals, "Patient")
+	c.Assert(o.Sort[1].Parameter.Name, Equals, "birthdate")
+	// subject can be a Group or Patient, both of which have identifiers
+	c.Assert(o.Sort[2].Parameter.Resource, Equals, "Group")
+	c.Assert(o.Sort[2].Parameter.Name, Equals, "identifier")
+
+	queryParams := o.URLQueryParameters()
+	c.Assert(queryParams.All()[0], DeepEquals, URLQueryParameter{Key: "_sort", Value: "patient.family"})
+	c.Assert(queryParams.All()[1], DeepEquals, URLQueryParameter{Key: "_sort:desc", Value: "subject:Patient.birthdate"})
+	c.Assert(queryParams.All()[2], DeepEquals, URLQueryParameter{Key: "_sort", Value: "subject.identifier"})
+}
+
+func (s *SearchPTSuite) TestQueryOptionsInvalidChainedSort(c *C) {
+	for _, query := range []string{"_sort=code.family", "_sort=patient.foo", "_sort=subject:Practitioner.family", "_sort=patient:Patient"} {
+		q := Query{Resource: "Condition", Query: query}
+		c.Assert(func() { q.Options() }, PanicMatches, `HTTP 400: .*`, Commentf(query))
+	}
+	q := Query{Resource: "Condition", Query: "_sort=patient.organization.name"}
+	c.Assert(func() { q.Options() }, PanicMatches, `HTTP 501: .*Parameter "_sort" can only be chained through a single reference.*`)
+}
+
 func (s *SearchPTSuite) TestQueryOptionsInvalidSortParam(c *C) {
 	q := Query{Resource: "Patient", Query: "_sort=foo"}
 	c.Assert(func() { q.Options() }, Panics, createInvalidSearchError("MSG_PARAM_INVALID", "Parameter \"_sort\" content is invalid"))
 }
 
+func (s *SearchPTSuite) TestQueryOptionsScoreSortWithoutTextSearch(c *C) {
+	for _, query := range []string{"_sort=_score", "_sort=-_score", "_sort:desc=_score", "_sort=family,_score"} {
+		q := Query{Resource: "Patient", Query: query}
+		c.Assert(func() { q.Options() }, PanicMatches, `HTTP 400: .*Parameter "_sort" can't be _score as _text and _content searches aren't supported.*`)
+	}
+}
+
 func (s *SearchPTSuite) TestQueryOptionsIncludeTargets(c *C) {
 	q := Query{Resource: "Patient", Query: "_include=Patient:general-practitioner:Organization"}
 	o := q.Options()
@@ -1989,6 +2182,230 @@ func (s *SearchPTSuite) TestQuerySupportsPaging(c *C) {
 	// Not supported for _summary=count
 	q = Query{"Observation", "_summary=count"}
 	c.Assert(q.SupportsPaging(), Equals, false)
+
+	q = Query{"Observation", "_summary=count&_count=50"}
+	c.Assert(q.SupportsPaging(), Equals, false)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsSummaryCountIgnoresPaging(c *C) {
+	q := Query{"Patient", "_count=50&_offset=10&_summary=count"}
+	o := q.Options()
+	c.Assert(o.Summary, Equals, "count")
+	c.Assert(o.Count, Equals, NewQueryOptions().Count)
+	c.Assert(o.Offset, Equals, 0)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsCountZero(c *C) {
+	q := Query{"Patient", "_count=0&_offset=10"}
+	o := q.Options()
+	c.Assert(o.Summary, Equals, "count")
+	c.Assert(o.Count, Equals, NewQueryOptions().Count)
+	c.Assert(o.Offset, Equals, 0)
+	c.Assert(q.SupportsPaging(), Equals, false)
+}
+
+func (s *SearchPTSuite) TestQueryLimitCount(c *C) {
+	q := Query{"Patient", "gender=male&_count=50"}
+	c.Assert(q.LimitCount(50), Equals, "")
+	c.Assert(q.Query, Equals, "gender=male&_count=50")
+
+	q = Query{"Patient", "gender=male&_count=5000&_sort=family"}
+	c.Assert(q.LimitCount(50), Equals, "Parameter \"_count\" was reduced from 5000 to the maximum of 50")
+	c.Assert(q.Query, Equals, "gender=male&_count=50&_sort=family")
+	o := q.Options()
+	c.Assert(o.Count, Equals, 50)
+	c.Assert(o.Warnings, HasLen, 0)
+
+	// a limit of zero disables it
+	q = Query{"Patient", "_count=5000"}
+	c.Assert(q.LimitCount(0), Equals, "")
+	c.Assert(q.Options().Count, Equals, 5000)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsNegativeCountAndOffset(c *C) {
+	q := Query{"Patient", "_count=-10&_offset=-5"}
+	o := q.Options()
+	c.Assert(o.Count, Equals, NewQueryOptions().Count)
+	c.Assert(o.Offset, Equals, 0)
+	c.Assert(o.Warnings, DeepEquals, []string{
+		"Parameter \"_count\" was ignored as it is negative (-10)",
+		"Parameter \"_offset\" was ignored as it is negative (-5)",
+	})
+}
+
+func (s *SearchPTSuite) TestQueryOptionsTotal(c *C) {
+	q := Query{"Patient", "_total=none&_count=10"}
+	o := q.Options()
+	c.Assert(o.Total, Equals, "none")
+	c.Assert(o.CountsTotal(true), Equals, false)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get(TotalParam), Equals, "none")
+
+	o = (&Query{"Patient", "_total=accurate"}).Options()
+	c.Assert(o.CountsTotal(false), Equals, true)
+
+	o = (&Query{"Patient", "_total=estimate"}).Options()
+	c.Assert(o.CountsTotal(false), Equals, true)
+
+	// otherwise the server's configuration applies, except for _summary=count
+	o = (&Query{"Patient", ""}).Options()
+	c.Assert(o.CountsTotal(true), Equals, true)
+	c.Assert(o.CountsTotal(false), Equals, false)
+	o = (&Query{"Patient", "_summary=count&_total=none"}).Options()
+	c.Assert(o.CountsTotal(false), Equals, true)
+
+	q = Query{"Patient", "_total=maybe"}
+	c.Assert(func() { q.Options() }, PanicMatches, `HTTP 400: .*Parameter "_total" content is invalid.*`)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsContained(c *C) {
+	q := Query{"Patient", "_contained=true&_containedType=contained&name=abbott"}
+	o := q.Options()
+	c.Assert(o.Contained, Equals, "true")
+	c.Assert(o.ContainedType, Equals, "contained")
+	c.Assert(o.SearchesContained(), Equals, true)
+	params := o.URLQueryParameters()
+	c.Assert(params.Get(ContainedParam), Equals, "true")
+	c.Assert(params.Get(ContainedTypeParam), Equals, "contained")
+	c.Assert(q.Params(), HasLen, 1)
+
+	o = (&Query{"Patient", "_contained=both"}).Options()
+	c.Assert(o.SearchesContained(), Equals, true)
+	o = (&Query{"Patient", "_contained=false"}).Options()
+	c.Assert(o.SearchesContained(), Equals, false)
+	o = (&Query{"Patient", "name=abbott"}).Options()
+	c.Assert(o.SearchesContained(), Equals, false)
+	params = o.URLQueryParameters()
+	c.Assert(params.GetMulti(ContainedParam), HasLen, 0)
+
+	q = Query{"Patient", "_contained=maybe"}
+	c.Assert(func() { q.Options() }, PanicMatches, `.*Parameter "_contained" content is invalid.*`)
+	q = Query{"Patient", "_containedType=both"}
+	c.Assert(func() { q.Options() }, PanicMatches, `.*Parameter "_containedType" content is invalid.*`)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsElements(c *C) {
+	q := Query{"Patient", "_elements=name,gender&_count=10"}
+	o := q.Options()
+	c.Assert(o.Elements, DeepEquals, []string{"name", "gender"})
+	params := o.URLQueryParameters()
+	c.Assert(params.Get("_elements"), Equals, "name,gender")
+	c.Assert(q.Params(), HasLen, 0)
+
+	q = Query{"Patient", "gender=male"}
+	o = q.Options()
+	c.Assert(o.Elements, IsNil)
+	params = o.URLQueryParameters()
+	c.Assert(params.GetMulti("_elements"), HasLen, 0)
+
+	q = Query{"Patient", "_elements=name,$where"}
+	c.Assert(func() { q.Options() }, PanicMatches, `.*Parameter "_elements" content is invalid.*`)
+}
+
+func (s *SearchPTSuite) TestQueryOptionsIterativeIncludes(c *C) {
+	q := Query{"Observation", "_include=Observation:subject&_include:iterate=Patient:organization&_revinclude:iterate=Provenance:target:Patient"}
+	o := q.Options()
+	c.Assert(o.UsesIterativeIncludes(), Equals, true)
+	c.Assert(o.Include, HasLen, 2)
+	c.Assert(o.Include[0].Iterate, Equals, false)
+	c.Assert(o.Include[1].Iterate, Equals, true)
+	c.Assert(o.Include[1].Resource, Equals, "Patient")
+	c.Assert(o.Include[1].Parameter.Name, Equals, "organization")
+	c.Assert(o.RevInclude, HasLen, 1)
+	c.Assert(o.RevInclude[0].Iterate, Equals, true)
+	c.Assert(o.RevInclude[0].Resource, Equals, "Provenance")
+	c.Assert(o.RevInclude[0].Parameter.Targets, DeepEquals, []string{"Patient"})
+
+	params := o.URLQueryParameters()
+	c.Assert(params.GetMulti("_include"), DeepEquals, []string{"Observation:subject"})
+	c.Assert(params.GetMulti("_include:iterate"), DeepEquals, []string{"Patient:organization"})
+	c.Assert(params.GetMulti("_revinclude:iterate"), DeepEquals, []string{"Provenance:target"})
+
+	// STU3 name for :iterate
+	q = Query{"Observation", "_include:recurse=Patient:organization"}
+	c.Assert(q.Options().Include[0].Iterate, Equals, true)
+
+	q = Query{"Observation", "_include=Observation:subject"}
+	c.Assert(q.Options().UsesIterativeIncludes(), Equals, false)
+
+	q = Query{"Observation", "_include:frobnicate=Patient:organization"}
+	c.Assert(func() { q.Options() }, PanicMatches, `.*Parameter "_include" content is invalid.*`)
+}
+
+func (s *SearchPTSuite) TestFilterParam(c *C) {
+	q := Query{"Patient", `_filter=(given eq "John" or family sw "Smi") and not (gender eq male)`}
+	params := q.Params()
+	c.Assert(params, HasLen, 1)
+
+	filter, ok := params[0].(*FilterExpressionParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(filter.Expression, Equals, `(given eq "John" or family sw "Smi") and not (gender eq male)`)
+
+	and, ok := filter.Root.(*AndParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(and.Items, HasLen, 2)
+
+	or, ok := and.Items[0].(*OrParam)
+	c.Assert(ok, Equals, true)
+	c.Assert(or.Items, HasLen, 2)
+	given := or.Items[0].(*StringParam)
+	c.Assert(given.Name, Equals, "given")
+	c.Assert(given.String, Equals, "John")
+	c.Assert(given.Match, Equals, StringMatchEquals)
+	family := or.Items[1].(*StringParam)
+	c.Assert(family.Name, Equals, "family")
+	c.Assert(family.Match, Equals, StringMatchStartsWith)
+
+	not, ok := and.Items[1].(*NotParam)
+	c.Assert(ok, Equals, true)
+	gender := not.Item.(*TokenParam)
+	c.Assert(gender.Name, Equals, "gender")
+	c.Assert(gender.Code, Equals, "male")
+
+	p, v := filter.getQueryParamAndValue()
+	c.Assert(p, Equals, "_filter")
+	c.Assert(v, Equals, filter.Expression)
+}
+
+func (s *SearchPTSuite) TestFilterParamPrecedenceAndValues(c *C) {
+	// "and" binds more tightly than "or"
+	filter := ParseFilterParam(`gender eq male or birthdate ge 1970-01-01 AND name co "a,b"`, "Patient")
+	or := filter.Root.(*OrParam)
+	c.Assert(or.Items, HasLen, 2)
+	and := or.Items[1].(*AndParam)
+
+	birthdate := and.Items[0].(*DateParam)
+	c.Assert(birthdate.Prefix, Equals, GE)
+	c.Assert(birthdate.Date.String(), Equals, "1970-01-01")
+
+	// commas in a filter value don't separate OR values
+	name := and.Items[1].(*StringParam)
+	c.Assert(name.String, Equals, "a,b")
+	c.Assert(name.Match, Equals, StringMatchContains)
+
+	// ne is the negation of eq
+	filter = ParseFilterParam(`identifier ne "http://acme.org/mrn|123"`, "Patient")
+	identifier := filter.Root.(*NotParam).Item.(*TokenParam)
+	c.Assert(identifier.System, Equals, "http://acme.org/mrn")
+	c.Assert(identifier.Code, Equals, "123")
+}
+
+func (s *SearchPTSuite) TestFilterParamInvalid(c *C) {
+	invalid := []string{
+		`gender eq`,
+		`(gender eq male`,
+		`gender eq male)`,
+		`gender eq male female`,
+		`gender xx male`,
+		`gender gt male`,
+		`birthdate co 1970`,
+		`family eq "Smith`,
+	}
+	for _, expression := range invalid {
+		c.Assert(func() { ParseFilterParam(expression, "Patient") }, PanicMatches, `.*Parameter "_filter" content is invalid.*`)
+	}
+
+	c.Assert(func() { ParseFilterParam(`foo eq bar`, "Patient") }, PanicMatches, `.*no processable search found for Patient search parameters "foo".*`)
 }
 
 func (s *SearchPTSuite) TestIsDollarEverything(c *C) {
@@ -11377,6 +11377,12 @@ var SearchParameterDictionary = map[string]map[string]SearchParamInfo{
 				SearchParamPath{Path: "code", Type: "CodeableConcept"},
 			},
 		},
+		"code-value-date": SearchParamInfo{
+			Resource:   "Observation",
+			Name:       "code-value-date",
+			Type:       "composite",
+			Composites: []string{"code", "value-date"},
+		},
 		"combo-code": SearchParamInfo{
 			Resource: "Observation",
 			Name:     "combo-code",
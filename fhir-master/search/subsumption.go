@@ -0,0 +1,39 @@
+package search
+
+import "sync"
+
+// SubsumptionResolver expands the code of a token search with the :above or :below modifier
+// using a terminology's hierarchy (e.g. SNOMED CT or LOINC)
+type SubsumptionResolver interface {
+	// ResolveSubsumption returns the codes in the system that the code subsumes when the modifier
+	// is "below", or that subsume it when the modifier is "above"
+	ResolveSubsumption(system, code, modifier string) []string
+}
+
+var subsumptionResolver SubsumptionResolver = noSubsumptionResolver{}
+var subsumptionResolverLock sync.RWMutex
+
+// RegisterSubsumptionResolver sets the resolver used for :above and :below token searches.
+// Without one these searches only match the code itself.
+func RegisterSubsumptionResolver(resolver SubsumptionResolver) {
+	subsumptionResolverLock.Lock()
+	defer subsumptionResolverLock.Unlock()
+	if resolver == nil {
+		resolver = noSubsumptionResolver{}
+	}
+	subsumptionResolver = resolver
+}
+
+// GlobalSubsumptionResolver returns the registered subsumption resolver
+func GlobalSubsumptionResolver() SubsumptionResolver {
+	subsumptionResolverLock.RLock()
+	defer subsumptionResolverLock.RUnlock()
+	return subsumptionResolver
+}
+
+// noSubsumptionResolver is the default resolver, which doesn't know any hierarchies
+type noSubsumptionResolver struct{}
+
+func (noSubsumptionResolver) ResolveSubsumption(system, code, modifier string) []string {
+	return nil
+}
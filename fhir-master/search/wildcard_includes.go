@@ -0,0 +1,196 @@
+package search
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// resolveWildcardIncludes adds the resources referenced by the matches of a search with _include=* and those
+// referencing them with _revinclude=* to their includes. These options expand to every reference parameter,
+// so rather than a $lookup for each of their paths and targets, each collection involved is queried once
+// for all the matches. The resources found are the same as with those $lookup stages, each included once
+// per match. documents are the stored matches, in the same order as resources.
+func (m *MongoSearcher) resolveWildcardIncludes(resourceType string, documents []bson.D, resources []*models2.Resource, options *QueryOptions) error {
+	if len(resources) == 0 {
+		return nil
+	}
+	included := make([]map[string]bool, len(resources))
+	include := func(i int, resource *models2.Resource) {
+		key := resource.ResourceType() + "/" + resource.Id()
+		if included[i] == nil {
+			included[i] = make(map[string]bool)
+		}
+		if !included[i][key] {
+			included[i][key] = true
+			resources[i].AddSearchIncludes(resource)
+		}
+	}
+
+	if options.IsIncludeAll {
+		if err := m.includeAll(documents, options, include); err != nil {
+			return err
+		}
+	}
+	if options.IsRevincludeAll {
+		if err := m.revincludeAll(resourceType, resources, options, include); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeAll finds the resources referenced by the matches through the _include=* parameters, querying each
+// target type's collection once, and warns of the references to resources that weren't found
+func (m *MongoSearcher) includeAll(documents []bson.D, options *QueryOptions, include func(i int, resource *models2.Resource)) error {
+	// the ids referenced by the matches by the type of resource they're looked up in, which like
+	// the $lookup stages are all the parameter's targets other than "Any" whatever the reference's type
+	idsByType := make(map[string]map[string]bool)
+	for _, document := range documents {
+		forEachIncludeReference(document, options, func(incl IncludeOption, referenceType string, id string) {
+			for _, target := range incl.Parameter.Targets {
+				if target == "Any" {
+					continue
+				}
+				if idsByType[target] == nil {
+					idsByType[target] = make(map[string]bool)
+				}
+				idsByType[target][id] = true
+			}
+		})
+	}
+
+	found := make(map[string]map[string]*models2.Resource)
+	for target, idSet := range idsByType {
+		ids := make([]string, 0, len(idSet))
+		for id := range idSet {
+			ids = append(ids, id)
+		}
+		byID := make(map[string]*models2.Resource)
+		err := m.findIncluded(target, bson.M{"_id": bson.M{"$in": ids}}, func(document bson.D, resource *models2.Resource) {
+			byID[resource.Id()] = resource
+		})
+		if err != nil {
+			return err
+		}
+		found[target] = byID
+	}
+
+	for i, document := range documents {
+		forEachIncludeReference(document, options, func(incl IncludeOption, referenceType string, id string) {
+			for _, target := range incl.Parameter.Targets {
+				if resource := found[target][id]; resource != nil {
+					include(i, resource)
+				}
+			}
+			// as in unresolvedIncludes
+			if includesTarget(incl.Parameter, referenceType) && found[referenceType][id] == nil {
+				matchID, _ := lookupField(document, "_id").(string)
+				m.warnings = append(m.warnings, fmt.Sprintf("The %s/%s referenced by %s/%s couldn't be included (_include=%s:%s)",
+					referenceType, id, incl.Resource, matchID, incl.Resource, incl.Parameter.Name))
+			}
+		})
+	}
+	return nil
+}
+
+// forEachIncludeReference calls fn with the type and id of each reference of a stored resource at the paths
+// of the _include parameters
+func forEachIncludeReference(document bson.D, options *QueryOptions, fn func(incl IncludeOption, referenceType string, id string)) {
+	for _, incl := range options.Include {
+		if incl.Iterate {
+			continue
+		}
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			for _, value := range valuesAtPath(document, strings.Split(strings.Replace(inclPath.Path, "[]", "", -1), ".")) {
+				reference, ok := value.(bson.D)
+				if !ok || lookupField(reference, "reference__external") == true {
+					continue
+				}
+				referenceType, _ := lookupField(reference, "reference__type").(string)
+				id, _ := lookupField(reference, "reference__id").(string)
+				if id != "" {
+					fn(incl, referenceType, id)
+				}
+			}
+		}
+	}
+}
+
+// revincludeAll finds the resources referencing the matches through the _revinclude=* parameters, querying
+// each referencing type's collection once for the references at any of its paths
+func (m *MongoSearcher) revincludeAll(resourceType string, resources []*models2.Resource, options *QueryOptions, include func(i int, resource *models2.Resource)) error {
+	matches := make(map[string]int)
+	ids := make([]string, len(resources))
+	for i, resource := range resources {
+		matches[resource.Id()] = i
+		ids[i] = resource.Id()
+	}
+
+	// the fields of the references to the matches by the type of resource they're in
+	fieldsByType := make(map[string][]string)
+	for _, incl := range options.RevInclude {
+		if incl.Iterate || !isValidTarget(resourceType, incl.Parameter) {
+			continue
+		}
+		for _, inclPath := range incl.Parameter.Paths {
+			if inclPath.Type != "Reference" {
+				continue
+			}
+			field := strings.Replace(inclPath.Path, "[]", "", -1)
+			if !contains(fieldsByType[incl.Parameter.Resource], field) {
+				fieldsByType[incl.Parameter.Resource] = append(fieldsByType[incl.Parameter.Resource], field)
+			}
+		}
+	}
+
+	for referencingType, fields := range fieldsByType {
+		var or []bson.M
+		for _, field := range fields {
+			or = append(or, bson.M{field + ".reference__id": bson.M{"$in": ids}})
+		}
+		err := m.findIncluded(referencingType, bson.M{"$or": or}, func(document bson.D, resource *models2.Resource) {
+			for _, field := range fields {
+				for _, value := range valuesAtPath(document, strings.Split(field+".reference__id", ".")) {
+					id, _ := value.(string)
+					if i, isMatch := matches[id]; isMatch {
+						include(i, resource)
+					}
+				}
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findIncluded calls fn with each resource of a type matching filter, along with its stored document
+func (m *MongoSearcher) findIncluded(resourceType string, filter bson.M, fn func(document bson.D, resource *models2.Resource)) error {
+	c := m.db.Collection(models.PluralizeLowerResourceName(resourceType))
+	cursor, err := c.Find(m.ctx, filter)
+	if err != nil {
+		return errors.Wrapf(err, "find of included %s failed", resourceType)
+	}
+	defer cursor.Close(m.ctx)
+	for cursor.Next(m.ctx) {
+		var document bson.D
+		if err := cursor.Decode(&document); err != nil {
+			return errors.Wrap(err, "included resource decoding error")
+		}
+		resource, err := models2.NewResourceFromBSON(document)
+		if err != nil {
+			return errors.Wrapf(err, "included %s: NewResourceFromBSON failed", resourceType)
+		}
+		fn(document, resource)
+	}
+	return errors.Wrapf(cursor.Err(), "cursor of included %s failed", resourceType)
+}
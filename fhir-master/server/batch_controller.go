@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"math"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"regexp"
@@ -31,6 +33,7 @@ import (
 type BatchController struct {
 	DAL    DataAccessLayer
 	Config Config
+	Logger Logger
 }
 
 // NewBatchController creates a new BatchController based on the passed in DAL
@@ -38,6 +41,7 @@ func NewBatchController(dal DataAccessLayer, config Config) *BatchController {
 	return &BatchController{
 		DAL:    dal,
 		Config: config,
+		Logger: loggerOrDefault(config.Logger),
 	}
 }
 
@@ -76,6 +80,10 @@ func notFound(err error) *response {
 	outcome := models.CreateOpOutcome("fatal", "not-found", "", err.Error())
 	return newFailureResponse(http.StatusBadRequest, err, outcome)
 }
+func tooCostly(err error) *response {
+	outcome := models.CreateOpOutcome("fatal", "too-costly", "", err.Error())
+	return newFailureResponse(http.StatusRequestEntityTooLarge, err, outcome)
+}
 func internalError(err error) *response {
 	outcome := models.CreateOpOutcome("fatal", "exception", "", err.Error())
 	return newFailureResponse(http.StatusInternalServerError, err, outcome)
@@ -87,6 +95,7 @@ func internalErrorWithStatus(httpStatus int, err error) *response {
 
 // Handles batch and transaction requests
 func (b *BatchController) Post(c *gin.Context) {
+	defer handlePanics(c)
 
 	req := c.Request
 
@@ -106,6 +115,7 @@ func (b *BatchController) Post(c *gin.Context) {
 		return
 	}
 
+	bundleResource.SetMaxDepth(b.Config.MaxResourceDepth)
 	bundle, err := bundleResource.AsShallowBundle(b.Config.FailedRequestsDir)
 	if err != nil {
 		response := badStructure(err)
@@ -113,17 +123,20 @@ func (b *BatchController) Post(c *gin.Context) {
 		return
 	}
 
+	if bundle.Type == "document" && b.Config.StoreDocumentBundles {
+		b.storeDocumentBundle(c, bundleResource, customDbName)
+		return
+	}
+
 	// retry if transaction
-	attemptsLeft := 1
+	attempts := 1
 	if bundle.Type == "transaction" {
-		attemptsLeft = 3
+		attempts += b.Config.TransactionRetries
 	}
 
 	var response *response
-	for attemptsLeft > 0 {
-		glog.Infof("FHIR POST: attempts left: %d", attemptsLeft)
-		attemptsLeft -= 1
-
+	for attempt := 1; attempt <= attempts; attempt++ {
+		glog.Infof("FHIR POST [%s]: attempt %d of %d", RequestID(ctx), attempt, attempts)
 		response = b.postInner(ctx, span, c, bundle, customDbName, provenanceHeader)
 
 		if response.reply != nil {
@@ -138,8 +151,16 @@ func (b *BatchController) Post(c *gin.Context) {
 			return
 		}
 
-		if response.err != nil && strings.Contains(response.err.Error(), "WriteConflict") {
-			// retry
+		if isWriteConflict(response.err) && attempt < attempts {
+			// retry after backing off to let the conflicting writes finish
+			select {
+			case <-time.After(retryDelay(b.Config.TransactionRetryDelay, attempt)):
+			case <-ctx.Done():
+			}
+			if ctx.Err() != nil {
+				attempts = attempt
+				break
+			}
 
 			// must reload bundle since it gets modified in placed (e.g. entry.Request = nil)
 			bundle, err = bundleResource.AsShallowBundle(b.Config.FailedRequestsDir)
@@ -155,23 +176,120 @@ func (b *BatchController) Post(c *gin.Context) {
 		}
 	}
 
+	if isWriteConflict(response.err) && bundle.Type == "transaction" {
+		// suggest when to try again, after the delay of another retry
+		retryAfter := retryDelay(b.Config.TransactionRetryDelay, attempts)
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		response = newFailureResponse(http.StatusConflict, response.err, models.CreateOpOutcome("error", "conflict", "",
+			fmt.Sprintf("Transaction conflicted with concurrent writes %d times; try again later", attempts)))
+	}
 	if response.err != nil {
 		c.AbortWithStatusJSON(response.httpStatus, response.errOutcome)
 	}
 
 }
 
+func isWriteConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "WriteConflict")
+}
+
+// maxRetryDelay is the longest a retry of a conflicting transaction waits, however many retries there are
+const maxRetryDelay = 10 * time.Second
+
+// retryDelay returns how long to wait before a retry (counting from 1) of a conflicting transaction:
+// base doubled for each previous retry up to maxRetryDelay, with jitter so that conflicting requests
+// don't retry in lockstep
+func retryDelay(base time.Duration, retry int) time.Duration {
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 1; i < retry && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// unsupportedBundleTypeError names the received Bundle.type and the types that can be POSTed to the server's base URL
+func (b *BatchController) unsupportedBundleTypeError(bundleType string) error {
+	accepted := "'batch' or 'transaction'"
+	if b.Config.StoreDocumentBundles {
+		accepted = "'batch', 'transaction' or 'document'"
+	}
+	if bundleType == "" {
+		return fmt.Errorf("Bundle has no type; expected %s", accepted)
+	}
+	return fmt.Errorf("Bundle type '%s' is not supported; expected %s", bundleType, accepted)
+}
+
+// storeDocumentBundle stores a document Bundle POSTed to the server's base URL as a Bundle resource,
+// as if it had been POSTed to /Bundle
+func (b *BatchController) storeDocumentBundle(c *gin.Context, bundleResource *models2.Resource, customDbName string) {
+	defer handlePanics(c)
+	session := b.DAL.StartSession(c.Request.Context(), customDbName)
+	defer session.Finish()
+
+	warnings, err := b.DAL.ValidateResource(c.Request.Context(), bundleResource)
+	if err != nil {
+		panic(errors.Wrap(err, "storeDocumentBundle ValidateResource failed"))
+	}
+	id, err := session.Post(bundleResource)
+	if err != nil {
+		panic(errors.Wrap(err, "storeDocumentBundle Post failed"))
+	}
+
+	c.Set("Resource", "Bundle")
+	c.Set("Action", "create")
+
+	rc := NewResourceController("Bundle", b.DAL, b.Config)
+	err = setHeaders(c, rc, true, bundleResource, id)
+	if err != nil {
+		panic(errors.Wrap(err, "storeDocumentBundle setHeaders failed"))
+	}
+	rc.renderPreferredReturn(c, http.StatusCreated, bundleResource, id, warnings)
+}
+
 // Handles batch and transaction requests
 func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gin.Context, bundle *models2.ShallowBundle, customDbName string, provenanceHeader string) *response {
 
 	req := c.Request
 
+	// Check the type first as entries of other bundles (e.g. a searchset) have no requests
+	if bundle.Type != "batch" && bundle.Type != "transaction" {
+		return badValue(b.unsupportedBundleTypeError(bundle.Type))
+	}
+
 	// Sort & validate bundle entries
 	entries, response := sortBundleEntries(bundle)
 	if response != nil {
 		return response
 	}
 
+	// Check the resources being created and updated before starting the transaction; entries of
+	// batches that fail are left out, as when they fail to be stored
+	warnings := make([][]models.OperationOutcomeIssueComponent, len(entries))
+	for i, entry := range entries {
+		if entry.Resource == nil || (entry.Request.Method != "POST" && entry.Request.Method != "PUT") {
+			continue
+		}
+		var err error
+		warnings[i], err = b.DAL.ValidateResource(ctx, entry.Resource)
+		if err != nil {
+			statusCode, outcome := ErrorToOpOutcome(errors.Wrapf(err, "failed to validate %s", entry.Request.Url))
+			if bundle.Type == "transaction" {
+				return newFailureResponse(statusCode, err, outcome)
+			}
+			entry.Resource = nil
+			entry.Response = &models.BundleEntryResponseComponent{
+				Status:  strconv.Itoa(statusCode),
+				Outcome: outcome,
+			}
+		}
+	}
+
 	// start DB session +- transaction
 	session := b.DAL.StartSession(ctx, customDbName)
 	defer session.Finish()
@@ -179,14 +297,14 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 	var transaction bool
 	switch bundle.Type {
 	case "transaction":
-		glog.V(2).Info("starting transaction")
+		glog.V(2).Infof("[%s] starting transaction", RequestID(ctx))
 		transaction = true
 		err := session.StartTransaction()
 		if err != nil {
 			return internalError(errors.Wrap(err, "error starting MongoDB transaction"))
 		}
 	case "batch":
-		glog.V(2).Info("starting batch")
+		glog.V(2).Infof("[%s] starting batch", RequestID(ctx))
 		transaction = false
 
 		if provenanceHeader != "" {
@@ -196,7 +314,7 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 		// TODO: If type is batch, ensure there are no interdependent resources
 
 	default:
-		return badValue(fmt.Errorf("Bundle type is neither 'batch' nor 'transaction'"))
+		return badValue(b.unsupportedBundleTypeError(bundle.Type))
 	}
 
 	span.AddAttributes(trace.BoolAttribute("transaction", transaction))
@@ -207,13 +325,23 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 	defer spanForResolvingIDs.End()
 	refMap := make(map[string]string)
 	newIDs := make([]string, len(entries))
+	postRefs := make([]string, len(entries))
 	createStatus := make([]string, len(entries))
+	conditionalCreates := make(map[string]int) // criteria (Type?query) of conditional creates --> index of the entry creating
+	duplicateCreates := make(map[int]bool)     // conditional creates with the criteria of an earlier entry
 	for i, entry := range entries {
 		if entry.Request.Method == "POST" {
 
 			id := ""
-
-			if len(entry.Request.IfNoneExist) > 0 {
+			criteria := entry.Request.Url + "?" + entry.Request.IfNoneExist
+
+			if first, seen := conditionalCreates[criteria]; seen && len(entry.Request.IfNoneExist) > 0 {
+				// The same criteria as an earlier entry that creates a resource, which then already exists
+				glog.V(3).Infof("  conditional create (%s): same as entry %d", criteria, first)
+				createStatus[i] = "200"
+				id = newIDs[first]
+				duplicateCreates[i] = true
+			} else if len(entry.Request.IfNoneExist) > 0 {
 				// Conditional Create
 				query := search.Query{Resource: entry.Request.Url, Query: entry.Request.IfNoneExist}
 				existingIds, err := session.FindIDs(query)
@@ -224,6 +352,7 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 
 				if len(existingIds) == 0 {
 					createStatus[i] = "201"
+					conditionalCreates[criteria] = i
 				} else if len(existingIds) == 1 {
 					createStatus[i] = "200"
 					id = existingIds[0]
@@ -245,6 +374,7 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 			if len(id) > 0 {
 				// Add id to the reference map
 				refMap[entry.FullUrl] = entry.Request.Url + "/" + id
+				postRefs[i] = entry.Request.Url + "/" + id
 				glog.V(3).Infof("    need to rewrite %s --> %s", entry.FullUrl, entry.Request.Url+"/"+id)
 				// Rewrite the FullUrl using the new ID
 				entry.FullUrl = b.Config.responseURL(req, entry.Request.Url, id).String()
@@ -304,6 +434,16 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 	if err != nil {
 		return badStructure(err)
 	}
+	// conditional references also match the resources created or updated by the transaction itself
+	var bundleResources map[string][]inBundleResource
+	if bundle.Type == "transaction" {
+		bundleResources, err = inBundleResources(entries, postRefs)
+		if err != nil {
+			return badStructure(err)
+		}
+	}
+	tokensCaseSensitive := b.Config.TokenParametersCaseSensitive || !b.Config.EnableCISearches
+	conditionalReferences := 0
 	for _, reference := range references {
 
 		if _, alreadyMapped := refMap[reference]; alreadyMapped {
@@ -311,28 +451,41 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 			continue
 		}
 
-		// Conditional references
-		// TODO: as per spec this needs to include in-bundle resources..
+		// Conditional references, which can match both in-bundle resources and those in the database
 		queryPos := strings.Index(reference, "?")
 		if queryPos >= 0 {
 
-			if bundle.Type != "transaction" {
+			// batch entries are independent so only resolve to resources already in the database
+			if bundle.Type != "transaction" && !b.Config.AllowConditionalReferencesInBatch {
 				return brokenInvariant(errors.New("conditional references are only allowed in transactions, not batches"))
 			}
 			glog.V(3).Infof("  conditional reference: %s", reference)
 
+			conditionalReferences++
+			if max := b.Config.MaxTransactionReferences; max > 0 && conditionalReferences > max {
+				return tooCostly(errors.Errorf("%s has more than %d conditional references", bundle.Type, max))
+			}
+
 			resourceType := reference[0:queryPos]
 			queryString := reference[queryPos+1:]
 			searchQuery := search.Query{Resource: resourceType, Query: queryString}
+			matches := matchInBundle(bundleResources, searchQuery, tokensCaseSensitive)
+			glog.V(3).Infof("    in-bundle matches: %v", matches)
 			ids, err := session.FindIDs(searchQuery)
 			if err != nil {
 				return internalError(errors.Wrapf(err, "lookup of conditional reference failed (%s)", reference))
 			}
 			glog.V(3).Infof("    ids: %v", ids)
+			for _, id := range ids {
+				// an in-bundle resource may also be in the database (e.g. if it's being updated)
+				if !stringSliceContains(matches, resourceType+"/"+id) {
+					matches = append(matches, resourceType+"/"+id)
+				}
+			}
 
-			if len(ids) == 1 {
-				refMap[reference] = resourceType + "/" + ids[0]
-			} else if len(ids) == 0 {
+			if len(matches) == 1 {
+				refMap[reference] = matches[0]
+			} else if len(matches) == 0 {
 				return notFound(errors.Errorf("no matches for conditional reference (%s)", reference))
 			} else {
 				return multipleMatches(errors.Errorf("multiple matches for conditional reference (%s)", reference))
@@ -342,6 +495,19 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 
 	// When being converted to BSON references will be updated to reflect newly assigned or conditional IDs
 	bundle.SetTransformReferencesMap(refMap)
+
+	// Searches are also updated, so that their results and self links reflect the resolved references
+	if transaction {
+		for _, entry := range entries {
+			if entry.Request.Method == "GET" {
+				resolvedUrl, err := resolveSearchReferences(entry.Request.Url, refMap)
+				if err != nil {
+					return badValue(errors.Wrapf(err, "failed to parse query string: %s", entry.Request.Url))
+				}
+				entry.Request.Url = resolvedUrl
+			}
+		}
+	}
 	spanForResolvingReferences.End()
 	spanForResolvingReferences = nil // gracefully handled by deferred End()
 
@@ -436,6 +602,9 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 			semaphore := make(chan bool, concurrency)
 
 			for i, _ := range entries {
+				if duplicateCreates[i] {
+					continue // reads what an earlier entry creates, so done afterwards
+				}
 				wg.Add(1)
 
 				go func(i int) {
@@ -459,6 +628,15 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 				}(i)
 			}
 			wg.Wait()
+
+			for i, entry := range entries {
+				if duplicateCreates[i] {
+					response = b.doRequest(req, transaction, session, i, entry, createStatus, newIDs)
+					if response != nil {
+						panic("doRequest should always return nil error in batches")
+					}
+				}
+			}
 		}
 	}
 
@@ -495,10 +673,24 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 	}
 
 	if proceed {
+		for i, entry := range entries {
+			if len(warnings[i]) > 0 && entry.Response != nil && entry.Response.Outcome == nil {
+				entry.Response.Outcome = &models.OperationOutcome{Issue: warnings[i]}
+			}
+		}
+
 		total := uint32(len(entries))
 		bundle.Total = &total
 		bundle.Type = fmt.Sprintf("%s-response", bundle.Type)
 
+		if !transaction && (b.Config.SummarizeBatchOutcomes || preferenceValue(c, "batch-outcome") == "summary") {
+			if summary := summarizeBatchOutcomes(bundle.Entry); summary != nil {
+				bundle.Entry = append(bundle.Entry, models2.ShallowBundleEntryComponent{
+					Response: &models.BundleEntryResponseComponent{Status: "200", Outcome: summary},
+				})
+			}
+		}
+
 		return sendReply(http.StatusOK, bundle)
 	} else {
 		return internalError(errors.New("invalid state (proceed is false)"))
@@ -506,30 +698,62 @@ func (b *BatchController) postInner(ctx context.Context, span *trace.Span, c *gi
 
 }
 
+// summarizeBatchOutcomes collects the warnings and errors in the outcomes of a batch's entries into a single
+// OperationOutcome, with each issue's expression pointing to its entry. It returns nil if there are none.
+func summarizeBatchOutcomes(entries []models2.ShallowBundleEntryComponent) *models.OperationOutcome {
+	var issues []models.OperationOutcomeIssueComponent
+	for i, entry := range entries {
+		if entry.Response == nil {
+			continue
+		}
+		outcome, ok := entry.Response.Outcome.(*models.OperationOutcome)
+		if !ok || outcome == nil {
+			continue
+		}
+		for _, issue := range outcome.Issue {
+			if issue.Severity == "information" {
+				continue
+			}
+			issue.Expression = append([]string{fmt.Sprintf("Bundle.entry[%d]", i)}, issue.Expression...)
+			issues = append(issues, issue)
+		}
+	}
+	if len(issues) == 0 {
+		return nil
+	}
+	return &models.OperationOutcome{Issue: issues}
+}
+
 func (b *BatchController) doRequest(req *http.Request, transaction bool, session DataAccessSession, i int, entry *models2.ShallowBundleEntryComponent, createStatus []string, newIDs []string) *response {
+	logFields := LogFields{"requestId": RequestID(req.Context()), "entry": i}
+	if entry.Request != nil {
+		logFields["method"] = entry.Request.Method
+		logFields["url"] = entry.Request.Url
+	}
 	err := b.doRequestInner(req, session, i, entry, createStatus, newIDs)
 
 	if err != nil {
-		glog.V(4).Infof("  --> ERROR %+v", err)
+		b.Logger.Debugf(logFields, "  --> entry %d ERROR %+v", i, err)
 	}
 	if entry.Response != nil {
 		glog.V(11).Infof("  --> %s", entry.Response.DebugString())
 	} else {
-		glog.V(4).Infof("  --> nil Response")
+		b.Logger.Debugf(logFields, "  --> nil Response")
 	}
 	if entry.Resource != nil {
 		glog.V(11).Infof("  --> %s", entry.Resource.JsonBytes())
 	} else {
-		glog.V(4).Infof("  --> nil Resource")
+		b.Logger.Debugf(logFields, "  --> nil Resource")
 	}
 
 	if err != nil {
 		statusCode, outcome := ErrorToOpOutcome(err)
+		logFields["status"] = statusCode
 		if transaction {
-			glog.V(2).Infof("  transaction failed for %s %s: %d %v", entry.Request.Method, entry.Request.Url, statusCode, outcome)
+			b.Logger.Infof(logFields, "transaction failed for %s %s: %d %v", entry.Request.Method, entry.Request.Url, statusCode, outcome)
 			return newFailureResponse(statusCode, err, outcome)
 		} else {
-			glog.V(2).Infof("  batch entry failed for %s %s: %d %v", entry.Request.Method, entry.Request.Url, statusCode, outcome)
+			b.Logger.Infof(logFields, "batch entry failed for %s %s: %d %v", entry.Request.Method, entry.Request.Url, statusCode, outcome)
 			entry.Resource = nil
 			entry.Request = nil
 			entry.Response = &models.BundleEntryResponseComponent{
@@ -543,10 +767,11 @@ func (b *BatchController) doRequest(req *http.Request, transaction bool, session
 }
 
 func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSession, i int, entry *models2.ShallowBundleEntryComponent, createStatus []string, newIDs []string) error {
-	glog.V(3).Infof("  doRequest %s %s", entry.Request.Method, entry.Request.Url)
+	logFields := LogFields{"requestId": RequestID(req.Context()), "entry": i, "method": entry.Request.Method, "url": entry.Request.Url}
+	b.Logger.Debugf(logFields, "  doRequest entry %d: %s %s", i, entry.Request.Method, entry.Request.Url)
 	if entry.Response != nil {
 		// already handled (e.g. conditional update returned 409)
-		glog.V(3).Infof("  already handled (%s)", entry.Response.DebugString())
+		b.Logger.Debugf(logFields, "  already handled (%s)", entry.Response.DebugString())
 		return nil
 	}
 
@@ -558,15 +783,23 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 			if len(parts) != 2 {
 				return fmt.Errorf("Couldn't identify resource and id to delete from %s", entry.Request.Url)
 			}
-			glog.V(3).Infof("    normal delete")
-			if _, err := session.Delete(parts[1], parts[0]); err != nil && err != ErrNotFound {
+			b.Logger.Debugf(logFields, "    normal delete")
+			conditionalVersionId := ""
+			if entry.Request.IfMatch != "" {
+				var err error
+				conditionalVersionId, err = utils.ETagToVersionId(entry.Request.IfMatch)
+				if err != nil {
+					return errors.Wrapf(err, "couldn't parse If-Match of %s", entry.Request.Url)
+				}
+			}
+			if _, err := session.Delete(parts[1], parts[0], conditionalVersionId); err != nil && err != ErrNotFound {
 				return errors.Wrapf(err, "failed to delete %s", entry.Request.Url)
 			}
 		} else {
 			// It's a conditional (query-based) delete
 			parts := strings.SplitN(entry.Request.Url, "?", 2)
 			query := search.Query{Resource: parts[0], Query: parts[1]}
-			glog.V(3).Infof("    conditional delete")
+			b.Logger.Debugf(logFields, "    conditional delete")
 			if _, err := session.ConditionalDelete(query); err != nil {
 				return errors.Wrapf(err, "failed to conditional-delete %s", entry.Request.Url)
 			}
@@ -687,7 +920,7 @@ func (b *BatchController) doRequestInner(req *http.Request, session DataAccessSe
 
 		if historyRequest {
 			baseURL := b.Config.responseURL(req, resourceType)
-			bundle, err := session.History(*baseURL, resourceType, id)
+			bundle, err := session.History(*baseURL, resourceType, id, HistoryOptions{Count: search.NewQueryOptions().Count})
 			glog.V(3).Infof("  history request (%s/%s) --> err %+v", resourceType, id, err)
 			if err != nil && err != ErrNotFound {
 				return errors.Wrapf(err, "History request failed: %s", entry.Request.Url)
@@ -914,6 +1147,37 @@ func (b *BatchController) processProvenanceHeader(provenanceHeader string, c *gi
 	return nil
 }
 
+// resolveSearchReferences replaces the values of a search URL's query parameters that are references
+// resolved elsewhere in the bundle (e.g. subject=Patient?identifier=123 or a temporary ID)
+func resolveSearchReferences(requestUrl string, refMap map[string]string) (string, error) {
+	pathAndQuery := strings.SplitN(requestUrl, "?", 2)
+	if len(pathAndQuery) != 2 {
+		return requestUrl, nil
+	}
+
+	params, err := search.ParseQuery(pathAndQuery[1])
+	if err != nil {
+		return "", err
+	}
+
+	resolved := search.URLQueryParameters{}
+	changed := false
+	for _, param := range params.All() {
+		value := param.Value
+		if ref, found := refMap[value]; found {
+			glog.V(3).Infof("  search %s: replaced %s --> %s", pathAndQuery[0], value, ref)
+			value = ref
+			changed = true
+		}
+		resolved.Add(param.Key, value)
+	}
+
+	if !changed {
+		return requestUrl, nil
+	}
+	return pathAndQuery[0] + "?" + resolved.Encode(), nil
+}
+
 func isConditional(entry *models2.ShallowBundleEntryComponent) bool {
 	if entry.Request == nil {
 		return false
@@ -965,6 +1229,9 @@ func sortBundleEntries(bundle *models2.ShallowBundle) ([]*models2.ShallowBundleE
 			if !strings.Contains(bundle.Entry[i].Request.Url, "/") && !strings.Contains(bundle.Entry[i].Request.Url, "?") {
 				return nil, brokenInvariant(errors.New("Batch PUT URL must have an id or a condition"))
 			}
+			if err := checkPutEntryID(&bundle.Entry[i]); err != nil {
+				return nil, brokenInvariant(err)
+			}
 		case "GET":
 			if bundle.Entry[i].Request.Url == "" {
 				return nil, brokenInvariant(errors.New("Batch GET must have a URL"))
@@ -979,6 +1246,22 @@ func sortBundleEntries(bundle *models2.ShallowBundle) ([]*models2.ShallowBundleE
 	return entries, nil
 }
 
+// checkPutEntryID checks that the resource and fullUrl of a PUT entry with an id in its URL (e.g. Patient/123)
+// don't have another id, as the URL's would otherwise silently replace it
+func checkPutEntryID(entry *models2.ShallowBundleEntryComponent) error {
+	if isConditional(entry) {
+		return nil
+	}
+	parts := strings.SplitN(entry.Request.Url, "/", 2)
+	if id := entry.Resource.Id(); id != "" && id != parts[1] {
+		return errors.Errorf("Batch PUT resource id %s doesn't match the id in its URL %s", id, entry.Request.Url)
+	}
+	if entry.FullUrl != "" && !strings.HasPrefix(entry.FullUrl, "urn:") && !strings.HasSuffix(entry.FullUrl, "/"+entry.Request.Url) {
+		return errors.Errorf("Batch PUT fullUrl %s doesn't match its URL %s", entry.FullUrl, entry.Request.Url)
+	}
+	return nil
+}
+
 // Support sorting by request method, as defined in the spec
 type byRequestMethod []*models2.ShallowBundleEntryComponent
 
@@ -8,15 +8,19 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
 	"github.com/gin-gonic/gin"
 	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
 	"github.com/pebbe/util"
+	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	. "gopkg.in/check.v1"
 	"gopkg.in/mgo.v2"
@@ -1158,6 +1162,487 @@ func (s *BatchControllerSuite) TestAllSupportedMethodsBundle(c *C) {
 	s.checkReference(c, responseBundle.Entry[4].Resource.(*models.Condition).Subject, patientID, "Patient")
 }
 
+func (s *BatchControllerSuite) TestUnsupportedBundleType(c *C) {
+	body := `{"resourceType":"Bundle","type":"searchset","entry":[{"resource":{"resourceType":"Patient"}}]}`
+	res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	c.Assert(oo.Issue[0].Code, Equals, "value")
+	c.Assert(oo.Issue[0].Details.Text, Equals, "Bundle type 'searchset' is not supported; expected 'batch' or 'transaction'")
+}
+
+func (s *BatchControllerSuite) TestTransactionPutWithMismatchedID(c *C) {
+	id := bson.NewObjectId().Hex()
+	otherID := bson.NewObjectId().Hex()
+	post := func(fullUrl string, resourceID string) *http.Response {
+		idField := ""
+		if resourceID != "" {
+			idField = `"id":"` + resourceID + `",`
+		}
+		body := `{"resourceType":"Bundle","type":"transaction","entry":[` +
+			`{"resource":{"resourceType":"Condition","code":{"text":"Asthma"}},"request":{"method":"POST","url":"Condition"}},` +
+			`{"fullUrl":"` + fullUrl + `","resource":{"resourceType":"Patient",` + idField + `"gender":"female"},` +
+			`"request":{"method":"PUT","url":"Patient/` + id + `"}}]}`
+		res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	assertBrokenInvariant := func(res *http.Response, diagnostics string) {
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 400)
+		oo := &models.OperationOutcome{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+		c.Assert(oo.Issue, HasLen, 1)
+		c.Assert(oo.Issue[0].Code, Equals, "invariant")
+		c.Assert(oo.Issue[0].Details.Text, Equals, diagnostics)
+	}
+
+	assertBrokenInvariant(post("urn:uuid:61ebe359-bfdc-4613-8bf2-c5e3009a5d12", otherID),
+		"Batch PUT resource id "+otherID+" doesn't match the id in its URL Patient/"+id)
+	assertBrokenInvariant(post("http://example.com/fhir/Patient/"+otherID, ""),
+		"Batch PUT fullUrl http://example.com/fhir/Patient/"+otherID+" doesn't match its URL Patient/"+id)
+
+	// nothing was written
+	count, err := s.MgoDB().C("conditions").Find(bson.M{"code.text": "Asthma"}).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+	count, err = s.MgoDB().C("patients").FindId(id).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+
+	// an id matching the URL or none at all is fine
+	for _, resourceID := range []string{id, ""} {
+		res := post("http://example.com/fhir/Patient/"+id, resourceID)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+	count, err = s.MgoDB().C("patients").FindId(id).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *BatchControllerSuite) TestDocumentBundle(c *C) {
+	body := `{"resourceType":"Bundle","type":"document","entry":[` +
+		`{"fullUrl":"urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a","resource":{"resourceType":"Composition","status":"final","type":{"text":"Discharge summary"},"date":"2018-10-01","title":"Discharge summary","author":[{"display":"Dr Smith"}]}}]}`
+
+	// rejected by default
+	res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+	util.CheckErr(err)
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	c.Assert(oo.Issue[0].Details.Text, Equals, "Bundle type 'document' is not supported; expected 'batch' or 'transaction'")
+
+	// stored as a Bundle resource when enabled
+	config := DefaultConfig
+	config.StoreDocumentBundles = true
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.MongoClient, s.DbName, true, "", s.Interceptors, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err = http.Post(server.URL+"/", "application/fhir+json", strings.NewReader(body))
+	util.CheckErr(err)
+	stored := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(stored))
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+	c.Assert(res.Header.Get("Location"), Matches, server.URL+"/Bundle/[0-9a-f]{24}/_history/1")
+	c.Assert(stored.Type, Equals, "document")
+	c.Assert(stored.Entry, HasLen, 1)
+
+	count, err := s.MgoDB().C("bundles").FindId(stored.Id).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+}
+
+func (s *BatchControllerSuite) TestTransactionSearchWithConditionalReference(c *C) {
+	patient := &models.Patient{
+		Identifier: []models.Identifier{{System: "http://acme.com/mrn", Value: "1234"}},
+	}
+	patient.Id = "5d3a0e5b9a2b1c0001f0c0e0"
+	util.CheckErr(s.MgoDB().C("patients").Insert(patient))
+
+	body := `{"resourceType":"Bundle","type":"transaction","entry":[` +
+		`{"resource":{"resourceType":"Observation","status":"final","code":{"text":"Weight"},"subject":{"reference":"Patient?identifier=http://acme.com/mrn|1234"}},` +
+		`"request":{"method":"POST","url":"Observation"}},` +
+		`{"request":{"method":"GET","url":"Observation?subject=Patient%3Fidentifier%3Dhttp%3A%2F%2Facme.com%2Fmrn%7C1234"}}]}`
+	res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	responseBundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+	c.Assert(responseBundle.Entry, HasLen, 2)
+
+	// the search found the Observation created with the resolved reference
+	searchBundle, ok := responseBundle.Entry[1].Resource.(*models.Bundle)
+	c.Assert(ok, Equals, true)
+	c.Assert(*searchBundle.Total, Equals, uint32(1))
+
+	// and its self link has the resolved rather than the conditional reference
+	var selfLink string
+	for _, link := range searchBundle.Link {
+		if link.Relation == "self" {
+			selfLink = link.Url
+		}
+	}
+	c.Assert(strings.HasPrefix(selfLink, s.Server.URL+"/Observation?"), Equals, true)
+	selfURL, err := url.Parse(selfLink)
+	util.CheckErr(err)
+	c.Assert(selfURL.Query().Get("subject"), Equals, "Patient/5d3a0e5b9a2b1c0001f0c0e0")
+}
+
+func (s *BatchControllerSuite) TestTransactionConditionalReferenceToInBundleResource(c *C) {
+	body := `{"resourceType":"Bundle","type":"transaction","entry":[` +
+		`{"resource":{"resourceType":"Observation","status":"final","code":{"text":"Weight"},"subject":{"reference":"Patient?identifier=http://acme.com/mrn|in-bundle-1"}},` +
+		`"request":{"method":"POST","url":"Observation"}},` +
+		`{"fullUrl":"urn:uuid:61ebe359-bfdc-4613-8bf2-c5e300945f0a",` +
+		`"resource":{"resourceType":"Patient","identifier":[{"system":"http://acme.com/mrn","value":"in-bundle-1"}]},` +
+		`"request":{"method":"POST","url":"Patient"}}]}`
+	res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	responseBundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+	c.Assert(responseBundle.Entry, HasLen, 2)
+	patientID := responseBundle.Entry[1].Resource.(*models.Patient).Id
+	c.Assert(bson.IsObjectIdHex(patientID), Equals, true)
+
+	// the reference resolved to the Patient created by the transaction, which didn't exist beforehand
+	s.checkReference(c, responseBundle.Entry[0].Resource.(*models.Observation).Subject, patientID, "Patient")
+}
+
+func (s *BatchControllerSuite) TestBatchDuplicateConditionalCreates(c *C) {
+	for _, concurrency := range []int{1, 4} {
+		mrn := fmt.Sprintf("duplicate-%d", concurrency)
+		body := `{"resourceType":"Bundle","type":"batch","entry":[` +
+			`{"resource":{"resourceType":"Patient","identifier":[{"system":"http://acme.com/mrn","value":"` + mrn + `"}],"gender":"female"},` +
+			`"request":{"method":"POST","url":"Patient","ifNoneExist":"identifier=http://acme.com/mrn|` + mrn + `"}},` +
+			`{"resource":{"resourceType":"Condition","code":{"text":"Asthma"}},"request":{"method":"POST","url":"Condition"}},` +
+			`{"resource":{"resourceType":"Patient","identifier":[{"system":"http://acme.com/mrn","value":"` + mrn + `"}],"gender":"male"},` +
+			`"request":{"method":"POST","url":"Patient","ifNoneExist":"identifier=http://acme.com/mrn|` + mrn + `"}}]}`
+
+		config := DefaultConfig
+		config.BatchConcurrency = concurrency
+		engine := gin.New()
+		RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.MongoClient, s.DbName, true, "", s.Interceptors, config), config)
+		server := httptest.NewServer(engine)
+
+		res, err := http.Post(server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 200)
+		responseBundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+		res.Body.Close()
+		server.Close()
+
+		// the second entry found the Patient created by the first rather than creating another
+		c.Assert(responseBundle.Entry, HasLen, 3)
+		c.Assert(responseBundle.Entry[0].Response.Status, Equals, "201")
+		c.Assert(responseBundle.Entry[2].Response.Status, Equals, "200")
+		patientID := s.getResourceID(responseBundle.Entry[0])
+		c.Assert(s.getResourceID(responseBundle.Entry[2]), Equals, patientID)
+		c.Assert(responseBundle.Entry[2].Response.Location, Equals, responseBundle.Entry[0].Response.Location)
+		c.Assert(responseBundle.Entry[2].Resource.(*models.Patient).Gender, Equals, "female")
+		c.Assert(responseBundle.Entry[2].Response.Etag, Equals, responseBundle.Entry[0].Response.Etag)
+		c.Assert(responseBundle.Entry[2].Response.LastModified, NotNil)
+		c.Assert(responseBundle.Entry[2].Response.LastModified.Time.Equal(responseBundle.Entry[0].Response.LastModified.Time), Equals, true)
+
+		count, err := s.MgoDB().C("patients").Find(bson.M{"identifier.value": mrn}).Count()
+		util.CheckErr(err)
+		c.Assert(count, Equals, 1, Commentf("concurrency %d", concurrency))
+	}
+}
+
+// writeConflictDAL makes the first creates of its sessions fail with a write conflict
+type writeConflictDAL struct {
+	DataAccessLayer
+	conflicts *int32
+}
+
+func (dal writeConflictDAL) StartSession(ctx context.Context, customDbName string) DataAccessSession {
+	return writeConflictSession{dal.DataAccessLayer.StartSession(ctx, customDbName), dal.conflicts}
+}
+
+type writeConflictSession struct {
+	DataAccessSession
+	conflicts *int32
+}
+
+func (session writeConflictSession) PostWithID(id string, resource *models2.Resource) error {
+	if atomic.AddInt32(session.conflicts, -1) >= 0 {
+		return errors.New("(WriteConflict) WriteConflict error: this operation conflicted with another operation")
+	}
+	return session.DataAccessSession.PostWithID(id, resource)
+}
+
+func (s *BatchControllerSuite) TestTransactionWriteConflictRetries(c *C) {
+	post := func(conflicts int32, mrn string) (*http.Response, time.Duration) {
+		config := DefaultConfig
+		config.TransactionRetryDelay = 20 * time.Millisecond
+		dal := writeConflictDAL{NewMongoDataAccessLayer(s.MongoClient, s.DbName, true, "", s.Interceptors, config), &conflicts}
+		engine := gin.New()
+		RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), dal, config)
+		server := httptest.NewServer(engine)
+		defer server.Close()
+
+		body := `{"resourceType":"Bundle","type":"transaction","entry":[` +
+			`{"resource":{"resourceType":"Patient","identifier":[{"system":"http://acme.com/mrn","value":"` + mrn + `"}]},` +
+			`"request":{"method":"POST","url":"Patient"}}]}`
+		start := time.Now()
+		res, err := http.Post(server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res, time.Since(start)
+	}
+	countPatients := func(mrn string) int {
+		count, err := s.MgoDB().C("patients").Find(bson.M{"identifier.value": mrn}).Count()
+		util.CheckErr(err)
+		return count
+	}
+
+	// two conflicts are retried after backing off (at least 10ms then 20ms)
+	res, elapsed := post(2, "retried")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(elapsed >= 30*time.Millisecond, Equals, true, Commentf("took %v", elapsed))
+	c.Assert(countPatients("retried"), Equals, 1)
+
+	// a third is one too many
+	res, _ = post(3, "conflicting")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusConflict)
+	c.Assert(res.Header.Get("Retry-After"), Equals, "1")
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	c.Assert(oo.Issue[0].Code, Equals, "conflict")
+	c.Assert(oo.Issue[0].Details.Text, Equals, "Transaction conflicted with concurrent writes 3 times; try again later")
+	c.Assert(countPatients("conflicting"), Equals, 0)
+}
+
+func (s *BatchControllerSuite) TestRetryDelay(c *C) {
+	for retry := 1; retry <= 4; retry++ {
+		delay := retryDelay(100*time.Millisecond, retry)
+		max := 100 * time.Millisecond << uint(retry-1)
+		c.Assert(delay >= max/2 && delay <= max, Equals, true, Commentf("retry %d: %v", retry, delay))
+	}
+	c.Assert(retryDelay(0, 1), Equals, time.Duration(0))
+
+	// the delay stops doubling at the maximum
+	for _, retry := range []int{9, 38, 100, 1000} {
+		delay := retryDelay(50*time.Millisecond, retry)
+		c.Assert(delay >= maxRetryDelay/2 && delay <= maxRetryDelay, Equals, true, Commentf("retry %d: %v", retry, delay))
+	}
+}
+
+func (s *BatchControllerSuite) TestTransactionReferencesLimit(c *C) {
+	for _, mrn := range []string{"1", "2"} {
+		patient := &models.Patient{
+			Identifier: []models.Identifier{{System: "http://acme.com/mrn", Value: "limit-" + mrn}},
+		}
+		patient.Id = bson.NewObjectId().Hex()
+		util.CheckErr(s.MgoDB().C("patients").Insert(patient))
+	}
+
+	body := `{"resourceType":"Bundle","type":"transaction","entry":[` +
+		`{"resource":{"resourceType":"Observation","status":"final","code":{"text":"Weight"},"subject":{"reference":"Patient?identifier=http://acme.com/mrn|limit-1"}},` +
+		`"request":{"method":"POST","url":"Observation"}},` +
+		`{"resource":{"resourceType":"Observation","status":"final","code":{"text":"Weight"},"subject":{"reference":"Patient?identifier=http://acme.com/mrn|limit-2"}},` +
+		`"request":{"method":"POST","url":"Observation"}}]}`
+	post := func(maxReferences int) *http.Response {
+		config := DefaultConfig
+		config.MaxTransactionReferences = maxReferences
+		engine := gin.New()
+		RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.MongoClient, s.DbName, true, "", s.Interceptors, config), config)
+		server := httptest.NewServer(engine)
+		defer server.Close()
+
+		res, err := http.Post(server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	countObservations := func() int {
+		count, err := s.MgoDB().C("observations").Find(bson.M{"code.text": "Weight"}).Count()
+		util.CheckErr(err)
+		return count
+	}
+	count := countObservations()
+
+	// the transaction is rejected without creating anything
+	res := post(1)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusRequestEntityTooLarge)
+	oo := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+	c.Assert(oo.Issue[0].Code, Equals, "too-costly")
+	c.Assert(oo.Issue[0].Details.Text, Equals, "transaction has more than 1 conditional references")
+
+	c.Assert(countObservations(), Equals, count)
+
+	res = post(2)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	c.Assert(countObservations(), Equals, count+2)
+}
+
+func (s *BatchControllerSuite) TestBatchConditionalReferences(c *C) {
+	patient := &models.Patient{
+		Identifier: []models.Identifier{{System: "http://acme.com/mrn", Value: "batch-ref-1"}},
+	}
+	patient.Id = bson.NewObjectId().Hex()
+	util.CheckErr(s.MgoDB().C("patients").Insert(patient))
+	for i := 0; i < 2; i++ {
+		duplicate := &models.Patient{
+			Identifier: []models.Identifier{{System: "http://acme.com/mrn", Value: "batch-ref-2"}},
+		}
+		duplicate.Id = bson.NewObjectId().Hex()
+		util.CheckErr(s.MgoDB().C("patients").Insert(duplicate))
+	}
+
+	batch := func(mrn string) string {
+		return `{"resourceType":"Bundle","type":"batch","entry":[` +
+			`{"resource":{"resourceType":"Observation","status":"final","code":{"text":"Batch weight"},"subject":{"reference":"Patient?identifier=http://acme.com/mrn|` + mrn + `"}},` +
+			`"request":{"method":"POST","url":"Observation"}}]}`
+	}
+	post := func(allow bool, body string) *http.Response {
+		config := DefaultConfig
+		config.AllowConditionalReferencesInBatch = allow
+		engine := gin.New()
+		RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.MongoClient, s.DbName, true, "", s.Interceptors, config), config)
+		server := httptest.NewServer(engine)
+		defer server.Close()
+
+		res, err := http.Post(server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+	decodeOutcome := func(res *http.Response) *models.OperationOutcome {
+		oo := &models.OperationOutcome{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(oo))
+		return oo
+	}
+
+	// rejected by default
+	res := post(false, batch("batch-ref-1"))
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	oo := decodeOutcome(res)
+	c.Assert(oo.Issue[0].Code, Equals, "invariant")
+	c.Assert(oo.Issue[0].Details.Text, Equals, "conditional references are only allowed in transactions, not batches")
+
+	// resolved to the only matching patient
+	res = post(true, batch("batch-ref-1"))
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	var observations []models.Observation
+	util.CheckErr(s.MgoDB().C("observations").Find(bson.M{"code.text": "Batch weight"}).All(&observations))
+	c.Assert(observations, HasLen, 1)
+	c.Assert(observations[0].Subject.Reference, Equals, "Patient/"+patient.Id)
+
+	// still an error without exactly one match
+	res = post(true, batch("batch-ref-2"))
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(decodeOutcome(res).Issue[0].Code, Equals, "multiple-matches")
+
+	res = post(true, batch("batch-ref-3"))
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	c.Assert(decodeOutcome(res).Issue[0].Code, Equals, "not-found")
+}
+
+func (s *BatchControllerSuite) TestBatchSearchesWithIncludes(c *C) {
+	post := func(body string) *models.Bundle {
+		res, err := http.Post(s.Server.URL+"/", "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		responseBundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+		return responseBundle
+	}
+
+	created := post(`{"resourceType":"Bundle","type":"transaction","entry":[` +
+		`{"fullUrl":"urn:uuid:0c3b0fa4-8d5e-4c3a-9d6b-2f4f4a6c1e01","resource":{"resourceType":"Patient","gender":"female"},"request":{"method":"POST","url":"Patient"}},` +
+		`{"resource":{"resourceType":"Condition","code":{"text":"Asthma"},"subject":{"reference":"urn:uuid:0c3b0fa4-8d5e-4c3a-9d6b-2f4f4a6c1e01"}},"request":{"method":"POST","url":"Condition"}}]}`)
+	patientID := s.getResourceID(created.Entry[0])
+	conditionID := s.getResourceID(created.Entry[1])
+
+	responseBundle := post(`{"resourceType":"Bundle","type":"batch","entry":[` +
+		`{"request":{"method":"GET","url":"Condition?_id=` + conditionID + `&_include=Condition:patient"}},` +
+		`{"request":{"method":"GET","url":"Patient?_id=` + patientID + `"}}]}`)
+	c.Assert(responseBundle.Entry, HasLen, 2)
+
+	// each search is returned as its own searchset with the includes of its own query
+	conditions, ok := responseBundle.Entry[0].Resource.(*models.Bundle)
+	c.Assert(ok, Equals, true)
+	c.Assert(conditions.Type, Equals, "searchset")
+	c.Assert(*conditions.Total, Equals, uint32(1))
+	c.Assert(conditions.Entry, HasLen, 2)
+	c.Assert(conditions.Entry[0].Search.Mode, Equals, "match")
+	c.Assert(s.getResourceID(conditions.Entry[0]), Equals, conditionID)
+	c.Assert(conditions.Entry[1].Search.Mode, Equals, "include")
+	c.Assert(conditions.Entry[1].Resource, FitsTypeOf, &models.Patient{})
+	c.Assert(s.getResourceID(conditions.Entry[1]), Equals, patientID)
+	c.Assert(conditions.Entry[1].FullUrl, Equals, s.Server.URL+"/Patient/"+patientID)
+
+	patients, ok := responseBundle.Entry[1].Resource.(*models.Bundle)
+	c.Assert(ok, Equals, true)
+	c.Assert(patients.Entry, HasLen, 1)
+	c.Assert(patients.Entry[0].Search.Mode, Equals, "match")
+	c.Assert(s.getResourceID(patients.Entry[0]), Equals, patientID)
+}
+
+func (s *BatchControllerSuite) TestBatchOutcomeSummary(c *C) {
+	body := `{"resourceType":"Bundle","type":"batch","entry":[` +
+		`{"request":{"method":"GET","url":"Patient/_history"}},` +
+		`{"resource":{"resourceType":"Patient","gender":"female"},"request":{"method":"POST","url":"Patient"}},` +
+		`{"request":{"method":"GET","url":"Patient/123/$everything"}}]}`
+	post := func(prefer string) *models.Bundle {
+		req, err := http.NewRequest("POST", s.Server.URL+"/", strings.NewReader(body))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/fhir+json")
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		responseBundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+		return responseBundle
+	}
+
+	// only the entries by default
+	responseBundle := post("")
+	c.Assert(responseBundle.Entry, HasLen, 3)
+
+	responseBundle = post("batch-outcome=summary")
+	c.Assert(*responseBundle.Total, Equals, uint32(3))
+	c.Assert(responseBundle.Entry, HasLen, 4)
+	c.Assert(responseBundle.Entry[1].Response.Status, Equals, "201")
+
+	summary := responseBundle.Entry[3]
+	c.Assert(summary.Resource, IsNil)
+	c.Assert(summary.Response.Status, Equals, "200")
+	oo, ok := summary.Response.Outcome.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(oo.Issue, HasLen, 2)
+	c.Assert(oo.Issue[0].Expression, DeepEquals, []string{"Bundle.entry[0]"})
+	c.Assert(oo.Issue[0].Diagnostics, Matches, "(?s).*resource-level history not supported in request: Patient/_history.*")
+	c.Assert(oo.Issue[1].Expression, DeepEquals, []string{"Bundle.entry[2]"})
+	c.Assert(oo.Issue[1].Diagnostics, Matches, "(?s).*operation not supported in request: Patient/123/\\$everything.*")
+}
+
 func (s *BatchControllerSuite) checkReference(c *C, ref *models.Reference, id string, typ string) {
 	c.Assert(ref.ReferencedID, Equals, id)
 	c.Assert(ref.Type, Equals, typ)
@@ -0,0 +1,442 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// exportPageSize is the number of resources read per search while exporting
+const exportPageSize = 500
+
+// exportJobs holds the $export jobs that have been kicked off and haven't expired or been deleted, by id
+var exportJobs sync.Map
+
+// exportJob is a bulk data export running (or finished) in the background
+type exportJob struct {
+	id              string
+	request         string    // the kickoff request URL
+	transactionTime time.Time // when the export was kicked off
+	expires         time.Time // when the job and its files are removed
+	dir             string    // where the job's ndjson files are written
+	fileURL         string    // the URL the job's files are served from
+
+	mutex    sync.Mutex
+	done     bool
+	err      error
+	output   []exportOutput
+	progress string
+}
+
+// exportOutput is an entry of the output of an export manifest: an ndjson file of one resource type
+type exportOutput struct {
+	Type  string `json:"type"`
+	URL   string `json:"url"`
+	Count int    `json:"count"`
+}
+
+// exportManifest is the response to polling a completed export
+type exportManifest struct {
+	TransactionTime     string         `json:"transactionTime"`
+	Request             string         `json:"request"`
+	RequiresAccessToken bool           `json:"requiresAccessToken"`
+	Output              []exportOutput `json:"output"`
+	Error               []exportOutput `json:"error"`
+}
+
+// exportOptions are the parameters of an $export request
+type exportOptions struct {
+	Types []string
+	Since time.Time
+}
+
+// exportScope is what an export includes: either everything, or the compartments of some patients
+type exportScope struct {
+	patientLevel bool
+	patientIDs   []string // the patients of a group-level export, or nil for all patients
+}
+
+// SystemExportHandler handles the $export operation at the server's base URL (GET /$export),
+// exporting all resources of the requested types
+func SystemExportHandler(dal DataAccessLayer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		kickOffExport(c, dal, config, registeredResourceTypes(), exportScope{})
+	}
+}
+
+// ExportHandler handles the $export operation for all patients (GET /Patient/$export)
+// or the patients of a group (GET /Group/123/$export), exporting the resources in their compartments
+func (rc *ResourceController) ExportHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	scope := exportScope{patientLevel: true}
+	if rc.Name == "Group" {
+		session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+		group, err := session.Get(c.Param("id"), "Group")
+		session.Finish()
+		switch err {
+		case nil:
+		case ErrNotFound:
+			c.Status(http.StatusNotFound)
+			return
+		case ErrDeleted:
+			c.Status(http.StatusGone)
+			return
+		default:
+			panic(errors.Wrap(err, "Export failed to get Group"))
+		}
+
+		scope.patientIDs, err = groupPatientIDs(group)
+		if err != nil {
+			panic(errors.Wrap(err, "Export failed to read Group members"))
+		}
+	}
+
+	kickOffExport(c, rc.DAL, rc.Config, patientCompartmentTypes(), scope)
+}
+
+// ExportStatusHandler handles polling an export (GET /$export-status/:job), which responds with
+// a 202 while the export is in progress and the manifest of its files once it's complete.
+// Deleting the status URL cancels the export or removes its files.
+func ExportStatusHandler(c *gin.Context) {
+	defer handlePanics(c)
+
+	value, ok := exportJobs.Load(c.Param("job"))
+	if !ok {
+		outcome := models.NewOperationOutcome("error", "not-found", "Unknown export job")
+		c.Render(http.StatusNotFound, CustomFhirRenderer{outcome, c})
+		return
+	}
+	job := value.(*exportJob)
+
+	if c.Request.Method == http.MethodDelete {
+		job.remove()
+		c.Status(http.StatusAccepted)
+		return
+	}
+
+	job.mutex.Lock()
+	defer job.mutex.Unlock()
+	switch {
+	case !job.done:
+		c.Header("X-Progress", job.progress)
+		c.Header("Retry-After", "1")
+		c.Status(http.StatusAccepted)
+	case job.err != nil:
+		outcome := models.NewOperationOutcome("fatal", "exception", "Export failed: "+job.err.Error())
+		c.Render(http.StatusInternalServerError, CustomFhirRenderer{outcome, c})
+	default:
+		c.Header("Expires", job.expires.UTC().Format(http.TimeFormat))
+		c.JSON(http.StatusOK, exportManifest{
+			TransactionTime: job.transactionTime.Format(time.RFC3339Nano),
+			Request:         job.request,
+			Output:          append([]exportOutput{}, job.output...),
+			Error:           []exportOutput{},
+		})
+	}
+}
+
+// ExportFileHandler serves the ndjson files of a completed export (GET /$export-file/:job/:file)
+func ExportFileHandler(c *gin.Context) {
+	value, ok := exportJobs.Load(c.Param("job"))
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	job := value.(*exportJob)
+
+	job.mutex.Lock()
+	var found bool
+	for _, output := range job.output {
+		found = found || output.Type+".ndjson" == c.Param("file")
+	}
+	job.mutex.Unlock()
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	c.Header("Content-Type", "application/fhir+ndjson")
+	c.File(filepath.Join(job.dir, c.Param("file")))
+}
+
+// kickOffExport starts an export job of the resources of the requested types (or of all
+// exportableTypes) in the background, responding with a 202 and the URL for polling its status.
+// The job and its files are removed once it expires after Config.BulkExportExpiry.
+func kickOffExport(c *gin.Context, dal DataAccessLayer, config Config, exportableTypes []string, scope exportScope) {
+	c.Set("Action", "export")
+
+	options, err := parseExportOptions(c, exportableTypes)
+	if err != nil {
+		outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+	if len(options.Types) == 0 {
+		options.Types = exportableTypes
+	}
+
+	requestURL := config.responseURL(c.Request, strings.TrimPrefix(c.Request.URL.Path, "/"))
+	requestURL.RawQuery = c.Request.URL.RawQuery
+
+	// the session is started before the job so that requests for databases that can't be used
+	// fail here with an OperationOutcome rather than in the background
+	session := dal.StartSession(context.Background(), c.GetHeader("Db"))
+
+	expiry := config.BulkExportExpiry
+	if expiry <= 0 {
+		expiry = DefaultConfig.BulkExportExpiry
+	}
+	id := bson.NewObjectId().Hex()
+	job := &exportJob{
+		id:              id,
+		request:         requestURL.String(),
+		transactionTime: time.Now().UTC(),
+		dir:             filepath.Join(config.BulkExportDir, id),
+		fileURL:         config.responseURL(c.Request, "$export-file", id).String(),
+	}
+	job.expires = job.transactionTime.Add(expiry)
+	if err := os.MkdirAll(job.dir, 0777); err != nil {
+		session.Finish()
+		panic(errors.Wrap(err, "failed to create export directory"))
+	}
+	exportJobs.Store(id, job)
+	time.AfterFunc(expiry, job.remove)
+
+	go job.run(session, options, scope)
+
+	c.Header("Content-Location", config.responseURL(c.Request, "$export-status", id).String())
+	c.Status(http.StatusAccepted)
+}
+
+// parseExportOptions reads the _type, _since and _outputFormat parameters of an $export request
+func parseExportOptions(c *gin.Context, exportableTypes []string) (options exportOptions, err error) {
+	switch c.Query("_outputFormat") {
+	case "", "application/fhir+ndjson", "application/ndjson", "ndjson":
+	default:
+		return options, errors.New("Parameter \"_outputFormat\" content is invalid (only ndjson is supported)")
+	}
+
+	if since := c.Query("_since"); since != "" {
+		options.Since, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return options, errors.New("Parameter \"_since\" content is invalid (should be an instant)")
+		}
+	}
+
+	exportable := make(map[string]bool, len(exportableTypes))
+	for _, resourceType := range exportableTypes {
+		exportable[resourceType] = true
+	}
+	for _, types := range c.QueryArray("_type") {
+		for _, resourceType := range strings.Split(types, ",") {
+			if !exportable[resourceType] {
+				return options, fmt.Errorf("Parameter \"_type\" content is invalid (%s resources can't be exported)", resourceType)
+			}
+			options.Types = append(options.Types, resourceType)
+		}
+	}
+	return options, nil
+}
+
+// patientCompartmentTypes returns Patient and the resource types in the Patient compartment
+func patientCompartmentTypes() []string {
+	resourceTypes := []string{"Patient"}
+	for resourceType := range search.CompartmentDefinitions["Patient"] {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes[1:])
+	return resourceTypes
+}
+
+// groupPatientIDs returns the ids of the patients that are members of a Group
+func groupPatientIDs(groupResource *models2.Resource) ([]string, error) {
+	var group models.Group
+	if err := json.Unmarshal(groupResource.JsonBytes(), &group); err != nil {
+		return nil, err
+	}
+
+	patientIDs := []string{}
+	for _, member := range group.Member {
+		if member.Entity != nil && strings.HasPrefix(member.Entity.Reference, "Patient/") {
+			patientIDs = append(patientIDs, strings.TrimPrefix(member.Entity.Reference, "Patient/"))
+		}
+	}
+	return patientIDs, nil
+}
+
+// remove forgets the job and deletes its files, which also cancels it if it's still running
+func (job *exportJob) remove() {
+	exportJobs.Delete(job.id)
+	if err := os.RemoveAll(job.dir); err != nil {
+		glog.Errorf("failed to remove files of export %s: %s", job.id, err.Error())
+	}
+}
+
+// run exports the resources of each type to an ndjson file with the session, which it finishes,
+// marking the job as done when finished
+func (job *exportJob) run(session DataAccessSession, options exportOptions, scope exportScope) {
+	defer session.Finish()
+
+	var err error
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		if err != nil {
+			glog.Errorf("export %s failed: %s", job.id, err.Error())
+		}
+		job.mutex.Lock()
+		job.done, job.err = true, err
+		job.mutex.Unlock()
+	}()
+
+	if scope.patientLevel && scope.patientIDs == nil {
+		scope.patientIDs, err = session.FindIDs(search.Query{Resource: "Patient"})
+		if err != nil {
+			err = errors.Wrap(err, "failed to find patients")
+			return
+		}
+	}
+
+	for i, resourceType := range options.Types {
+		if _, ok := exportJobs.Load(job.id); !ok {
+			return // cancelled
+		}
+
+		job.mutex.Lock()
+		job.progress = fmt.Sprintf("Exporting %s (%d of %d resource types)", resourceType, i+1, len(options.Types))
+		job.mutex.Unlock()
+
+		var output exportOutput
+		output, err = job.exportType(session, resourceType, options.Since, scope)
+		if err != nil {
+			err = errors.Wrapf(err, "failed to export %s resources", resourceType)
+			return
+		}
+		if output.Count > 0 {
+			job.mutex.Lock()
+			job.output = append(job.output, output)
+			job.mutex.Unlock()
+		}
+	}
+}
+
+// exportType writes the resources of a type to the job's ndjson file for that type, which is removed if there are none
+func (job *exportJob) exportType(session DataAccessSession, resourceType string, since time.Time, scope exportScope) (output exportOutput, err error) {
+	fileName := resourceType + ".ndjson"
+	output = exportOutput{Type: resourceType, URL: job.fileURL + "/" + fileName}
+
+	filePath := filepath.Join(job.dir, fileName)
+	file, err := os.Create(filePath)
+	if err != nil {
+		return output, err
+	}
+	writer := bufio.NewWriter(file)
+
+	var sinceParam string
+	if !since.IsZero() {
+		sinceParam = "_lastUpdated=ge" + url.QueryEscape(since.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	}
+
+	if !scope.patientLevel {
+		query := search.Query{Resource: resourceType, Query: sinceParam}
+		err = exportSearchResults(session, query, writer, nil, &output.Count)
+	} else if resourceType == "Patient" && sinceParam == "" && scope.patientIDs == nil {
+		err = exportSearchResults(session, search.Query{Resource: "Patient"}, writer, nil, &output.Count)
+	} else {
+		// a resource can be in the compartments of several patients, but is only exported once
+		exported := make(map[string]bool)
+		for _, patientID := range scope.patientIDs {
+			var query search.Query
+			if resourceType == "Patient" {
+				query = search.Query{Resource: "Patient", Query: "_id=" + url.QueryEscape(patientID)}
+				if sinceParam != "" {
+					query.Query += "&" + sinceParam
+				}
+			} else {
+				query, _ = search.CompartmentQuery("Patient", patientID, resourceType, sinceParam)
+			}
+			if err = exportSearchResults(session, query, writer, exported, &output.Count); err != nil {
+				break
+			}
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && output.Count == 0 {
+		err = os.Remove(filePath)
+	}
+	return output, err
+}
+
+// exportSearchResults writes the results of a search as ndjson, following the search's next links
+// until all pages have been written. Resources whose ids are in exported are skipped.
+func exportSearchResults(session DataAccessSession, query search.Query, writer *bufio.Writer, exported map[string]bool, count *int) error {
+	query.Query = strings.TrimPrefix(fmt.Sprintf("%s&%s=%d&%s=none", query.Query, search.CountParam, exportPageSize, search.TotalParam), "&")
+
+	for {
+		bundle, err := session.Search(url.URL{}, query)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range bundle.Entry {
+			if entry.Resource == nil || (entry.Search != nil && entry.Search.Mode != "match") {
+				continue
+			}
+			if exported != nil {
+				if exported[entry.Resource.Id()] {
+					continue
+				}
+				exported[entry.Resource.Id()] = true
+			}
+			if _, err := writer.Write(entry.Resource.JsonBytes()); err != nil {
+				return err
+			}
+			if err := writer.WriteByte('\n'); err != nil {
+				return err
+			}
+			*count++
+		}
+
+		next := ""
+		for _, link := range bundle.Link {
+			if link.Relation == "next" {
+				next = link.Url
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		nextURL, err := url.Parse(next)
+		if err != nil {
+			return errors.Wrap(err, "invalid next link")
+		}
+		query.Query = nextURL.RawQuery
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// inBundleResource is a resource created or updated by a transaction, which the conditional
+// references of the transaction can resolve to
+type inBundleResource struct {
+	reference string // e.g. Patient/123
+	json      map[string]interface{}
+}
+
+// inBundleResources returns the resources created or updated by the entries of a transaction by type,
+// given the reference (Type/id) that each POST entry resolved to, if any
+func inBundleResources(entries []*models2.ShallowBundleEntryComponent, postRefs []string) (map[string][]inBundleResource, error) {
+	resources := make(map[string][]inBundleResource)
+	for i, entry := range entries {
+		if entry.Resource == nil {
+			continue
+		}
+		var reference string
+		switch entry.Request.Method {
+		case "POST":
+			reference = postRefs[i]
+		case "PUT":
+			// conditional PUTs have been resolved to Type/id unless they failed
+			if !strings.Contains(entry.Request.Url, "?") && strings.Count(entry.Request.Url, "/") == 1 {
+				reference = entry.Request.Url
+			}
+		}
+		if reference == "" {
+			continue
+		}
+
+		var resourceJSON map[string]interface{}
+		if err := json.Unmarshal(entry.Resource.JsonBytes(), &resourceJSON); err != nil {
+			return nil, errors.Wrapf(err, "failed to parse the resource of entry %d", i)
+		}
+		resourceType := entry.Resource.ResourceType()
+		resources[resourceType] = append(resources[resourceType], inBundleResource{reference, resourceJSON})
+	}
+	return resources, nil
+}
+
+// matchInBundle returns the references of the in-bundle resources matching a conditional reference's query.
+// Only a subset of searches can be evaluated: those whose parameters are all tokens without modifiers on
+// identifiers, codings and primitive values. Other queries match nothing here and are only resolved against
+// the database.
+func matchInBundle(resources map[string][]inBundleResource, query search.Query, caseSensitive bool) []string {
+	candidates := resources[query.Resource]
+	if len(candidates) == 0 {
+		return nil
+	}
+	equal := strings.EqualFold
+	if caseSensitive {
+		equal = func(a, b string) bool { return a == b }
+	}
+
+	var tokens []*search.TokenParam
+	for _, param := range query.Params() {
+		token, isToken := param.(*search.TokenParam)
+		if !isToken || token.Modifier != "" {
+			return nil
+		}
+		for _, path := range token.Paths {
+			switch path.Type {
+			case "Identifier", "Coding", "CodeableConcept", "code", "string", "id", "uri":
+			default:
+				return nil
+			}
+		}
+		tokens = append(tokens, token)
+	}
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var references []string
+	for _, candidate := range candidates {
+		matchesAll := true
+		for _, token := range tokens {
+			if !tokenMatchesResource(token, candidate.json, equal) {
+				matchesAll = false
+				break
+			}
+		}
+		if matchesAll {
+			references = append(references, candidate.reference)
+		}
+	}
+	return references
+}
+
+// tokenMatchesResource returns true if any of the values at the paths of a token parameter match it
+func tokenMatchesResource(token *search.TokenParam, resource map[string]interface{}, equal func(a, b string) bool) bool {
+	// like createTokenQueryObject: [code], |[code], [system]| or [system]|[code]
+	matches := func(system string, hasSystem bool, code string) bool {
+		if token.Code != "" && !equal(code, token.Code) {
+			return false
+		}
+		if token.System != "" {
+			return equal(system, token.System)
+		}
+		return token.AnySystem || !hasSystem
+	}
+	codingMatches := func(value interface{}, codeKey string) bool {
+		element, isObject := value.(map[string]interface{})
+		if !isObject {
+			return false
+		}
+		system, hasSystem := element["system"].(string)
+		code, _ := element[codeKey].(string)
+		return matches(system, hasSystem, code)
+	}
+
+	for _, path := range token.Paths {
+		for _, value := range valuesAtPath(resource, path.Path) {
+			switch path.Type {
+			case "Identifier":
+				if codingMatches(value, "value") {
+					return true
+				}
+			case "Coding":
+				if codingMatches(value, "code") {
+					return true
+				}
+			case "CodeableConcept":
+				for _, coding := range valuesAtPath(value, "[]coding") {
+					if codingMatches(coding, "code") {
+						return true
+					}
+				}
+			default:
+				if code, isString := value.(string); isString && token.System == "" && equal(code, token.Code) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// valuesAtPath returns the values at a search parameter path (e.g. "[]name.[]given") of parsed JSON,
+// with those of arrays flattened
+func valuesAtPath(value interface{}, path string) []interface{} {
+	values := []interface{}{value}
+	for _, segment := range strings.Split(path, ".") {
+		if end := strings.Index(segment, "]"); strings.HasPrefix(segment, "[") && end > 0 {
+			segment = segment[end+1:]
+		}
+		var next []interface{}
+		for _, v := range values {
+			object, isObject := v.(map[string]interface{})
+			if !isObject {
+				continue
+			}
+			switch child := object[segment].(type) {
+			case nil:
+			case []interface{}:
+				next = append(next, child...)
+			default:
+				next = append(next, child)
+			}
+		}
+		values = next
+	}
+	return values
+}
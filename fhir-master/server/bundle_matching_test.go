@@ -0,0 +1,58 @@
+package server
+
+import (
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	. "gopkg.in/check.v1"
+)
+
+type BundleMatchingSuite struct {
+}
+
+var _ = Suite(&BundleMatchingSuite{})
+
+func (s *BundleMatchingSuite) inBundleResources(c *C) map[string][]inBundleResource {
+	patient, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType":"Patient","identifier":[{"system":"http://acme.com/mrn","value":"IB-1"}],"gender":"male"}`))
+	c.Assert(err, IsNil)
+	observation, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType":"Observation","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}}`))
+	c.Assert(err, IsNil)
+
+	entries := []*models2.ShallowBundleEntryComponent{
+		{Resource: patient, Request: &models.BundleEntryRequestComponent{Method: "POST", Url: "Patient"}},
+		{Resource: observation, Request: &models.BundleEntryRequestComponent{Method: "PUT", Url: "Observation/o1"}},
+		{Request: &models.BundleEntryRequestComponent{Method: "DELETE", Url: "Patient/p2"}},
+	}
+	resources, err := inBundleResources(entries, []string{"Patient/p1", "", ""})
+	c.Assert(err, IsNil)
+	return resources
+}
+
+func (s *BundleMatchingSuite) TestMatchInBundle(c *C) {
+	resources := s.inBundleResources(c)
+	match := func(resource, query string, caseSensitive bool) []string {
+		return matchInBundle(resources, search.Query{Resource: resource, Query: query}, caseSensitive)
+	}
+
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|IB-1", false), DeepEquals, []string{"Patient/p1"})
+	c.Assert(match("Patient", "identifier=IB-1", false), DeepEquals, []string{"Patient/p1"})
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|", false), DeepEquals, []string{"Patient/p1"})
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|IB-1&gender=male", false), DeepEquals, []string{"Patient/p1"})
+	c.Assert(match("Observation", "code=http://loinc.org|1234-5", false), DeepEquals, []string{"Observation/o1"})
+
+	c.Assert(match("Patient", "identifier=|IB-1", false), HasLen, 0)
+	c.Assert(match("Patient", "identifier=http://other.com/mrn|IB-1", false), HasLen, 0)
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|IB-1&gender=female", false), HasLen, 0)
+	c.Assert(match("Observation", "code=1234-6", false), HasLen, 0)
+
+	// case sensitivity follows the server's token searches
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|ib-1", false), DeepEquals, []string{"Patient/p1"})
+	c.Assert(match("Patient", "identifier=http://acme.com/mrn|ib-1", true), HasLen, 0)
+}
+
+func (s *BundleMatchingSuite) TestUnsupportedQueriesDontMatch(c *C) {
+	resources := s.inBundleResources(c)
+	for _, query := range []string{"name=x", "identifier:text=IB-1", "_id=p1&name=x"} {
+		c.Assert(matchInBundle(resources, search.Query{Resource: "Patient", Query: query}, false), HasLen, 0)
+	}
+}
@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/search"
+)
+
+// CapabilityStatementHandler serves a CapabilityStatement describing the resources
+// and search parameters supported by this server (i.e. the /metadata endpoint)
+func CapabilityStatementHandler(config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		// built for each request as custom search parameters can be registered at any time
+		statement := NewCapabilityStatement(config, time.Now())
+		c.Render(200, CustomFhirRenderer{statement, c})
+	}
+}
+
+// NewCapabilityStatement builds a CapabilityStatement from the search parameter registry,
+// reflecting the interactions enabled in the server's configuration
+func NewCapabilityStatement(config Config, date time.Time) *models.CapabilityStatement {
+	registry := search.GlobalRegistry()
+
+	formats := []string{"application/fhir+json"}
+	if config.EnableXML {
+		formats = append(formats, "application/fhir+xml")
+	}
+
+	rest := models.CapabilityStatementRestComponent{
+		Mode: "server",
+		Operation: []models.CapabilityStatementRestOperationComponent{
+			{Name: "validate", Definition: &models.Reference{Reference: "http://hl7.org/fhir/OperationDefinition/Resource-validate"}},
+		},
+		Compartment: []string{"http://hl7.org/fhir/CompartmentDefinition/patient"},
+	}
+	rest.Operation = append(rest.Operation, models.CapabilityStatementRestOperationComponent{
+		Name: "meta", Definition: &models.Reference{Reference: "http://hl7.org/fhir/OperationDefinition/Resource-meta"},
+	})
+	if !config.ReadOnly {
+		rest.Operation = append(rest.Operation,
+			models.CapabilityStatementRestOperationComponent{Name: "meta-add", Definition: &models.Reference{Reference: "http://hl7.org/fhir/OperationDefinition/Resource-meta-add"}},
+			models.CapabilityStatementRestOperationComponent{Name: "meta-delete", Definition: &models.Reference{Reference: "http://hl7.org/fhir/OperationDefinition/Resource-meta-delete"}},
+		)
+	}
+	if config.CountTotalResults {
+		rest.Documentation = "Searches return the total number of matches in Bundle.total"
+	} else {
+		rest.Documentation = "Searches do not return Bundle.total"
+	}
+	if !config.ReadOnly {
+		rest.Interaction = []models.CapabilityStatementSystemInteractionComponent{
+			{Code: "transaction"},
+			{Code: "batch"},
+		}
+	}
+	if config.EnableHistory {
+		rest.Interaction = append(rest.Interaction, models.CapabilityStatementSystemInteractionComponent{Code: "history-system"})
+	}
+	// with _type (see SystemSearchHandler)
+	rest.Interaction = append(rest.Interaction, models.CapabilityStatementSystemInteractionComponent{Code: "search-system"})
+
+	for _, resourceType := range registeredResourceTypes() {
+		rest.Resource = append(rest.Resource, capabilityStatementResource(config, registry, resourceType))
+	}
+
+	return &models.CapabilityStatement{
+		Name:          "GoFHIR Capability Statement",
+		Status:        "active",
+		Date:          &models.FHIRDateTime{Time: date, Precision: models.Timestamp},
+		Publisher:     "PAT Pty Ltd, The MITRE Corporation",
+		Description:   "GoFHIR capability statement",
+		Kind:          "instance",
+		Software:      &models.CapabilityStatementSoftwareComponent{Name: "GoFHIR"},
+		FhirVersion:   FhirVersion,
+		AcceptUnknown: "extensions",
+		Format:        formats,
+		PatchFormat:   []string{"application/json-patch+json", "application/fhir+json"},
+		Rest:          []models.CapabilityStatementRestComponent{rest},
+	}
+}
+
+// registeredResourceTypes returns the resource types in the search parameter registry, skipping any
+// custom search parameters registered for unknown resources
+func registeredResourceTypes() []string {
+	var resourceTypes []string
+	for _, resourceType := range search.GlobalRegistry().ResourceNames() {
+		if models.StructForResourceName(resourceType) != nil {
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+	return resourceTypes
+}
+
+func capabilityStatementResource(config Config, registry *search.Registry, resourceType string) models.CapabilityStatementRestResourceComponent {
+	codes := []string{"read", "search-type"}
+	if config.EnableHistory {
+		codes = append(codes, "vread", "history-instance", "history-type")
+	}
+	if !config.ReadOnly {
+		codes = append(codes, "create", "update", "patch", "delete")
+	}
+
+	resource := models.CapabilityStatementRestResourceComponent{
+		Type:            resourceType,
+		ReadHistory:     &config.EnableHistory,
+		ConditionalRead: "not-supported",
+		SearchInclude:   []string{"*"},
+	}
+	for _, code := range codes {
+		resource.Interaction = append(resource.Interaction, models.CapabilityStatementResourceInteractionComponent{Code: code})
+	}
+	if config.EnableHistory {
+		resource.Versioning = "versioned-update"
+	} else {
+		resource.Versioning = "versioned"
+	}
+	if !config.ReadOnly {
+		supported := true
+		resource.UpdateCreate = &supported
+		resource.ConditionalCreate = &supported
+		resource.ConditionalUpdate = &supported
+		resource.ConditionalDelete = "multiple"
+	}
+
+	for _, info := range registry.ParameterInfos(resourceType) {
+		if info.Type == "composite" {
+			continue // not supported by the searcher
+		}
+
+		param := models.CapabilityStatementRestResourceSearchParamComponent{
+			Name: info.Name,
+			Type: info.Type,
+		}
+		if modifiers := search.SupportedModifiers(info); len(modifiers) > 0 {
+			param.Documentation = "Supported modifiers: :" + strings.Join(modifiers, ", :")
+		}
+		resource.SearchParam = append(resource.SearchParam, param)
+
+		if info.Type == "reference" {
+			resource.SearchInclude = append(resource.SearchInclude, fmt.Sprintf("%s:%s", resourceType, info.Name))
+		}
+	}
+
+	return resource
+}
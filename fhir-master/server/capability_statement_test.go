@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+)
+
+func (m *MiddlewareTestSuite) getMetadata(config Config, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/metadata", nil)
+	req.Header.Set("Accept", accept)
+	rw := m.serve(req, func(e *gin.Engine) {
+		e.GET("/metadata", CapabilityStatementHandler(config))
+	}, EnableXmlToJsonConversionMiddleware(), AbortNonFhirXMLorJSONRequestsMiddleware)
+	m.Require().Equal(http.StatusOK, rw.Code)
+	return rw
+}
+
+func (m *MiddlewareTestSuite) getStatement(config Config) (statement models.CapabilityStatement, patient models.CapabilityStatementRestResourceComponent) {
+	rw := m.getMetadata(config, "application/fhir+json")
+	m.Require().NoError(json.Unmarshal(rw.Body.Bytes(), &statement))
+	m.Equal("CapabilityStatement", statement.ResourceType)
+	m.Require().Len(statement.Rest, 1)
+
+	for _, resource := range statement.Rest[0].Resource {
+		if resource.Type == "Patient" {
+			patient = resource
+		}
+	}
+	m.Require().Equal("Patient", patient.Type)
+	return
+}
+
+func interactionCodes(resource models.CapabilityStatementRestResourceComponent) []string {
+	var codes []string
+	for _, interaction := range resource.Interaction {
+		codes = append(codes, interaction.Code)
+	}
+	return codes
+}
+
+func operationNames(statement models.CapabilityStatement) []string {
+	var names []string
+	for _, operation := range statement.Rest[0].Operation {
+		names = append(names, operation.Name)
+	}
+	return names
+}
+
+func (m *MiddlewareTestSuite) TestCapabilityStatementSearchParams() {
+	statement, patient := m.getStatement(DefaultConfig)
+	m.True(len(statement.Rest[0].Resource) > 100)
+
+	params := make(map[string]models.CapabilityStatementRestResourceSearchParamComponent)
+	for _, param := range patient.SearchParam {
+		params[param.Name] = param
+	}
+	m.Equal("string", params["name"].Type)
+	m.Equal("date", params["birthdate"].Type)
+	m.Equal("token", params["gender"].Type)
+	m.Equal("Supported modifiers: :text, :above, :below", params["gender"].Documentation)
+	m.Equal("reference", params["organization"].Type)
+	m.Equal("Supported modifiers: :Organization, :identifier", params["organization"].Documentation)
+	m.Equal([]string{"*", "Patient:general-practitioner", "Patient:link", "Patient:organization"}, patient.SearchInclude)
+}
+
+func (m *MiddlewareTestSuite) TestCapabilityStatementReflectsConfig() {
+	statement, patient := m.getStatement(DefaultConfig)
+	m.Equal([]string{"read", "search-type", "vread", "history-instance", "history-type", "create", "update", "patch", "delete"}, interactionCodes(patient))
+	m.True(*patient.ReadHistory)
+	m.True(*patient.ConditionalCreate)
+	m.True(*patient.ConditionalUpdate)
+	m.Equal([]string{"application/fhir+json", "application/fhir+xml"}, statement.Format)
+	m.Regexp("return the total", statement.Rest[0].Documentation)
+	m.Len(statement.Rest[0].Interaction, 4)
+	m.Equal([]string{"validate", "meta", "meta-add", "meta-delete"}, operationNames(statement))
+	m.Equal([]string{"http://hl7.org/fhir/CompartmentDefinition/patient"}, statement.Rest[0].Compartment)
+
+	config := DefaultConfig
+	config.EnableHistory = false
+	config.CountTotalResults = false
+	config.ReadOnly = true
+	statement, patient = m.getStatement(config)
+	m.Equal([]string{"read", "search-type"}, interactionCodes(patient))
+	m.False(*patient.ReadHistory)
+	m.Nil(patient.ConditionalCreate)
+	m.Nil(patient.ConditionalUpdate)
+	m.Require().Len(statement.Rest[0].Interaction, 1)
+	m.Equal("search-system", statement.Rest[0].Interaction[0].Code)
+	m.Equal([]string{"validate", "meta"}, operationNames(statement))
+	m.Regexp("do not return", statement.Rest[0].Documentation)
+}
+
+func (m *MiddlewareTestSuite) TestCapabilityStatementXML() {
+	rw := m.getMetadata(DefaultConfig, "application/fhir+xml")
+	m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+	body := rw.Body.String()
+	m.Contains(body, `<CapabilityStatement xmlns="http://hl7.org/fhir">`)
+	m.Regexp(`<searchParam><name value="name"/><type value="string"/></searchParam>`, body)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/search"
+)
+
+// CompartmentHandler handles GET requests for /Patient/:id/:type. These are compartment searches
+// (e.g. /Patient/123/Condition?code=...), but as gin can't route them separately from
+// /Patient/:id/_history, /Patient/:id/$everything, /Patient/:id/$meta and custom instance-level operations,
+// those are also dispatched from here.
+func (rc *ResourceController) CompartmentHandler(c *gin.Context) {
+	switch c.Param("type") {
+	case "_history":
+		if rc.Config.EnableHistory {
+			if c.Param("vid") != "" {
+				rc.ShowHandler(c)
+			} else {
+				rc.HistoryHandler(c)
+			}
+			return
+		}
+	case "$everything":
+		if c.Param("vid") == "" {
+			rc.EverythingHandler(c)
+			return
+		}
+	case "$graphql":
+		if c.Param("vid") == "" {
+			rc.GraphQLHandler(c)
+			return
+		}
+	case "$meta":
+		if c.Param("vid") == "" {
+			rc.MetaHandler(c)
+			return
+		}
+	default:
+		if c.Param("vid") == "" {
+			if strings.HasPrefix(c.Param("type"), "$") {
+				rc.OperationHandler(strings.TrimPrefix(c.Param("type"), "$"), InstanceLevel)(c)
+			} else {
+				rc.compartmentSearch(c)
+			}
+			return
+		}
+	}
+	c.Status(http.StatusNotFound)
+}
+
+// compartmentSearch searches for resources of a type within the compartment of this
+// resource, e.g. the Conditions of a Patient
+func (rc *ResourceController) compartmentSearch(c *gin.Context) {
+	defer handlePanics(c)
+
+	resourceType := c.Param("type")
+	searchQuery, ok := search.CompartmentQuery(rc.Name, c.Param("id"), resourceType, c.Request.URL.RawQuery)
+	if !ok {
+		outcome := models.NewOperationOutcome("error", "not-found", fmt.Sprintf("%s resources are not in the %s compartment", resourceType, rc.Name))
+		c.Render(http.StatusNotFound, CustomFhirRenderer{outcome, c})
+		return
+	}
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	baseURL := rc.Config.responseURL(c.Request, resourceType)
+	bundle, err := session.Search(*baseURL, searchQuery)
+	if err != nil {
+		panic(errors.Wrap(err, "Search failed"))
+	}
+
+	c.Set("bundle", bundle)
+	c.Set("Resource", resourceType)
+	c.Set("Action", "search")
+
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
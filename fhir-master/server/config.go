@@ -40,9 +40,16 @@ type Config struct {
 	// e.g. to use test4_fhir http://fhir-server/db/test4_fhir/Patient?name=alex
 	EnableMultiDB bool
 
+	// RequireExistingDb rejects requests for custom databases (see EnableMultiDB) that haven't been
+	// provisioned with a 404, instead of the first write creating them
+	RequireExistingDb bool
+
 	// All custom database names should end with this suffix (default is "_fhir")
 	DatabaseSuffix string
 
+	// ShardKey, if set, is applied to resource collections when they are created on a sharded cluster
+	ShardKey ShardKey
+
 	// DatabaseSocketTimeout is the amount of time the mgo driver will wait for a response
 	// from mongo before timing out.
 	DatabaseSocketTimeout time.Duration
@@ -59,6 +66,21 @@ type Config struct {
 	// for large datasets.
 	CountTotalResults bool
 
+	// EnableCursorPaging makes the paging links of searches continue after the last result of the
+	// page (_searchafter) rather than skipping results (_offset), which is faster for deep pages.
+	// Searches sorted in a way that doesn't allow it still use _offset
+	EnableCursorPaging bool
+
+	// MissingValuesSortOrder puts resources without a value of a _sort parameter "first" or "last"
+	// whatever the direction of the sort. By default ("") they come first when ascending and last when
+	// descending, as MongoDB sorts them. Sorts that then need reordering can't be paged with _searchafter.
+	MissingValuesSortOrder string
+
+	// DefaultSearchFilters are search parameters (by resource type, e.g. "Patient": "active=true") added to
+	// searches that don't already use them. Searches with default filters applied disclose them in their self
+	// link and in a warning OperationOutcome entry
+	DefaultSearchFilters map[string]string
+
 	// EnableCISearches toggles whether the mongo searches uses regexes to maintain
 	// case-insesitivity when performing searches on string fields, codes, etc.
 	EnableCISearches bool
@@ -68,17 +90,51 @@ type Config struct {
 	// R4 leans towards case-sensitive, whereas STU3 text suggests case-insensitive (https://github.com/HL7/fhir/commit/13fb1c1f102caf7de7266d6e78ab261efac06a1f)
 	TokenParametersCaseSensitive bool
 
+	// CaseSensitiveParameters overrides EnableCISearches and TokenParametersCaseSensitive for some
+	// string and token parameters, keyed by resource type and parameter (e.g. "Patient.identifier").
+	// true makes a parameter match case-sensitively and false case-insensitively.
+	CaseSensitiveParameters map[string]bool
+
 	// Whether to support storing previous versions of each resource
 	EnableHistory bool
 
+	// AllowClientAssignedStringIds lets resources be created with any valid FHIR id (e.g. PUT /Patient/my-custom-id),
+	// which is stored as is. Otherwise ids have to be BSON ObjectIds, as those assigned by the server are.
+	AllowClientAssignedStringIds bool
+
 	// Number of concurrent operations to do during batch bundle processing
 	BatchConcurrency int
 
+	// AllowConditionalReferencesInBatch resolves conditional references (e.g. Patient?identifier=...) in batches
+	// against the database, as in transactions. They must match exactly one resource. Otherwise such batches
+	// are rejected, as their entries are independent and can't refer to each other.
+	AllowConditionalReferencesInBatch bool
+
+	// TransactionRetries is how many times a transaction failing with a write conflict is retried (default 2),
+	// after a delay starting at TransactionRetryDelay (default 50ms) and doubling with each retry up to 10 seconds, with jitter.
+	// Transactions still conflicting are rejected with a 409 and a Retry-After header.
+	TransactionRetries    int
+	TransactionRetryDelay time.Duration
+
+	// SummarizeBatchOutcomes adds an entry to batch responses with an OperationOutcome collecting the
+	// warnings and errors of all the other entries. Clients can also ask for it with "Prefer: batch-outcome=summary"
+	SummarizeBatchOutcomes bool
+
 	// Whether to allow retrieving resources with no meta component,
 	// meaning Last-Modified & ETag headers can't be generated (breaking spec compliance)
 	// May be needed to support previous databases
+	// When false, resources created or updated without a meta are handled as per MetaLessResources
 	AllowResourcesWithoutMeta bool
 
+	// MetaLessResources is how resources created or updated without a meta are handled when
+	// AllowResourcesWithoutMeta is false: "inject" (the default) gives them a meta with the
+	// DefaultMetaProfiles of their type, while "reject" rejects them with a 400.
+	// Either way stored resources get the server's meta.versionId and meta.lastUpdated
+	MetaLessResources string
+
+	// DefaultMetaProfiles are the meta.profile URLs, by resource type, of injected metas
+	DefaultMetaProfiles map[string][]string
+
 	// ValidatorURL is an endpoint to which validation requests will be sent
 	ValidatorURL string
 
@@ -86,14 +142,93 @@ type Config struct {
 	// mode any HTTP verb other than GET, HEAD or OPTIONS is rejected.
 	ReadOnly bool
 
+	// CountCacheTTL is how long a read-only server reuses the cached total of a search before
+	// counting it again. Writes invalidate cached totals of their resource type, so this is only
+	// a safeguard against totals that depend on other resource types (default 10 minutes, 0 for no expiry)
+	CountCacheTTL time.Duration
+
 	// Enables requests and responses using FHIR XML MIME-types
 	EnableXML bool
 
+	// DefaultResponseFormat is the format ("json" or "xml") of responses to requests
+	// without an Accept header (or accepting */*) and without _format. XML requires EnableXML.
+	DefaultResponseFormat string
+
+	// FormatParamHandling is how requests with an unknown _format are handled: "lenient" ignores
+	// the parameter (so the Accept header or DefaultResponseFormat apply) while "strict" rejects them with a 400
+	FormatParamHandling string
+
+	// EnableFhirVersionConversion lets requests whose Accept header asks for another FHIR version
+	// through to a conversion layer (which must be provided separately, e.g. as middleware) rather
+	// than rejecting them with a 406 Not Acceptable
+	EnableFhirVersionConversion bool
+
 	// Debug toggles debug-level logging.
 	Debug bool
 
 	// Where to dump failed requests for debugging
 	FailedRequestsDir string
+
+	// Operations are custom operations (e.g. $match) that RegisterRoutes routes in addition to the built-in ones
+	Operations *OperationRegistry
+
+	// BulkExportDir is where $export jobs write their ndjson files. The $export operation
+	// is only supported when this is set
+	BulkExportDir string
+	// BulkExportExpiry is how long after an $export is kicked off its status and files remain
+	// available, after which they're removed (default 24 hours)
+	BulkExportExpiry time.Duration
+
+	// CaptureFailedRequests toggles saving the body and OperationOutcome of create, update
+	// and batch requests that fail with a 4xx or 5xx status to FailedRequestsDir
+	CaptureFailedRequests bool
+
+	// StoreDocumentBundles toggles storing document Bundles POSTed to the server's base URL
+	// as Bundle resources, rather than rejecting them as only batches and transactions are processed there
+	StoreDocumentBundles bool
+
+	// CaseInsensitiveResourceTypes routes requests whose resource type differs only in case
+	// (e.g. /patient/123) to that resource type
+	CaseInsensitiveResourceTypes bool
+
+	// MaxResourceDepth limits how deeply objects and arrays may be nested within a resource.
+	// Deeper resources are rejected with a 400 when being stored (default 64)
+	MaxResourceDepth int
+
+	// MaxSearchParameters limits how many search parameters a single search may have,
+	// while MaxSearchValuesPerParameter limits how many comma-separated values each may have.
+	// More complex searches are rejected with a 400 (defaults 100 and 1000, 0 for no limit)
+	MaxSearchParameters         int
+	MaxSearchValuesPerParameter int
+
+	// MaxResultCount limits the number of results of a single page of a search. Searches with
+	// a larger _count get this many, with a warning in an OperationOutcome entry (default 1000, 0 for no limit).
+	// It also limits the pages of history and $everything requests.
+	MaxResultCount int
+
+	// MaxTransactionReferences limits how many conditional references (e.g. Patient?identifier=...)
+	// a single transaction may have, as each is resolved with a search. Transactions with more are
+	// rejected with a 413 (default 1000, 0 for no limit)
+	MaxTransactionReferences int
+
+	// RequireIndexedSearch rejects searches with a 400 unless one of their parameters can use one
+	// of the indexes in IndexConfigPath, as other searches scan the whole collection
+	RequireIndexedSearch bool
+
+	// ReadFromSecondaries makes searches prefer to read from secondary members of the replica set,
+	// taking load off the primary at the cost of results possibly lagging behind recent writes.
+	// Writes, reads of single resources and everything in transactions still go to the primary.
+	ReadFromSecondaries bool
+
+	// Logger receives the log messages of the data access and batch layers (default GlogLogger)
+	Logger Logger
+
+	// EnableMetrics serves metrics of the data access operations at /metrics in the Prometheus text format,
+	// recorded by a PrometheusMetrics unless MetricsRecorder is set to another http.Handler
+	EnableMetrics bool
+
+	// MetricsRecorder receives the count, duration and errors of the data access operations (default none)
+	MetricsRecorder MetricsRecorder
 }
 
 // DefaultConfig is the default server configuration
@@ -110,10 +245,22 @@ var DefaultConfig = Config{
 	TokenParametersCaseSensitive: false,
 	EnableHistory:                true,
 	BatchConcurrency:             1,
+	TransactionRetries:           2,
+	TransactionRetryDelay:        50 * time.Millisecond,
 	EnableXML:                    true,
+	DefaultResponseFormat:        "json",
+	FormatParamHandling:          "lenient",
 	CountTotalResults:            true,
+	MetaLessResources:            "inject",
 	ReadOnly:                     false,
+	CountCacheTTL:                10 * time.Minute,
+	BulkExportExpiry:             24 * time.Hour,
 	Debug:                        false,
+	MaxResourceDepth:             64,
+	MaxSearchParameters:          100,
+	MaxSearchValuesPerParameter:  1000,
+	MaxResultCount:               1000,
+	MaxTransactionReferences:     1000,
 }
 
 func (config *Config) responseURL(r *http.Request, paths ...string) *url.URL {
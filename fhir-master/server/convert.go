@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+)
+
+// ConvertHandler handles the $convert operation (POST /$convert), returning the resource in the body
+// (JSON or XML as per the Content-Type) in the format of the Accept header or _format, without storing it.
+// XML requires EnableXML.
+func ConvertHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Action", "operation")
+
+	resource, err := FHIRBind(c, "")
+	if err != nil {
+		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+)
+
+func (m *MiddlewareTestSuite) convert(contentType string, accept string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/$convert", strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", accept)
+	return m.serve(req, func(e *gin.Engine) {
+		e.POST("/$convert", ConvertHandler)
+	}, EnableXmlToJsonConversionMiddleware(), AbortNonFhirXMLorJSONRequestsMiddleware)
+}
+
+func (m *MiddlewareTestSuite) TestConvertRoundTrip() {
+	patientJSON := `{"resourceType":"Patient","id":"123","name":[{"family":"Smith","given":["Jane"]}],"gender":"female","birthDate":"1974-12-25"}`
+
+	rw := m.convert("application/fhir+json", "application/fhir+xml", patientJSON)
+	m.Require().Equal(http.StatusOK, rw.Code)
+	m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+	xml := rw.Body.String()
+	m.Regexp(`(?s)<Patient xmlns="http://hl7.org/fhir">.*<family value="Smith"/>`, xml)
+
+	rw = m.convert("application/fhir+xml", "application/fhir+json", xml)
+	m.Require().Equal(http.StatusOK, rw.Code)
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+	var patient models.Patient
+	m.Require().NoError(json.Unmarshal(rw.Body.Bytes(), &patient))
+	m.Equal("123", patient.Id)
+	m.Require().Len(patient.Name, 1)
+	m.Equal("Smith", patient.Name[0].Family)
+	m.Equal([]string{"Jane"}, patient.Name[0].Given)
+	m.Equal("female", patient.Gender)
+	m.Equal("1974-12-25", patient.BirthDate.Time.Format("2006-01-02"))
+}
+
+func (m *MiddlewareTestSuite) TestConvertUnknownContentType() {
+	rw := m.convert("text/plain", "application/fhir+json", `Patient Jane Smith`)
+	m.Equal(http.StatusBadRequest, rw.Code)
+	var oo models.OperationOutcome
+	m.Require().NoError(json.Unmarshal(rw.Body.Bytes(), &oo))
+	m.Require().NotEmpty(oo.Issue)
+	m.Equal("structure", oo.Issue[0].Code)
+}
@@ -3,14 +3,22 @@ package server
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net/url"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/eug48/fhir/models"
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
 )
 
 type DataAccessLayer interface {
 	StartSession(ctx context.Context, dbname string) DataAccessSession
+	// ValidateResource runs the "Validate" interceptors on a resource about to be created or updated,
+	// returning the warnings they found, or a *ValidationError if they found errors
+	ValidateResource(ctx context.Context, resource *models2.Resource) (warnings []models.OperationOutcomeIssueComponent, err error)
 }
 
 // DataAccessLayer is an interface for the various interactions that can occur on a FHIR data store.
@@ -26,20 +34,34 @@ type DataAccessSession interface {
 	Get(id, resourceType string) (resource *models2.Resource, err error)
 	// GetVersion retrieves a single resource instance identified by its resource type, ID and versionId
 	GetVersion(id, versionId, resourceType string) (resource *models2.Resource, err error)
+	// AdjacentVersions returns the versionIds before and after the given version of a resource
+	// (empty if there are none), including versions recording a deletion
+	AdjacentVersions(id, versionId, resourceType string) (previousVersionId string, nextVersionId string, err error)
 	// Post creates a resource instance, returning its new ID.
 	Post(resource *models2.Resource) (id string, err error)
 	// ConditionalPost creates a resource if the query finds no matches
 	ConditionalPost(query search.Query, resource *models2.Resource) (httpStatus int, id string, outputResource *models2.Resource, err error)
 	// PostWithID creates a resource instance with the given ID.
 	PostWithID(id string, resource *models2.Resource) error
+	// BulkInsert creates many resources of a type with new IDs in a single round-trip, returning their IDs
+	// (in the order of resources). If some couldn't be created the others still are and the error is a
+	// *BulkInsertError, with the IDs of the resources that weren't created left empty. The resources go
+	// through ValidateResource, whose warnings are only logged.
+	BulkInsert(resourceType string, resources []*models2.Resource) (ids []string, err error)
 	// Put creates or updates a resource instance with the given ID.
 	Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error)
+	// Patch replaces the current version of a resource with the result of patch, failing with ErrConflict if the
+	// resource was updated in the meantime or its current version isn't conditionalVersionId (if not empty).
+	// Errors returned by patch are returned as they are.
+	Patch(id, resourceType, conditionalVersionId string, patch func(resource *models2.Resource) (*models2.Resource, error)) (patched *models2.Resource, err error)
 	// ConditionalPut creates or updates a resource based on search criteria.  If the criteria results in zero matches,
 	// the resource is created.  If the criteria results in one match, it is updated.  Otherwise, a ErrMultipleMatches
 	// error is returned.
 	ConditionalPut(query search.Query, conditionalVersionId string, resource *models2.Resource) (id string, createdNew bool, err error)
 	// Delete removes the resource instance with the given ID.  This operation cannot be undone.
-	Delete(id, resourceType string) (newVersionId string, err error)
+	// If conditionalVersionId isn't empty, the resource is only removed if that is its current version,
+	// otherwise an ErrConflict is returned.
+	Delete(id, resourceType, conditionalVersionId string) (newVersionId string, err error)
 	// ConditionalDelete removes zero or more resources matching the passed in search criteria.  This operation cannot
 	// be undone.
 	ConditionalDelete(query search.Query) (count int64, err error)
@@ -49,8 +71,46 @@ type DataAccessSession interface {
 	// search options that don't make sense in this context: _include, _revinclude, _summary, _elements, _contained,
 	// and _containedType.  It honors search options such as _count, _sort, and _offset.
 	FindIDs(searchQuery search.Query) (result []string, err error)
-	// History executes the history operation (partial support)
-	History(baseURL url.URL, resoureType string, id string) (bundle *models2.ShallowBundle, err error)
+	// GroupCounts counts the resources matching searchQuery grouped by the value of field (a dot-separated path
+	// such as status or class.code), ignoring search options such as _count and _sort.
+	GroupCounts(searchQuery search.Query, field string) (counts []search.GroupCount, err error)
+	// LastN returns a searchset bundle of the max most recent Observations matching searchQuery for
+	// each code and patient, for the $lastn operation (baseURL is the URL of Observation)
+	LastN(baseURL url.URL, searchQuery search.Query, max int) (bundle *models2.ShallowBundle, err error)
+	// Everything returns a resource along with the resources it references and those referencing it,
+	// one page at a time (baseURL is the server's root)
+	Everything(baseURL url.URL, resourceType string, id string, options EverythingOptions) (bundle *models2.ShallowBundle, err error)
+	// History executes the history operation for a single resource (baseURL includes the resource type)
+	History(baseURL url.URL, resoureType string, id string, options HistoryOptions) (bundle *models2.ShallowBundle, err error)
+	// HistoryForType returns changes to all resources of a type, most recent first (baseURL is the server's root)
+	HistoryForType(baseURL url.URL, resourceType string, options HistoryOptions) (bundle *models2.ShallowBundle, err error)
+	// HistoryForAll returns changes to all resources, most recent first (baseURL is the server's root)
+	HistoryForAll(baseURL url.URL, options HistoryOptions) (bundle *models2.ShallowBundle, err error)
+}
+
+// HistoryOptions holds the paging and filtering parameters of a history request
+type HistoryOptions struct {
+	// Count is the maximum number of entries to return (_count)
+	Count int
+	// Offset is the number of entries to skip (_offset)
+	Offset int
+	// Since excludes versions last updated before this time if it isn't zero (_since)
+	Since time.Time
+	// At selects the version that was current at this time if it isn't zero (_at).
+	// Only supported for the history of a single resource.
+	At time.Time
+}
+
+// EverythingOptions holds the paging and filtering parameters of a $everything request
+type EverythingOptions struct {
+	// Count is the maximum number of resources to return (_count)
+	Count int
+	// Offset is the number of resources to skip (_offset)
+	Offset int
+	// Types restricts the resources returned to these types if it isn't empty (_type)
+	Types []string
+	// Since excludes resources last updated before this time if it isn't zero (_since)
+	Since time.Time
 }
 
 // ErrNotFound indicates that the resource was not found (HTTP 404)
@@ -68,9 +128,51 @@ func (e ErrMultipleMatches) Error() string {
 	return e.msg
 }
 
+// ErrMissingMeta indicates that a resource without a meta was rejected (HTTP 400)
+var ErrMissingMeta = errors.New("Resource has no meta, which this server requires")
+
 // ErrOpInterrupted indicates that the query was interrupted by a killOp() operation
 var ErrOpInterrupted = errors.New("Operation Interrupted")
 
+// BulkInsertError reports the resources that BulkInsert couldn't create
+type BulkInsertError struct {
+	// Failures maps the index of each resource that wasn't created to the reason
+	Failures map[int]error
+}
+
+func (e *BulkInsertError) Error() string {
+	indices := make([]int, 0, len(e.Failures))
+	for index := range e.Failures {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return fmt.Sprintf("%d resources couldn't be created (first at index %d: %s)", len(indices), indices[0], e.Failures[indices[0]])
+}
+
+// ValidationError reports the issues the "Validate" interceptors found with a resource,
+// some of which are errors (HTTP 400)
+type ValidationError struct {
+	Issues []models.OperationOutcomeIssueComponent
+}
+
+func (e *ValidationError) Error() string {
+	diagnostics := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		diagnostics[i] = issue.Diagnostics
+	}
+	return strings.Join(diagnostics, "; ")
+}
+
+// ErrDatabaseNotFound indicates that a request named a custom database (see Config.EnableMultiDB)
+// that doesn't exist, with Config.RequireExistingDb set (HTTP 404)
+type ErrDatabaseNotFound struct {
+	name string
+}
+
+func (e ErrDatabaseNotFound) Error() string {
+	return fmt.Sprintf("Database \"%s\" not found", e.name)
+}
+
 type ErrConflict struct {
 	msg string
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
 	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
 func ErrorToOpOutcome(err interface{}) (statusCode int, outcome *models.OperationOutcome) {
@@ -19,11 +20,25 @@ func ErrorToOpOutcome(err interface{}) (statusCode int, outcome *models.Operatio
 		return x.HTTPStatus, x.OperationOutcome
 	case error:
 		cause := errors.Cause(x)
+		if marshalError, isMarshalError := cause.(mongo.MarshalError); isMarshalError {
+			// resources are converted to BSON by the mongo driver
+			cause = errors.Cause(marshalError.Err)
+		}
 		_, isSchemaError := cause.(models2.FhirSchemaError)
 		_, isVersionConflict := cause.(ErrConflict)
+		_, isDatabaseNotFound := cause.(ErrDatabaseNotFound)
+		validationErr, isValidationError := cause.(*ValidationError)
 		if isSchemaError {
 			outcome := models.NewOperationOutcome("fatal", "structure", cause.Error())
 			return http.StatusBadRequest, outcome
+		} else if cause == ErrMissingMeta {
+			outcome := models.NewOperationOutcome("error", "required", cause.Error())
+			return http.StatusBadRequest, outcome
+		} else if isValidationError {
+			return http.StatusBadRequest, &models.OperationOutcome{Issue: validationErr.Issues}
+		} else if isDatabaseNotFound {
+			outcome := models.NewOperationOutcome("error", "not-found", cause.Error())
+			return http.StatusNotFound, outcome
 		} else if isVersionConflict {
 			outcome := models.NewOperationOutcome("error", "conflict", cause.Error())
 			return http.StatusConflict, outcome // TODO (FHIR R4): changed to 412
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "gopkg.in/check.v1"
+)
+
+type ErrorsSuite struct {
+}
+
+var _ = Suite(&ErrorsSuite{})
+
+func deeplyNestedPatient(levels int) []byte {
+	extension := `{"url": "http://example.org/leaf", "valueString": "leaf"}`
+	for i := 0; i < levels; i++ {
+		extension = fmt.Sprintf(`{"url": "http://example.org/level%d", "extension": [%s]}`, i, extension)
+	}
+	return []byte(`{"resourceType": "Patient", "extension": [` + extension + `]}`)
+}
+
+func (s *ErrorsSuite) TestTooDeepResourceIs400(c *C) {
+	resource, err := models2.NewResourceFromJsonBytes(deeplyNestedPatient(models2.DefaultMaxConversionDepth + 1))
+	c.Assert(err, IsNil)
+
+	// as when the mongo driver fails to marshal a resource being stored
+	_, err = bson.Marshal(resource)
+	c.Assert(err, NotNil)
+	err = errors.Wrap(mongo.MarshalError{Value: resource, Err: err}, "failed to insert")
+
+	status, outcome := ErrorToOpOutcome(err)
+	c.Assert(status, Equals, http.StatusBadRequest)
+	c.Assert(outcome.Issue[0].Code, Equals, "structure")
+	c.Assert(outcome.Issue[0].Diagnostics, Matches, ".*nested too deeply.*")
+}
+
+func (s *ErrorsSuite) TestMalformedSearchDateIs400(c *C) {
+	for _, value := range []string{"notadate", "2019-02-30", "2019-01-01T25:00"} {
+		status, outcome := func() (status int, outcome *models.OperationOutcome) {
+			// as when handlePanics recovers from a search
+			defer func() { status, outcome = ErrorToOpOutcome(recover()) }()
+			query := search.Query{Resource: "Condition", Query: "onset-date=" + value}
+			query.Params()
+			return
+		}()
+		c.Assert(status, Equals, http.StatusBadRequest, Commentf(value))
+		c.Assert(outcome.Issue[0].Details.Text, Equals, fmt.Sprintf(`Parameter "onset-date" content is invalid: %q isn't a valid date (e.g. 2019, 2019-03, 2019-03-31 or 2019-03-31T14:30:00Z)`, value))
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// failedRequestWriter keeps a copy of the response body so that it can be
+// written out alongside the request if the request fails
+type failedRequestWriter struct {
+	gin.ResponseWriter
+	body *bytes.Buffer
+}
+
+func (w *failedRequestWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *failedRequestWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// FailedRequestCaptureMiddleware saves the body of create, update and batch/transaction
+// requests that fail with a 4xx or 5xx status to outputDirectory, together with the
+// OperationOutcome that was returned. Files are named after the time of the request
+// and its request id (taken from the X-Request-Id header or generated).
+func FailedRequestCaptureMiddleware(outputDirectory string) gin.HandlerFunc {
+
+	if err := os.MkdirAll(outputDirectory, 0777); err != nil {
+		panic(fmt.Sprintf("failed_requests.go: failed to create directory (%s): %s", outputDirectory, err.Error()))
+	}
+
+	return func(c *gin.Context) {
+		if !isCreateUpdateOrBatch(c) {
+			c.Next()
+			return
+		}
+
+		var requestBody []byte
+		if c.Request.Body != nil {
+			var err error
+			requestBody, err = ioutil.ReadAll(c.Request.Body)
+			c.Request.Body.Close()
+			if err != nil {
+				glog.Errorf("FailedRequestCaptureMiddleware: failed to read request body: %s", err.Error())
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+		}
+
+		writer := &failedRequestWriter{ResponseWriter: c.Writer, body: &bytes.Buffer{}}
+		c.Writer = writer
+		startTime := time.Now()
+
+		c.Next()
+
+		status := c.Writer.Status()
+		if status < 400 {
+			return
+		}
+
+		requestId := c.GetHeader("X-Request-Id")
+		if requestId == "" {
+			requestId = bson.NewObjectId().Hex()
+		}
+
+		err := dumpFailedRequest(outputDirectory, startTime, requestId, c, status, requestBody, writer.body.Bytes())
+		if err != nil {
+			glog.Errorf("FailedRequestCaptureMiddleware: %s", err.Error())
+		}
+	}
+}
+
+// isCreateUpdateOrBatch returns true for POSTs, PUTs and PATCHes other than POST _search
+func isCreateUpdateOrBatch(c *gin.Context) bool {
+	switch c.Request.Method {
+	case "PUT", "PATCH":
+		return true
+	case "POST":
+		return !strings.HasSuffix(strings.TrimSuffix(c.Request.URL.Path, "/"), "/_search")
+	default:
+		return false
+	}
+}
+
+func dumpFailedRequest(outputDirectory string, startTime time.Time, requestId string, c *gin.Context, status int, requestBody []byte, responseBody []byte) error {
+	timestamp := startTime.Format("2006-01-02-15-04-05.000000")
+	filename := fmt.Sprintf("%s.%s.failed.txt", timestamp, sanitizeFilename(requestId))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s\n", c.Request.Method, c.Request.URL.RequestURI())
+	fmt.Fprintf(&buf, "Request-Id: %s\n", requestId)
+	fmt.Fprintf(&buf, "Status: %d\n", status)
+	buf.WriteString("\nREQUEST BODY:\n")
+	buf.Write(requestBody)
+	buf.WriteString("\n\nRESPONSE BODY:\n")
+	buf.Write(responseBody)
+	buf.WriteString("\n")
+
+	err := ioutil.WriteFile(path.Join(outputDirectory, filename), buf.Bytes(), 0666)
+	if err != nil {
+		return errors.Wrap(err, "failed to write failed request")
+	}
+	return nil
+}
+
+// sanitizeFilename stops client-supplied request ids from escaping the output directory
+func sanitizeFilename(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, s)
+}
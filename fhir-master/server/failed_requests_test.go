@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	. "gopkg.in/check.v1"
+)
+
+type FailedRequestsSuite struct {
+	dir string
+}
+
+var _ = Suite(&FailedRequestsSuite{})
+
+func (s *FailedRequestsSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	gin.SetMode(gin.ReleaseMode)
+}
+
+func (s *FailedRequestsSuite) newEngine(c *C) *gin.Engine {
+	// the create below fails before any database operation so no server is needed
+	client, err := mongowrapper.Connect(context.TODO(), options.Client().ApplyURI("mongodb://localhost"))
+	c.Assert(err, IsNil)
+
+	e := gin.New()
+	e.Use(FailedRequestCaptureMiddleware(s.dir))
+	RegisterController("Patient", e, nil, NewMongoDataAccessLayer(client, "fhir-test", false, "", nil, DefaultConfig), DefaultConfig)
+	return e
+}
+
+func (s *FailedRequestsSuite) TestFailedCreateIsCaptured(c *C) {
+	e := s.newEngine(c)
+
+	req, _ := http.NewRequest("POST", "/Patient", strings.NewReader(`{"name": [{"family": "Doe"}]}`))
+	req.Header.Set("Content-Type", "application/fhir+json")
+	req.Header.Set("X-Request-Id", "abc123")
+	rw := httptest.NewRecorder()
+	e.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusBadRequest)
+
+	files, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 1)
+	c.Assert(strings.HasSuffix(files[0].Name(), ".abc123.failed.txt"), Equals, true)
+
+	contents, err := ioutil.ReadFile(path.Join(s.dir, files[0].Name()))
+	c.Assert(err, IsNil)
+	c.Assert(string(contents), Matches, `(?s)POST /Patient\n.*Status: 400\n.*"family": "Doe".*OperationOutcome.*`)
+}
+
+func (s *FailedRequestsSuite) TestSearchIsNotCaptured(c *C) {
+	e := gin.New()
+	e.Use(FailedRequestCaptureMiddleware(s.dir))
+	e.POST("/Patient/_search", func(ctx *gin.Context) {
+		ctx.Status(http.StatusBadRequest)
+	})
+
+	req, _ := http.NewRequest("POST", "/Patient/_search", strings.NewReader("name=a"))
+	rw := httptest.NewRecorder()
+	e.ServeHTTP(rw, req)
+	c.Assert(rw.Code, Equals, http.StatusBadRequest)
+
+	files, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, IsNil)
+	c.Assert(files, HasLen, 0)
+}
+
+func (s *FailedRequestsSuite) TestDirectoryIsCreated(c *C) {
+	dir := path.Join(s.dir, "nested", "failed")
+	FailedRequestCaptureMiddleware(dir)
+	info, err := os.Stat(dir)
+	c.Assert(err, IsNil)
+	c.Assert(info.IsDir(), Equals, true)
+}
@@ -0,0 +1,571 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+const (
+	// maxGraphQLRequestSize is the largest request body of a GraphQL query, in bytes
+	maxGraphQLRequestSize = 1 << 20
+	// maxGraphQLDepth is how deeply the selection sets of a GraphQL query may be nested
+	maxGraphQLDepth = 32
+)
+
+// GraphQLHandler handles the $graphql operation on a resource (e.g. POST /Patient/123/$graphql),
+// where the fields of the query are those of the resource, e.g.
+// { name { family } managingOrganization { resource { name } } }
+func (rc *ResourceController) GraphQLHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "operation")
+
+	fields, ok := parseGraphQLRequest(c)
+	if !ok {
+		return
+	}
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	resource, err := session.Get(c.Param("id"), rc.Name)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "$graphql: Get failed"))
+	}
+
+	resolver := &graphQLResolver{c: c, session: session, config: rc.Config}
+	object, err := resolver.resolveResource(resource, fields)
+	renderGraphQLResult(c, object, err)
+}
+
+// SystemGraphQLHandler handles the $graphql operation on the server (e.g. POST /$graphql), where the fields of
+// the query are reads of resources (e.g. Patient(id: "123")) and searches (e.g. PatientList(name: "smith"))
+func SystemGraphQLHandler(dal DataAccessLayer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		c.Set("Action", "operation")
+
+		fields, ok := parseGraphQLRequest(c)
+		if !ok {
+			return
+		}
+
+		session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+		defer session.Finish()
+
+		resolver := &graphQLResolver{c: c, session: session, config: config}
+		object, err := resolver.resolveRoot(fields)
+		renderGraphQLResult(c, object, err)
+	}
+}
+
+// parseGraphQLRequest parses the query of a GraphQL request: the query parameter of a GET or the body
+// of a POST, either as is (application/graphql) or as the query of a JSON object (application/json).
+// If the query can't be parsed, the error has been rendered.
+func parseGraphQLRequest(c *gin.Context) (fields []graphQLField, ok bool) {
+	query := c.Query("query")
+	if c.Request.Method == "POST" && query == "" {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxGraphQLRequestSize))
+		if err != nil && len(body) == maxGraphQLRequestSize {
+			renderGraphQLErrors(c, http.StatusRequestEntityTooLarge, fmt.Errorf("the request body is larger than %d bytes", maxGraphQLRequestSize))
+			return nil, false
+		}
+		if err != nil {
+			panic(errors.Wrap(err, "$graphql: failed to read the request body"))
+		}
+		query = string(body)
+
+		ct, _, _ := mime.ParseMediaType(c.GetHeader("Content-Type"))
+		if ct == "application/json" {
+			var request struct {
+				Query string `json:"query"`
+			}
+			if err := json.Unmarshal(body, &request); err != nil {
+				renderGraphQLErrors(c, http.StatusBadRequest, fmt.Errorf("failed to parse the request body: %s", err))
+				return nil, false
+			}
+			query = request.Query
+		}
+	}
+
+	fields, err := parseGraphQL(query)
+	if err != nil {
+		renderGraphQLErrors(c, http.StatusBadRequest, err)
+		return nil, false
+	}
+	return fields, true
+}
+
+func renderGraphQLResult(c *gin.Context, data graphQLObject, err error) {
+	if err != nil {
+		renderGraphQLErrors(c, http.StatusBadRequest, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": data})
+}
+
+func renderGraphQLErrors(c *gin.Context, status int, err error) {
+	c.JSON(status, gin.H{"errors": []gin.H{{"message": err.Error()}}})
+}
+
+// graphQLResolver resolves the fields of a GraphQL query against resources read from a session
+type graphQLResolver struct {
+	c       *gin.Context
+	session DataAccessSession
+	config  Config
+}
+
+// resolveRoot resolves the top-level fields of a system-level query
+func (r *graphQLResolver) resolveRoot(fields []graphQLField) (graphQLObject, error) {
+	var object graphQLObject
+	for _, field := range fields {
+		var value interface{}
+		var err error
+		if resourceType := strings.TrimSuffix(field.name, "List"); resourceType != field.name && models.StructForResourceName(resourceType) != nil {
+			value, err = r.resolveSearch(resourceType, field)
+		} else if models.StructForResourceName(field.name) != nil {
+			value, err = r.resolveRead(field)
+		} else {
+			err = fmt.Errorf("unknown field %s: top-level fields are resource types (e.g. Patient) or searches (e.g. PatientList)", field.name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		object = append(object, graphQLProperty{field.key(), value})
+	}
+	return object, nil
+}
+
+// resolveRead resolves a read such as Patient(id: "123"), which is null if the resource doesn't exist
+func (r *graphQLResolver) resolveRead(field graphQLField) (interface{}, error) {
+	id, found := field.argument("id")
+	if !found || len(field.arguments) != 1 {
+		return nil, fmt.Errorf("%s needs a single id argument", field.name)
+	}
+	resource, err := r.session.Get(id, field.name)
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "$graphql: Get failed")
+	}
+	return r.resolveResource(resource, field.selection)
+}
+
+// resolveSearch resolves a search such as PatientList(name: "smith") to a list of the matching resources.
+// The arguments are search parameters, with underscores in place of dashes (e.g. address_city)
+func (r *graphQLResolver) resolveSearch(resourceType string, field graphQLField) (interface{}, error) {
+	values := url.Values{}
+	for _, argument := range field.arguments {
+		name := "_" + strings.Replace(strings.TrimPrefix(argument.name, "_"), "_", "-", -1)
+		if !strings.HasPrefix(argument.name, "_") {
+			name = name[1:]
+		}
+		values.Add(name, argument.value)
+	}
+
+	searchQuery := search.Query{Resource: resourceType, Query: values.Encode()}
+	bundle, err := r.session.Search(*r.config.responseURL(r.c.Request, resourceType), searchQuery)
+	if err != nil {
+		return nil, errors.Wrap(err, "$graphql: Search failed")
+	}
+
+	list := []interface{}{}
+	for _, entry := range bundle.Entry {
+		if entry.Search != nil && entry.Search.Mode != "match" {
+			continue
+		}
+		object, err := r.resolveResource(entry.Resource, field.selection)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, object)
+	}
+	return list, nil
+}
+
+func (r *graphQLResolver) resolveResource(resource *models2.Resource, fields []graphQLField) (graphQLObject, error) {
+	data, err := json.Marshal(resource)
+	if err != nil {
+		return nil, errors.Wrap(err, "$graphql: failed to marshal resource")
+	}
+	var object map[string]interface{}
+	if err := json.Unmarshal(data, &object); err != nil {
+		return nil, errors.Wrap(err, "$graphql: failed to unmarshal resource")
+	}
+	return r.resolveObject(object, fields)
+}
+
+// resolveObject resolves the fields of an element. The resource field of a Reference is the resource it refers to.
+func (r *graphQLResolver) resolveObject(object map[string]interface{}, fields []graphQLField) (graphQLObject, error) {
+	resolved := graphQLObject{}
+	for _, field := range fields {
+		var value interface{}
+		var err error
+		if reference, isReference := object["reference"].(string); isReference && field.name == "resource" {
+			value, err = r.resolveReference(reference, field)
+		} else {
+			value, err = r.resolveValue(object[field.name], field)
+		}
+		if err != nil {
+			return nil, err
+		}
+		resolved = append(resolved, graphQLProperty{field.key(), value})
+	}
+	return resolved, nil
+}
+
+// resolveValue resolves the value of a field. Arguments filter the items of lists,
+// e.g. name(use: "official") only has the official names.
+func (r *graphQLResolver) resolveValue(value interface{}, field graphQLField) (interface{}, error) {
+	switch value := value.(type) {
+	case []interface{}:
+		list := []interface{}{}
+		for _, item := range value {
+			if !field.matches(item) {
+				continue
+			}
+			resolved, err := r.resolveValue(item, graphQLField{name: field.name, selection: field.selection})
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, resolved)
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(field.selection) == 0 {
+			return value, nil
+		}
+		return r.resolveObject(value, field.selection)
+	default:
+		return value, nil
+	}
+}
+
+// resolveReference resolves the resource of a Reference to another resource on this server,
+// which is null if it doesn't exist (or is external or contained)
+func (r *graphQLResolver) resolveReference(reference string, field graphQLField) (interface{}, error) {
+	parts := strings.Split(reference, "/")
+	if len(parts) != 2 || models.StructForResourceName(parts[0]) == nil {
+		return nil, nil
+	}
+	resource, err := r.session.Get(parts[1], parts[0])
+	if err == ErrNotFound || err == ErrDeleted {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "$graphql: Get failed")
+	}
+	return r.resolveResource(resource, field.selection)
+}
+
+// graphQLObject is a JSON object whose properties are in the order of the fields of the query
+type graphQLObject []graphQLProperty
+
+type graphQLProperty struct {
+	key   string
+	value interface{}
+}
+
+func (o graphQLObject) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, property := range o {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(property.key)
+		if err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(property.value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// graphQLField is a field of a GraphQL query, e.g. n: name(use: "official") { family }
+type graphQLField struct {
+	alias     string
+	name      string
+	arguments []graphQLArgument
+	selection []graphQLField
+}
+
+type graphQLArgument struct {
+	name  string
+	value string
+}
+
+// key returns the name of the field in the result
+func (f graphQLField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+func (f graphQLField) argument(name string) (value string, found bool) {
+	for _, argument := range f.arguments {
+		if argument.name == name {
+			return argument.value, true
+		}
+	}
+	return "", false
+}
+
+// matches reports whether a list item has the values of all the field's arguments
+func (f graphQLField) matches(item interface{}) bool {
+	if len(f.arguments) == 0 {
+		return true
+	}
+	object, isObject := item.(map[string]interface{})
+	if !isObject {
+		return false
+	}
+	for _, argument := range f.arguments {
+		value, found := object[argument.name]
+		if !found || fmt.Sprint(value) != argument.value {
+			return false
+		}
+	}
+	return true
+}
+
+// parseGraphQL parses a GraphQL query into its fields. Only what FHIR queries need is supported:
+// fields with aliases, arguments and selection sets, but not variables, fragments or directives.
+func parseGraphQL(query string) ([]graphQLField, error) {
+	tokens, err := tokenizeGraphQL(query)
+	if err != nil {
+		return nil, err
+	}
+	p := &graphQLParser{tokens: tokens}
+
+	if p.peek() == "query" {
+		p.next()
+		if isGraphQLName(p.peek()) {
+			p.next() // the operation name
+		}
+		if p.peek() == "(" {
+			return nil, errors.New("GraphQL variables are not supported")
+		}
+	} else if p.peek() == "mutation" || p.peek() == "subscription" {
+		return nil, fmt.Errorf("GraphQL %s operations are not supported", p.peek())
+	}
+
+	fields, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != "" {
+		return nil, fmt.Errorf("unexpected %s after the query", p.peek())
+	}
+	return fields, nil
+}
+
+type graphQLParser struct {
+	tokens []string
+	pos    int
+	depth  int // of the selection set being parsed
+}
+
+// peek returns the next token, or an empty string at the end of the query
+func (p *graphQLParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *graphQLParser) next() string {
+	token := p.peek()
+	p.pos++
+	return token
+}
+
+func (p *graphQLParser) expect(token string) error {
+	if next := p.next(); next != token {
+		if next == "" {
+			return fmt.Errorf("expected %s but the query ended", token)
+		}
+		return fmt.Errorf("expected %s but found %s", token, next)
+	}
+	return nil
+}
+
+func (p *graphQLParser) selectionSet() ([]graphQLField, error) {
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxGraphQLDepth {
+		return nil, fmt.Errorf("the query is nested more than %d levels deep", maxGraphQLDepth)
+	}
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []graphQLField
+	for p.peek() != "}" {
+		field, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	p.next()
+	if len(fields) == 0 {
+		return nil, errors.New("empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *graphQLParser) field() (field graphQLField, err error) {
+	field.name, err = p.name()
+	if err != nil {
+		return field, err
+	}
+	if p.peek() == ":" {
+		p.next()
+		field.alias = field.name
+		if field.name, err = p.name(); err != nil {
+			return field, err
+		}
+	}
+
+	if p.peek() == "(" {
+		p.next()
+		for p.peek() != ")" {
+			var argument graphQLArgument
+			if argument.name, err = p.name(); err != nil {
+				return field, err
+			}
+			if err = p.expect(":"); err != nil {
+				return field, err
+			}
+			if argument.value, err = p.value(); err != nil {
+				return field, err
+			}
+			field.arguments = append(field.arguments, argument)
+		}
+		p.next()
+	}
+
+	switch p.peek() {
+	case "{":
+		field.selection, err = p.selectionSet()
+	case "@", "...":
+		err = errors.New("GraphQL fragments and directives are not supported")
+	}
+	return field, err
+}
+
+func (p *graphQLParser) name() (string, error) {
+	token := p.next()
+	if !isGraphQLName(token) {
+		if token == "" {
+			return "", errors.New("expected a name but the query ended")
+		}
+		return "", fmt.Errorf("expected a name but found %s", token)
+	}
+	return token, nil
+}
+
+// value parses an argument value: a string, number, boolean or enum value
+func (p *graphQLParser) value() (string, error) {
+	token := p.next()
+	switch {
+	case strings.HasPrefix(token, `"`):
+		return strconv.Unquote(token)
+	case token == "$":
+		return "", errors.New("GraphQL variables are not supported")
+	case token == "" || strings.ContainsAny(token[:1], "{}()[]:@!=|"):
+		return "", fmt.Errorf("expected a value but found %s", token)
+	default:
+		return token, nil
+	}
+}
+
+func isGraphQLName(token string) bool {
+	if token == "" || unicode.IsDigit(rune(token[0])) {
+		return false
+	}
+	for _, r := range token {
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// tokenizeGraphQL splits a query into punctuators, names, numbers and (quoted) strings,
+// skipping whitespace, commas and comments
+func tokenizeGraphQL(query string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(query); {
+		ch := query[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n' || ch == '\r' || ch == ',':
+			i++
+		case ch == '#':
+			for i < len(query) && query[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(query[i:], "..."):
+			tokens = append(tokens, "...")
+			i += 3
+		case strings.IndexByte("{}()[]:@!=|$", ch) >= 0:
+			tokens = append(tokens, string(ch))
+			i++
+		case ch == '"':
+			end := i + 1
+			for end < len(query) && query[end] != '"' {
+				if query[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(query) {
+				return nil, errors.New("unterminated string in the query")
+			}
+			tokens = append(tokens, query[i:end+1])
+			i = end + 1
+		default:
+			end := i
+			for end < len(query) && (query[end] == '_' || query[end] == '-' || query[end] == '.' || query[end] == '+' ||
+				unicode.IsLetter(rune(query[end])) || unicode.IsDigit(rune(query[end]))) {
+				end++
+			}
+			if end == i {
+				return nil, fmt.Errorf("unexpected character %q in the query", ch)
+			}
+			tokens = append(tokens, query[i:end])
+			i = end
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/search"
+)
+
+// LastNHandler handles the Observation $lastn operation (e.g. GET /Observation/$lastn?patient=123&max=3),
+// returning the max (default 1) most recent Observations for each code and patient as a searchset Bundle.
+// Any other parameters are search parameters restricting the Observations that are considered.
+func (rc *ResourceController) LastNHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "search")
+
+	values := c.Request.URL.Query()
+	max := 1
+	if maxParam := values.Get("max"); maxParam != "" {
+		var err error
+		max, err = strconv.Atoi(maxParam)
+		if err != nil || max < 1 {
+			outcome := models.NewOperationOutcome("error", "invalid", "Parameter \"max\" content is invalid (should be a positive integer)")
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+			return
+		}
+	}
+	values.Del("max")
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	searchQuery := search.Query{Resource: rc.Name, Query: values.Encode()}
+	baseURL := rc.Config.responseURL(c.Request, rc.Name)
+	bundle, err := session.LastN(*baseURL, searchQuery, max)
+	if err != nil {
+		panic(errors.Wrap(err, "LastN failed"))
+	}
+
+	c.Set("bundle", bundle)
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// LogFields are the structured context of a log message, e.g. {"resourceType": "Patient", "id": "123"}
+type LogFields map[string]interface{}
+
+// Logger receives the log messages of the data access and batch layers, so that deployments
+// embedding the server can send them to their own logging library (set with Config.Logger)
+type Logger interface {
+	Debugf(fields LogFields, format string, args ...interface{})
+	Infof(fields LogFields, format string, args ...interface{})
+	Warnf(fields LogFields, format string, args ...interface{})
+	Errorf(fields LogFields, format string, args ...interface{})
+}
+
+// GlogLogger is the default Logger, writing to glog with the fields appended to the message
+// as key=value pairs. Debug messages are logged with -v=3 and info messages with -v=2.
+type GlogLogger struct{}
+
+func (GlogLogger) Debugf(fields LogFields, format string, args ...interface{}) {
+	if glog.V(3) {
+		glog.InfoDepth(1, withLogFields(fields, format, args))
+	}
+}
+
+func (GlogLogger) Infof(fields LogFields, format string, args ...interface{}) {
+	if glog.V(2) {
+		glog.InfoDepth(1, withLogFields(fields, format, args))
+	}
+}
+
+func (GlogLogger) Warnf(fields LogFields, format string, args ...interface{}) {
+	glog.WarningDepth(1, withLogFields(fields, format, args))
+}
+
+func (GlogLogger) Errorf(fields LogFields, format string, args ...interface{}) {
+	glog.ErrorDepth(1, withLogFields(fields, format, args))
+}
+
+func withLogFields(fields LogFields, format string, args []interface{}) string {
+	message := fmt.Sprintf(format, args...)
+	if len(fields) == 0 {
+		return message
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	b.WriteString(message)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, fields[key])
+	}
+	return b.String()
+}
+
+// loggerOrDefault returns the Logger of a Config, or a GlogLogger if it has none
+func loggerOrDefault(logger Logger) Logger {
+	if logger == nil {
+		return GlogLogger{}
+	}
+	return logger
+}
+
+// requestLogFields returns the fields of a log message about a resource during a request
+func requestLogFields(ctx context.Context, resourceType string, id string) LogFields {
+	fields := LogFields{"requestId": RequestID(ctx), "resourceType": resourceType}
+	if id != "" {
+		fields["id"] = id
+	}
+	return fields
+}
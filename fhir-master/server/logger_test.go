@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"sync"
+
+	. "gopkg.in/check.v1"
+)
+
+type LoggerSuite struct{}
+
+var _ = Suite(&LoggerSuite{})
+
+// capturingLogger is a Logger keeping the messages it receives
+type capturingLogger struct {
+	mutex    sync.Mutex
+	messages []capturedLogMessage
+}
+
+type capturedLogMessage struct {
+	level   string
+	fields  LogFields
+	message string
+}
+
+func (l *capturingLogger) capture(level string, fields LogFields, format string, args []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages = append(l.messages, capturedLogMessage{level, fields, fmt.Sprintf(format, args...)})
+}
+
+func (l *capturingLogger) Debugf(fields LogFields, format string, args ...interface{}) {
+	l.capture("debug", fields, format, args)
+}
+
+func (l *capturingLogger) Infof(fields LogFields, format string, args ...interface{}) {
+	l.capture("info", fields, format, args)
+}
+
+func (l *capturingLogger) Warnf(fields LogFields, format string, args ...interface{}) {
+	l.capture("warn", fields, format, args)
+}
+
+func (l *capturingLogger) Errorf(fields LogFields, format string, args ...interface{}) {
+	l.capture("error", fields, format, args)
+}
+
+// withLevel returns the messages logged at a level
+func (l *capturingLogger) withLevel(level string) []capturedLogMessage {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	var messages []capturedLogMessage
+	for _, message := range l.messages {
+		if message.level == level {
+			messages = append(messages, message)
+		}
+	}
+	return messages
+}
+
+func (s *LoggerSuite) TestGlogMessagesEndWithSortedFields(c *C) {
+	message := withLogFields(LogFields{"resourceType": "Patient", "id": "123", "versionId": 2}, "updated %s/%s", []interface{}{"Patient", "123"})
+	c.Assert(message, Equals, "updated Patient/123 id=123 resourceType=Patient versionId=2")
+
+	c.Assert(withLogFields(nil, "no fields", nil), Equals, "no fields")
+}
+
+func (s *LoggerSuite) TestDefaultLogger(c *C) {
+	c.Assert(loggerOrDefault(nil), Equals, Logger(GlogLogger{}))
+
+	logger := &capturingLogger{}
+	c.Assert(loggerOrDefault(logger), Equals, Logger(logger))
+	c.Assert(NewBatchController(nil, Config{Logger: logger}).Logger, Equals, Logger(logger))
+	c.Assert(NewBatchController(nil, Config{}).Logger, Equals, Logger(GlogLogger{}))
+}
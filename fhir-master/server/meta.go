@@ -0,0 +1,212 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// MetaHandler handles the $meta operation on a resource (e.g. GET /Patient/123/$meta),
+// returning its meta (version, tags, security labels and profiles) in a Parameters resource
+func (rc *ResourceController) MetaHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Action", "read")
+
+	_, resource, err := rc.LoadResource(c)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "MetaHandler: LoadResource failed"))
+	}
+
+	meta, err := resourceMeta(resource)
+	if err != nil {
+		panic(errors.Wrap(err, "MetaHandler: failed to read meta"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{metaParameters(meta), c})
+}
+
+// MetaAddHandler handles the $meta-add operation (e.g. POST /Patient/123/$meta-add), adding the
+// tags, security labels and profiles in the meta parameter that the resource doesn't already have
+func (rc *ResourceController) MetaAddHandler(c *gin.Context) {
+	rc.changeMeta(c, addMeta)
+}
+
+// MetaDeleteHandler handles the $meta-delete operation (e.g. POST /Patient/123/$meta-delete),
+// removing the tags, security labels and profiles in the meta parameter from the resource
+func (rc *ResourceController) MetaDeleteHandler(c *gin.Context) {
+	rc.changeMeta(c, deleteMeta)
+}
+
+// changeMeta stores a new version of a resource with its meta changed by the Parameters of the request
+// and renders the resulting meta
+func (rc *ResourceController) changeMeta(c *gin.Context, change func(meta *models.Meta, changes *models.Meta)) {
+	defer handlePanics(c)
+
+	parameters, err := FHIRBind(c, rc.Config.ValidatorURL)
+	var changes *models.Meta
+	if err == nil {
+		changes, err = metaParameter(parameters)
+	}
+	if err != nil {
+		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	resourceId := c.Param("id")
+	updated, err := session.Patch(resourceId, rc.Name, "", func(resource *models2.Resource) (*models2.Resource, error) {
+		return withChangedMeta(resource, func(meta *models.Meta) { change(meta, changes) })
+	})
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "changeMeta: Patch failed"))
+	}
+
+	c.Set(rc.Name, updated)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "update")
+
+	err = setHeaders(c, rc, false, updated, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "changeMeta: setHeaders failed"))
+	}
+	meta, err := resourceMeta(updated)
+	if err != nil {
+		panic(errors.Wrap(err, "changeMeta: failed to read meta"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{metaParameters(meta), c})
+}
+
+// metaParameter returns the meta parameter of the Parameters of a $meta-add or $meta-delete request
+func metaParameter(parameters *models2.Resource) (*models.Meta, error) {
+	if parameters.ResourceType() != "Parameters" {
+		return nil, errors.Errorf("Expected a Parameters resource but got %s", parameters.ResourceType())
+	}
+	var params struct {
+		Parameter []struct {
+			Name      string       `json:"name"`
+			ValueMeta *models.Meta `json:"valueMeta"`
+		} `json:"parameter"`
+	}
+	err := json.Unmarshal(parameters.JsonBytes(), &params)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse Parameters")
+	}
+
+	for _, param := range params.Parameter {
+		if param.Name == "meta" && param.ValueMeta != nil {
+			return param.ValueMeta, nil
+		}
+	}
+	return nil, errors.New("Parameters must have a meta parameter with a valueMeta")
+}
+
+// metaParameters returns the Parameters resource responding to a $meta operation
+func metaParameters(meta *models.Meta) *models.Parameters {
+	return &models.Parameters{
+		Parameter: []models.ParametersParameterComponent{{Name: "return", ValueMeta: meta}},
+	}
+}
+
+// resourceMeta returns the meta of a resource, which is empty if it has none
+func resourceMeta(resource *models2.Resource) (*models.Meta, error) {
+	var withMeta struct {
+		Meta models.Meta `json:"meta"`
+	}
+	err := json.Unmarshal(resource.JsonBytes(), &withMeta)
+	return &withMeta.Meta, err
+}
+
+// withChangedMeta returns a copy of a resource with its meta changed, leaving the rest of its JSON as it was
+func withChangedMeta(resource *models2.Resource, change func(meta *models.Meta)) (*models2.Resource, error) {
+	meta, err := resourceMeta(resource)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read meta")
+	}
+	change(meta)
+
+	var doc map[string]interface{}
+	if err := unmarshalJsonWithNumbers(resource.JsonBytes(), &doc); err != nil {
+		return nil, err
+	}
+	doc["meta"] = meta
+	changedJson, err := json.Marshal(doc)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal resource")
+	}
+	return models2.NewResourceFromJsonBytes(changedJson)
+}
+
+// addMeta adds the tags, security labels and profiles of changes that meta doesn't already have.
+// Codings are the same if they have the same system and code.
+func addMeta(meta *models.Meta, changes *models.Meta) {
+	for _, tag := range changes.Tag {
+		if !hasCoding(meta.Tag, tag) {
+			meta.Tag = append(meta.Tag, tag)
+		}
+	}
+	for _, label := range changes.Security {
+		if !hasCoding(meta.Security, label) {
+			meta.Security = append(meta.Security, label)
+		}
+	}
+	for _, profile := range changes.Profile {
+		if !stringSliceContains(meta.Profile, profile) {
+			meta.Profile = append(meta.Profile, profile)
+		}
+	}
+}
+
+// deleteMeta removes the tags, security labels and profiles of changes from meta
+func deleteMeta(meta *models.Meta, changes *models.Meta) {
+	withoutCodings := func(codings []models.Coding, removed []models.Coding) []models.Coding {
+		var kept []models.Coding
+		for _, coding := range codings {
+			if !hasCoding(removed, coding) {
+				kept = append(kept, coding)
+			}
+		}
+		return kept
+	}
+	meta.Tag = withoutCodings(meta.Tag, changes.Tag)
+	meta.Security = withoutCodings(meta.Security, changes.Security)
+
+	var profiles []string
+	for _, profile := range meta.Profile {
+		if !stringSliceContains(changes.Profile, profile) {
+			profiles = append(profiles, profile)
+		}
+	}
+	meta.Profile = profiles
+}
+
+func hasCoding(codings []models.Coding, coding models.Coding) bool {
+	for _, c := range codings {
+		if c.System == coding.System && c.Code == coding.Code {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+)
+
+type MetaSuite struct {
+}
+
+var _ = Suite(&MetaSuite{})
+
+func (s *MetaSuite) TestAddAndDeleteMeta(c *C) {
+	restricted := models.Coding{System: "http://terminology.hl7.org/CodeSystem/v3-Confidentiality", Code: "R"}
+	normal := models.Coding{System: "http://terminology.hl7.org/CodeSystem/v3-Confidentiality", Code: "N"}
+	tag := models.Coding{System: "http://example.com/tags", Code: "reviewed"}
+	meta := &models.Meta{Security: []models.Coding{normal}, Profile: []string{"http://example.com/a"}}
+
+	addMeta(meta, &models.Meta{
+		Security: []models.Coding{restricted, normal},
+		Tag:      []models.Coding{tag},
+		Profile:  []string{"http://example.com/a", "http://example.com/b"},
+	})
+	c.Assert(meta.Security, DeepEquals, []models.Coding{normal, restricted})
+	c.Assert(meta.Tag, DeepEquals, []models.Coding{tag})
+	c.Assert(meta.Profile, DeepEquals, []string{"http://example.com/a", "http://example.com/b"})
+
+	// codings are matched by system and code only
+	deleteMeta(meta, &models.Meta{
+		Security: []models.Coding{{System: normal.System, Code: normal.Code, Display: "normal"}},
+		Profile:  []string{"http://example.com/a"},
+	})
+	c.Assert(meta.Security, DeepEquals, []models.Coding{restricted})
+	c.Assert(meta.Tag, DeepEquals, []models.Coding{tag})
+	c.Assert(meta.Profile, DeepEquals, []string{"http://example.com/b"})
+}
+
+func (s *MetaSuite) TestWithChangedMeta(c *C) {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType":"Observation","id":"o1","meta":{"versionId":"3"},"valueQuantity":{"value":1.50}}`))
+	c.Assert(err, IsNil)
+
+	changed, err := withChangedMeta(resource, func(meta *models.Meta) {
+		meta.Tag = append(meta.Tag, models.Coding{System: "http://example.com/tags", Code: "reviewed"})
+	})
+	c.Assert(err, IsNil)
+	c.Assert(string(changed.JsonBytes()), Equals, `{"id":"o1","meta":{"versionId":"3","tag":[{"system":"http://example.com/tags","code":"reviewed"}]},"resourceType":"Observation","valueQuantity":{"value":1.50}}`)
+
+	meta, err := resourceMeta(changed)
+	c.Assert(err, IsNil)
+	c.Assert(meta.VersionId, Equals, "3")
+	c.Assert(meta.Tag, HasLen, 1)
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsRecorder receives the outcome of each data access operation (Get, Post, Put, Delete and Search)
+// so that deployments can monitor their rate, latency and errors (set with Config.MetricsRecorder).
+// err is the error returned by the operation, if any, including ErrNotFound and the like.
+type MetricsRecorder interface {
+	RecordOperation(operation string, resourceType string, duration time.Duration, err error)
+}
+
+// recordOperation passes the outcome of an operation started at start to the MetricsRecorder, if any,
+// for use in a defer statement with the operation's named error result
+func (dal *mongoDataAccessLayer) recordOperation(operation string, resourceType string, start time.Time, err *error) {
+	if dal.metrics != nil {
+		dal.metrics.RecordOperation(operation, resourceType, time.Since(start), *err)
+	}
+}
+
+// metricsDurationBuckets are the upper bounds in seconds of the buckets of the operation duration histogram
+var metricsDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics is a MetricsRecorder keeping counters and a duration histogram of the operations by
+// operation and resource type, which it serves in the Prometheus text format (at /metrics with -enableMetrics).
+// ErrNotFound and ErrDeleted aren't counted as errors as they're the outcome of reads of missing resources.
+type PrometheusMetrics struct {
+	mutex      sync.Mutex
+	operations map[operationLabels]*operationMetrics
+}
+
+type operationLabels struct {
+	operation    string
+	resourceType string
+}
+
+type operationMetrics struct {
+	count           uint64
+	errors          uint64
+	durationSum     float64
+	durationBuckets []uint64 // counts of the durations within each of metricsDurationBuckets
+}
+
+// NewPrometheusMetrics returns a PrometheusMetrics without any operations recorded
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{operations: make(map[operationLabels]*operationMetrics)}
+}
+
+func (m *PrometheusMetrics) RecordOperation(operation string, resourceType string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labels := operationLabels{operation, resourceType}
+	metrics := m.operations[labels]
+	if metrics == nil {
+		metrics = &operationMetrics{durationBuckets: make([]uint64, len(metricsDurationBuckets))}
+		m.operations[labels] = metrics
+	}
+	metrics.count++
+	if err != nil && err != ErrNotFound && err != ErrDeleted {
+		metrics.errors++
+	}
+	seconds := duration.Seconds()
+	metrics.durationSum += seconds
+	for i, bucket := range metricsDurationBuckets {
+		if seconds <= bucket {
+			metrics.durationBuckets[i]++
+		}
+	}
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(m.String()))
+}
+
+func (m *PrometheusMetrics) String() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	labelsList := make([]operationLabels, 0, len(m.operations))
+	for labels := range m.operations {
+		labelsList = append(labelsList, labels)
+	}
+	sort.Slice(labelsList, func(i, j int) bool {
+		if labelsList[i].operation != labelsList[j].operation {
+			return labelsList[i].operation < labelsList[j].operation
+		}
+		return labelsList[i].resourceType < labelsList[j].resourceType
+	})
+
+	var b strings.Builder
+	b.WriteString("# HELP fhir_dal_operations_total Data access operations by operation and resource type.\n")
+	b.WriteString("# TYPE fhir_dal_operations_total counter\n")
+	for _, labels := range labelsList {
+		fmt.Fprintf(&b, "fhir_dal_operations_total{%s} %d\n", labels, m.operations[labels].count)
+	}
+	b.WriteString("# HELP fhir_dal_operation_errors_total Data access operations that failed by operation and resource type.\n")
+	b.WriteString("# TYPE fhir_dal_operation_errors_total counter\n")
+	for _, labels := range labelsList {
+		fmt.Fprintf(&b, "fhir_dal_operation_errors_total{%s} %d\n", labels, m.operations[labels].errors)
+	}
+	b.WriteString("# HELP fhir_dal_operation_duration_seconds Duration of data access operations by operation and resource type.\n")
+	b.WriteString("# TYPE fhir_dal_operation_duration_seconds histogram\n")
+	for _, labels := range labelsList {
+		metrics := m.operations[labels]
+		for i, bucket := range metricsDurationBuckets {
+			fmt.Fprintf(&b, "fhir_dal_operation_duration_seconds_bucket{%s,le=\"%g\"} %d\n", labels, bucket, metrics.durationBuckets[i])
+		}
+		fmt.Fprintf(&b, "fhir_dal_operation_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, metrics.count)
+		fmt.Fprintf(&b, "fhir_dal_operation_duration_seconds_sum{%s} %g\n", labels, metrics.durationSum)
+		fmt.Fprintf(&b, "fhir_dal_operation_duration_seconds_count{%s} %d\n", labels, metrics.count)
+	}
+	return b.String()
+}
+
+func (l operationLabels) String() string {
+	return fmt.Sprintf("operation=%q,resource_type=%q", l.operation, l.resourceType)
+}
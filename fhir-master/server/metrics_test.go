@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	. "gopkg.in/check.v1"
+)
+
+type MetricsSuite struct{}
+
+var _ = Suite(&MetricsSuite{})
+
+// inMemoryMetrics is a MetricsRecorder keeping the operations it receives
+type inMemoryMetrics struct {
+	mutex      sync.Mutex
+	operations []recordedOperation
+}
+
+type recordedOperation struct {
+	operation    string
+	resourceType string
+	err          error
+}
+
+func (m *inMemoryMetrics) RecordOperation(operation string, resourceType string, duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.operations = append(m.operations, recordedOperation{operation, resourceType, err})
+}
+
+// count returns the number of operations recorded with an operation and resource type
+func (m *inMemoryMetrics) count(operation string, resourceType string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	count := 0
+	for _, recorded := range m.operations {
+		if recorded.operation == operation && recorded.resourceType == resourceType {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *MetricsSuite) TestPrometheusMetrics(c *C) {
+	metrics := NewPrometheusMetrics()
+	metrics.RecordOperation("Get", "Patient", 20*time.Millisecond, nil)
+	metrics.RecordOperation("Get", "Patient", 3*time.Second, ErrNotFound)
+	metrics.RecordOperation("Search", "Condition", time.Millisecond, errors.New("search failed"))
+
+	res := httptest.NewRecorder()
+	metrics.ServeHTTP(res, httptest.NewRequest("GET", "/metrics", nil))
+	c.Assert(res.Header().Get("Content-Type"), Equals, "text/plain; version=0.0.4; charset=utf-8")
+	lines := strings.Split(res.Body.String(), "\n")
+
+	c.Assert(lines, HasLen, 39)
+	c.Assert(lines[:6], DeepEquals, []string{
+		"# HELP fhir_dal_operations_total Data access operations by operation and resource type.",
+		"# TYPE fhir_dal_operations_total counter",
+		`fhir_dal_operations_total{operation="Get",resource_type="Patient"} 2`,
+		`fhir_dal_operations_total{operation="Search",resource_type="Condition"} 1`,
+		"# HELP fhir_dal_operation_errors_total Data access operations that failed by operation and resource type.",
+		"# TYPE fhir_dal_operation_errors_total counter",
+	})
+	// reads of missing resources aren't errors
+	c.Assert(lines[6], Equals, `fhir_dal_operation_errors_total{operation="Get",resource_type="Patient"} 0`)
+	c.Assert(lines[7], Equals, `fhir_dal_operation_errors_total{operation="Search",resource_type="Condition"} 1`)
+
+	// the buckets are cumulative
+	c.Assert(lines[10], Equals, `fhir_dal_operation_duration_seconds_bucket{operation="Get",resource_type="Patient",le="0.005"} 0`)
+	c.Assert(lines[12], Equals, `fhir_dal_operation_duration_seconds_bucket{operation="Get",resource_type="Patient",le="0.025"} 1`)
+	c.Assert(lines[19], Equals, `fhir_dal_operation_duration_seconds_bucket{operation="Get",resource_type="Patient",le="5"} 2`)
+	c.Assert(lines[21], Equals, `fhir_dal_operation_duration_seconds_bucket{operation="Get",resource_type="Patient",le="+Inf"} 2`)
+	c.Assert(lines[22], Equals, `fhir_dal_operation_duration_seconds_sum{operation="Get",resource_type="Patient"} 3.02`)
+	c.Assert(lines[23], Equals, `fhir_dal_operation_duration_seconds_count{operation="Get",resource_type="Patient"} 2`)
+	c.Assert(lines[24], Equals, `fhir_dal_operation_duration_seconds_bucket{operation="Search",resource_type="Condition",le="0.005"} 1`)
+}
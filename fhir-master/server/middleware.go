@@ -1,10 +1,18 @@
 package server
 
 import (
+	"context"
+	"fmt"
+	"mime"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"github.com/eug48/fhir/models"
 )
 
 func EnableXmlToJsonConversionMiddleware() gin.HandlerFunc {
@@ -30,6 +38,18 @@ func AbortNonJSONRequestsMiddleware(c *gin.Context) {
 // AbortNonFhirXMLorJSONRequestsMiddleware is middleware that responds to any request that Accepts a Content-Type
 // other than FHIR JSON or XML with a 406 Not Acceptable status.
 func AbortNonFhirXMLorJSONRequestsMiddleware(c *gin.Context) {
+	abortNonFhirXMLorJSONRequests(c, "json")
+}
+
+// AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware is like AbortNonFhirXMLorJSONRequestsMiddleware but responds
+// in defaultFormat ("json" or "xml") when neither the Accept header nor _format ask for a particular format.
+func AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware(defaultFormat string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		abortNonFhirXMLorJSONRequests(c, defaultFormat)
+	}
+}
+
+func abortNonFhirXMLorJSONRequests(c *gin.Context, defaultFormat string) {
 	acceptHeader := c.Request.Header.Get("Accept")
 	formatOption := c.DefaultQuery("_format", "")
 	hasJSON := hasJsonMimeType(acceptHeader, formatOption)
@@ -39,14 +59,145 @@ func AbortNonFhirXMLorJSONRequestsMiddleware(c *gin.Context) {
 	}
 	if hasXML > hasJSON { // integer comparison so that _format overrides an Accept header
 		c.Set("SendXML", true)
+	} else if hasXML == 0 && hasJSON == 0 && defaultFormat == "xml" {
+		c.Set("SendXML", true)
 	}
 	c.Next()
 }
 
+// InvalidFormatParamMiddleware handles requests with a _format that isn't a known JSON or XML format.
+// With "strict" handling they are rejected with a 400 Bad Request, while with "lenient" handling
+// the _format parameter is dropped so that the response is in the format requested by the Accept
+// header or otherwise the default format.
+func InvalidFormatParamMiddleware(handling string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		formats, present := c.Request.URL.Query()["_format"]
+		if !present {
+			c.Next()
+			return
+		}
+		for _, format := range formats {
+			if hasJsonMimeType("", format) > 0 || hasXmlMimeType("", format) > 0 {
+				continue
+			}
+			if handling == "strict" {
+				outcome := models.NewOperationOutcome("error", "invalid", fmt.Sprintf("Parameter \"_format\" content is invalid (%s)", format))
+				c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+				c.Abort()
+				return
+			}
+			c.Request.URL.RawQuery = removeQueryParam(c.Request.URL.RawQuery, "_format")
+			break
+		}
+		c.Next()
+	}
+}
+
+// RequestIDHeader identifies a request for tracing it through the logs
+const RequestIDHeader = "X-Request-Id"
+
+// requestIDRegex matches the client-supplied request IDs that are used rather than replaced,
+// which mustn't be able to garble the logs
+var requestIDRegex = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,200}$`)
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware gives each request an ID: the X-Request-Id header of the request if there's one,
+// otherwise a new UUID. The ID is echoed in the X-Request-Id header of the response, set as "RequestID"
+// and stored in the request's context for logging (see RequestID).
+func RequestIDMiddleware(c *gin.Context) {
+	id := c.GetHeader(RequestIDHeader)
+	if !requestIDRegex.MatchString(id) {
+		id = uuid.New().String()
+		// kept for requests handled again (e.g. with a Db from the /db/:db route)
+		c.Request.Header.Set(RequestIDHeader, id)
+	}
+	c.Header(RequestIDHeader, id)
+	c.Set("RequestID", id)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+	c.Next()
+}
+
+// RequestID returns the ID given by RequestIDMiddleware to the request a context belongs to, or "-" if none
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return "-"
+	}
+	if id, ok := ctx.Value(requestIDKey{}).(string); ok {
+		return id
+	}
+	return "-"
+}
+
+// FhirVersion is the version of FHIR that resources are stored and returned in
+const FhirVersion = "3.0.1"
+
+// FhirVersionMiddleware handles requests whose Accept header asks for a particular FHIR version
+// using the fhirVersion parameter (e.g. application/fhir+json; fhirVersion=3.0). Requests for this
+// server's version are passed through, while requests for other versions are rejected with a
+// 406 Not Acceptable unless enableConversion is set, in which case the requested version is
+// stored in the context as "FhirVersion" for a conversion layer to act on.
+func FhirVersionMiddleware(enableConversion bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requested := requestedFhirVersions(c.Request.Header.Get("Accept"))
+		if len(requested) == 0 {
+			c.Next()
+			return
+		}
+		for _, version := range requested {
+			if fhirVersionMatches(version) {
+				c.Next()
+				return
+			}
+		}
+		if enableConversion {
+			c.Set("FhirVersion", requested[0])
+			c.Next()
+			return
+		}
+		outcome := models.NewOperationOutcome("error", "not-supported", fmt.Sprintf("FHIR version %s is not available (only %s is supported)", strings.Join(requested, ", "), FhirVersion))
+		c.Render(http.StatusNotAcceptable, CustomFhirRenderer{outcome, c})
+		c.Abort()
+	}
+}
+
+// requestedFhirVersions returns the fhirVersion parameters of the media ranges in an Accept header
+func requestedFhirVersions(acceptHeader string) []string {
+	var versions []string
+	for _, mediaRange := range strings.Split(acceptHeader, ",") {
+		_, params, err := mime.ParseMediaType(mediaRange)
+		if err != nil {
+			continue
+		}
+		if version := params["fhirversion"]; version != "" { // parameter names are lower-cased
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// fhirVersionMatches returns true if a requested version (e.g. 3.0 or 3.0.1) is this server's version
+func fhirVersionMatches(version string) bool {
+	return version == FhirVersion || strings.HasPrefix(FhirVersion, version+".")
+}
+
+// removeQueryParam removes all values of a parameter from a raw query, leaving the rest untouched
+func removeQueryParam(rawQuery string, name string) string {
+	var kept []string
+	for _, param := range strings.Split(rawQuery, "&") {
+		key := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	return strings.Join(kept, "&")
+}
+
 func hasJsonMimeType(acceptHeader string, formatOption string) int {
 	// _format overrides the Accept header according to the spec
 	switch formatOption {
-	case "json", "text/json", "application/json", "application/fhir+json":
+	case "json", "text/json", "application/json", "application/fhir+json", "application/json+fhir":
 		return 2
 	}
 	if strings.Contains(acceptHeader, "application/fhir+json") || strings.Contains(acceptHeader, "application/json+fhir") {
@@ -58,7 +209,7 @@ func hasJsonMimeType(acceptHeader string, formatOption string) int {
 func hasXmlMimeType(acceptHeader string, formatOption string) int {
 	// _format overrides the Accept header according to the spec
 	switch formatOption {
-	case "xml", "text/xml", "application/xml", "application/fhir+xml":
+	case "xml", "text/xml", "application/xml", "application/fhir+xml", "application/xml+fhir":
 		return 2
 	}
 	if strings.Contains(acceptHeader, "application/fhir+xml") || strings.Contains(acceptHeader, "application/xml+fhir") {
@@ -73,6 +73,16 @@ func (m *MiddlewareTestSuite) TearDownSuite() {
 	}
 }
 
+// serve sends a request to a new engine using the middleware, with the routes added by routes
+func (m *MiddlewareTestSuite) serve(req *http.Request, routes func(e *gin.Engine), middleware ...gin.HandlerFunc) *httptest.ResponseRecorder {
+	e := gin.New()
+	e.Use(middleware...)
+	routes(e)
+	rw := httptest.NewRecorder()
+	e.ServeHTTP(rw, req)
+	return rw
+}
+
 func (m *MiddlewareTestSuite) TestRejectXML() {
 	e := gin.New()
 	e.Use(AbortNonJSONRequestsMiddleware)
@@ -99,3 +109,189 @@ func (m *MiddlewareTestSuite) TestReadOnlyMode() {
 	resp, err := http.DefaultClient.Do(req)
 	m.Equal(http.StatusMethodNotAllowed, resp.StatusCode)
 }
+
+func (m *MiddlewareTestSuite) TestTrailingSlashAndResourceTypeCase() {
+	// redirects aren't followed so that only paths handled directly succeed
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	get := func(server *httptest.Server, path string) int {
+		resp, err := client.Get(server.URL + path)
+		m.NoError(err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	e := gin.New()
+	RegisterRoutes(e, nil, NewMongoDataAccessLayer(m.client, m.dbname, true, "", nil, DefaultConfig), DefaultConfig)
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	m.Equal(http.StatusOK, get(server, "/Patient"))
+	m.Equal(http.StatusOK, get(server, "/Patient/"))
+	m.Equal(http.StatusOK, get(server, "/metadata/"))
+	m.Equal(http.StatusNotFound, get(server, "/patient"))
+	m.Equal(http.StatusNotFound, get(server, "/NotAResource/"))
+
+	config := DefaultConfig
+	config.CaseInsensitiveResourceTypes = true
+	e = gin.New()
+	RegisterRoutes(e, nil, NewMongoDataAccessLayer(m.client, m.dbname, true, "", nil, config), config)
+	ciServer := httptest.NewServer(e)
+	defer ciServer.Close()
+
+	m.Equal(http.StatusOK, get(ciServer, "/Patient"))
+	m.Equal(http.StatusOK, get(ciServer, "/Patient/"))
+	m.Equal(http.StatusOK, get(ciServer, "/patient"))
+	m.Equal(http.StatusOK, get(ciServer, "/PATIENT/"))
+	m.Equal(http.StatusNotFound, get(ciServer, "/notaresource"))
+}
+
+func (m *MiddlewareTestSuite) getMetadataWithDefaultFormat(defaultFormat string, url string, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", url, nil)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	rw := m.serve(req, func(e *gin.Engine) {
+		e.GET("/metadata", CapabilityStatementHandler(DefaultConfig))
+	}, EnableXmlToJsonConversionMiddleware(), AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware(defaultFormat))
+	m.Require().Equal(http.StatusOK, rw.Code)
+	return rw
+}
+
+func (m *MiddlewareTestSuite) TestDefaultFormatWithoutAcceptHeader() {
+	rw := m.getMetadataWithDefaultFormat("xml", "/metadata", "")
+	m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+
+	rw = m.getMetadataWithDefaultFormat("json", "/metadata", "")
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+}
+
+func (m *MiddlewareTestSuite) TestDefaultFormatAcceptingAnything() {
+	rw := m.getMetadataWithDefaultFormat("xml", "/metadata", "*/*")
+	m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+}
+
+func (m *MiddlewareTestSuite) TestRequestedFormatOverridesDefault() {
+	rw := m.getMetadataWithDefaultFormat("xml", "/metadata", "application/fhir+json")
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+
+	rw = m.getMetadataWithDefaultFormat("xml", "/metadata?_format=json", "")
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+
+	rw = m.getMetadataWithDefaultFormat("json", "/metadata", "application/fhir+xml")
+	m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+}
+
+func (m *MiddlewareTestSuite) getWithFormatParamHandling(handling string, url string) *httptest.ResponseRecorder {
+	return m.serve(httptest.NewRequest("GET", url, nil), func(e *gin.Engine) {
+		e.GET("/metadata", CapabilityStatementHandler(DefaultConfig))
+		e.GET("/query", func(c *gin.Context) {
+			c.String(http.StatusOK, c.Request.URL.RawQuery)
+		})
+	}, InvalidFormatParamMiddleware(handling), EnableXmlToJsonConversionMiddleware(), AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware("json"))
+}
+
+func (m *MiddlewareTestSuite) TestValidFormat() {
+	for _, handling := range []string{"lenient", "strict"} {
+		rw := m.getWithFormatParamHandling(handling, "/metadata?_format=xml")
+		m.Equal(http.StatusOK, rw.Code)
+		m.Regexp("^application/fhir\\+xml", rw.Header().Get("Content-Type"))
+
+		rw = m.getWithFormatParamHandling(handling, "/metadata?_format=application/json%2Bfhir")
+		m.Equal(http.StatusOK, rw.Code)
+		m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+	}
+}
+
+func (m *MiddlewareTestSuite) TestInvalidFormatStrict() {
+	rw := m.getWithFormatParamHandling("strict", "/metadata?_format=bogus")
+	m.Equal(http.StatusBadRequest, rw.Code)
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+	m.Regexp(`(?s)"resourceType":"OperationOutcome".*Parameter \\"_format\\" content is invalid \(bogus\)`, rw.Body.String())
+}
+
+func (m *MiddlewareTestSuite) TestInvalidFormatLenient() {
+	rw := m.getWithFormatParamHandling("lenient", "/metadata?_format=bogus")
+	m.Equal(http.StatusOK, rw.Code)
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+
+	// the parameter is dropped so that handlers (e.g. searches) don't see it
+	rw = m.getWithFormatParamHandling("lenient", "/query?name=a%26b&_format=bogus&_count=2")
+	m.Equal(http.StatusOK, rw.Code)
+	m.Equal("name=a%26b&_count=2", rw.Body.String())
+}
+
+func (m *MiddlewareTestSuite) getWithFhirVersion(enableConversion bool, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/version", nil)
+	req.Header.Set("Accept", accept)
+	return m.serve(req, func(e *gin.Engine) {
+		e.GET("/version", func(c *gin.Context) {
+			c.String(http.StatusOK, c.GetString("FhirVersion"))
+		})
+	}, EnableXmlToJsonConversionMiddleware(), AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware("json"), FhirVersionMiddleware(enableConversion))
+}
+
+func (m *MiddlewareTestSuite) TestMatchingVersion() {
+	for _, accept := range []string{
+		"application/fhir+json",
+		"application/fhir+json; fhirVersion=3.0",
+		"application/fhir+xml;fhirVersion=3.0.1",
+		"application/fhir+json; fhirVersion=4.0, application/fhir+json; fhirVersion=3.0",
+	} {
+		rw := m.getWithFhirVersion(false, accept)
+		m.Equal(http.StatusOK, rw.Code, "Accept: %s", accept)
+		m.Equal("", rw.Body.String())
+	}
+}
+
+func (m *MiddlewareTestSuite) TestMismatchingVersion() {
+	rw := m.getWithFhirVersion(false, "application/fhir+json; fhirVersion=4.0")
+	m.Equal(http.StatusNotAcceptable, rw.Code)
+	m.Regexp("^application/fhir\\+json", rw.Header().Get("Content-Type"))
+	m.Regexp(`(?s)"resourceType":"OperationOutcome".*FHIR version 4.0 is not available \(only 3.0.1 is supported\)`, rw.Body.String())
+
+	// a different patch release is a different version
+	rw = m.getWithFhirVersion(false, "application/fhir+json; fhirVersion=3.0.2")
+	m.Equal(http.StatusNotAcceptable, rw.Code)
+}
+
+func (m *MiddlewareTestSuite) TestMismatchingVersionWithConversion() {
+	rw := m.getWithFhirVersion(true, "application/fhir+json; fhirVersion=4.0")
+	m.Equal(http.StatusOK, rw.Code)
+	m.Equal("4.0", rw.Body.String())
+}
+
+func (m *MiddlewareTestSuite) getWithRequestID(requestID string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/id", nil)
+	if requestID != "" {
+		req.Header.Set("X-Request-Id", requestID)
+	}
+	return m.serve(req, func(e *gin.Engine) {
+		e.GET("/id", func(c *gin.Context) {
+			c.String(http.StatusOK, RequestID(c.Request.Context()))
+		})
+	}, RequestIDMiddleware)
+}
+
+func (m *MiddlewareTestSuite) TestSuppliedRequestID() {
+	rw := m.getWithRequestID("abc-123")
+	m.Equal(http.StatusOK, rw.Code)
+	m.Equal("abc-123", rw.Header().Get("X-Request-Id"))
+	m.Equal("abc-123", rw.Body.String())
+}
+
+func (m *MiddlewareTestSuite) TestGeneratedRequestID() {
+	rw := m.getWithRequestID("")
+	id := rw.Header().Get("X-Request-Id")
+	m.Regexp("^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$", id)
+	m.Equal(id, rw.Body.String())
+
+	// each request gets its own ID
+	m.NotEqual(id, m.getWithRequestID("").Header().Get("X-Request-Id"))
+
+	// as do requests with IDs that could garble the logs
+	rw = m.getWithRequestID("abc\tdef")
+	m.NotEqual("abc\tdef", rw.Header().Get("X-Request-Id"))
+	m.Regexp("^[0-9a-f-]{36}$", rw.Header().Get("X-Request-Id"))
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"container/heap"
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/url"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -20,6 +24,7 @@ import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 
@@ -30,6 +35,7 @@ type mongoDataAccessLayer struct {
 	client                       *mongowrapper.WrappedClient
 	defaultDbName                string
 	enableMultiDB                bool
+	requireExistingDb            bool
 	dbSuffix                     string
 	Interceptors                 map[string]InterceptorList
 	countTotalResults            bool
@@ -37,17 +43,54 @@ type mongoDataAccessLayer struct {
 	tokenParametersCaseSensitive bool
 	enableHistory                bool
 	readonly                     bool
+	cursorPaging                 bool
+	allowResourcesWithoutMeta    bool
+	rejectResourcesWithoutMeta   bool
+	defaultMetaProfiles          map[string][]string
+	indexedFields                map[string][]string // only set to require indexed searches
+	readFromSecondaries          bool
+	caseSensitiveParameters      map[string]bool
+	missingValuesSortOrder       string
+	allowClientAssignedStringIds bool
+	maxResourceDepth             int
+	maxSearchParameters          int
+	maxSearchValuesPerParameter  int
+	maxResultCount               int
+	countCacheTTL                time.Duration
+	logger                       Logger
+	metrics                      MetricsRecorder
 }
 
 type mongoSession struct {
-	session       mongo.Session
-	context       mongo.SessionContext
-	db            *mongowrapper.WrappedDatabase
-	dal           *mongoDataAccessLayer
-	inTransaction bool
+	session          mongo.Session
+	context          mongo.SessionContext
+	db               *mongowrapper.WrappedDatabase
+	dal              *mongoDataAccessLayer
+	inTransaction    bool
+	staleCountCaches []string // resource types written in the transaction, whose cached counts are invalidated once it's committed
 }
 
 func (dal *mongoDataAccessLayer) StartSession(ctx context.Context, customDbName string) DataAccessSession {
+	var dbName string
+	if dal.enableMultiDB && customDbName != "" {
+		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
+			panic(errors.Errorf("database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
+		}
+		if dal.requireExistingDb && customDbName != dal.defaultDbName {
+			// rather than letting the first write create it
+			names, err := dal.client.ListDatabaseNames(ctx, bson.D{{"name", customDbName}})
+			if err != nil {
+				panic(errors.Wrap(err, "StartSession: ListDatabaseNames failed"))
+			}
+			if len(names) == 0 {
+				panic(ErrDatabaseNotFound{name: customDbName})
+			}
+		}
+		dbName = customDbName
+	} else {
+		dbName = dal.defaultDbName
+	}
+
 	opts := options.Session()
 	opts.SetCausalConsistency(true)
 	opts.SetDefaultReadConcern(readconcern.Majority())
@@ -58,16 +101,6 @@ func (dal *mongoDataAccessLayer) StartSession(ctx context.Context, customDbName
 		panic(errors.Wrap(err, "StartSession failed"))
 	}
 
-	var dbName string
-	if dal.enableMultiDB && customDbName != "" {
-		if dal.dbSuffix != "" && !strings.HasSuffix(customDbName, dal.dbSuffix) {
-			panic(errors.Wrapf(err, "database name (%s) doesn't end with suffix (%s)", customDbName, dal.dbSuffix))
-		}
-		dbName = customDbName
-	} else {
-		dbName = dal.defaultDbName
-	}
-
 	db := dal.client.Database(dbName)
 	if db == nil {
 		panic(errors.Wrap(err, "client.Database failed"))
@@ -98,6 +131,15 @@ func (ms *mongoSession) PreviousVersionsCollection(resourceType string) *mongowr
 	return ms.db.Collection(models.PluralizeLowerResourceName(resourceType) + "_prev")
 }
 
+// searchDB returns the database that searches read from, which prefers secondaries if ReadFromSecondaries
+// is set. Transactions have to read from the primary so they always get ms.db.
+func (ms *mongoSession) searchDB() *mongowrapper.WrappedDatabase {
+	if !ms.dal.readFromSecondaries || ms.inTransaction {
+		return ms.db
+	}
+	return ms.db.Client().Database(ms.db.Name(), options.Database().SetReadPreference(readpref.SecondaryPreferred()))
+}
+
 func (ms *mongoSession) StartTransaction() error {
 	if ms.inTransaction {
 		// sucess if already in a transaction
@@ -105,7 +147,7 @@ func (ms *mongoSession) StartTransaction() error {
 	}
 
 	err := ms.session.StartTransaction()
-	glog.V(3).Infof("StartTransaction")
+	glog.V(3).Infof("[%s] StartTransaction", RequestID(ms.context))
 	if err == nil {
 		ms.inTransaction = true
 	}
@@ -113,9 +155,16 @@ func (ms *mongoSession) StartTransaction() error {
 }
 func (ms *mongoSession) CommmitIfTransaction() error {
 	if ms.inTransaction {
-		glog.V(3).Infof("CommmitTransaction")
+		glog.V(3).Infof("[%s] CommmitTransaction", RequestID(ms.context))
 		err := ms.session.CommitTransaction(ms.context)
 		ms.inTransaction = false
+		staleCountCaches := ms.staleCountCaches
+		ms.staleCountCaches = nil
+		if err == nil {
+			for _, resourceType := range staleCountCaches {
+				ms.invalidateCountCache(resourceType)
+			}
+		}
 		return errors.Wrap(err, "mongoSession.CommmitIfTransaction")
 	} else {
 		return nil
@@ -126,8 +175,9 @@ func (ms *mongoSession) Finish() {
 	if ms.inTransaction {
 		err = ms.session.AbortTransaction(ms.context)
 		if err == nil {
-			glog.Warningf("AbortTransaction called from mongoSession.Finish")
+			glog.Warningf("[%s] AbortTransaction called from mongoSession.Finish", RequestID(ms.context))
 			ms.inTransaction = false
+			ms.staleCountCaches = nil
 		} else {
 			commandErr, ok := err.(mongo.CommandError)
 			if ok && commandErr.Name == "OperationNotSupportedInTransaction" {
@@ -150,10 +200,11 @@ func (ms *mongoSession) Finish() {
 
 // NewMongoDataAccessLayer returns an implementation of DataAccessLayer that is backed by a Mongo database
 func NewMongoDataAccessLayer(client *mongowrapper.WrappedClient, defaultDbName string, enableMultiDB bool, dbSuffix string, interceptors map[string]InterceptorList, config Config) DataAccessLayer {
-	return &mongoDataAccessLayer{
+	dal := &mongoDataAccessLayer{
 		client:                       client,
 		defaultDbName:                defaultDbName,
 		enableMultiDB:                enableMultiDB,
+		requireExistingDb:            config.RequireExistingDb,
 		dbSuffix:                     dbSuffix,
 		Interceptors:                 interceptors,
 		countTotalResults:            config.CountTotalResults,
@@ -161,7 +212,30 @@ func NewMongoDataAccessLayer(client *mongowrapper.WrappedClient, defaultDbName s
 		tokenParametersCaseSensitive: config.TokenParametersCaseSensitive,
 		enableHistory:                config.EnableHistory,
 		readonly:                     config.ReadOnly,
+		cursorPaging:                 config.EnableCursorPaging,
+		allowResourcesWithoutMeta:    config.AllowResourcesWithoutMeta,
+		rejectResourcesWithoutMeta:   config.MetaLessResources == "reject",
+		defaultMetaProfiles:          config.DefaultMetaProfiles,
+		readFromSecondaries:          config.ReadFromSecondaries,
+		caseSensitiveParameters:      config.CaseSensitiveParameters,
+		missingValuesSortOrder:       config.MissingValuesSortOrder,
+		allowClientAssignedStringIds: config.AllowClientAssignedStringIds,
+		maxResourceDepth:             config.MaxResourceDepth,
+		maxSearchParameters:          config.MaxSearchParameters,
+		maxSearchValuesPerParameter:  config.MaxSearchValuesPerParameter,
+		maxResultCount:               config.MaxResultCount,
+		countCacheTTL:                config.CountCacheTTL,
+		logger:                       loggerOrDefault(config.Logger),
+		metrics:                      config.MetricsRecorder,
+	}
+	if config.RequireIndexedSearch {
+		indexedFields, err := IndexedFields(config.IndexConfigPath)
+		if err != nil {
+			panic(errors.Wrap(err, "RequireIndexedSearch: failed to read the indexes in IndexConfigPath"))
+		}
+		dal.indexedFields = indexedFields
 	}
+	return dal
 }
 
 // InterceptorList is a list of interceptors registered for a given database operation
@@ -173,6 +247,28 @@ type InterceptorList []Interceptor
 type Interceptor struct {
 	ResourceType string
 	Handler      InterceptorHandler
+	// ResultHandler is the handler of interceptors of the "Search" operation
+	ResultHandler ResultInterceptor
+	// ValidationHandler is the handler of interceptors of the "Validate" operation
+	ValidationHandler ValidationInterceptor
+}
+
+// ResultInterceptor is run on the resources found by a search before they're returned, e.g. for access control
+// or redaction. FilterResult returns the resource to return in place of the one found, which can be a modified
+// copy of it, or nil to leave it out. The resources included with a match (by _include and _revinclude)
+// are run through it too, and aren't returned if their match is left out. ctx is that of the request.
+// Bundle.total isn't adjusted for the resources left out.
+type ResultInterceptor interface {
+	FilterResult(ctx context.Context, resource *models2.Resource) (*models2.Resource, error)
+}
+
+// ValidationInterceptor checks resources before they're created or updated (including by patches and the
+// entries of batches and transactions, which are checked before any of them is stored) and by $validate.
+// ValidateResource returns the issues it finds: those with the "error" or "fatal" severity reject the resource
+// with a 400 and an OperationOutcome of the issues, while the others are returned to the client as warnings
+// along with the outcome of the write. ctx is that of the request.
+type ValidationInterceptor interface {
+	ValidateResource(ctx context.Context, resource *models2.Resource) ([]models.OperationOutcomeIssueComponent, error)
 }
 
 // InterceptorHandler is an interface that defines three methods that are executed on a resource
@@ -217,6 +313,66 @@ func (ms *mongoSession) invokeInterceptorsOnError(op, resourceType string, err e
 	}
 }
 
+// interceptSearchResult runs the "Search" interceptors for its resource type on a resource found by a search,
+// returning the resource to return or nil if it's to be left out
+func (ms *mongoSession) interceptSearchResult(resource *models2.Resource) (*models2.Resource, error) {
+	for _, interceptor := range ms.dal.Interceptors["Search"] {
+		if interceptor.ResourceType == resource.ResourceType() || interceptor.ResourceType == "*" {
+			var err error
+			resource, err = interceptor.ResultHandler.FilterResult(ms.context, resource)
+			if err != nil {
+				return nil, errors.Wrapf(err, "search interceptor failed on %s", interceptor.ResourceType)
+			}
+			if resource == nil {
+				return nil, nil
+			}
+		}
+	}
+	return resource, nil
+}
+
+func (dal *mongoDataAccessLayer) ValidateResource(ctx context.Context, resource *models2.Resource) (warnings []models.OperationOutcomeIssueComponent, err error) {
+	var issues []models.OperationOutcomeIssueComponent
+	failed := false
+	for _, interceptor := range dal.Interceptors["Validate"] {
+		if interceptor.ResourceType == resource.ResourceType() || interceptor.ResourceType == "*" {
+			interceptorIssues, err := interceptor.ValidationHandler.ValidateResource(ctx, resource)
+			if err != nil {
+				return nil, errors.Wrapf(err, "validation interceptor failed on %s", interceptor.ResourceType)
+			}
+			for _, issue := range interceptorIssues {
+				failed = failed || issue.Severity == "error" || issue.Severity == "fatal"
+			}
+			issues = append(issues, interceptorIssues...)
+		}
+	}
+
+	if failed {
+		return nil, &ValidationError{Issues: issues}
+	}
+	logFields := requestLogFields(ctx, resource.ResourceType(), resource.Id())
+	for _, issue := range issues {
+		dal.logger.Warnf(logFields, "%s", issue.Diagnostics)
+	}
+	return issues, nil
+}
+
+// invalidateCountCache removes the cached search totals for a resource type after its resources
+// have changed. In a transaction this is done once it's committed, as until then searches outside
+// of it would cache the old totals again, and a failure mustn't abort the transaction.
+func (ms *mongoSession) invalidateCountCache(resourceType string) {
+	if ms.inTransaction {
+		if !stringSliceContains(ms.staleCountCaches, resourceType) {
+			ms.staleCountCaches = append(ms.staleCountCaches, resourceType)
+		}
+		return
+	}
+	err := search.InvalidateCountCache(ms.context, ms.db, resourceType)
+	if err != nil {
+		ms.dal.logger.Warnf(requestLogFields(ms.context, resourceType, ""), "failed to invalidate cached counts of %s: %+v", resourceType, err)
+	}
+}
+
 // hasInterceptorsForOpAndType checks if any interceptors are registered for a particular database operation AND resource type
 func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) bool {
 
@@ -232,21 +388,27 @@ func (ms *mongoSession) hasInterceptorsForOpAndType(op, resourceType string) boo
 }
 
 func (ms *mongoSession) Get(id, resourceType string) (resource *models2.Resource, err error) {
-	bsonID, err := convertIDToBsonID(id)
+	defer ms.dal.recordOperation("Get", resourceType, time.Now(), &err)
+	return ms.get(id, resourceType)
+}
+
+// get is Get without recording the operation, for the reads of other operations
+func (ms *mongoSession) get(id, resourceType string) (resource *models2.Resource, err error) {
+	docID, err := ms.dal.convertID(id)
 	if err != nil {
 		return nil, ErrNotFound
 	}
 
 	collection := ms.CurrentVersionCollection(resourceType)
-	filter := bson.D{{"_id", bsonID.Hex()}}
+	filter := bson.D{{"_id", docID}}
 	var doc bson.D
 	err = collection.FindOne(ms.context, filter).Decode(&doc)
-	glog.V(3).Infof("Get %s/%s --> %s (err %+v)", resourceType, id, doc, err)
+	glog.V(3).Infof("[%s] Get %s/%s --> %s (err %+v)", RequestID(ms.context), resourceType, id, doc, err)
 	if err == mongo.ErrNoDocuments && ms.dal.enableHistory {
 		// check whether this is a deleted record
 		prevCollection := ms.PreviousVersionsCollection(resourceType)
 		prevQuery := bson.D{
-			{"_id._id", bsonID.Hex()},
+			{"_id._id", docID},
 			{"_id._deleted", 1},
 		}
 		idOnly := bson.D{{"_id", 1}}
@@ -278,7 +440,7 @@ func (ms *mongoSession) Get(id, resourceType string) (resource *models2.Resource
 }
 
 func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resource *models2.Resource, err error) {
-	bsonID, err := convertIDToBsonID(id)
+	docID, err := ms.dal.convertID(id)
 	if err != nil {
 		return nil, ErrNotFound
 	}
@@ -290,7 +452,7 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 
 	// First assume versionId is for the current version
 	curQuery := bson.D{
-		{"_id", bsonID.Hex()},
+		{"_id", docID},
 		{"meta.versionId", versionIdStr},
 	}
 	curCollection := ms.CurrentVersionCollection(resourceType)
@@ -301,7 +463,7 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 	if err == mongo.ErrNoDocuments {
 		// try to search for previous versions
 		prevQuery := bson.D{
-			{"_id._id", bsonID.Hex()},
+			{"_id._id", docID},
 			{"_id._version", int32(versionIdInt)},
 		}
 		prevCollection := ms.PreviousVersionsCollection(resourceType)
@@ -344,6 +506,74 @@ func (ms *mongoSession) GetVersion(id, versionIdStr, resourceType string) (resou
 	return
 }
 
+func (ms *mongoSession) AdjacentVersions(id, versionId, resourceType string) (previousVersionId string, nextVersionId string, err error) {
+	docID, err := ms.dal.convertID(id)
+	if err != nil {
+		return "", "", ErrNotFound
+	}
+	versionIdInt, err := strconv.Atoi(versionId)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to convert versionId to an integer (%s)", versionId)
+	}
+
+	var versions []int
+	curCollection := ms.CurrentVersionCollection(resourceType)
+	var current struct {
+		Meta struct {
+			VersionId string `bson:"versionId"`
+		} `bson:"meta"`
+	}
+	err = curCollection.FindOne(ms.context, bson.D{{"_id", docID}}, options.FindOne().SetProjection(bson.D{{"meta.versionId", 1}})).Decode(&current)
+	switch err {
+	case nil:
+		if currentVersion, err := strconv.Atoi(current.Meta.VersionId); err == nil {
+			versions = append(versions, currentVersion)
+		}
+	case mongo.ErrNoDocuments:
+		// deleted, so all versions are in the previous versions collection
+	default:
+		return "", "", errors.Wrap(convertMongoErr(err), "AdjacentVersions: failed to find current version")
+	}
+
+	prevCollection := ms.PreviousVersionsCollection(resourceType)
+	cursor, err := prevCollection.Find(ms.context, bson.D{{"_id._id", docID}}, options.Find().SetProjection(bson.D{{"_id._version", 1}}))
+	if err != nil {
+		return "", "", errors.Wrap(convertMongoErr(err), "AdjacentVersions: failed to find previous versions")
+	}
+	defer cursor.Close(ms.context)
+	for cursor.Next(ms.context) {
+		if version, ok := cursor.Current.Lookup("_id", "_version").Int32OK(); ok {
+			versions = append(versions, int(version))
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return "", "", errors.Wrap(convertMongoErr(err), "AdjacentVersions: previous versions cursor error")
+	}
+
+	found := false
+	previous, next := 0, 0
+	for _, version := range versions {
+		switch {
+		case version == versionIdInt:
+			found = true
+		case version < versionIdInt && version > previous:
+			previous = version
+		case version > versionIdInt && (next == 0 || version < next):
+			next = version
+		}
+	}
+	if !found {
+		return "", "", ErrNotFound
+	}
+	if previous > 0 {
+		previousVersionId = strconv.Itoa(previous)
+	}
+	if next > 0 {
+		nextVersionId = strconv.Itoa(next)
+	}
+	return previousVersionId, nextVersionId, nil
+}
+
 // Convert document stored in one of the _prev collections into a resource
 func unmarshalPreviousVersion(rawDoc *bson.Raw) (deleted bool, resource *models2.Resource, err error) {
 	// glog.Debugf("[unmarshalPreviousVersion] %+v\n", rawDoc)
@@ -422,7 +652,7 @@ func (ms *mongoSession) ConditionalPost(query search.Query, resource *models2.Re
 	} else if len(existingIds) == 1 {
 		httpStatus = 200
 		id = existingIds[0]
-		outputResource, err = ms.Get(id, query.Resource)
+		outputResource, err = ms.get(id, query.Resource)
 
 	} else if len(existingIds) > 1 {
 		httpStatus = 412
@@ -431,23 +661,32 @@ func (ms *mongoSession) ConditionalPost(query search.Query, resource *models2.Re
 	return
 }
 
-func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) error {
-	bsonID, err := convertIDToBsonID(id)
+func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) (err error) {
+	defer ms.dal.recordOperation("Post", resource.ResourceType(), time.Now(), &err)
+
+	docID, err := ms.dal.convertID(id)
 	if err != nil {
 		return convertMongoErr(err)
 	}
 
-	resource.SetId(bsonID.Hex())
+	err = ms.checkResourceMeta(resource)
+	if err != nil {
+		return err
+	}
+
+	resource.SetId(docID)
+	resource.SetMaxDepth(ms.dal.maxResourceDepth)
 	updateResourceMeta(resource, 1)
 	resourceType := resource.ResourceType()
 	curCollection := ms.CurrentVersionCollection(resourceType)
 
 	ms.invokeInterceptorsBefore("Create", resourceType, resource)
 
-	glog.V(3).Infof("PostWithID: inserting %s/%s", resourceType, id)
+	glog.V(3).Infof("[%s] PostWithID: inserting %s/%s", RequestID(ms.context), resourceType, id)
 	_, err = curCollection.InsertOne(ms.context, resource)
 
 	if err == nil {
+		ms.invalidateCountCache(resourceType)
 		ms.invokeInterceptorsAfter("Create", resourceType, resource)
 	} else {
 		ms.invokeInterceptorsOnError("Create", resourceType, err, resource)
@@ -456,19 +695,93 @@ func (ms *mongoSession) PostWithID(id string, resource *models2.Resource) error
 	return convertMongoErr(err)
 }
 
+func (ms *mongoSession) BulkInsert(resourceType string, resources []*models2.Resource) (ids []string, err error) {
+	ids = make([]string, len(resources))
+	failures := make(map[int]error)
+
+	// the documents inserted and the index of the resource of each
+	documents := make([]interface{}, 0, len(resources))
+	indices := make([]int, 0, len(resources))
+	for i, resource := range resources {
+		if resource.ResourceType() != resourceType {
+			failures[i] = errors.Errorf("resource type is %s rather than %s", resource.ResourceType(), resourceType)
+			continue
+		}
+		if err := ms.checkResourceMeta(resource); err != nil {
+			failures[i] = err
+			continue
+		}
+		if _, err := ms.dal.ValidateResource(ms.context, resource); err != nil {
+			failures[i] = err
+			continue
+		}
+		resource.SetId(primitive.NewObjectID().Hex())
+		resource.SetMaxDepth(ms.dal.maxResourceDepth)
+		updateResourceMeta(resource, 1)
+		ms.invokeInterceptorsBefore("Create", resourceType, resource)
+		documents = append(documents, resource)
+		indices = append(indices, i)
+	}
+
+	if len(documents) > 0 {
+		glog.V(3).Infof("[%s] BulkInsert: inserting %d %s resources", RequestID(ms.context), len(documents), resourceType)
+		curCollection := ms.CurrentVersionCollection(resourceType)
+		_, err = curCollection.InsertMany(ms.context, documents, options.InsertMany().SetOrdered(false))
+
+		// errors writing particular documents are reported per resource
+		bulkErr, isBulkErr := err.(mongo.BulkWriteException)
+		if err != nil && (!isBulkErr || bulkErr.WriteConcernError != nil) {
+			for _, index := range indices {
+				ms.invokeInterceptorsOnError("Create", resourceType, err, resources[index])
+			}
+			return nil, convertMongoErr(err)
+		}
+		failed := make(map[int]error)
+		for _, writeErr := range bulkErr.WriteErrors {
+			failed[writeErr.Index] = writeErr
+		}
+
+		for j, index := range indices {
+			resource := resources[index]
+			if writeErr, found := failed[j]; found {
+				failures[index] = writeErr
+				ms.invokeInterceptorsOnError("Create", resourceType, writeErr, resource)
+			} else {
+				ids[index] = resource.Id()
+				ms.invokeInterceptorsAfter("Create", resourceType, resource)
+			}
+		}
+		ms.invalidateCountCache(resourceType)
+	}
+
+	if len(failures) > 0 {
+		return ids, &BulkInsertError{Failures: failures}
+	}
+	return ids, nil
+}
+
 func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *models2.Resource) (createdNew bool, err error) {
-	bsonID, err := convertIDToBsonID(id)
+	defer ms.dal.recordOperation("Put", resource.ResourceType(), time.Now(), &err)
+
+	docID, err := ms.dal.convertID(id)
 	if err != nil {
 		return false, convertMongoErr(err)
 	}
 
+	err = ms.checkResourceMeta(resource)
+	if err != nil {
+		return false, err
+	}
+
 	resourceType := resource.ResourceType()
 	curCollection := ms.CurrentVersionCollection(resourceType)
-	resource.SetId(bsonID.Hex())
+	resource.SetId(docID)
+	resource.SetMaxDepth(ms.dal.maxResourceDepth)
+	logFields := requestLogFields(ms.context, resourceType, resource.Id())
 	if conditionalVersionId != "" {
-		glog.V(3).Infof("PUT %s/%s (If-Match %s)", resourceType, resource.Id(), conditionalVersionId)
+		ms.dal.logger.Debugf(logFields, "PUT %s/%s (If-Match %s)", resourceType, resource.Id(), conditionalVersionId)
 	} else {
-		glog.V(3).Infof("PUT %s/%s", resourceType, resource.Id())
+		ms.dal.logger.Debugf(logFields, "PUT %s/%s", resourceType, resource.Id())
 	}
 
 	var curVersionId *int = nil
@@ -479,7 +792,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 		if conditionalVersionId != "" {
 			return false, errors.Errorf("If-Match specified for a conditional put, but version histories are disabled")
 		}
-		glog.V(3).Infof("  versionIds: history disabled; new %d", newVersionId)
+		ms.dal.logger.Debugf(logFields, "  versionIds: history disabled; new %d", newVersionId)
 	} else {
 
 		// get current version of this document
@@ -488,7 +801,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 		}
 		var currentDoc bson.D
 		var currentDocRaw bson.Raw
-		currentDocQuery := bson.D{{"_id", bsonID.Hex()}}
+		currentDocQuery := bson.D{{"_id", docID}}
 		if err = curCollection.FindOne(ms.context, currentDocQuery).Decode(&currentDocRaw); err != nil && err != mongo.ErrNoDocuments {
 			return false, errors.Wrap(convertMongoErr(err), "Put handler: error retrieving current version")
 		}
@@ -500,7 +813,14 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 			if conditionalVersionId != "" {
 				return false, ErrConflict{msg: "If-Match specified for a resource that doesn't exist"}
 			}
-			glog.V(3).Infof("  versionIds: no current; new %d", newVersionId)
+
+			// a deleted resource is brought back as its next version, continuing its history
+			latestVersionId, err := ms.latestPreviousVersionId(resourceType, docID)
+			if err != nil {
+				return false, errors.Wrap(err, "Put handler: error retrieving previous versions")
+			}
+			newVersionId = latestVersionId + 1
+			ms.dal.logger.Debugf(logFields, "  versionIds: no current; new %d", newVersionId)
 		} else {
 			// unmarshal fully
 			err = bson.Unmarshal(currentDocRaw, &currentDoc)
@@ -517,7 +837,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 				curVersionIdTemp = 0
 			}
 			curVersionId = &curVersionIdTemp
-			glog.V(3).Infof("  versionIds: current %d; new %d", *curVersionId, newVersionId)
+			ms.dal.logger.Debugf(logFields, "  versionIds: current %d; new %d", *curVersionId, newVersionId)
 
 			if conditionalVersionId != "" && conditionalVersionId != curVersionIdStr {
 				return false, ErrConflict{msg: "If-Match doesn't match current versionId"}
@@ -551,7 +871,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	updateResourceMeta(resource, newVersionId)
 
 	if ms.hasInterceptorsForOpAndType("Update", resourceType) {
-		oldResource, getError := ms.Get(id, resourceType)
+		oldResource, getError := ms.get(id, resourceType)
 		if getError == nil {
 			ms.invokeInterceptorsBefore("Update", resourceType, oldResource)
 		}
@@ -560,7 +880,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	var updated int64
 	if curVersionId == nil {
 		var info *mongo.UpdateResult
-		selector := bson.D{{"_id", bsonID.Hex()}}
+		selector := bson.D{{"_id", docID}}
 		if glog.V(5) {
 			start = time.Now()
 		}
@@ -580,7 +900,7 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	} else {
 		// atomic check-then-update
 		selector := bson.D{
-			{"_id", bsonID.Hex()},
+			{"_id", docID},
 			{"meta.versionId", strconv.Itoa(*curVersionId)},
 		}
 		if *curVersionId == 0 {
@@ -602,13 +922,14 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 		}
 		updated = 1
 	}
-	if updated == 0 {
-		glog.V(3).Infof("      created new")
-	} else {
-		glog.V(3).Infof("      updated %d", updated)
-	}
-
 	if err == nil {
+		logFields["versionId"] = newVersionId
+		if updated == 0 {
+			ms.dal.logger.Infof(logFields, "created %s/%s", resourceType, resource.Id())
+		} else {
+			ms.dal.logger.Infof(logFields, "updated %s/%s", resourceType, resource.Id())
+		}
+		ms.invalidateCountCache(resourceType)
 		createdNew = (updated == 0)
 		if createdNew {
 			ms.invokeInterceptorsAfter("Create", resourceType, resource)
@@ -622,6 +943,92 @@ func (ms *mongoSession) Put(id string, conditionalVersionId string, resource *mo
 	return createdNew, convertMongoErr(err)
 }
 
+func (ms *mongoSession) Patch(id, resourceType, conditionalVersionId string, patch func(resource *models2.Resource) (*models2.Resource, error)) (patched *models2.Resource, err error) {
+	docID, err := ms.dal.convertID(id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	current, err := ms.get(id, resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	curVersionIdStr := current.VersionId()
+	newVersionId := 1
+	if ms.dal.enableHistory == false {
+		if conditionalVersionId != "" {
+			return nil, errors.Errorf("If-Match specified for a patch, but version histories are disabled")
+		}
+	} else if curVersionIdStr != "" {
+		curVersionId, err := strconv.Atoi(curVersionIdStr)
+		if err != nil {
+			return nil, errors.Errorf("meta.versionId is not an integer: %s", curVersionIdStr)
+		}
+		newVersionId = curVersionId + 1
+	}
+	if conditionalVersionId != "" && conditionalVersionId != curVersionIdStr {
+		return nil, ErrConflict{msg: "If-Match doesn't match current versionId"}
+	}
+	glog.V(3).Infof("[%s] PATCH %s/%s (version %s)", RequestID(ms.context), resourceType, id, curVersionIdStr)
+
+	patched, err = patch(current)
+	if err != nil {
+		return nil, err
+	}
+	err = ms.checkResourceMeta(patched)
+	if err != nil {
+		return nil, err
+	}
+	patched.SetId(docID)
+	patched.SetMaxDepth(ms.dal.maxResourceDepth)
+	updateResourceMeta(patched, newVersionId)
+
+	ms.invokeInterceptorsBefore("Update", resourceType, current)
+
+	// Atomically replace the version that was patched (findAndModify), so that updates made since
+	// it was read aren't lost, getting back the document replaced to store it in the history
+	selector := bson.D{
+		{"_id", docID},
+		{"meta.versionId", curVersionIdStr},
+	}
+	if curVersionIdStr == "" {
+		// documents created by previous versions not supporting versioning or if it was disabled
+		selector[1] = bson.E{"meta.versionId", bson.D{{"$exists", false}}}
+	}
+	curCollection := ms.CurrentVersionCollection(resourceType)
+	var previousDoc bson.D
+	err = curCollection.FindOneAndReplace(ms.context, selector, patched, options.FindOneAndReplace().SetReturnDocument(options.Before)).Decode(&previousDoc)
+	if err == mongo.ErrNoDocuments {
+		err = ErrConflict{msg: fmt.Sprintf("conflicting update of %s/%s (version %s)", resourceType, id, curVersionIdStr)}
+	} else if err != nil {
+		err = errors.Wrap(convertMongoErr(err), "Patch: failed to replace current version")
+	}
+
+	if err == nil && ms.dal.enableHistory {
+		// store the replaced document in the previous version collection with a vermongo-like _id (as in Put)
+		setVermongoId(&previousDoc, newVersionId-1)
+		vermongoIdField := bson.D{previousDoc[0]}
+		prevCollection := ms.PreviousVersionsCollection(resourceType)
+		err = prevCollection.FindOneAndReplace(ms.context, &vermongoIdField, &previousDoc, options.FindOneAndReplace().SetUpsert(true).SetReturnDocument(options.Before)).Err()
+		if err == mongo.ErrNoDocuments {
+			err = nil
+		}
+		if err != nil {
+			err = errors.Wrap(convertMongoErr(err), "Patch: failed to store previous version")
+		}
+	}
+
+	if err != nil {
+		ms.invokeInterceptorsOnError("Update", resourceType, err, patched)
+		return nil, err
+	}
+
+	ms.invalidateCountCache(resourceType)
+	ms.invokeInterceptorsAfter("Update", resourceType, patched)
+	return patched, nil
+}
+
 func getVersionIdFromResource(doc *bson.Raw) (hasVersionId bool, versionIdInt int, versionIdStr string) {
 	versionId, err := doc.LookupErr("meta", "versionId")
 	if err == bsoncore.ErrElementNotFound {
@@ -644,6 +1051,25 @@ func getVersionIdFromResource(doc *bson.Raw) (hasVersionId bool, versionIdInt in
 	}
 }
 
+// latestPreviousVersionId returns the highest versionId of a resource in the previous versions
+// collection (e.g. that of its deletion), or 0 if it has no previous versions
+func (ms *mongoSession) latestPreviousVersionId(resourceType string, id string) (int, error) {
+	prevCollection := ms.PreviousVersionsCollection(resourceType)
+	opts := options.FindOne().SetSort(bson.D{{"_id._version", -1}}).SetProjection(bson.D{{"_id._version", 1}})
+	var latest bson.Raw
+	err := prevCollection.FindOne(ms.context, bson.D{{"_id._id", id}}, opts).Decode(&latest)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	} else if err != nil {
+		return 0, convertMongoErr(err)
+	}
+	version, ok := latest.Lookup("_id", "_version").Int32OK()
+	if !ok {
+		return 0, errors.Errorf("_id._version of a previous version of %s/%s is not an int32", resourceType, id)
+	}
+	return int(version), nil
+}
+
 // Updates the doc to use a vermongo-like _id (_id: current_id, _version: versionId)
 func setVermongoId(doc *bson.D, versionIdInt int) {
 	idItem := &((*doc)[0])
@@ -677,8 +1103,10 @@ func (ms *mongoSession) ConditionalPut(query search.Query, conditionalVersionId
 	return id, createdNew, err
 }
 
-func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, err error) {
-	bsonID, err := convertIDToBsonID(id)
+func (ms *mongoSession) Delete(id, resourceType, conditionalVersionId string) (newVersionId string, err error) {
+	defer ms.dal.recordOperation("Delete", resourceType, time.Now(), &err)
+
+	docID, err := ms.dal.convertID(id)
 	if err != nil {
 		return "", ErrNotFound
 	}
@@ -687,7 +1115,7 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 	prevCollection := ms.PreviousVersionsCollection(resourceType)
 
 	if ms.dal.enableHistory {
-		newVersionId, err = saveDeletionIntoHistory(resourceType, bsonID.Hex(), curCollection, prevCollection, ms)
+		newVersionId, err = saveDeletionIntoHistory(resourceType, docID, conditionalVersionId, curCollection, prevCollection, ms)
 		if err == mongo.ErrNoDocuments {
 			return "", ErrNotFound
 		} else if err != nil {
@@ -701,15 +1129,27 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 	if hasInterceptor {
 		// Although this is a delete operation we need to get the resource first so we can
 		// run any interceptors on the resource before it's deleted.
-		resource, getError = ms.Get(id, resourceType)
+		resource, getError = ms.get(id, resourceType)
 		ms.invokeInterceptorsBefore("Delete", resourceType, resource)
 	}
 
-	filter := bson.D{{"_id", bsonID.Hex()}}
+	filter := bson.D{{"_id", docID}}
+	if conditionalVersionId != "" {
+		// also guards against updates since the check in saveDeletionIntoHistory
+		filter = append(filter, bson.E{"meta.versionId", conditionalVersionId})
+	}
 	deleteInfo, err := curCollection.DeleteOne(ms.context, filter)
-	glog.V(3).Infof("   deleteInfo: %+v (err %+v)", deleteInfo, err)
+	logFields := requestLogFields(ms.context, resourceType, docID)
+	ms.dal.logger.Debugf(logFields, "   deleteInfo: %+v (err %+v)", deleteInfo, err)
 	if deleteInfo.DeletedCount == 0 && err == nil {
 		err = mongo.ErrNoDocuments
+		if conditionalVersionId != "" {
+			err = ErrConflict{msg: "If-Match doesn't match current versionId"}
+		}
+	}
+	if err == nil {
+		ms.invalidateCountCache(resourceType)
+		ms.dal.logger.Infof(logFields, "deleted %s/%s", resourceType, docID)
 	}
 
 	if hasInterceptor {
@@ -724,7 +1164,7 @@ func (ms *mongoSession) Delete(id, resourceType string) (newVersionId string, er
 	return
 }
 
-func saveDeletionIntoHistory(resourceType string, id string, curCollection *mongowrapper.WrappedCollection, prevCollection *mongowrapper.WrappedCollection, ms *mongoSession) (newVersionIdStr string, err error) {
+func saveDeletionIntoHistory(resourceType string, id string, conditionalVersionId string, curCollection *mongowrapper.WrappedCollection, prevCollection *mongowrapper.WrappedCollection, ms *mongoSession) (newVersionIdStr string, err error) {
 	// get current version of this document
 	var currentDoc bson.D
 	var currentDocRaw bson.Raw
@@ -744,7 +1184,10 @@ func saveDeletionIntoHistory(resourceType string, id string, curCollection *mong
 		}
 
 		// extract current version
-		hasVersionId, curVersionId, _ := getVersionIdFromResource(&currentDocRaw)
+		hasVersionId, curVersionId, curVersionIdStr := getVersionIdFromResource(&currentDocRaw)
+		if conditionalVersionId != "" && conditionalVersionId != curVersionIdStr {
+			return "", ErrConflict{msg: "If-Match doesn't match current versionId"}
+		}
 		var newVersionId int
 		if hasVersionId {
 			newVersionId = curVersionId + 1
@@ -838,7 +1281,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 		*/
 
 		// get the resources that are about to be deleted
-		bundle, err := ms.Search(url.URL{}, query) // the baseURL argument here does not matter
+		bundle, err := ms.search(url.URL{}, query) // the baseURL argument here does not matter
 
 		if err == nil {
 			for _, elem := range bundle.Entry {
@@ -850,7 +1293,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 			for _, elem := range bundle.Entry {
 				if ms.dal.enableHistory {
 					id := elem.Resource.Id()
-					_, err = saveDeletionIntoHistory(resourceType, id, curCollection, prevCollection, ms)
+					_, err = saveDeletionIntoHistory(resourceType, id, "", curCollection, prevCollection, ms)
 					if err != nil {
 						return count, errors.Wrapf(err, "failed to save deletion into history (%s/%s)", resourceType, id)
 					}
@@ -863,6 +1306,9 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 			if info != nil {
 				count = info.DeletedCount
 			}
+			if count > 0 {
+				ms.invalidateCountCache(resourceType)
+			}
 
 			if err != nil {
 				if hasInterceptors {
@@ -881,7 +1327,7 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 				// Some but not all resources were removed, so use the original search query
 				// to see which resources are left.
 				var failBundle *models2.ShallowBundle
-				failBundle, searchErr = ms.Search(url.URL{}, query)
+				failBundle, searchErr = ms.search(url.URL{}, query)
 				deletedIds = setDiff(IDsToDelete, getResourceIdsFromBundle(failBundle))
 			} else {
 				// All resources were successfully removed
@@ -910,14 +1356,17 @@ func (ms *mongoSession) ConditionalDelete(query search.Query) (count int64, err
 		if info != nil {
 			count = info.DeletedCount
 		}
+		if count > 0 {
+			ms.invalidateCountCache(resourceType)
+		}
 		return count, convertMongoErr(err)
 	}
 }
 
-func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string) (bundle *models2.ShallowBundle, err error) {
+func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string, opts HistoryOptions) (bundle *models2.ShallowBundle, err error) {
 
 	// check id
-	_, err = convertIDToBsonID(id)
+	_, err = ms.dal.convertID(id)
 	if err != nil {
 		return nil, ErrNotFound
 	}
@@ -931,7 +1380,6 @@ func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string)
 	curCollection := ms.CurrentVersionCollection(resourceType)
 	prevCollection := ms.PreviousVersionsCollection(resourceType)
 
-	var entryList []models2.ShallowBundleEntryComponent
 	makeEntryRequest := func(method string) *models.BundleEntryRequestComponent {
 		return &models.BundleEntryRequestComponent{
 			Url:    resourceType + "/" + id,
@@ -939,68 +1387,143 @@ func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string)
 		}
 	}
 
-	// add current version
-	var curDoc bson.D
+	// versions are listed newest first: the current version followed by the previous ones,
+	// and only the requested page of them is loaded
+	lastUpdated := bson.D{}
+	if !opts.Since.IsZero() {
+		lastUpdated = append(lastUpdated, bson.E{"$gte", opts.Since})
+	}
+	if !opts.At.IsZero() {
+		lastUpdated = append(lastUpdated, bson.E{"$not", bson.D{{"$gt", opts.At}}})
+	}
 	curDocQuery := bson.D{{"_id", id}}
-	err = curCollection.FindOne(ms.context, curDocQuery).Decode(&curDoc)
+	prevDocsQuery := bson.D{{"_id._id", id}}
+	if len(lastUpdated) > 0 {
+		curDocQuery = append(curDocQuery, bson.E{"meta.lastUpdated", lastUpdated})
+		prevDocsQuery = append(prevDocsQuery, bson.E{"meta.lastUpdated", lastUpdated})
+	}
+
+	var curDoc bson.D
+	curDocBson, err := curCollection.FindOne(ms.context, curDocQuery).DecodeBytes()
 	if err == nil {
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
-		entry.Resource, err = models2.NewResourceFromBSON(curDoc)
+		err = bson.Unmarshal(curDocBson, &curDoc)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: NewResourceFromBSON failed")
+			return nil, errors.Wrap(err, "History: bson.Unmarshal failed")
 		}
-		entry.Request = makeEntryRequest("PUT")
-		entryList = append(entryList, entry)
 	} else if err != mongo.ErrNoDocuments {
 		return nil, err
 	}
 
-	// sort - oldest versions last
-	prevDocsQuery := bson.D{{"_id._id", id}}
-	prevDocsSort := options.Find().SetSort(bson.D{{"_id._version", -1}})
-	cursor, err := prevCollection.Find(ms.context, prevDocsQuery, prevDocsSort)
+	prevDocsCount, err := prevCollection.CountDocuments(ms.context, prevDocsQuery)
 	if err != nil {
-		return nil, errors.Wrap(err, "History: prevCollection.Find failed")
+		return nil, errors.Wrap(convertMongoErr(err), "History: prevCollection.CountDocuments failed")
 	}
-
-	for cursor.Next(ms.context) {
-
-		var prevDocBson bson.Raw
-		err = cursor.Decode(&prevDocBson)
-		glog.V(8).Infof("History: decoded prev document: %s", prevDocBson.String())
-		if err != nil {
-			return nil, errors.Wrap(err, "History: cursor.Decode failed")
-		}
-
-		var entry models2.ShallowBundleEntryComponent
-		entry.FullUrl = fullUrl
-
-		deleted, resource, err := unmarshalPreviousVersion(&prevDocBson)
+	total := int(prevDocsCount)
+	if curDoc != nil {
+		total++
+	}
+	if total == 0 {
+		// distinguish a resource without versions matching _since or _at from one that doesn't exist
+		exists, err := ms.hasAnyVersion(resourceType, id)
 		if err != nil {
-			return nil, errors.Wrap(err, "History: unmarshalPreviousVersion failed")
+			return nil, err
 		}
-		if deleted {
-			entry.Request = makeEntryRequest("DELETE")
-		} else {
-			entry.Resource = resource
-			entry.Request = makeEntryRequest("PUT")
+		if !exists {
+			return nil, ErrNotFound
 		}
+	}
+	if !opts.At.IsZero() && total > 1 {
+		// only the most recent version updated at or before _at
+		total = 1
+	}
 
-		entryList = append(entryList, entry)
+	// the oldest version was created with a POST
+	oldestVersion := int32(-1)
+	oldestDocBson, err := prevCollection.FindOne(ms.context, bson.D{{"_id._id", id}}, options.FindOne().SetSort(bson.D{{"_id._version", 1}}).SetProjection(bson.D{{"_id._version", 1}})).DecodeBytes()
+	if err == nil {
+		oldestVersion, _ = oldestDocBson.Lookup("_id", "_version").Int32OK()
+	} else if err != mongo.ErrNoDocuments {
+		return nil, errors.Wrap(convertMongoErr(err), "History: failed to find the oldest version")
 	}
-	if err := cursor.Err(); err != nil {
-		return nil, errors.Wrap(err, "History: MongoDB query for previous versions failed")
+
+	start := opts.Offset
+	if start > total {
+		start = total
 	}
+	end := opts.Offset + opts.Count
+	if end > total {
+		end = total
+	}
+	entryList := make([]models2.ShallowBundleEntryComponent, 0, end-start)
 
-	totalDocs := uint32(len(entryList))
-	if totalDocs == 0 {
-		return nil, ErrNotFound
+	prevStart, prevEnd := start, end
+	if curDoc != nil {
+		if start == 0 && end > 0 {
+			var entry models2.ShallowBundleEntryComponent
+			entry.FullUrl = fullUrl
+			entry.Resource, err = models2.NewResourceFromBSON(curDoc)
+			if err != nil {
+				return nil, errors.Wrap(err, "History: NewResourceFromBSON failed")
+			}
+			if oldestVersion == -1 {
+				entry.Request = &models.BundleEntryRequestComponent{Method: "POST", Url: resourceType}
+			} else {
+				entry.Request = makeEntryRequest("PUT")
+			}
+			entryList = append(entryList, entry)
+		}
+		prevEnd--
+		if prevStart > 0 {
+			prevStart--
+		}
 	}
 
-	// last entry should be a POST
-	entryList[len(entryList)-1].Request.Method = "POST"
-	entryList[len(entryList)-1].Request.Url = resourceType
+	if prevEnd > prevStart {
+		prevDocsOptions := options.Find().
+			SetSort(bson.D{{"_id._version", -1}}).
+			SetSkip(int64(prevStart)).
+			SetLimit(int64(prevEnd - prevStart))
+		cursor, err := prevCollection.Find(ms.context, prevDocsQuery, prevDocsOptions)
+		if err != nil {
+			return nil, errors.Wrap(err, "History: prevCollection.Find failed")
+		}
+		defer cursor.Close(ms.context)
+
+		for cursor.Next(ms.context) {
+
+			var prevDocBson bson.Raw
+			err = cursor.Decode(&prevDocBson)
+			glog.V(8).Infof("History: decoded prev document: %s", prevDocBson.String())
+			if err != nil {
+				return nil, errors.Wrap(err, "History: cursor.Decode failed")
+			}
+
+			var entry models2.ShallowBundleEntryComponent
+			entry.FullUrl = fullUrl
+
+			deleted, resource, err := unmarshalPreviousVersion(&prevDocBson)
+			if err != nil {
+				return nil, errors.Wrap(err, "History: unmarshalPreviousVersion failed")
+			}
+			version, _ := prevDocBson.Lookup("_id", "_version").Int32OK()
+			switch {
+			case deleted:
+				entry.Request = makeEntryRequest("DELETE")
+			case version == oldestVersion:
+				entry.Resource = resource
+				entry.Request = &models.BundleEntryRequestComponent{Method: "POST", Url: resourceType}
+			default:
+				entry.Resource = resource
+				entry.Request = makeEntryRequest("PUT")
+			}
+
+			entryList = append(entryList, entry)
+		}
+		if err := cursor.Err(); err != nil {
+			return nil, errors.Wrap(err, "History: MongoDB query for previous versions failed")
+		}
+	}
+	totalDocs := uint32(total)
 
 	// output a Bundle
 	bundle = &models2.ShallowBundle{
@@ -1010,51 +1533,542 @@ func (ms *mongoSession) History(baseURL url.URL, resourceType string, id string)
 		Total: &totalDocs,
 	}
 
-	// TODO: use paging
-	// bundle.Link = dal.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+	historyURL := baseURL
+	historyURL.Path = strings.TrimSuffix(historyURL.Path, "/") + "/" + id + "/_history"
+	bundle.Link = ms.generateHistoryPagingLinks(historyURL, opts, bundle.Total, len(bundle.Entry))
 
 	return bundle, nil
 }
 
-func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+func (ms *mongoSession) HistoryForType(baseURL url.URL, resourceType string, options HistoryOptions) (*models2.ShallowBundle, error) {
+	return ms.historyOfTypes(baseURL, resourceType+"/_history", []string{resourceType}, options)
+}
 
-	searcher := search.NewMongoSearcher(ms.db, ms.context, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive, ms.dal.readonly)
+func (ms *mongoSession) HistoryForAll(baseURL url.URL, options HistoryOptions) (*models2.ShallowBundle, error) {
+	return ms.historyOfTypes(baseURL, "_history", registeredResourceTypes(), options)
+}
 
-	resources, total, err := searcher.Search(searchQuery)
+// hasAnyVersion returns true if the current or any previous version of a resource exists, including deletion records
+func (ms *mongoSession) hasAnyVersion(resourceType string, id string) (bool, error) {
+	count, err := ms.CurrentVersionCollection(resourceType).CountDocuments(ms.context, bson.D{{"_id", id}}, options.Count().SetLimit(1))
 	if err != nil {
-		return nil, convertMongoErr(err)
+		return false, errors.Wrap(convertMongoErr(err), "History: count of current version failed")
 	}
-
-	includesMap := make(map[string]*models2.Resource)
-	var entryList []models2.ShallowBundleEntryComponent
-	numResults := len(resources)
-	baseURLstr := baseURL.String()
-	if !strings.HasSuffix(baseURLstr, "/") {
-		baseURLstr = baseURLstr + "/"
+	if count == 0 {
+		count, err = ms.PreviousVersionsCollection(resourceType).CountDocuments(ms.context, bson.D{{"_id._id", id}}, options.Count().SetLimit(1))
+		if err != nil {
+			return false, errors.Wrap(convertMongoErr(err), "History: count of previous versions failed")
+		}
 	}
+	return count > 0, nil
+}
 
-	for i := 0; i < numResults; i++ {
-		var entry models2.ShallowBundleEntryComponent
-		entry.Resource = resources[i]
-		entry.FullUrl = baseURLstr + resources[i].Id()
-		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
-		entryList = append(entryList, entry)
+// historyCursor is a cursor over the versions of a resource type in one collection, most recently
+// updated first, along with the version it's at
+type historyCursor struct {
+	resourceType string
+	order        int // breaks ties between versions updated at the same time
+	cursor       *mongo.Cursor
+	lastUpdated  time.Time
+}
 
-		if searchQuery.UsesIncludes() || searchQuery.UsesRevIncludes() {
+// next moves the cursor to its next version, returning false when there are no more
+func (hc *historyCursor) next(ctx context.Context) (bool, error) {
+	if !hc.cursor.Next(ctx) {
+		return false, hc.cursor.Err()
+	}
+	hc.lastUpdated, _ = hc.cursor.Current.Lookup("meta", "lastUpdated").TimeOK()
+	return true, nil
+}
+
+// historyCursors is a heap of cursors ordered by their versions, most recently updated first
+type historyCursors []*historyCursor
+
+func (h historyCursors) Len() int { return len(h) }
+func (h historyCursors) Less(i, j int) bool {
+	if h[i].lastUpdated.Equal(h[j].lastUpdated) {
+		return h[i].order < h[j].order
+	}
+	return h[i].lastUpdated.After(h[j].lastUpdated)
+}
+func (h historyCursors) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *historyCursors) Push(x interface{}) { *h = append(*h, x.(*historyCursor)) }
+func (h *historyCursors) Pop() interface{} {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// historyOfTypes merges the current and previous versions of the given resource types,
+// most recently updated first. The collections are read with a cursor each and merged as they're read,
+// so that the versions skipped by _offset aren't held in memory.
+func (ms *mongoSession) historyOfTypes(baseURL url.URL, historyPath string, resourceTypes []string, opts HistoryOptions) (*models2.ShallowBundle, error) {
+
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	filter := bson.D{}
+	if !opts.Since.IsZero() {
+		filter = bson.D{{"meta.lastUpdated", bson.D{{"$gte", opts.Since}}}}
+	}
+	// each collection only needs to supply enough versions to fill the requested page
+	findOptions := options.Find().
+		SetSort(bson.D{{"meta.lastUpdated", -1}}).
+		SetLimit(int64(opts.Offset + opts.Count))
+
+	var cursors historyCursors
+	var opened []*mongo.Cursor
+	defer func() {
+		for _, cursor := range opened {
+			cursor.Close(ms.context)
+		}
+	}()
+	var total int64
+	for _, resourceType := range resourceTypes {
+		collections := []*mongowrapper.WrappedCollection{
+			ms.CurrentVersionCollection(resourceType),
+			ms.PreviousVersionsCollection(resourceType),
+		}
+		for _, collection := range collections {
+			cursor, err := collection.Find(ms.context, filter, findOptions)
+			if err != nil {
+				return nil, errors.Wrapf(convertMongoErr(err), "history: find in %s failed", collection.Name())
+			}
+			opened = append(opened, cursor)
+			hc := &historyCursor{resourceType: resourceType, order: len(opened), cursor: cursor}
+			more, err := hc.next(ms.context)
+			if err != nil {
+				return nil, errors.Wrapf(convertMongoErr(err), "history: cursor for %s failed", collection.Name())
+			}
+			if more {
+				cursors = append(cursors, hc)
+			}
+
+			if ms.dal.countTotalResults {
+				count, err := collection.CountDocuments(ms.context, filter)
+				if err != nil {
+					return nil, errors.Wrapf(convertMongoErr(err), "history: count in %s failed", collection.Name())
+				}
+				total += count
+			}
+		}
+	}
+	heap.Init(&cursors)
+
+	bundle := &models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "history",
+		Entry: []models2.ShallowBundleEntryComponent{},
+	}
+	for skipped := 0; len(cursors) > 0 && len(bundle.Entry) < opts.Count; {
+		head := cursors[0]
+		if skipped < opts.Offset {
+			skipped++
+		} else {
+			entry, err := newHistoryEntry(baseURLstr, head.resourceType, head.cursor.Current)
+			if err != nil {
+				return nil, errors.Wrapf(err, "history: failed to load version of %s", head.resourceType)
+			}
+			bundle.Entry = append(bundle.Entry, entry)
+		}
+		more, err := head.next(ms.context)
+		if err != nil {
+			return nil, errors.Wrapf(convertMongoErr(err), "history: cursor for %s failed", head.resourceType)
+		}
+		if more {
+			heap.Fix(&cursors, 0)
+		} else {
+			heap.Pop(&cursors)
+		}
+	}
+	if ms.dal.countTotalResults {
+		totalDocs := uint32(total)
+		bundle.Total = &totalDocs
+	}
+
+	historyURL := baseURL
+	historyURL.Path = strings.TrimSuffix(historyURL.Path, "/") + "/" + historyPath
+	bundle.Link = ms.generateHistoryPagingLinks(historyURL, opts, bundle.Total, len(bundle.Entry))
+
+	return bundle, nil
+}
+
+// newHistoryEntry converts a document from either the current or previous versions collection
+func newHistoryEntry(baseURLstr string, resourceType string, doc bson.Raw) (models2.ShallowBundleEntryComponent, error) {
+	var entry models2.ShallowBundleEntryComponent
+
+	versionId, _ := doc.Lookup("meta", "versionId").StringValueOK()
+
+	var id string
+	var deleted bool
+	if vermongoId, isPreviousVersion := doc.Lookup("_id").DocumentOK(); isPreviousVersion {
+		id, _ = vermongoId.Lookup("_id").StringValueOK()
+		var err error
+		deleted, entry.Resource, err = unmarshalPreviousVersion(&doc)
+		if err != nil {
+			return entry, err
+		}
+	} else {
+		id, _ = doc.Lookup("_id").StringValueOK()
+		var curDoc bson.D
+		err := bson.Unmarshal(doc, &curDoc)
+		if err != nil {
+			return entry, errors.Wrap(err, "bson.Unmarshal failed")
+		}
+		entry.Resource, err = models2.NewResourceFromBSON(curDoc)
+		if err != nil {
+			return entry, errors.Wrap(err, "NewResourceFromBSON failed")
+		}
+	}
+
+	entry.FullUrl = baseURLstr + resourceType + "/" + id
+	switch {
+	case deleted:
+		entry.Request = &models.BundleEntryRequestComponent{Method: "DELETE", Url: resourceType + "/" + id}
+	case versionId == "1":
+		entry.Request = &models.BundleEntryRequestComponent{Method: "POST", Url: resourceType}
+	default:
+		entry.Request = &models.BundleEntryRequestComponent{Method: "PUT", Url: resourceType + "/" + id}
+	}
+	return entry, nil
+}
+
+func (ms *mongoSession) generateHistoryPagingLinks(historyURL url.URL, opts HistoryOptions, total *uint32, numResults int) []models.BundleLinkComponent {
+
+	var params search.URLQueryParameters
+	if !opts.Since.IsZero() {
+		params.Set("_since", opts.Since.Format(time.RFC3339Nano))
+	}
+	if !opts.At.IsZero() {
+		params.Set("_at", opts.At.Format(time.RFC3339Nano))
+	}
+
+	return generateOffsetPagingLinks(historyURL, params, opts.Offset, opts.Count, total, numResults)
+}
+
+// generateOffsetPagingLinks returns self, first, previous and next links for results paged with _offset and _count.
+// Without a total, a full page is assumed to have a next page.
+func generateOffsetPagingLinks(pageURL url.URL, params search.URLQueryParameters, offset int, count int, total *uint32, numResults int) []models.BundleLinkComponent {
+	links := make([]models.BundleLinkComponent, 0, 5)
+	links = append(links, newLink("self", pageURL, params, offset, count))
+	links = append(links, newLink("first", pageURL, params, 0, count))
+
+	if offset > 0 {
+		prevOffset := offset - count
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		links = append(links, newLink("previous", pageURL, params, prevOffset, offset-prevOffset))
+	}
+
+	var hasNext bool
+	if total != nil {
+		hasNext = int(*total) > offset+count
+	} else {
+		hasNext = numResults == count
+	}
+	if hasNext {
+		links = append(links, newLink("next", pageURL, params, offset+count, count))
+	}
+
+	return links
+}
+
+func (ms *mongoSession) Everything(baseURL url.URL, resourceType string, id string, opts EverythingOptions) (*models2.ShallowBundle, error) {
+	focus, err := ms.get(id, resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
+
+	sources, err := everythingSources(focus, ms.dal.maxResourceDepth)
+	if err != nil {
+		return nil, errors.Wrap(err, "everything: failed to find related resources")
+	}
 
-			for _, included := range entry.Resource.SearchIncludes() {
-				includesMap[included.ResourceType()+"/"+included.Id()] = included
+	bundle := &models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "searchset",
+		Entry: make([]models2.ShallowBundleEntryComponent, 0, opts.Count),
+	}
+
+	// sources are paged through in order, skipping whole sources that fall before the offset.
+	// Paging depends on the resources loaded before any are removed by interceptors.
+	var total int64
+	loaded := 0
+	skip := int64(opts.Offset)
+	for _, source := range sources {
+		if len(opts.Types) > 0 && !stringSliceContains(opts.Types, source.resourceType) {
+			continue
+		}
+		filter := source.filter
+		if !opts.Since.IsZero() {
+			filter = append(filter, bson.E{"meta.lastUpdated", bson.D{{"$gte", opts.Since}}})
+		}
+
+		collection := ms.CurrentVersionCollection(source.resourceType)
+		count, err := collection.CountDocuments(ms.context, filter)
+		if err != nil {
+			return nil, errors.Wrapf(convertMongoErr(err), "everything: count in %s failed", collection.Name())
+		}
+		total += count
+
+		if skip >= count {
+			skip -= count
+			continue
+		}
+		remaining := opts.Count - loaded
+		if remaining == 0 {
+			continue // only counting
+		}
+
+		findOptions := options.Find().SetSort(bson.D{{"_id", 1}}).SetSkip(skip).SetLimit(int64(remaining))
+		skip = 0
+		cursor, err := collection.Find(ms.context, filter, findOptions)
+		if err != nil {
+			return nil, errors.Wrapf(convertMongoErr(err), "everything: find in %s failed", collection.Name())
+		}
+		for cursor.Next(ms.context) {
+			entry, err := newEverythingEntry(baseURLstr, source, cursor.Current)
+			if err != nil {
+				cursor.Close(ms.context)
+				return nil, errors.Wrapf(err, "everything: failed to load resource from %s", collection.Name())
+			}
+			loaded++
+			entry.Resource, err = ms.interceptSearchResult(entry.Resource)
+			if err != nil {
+				cursor.Close(ms.context)
+				return nil, err
+			}
+			if entry.Resource != nil {
+				bundle.Entry = append(bundle.Entry, entry)
+			}
+		}
+		err = cursor.Err()
+		cursor.Close(ms.context)
+		if err != nil {
+			return nil, errors.Wrapf(convertMongoErr(err), "everything: cursor for %s failed", collection.Name())
+		}
+	}
+
+	totalDocs := uint32(total)
+	bundle.Total = &totalDocs
+
+	var params search.URLQueryParameters
+	if len(opts.Types) > 0 {
+		params.Set("_type", strings.Join(opts.Types, ","))
+	}
+	if !opts.Since.IsZero() {
+		params.Set("_since", opts.Since.Format(time.RFC3339Nano))
+	}
+	everythingURL := baseURL
+	everythingURL.Path = strings.TrimSuffix(everythingURL.Path, "/") + "/" + resourceType + "/" + id + "/$everything"
+	bundle.Link = generateOffsetPagingLinks(everythingURL, params, opts.Offset, opts.Count, bundle.Total, loaded)
+
+	return bundle, nil
+}
+
+// everythingSource is a query for some of the resources returned by $everything
+type everythingSource struct {
+	resourceType string
+	filter       bson.D
+	searchMode   string
+}
+
+// everythingSources returns queries for the focus resource, then for the resources related to it by type
+// (in alphabetical order). These are the resources it references and those that reference it
+// through a reference search parameter, as with _include=* and _revinclude=*.
+func everythingSources(focus *models2.Resource, maxResourceDepth int) ([]everythingSource, error) {
+	resourceType, id := focus.ResourceType(), focus.Id()
+	conditions := make(map[string][]bson.D)
+
+	visitor := models2.NewFhirVisitorCollectReferences()
+	if err := models2.WalkFHIRjson(focus.JsonBytes(), visitor, maxResourceDepth); err != nil {
+		return nil, errors.Wrap(err, "failed to collect references")
+	}
+	referencedIds := make(map[string][]string)
+	for _, reference := range visitor.GetReferences() {
+		parts := strings.Split(reference, "/")
+		if len(parts) != 2 && !(len(parts) == 4 && parts[2] == "_history") {
+			continue // absolute, contained or urn:uuid: references
+		}
+		if models.StructForResourceName(parts[0]) == nil || (parts[0] == resourceType && parts[1] == id) {
+			continue
+		}
+		referencedIds[parts[0]] = append(referencedIds[parts[0]], parts[1])
+	}
+	for referencedType, ids := range referencedIds {
+		conditions[referencedType] = append(conditions[referencedType], bson.D{{"_id", bson.D{{"$in", ids}}}})
+	}
+
+	for referencingType, params := range search.SearchParameterDictionary {
+		if models.StructForResourceName(referencingType) == nil {
+			continue
+		}
+		fields := make(map[string]bool)
+		for _, param := range params {
+			if param.Type != "reference" || !(stringSliceContains(param.Targets, resourceType) || stringSliceContains(param.Targets, "Any")) {
+				continue
 			}
+			for _, path := range param.Paths {
+				if path.Type != "Reference" {
+					continue
+				}
+				// Mongo paths shouldn't have the array indicators, so remove them
+				field := strings.Replace(path.Path, "[]", "", -1) + ".reference__id"
+				if !fields[field] {
+					fields[field] = true
+					conditions[referencingType] = append(conditions[referencingType], bson.D{{field, id}})
+				}
+			}
+		}
+	}
+
+	sources := []everythingSource{{resourceType: resourceType, filter: bson.D{{"_id", id}}, searchMode: "match"}}
+
+	relatedTypes := make([]string, 0, len(conditions))
+	for relatedType := range conditions {
+		relatedTypes = append(relatedTypes, relatedType)
+	}
+	sort.Strings(relatedTypes)
+	for _, relatedType := range relatedTypes {
+		filter := bson.D{{"$or", conditions[relatedType]}}
+		if relatedType == resourceType {
+			// the focus resource has already been returned
+			filter = append(filter, bson.E{"_id", bson.D{{"$ne", id}}})
+		}
+		sources = append(sources, everythingSource{resourceType: relatedType, filter: filter, searchMode: "include"})
+	}
+	return sources, nil
+}
+
+func newEverythingEntry(baseURLstr string, source everythingSource, doc bson.Raw) (models2.ShallowBundleEntryComponent, error) {
+	var entry models2.ShallowBundleEntryComponent
+	var curDoc bson.D
+	err := bson.Unmarshal(doc, &curDoc)
+	if err != nil {
+		return entry, errors.Wrap(err, "bson.Unmarshal failed")
+	}
+	entry.Resource, err = models2.NewResourceFromBSON(curDoc)
+	if err != nil {
+		return entry, errors.Wrap(err, "NewResourceFromBSON failed")
+	}
+	entry.FullUrl = baseURLstr + source.resourceType + "/" + entry.Resource.Id()
+	entry.Search = &models.BundleEntrySearchComponent{Mode: source.searchMode}
+	return entry, nil
+}
 
+func stringSliceContains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
 		}
 	}
+	return false
+}
+
+// newSearcher returns a searcher of db with the search settings of the DAL
+func (ms *mongoSession) newSearcher(db *mongowrapper.WrappedDatabase) *search.MongoSearcher {
+	searcher := search.NewMongoSearcher(db, ms.context, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive, ms.dal.readonly)
+	searcher.SetCaseSensitivity(ms.dal.caseSensitiveParameters)
+	searcher.SetLimits(ms.dal.maxSearchParameters, ms.dal.maxSearchValuesPerParameter)
+	searcher.SetCountCacheTTL(ms.dal.countCacheTTL)
+	return searcher
+}
+
+func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (bundle *models2.ShallowBundle, err error) {
+	defer ms.dal.recordOperation("Search", searchQuery.Resource, time.Now(), &err)
+	return ms.search(baseURL, searchQuery)
+}
+
+func (ms *mongoSession) search(baseURL url.URL, searchQuery search.Query) (*models2.ShallowBundle, error) {
+
+	baseURLstr := baseURL.String()
+	if !strings.HasSuffix(baseURLstr, "/") {
+		baseURLstr = baseURLstr + "/"
+	}
 
-	for _, v := range includesMap {
+	serverBaseStr := strings.TrimSuffix(baseURLstr, searchQuery.Resource+"/")
+
+	// larger pages are reduced to the maximum, which the paging links then use too
+	countWarning := searchQuery.LimitCount(ms.dal.maxResultCount)
+
+	searcher := ms.newSearcher(ms.searchDB())
+	if baseURL.Host != "" {
+		// baseURL is the URL of the resource type, e.g. http://example.com/fhir/Condition
+		searcher.SetServerBase(serverBaseStr)
+	}
+	if ms.dal.cursorPaging {
+		searcher.EnableCursorPaging()
+	}
+	searcher.SetMissingValuesOrder(ms.dal.missingValuesSortOrder)
+	if ms.dal.indexedFields != nil {
+		searcher.RequireIndexes(ms.dal.indexedFields)
+	}
+
+	resources, total, err := searcher.Search(searchQuery)
+	if err != nil {
+		return nil, convertMongoErr(err)
+	}
+	ms.dal.logger.Debugf(requestLogFields(ms.context, searchQuery.Resource, ""), "search %s?%s: %d results (total %d)", searchQuery.Resource, searchQuery.Query, len(resources), total)
+
+	// resources already in the bundle by Type/id, so that each appears once
+	inBundle := make(map[string]bool, len(resources))
+	for _, resource := range resources {
+		inBundle[resource.ResourceType()+"/"+resource.Id()] = true
+	}
+	var includes []*models2.Resource
+	var entryList []models2.ShallowBundleEntryComponent
+	// the number of results before any are removed by interceptors, which is what paging depends on
+	numResults := len(resources)
+
+	for _, resource := range resources {
+		result, err := ms.interceptSearchResult(resource)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			continue
+		}
+		var entry models2.ShallowBundleEntryComponent
+		entry.Resource = result
+		entry.FullUrl = baseURLstr + resource.Id()
+		if container := searcher.Container(resource); container != "" {
+			// a contained resource found with _containedType=contained is identified within its container
+			entry.FullUrl = serverBaseStr + container + "#" + resource.Id()
+		} else if resource.ResourceType() != searchQuery.Resource {
+			// the container of a contained resource found with _contained
+			entry.FullUrl = serverBaseStr + resource.ResourceType() + "/" + resource.Id()
+		}
+		entry.Search = &models.BundleEntrySearchComponent{Mode: "match"}
+		entryList = append(entryList, entry)
+
+		if searchQuery.UsesIncludes() || searchQuery.UsesRevIncludes() {
+			includes = collectSearchIncludes(resource, inBundle, includes)
+		}
+	}
+
+	for _, included := range includes {
+		v, err := ms.interceptSearchResult(included)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
 		if glog.V(4) {
-			glog.V(4).Infof("includesMap: %s/%s/_history/%s\n", v.ResourceType(), v.Id(), v.VersionId())
+			glog.V(4).Infof("includes: %s/%s/_history/%s\n", v.ResourceType(), v.Id(), v.VersionId())
 		}
 		var entry models2.ShallowBundleEntryComponent
 		entry.Resource = v
+		entry.FullUrl = serverBaseStr + v.ResourceType() + "/" + v.Id()
 		entry.Search = &models.BundleEntrySearchComponent{Mode: "include"}
 		entryList = append(entryList, entry)
 	}
@@ -1065,16 +2079,169 @@ func (ms *mongoSession) Search(baseURL url.URL, searchQuery search.Query) (*mode
 		Entry: entryList,
 	}
 
-	// Only include the total if counts are enabled, or if _summary=count was applied.
-	if ms.dal.countTotalResults || searchQuery.Options().Summary == "count" {
+	// Only include the total if counts are enabled (unless _total says otherwise), or if _summary=count was applied.
+	countsTotal := searchQuery.Options().CountsTotal(ms.dal.countTotalResults)
+	if countsTotal {
 		bundle.Total = &total
 	}
 
-	bundle.Link = ms.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+	// Conditions that don't fail the search but that clients should know about are disclosed
+	// in an OperationOutcome entry, as otherwise e.g. a page past the end looks like a search without matches
+	var issues []models.OperationOutcomeIssueComponent
+	if offset := searchQuery.Options().Offset; countsTotal && offset > int(total) {
+		issues = append(issues, models.OperationOutcomeIssueComponent{
+			Severity:    "information",
+			Code:        "informational",
+			Diagnostics: fmt.Sprintf("The offset (%d) exceeds the total number of results (%d)", offset, total),
+		})
+	}
+	if countWarning != "" {
+		issues = append(issues, models.OperationOutcomeIssueComponent{Severity: "warning", Code: "informational", Diagnostics: countWarning})
+	}
+	for _, warning := range searcher.Warnings() {
+		issues = append(issues, models.OperationOutcomeIssueComponent{Severity: "warning", Code: "informational", Diagnostics: warning})
+	}
+	if err := addSearchOutcomeIssues(&bundle, issues...); err != nil {
+		return nil, err
+	}
+
+	if searchAfter, cursorPaged := searcher.NextSearchAfter(); cursorPaged {
+		bundle.Link = generateCursorPagingLinks(baseURL, searchQuery, searchAfter, numResults)
+	} else {
+		bundle.Link = ms.generatePagingLinks(baseURL, searchQuery, total, uint32(numResults))
+	}
 
 	return &bundle, nil
 }
 
+// generateCursorPagingLinks returns self, first and next links for results paged with _searchafter,
+// which can't go backwards or skip to the end
+func generateCursorPagingLinks(baseURL url.URL, query search.Query, searchAfter string, numResults int) []models.BundleLinkComponent {
+	count := query.Options().Count
+	params := query.URLQueryParameters(true)
+	var firstParams search.URLQueryParameters
+	for _, param := range params.All() {
+		if param.Key != search.SearchAfterParam && param.Key != search.OffsetParam {
+			firstParams.Add(param.Key, param.Value)
+		}
+	}
+	firstParams.Set(search.CountParam, strconv.Itoa(count))
+
+	links := []models.BundleLinkComponent{newCursorLink("self", baseURL, params, count)}
+	links = append(links, newCursorLink("first", baseURL, firstParams, count))
+	if searchAfter != "" && numResults == count {
+		nextParams := firstParams
+		nextParams.Set(search.SearchAfterParam, searchAfter)
+		links = append(links, newCursorLink("next", baseURL, nextParams, count))
+	}
+	return links
+}
+
+// addSearchOutcomeIssues adds issues (such as warnings) to the OperationOutcome entry at the end
+// of a search bundle, whose search mode is "outcome", adding the entry if there isn't one yet
+func addSearchOutcomeIssues(bundle *models2.ShallowBundle, issues ...models.OperationOutcomeIssueComponent) error {
+	if len(issues) == 0 {
+		return nil
+	}
+
+	outcome := &models.OperationOutcome{}
+	last := len(bundle.Entry) - 1
+	hasOutcome := last >= 0 && bundle.Entry[last].Search != nil && bundle.Entry[last].Search.Mode == "outcome"
+	if hasOutcome {
+		if err := json.Unmarshal(bundle.Entry[last].Resource.JsonBytes(), outcome); err != nil {
+			return errors.Wrap(err, "failed to unmarshal search OperationOutcome")
+		}
+	}
+	outcome.Issue = append(outcome.Issue, issues...)
+
+	outcomeJSON, err := json.Marshal(outcome)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal search OperationOutcome")
+	}
+	resource, err := models2.NewResourceFromJsonBytes(outcomeJSON)
+	if err != nil {
+		return err
+	}
+
+	entry := models2.ShallowBundleEntryComponent{
+		Resource: resource,
+		Search:   &models.BundleEntrySearchComponent{Mode: "outcome"},
+	}
+	if hasOutcome {
+		bundle.Entry[last] = entry
+	} else {
+		bundle.Entry = append(bundle.Entry, entry)
+	}
+	return nil
+}
+
+// collectSearchIncludes appends the resources included with a search result to includes, along with
+// those included with them in turn (by _include:iterate and _revinclude:iterate), skipping those
+// already in the bundle
+func collectSearchIncludes(resource *models2.Resource, inBundle map[string]bool, includes []*models2.Resource) []*models2.Resource {
+	for _, included := range resource.SearchIncludes() {
+		key := included.ResourceType() + "/" + included.Id()
+		if inBundle[key] {
+			continue
+		}
+		inBundle[key] = true
+		includes = append(includes, included)
+		includes = collectSearchIncludes(included, inBundle, includes)
+	}
+	return includes
+}
+
+func (ms *mongoSession) GroupCounts(searchQuery search.Query, field string) ([]search.GroupCount, error) {
+	searcher := ms.newSearcher(ms.searchDB())
+
+	counts, err := searcher.GroupCounts(searchQuery, field)
+	if err != nil {
+		return nil, convertMongoErr(err)
+	}
+	return counts, nil
+}
+
+func (ms *mongoSession) LastN(baseURL url.URL, searchQuery search.Query, max int) (*models2.ShallowBundle, error) {
+	searcher := ms.newSearcher(ms.searchDB())
+
+	resources, err := searcher.LastN(searchQuery, max)
+	if err != nil {
+		return nil, convertMongoErr(err)
+	}
+
+	baseURLstr := strings.TrimSuffix(baseURL.String(), "/") + "/"
+	entries := make([]models2.ShallowBundleEntryComponent, 0, len(resources))
+	for _, resource := range resources {
+		result, err := ms.interceptSearchResult(resource)
+		if err != nil {
+			return nil, err
+		}
+		if result == nil {
+			continue
+		}
+		entries = append(entries, models2.ShallowBundleEntryComponent{
+			Resource: result,
+			FullUrl:  baseURLstr + resource.Id(),
+			Search:   &models.BundleEntrySearchComponent{Mode: "match"},
+		})
+	}
+
+	total := uint32(len(entries))
+	selfURL := baseURL
+	selfURL.Path = strings.TrimSuffix(selfURL.Path, "/") + "/$lastn"
+	selfParams := searchQuery.URLQueryParameters(false)
+	selfParams.Set("max", strconv.Itoa(max))
+	selfURL.RawQuery = selfParams.Encode()
+
+	return &models2.ShallowBundle{
+		Id:    primitive.NewObjectID().Hex(),
+		Type:  "searchset",
+		Total: &total,
+		Entry: entries,
+		Link:  []models.BundleLinkComponent{{Relation: "self", Url: selfURL.String()}},
+	}, nil
+}
+
 func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err error) {
 
 	// First create a new query with the unsupported query options filtered out
@@ -1092,7 +2259,7 @@ func (ms *mongoSession) FindIDs(searchQuery search.Query) (IDs []string, err err
 	newQuery := search.Query{Resource: searchQuery.Resource, Query: newParams.Encode()}
 
 	// Now search on that query, unmarshaling to a temporary struct and converting results to []string
-	searcher := search.NewMongoSearcher(ms.db, ms.context, ms.dal.countTotalResults, ms.dal.enableCISearches, ms.dal.tokenParametersCaseSensitive, ms.dal.readonly)
+	searcher := ms.newSearcher(ms.db)
 	results, _, err := searcher.Search(newQuery)
 	if err != nil {
 		return nil, convertMongoErr(err)
@@ -1127,7 +2294,11 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 
 	// For queries that don't support paging, only return the "self" link created directly from the original query.
 	if !query.SupportsPaging() {
-		links = append(links, newRawSelfLink(baseURL, query))
+		if query.Options().Summary == "count" {
+			links = append(links, newSummaryCountSelfLink(baseURL, query))
+		} else {
+			links = append(links, newRawSelfLink(baseURL, query))
+		}
 		return links
 	}
 
@@ -1148,8 +2319,8 @@ func (ms *mongoSession) generatePagingLinks(baseURL url.URL, query search.Query,
 		links = append(links, newLink("previous", baseURL, params, prevOffset, prevCount))
 	}
 
-	// If counts are enabled, the total is accurate and can be used to compute the links.
-	if ms.dal.countTotalResults {
+	// If the total was counted, it is accurate (or a reasonable estimate) and can be used to compute the links.
+	if query.Options().CountsTotal(ms.dal.countTotalResults) {
 		// Next Link
 		if total > uint32(offset+count) {
 			nextOffset := offset + count
@@ -1197,6 +2368,26 @@ func newRawSelfLink(baseURL url.URL, query search.Query) models.BundleLinkCompon
 	}
 }
 
+// newSummaryCountSelfLink is like newRawSelfLink but leaves out any paging parameters,
+// which are ignored for _summary=count
+func newSummaryCountSelfLink(baseURL url.URL, query search.Query) models.BundleLinkComponent {
+	params, _ := search.ParseQuery(query.Query)
+	filtered := search.URLQueryParameters{}
+	for _, param := range params.All() {
+		// _count=0 is kept as it's what asks for the total only
+		if (param.Key != search.CountParam || param.Value == "0") && param.Key != search.OffsetParam {
+			filtered.Add(param.Key, param.Value)
+		}
+	}
+	return newRawSelfLink(baseURL, search.Query{Resource: query.Resource, Query: filtered.Encode()})
+}
+
+func newCursorLink(relation string, baseURL url.URL, params search.URLQueryParameters, count int) models.BundleLinkComponent {
+	params.Set(search.CountParam, strconv.Itoa(count))
+	baseURL.RawQuery = params.Encode()
+	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
+}
+
 func newLink(relation string, baseURL url.URL, params search.URLQueryParameters, offset int, count int) models.BundleLinkComponent {
 	params.Set(search.OffsetParam, strconv.Itoa(offset))
 	params.Set(search.CountParam, strconv.Itoa(count))
@@ -1204,12 +2395,32 @@ func newLink(relation string, baseURL url.URL, params search.URLQueryParameters,
 	return models.BundleLinkComponent{Relation: relation, Url: baseURL.String()}
 }
 
-func convertIDToBsonID(id string) (primitive.ObjectID, error) {
+// fhirIDRegex matches the ids FHIR allows
+var fhirIDRegex = regexp.MustCompile(`^[A-Za-z0-9\-\.]{1,64}$`)
+
+// convertID returns the _id of the document of a resource: its id if it's a BSON ObjectId (in lower case)
+// or, with AllowClientAssignedStringIds, any other valid FHIR id as is
+func (dal *mongoDataAccessLayer) convertID(id string) (string, error) {
 	objId, err := primitive.ObjectIDFromHex(id)
 	if err == nil {
-		return objId, nil
+		return objId.Hex(), nil
+	}
+	if dal.allowClientAssignedStringIds && fhirIDRegex.MatchString(id) {
+		return id, nil
+	}
+	return "", models.NewOperationOutcome("fatal", "exception", "Id must be a valid BSON ObjectId")
+}
+
+// checkResourceMeta handles a resource being stored without a meta when that isn't allowed,
+// either rejecting it or injecting a meta with the default profiles for its type
+func (ms *mongoSession) checkResourceMeta(resource *models2.Resource) error {
+	if ms.dal.allowResourcesWithoutMeta || resource.HasMeta() {
+		return nil
+	}
+	if ms.dal.rejectResourcesWithoutMeta {
+		return ErrMissingMeta
 	}
-	return primitive.NilObjectID, models.NewOperationOutcome("fatal", "exception", "Id must be a valid BSON ObjectId")
+	return resource.SetDefaultMeta(ms.dal.defaultMetaProfiles[resource.ResourceType()])
 }
 
 func updateResourceMeta(resource *models2.Resource, versionId int) {
@@ -0,0 +1,49 @@
+package server
+
+import (
+	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	. "gopkg.in/check.v1"
+)
+
+type ReadPreferenceSuite struct {
+}
+
+var _ = Suite(&ReadPreferenceSuite{})
+
+// readPreferenceSession returns a session of an unconnected client, as reading the read preferences
+// of its databases doesn't need a server
+func readPreferenceSession(c *C, readFromSecondaries bool) *mongoSession {
+	client, err := mongowrapper.NewClient(options.Client().ApplyURI("mongodb://localhost:27017"))
+	c.Assert(err, IsNil)
+
+	config := DefaultConfig
+	config.ReadFromSecondaries = readFromSecondaries
+	dal := NewMongoDataAccessLayer(client, "fhir", false, "", nil, config).(*mongoDataAccessLayer)
+	return &mongoSession{db: client.Database("fhir"), dal: dal}
+}
+
+func readPreferenceMode(db *mongowrapper.WrappedDatabase) readpref.Mode {
+	if db.ReadPreference() == nil {
+		return readpref.PrimaryMode
+	}
+	return db.ReadPreference().Mode()
+}
+
+func (s *ReadPreferenceSuite) TestSearchesReadFromSecondaries(c *C) {
+	ms := readPreferenceSession(c, true)
+	c.Assert(readPreferenceMode(ms.searchDB()), Equals, readpref.SecondaryPreferredMode)
+
+	// writes such as Put use ms.db
+	c.Assert(readPreferenceMode(ms.db), Equals, readpref.PrimaryMode)
+
+	// transactions can only read from the primary
+	ms.inTransaction = true
+	c.Assert(readPreferenceMode(ms.searchDB()), Equals, readpref.PrimaryMode)
+}
+
+func (s *ReadPreferenceSuite) TestSearchesReadFromPrimaryByDefault(c *C) {
+	ms := readPreferenceSession(c, false)
+	c.Assert(readPreferenceMode(ms.searchDB()), Equals, readpref.PrimaryMode)
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strings"
@@ -57,8 +58,33 @@ func (i *Indexer) ConfigureIndexes(db *mongowrapper.WrappedDatabase) {
 	defer f.Close()
 
 	// parse the config file
+	indexMap, err := parseIndexes(f)
+	if err != nil {
+		i.log(fmt.Sprintf("[ERROR] %s\n", err.Error()))
+		panic(err)
+	}
+
+	// ensure all indexes in the config file
+	for k := range indexMap {
+		collection := db.Collection(k)
+
+		indexes := indexMap[k]
+		for _, index := range indexes {
+			i.log(fmt.Sprintf("Ensuring index: %s.%s: %s", i.dbName, k, sprintIndexKeys(&index)))
+		}
+
+		_, err = collection.Indexes().CreateMany(context.Background(), indexes)
+		if err != nil {
+			i.log(fmt.Sprintf("[WARNING] Could not ensure indexes for: %s.%s: %s\n", i.dbName, k, err.Error()))
+		}
+
+	}
+}
+
+// parseIndexes parses the indexes of an indexes.conf file
+func parseIndexes(r io.Reader) (IndexMap, error) {
 	var indexMap = make(IndexMap)
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
 		line := strings.TrimSpace(scanner.Text())
@@ -67,31 +93,39 @@ func (i *Indexer) ConfigureIndexes(db *mongowrapper.WrappedDatabase) {
 		if line != "" && !strings.HasPrefix(line, "#") {
 
 			collectionName, index, err := parseIndex(line)
-
 			if err != nil {
-				i.log(fmt.Sprintf("[ERROR] %s\n", err.Error()))
-				panic(err)
+				return nil, err
 			}
 
 			indexMap[collectionName] = append(indexMap[collectionName], *index)
 		}
 	}
+	return indexMap, scanner.Err()
+}
 
-	// ensure all indexes in the config file
-	for k := range indexMap {
-		collection := db.Collection(k)
+// IndexedFields returns the first key of each index in an indexes.conf file by collection
+// (e.g. "subject.reference__id" for observations), which is what a query has to constrain
+// for MongoDB to be able to use the index
+func IndexedFields(idxPath string) (map[string][]string, error) {
+	f, err := os.Open(idxPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
 
-		indexes := indexMap[k]
-		for _, index := range indexes {
-			i.log(fmt.Sprintf("Ensuring index: %s.%s: %s", i.dbName, k, sprintIndexKeys(&index)))
-		}
+	indexMap, err := parseIndexes(f)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = collection.Indexes().CreateMany(context.Background(), indexes)
-		if err != nil {
-			i.log(fmt.Sprintf("[WARNING] Could not ensure indexes for: %s.%s: %s\n", i.dbName, k, err.Error()))
+	fields := make(map[string][]string)
+	for collectionName, indexes := range indexMap {
+		for _, index := range indexes {
+			keys := index.Keys.(bson.D)
+			fields[collectionName] = append(fields[collectionName], keys[0].Key)
 		}
-
 	}
+	return fields, nil
 }
 
 func (i *Indexer) log(msg string) {
@@ -288,6 +288,15 @@ func (s *MongoIndexesTestSuite) TestConfigureIndexesNoConfigFile() {
 	s.NotPanics(func() { NewIndexer("fhir", s.Config).ConfigureIndexes(s.client.Database("fhir")) }, "Should not panic if no config file is found")
 }
 
+func (s *MongoIndexesTestSuite) TestIndexedFields() {
+	fields, err := IndexedFields(s.Config.IndexConfigPath)
+	s.Nil(err, "Should not return an error")
+	s.Equal(map[string][]string{"testcollection": []string{"foo", "foo", "bar.foo", "bar.foo", "foo", "bar"}}, fields)
+
+	_, err = IndexedFields("./does_not_exist.conf")
+	s.NotNil(err, "Should return an error if no config file is found")
+}
+
 func (s *MongoIndexesTestSuite) compareIndexes(expected, actual []mgo.Index) {
 
 	for _, idx := range actual {
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OperationLevel is where a custom operation is invoked: on the server, a resource type or a resource
+type OperationLevel int
+
+const (
+	SystemLevel   OperationLevel = iota // e.g. GET /$ping
+	TypeLevel                           // e.g. GET /Patient/$ping
+	InstanceLevel                       // e.g. GET /Patient/123/$ping
+)
+
+// OperationHandler handles a custom operation using a session of the request's database.
+// resourceType is empty for system-level operations and id is only set for instance-level ones.
+type OperationHandler func(c *gin.Context, session DataAccessSession, resourceType string, id string)
+
+type operationKey struct {
+	name  string
+	level OperationLevel
+}
+
+// OperationRegistry holds custom FHIR operations (e.g. $match or $lastn), which RegisterRoutes
+// routes for GET and POST requests at their level without the router having to be edited
+type OperationRegistry struct {
+	operations map[operationKey]OperationHandler
+}
+
+// NewOperationRegistry returns an empty OperationRegistry
+func NewOperationRegistry() *OperationRegistry {
+	return &OperationRegistry{operations: make(map[operationKey]OperationHandler)}
+}
+
+// Register adds an operation (named with or without the leading $) at a level. Operations must be
+// registered before RegisterRoutes is called and can't have the name of a built-in operation.
+func (r *OperationRegistry) Register(name string, level OperationLevel, handler OperationHandler) {
+	r.operations[operationKey{strings.TrimPrefix(name, "$"), level}] = handler
+}
+
+// Lookup returns the handler of the operation named name (without the $) at a level, if any
+func (r *OperationRegistry) Lookup(name string, level OperationLevel) (handler OperationHandler, found bool) {
+	if r == nil {
+		return nil, false
+	}
+	handler, found = r.operations[operationKey{name, level}]
+	return handler, found
+}
+
+// names returns the names of the operations at a level
+func (r *OperationRegistry) names(level OperationLevel) []string {
+	var names []string
+	if r != nil {
+		for key := range r.operations {
+			if key.level == level {
+				names = append(names, key.name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SystemOperationHandler handles requests for the system-level custom operation named name (e.g. GET /$ping)
+func SystemOperationHandler(dal DataAccessLayer, config Config, name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invokeOperation(c, dal, config, name, SystemLevel, "", "")
+	}
+}
+
+// OperationHandler returns a handler for requests for the custom operation named name at a level,
+// e.g. GET /Patient/$ping at the type level or GET /Patient/123/$ping at the instance level
+func (rc *ResourceController) OperationHandler(name string, level OperationLevel) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := ""
+		if level == InstanceLevel {
+			id = c.Param("id")
+		}
+		invokeOperation(c, rc.DAL, rc.Config, name, level, rc.Name, id)
+	}
+}
+
+// invokeOperation calls the handler of a custom operation, responding with a 404 if there's none
+func invokeOperation(c *gin.Context, dal DataAccessLayer, config Config, name string, level OperationLevel, resourceType string, id string) {
+	defer handlePanics(c)
+
+	handler, found := config.Operations.Lookup(name, level)
+	if !found {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Set("Resource", resourceType)
+	c.Set("Action", "operation")
+
+	session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+	handler(c, session, resourceType, id)
+}
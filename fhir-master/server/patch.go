@@ -0,0 +1,561 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eug48/fhir/models"
+)
+
+// PatchError is returned when a patch document is malformed (400)
+// or cannot be applied to the resource (422)
+type PatchError struct {
+	HTTPStatus int
+	Msg        string
+}
+
+func (e *PatchError) Error() string {
+	return e.Msg
+}
+
+func invalidPatch(format string, args ...interface{}) *PatchError {
+	return &PatchError{HTTPStatus: http.StatusBadRequest, Msg: fmt.Sprintf(format, args...)}
+}
+
+func unprocessablePatch(format string, args ...interface{}) *PatchError {
+	return &PatchError{HTTPStatus: http.StatusUnprocessableEntity, Msg: fmt.Sprintf(format, args...)}
+}
+
+// ApplyPatch applies a JSON Patch (RFC 6902) or FHIRPath Patch (a Parameters resource)
+// document to the JSON of a resource, depending on the Content-Type of the patch.
+func ApplyPatch(contentType string, resourceJson []byte, patchBody []byte) (patchedJson []byte, err error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, invalidPatch("failed to parse Content-Type: %s", err.Error())
+	}
+
+	var resource interface{}
+	if err := unmarshalJsonWithNumbers(resourceJson, &resource); err != nil {
+		return nil, err
+	}
+	resourceType, _ := resource.(map[string]interface{})["resourceType"].(string)
+	id := resource.(map[string]interface{})["id"]
+
+	var patched interface{}
+	switch mediaType {
+	case "application/json-patch+json":
+		patched, err = applyJsonPatch(resource, patchBody)
+	case "application/fhir+json", "application/json+fhir", "application/json":
+		patched, err = applyFhirPathPatch(resourceType, resource, patchBody)
+	default:
+		return nil, &PatchError{HTTPStatus: http.StatusUnsupportedMediaType, Msg: fmt.Sprintf("unsupported patch Content-Type: %s", mediaType)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	patchedMap, ok := patched.(map[string]interface{})
+	if !ok {
+		return nil, unprocessablePatch("patch result is not a resource")
+	}
+	if patchedMap["resourceType"] != resourceType {
+		return nil, unprocessablePatch("patch must not change the resourceType")
+	}
+	if patchedMap["id"] != id {
+		return nil, unprocessablePatch("patch must not change the resource id")
+	}
+
+	return json.Marshal(patched)
+}
+
+func unmarshalJsonWithNumbers(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber() // keep decimals as they were sent
+	if err := decoder.Decode(v); err != nil {
+		return invalidPatch("failed to parse JSON: %s", err.Error())
+	}
+	return nil
+}
+
+/*
+	JSON Patch (https://tools.ietf.org/html/rfc6902)
+*/
+
+type jsonPatchOperation struct {
+	Op    string           `json:"op"`
+	Path  *string          `json:"path"`
+	From  *string          `json:"from"`
+	Value *json.RawMessage `json:"value"`
+}
+
+func applyJsonPatch(doc interface{}, patchBody []byte) (interface{}, error) {
+	var operations []jsonPatchOperation
+	if err := json.Unmarshal(patchBody, &operations); err != nil {
+		return nil, invalidPatch("JSON Patch must be an array of operations: %s", err.Error())
+	}
+
+	for i, op := range operations {
+		if op.Path == nil {
+			return nil, invalidPatch("JSON Patch operation %d has no path", i)
+		}
+		path, err := parseJsonPointer(*op.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		var value interface{}
+		needsValue := op.Op == "add" || op.Op == "replace" || op.Op == "test"
+		if needsValue {
+			if op.Value == nil {
+				return nil, invalidPatch("JSON Patch %s operation %d has no value", op.Op, i)
+			}
+			if err := unmarshalJsonWithNumbers(*op.Value, &value); err != nil {
+				return nil, err
+			}
+		}
+
+		var from []string
+		if op.Op == "move" || op.Op == "copy" {
+			if op.From == nil {
+				return nil, invalidPatch("JSON Patch %s operation %d has no from", op.Op, i)
+			}
+			if from, err = parseJsonPointer(*op.From); err != nil {
+				return nil, err
+			}
+		}
+
+		switch op.Op {
+		case "add":
+			doc, err = patchAdd(doc, path, value)
+		case "remove":
+			doc, err = patchRemove(doc, path)
+		case "replace":
+			doc, err = patchReplace(doc, path, value)
+		case "move":
+			if value, err = patchGet(doc, from); err == nil {
+				if doc, err = patchRemove(doc, from); err == nil {
+					doc, err = patchAdd(doc, path, value)
+				}
+			}
+		case "copy":
+			if value, err = patchGet(doc, from); err == nil {
+				doc, err = patchAdd(doc, path, deepCopyJson(value))
+			}
+		case "test":
+			var current interface{}
+			if current, err = patchGet(doc, path); err == nil && !reflect.DeepEqual(current, value) {
+				err = unprocessablePatch("JSON Patch test operation %d failed at %s", i, *op.Path)
+			}
+		default:
+			return nil, invalidPatch("JSON Patch operation %d has an unknown op: %s", i, op.Op)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func parseJsonPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, invalidPatch("invalid JSON Pointer: %s", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func deepCopyJson(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = deepCopyJson(item)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(v))
+		for i, item := range v {
+			s[i] = deepCopyJson(item)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+// arrayIndex parses an index into an array of length n. If allowEnd is set
+// n itself (or "-") is accepted, for appending.
+func arrayIndex(token string, n int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return n, nil
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 || index > n || (index == n && !allowEnd) {
+		return 0, unprocessablePatch("invalid array index: %s", token)
+	}
+	return index, nil
+}
+
+// patchAtParent finds the container of the last path token and passes it to
+// apply, which returns the (possibly re-allocated) container
+func patchAtParent(doc interface{}, path []string, apply func(container interface{}, key string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, unprocessablePatch("the whole resource cannot be patched")
+	}
+	if len(path) == 1 {
+		return apply(doc, path[0])
+	}
+
+	child, err := patchGet(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	newChild, err := patchAtParent(child, path[1:], apply)
+	if err != nil {
+		return nil, err
+	}
+
+	switch container := doc.(type) {
+	case map[string]interface{}:
+		container[path[0]] = newChild
+	case []interface{}:
+		index, _ := arrayIndex(path[0], len(container), false)
+		container[index] = newChild
+	}
+	return doc, nil
+}
+
+func patchGet(doc interface{}, path []string) (interface{}, error) {
+	current := doc
+	for _, token := range path {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			value, exists := container[token]
+			if !exists {
+				return nil, unprocessablePatch("path not found: %s", token)
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(token, len(container), false)
+			if err != nil {
+				return nil, err
+			}
+			current = container[index]
+		default:
+			return nil, unprocessablePatch("path not found: %s", token)
+		}
+	}
+	return current, nil
+}
+
+func patchAdd(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	return patchAtParent(doc, path, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			c[key] = value
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[index+1:], c[index:])
+			c[index] = value
+			return c, nil
+		default:
+			return nil, unprocessablePatch("cannot add %s to a primitive value", key)
+		}
+	})
+}
+
+func patchRemove(doc interface{}, path []string) (interface{}, error) {
+	return patchAtParent(doc, path, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, exists := c[key]; !exists {
+				return nil, unprocessablePatch("path not found: %s", key)
+			}
+			delete(c, key)
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(c[:index], c[index+1:]...), nil
+		default:
+			return nil, unprocessablePatch("path not found: %s", key)
+		}
+	})
+}
+
+func patchReplace(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	return patchAtParent(doc, path, func(container interface{}, key string) (interface{}, error) {
+		switch c := container.(type) {
+		case map[string]interface{}:
+			if _, exists := c[key]; !exists {
+				return nil, unprocessablePatch("path not found: %s", key)
+			}
+			c[key] = value
+			return c, nil
+		case []interface{}:
+			index, err := arrayIndex(key, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			c[index] = value
+			return c, nil
+		default:
+			return nil, unprocessablePatch("path not found: %s", key)
+		}
+	})
+}
+
+/*
+	FHIRPath Patch (http://hl7.org/fhir/fhirpatch.html)
+
+	Only simple paths are supported: element names separated by dots, each optionally
+	followed by an index, e.g. Patient.name[0].given
+*/
+
+var fhirPathStepRegex = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9_]*)(?:\[(\d+)\])?$`)
+
+func applyFhirPathPatch(resourceType string, doc interface{}, patchBody []byte) (interface{}, error) {
+	var parameters map[string]interface{}
+	if err := unmarshalJsonWithNumbers(patchBody, &parameters); err != nil {
+		return nil, err
+	}
+	if parameters["resourceType"] != "Parameters" {
+		return nil, invalidPatch("FHIRPath Patch must be a Parameters resource")
+	}
+
+	operations, _ := parameters["parameter"].([]interface{})
+	for i, operation := range operations {
+		opMap, _ := operation.(map[string]interface{})
+		if opMap["name"] != "operation" {
+			return nil, invalidPatch("FHIRPath Patch parameter %d is not an operation", i)
+		}
+		parts := fhirPatchParts(opMap)
+
+		opType, _ := parts["type"].(string)
+		pathExpr, _ := parts["path"].(string)
+		if pathExpr == "" {
+			return nil, invalidPatch("FHIRPath Patch operation %d has no path", i)
+		}
+		// the path of insert and move operations is the list itself rather than its items
+		isListOperation := opType == "insert" || opType == "move"
+		locations, err := evaluateSimpleFhirPath(resourceType, doc, pathExpr, isListOperation)
+		if err != nil {
+			return nil, err
+		}
+
+		if opType == "delete" {
+			if len(locations) > 1 {
+				return nil, unprocessablePatch("FHIRPath Patch delete path %s matches more than one element", pathExpr)
+			}
+			if len(locations) == 1 {
+				if doc, err = patchRemove(doc, locations[0]); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if len(locations) != 1 {
+			return nil, unprocessablePatch("FHIRPath Patch path %s must match exactly one element (matched %d)", pathExpr, len(locations))
+		}
+		location := locations[0]
+
+		switch opType {
+		case "add":
+			name, _ := parts["name"].(string)
+			value, hasValue := parts["value"]
+			if name == "" || !hasValue {
+				return nil, invalidPatch("FHIRPath Patch add operation %d needs a name and a value", i)
+			}
+			childPath := append(append([]string{}, location...), name)
+			existing, err := patchGet(doc, childPath)
+			if existingArray, isArray := existing.([]interface{}); err == nil && isArray {
+				doc, err = patchAdd(doc, append(childPath, strconv.Itoa(len(existingArray))), value)
+			} else if err != nil && isRepeatingElement(resourceType, childPath) {
+				doc, err = patchAdd(doc, childPath, []interface{}{value})
+			} else {
+				doc, err = patchAdd(doc, childPath, value)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+		case "insert":
+			value, hasValue := parts["value"]
+			index, err := fhirPatchIndex(parts, "index")
+			if err != nil || !hasValue {
+				return nil, invalidPatch("FHIRPath Patch insert operation %d needs an index and a value", i)
+			}
+			if doc, err = patchAdd(doc, append(location, strconv.Itoa(index)), value); err != nil {
+				return nil, err
+			}
+
+		case "replace":
+			value, hasValue := parts["value"]
+			if !hasValue {
+				return nil, invalidPatch("FHIRPath Patch replace operation %d needs a value", i)
+			}
+			if doc, err = patchReplace(doc, location, value); err != nil {
+				return nil, err
+			}
+
+		case "move":
+			source, err1 := fhirPatchIndex(parts, "source")
+			destination, err2 := fhirPatchIndex(parts, "destination")
+			if err1 != nil || err2 != nil {
+				return nil, invalidPatch("FHIRPath Patch move operation %d needs a source and a destination", i)
+			}
+			value, err := patchGet(doc, append(location, strconv.Itoa(source)))
+			if err != nil {
+				return nil, err
+			}
+			if doc, err = patchRemove(doc, append(location, strconv.Itoa(source))); err != nil {
+				return nil, err
+			}
+			if doc, err = patchAdd(doc, append(location, strconv.Itoa(destination)), value); err != nil {
+				return nil, err
+			}
+
+		default:
+			return nil, invalidPatch("FHIRPath Patch operation %d has an unknown type: %s", i, opType)
+		}
+	}
+
+	return doc, nil
+}
+
+// fhirPatchParts converts the parts of a Parameters parameter to a map from part
+// name to value. Parts with nested parts (i.e. complex values) are converted to objects.
+func fhirPatchParts(parameter map[string]interface{}) map[string]interface{} {
+	result := map[string]interface{}{}
+	parts, _ := parameter["part"].([]interface{})
+	for _, part := range parts {
+		partMap, _ := part.(map[string]interface{})
+		name, _ := partMap["name"].(string)
+		if _, hasParts := partMap["part"]; hasParts {
+			result[name] = fhirPatchParts(partMap)
+			continue
+		}
+		for key, value := range partMap {
+			if strings.HasPrefix(key, "value") || key == "resource" {
+				result[name] = value
+			}
+		}
+	}
+	return result
+}
+
+func fhirPatchIndex(parts map[string]interface{}, name string) (int, error) {
+	number, ok := parts[name].(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("missing %s", name)
+	}
+	index, err := strconv.Atoi(number.String())
+	return index, err
+}
+
+// evaluateSimpleFhirPath returns the JSON Pointer tokens of each element matched by the path.
+// If the last element is a list and asList is set the list itself is returned instead of its items.
+func evaluateSimpleFhirPath(resourceType string, doc interface{}, pathExpr string, asList bool) ([][]string, error) {
+	steps := strings.Split(pathExpr, ".")
+	if steps[0] == resourceType {
+		steps = steps[1:]
+	}
+
+	locations := [][]string{[]string{}}
+	for stepIndex, step := range steps {
+		m := fhirPathStepRegex.FindStringSubmatch(step)
+		if m == nil {
+			return nil, invalidPatch("unsupported FHIRPath expression: %s", pathExpr)
+		}
+
+		var next [][]string
+		for _, location := range locations {
+			childPath := append(append([]string{}, location...), m[1])
+			child, err := patchGet(doc, childPath)
+			if err != nil {
+				continue
+			}
+			keepList := asList && stepIndex == len(steps)-1 && m[2] == ""
+			if array, isArray := child.([]interface{}); isArray && !keepList {
+				for i := range array {
+					next = append(next, append(append([]string{}, childPath...), strconv.Itoa(i)))
+				}
+			} else {
+				next = append(next, childPath)
+			}
+		}
+
+		if m[2] != "" {
+			index, _ := strconv.Atoi(m[2])
+			if index < len(next) {
+				next = next[index : index+1]
+			} else {
+				next = nil
+			}
+		}
+		locations = next
+	}
+	return locations, nil
+}
+
+// isRepeatingElement uses the generated models to find out whether an element is an array
+func isRepeatingElement(resourceType string, path []string) bool {
+	defer func() {
+		recover() // unknown resource types
+	}()
+
+	t := reflect.TypeOf(models.StructForResourceName(resourceType))
+	for _, token := range path {
+		if _, err := strconv.Atoi(token); err == nil {
+			continue
+		}
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		field, found := findJsonField(t, token)
+		if !found {
+			return false
+		}
+		t = field.Type
+	}
+	return t.Kind() == reflect.Slice
+}
+
+func findJsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous {
+			if found, ok := findJsonField(field.Type, name); ok {
+				return found, true
+			}
+			continue
+		}
+		if strings.Split(field.Tag.Get("json"), ",")[0] == name {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
@@ -0,0 +1,215 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	. "gopkg.in/check.v1"
+)
+
+type PatchSuite struct {
+}
+
+var _ = Suite(&PatchSuite{})
+
+const patchTestPatient = `{
+	"resourceType": "Patient",
+	"id": "123",
+	"meta": {"versionId": "1"},
+	"name": [{"family": "Duck", "given": ["Donald"]}],
+	"gender": "male",
+	"birthDate": "1934-06-09"
+}`
+
+func applyTestPatch(c *C, contentType string, patch string) (map[string]interface{}, error) {
+	patched, err := ApplyPatch(contentType, []byte(patchTestPatient), []byte(patch))
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	c.Assert(json.Unmarshal(patched, &result), IsNil)
+	return result, nil
+}
+
+func (s *PatchSuite) TestJsonPatchAddReplaceRemove(c *C) {
+	patient, err := applyTestPatch(c, "application/json-patch+json", `[
+		{"op": "add", "path": "/name/0/given/-", "value": "Fauntleroy"},
+		{"op": "add", "path": "/active", "value": true},
+		{"op": "replace", "path": "/gender", "value": "other"},
+		{"op": "remove", "path": "/birthDate"}
+	]`)
+	c.Assert(err, IsNil)
+
+	c.Assert(patient["name"].([]interface{})[0].(map[string]interface{})["given"], DeepEquals, []interface{}{"Donald", "Fauntleroy"})
+	c.Assert(patient["active"], Equals, true)
+	c.Assert(patient["gender"], Equals, "other")
+	_, hasBirthDate := patient["birthDate"]
+	c.Assert(hasBirthDate, Equals, false)
+	c.Assert(patient["id"], Equals, "123")
+}
+
+func (s *PatchSuite) TestJsonPatchMoveCopyTest(c *C) {
+	patient, err := applyTestPatch(c, "application/json-patch+json", `[
+		{"op": "test", "path": "/gender", "value": "male"},
+		{"op": "copy", "from": "/name/0", "path": "/name/-"},
+		{"op": "move", "from": "/birthDate", "path": "/deceasedDateTime"}
+	]`)
+	c.Assert(err, IsNil)
+
+	c.Assert(patient["name"], HasLen, 2)
+	c.Assert(patient["deceasedDateTime"], Equals, "1934-06-09")
+	_, hasBirthDate := patient["birthDate"]
+	c.Assert(hasBirthDate, Equals, false)
+}
+
+func (s *PatchSuite) TestJsonPatchFailedTest(c *C) {
+	_, err := applyTestPatch(c, "application/json-patch+json", `[{"op": "test", "path": "/gender", "value": "female"}]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusUnprocessableEntity)
+}
+
+func (s *PatchSuite) TestJsonPatchMissingPath(c *C) {
+	_, err := applyTestPatch(c, "application/json-patch+json", `[{"op": "remove", "path": "/address"}]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusUnprocessableEntity)
+}
+
+func (s *PatchSuite) TestJsonPatchInvalidDocument(c *C) {
+	_, err := applyTestPatch(c, "application/json-patch+json", `{"op": "remove", "path": "/gender"}`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusBadRequest)
+
+	_, err = applyTestPatch(c, "application/json-patch+json", `[{"op": "frobnicate", "path": "/gender"}]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusBadRequest)
+}
+
+func (s *PatchSuite) TestJsonPatchCannotChangeId(c *C) {
+	_, err := applyTestPatch(c, "application/json-patch+json", `[{"op": "replace", "path": "/id", "value": "456"}]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusUnprocessableEntity)
+
+	_, err = applyTestPatch(c, "application/json-patch+json", `[{"op": "replace", "path": "/resourceType", "value": "Person"}]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusUnprocessableEntity)
+}
+
+func (s *PatchSuite) TestFhirPathPatchAddReplaceDelete(c *C) {
+	patient, err := applyTestPatch(c, "application/fhir+json", `{
+		"resourceType": "Parameters",
+		"parameter": [{
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "add"},
+				{"name": "path", "valueString": "Patient"},
+				{"name": "name", "valueString": "telecom"},
+				{"name": "value", "part": [
+					{"name": "system", "valueCode": "phone"},
+					{"name": "value", "valueString": "555-1234"}
+				]}
+			]
+		}, {
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "add"},
+				{"name": "path", "valueString": "Patient.name[0]"},
+				{"name": "name", "valueString": "given"},
+				{"name": "value", "valueString": "Fauntleroy"}
+			]
+		}, {
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "replace"},
+				{"name": "path", "valueString": "Patient.gender"},
+				{"name": "value", "valueCode": "other"}
+			]
+		}, {
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "delete"},
+				{"name": "path", "valueString": "Patient.birthDate"}
+			]
+		}]
+	}`)
+	c.Assert(err, IsNil)
+
+	c.Assert(patient["telecom"], DeepEquals, []interface{}{
+		map[string]interface{}{"system": "phone", "value": "555-1234"},
+	})
+	c.Assert(patient["name"].([]interface{})[0].(map[string]interface{})["given"], DeepEquals, []interface{}{"Donald", "Fauntleroy"})
+	c.Assert(patient["gender"], Equals, "other")
+	_, hasBirthDate := patient["birthDate"]
+	c.Assert(hasBirthDate, Equals, false)
+}
+
+func (s *PatchSuite) TestFhirPathPatchInsertAndMove(c *C) {
+	patient, err := applyTestPatch(c, "application/fhir+json", `{
+		"resourceType": "Parameters",
+		"parameter": [{
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "insert"},
+				{"name": "path", "valueString": "Patient.name.given"},
+				{"name": "index", "valueInteger": 0},
+				{"name": "value", "valueString": "Fauntleroy"}
+			]
+		}, {
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "move"},
+				{"name": "path", "valueString": "Patient.name.given"},
+				{"name": "source", "valueInteger": 0},
+				{"name": "destination", "valueInteger": 1}
+			]
+		}]
+	}`)
+	c.Assert(err, IsNil)
+	c.Assert(patient["name"].([]interface{})[0].(map[string]interface{})["given"], DeepEquals, []interface{}{"Donald", "Fauntleroy"})
+
+	patient, err = applyTestPatch(c, "application/fhir+json", `{
+		"resourceType": "Parameters",
+		"parameter": [{
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "insert"},
+				{"name": "path", "valueString": "Patient.name"},
+				{"name": "index", "valueInteger": 0},
+				{"name": "value", "part": [{"name": "family", "valueString": "McDuck"}]}
+			]
+		}, {
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "move"},
+				{"name": "path", "valueString": "Patient.name"},
+				{"name": "source", "valueInteger": 0},
+				{"name": "destination", "valueInteger": 1}
+			]
+		}]
+	}`)
+	c.Assert(err, IsNil)
+	names := patient["name"].([]interface{})
+	c.Assert(names, HasLen, 2)
+	c.Assert(names[0].(map[string]interface{})["family"], Equals, "Duck")
+	c.Assert(names[1].(map[string]interface{})["family"], Equals, "McDuck")
+}
+
+func (s *PatchSuite) TestFhirPathPatchUnsupportedExpression(c *C) {
+	_, err := applyTestPatch(c, "application/fhir+json", `{
+		"resourceType": "Parameters",
+		"parameter": [{
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "delete"},
+				{"name": "path", "valueString": "Patient.name.where(use='official')"}
+			]
+		}]
+	}`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusBadRequest)
+}
+
+func (s *PatchSuite) TestUnsupportedContentType(c *C) {
+	_, err := applyTestPatch(c, "text/plain", `[]`)
+	c.Assert(err, FitsTypeOf, &PatchError{})
+	c.Assert(err.(*PatchError).HTTPStatus, Equals, http.StatusUnsupportedMediaType)
+}
@@ -8,6 +8,9 @@ import (
 	"mime"
 	"net/http"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/eug48/fhir/utils"
 
@@ -46,41 +49,34 @@ func handlePanics(c *gin.Context) {
 func (rc *ResourceController) IndexHandler(c *gin.Context) {
 	defer handlePanics(c)
 
-	rawQuery := c.Request.URL.RawQuery
-	if c.Request.Method == "POST" {
-		// handle _search (http://hl7.org/fhir/http.html#search)
-		// reading urlencoded form values similarly to http/request.go
-		ct := c.Request.Header.Get("Content-Type")
-		if ct == "" {
-			// RFC 2616, section 7.2.1 - empty type SHOULD be treated as application/octet-stream
-			ct = "application/octet-stream"
-		}
-		var err error
-		ct, _, err = mime.ParseMediaType(ct)
-		if err != nil {
-			outcome := models.NewOperationOutcome("fatal", "structure", "failed to parse Content-Type")
-			c.Render(http.StatusUnsupportedMediaType, CustomFhirRenderer{outcome, c})
-			return
-		}
-		if ct == "application/x-www-form-urlencoded" {
-			bodyBytes, err := ioutil.ReadAll(c.Request.Body)
-			if err != nil {
-				panic(fmt.Errorf("failed to read POSTed form body: %#v", err))
-			}
-			rawQuery = string(bodyBytes)
-		}
+	rawQuery, ok := searchRawQuery(c)
+	if !ok {
+		return
 	}
 
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
 	defer session.Finish()
 
 	searchQuery := search.Query{Resource: rc.Name, Query: rawQuery}
+	defaultFilters := rc.applyDefaultSearchFilters(&searchQuery)
 	baseURL := rc.Config.responseURL(c.Request, rc.Name)
 	bundle, err := session.Search(*baseURL, searchQuery)
 	if err != nil {
 		panic(errors.Wrap(err, "Search failed"))
 	}
 
+	// the self link shows the default filters too, but clients might not compare it with their query
+	if defaultFilters != "" {
+		issue := models.OperationOutcomeIssueComponent{
+			Severity:    "warning",
+			Code:        "informational",
+			Diagnostics: "Default search filters were applied: " + defaultFilters,
+		}
+		if err := addSearchOutcomeIssues(bundle, issue); err != nil {
+			panic(err)
+		}
+	}
+
 	c.Set("bundle", bundle)
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "search")
@@ -88,6 +84,46 @@ func (rc *ResourceController) IndexHandler(c *gin.Context) {
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
+// searchRawQuery returns the URL-encoded query of a search. For a POST to _search (http://hl7.org/fhir/http.html#search)
+// this includes the parameters of a form-encoded body. If the body can't be read an error is rendered and ok is false.
+func searchRawQuery(c *gin.Context) (rawQuery string, ok bool) {
+	rawQuery = c.Request.URL.RawQuery
+	if c.Request.Method != "POST" {
+		return rawQuery, true
+	}
+	// reading urlencoded form values similarly to http/request.go
+	ct := c.Request.Header.Get("Content-Type")
+	if ct == "" {
+		// RFC 2616, section 7.2.1 - empty type SHOULD be treated as application/octet-stream
+		ct = "application/octet-stream"
+	}
+	ct, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		outcome := models.NewOperationOutcome("fatal", "structure", "failed to parse Content-Type")
+		c.Render(http.StatusUnsupportedMediaType, CustomFhirRenderer{outcome, c})
+		return "", false
+	}
+	if ct == "application/x-www-form-urlencoded" {
+		bodyBytes, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			panic(fmt.Errorf("failed to read POSTed form body: %#v", err))
+		}
+		// parameters can be in the URL as well as in the body
+		rawQuery = joinRawQueries(rawQuery, strings.TrimSpace(string(bodyBytes)))
+	}
+	// The paging links of the results are GET URLs with the whole query, which clients that only
+	// search with POST can also follow by POSTing to _search with the query as the URL's or the body's
+	return rawQuery, true
+}
+
+// joinRawQueries joins two URL-encoded queries, either of which can be empty
+func joinRawQueries(a string, b string) string {
+	if a == "" || b == "" {
+		return a + b
+	}
+	return a + "&" + b
+}
+
 // LoadResource uses the resource id in the request to get a resource from the DataAccessLayer and store it in the
 // context.
 func (rc *ResourceController) LoadResource(c *gin.Context) (resourceId string, resource *models2.Resource, err error) {
@@ -113,27 +149,111 @@ func (rc *ResourceController) LoadResource(c *gin.Context) (resourceId string, r
 // ShowHandler handles requests to get a particular resource by ID.
 func (rc *ResourceController) ShowHandler(c *gin.Context) {
 	defer handlePanics(c)
+	if c.Param("id") == "_history" && rc.Config.EnableHistory {
+		// gin can't route /Patient/_history separately from /Patient/:id
+		rc.TypeHistoryHandler(c)
+		return
+	}
+	if c.Param("id") == "$stats" {
+		// likewise for /Patient/$stats
+		rc.StatsHandler(c)
+		return
+	}
+	if c.Param("id") == "$lastn" && rc.Name == "Observation" {
+		// and /Observation/$lastn
+		rc.LastNHandler(c)
+		return
+	}
+	if c.Param("id") == "$export" && rc.Name == "Patient" && rc.Config.BulkExportDir != "" {
+		// and /Patient/$export
+		rc.ExportHandler(c)
+		return
+	}
+	if strings.HasPrefix(c.Param("id"), "$") {
+		// and custom type-level operations such as /Patient/$match
+		name := strings.TrimPrefix(c.Param("id"), "$")
+		if _, found := rc.Config.Operations.Lookup(name, TypeLevel); found {
+			rc.OperationHandler(name, TypeLevel)(c)
+			return
+		}
+	}
 	c.Set("Action", "read")
 	resourceId, resource, err := rc.LoadResource(c)
 	if err == nil {
+		if c.Query("_resolveInternalReferences") == "true" {
+			// e.g. urn:uuid: references between the entries of a document Bundle
+			resource.ResolveInternalReferences()
+		}
 		err = setHeaders(c, rc, false, resource, resourceId)
 		if err != nil {
 			err = errors.Wrap(err, "ShowHandler setHeaders failed")
 		}
 	}
+	if err == nil && c.Param("vid") != "" {
+		err = rc.setAdjacentVersionHeaders(c, resourceId, c.Param("vid"))
+	}
 
-	switch err {
-	case nil:
+	switch {
+	case err == nil && notModified(c, resource):
+		c.Status(http.StatusNotModified)
+	case err == nil:
 		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
-	case ErrNotFound:
+	case err == ErrNotFound:
 		c.Status(http.StatusNotFound)
-	case ErrDeleted:
+	case err == ErrDeleted:
 		c.Status(http.StatusGone)
 	default:
 		panic(errors.Wrap(err, "LoadResource failed"))
 	}
 }
 
+// notModified reports whether a read can be answered with a 304 Not Modified because the client's
+// cached copy is current, going by If-None-Match or, when there's none, If-Modified-Since
+func notModified(c *gin.Context, resource *models2.Resource) bool {
+	if ifNoneMatch := c.GetHeader("If-None-Match"); ifNoneMatch != "" {
+		versionId := resource.VersionId()
+		for _, etag := range strings.Split(ifNoneMatch, ",") {
+			etag = strings.TrimSpace(etag)
+			if etag == "*" {
+				return true
+			}
+			// ETags are compared weakly so W/"1" matches "1"
+			if versionId != "" && strings.Trim(strings.TrimPrefix(etag, "W/"), "\"") == versionId {
+				return true
+			}
+		}
+		return false
+	}
+
+	if ifModifiedSince := c.GetHeader("If-Modified-Since"); ifModifiedSince != "" && resource.LastUpdated() != "" {
+		since, err := http.ParseTime(ifModifiedSince)
+		// Last-Modified only has a resolution of seconds
+		if err == nil && !resource.LastUpdatedTime().Truncate(time.Second).After(since) {
+			return true
+		}
+	}
+	return false
+}
+
+// setAdjacentVersionHeaders adds the X-GoFHIR-Previous-Version and X-GoFHIR-Next-Version headers
+// to a vread response so that clients can navigate a resource's history
+func (rc *ResourceController) setAdjacentVersionHeaders(c *gin.Context, id string, versionId string) error {
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	previousVersionId, nextVersionId, err := session.AdjacentVersions(id, versionId, rc.Name)
+	if err != nil {
+		return errors.Wrap(err, "AdjacentVersions failed")
+	}
+	if previousVersionId != "" {
+		c.Header("X-GoFHIR-Previous-Version", previousVersionId)
+	}
+	if nextVersionId != "" {
+		c.Header("X-GoFHIR-Next-Version", nextVersionId)
+	}
+	return nil
+}
+
 func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 	defer handlePanics(c)
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
@@ -141,9 +261,16 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 
 	c.Set("Action", "history")
 
+	options, err := parseHistoryOptions(c, rc.Config.MaxResultCount)
+	if err != nil {
+		outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+
 	baseURL := rc.Config.responseURL(c.Request, rc.Name)
 	resourceId := c.Param("id")
-	bundle, err := session.History(*baseURL, rc.Name, resourceId)
+	bundle, err := session.History(*baseURL, rc.Name, resourceId, options)
 	if err != nil && err != ErrNotFound {
 		panic(errors.Wrap(err, "History request failed"))
 	}
@@ -155,29 +282,207 @@ func (rc *ResourceController) HistoryHandler(c *gin.Context) {
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
-// EverythingHandler handles requests for everything related to a Patient or Encounter resource.
-func (rc *ResourceController) EverythingHandler(c *gin.Context) {
+// TypeHistoryHandler handles requests for the history of all resources of a type (e.g. /Patient/_history)
+func (rc *ResourceController) TypeHistoryHandler(c *gin.Context) {
 	defer handlePanics(c)
+	c.Set("Action", "history")
+
+	options, err := parseHistoryOptions(c, rc.Config.MaxResultCount)
+	if err == nil && !options.At.IsZero() {
+		err = errUnsupportedHistoryAt
+	}
+	if err != nil {
+		outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
 	defer session.Finish()
 
-	// For now we interpret $everything as the union of _include and _revinclude
-	query := fmt.Sprintf("_id=%s&_include=*&_revinclude=*", c.Param("id"))
+	baseURL := rc.Config.responseURL(c.Request)
+	bundle, err := session.HistoryForType(*baseURL, rc.Name, options)
+	if err != nil {
+		panic(errors.Wrap(err, "HistoryForType request failed"))
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+}
+
+// SystemHistoryHandler handles requests for the history of all resources (i.e. /_history)
+func SystemHistoryHandler(dal DataAccessLayer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		c.Set("Action", "history")
 
-	searchQuery := search.Query{Resource: rc.Name, Query: query}
-	baseURL := rc.Config.responseURL(c.Request, rc.Name)
-	bundle, err := session.Search(*baseURL, searchQuery)
+		options, err := parseHistoryOptions(c, config.MaxResultCount)
+		if err == nil && !options.At.IsZero() {
+			err = errUnsupportedHistoryAt
+		}
+		if err != nil {
+			outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+			return
+		}
+
+		session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+		defer session.Finish()
+
+		baseURL := config.responseURL(c.Request)
+		bundle, err := session.HistoryForAll(*baseURL, options)
+		if err != nil {
+			panic(errors.Wrap(err, "HistoryForAll request failed"))
+		}
+		c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+	}
+}
+
+var errUnsupportedHistoryAt = errors.New("Parameter \"_at\" is only supported for the history of a single resource")
+
+// parseHistoryOptions reads the _count, _offset, _since and _at parameters of a history request,
+// reducing a _count larger than maxCount to it (zero for no limit)
+func parseHistoryOptions(c *gin.Context, maxCount int) (options HistoryOptions, err error) {
+	options.Count = search.NewQueryOptions().Count
+	if count := c.Query(search.CountParam); count != "" {
+		options.Count, err = strconv.Atoi(count)
+		if err != nil || options.Count < 1 {
+			return options, fmt.Errorf("Parameter \"%s\" content is invalid", search.CountParam)
+		}
+		if maxCount > 0 && options.Count > maxCount {
+			// like searches, but the smaller page is only apparent from the paging links
+			options.Count = maxCount
+		}
+	}
+	if offset := c.Query(search.OffsetParam); offset != "" {
+		options.Offset, err = strconv.Atoi(offset)
+		if err != nil || options.Offset < 0 {
+			return options, fmt.Errorf("Parameter \"%s\" content is invalid", search.OffsetParam)
+		}
+	}
+	if since := c.Query("_since"); since != "" {
+		options.Since, err = time.Parse(time.RFC3339Nano, since)
+		if err != nil {
+			return options, fmt.Errorf("Parameter \"_since\" content is invalid (should be an instant)")
+		}
+	}
+	if at := c.Query("_at"); at != "" {
+		options.At, err = time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return options, fmt.Errorf("Parameter \"_at\" content is invalid (should be an instant)")
+		}
+	}
+	return options, nil
+}
+
+// parseEverythingOptions reads the _count, _offset, _type and _since parameters of a $everything request
+func parseEverythingOptions(c *gin.Context, maxCount int) (options EverythingOptions, err error) {
+	historyOptions, err := parseHistoryOptions(c, maxCount)
+	if err == nil && !historyOptions.At.IsZero() {
+		err = errors.New("Parameter \"_at\" is not supported by $everything")
+	}
 	if err != nil {
-		panic(errors.Wrap(err, "Search (everything) failed"))
+		return options, err
 	}
+	options.Count = historyOptions.Count
+	options.Offset = historyOptions.Offset
+	options.Since = historyOptions.Since
+
+	for _, types := range c.QueryArray("_type") {
+		for _, resourceType := range strings.Split(types, ",") {
+			if models.StructForResourceName(resourceType) == nil {
+				return options, fmt.Errorf("Parameter \"_type\" content is invalid (unknown resource type %s)", resourceType)
+			}
+			options.Types = append(options.Types, resourceType)
+		}
+	}
+	return options, nil
+}
 
-	c.Set("bundle", bundle)
+// EverythingHandler handles requests for everything related to a Patient or Encounter resource.
+// For now we interpret $everything as the union of _include=* and _revinclude=*, with paging
+// and the _type and _since parameters.
+func (rc *ResourceController) EverythingHandler(c *gin.Context) {
+	defer handlePanics(c)
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "search")
 
+	options, err := parseEverythingOptions(c, rc.Config.MaxResultCount)
+	if err != nil {
+		outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	baseURL := rc.Config.responseURL(c.Request)
+	bundle, err := session.Everything(*baseURL, rc.Name, c.Param("id"), options)
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "Everything failed"))
+	}
+
+	c.Set("bundle", bundle)
 	c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
 }
 
+// applyDefaultSearchFilters adds the configured default filters of the resource type to a search,
+// apart from those on parameters it already uses (with any modifier), returning those it added
+func (rc *ResourceController) applyDefaultSearchFilters(query *search.Query) string {
+	filters, hasFilters := rc.Config.DefaultSearchFilters[rc.Name]
+	if !hasFilters {
+		return ""
+	}
+	defaults, err := search.ParseQuery(filters)
+	if err != nil {
+		panic(errors.Wrapf(err, "invalid default search filters for %s: %s", rc.Name, filters))
+	}
+	params, _ := search.ParseQuery(query.Query)
+
+	used := make(map[string]bool)
+	for _, param := range params.All() {
+		used[strings.SplitN(param.Key, ":", 2)[0]] = true
+	}
+	var applied search.URLQueryParameters
+	for _, param := range defaults.All() {
+		if !used[strings.SplitN(param.Key, ":", 2)[0]] {
+			applied.Add(param.Key, param.Value)
+		}
+	}
+	if len(applied.All()) == 0 {
+		return ""
+	}
+
+	if query.Query == "" {
+		query.Query = applied.Encode()
+	} else {
+		query.Query += "&" + applied.Encode()
+	}
+	return applied.Encode()
+}
+
+// TypeOperationHandler handles POSTs to /Patient/_search, /Patient/$validate and custom type-level
+// operations (gin can't route these separately from /Patient/:id/$validate)
+func (rc *ResourceController) TypeOperationHandler(c *gin.Context) {
+	switch id := c.Param("id"); {
+	case id == "_search":
+		rc.IndexHandler(c)
+	case id == "$validate":
+		rc.ValidateHandler(c)
+	case strings.HasPrefix(id, "$"):
+		rc.OperationHandler(strings.TrimPrefix(id, "$"), TypeLevel)(c)
+	default:
+		c.AbortWithStatus(http.StatusNotFound)
+	}
+}
+
 // CreateHandler handles requests to create a new resource instance, assigning it a new ID.
 func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	defer handlePanics(c)
@@ -191,6 +496,11 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 		return
 	}
 
+	warnings, err := rc.DAL.ValidateResource(c.Request.Context(), resource)
+	if err != nil {
+		panic(errors.Wrap(err, "CreateHandler ValidateResource failed"))
+	}
+
 	// check for conditional create
 	ifNoneExist := c.GetHeader("If-None-Exist")
 	var httpStatus int
@@ -210,14 +520,21 @@ func (rc *ResourceController) CreateHandler(c *gin.Context) {
 	c.Set("Resource", rc.Name)
 	c.Set("Action", "create")
 
-	if resource != nil { // nil when e.g. HTTP status from ConditionalPost 412
-		err = setHeaders(c, rc, true, resource, resourceId)
-		if err != nil {
-			panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
-		}
+	if resource == nil { // nil when ConditionalPost found more than one match (HTTP 412)
+		// as for a conditional create in a batch
+		oo := models.CreateOpOutcome("error", "duplicate", "", "search criteria were not selective enough")
+		c.Render(httpStatus, CustomFhirRenderer{oo, c})
+		return
 	}
 
-	c.Render(httpStatus, CustomFhirRenderer{resource, c})
+	err = setHeaders(c, rc, true, resource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "CreateHandler setHeaders failed"))
+	}
+	if httpStatus != http.StatusCreated {
+		warnings = nil // about the resource sent rather than the one that already exists
+	}
+	rc.renderPreferredReturn(c, httpStatus, resource, resourceId, warnings)
 }
 
 // UpdateHandler handles requests to update a resource having a given ID.  If the resource with that ID does not
@@ -246,6 +563,11 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 		}
 	}
 
+	warnings, err := rc.DAL.ValidateResource(c.Request.Context(), resource)
+	if err != nil {
+		panic(errors.Wrap(err, "UpdateHandler ValidateResource failed"))
+	}
+
 	// Perform update
 	resourceId := c.Param("id")
 	createdNew, err := session.Put(resourceId, conditionalVersionId, resource)
@@ -262,13 +584,152 @@ func (rc *ResourceController) UpdateHandler(c *gin.Context) {
 
 	if createdNew {
 		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		rc.renderPreferredReturn(c, http.StatusCreated, resource, resourceId, warnings)
 	} else {
 		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		rc.renderPreferredReturn(c, http.StatusOK, resource, resourceId, warnings)
 	}
 }
 
+// PatchHandler handles requests to patch a resource having a given ID, using either
+// JSON Patch (application/json-patch+json) or FHIRPath Patch (a Parameters resource).
+// The patched resource is stored as a new version with session.Patch.
+func (rc *ResourceController) PatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	patchBody, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		panic(errors.Wrap(err, "PatchHandler: failed to read request body"))
+	}
+
+	conditionalVersionId := ""
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" {
+		conditionalVersionId, err = utils.ETagToVersionId(ifMatch)
+		if err != nil {
+			oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+			return
+		}
+	}
+
+	rc.patch(c, session, c.Param("id"), patchBody, conditionalVersionId)
+}
+
+// ConditionalPatchHandler handles requests to patch the single resource matching search criteria
+// (e.g. PATCH /Observation?identifier=123). No matches result in a 404 and multiple matches in a 412.
+func (rc *ResourceController) ConditionalPatchHandler(c *gin.Context) {
+	defer handlePanics(c)
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	patchBody, err := ioutil.ReadAll(c.Request.Body)
+	if err != nil {
+		panic(errors.Wrap(err, "ConditionalPatchHandler: failed to read request body"))
+	}
+
+	conditionalVersionId := ""
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch != "" {
+		conditionalVersionId, err = utils.ETagToVersionId(ifMatch)
+		if err != nil {
+			oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+			return
+		}
+	}
+
+	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
+	IDs, err := session.FindIDs(query)
+	if err != nil {
+		panic(errors.Wrap(err, "ConditionalPatchHandler: FindIDs failed"))
+	}
+	switch len(IDs) {
+	case 0:
+		c.Status(http.StatusNotFound)
+		return
+	case 1:
+	default:
+		oo := models.NewOperationOutcome("error", "multiple-matches", fmt.Sprintf("%d resources match the search criteria", len(IDs)))
+		c.Render(http.StatusPreconditionFailed, CustomFhirRenderer{oo, c})
+		return
+	}
+
+	rc.patch(c, session, IDs[0], patchBody, conditionalVersionId)
+}
+
+// patch applies a patch to a resource, stores the result and renders the response
+func (rc *ResourceController) patch(c *gin.Context, session DataAccessSession, resourceId string, patchBody []byte, conditionalVersionId string) {
+	var patchErr error
+	var warnings []models.OperationOutcomeIssueComponent
+	patchedResource, err := session.Patch(resourceId, rc.Name, conditionalVersionId, func(resource *models2.Resource) (*models2.Resource, error) {
+		patched, err := rc.patchResource(c, resource, patchBody)
+		patchErr = err
+		if err != nil {
+			return nil, err
+		}
+		warnings, err = rc.DAL.ValidateResource(c.Request.Context(), patched)
+		return patched, err
+	})
+	if patchErr != nil {
+		status := http.StatusBadRequest
+		if e, ok := patchErr.(*PatchError); ok {
+			status = e.HTTPStatus
+		}
+		oo := models.NewOperationOutcome("error", "processing", patchErr.Error())
+		c.Render(status, CustomFhirRenderer{oo, c})
+		return
+	}
+	switch err {
+	case nil:
+	case ErrNotFound:
+		c.Status(http.StatusNotFound)
+		return
+	case ErrDeleted:
+		c.Status(http.StatusGone)
+		return
+	default:
+		panic(errors.Wrap(err, "Patch failed"))
+	}
+
+	c.Set(rc.Name, patchedResource)
+	c.Set("Resource", rc.Name)
+	c.Set("Action", "update")
+
+	err = setHeaders(c, rc, false, patchedResource, resourceId)
+	if err != nil {
+		panic(errors.Wrap(err, "patch setHeaders failed"))
+	}
+	rc.renderPreferredReturn(c, http.StatusOK, patchedResource, resourceId, warnings)
+}
+
+// patchResource applies a patch document to a resource, converting FHIRPath Patches
+// sent as XML to JSON first
+func (rc *ResourceController) patchResource(c *gin.Context, resource *models2.Resource, patchBody []byte) (*models2.Resource, error) {
+	contentType := c.GetHeader("Content-Type")
+
+	if strings.Contains(contentType, "application/fhir+xml") || strings.Contains(contentType, "application/xml+fhir") {
+		converterInterface, enabled := c.Get("FhirFormatConverter")
+		if !enabled {
+			return nil, &PatchError{HTTPStatus: http.StatusUnsupportedMediaType, Msg: "XML is not enabled"}
+		}
+		jsonStr, err := converterInterface.(*FhirFormatConverter).XmlToJson(string(patchBody))
+		if err != nil {
+			return nil, err
+		}
+		patchBody = []byte(jsonStr)
+		contentType = "application/fhir+json"
+	}
+
+	patchedJson, err := ApplyPatch(contentType, resource.JsonBytes(), patchBody)
+	if err != nil {
+		return nil, err
+	}
+	return models2.NewResourceFromJsonBytes(patchedJson)
+}
+
 // ConditionalUpdateHandler handles requests for conditional updates.  These requests contain search criteria for the
 // resource to update.  If the criteria results in no found resources, a new resource is created.  If the criteria
 // results in one found resource, that resource will be updated.  Criteria resulting in more than one found resource
@@ -297,6 +758,11 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 		}
 	}
 
+	warnings, err := rc.DAL.ValidateResource(c.Request.Context(), resource)
+	if err != nil {
+		panic(errors.Wrap(err, "ConditionalUpdateHandler ValidateResource failed"))
+	}
+
 	// Perform update
 	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
 	resourceId, createdNew, err := session.ConditionalPut(query, conditionalVersionId, resource)
@@ -316,10 +782,10 @@ func (rc *ResourceController) ConditionalUpdateHandler(c *gin.Context) {
 
 	if createdNew {
 		c.Set("Action", "create")
-		c.Render(http.StatusCreated, CustomFhirRenderer{resource, c})
+		rc.renderPreferredReturn(c, http.StatusCreated, resource, resourceId, warnings)
 	} else {
 		c.Set("Action", "update")
-		c.Render(http.StatusOK, CustomFhirRenderer{resource, c})
+		rc.renderPreferredReturn(c, http.StatusOK, resource, resourceId, warnings)
 	}
 }
 
@@ -330,8 +796,12 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 	defer session.Finish()
 
 	id := c.Param("id")
+	conditionalVersionId, ok := ifMatchVersionId(c)
+	if !ok {
+		return
+	}
 
-	newVersionId, err := session.Delete(id, rc.Name)
+	newVersionId, err := session.Delete(id, rc.Name, conditionalVersionId)
 	if err != nil && err != ErrNotFound {
 		panic(errors.Wrap(err, "Delete failed"))
 	}
@@ -347,16 +817,50 @@ func (rc *ResourceController) DeleteHandler(c *gin.Context) {
 }
 
 // ConditionalDeleteHandler handles requests to delete resources identified by search criteria.  All resources
-// matching the search criteria will be deleted.
+// matching the search criteria will be deleted, unless _dryRun=true is passed to only list them.
 func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	defer handlePanics(c)
 	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
 	defer session.Finish()
 
-	query := search.Query{Resource: rc.Name, Query: c.Request.URL.RawQuery}
-	_, err := session.ConditionalDelete(query)
-	if err != nil {
-		panic(errors.Wrap(err, "ConditionalDelete failed"))
+	dryRun := c.Query("_dryRun") == "true"
+	query := search.Query{Resource: rc.Name, Query: removeQueryParam(c.Request.URL.RawQuery, "_dryRun")}
+	if dryRun {
+		ids, err := session.FindIDs(query)
+		if err != nil {
+			panic(errors.Wrap(err, "FindIDs failed"))
+		}
+		c.Set("Resource", rc.Name)
+		c.Render(http.StatusOK, CustomFhirRenderer{dryRunDeleteOutcome(rc.Name, ids), c})
+		return
+	}
+
+	conditionalVersionId, ok := ifMatchVersionId(c)
+	if !ok {
+		return
+	}
+	if conditionalVersionId != "" {
+		// a version can only be expected of a single resource
+		ids, err := session.FindIDs(query)
+		if err != nil {
+			panic(errors.Wrap(err, "FindIDs failed"))
+		}
+		if len(ids) > 1 {
+			oo := models.NewOperationOutcome("error", "multiple-matches",
+				fmt.Sprintf("If-Match requires the search criteria to match a single resource but %d match", len(ids)))
+			c.Render(http.StatusPreconditionFailed, CustomFhirRenderer{oo, c})
+			return
+		}
+		for _, id := range ids {
+			if _, err := session.Delete(id, rc.Name, conditionalVersionId); err != nil && err != ErrNotFound {
+				panic(errors.Wrap(err, "Delete failed"))
+			}
+		}
+	} else {
+		_, err := session.ConditionalDelete(query)
+		if err != nil {
+			panic(errors.Wrap(err, "ConditionalDelete failed"))
+		}
 	}
 
 	c.Set("Resource", rc.Name)
@@ -365,6 +869,36 @@ func (rc *ResourceController) ConditionalDeleteHandler(c *gin.Context) {
 	c.Status(http.StatusNoContent)
 }
 
+// ifMatchVersionId returns the versionId expected by the If-Match header of a request, if any.
+// Invalid headers are rejected with a 400, returning false.
+func ifMatchVersionId(c *gin.Context) (versionId string, ok bool) {
+	ifMatch := c.GetHeader("If-Match")
+	if ifMatch == "" {
+		return "", true
+	}
+	versionId, err := utils.ETagToVersionId(ifMatch)
+	if err != nil {
+		oo := models.NewOperationOutcome("fatal", "structure", err.Error())
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{oo, c})
+		return "", false
+	}
+	return versionId, true
+}
+
+// dryRunDeleteOutcome returns an OperationOutcome listing the resources a conditional delete would remove
+func dryRunDeleteOutcome(resourceType string, ids []string) *models.OperationOutcome {
+	outcome := models.NewOperationOutcome("information", "informational",
+		fmt.Sprintf("Dry run: %d %s resources match and would be deleted", len(ids), resourceType))
+	for _, id := range ids {
+		outcome.Issue = append(outcome.Issue, models.OperationOutcomeIssueComponent{
+			Severity:    "information",
+			Code:        "informational",
+			Diagnostics: resourceType + "/" + id,
+		})
+	}
+	return outcome
+}
+
 func setHeaders(c *gin.Context, rc *ResourceController, setLocationHeader bool, resource *models2.Resource, id string) error {
 	lastUpdated := resource.LastUpdated()
 	if lastUpdated != "" {
@@ -387,6 +921,57 @@ func setHeaders(c *gin.Context, rc *ResourceController, setLocationHeader bool,
 	return nil
 }
 
+// renderPreferredReturn renders the response to a create or update as requested by the
+// Prefer header: nothing (return=minimal), an OperationOutcome (return=OperationOutcome)
+// or the resource itself (return=representation, the default). The warnings found by
+// ValidateResource are added to the OperationOutcome (they're logged in any case).
+func (rc *ResourceController) renderPreferredReturn(c *gin.Context, status int, resource *models2.Resource, id string, warnings []models.OperationOutcomeIssueComponent) {
+	switch preferredReturn(c) {
+	case "minimal":
+		c.Status(status)
+	case "OperationOutcome":
+		action := "updated"
+		if status == http.StatusCreated {
+			action = "created"
+		}
+		diagnostics := fmt.Sprintf("Successfully %s %s/%s", action, rc.Name, id)
+		if status == http.StatusOK && c.Request.Method == http.MethodPost && c.GetHeader("If-None-Exist") != "" {
+			// a conditional create that found the resource, which is left as it was
+			diagnostics = fmt.Sprintf("%s/%s matching If-None-Exist already exists", rc.Name, id)
+		}
+		if versionId := resource.VersionId(); versionId != "" {
+			diagnostics += " (version " + versionId + ")"
+		}
+		oo := models.NewOperationOutcome("information", "informational", diagnostics)
+		oo.Issue = append(oo.Issue, warnings...)
+		c.Render(status, CustomFhirRenderer{oo, c})
+	default:
+		c.Render(status, CustomFhirRenderer{resource, c})
+	}
+}
+
+// preferredReturn returns the value of the return preference in the Prefer header, if any
+// (e.g. "minimal" for "Prefer: return=minimal")
+func preferredReturn(c *gin.Context) string {
+	return preferenceValue(c, "return")
+}
+
+// preferenceValue returns the value of a preference in the Prefer header, if any
+func preferenceValue(c *gin.Context, preferenceName string) string {
+	for _, header := range c.Request.Header["Prefer"] {
+		for _, preference := range strings.FieldsFunc(header, func(r rune) bool { return r == ',' || r == ';' }) {
+			name, value := preference, ""
+			if equals := strings.Index(preference, "="); equals >= 0 {
+				name, value = preference[:equals], preference[equals+1:]
+			}
+			if strings.TrimSpace(name) == preferenceName {
+				return strings.Trim(strings.TrimSpace(value), "\"")
+			}
+		}
+	}
+	return ""
+}
+
 // CustomFhirRenderer replaces gin's default JSON renderer and ensures
 // that the special characters "<", ">", and "&" are not escaped after the
 // the JSON is marshaled. Escaping these special HTML characters is the default
@@ -5,10 +5,12 @@ package server
 import (
 	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/contrib/sessions"
 	"github.com/gin-gonic/gin"
 	"github.com/eug48/fhir/auth"
+	"github.com/eug48/fhir/search"
 	"github.com/mitre/heart"
 	"golang.org/x/oauth2"
 )
@@ -32,29 +34,91 @@ func RegisterController(name string, e *gin.Engine, m []gin.HandlerFunc, dal Dat
 	}
 
 	rcBase.GET("", rc.IndexHandler)
-	rcBase.POST("/_search", rc.IndexHandler)
+	rcBase.POST("/:id", rc.TypeOperationHandler) // _search and $validate
 	rcBase.POST("", rc.CreateHandler)
 	rcBase.PUT("", rc.ConditionalUpdateHandler)
+	rcBase.PATCH("", rc.ConditionalPatchHandler)
 	rcBase.DELETE("", rc.ConditionalDeleteHandler)
 
 	rcItem := rcBase.Group("/:id")
 	rcItem.GET("", rc.ShowHandler)
-	if config.EnableHistory {
-		rcItem.GET("/_history/:vid", rc.ShowHandler)
-		rcItem.GET("/_history", rc.HistoryHandler)
-	}
 	rcItem.PUT("", rc.UpdateHandler)
+	rcItem.PATCH("", rc.PatchHandler)
 	rcItem.DELETE("", rc.DeleteHandler)
+	rcItem.POST("/$validate", rc.ValidateHandler)
+	rcItem.POST("/$graphql", rc.GraphQLHandler)
+	rcItem.POST("/$meta-add", rc.MetaAddHandler)
+	rcItem.POST("/$meta-delete", rc.MetaDeleteHandler)
+	for _, operation := range config.Operations.names(InstanceLevel) {
+		rcItem.POST("/$"+operation, rc.OperationHandler(operation, InstanceLevel))
+	}
+
+	if search.IsCompartmentType(name) {
+		// compartment searches (e.g. /Patient/123/Condition) can't be routed separately
+		// from _history and $everything, so CompartmentHandler dispatches those too
+		rcItem.GET("/:type", rc.CompartmentHandler)
+		if config.EnableHistory {
+			rcItem.GET("/:type/:vid", rc.CompartmentHandler)
+		}
+	} else {
+		if config.EnableHistory {
+			rcItem.GET("/_history/:vid", rc.ShowHandler)
+			rcItem.GET("/_history", rc.HistoryHandler)
+		}
+
+		if name == "Encounter" {
+			everythingItem := rcItem.Group("/$everything")
+			everythingItem.GET("", rc.EverythingHandler)
+		}
+
+		rcItem.GET("/$graphql", rc.GraphQLHandler)
+		rcItem.GET("/$meta", rc.MetaHandler)
+
+		if name == "Group" && config.BulkExportDir != "" {
+			rcItem.GET("/$export", rc.ExportHandler)
+		}
 
-	if name == "Patient" || name == "Encounter" {
-		everythingItem := rcItem.Group("/$everything")
-		everythingItem.GET("", rc.EverythingHandler)
+		for _, operation := range config.Operations.names(InstanceLevel) {
+			rcItem.GET("/$"+operation, rc.OperationHandler(operation, InstanceLevel))
+		}
+	}
+}
+
+// NormalizedPathHandler handles requests that didn't match a route by removing any trailing
+// slash and, if caseInsensitive, correcting the case of the resource type before routing them again
+func NormalizedPathHandler(e *gin.Engine, caseInsensitive bool) gin.HandlerFunc {
+	resourceTypes := make(map[string]string)
+	if caseInsensitive {
+		for _, resourceType := range registeredResourceTypes() {
+			resourceTypes[strings.ToLower(resourceType)] = resourceType
+		}
+	}
+
+	return func(c *gin.Context) {
+		path := c.Request.URL.Path
+		normalized := "/" + strings.Trim(path, "/")
+
+		if caseInsensitive {
+			segments := strings.SplitN(normalized, "/", 3)
+			if resourceType, found := resourceTypes[strings.ToLower(segments[1])]; found {
+				segments[1] = resourceType
+				normalized = strings.Join(segments, "/")
+			}
+		}
+
+		if normalized == path {
+			return // not found
+		}
+		c.Request.URL.Path = normalized
+		e.HandleContext(c)
 	}
 }
 
 // RegisterRoutes registers the routes for each of the FHIR resources
 func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal DataAccessLayer, serverConfig Config) {
 
+	e.Use(RequestIDMiddleware)
+
 	switch serverConfig.Auth.Method {
 	case auth.AuthTypeNone:
 		// do nothing
@@ -121,6 +185,10 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 		})
 	}
 
+	// Paths with a trailing slash (e.g. /Patient/) are handled like those without rather than redirected
+	e.RedirectTrailingSlash = false
+	e.NoRoute(NormalizedPathHandler(e, serverConfig.CaseInsensitiveResourceTypes))
+
 	// Batch Support
 	batch := NewBatchController(dal, serverConfig)
 	batchHandlers := make([]gin.HandlerFunc, len(config["Batch"]))
@@ -128,13 +196,50 @@ func RegisterRoutes(e *gin.Engine, config map[string][]gin.HandlerFunc, dal Data
 	batchHandlers = append(batchHandlers, batch.Post)
 	e.POST("/", batchHandlers...)
 
+	// Metrics of the data access operations
+	if handler, ok := serverConfig.MetricsRecorder.(http.Handler); ok && serverConfig.EnableMetrics {
+		e.GET("/metrics", gin.WrapH(handler))
+	}
+
+	// System-level history
+	if serverConfig.EnableHistory {
+		e.GET("/_history", SystemHistoryHandler(dal, serverConfig))
+	}
+
+	// Bulk data export
+	if serverConfig.BulkExportDir != "" {
+		e.GET("/$export", SystemExportHandler(dal, serverConfig))
+		e.GET("/$export-status/:job", ExportStatusHandler)
+		e.DELETE("/$export-status/:job", ExportStatusHandler)
+		e.GET("/$export-file/:job/:file", ExportFileHandler)
+	}
+
+	// Format conversion
+	e.POST("/$convert", ConvertHandler)
+
+	// GraphQL
+	e.GET("/$graphql", SystemGraphQLHandler(dal, serverConfig))
+	e.POST("/$graphql", SystemGraphQLHandler(dal, serverConfig))
+
+	// Custom system-level operations (those of types and resources are routed by their controllers)
+	for _, operation := range serverConfig.Operations.names(SystemLevel) {
+		e.GET("/$"+operation, SystemOperationHandler(dal, serverConfig, operation))
+		e.POST("/$"+operation, SystemOperationHandler(dal, serverConfig, operation))
+	}
+
 	// Conformance Statement
-	e.StaticFile("metadata", "conformance/capability_statement.json")
+	e.GET("/metadata", CapabilityStatementHandler(serverConfig))
 
-	// Redirect server root to /metadata
+	// Search across resource types, otherwise redirect server root to /metadata
+	systemSearch := SystemSearchHandler(dal, serverConfig)
 	e.GET("/", func(c *gin.Context) {
+		if c.Request.URL.RawQuery != "" {
+			systemSearch(c)
+			return
+		}
 		c.Redirect(http.StatusPermanentRedirect, "/metadata")
 	})
+	e.POST("/_search", systemSearch)
 
 	// Resources
 	RegisterController("Account", e, config["Account"], dal, serverConfig)
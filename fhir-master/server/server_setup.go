@@ -12,6 +12,7 @@ import (
 	cors "github.com/itsjamie/gin-cors"
 	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 
 	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
@@ -38,7 +39,8 @@ func (f *FHIRServer) AddMiddleware(key string, middleware gin.HandlerFunc) {
 //
 // To run a handler against ALL resources pass "*" as the resourceType.
 //
-// Supported database operations are: "Create", "Update", "Delete"
+// Supported database operations are: "Create", "Update", "Delete" (see AddResultInterceptor for searches
+// and AddValidationInterceptor for checking resources before they're stored)
 func (f *FHIRServer) AddInterceptor(op, resourceType string, handler InterceptorHandler) error {
 
 	if op == "Create" || op == "Update" || op == "Delete" {
@@ -48,7 +50,24 @@ func (f *FHIRServer) AddInterceptor(op, resourceType string, handler Interceptor
 	return fmt.Errorf("AddInterceptor: unsupported database operation %s", op)
 }
 
+// AddResultInterceptor adds an interceptor run on the resources of a FHIR resource type found by searches
+// before they're returned (see ResultInterceptor), which can leave them out or modify them.
+// To run it on the resources of ALL types pass "*" as the resourceType.
+func (f *FHIRServer) AddResultInterceptor(resourceType string, handler ResultInterceptor) {
+	f.Interceptors["Search"] = append(f.Interceptors["Search"], Interceptor{ResourceType: resourceType, ResultHandler: handler})
+}
+
+// AddValidationInterceptor adds an interceptor checking the resources of a FHIR resource type before they're
+// created or updated (see ValidationInterceptor), which can reject them or return warnings to the client,
+// e.g. a TerminologyInterceptor. To run it on the resources of ALL types pass "*" as the resourceType.
+func (f *FHIRServer) AddValidationInterceptor(resourceType string, handler ValidationInterceptor) {
+	f.Interceptors["Validate"] = append(f.Interceptors["Validate"], Interceptor{ResourceType: resourceType, ValidationHandler: handler})
+}
+
 func NewServer(config Config) *FHIRServer {
+	if config.EnableMetrics && config.MetricsRecorder == nil {
+		config.MetricsRecorder = NewPrometheusMetrics()
+	}
 	server := &FHIRServer{
 		Config:           config,
 		MiddlewareConfig: make(map[string][]gin.HandlerFunc),
@@ -65,25 +84,31 @@ func NewServer(config Config) *FHIRServer {
 
 	server.Engine.Use(cors.Middleware(cors.Config{
 		Origins:         "*",
-		Methods:         "GET, PUT, POST, DELETE",
+		Methods:         "GET, PUT, POST, PATCH, DELETE",
 		RequestHeaders:  "Origin, Authorization, Content-Type, If-Match, If-None-Exist",
-		ExposedHeaders:  "Location, ETag, Last-Modified",
+		ExposedHeaders:  "Location, ETag, Last-Modified, X-GoFHIR-Previous-Version, X-GoFHIR-Next-Version",
 		MaxAge:          86400 * time.Second, // Preflight expires after 1 day
 		Credentials:     true,
 		ValidateHeaders: false,
 	}))
 
+	server.Engine.Use(InvalidFormatParamMiddleware(config.FormatParamHandling))
 	if config.EnableXML {
 		server.Engine.Use(EnableXmlToJsonConversionMiddleware())
-		server.Engine.Use(AbortNonFhirXMLorJSONRequestsMiddleware)
+		server.Engine.Use(AbortNonFhirXMLorJSONRequestsWithDefaultMiddleware(config.DefaultResponseFormat))
 	} else {
 		server.Engine.Use(AbortNonJSONRequestsMiddleware)
 	}
+	server.Engine.Use(FhirVersionMiddleware(config.EnableFhirVersionConversion))
 
 	if config.ReadOnly {
 		server.Engine.Use(ReadOnlyMiddleware)
 	}
 
+	if config.CaptureFailedRequests && config.FailedRequestsDir != "" {
+		server.Engine.Use(FailedRequestCaptureMiddleware(config.FailedRequestsDir))
+	}
+
 	return server
 }
 
@@ -129,6 +154,10 @@ func (f *FHIRServer) InitEngine() {
 	// Pre-create collections for transactions
 	db := client.Database(f.Config.DefaultDatabaseName)
 	CreateCollections(db)
+	err = ShardCollections(context.Background(), db, resourceCollectionNames(), f.Config.ShardKey)
+	if err != nil {
+		panic(errors.Wrap(err, "sharding collections"))
+	}
 
 	// Ensure all indexes
 	if f.Config.CreateIndexes {
@@ -163,7 +192,8 @@ func (f *FHIRServer) InitEngine() {
 				db := client.Database(databaseName)
 				count, err := db.Collection("countcache").CountDocuments(context.Background(), nil)
 				if count > 0 || err != nil {
-					err = db.Collection("countcache").Drop(context.Background())
+					// the documents are deleted rather than dropping the collection, which would drop its index too
+					_, err = db.Collection("countcache").DeleteMany(context.Background(), bson.D{})
 					if err != nil {
 						panic(fmt.Sprintf("Server: Failed to clear count cache (%+v)", err))
 					}
@@ -195,6 +225,10 @@ func (f *FHIRServer) InitDB(databaseName string) {
 	// Pre-create collections for transactions
 	db := client.Database(databaseName)
 	CreateCollections(db)
+	err = ShardCollections(context.Background(), db, resourceCollectionNames(), f.Config.ShardKey)
+	if err != nil {
+		panic(errors.Wrap(err, "sharding collections"))
+	}
 
 	// Ensure all indexes
 	if f.Config.CreateIndexes {
@@ -202,6 +236,15 @@ func (f *FHIRServer) InitDB(databaseName string) {
 	}
 }
 
+// resourceCollectionNames returns the names of the current and previous version collections of all resources
+func resourceCollectionNames() []string {
+	var names []string
+	for _, name := range models2.AllFhirResourceCollectionNames() {
+		names = append(names, name, name+"_prev")
+	}
+	return names
+}
+
 func CreateCollections(db *mongowrapper.WrappedDatabase) {
 	// MongoDB transactions require that collections be pre-created
 	for _, name := range models2.AllFhirResourceCollectionNames() {
@@ -215,4 +258,10 @@ func CreateCollections(db *mongowrapper.WrappedDatabase) {
 			panic(res.Err())
 		}
 	}
+
+	// writes remove the cached counts of their resource type
+	_, err := db.Collection("countcache").Indexes().CreateOne(context.Background(), mongo.IndexModel{Keys: bson.D{{"resource", 1}}})
+	if err != nil {
+		panic(errors.Wrap(err, "creating the countcache index"))
+	}
 }
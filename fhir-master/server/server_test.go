@@ -13,11 +13,13 @@ import (
 	"os"
 	"path"
 	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
 	"github.com/eug48/fhir/search"
 	"github.com/gin-gonic/gin"
 	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
@@ -111,7 +113,165 @@ func (s *ServerSuite) TestGetPatientsWithOptions(c *C) {
 	assertBundleCount(c, s.Server.URL+"/Patient?_offset=2", 3, 5)
 	assertBundleCount(c, s.Server.URL+"/Patient?_count=2&_offset=1", 2, 5)
 	assertBundleCount(c, s.Server.URL+"/Patient?_count=2&_offset=4", 1, 5)
-	assertBundleCount(c, s.Server.URL+"/Patient?_offset=100", 0, 5)
+	// only an OperationOutcome noting the offset is past the end
+	assertBundleCount(c, s.Server.URL+"/Patient?_offset=100", 1, 5)
+}
+
+func (s *ServerSuite) TestPostSearchPagingLinks(c *C) {
+	for i := 0; i < 2; i++ {
+		s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	}
+	postSearch := func(url string, body string) *models.Bundle {
+		res, err := http.Post(url, "application/x-www-form-urlencoded", strings.NewReader(body))
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		bundle := &models.Bundle{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+		return bundle
+	}
+
+	// the parameters in the URL are used along with those in the body
+	bundle := postSearch(s.Server.URL+"/Patient/_search?_count=2", "gender=male")
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(*bundle.Total, Equals, uint32(3))
+	v := url.Values{"gender": []string{"male"}}
+	assertPagingLinkWithParams(c, bundle.Link[0], "self", v, 2, 0)
+	assertPagingLinkWithParams(c, bundle.Link[2], "next", v, 2, 2)
+
+	// the next link can be followed with a GET ...
+	next := bundle.Link[2].Url
+	assertBundleCount(c, next, 1, 3)
+
+	// ... or by POSTing its query to _search
+	nextURL, err := url.Parse(next)
+	util.CheckErr(err)
+	bundle = postSearch(s.Server.URL+"/Patient/_search", nextURL.RawQuery)
+	c.Assert(bundle.Entry, HasLen, 1)
+	bundle = postSearch(s.Server.URL+"/Patient/_search?"+nextURL.RawQuery, "")
+	c.Assert(bundle.Entry, HasLen, 1)
+}
+
+func (s *ServerSuite) TestSystemSearchAcrossTypes(c *C) {
+	s.DB().C("conditions").DropCollection()
+	since := time.Now().UTC().Add(-time.Second).Format(time.RFC3339)
+
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","gender":"female"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+	patientID := resourceIdFromLocation(res)
+	res, err = http.Post(s.Server.URL+"/Condition", "application/json", strings.NewReader(`{"resourceType":"Condition","verificationStatus":"confirmed","subject":{"reference":"Patient/`+patientID+`"}}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+
+	// the patient of the fixture wasn't updated recently
+	bundle := assertBundleCount(c, s.Server.URL+"/?_type=Patient,Condition&_lastUpdated=gt"+since, 2, 2)
+	c.Assert(bundle.Type, Equals, "searchset")
+	_, isPatient := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(isPatient, Equals, true)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Patient/"+patientID)
+	_, isCondition := bundle.Entry[1].Resource.(*models.Condition)
+	c.Assert(isCondition, Equals, true)
+	self, _ := url.Parse(bundle.Link[0].Url)
+	c.Assert(self.Query().Get("_type"), Equals, "Patient,Condition")
+
+	// _count applies to each type
+	bundle = assertBundleCount(c, s.Server.URL+"/?_type=Patient,Condition&_count=1", 2, 3)
+	c.Assert(hasLinkRelation(bundle.Link, "next"), Equals, true)
+
+	// and POST to _search
+	res, err = http.Post(s.Server.URL+"/_search", "application/x-www-form-urlencoded", strings.NewReader("_type=Condition&_lastUpdated=gt"+url.QueryEscape(since)))
+	util.CheckErr(err)
+	bundle = &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	res.Body.Close()
+	c.Assert(*bundle.Total, Equals, uint32(1))
+
+	// the types have to be given
+	for _, query := range []string{"_lastUpdated=gt" + since, "_type=Patient,Nonsense"} {
+		res, err = http.Get(s.Server.URL + "/?" + query)
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 400)
+	}
+}
+
+// taggedResultsFilter is a ResultInterceptor leaving out the resources with a tag
+type taggedResultsFilter struct {
+	code string
+}
+
+func (f taggedResultsFilter) FilterResult(ctx context.Context, resource *models2.Resource) (*models2.Resource, error) {
+	meta, err := resourceMeta(resource)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range meta.Tag {
+		if tag.Code == f.code {
+			return nil, nil
+		}
+	}
+	return resource, nil
+}
+
+func (s *ServerSuite) TestSearchResultInterceptor(c *C) {
+	s.DB().C("conditions").DropCollection()
+	interceptors := map[string]InterceptorList{
+		"Search": {{ResourceType: "*", ResultHandler: taggedResultsFilter{"restricted"}}},
+	}
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", interceptors, DefaultConfig), DefaultConfig)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	create := func(resourceType string, body string) string {
+		res, err := http.Post(server.URL+"/"+resourceType, "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 201)
+		return resourceIdFromLocation(res)
+	}
+	restrictedID := create("Patient", `{"resourceType":"Patient","gender":"female","meta":{"tag":[{"system":"http://example.com/tags","code":"restricted"}]}}`)
+	create("Patient", `{"resourceType":"Patient","gender":"female"}`)
+	create("Condition", `{"resourceType":"Condition","verificationStatus":"confirmed","subject":{"reference":"Patient/`+restrictedID+`"}}`)
+
+	bundle := performSearch(c, server.URL+"/Patient?gender=female")
+	c.Assert(bundle.Entry, HasLen, 1)
+	patient, ok := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(ok, Equals, true)
+	c.Assert(patient.Id, Not(Equals), restrictedID)
+
+	// nor are the resources included with other resources
+	bundle = performSearch(c, server.URL+"/Condition?_include=Condition:subject")
+	c.Assert(bundle.Entry, HasLen, 1)
+	_, ok = bundle.Entry[0].Resource.(*models.Condition)
+	c.Assert(ok, Equals, true)
+
+	// nor by $lastn
+	observation := `{"resourceType":"Observation","status":"final",%s"code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},` +
+		`"subject":{"reference":"Patient/` + restrictedID + `"},"effectiveDateTime":"%s"}`
+	create("Observation", fmt.Sprintf(observation, `"meta":{"tag":[{"code":"restricted"}]},`, "2018-03-01T10:00:00Z"))
+	olderID := create("Observation", fmt.Sprintf(observation, "", "2018-01-01T10:00:00Z"))
+	bundle = performSearch(c, server.URL+"/Observation/$lastn?patient="+restrictedID+"&max=2")
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(bundle.Entry[0].Resource.(*models.Observation).Id, Equals, olderID)
+
+	// nor by $everything, which still pages through all of the related resources
+	everything := performEverything(c, server.URL+"/Patient/"+restrictedID+"/$everything?_count=2")
+	c.Assert(*everything.Total, Equals, uint32(4))
+	c.Assert(everything.Entry, HasLen, 1)
+	c.Assert(everything.Entry[0].Resource["resourceType"], Equals, "Condition")
+	assertPagingLink(c, everything.Link[2], "next", 2, 2)
+	everything = performEverything(c, everything.Link[2].Url)
+	c.Assert(everything.Entry, HasLen, 1)
+	c.Assert(everything.Entry[0].Resource["id"], Equals, olderID)
+
+	// but they're still returned without the interceptor
+	bundle = performSearch(c, s.Server.URL+"/Patient?gender=female")
+	c.Assert(bundle.Entry, HasLen, 2)
 }
 
 func (s *ServerSuite) TestGetPatientsDefaultLimitIs100(c *C) {
@@ -200,13 +360,21 @@ func (s *ServerSuite) TestGetPatientsPaging(c *C) {
 	assertPagingLink(c, bundle.Link[1], "first", 10, 0)
 	assertPagingLink(c, bundle.Link[2], "previous", 10, 990)
 	assertPagingLink(c, bundle.Link[3], "last", 10, 30)
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Entry[0].Search.Mode, Equals, "outcome")
+	outcome, ok := bundle.Entry[0].Resource.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "The offset (1000) exceeds the total number of results (40)")
 
-	// Search with negative offset
+	// Search with negative offset, which is ignored with a warning
 	bundle = performSearch(c, s.Server.URL+"/Patient?_offset=-10")
 	c.Assert(bundle.Link, HasLen, 3)
 	assertPagingLink(c, bundle.Link[0], "self", 100, 0)
 	assertPagingLink(c, bundle.Link[1], "first", 100, 0)
 	assertPagingLink(c, bundle.Link[2], "last", 100, 0)
+	assertSearchWarning(c, bundle, "Parameter \"_offset\" was ignored as it is negative (-10)")
 
 	// Search with negative count
 	bundle = performSearch(c, s.Server.URL+"/Patient?_count=-10")
@@ -214,6 +382,243 @@ func (s *ServerSuite) TestGetPatientsPaging(c *C) {
 	assertPagingLink(c, bundle.Link[0], "self", 100, 0)
 	assertPagingLink(c, bundle.Link[1], "first", 100, 0)
 	assertPagingLink(c, bundle.Link[2], "last", 100, 0)
+	assertSearchWarning(c, bundle, "Parameter \"_count\" was ignored as it is negative (-10)")
+}
+
+func (s *ServerSuite) TestMaxResultCount(c *C) {
+	config := DefaultConfig
+	config.MaxResultCount = 5
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	for i := 0; i < 7; i++ {
+		s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	}
+
+	// the page has at most 5 results, followed by the warning
+	bundle := performSearch(c, server.URL+"/Patient?_count=100000")
+	c.Assert(*bundle.Total, Equals, uint32(8))
+	c.Assert(bundle.Entry, HasLen, 6)
+	for _, entry := range bundle.Entry[:5] {
+		c.Assert(entry.Search.Mode, Equals, "match")
+	}
+	assertSearchWarning(c, bundle, "Parameter \"_count\" was reduced from 100000 to the maximum of 5")
+	assertPagingLink(c, bundle.Link[0], "self", 5, 0)
+	assertPagingLink(c, bundle.Link[2], "next", 5, 5)
+
+	// history pages are limited likewise
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	for i := 0; i < 6; i++ {
+		req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+s.FixtureID, bytes.NewReader(data))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+	bundle = assertBundleCount(c, server.URL+"/Patient/"+s.FixtureID+"/_history?_count=100000", 5, 7)
+	assertPagingLink(c, bundle.Link[0], "self", 5, 0)
+}
+
+func (s *ServerSuite) TestLoggerReceivesPuts(c *C) {
+	logger := &capturingLogger{}
+	config := DefaultConfig
+	config.Logger = logger
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config)
+
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	resource, err := models2.NewResourceFromJsonBytes(data)
+	util.CheckErr(err)
+	session := dal.StartSession(context.TODO(), s.dbname)
+	defer session.Finish()
+	_, err = session.Put(s.FixtureID, "", resource)
+	util.CheckErr(err)
+
+	infos := logger.withLevel("info")
+	c.Assert(infos, HasLen, 1)
+	c.Assert(infos[0].message, Equals, "updated Patient/"+s.FixtureID)
+	c.Assert(infos[0].fields["resourceType"], Equals, "Patient")
+	c.Assert(infos[0].fields["id"], Equals, s.FixtureID)
+	c.Assert(infos[0].fields["versionId"], Equals, 2)
+}
+
+func (s *ServerSuite) TestMetricsRecorderCountsGets(c *C) {
+	metrics := &inMemoryMetrics{}
+	config := DefaultConfig
+	config.MetricsRecorder = metrics
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config)
+
+	session := dal.StartSession(context.TODO(), s.dbname)
+	defer session.Finish()
+	_, err := session.Get(s.FixtureID, "Patient")
+	util.CheckErr(err)
+	c.Assert(metrics.count("Get", "Patient"), Equals, 1)
+	c.Assert(metrics.operations[0].err, IsNil)
+
+	_, err = session.Get(bson.NewObjectId().Hex(), "Patient")
+	c.Assert(err, Equals, ErrNotFound)
+	c.Assert(metrics.count("Get", "Patient"), Equals, 2)
+	c.Assert(metrics.operations[1].err, Equals, ErrNotFound)
+
+	// the reads done by other operations aren't counted as Gets
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	resource, err := models2.NewResourceFromJsonBytes(data)
+	util.CheckErr(err)
+	_, err = session.Put(s.FixtureID, "", resource)
+	util.CheckErr(err)
+	c.Assert(metrics.count("Put", "Patient"), Equals, 1)
+	c.Assert(metrics.count("Get", "Patient"), Equals, 2)
+
+	_, err = session.Search(url.URL{}, search.Query{Resource: "Condition"})
+	util.CheckErr(err)
+	c.Assert(metrics.count("Search", "Condition"), Equals, 1)
+	c.Assert(metrics.operations, HasLen, 4)
+}
+
+func (s *ServerSuite) TestMetricsEndpoint(c *C) {
+	config := DefaultConfig
+	config.EnableMetrics = true
+	config.MetricsRecorder = NewPrometheusMetrics()
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/Patient/" + s.FixtureID)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	res, err = http.Get(server.URL + "/metrics")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	body, err := ioutil.ReadAll(res.Body)
+	util.CheckErr(err)
+	c.Assert(string(body), Matches, `(?s).*\nfhir_dal_operations_total\{operation="Get",resource_type="Patient"\} 1\n.*`)
+	c.Assert(string(body), Matches, `(?s).*\nfhir_dal_operation_errors_total\{operation="Get",resource_type="Patient"\} 0\n.*`)
+}
+
+// terminologyTestServer serves a DAL with a TerminologyInterceptor checking Observation.code
+func (s *ServerSuite) terminologyTestServer(severity string) *httptest.Server {
+	interceptor := &TerminologyInterceptor{
+		Bindings:  map[string]string{"Observation.code": vitalSignsValueSet},
+		Validator: testTerminologyValidator,
+		Severity:  severity,
+	}
+	interceptors := map[string]InterceptorList{
+		"Validate": {{ResourceType: "Observation", ValidationHandler: interceptor}},
+	}
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", interceptors, DefaultConfig), DefaultConfig)
+	return httptest.NewServer(engine)
+}
+
+func (s *ServerSuite) TestTerminologyValidatorRejectsUnknownCode(c *C) {
+	s.DB().C("observations").DropCollection()
+	server := s.terminologyTestServer(TerminologySeverityError)
+	defer server.Close()
+
+	create := func(code string) *http.Response {
+		body := `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"` + code + `"}]}}`
+		res, err := http.Post(server.URL+"/Observation", "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		return res
+	}
+
+	res := create("1234-5")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "error")
+	c.Assert(outcome.Issue[0].Code, Equals, "code-invalid")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Observation.code http://loinc.org|1234-5 is not in the value set "+vitalSignsValueSet)
+	count, err := s.DB().C("observations").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 0)
+
+	res = create("8867-4")
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+	observationID := resourceIdFromLocation(res)
+
+	// updates are checked too
+	body := `{"resourceType":"Observation","id":"` + observationID + `","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}}`
+	req, err := http.NewRequest("PUT", server.URL+"/Observation/"+observationID, strings.NewReader(body))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// transactions are rejected before any of their entries is stored
+	transaction := `{"resourceType":"Bundle","type":"transaction","entry":[
+		{"resource":{"resourceType":"Patient"},"request":{"method":"POST","url":"Patient"}},
+		{"resource":{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}},
+		 "request":{"method":"POST","url":"Observation"}}]}`
+	patients, err := s.DB().C("patients").Count()
+	util.CheckErr(err)
+	res, err = http.Post(server.URL+"/", "application/json", strings.NewReader(transaction))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	count, err = s.DB().C("patients").Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, patients)
+}
+
+func (s *ServerSuite) TestTerminologyValidatorWarnings(c *C) {
+	server := s.terminologyTestServer(TerminologySeverityWarning)
+	defer server.Close()
+	body := `{"resourceType":"Observation","status":"final","code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}}`
+
+	// the resource is stored and returned as usual
+	res, err := http.Post(server.URL+"/Observation", "application/json", strings.NewReader(body))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	observation := &models.Observation{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(observation))
+	res.Body.Close()
+	c.Assert(observation.Status, Equals, "final")
+	c.Assert(s.DB().C("observations").FindId(resourceIdFromLocation(res)).One(&models.Observation{}), IsNil)
+
+	// with the warnings in the OperationOutcome if the client asks for one
+	req, err := http.NewRequest("POST", server.URL+"/Observation", strings.NewReader(body))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=OperationOutcome")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	res.Body.Close()
+	c.Assert(outcome.Issue, HasLen, 2)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+	c.Assert(outcome.Issue[1].Severity, Equals, "warning")
+	c.Assert(outcome.Issue[1].Diagnostics, Equals, "Observation.code http://loinc.org|1234-5 is not in the value set "+vitalSignsValueSet)
+
+	// and in the outcomes of batch entries
+	batch := `{"resourceType":"Bundle","type":"batch","entry":[{"resource":` + body + `,"request":{"method":"POST","url":"Observation"}}]}`
+	res, err = http.Post(server.URL+"/", "application/json", strings.NewReader(batch))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	responseBundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(responseBundle))
+	res.Body.Close()
+	c.Assert(responseBundle.Entry[0].Response.Status, Equals, "201")
+	outcome, ok := responseBundle.Entry[0].Response.Outcome.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "warning")
 }
 
 func (s *ServerSuite) TestPatientPagingWithCountsDisabled(c *C) {
@@ -247,6 +652,535 @@ func (s *ServerSuite) TestPatientPagingWithCountsDisabled(c *C) {
 	c.Assert(links[1].Relation, Equals, "first")
 }
 
+func hasLinkRelation(links []models.BundleLinkComponent, relation string) bool {
+	for _, link := range links {
+		if link.Relation == relation {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *ServerSuite) TestSearchTotalParam(c *C) {
+	// _total=none skips the count, so there's no last link either
+	bundle := performSearch(c, s.Server.URL+"/Patient?_total=none")
+	c.Assert(bundle.Total, IsNil)
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, false)
+
+	bundle = performSearch(c, s.Server.URL+"/Patient?_total=accurate")
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, true)
+
+	// estimates come from the collection's metadata for searches without criteria
+	bundle = performSearch(c, s.Server.URL+"/Patient?_total=estimate")
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, true)
+
+	// and are counted otherwise
+	bundle = performSearch(c, s.Server.URL+"/Patient?_id="+s.FixtureID+"&_total=estimate")
+	c.Assert(*bundle.Total, Equals, uint32(1))
+
+	res, err := http.Get(s.Server.URL + "/Patient?_total=maybe")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *ServerSuite) TestSearchTotalParamWithCountsDisabled(c *C) {
+	config := DefaultConfig
+	config.CountTotalResults = false
+	dal, ok := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config).(*mongoDataAccessLayer)
+	c.Assert(ok, Equals, true)
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   "fhir.example.com",
+		Path:   "fhir/Patient",
+	}
+	session := dal.StartSession(context.TODO(), s.dbname).(*mongoSession)
+	defer session.Finish()
+
+	bundle, err := session.Search(u, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(bundle.Total, IsNil)
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, false)
+
+	// _total=accurate counts anyway
+	bundle, err = session.Search(u, search.Query{Resource: "Patient", Query: "_total=accurate"})
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, true)
+}
+
+func (s *ServerSuite) TestCountCacheInvalidatedOnWrites(c *C) {
+	config := DefaultConfig
+	config.ReadOnly = true // counts are only cached in read-only mode
+	dal, ok := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config).(*mongoDataAccessLayer)
+	c.Assert(ok, Equals, true)
+
+	u := url.URL{
+		Scheme: "https",
+		Host:   "fhir.example.com",
+		Path:   "fhir/Patient",
+	}
+	session := dal.StartSession(context.TODO(), s.dbname).(*mongoSession)
+	defer session.Finish()
+
+	bundle, err := session.Search(u, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	cached, err := session.db.Collection("countcache").CountDocuments(context.TODO(), bson.M{"resource": "Patient"})
+	util.CheckErr(err)
+	c.Assert(cached, Equals, int64(1))
+
+	resource, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType":"Patient","gender":"other"}`))
+	util.CheckErr(err)
+	id, err := session.Post(resource)
+	util.CheckErr(err)
+
+	bundle, err = session.Search(u, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(2))
+
+	_, err = session.Delete(id, "Patient", "")
+	util.CheckErr(err)
+
+	bundle, err = session.Search(u, search.Query{Resource: "Patient"})
+	util.CheckErr(err)
+	c.Assert(*bundle.Total, Equals, uint32(1))
+
+	// writes in a transaction invalidate the cached counts once it's committed
+	util.CheckErr(session.StartTransaction())
+	_, err = session.Post(resource)
+	util.CheckErr(err)
+	cached, err = session.db.Collection("countcache").CountDocuments(context.TODO(), bson.M{"resource": "Patient"})
+	util.CheckErr(err)
+	c.Assert(cached, Equals, int64(1))
+	util.CheckErr(session.CommmitIfTransaction())
+	cached, err = session.db.Collection("countcache").CountDocuments(context.TODO(), bson.M{"resource": "Patient"})
+	util.CheckErr(err)
+	c.Assert(cached, Equals, int64(0))
+}
+
+func (s *ServerSuite) TestDefaultSearchFilters(c *C) {
+	inactive := s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	active := false
+	inactive.Active = &active
+	util.CheckErr(s.DB().C("patients").UpdateId(inactive.Id, inactive))
+
+	config := DefaultConfig
+	config.DefaultSearchFilters = map[string]string{"Patient": "active=true"}
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	// the filter is disclosed in the self link and an OperationOutcome
+	bundle := performSearch(c, server.URL+"/Patient")
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, s.FixtureID)
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "outcome")
+	outcome, ok := bundle.Entry[1].Resource.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(outcome.Issue[0].Severity, Equals, "warning")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Default search filters were applied: active=true")
+	c.Assert(bundle.Link[0].Relation, Equals, "self")
+	c.Assert(strings.Contains(bundle.Link[0].Url, "active=true"), Equals, true)
+
+	// but not applied to searches using the parameter already
+	bundle = performSearch(c, server.URL+"/Patient?active=false")
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, inactive.Id)
+}
+
+func (s *ServerSuite) TestSearchWarningOutcomes(c *C) {
+	observation := `{"resourceType": "Observation", "status": "final", "code": {"text": "Weight"}, "subject": {"reference": "Patient/5c0000000000000000000000"}}`
+	res, err := http.Post(s.Server.URL+"/Observation", "application/json", strings.NewReader(observation))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	observationID := resourceIdFromLocation(res)
+
+	// the subject can't be included as it doesn't exist, and _count is reduced to the maximum
+	bundle := performSearch(c, s.Server.URL+"/Observation?_id="+observationID+"&_include=Observation:subject&_count=5000")
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Entry[0].Search.Mode, Equals, "match")
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "outcome")
+	outcome, ok := bundle.Entry[1].Resource.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(outcome.Issue, HasLen, 2)
+	c.Assert(outcome.Issue[0].Severity, Equals, "warning")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Parameter \"_count\" was reduced from 5000 to the maximum of 1000")
+	c.Assert(outcome.Issue[1].Severity, Equals, "warning")
+	c.Assert(outcome.Issue[1].Diagnostics, Equals, "The Patient/5c0000000000000000000000 referenced by Observation/"+observationID+" couldn't be included (_include=Observation:subject)")
+	assertPagingLink(c, bundle.Link[0], "self", 1000, 0)
+
+	// but there are no warnings when the subject is included
+	res, err = http.Post(s.Server.URL+"/Observation", "application/json", strings.NewReader(strings.Replace(observation, "5c0000000000000000000000", s.FixtureID, 1)))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	bundle = performSearch(c, s.Server.URL+"/Observation?_id="+resourceIdFromLocation(res)+"&_include=Observation:subject")
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Entry[1].Search.Mode, Equals, "include")
+}
+
+func (s *ServerSuite) TestRequireIndexedSearch(c *C) {
+	config := DefaultConfig
+	config.RequireIndexedSearch = true
+	config.IndexConfigPath = "../config/indexes.conf"
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	// Observation.subject is indexed
+	res, err := http.Get(server.URL + "/Observation?subject=Patient/" + s.FixtureID)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+	// as is _id, while listing a collection doesn't need an index
+	for _, query := range []string{"_id=" + s.FixtureID, ""} {
+		res, err = http.Get(server.URL + "/Observation?" + query)
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+	}
+
+	// but Observation.valueString isn't
+	res, err = http.Get(server.URL + "/Observation?value-string=abc")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	outcome := &models.OperationOutcome{}
+	err = json.NewDecoder(res.Body).Decode(outcome)
+	util.CheckErr(err)
+	c.Assert(outcome.Issue[0].Details.Text, Matches, "None of the parameters of this Observation search can use an index.*")
+}
+
+func (s *ServerSuite) TestObservationLastN(c *C) {
+	other := s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	post := func(patientID, code, effective string) string {
+		observation := fmt.Sprintf(`{"resourceType": "Observation", "status": "final",
+			"category": [{"coding": [{"system": "http://hl7.org/fhir/observation-category", "code": "vital-signs"}]}],
+			"code": {"coding": [{"system": "http://loinc.org", "code": "%s"}]},
+			"subject": {"reference": "Patient/%s"}, "effectiveDateTime": "%s"}`, code, patientID, effective)
+		res, err := http.Post(s.Server.URL+"/Observation", "application/json", strings.NewReader(observation))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusCreated)
+		return resourceIdFromLocation(res)
+	}
+	post(s.FixtureID, "8867-4", "2018-01-01T10:00:00Z")
+	newestHeartRate := post(s.FixtureID, "8867-4", "2018-03-01T10:00:00Z")
+	middleHeartRate := post(s.FixtureID, "8867-4", "2018-02-01T10:00:00Z")
+	newestWeight := post(s.FixtureID, "29463-7", "2018-02-15")
+	post(s.FixtureID, "29463-7", "2017-12-24")
+	post(other.Id, "8867-4", "2019-01-01T10:00:00Z")
+
+	lastn := func(query string) []string {
+		bundle := performSearch(c, s.Server.URL+"/Observation/$lastn?"+query)
+		c.Assert(bundle.Type, Equals, "searchset")
+		c.Assert(*bundle.Total, Equals, uint32(len(bundle.Entry)))
+		var ids []string
+		for _, entry := range bundle.Entry {
+			c.Assert(entry.Search.Mode, Equals, "match")
+			ids = append(ids, entry.Resource.(*models.Observation).Id)
+		}
+		return ids
+	}
+
+	// only the newest of each code, and only of the patient
+	c.Assert(lastn("patient="+s.FixtureID+"&max=1&category=vital-signs"), DeepEquals, []string{newestWeight, newestHeartRate})
+	c.Assert(lastn("patient="+s.FixtureID), DeepEquals, []string{newestWeight, newestHeartRate})
+	c.Assert(lastn("patient="+s.FixtureID+"&max=2&code=8867-4"), DeepEquals, []string{newestHeartRate, middleHeartRate})
+	c.Assert(lastn("patient="+s.FixtureID+"&category=laboratory"), HasLen, 0)
+
+	res, err := http.Get(s.Server.URL + "/Observation/$lastn?patient=" + s.FixtureID + "&max=0")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+}
+
+func (s *ServerSuite) TestBulkExport(c *C) {
+	other := s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+
+	config := DefaultConfig
+	config.BulkExportDir = c.MkDir()
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	post := func(resourceType, body string) string {
+		res, err := http.Post(server.URL+"/"+resourceType, "application/json", strings.NewReader(body))
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusCreated)
+		return resourceIdFromLocation(res)
+	}
+	conditionBody := `{"resourceType": "Condition", "subject": {"reference": "Patient/%s"}, "verificationStatus": "confirmed"}`
+	conditionID := post("Condition", fmt.Sprintf(conditionBody, s.FixtureID))
+	post("Condition", fmt.Sprintf(conditionBody, other.Id))
+	groupID := post("Group", fmt.Sprintf(`{"resourceType": "Group", "type": "person", "actual": true, "member": [{"entity": {"reference": "Patient/%s"}}]}`, s.FixtureID))
+
+	// kicks off an export, polls it until it completes and returns the manifest
+	export := func(path string) exportManifest {
+		res, err := http.Get(server.URL + path)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusAccepted)
+		statusURL := res.Header.Get("Content-Location")
+		c.Assert(strings.HasPrefix(statusURL, server.URL+"/$export-status/"), Equals, true)
+
+		for i := 0; i < 100; i++ {
+			res, err = http.Get(statusURL)
+			util.CheckErr(err)
+			if res.StatusCode != http.StatusAccepted {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+
+		var manifest exportManifest
+		util.CheckErr(json.NewDecoder(res.Body).Decode(&manifest))
+		c.Assert(manifest.Request, Equals, server.URL+path)
+		return manifest
+	}
+
+	// returns the ids of the resources in an output file
+	download := func(output exportOutput) []string {
+		res, err := http.Get(output.URL)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		c.Assert(res.Header.Get("Content-Type"), Equals, "application/fhir+ndjson")
+		body, err := ioutil.ReadAll(res.Body)
+		util.CheckErr(err)
+
+		var ids []string
+		for _, line := range strings.Split(strings.TrimSpace(string(body)), "\n") {
+			var resource struct{ ResourceType, Id string }
+			util.CheckErr(json.Unmarshal([]byte(line), &resource))
+			c.Assert(resource.ResourceType, Equals, output.Type)
+			ids = append(ids, resource.Id)
+		}
+		sort.Strings(ids)
+		c.Assert(ids, HasLen, output.Count)
+		return ids
+	}
+
+	patientIDs := []string{s.FixtureID, other.Id}
+	sort.Strings(patientIDs)
+
+	// system level, with _type
+	manifest := export("/$export?_type=Patient,Group")
+	c.Assert(manifest.Output, HasLen, 2)
+	c.Assert(manifest.Output[0].Type, Equals, "Patient")
+	c.Assert(download(manifest.Output[0]), DeepEquals, patientIDs)
+	c.Assert(manifest.Output[1].Type, Equals, "Group")
+	c.Assert(download(manifest.Output[1]), DeepEquals, []string{groupID})
+
+	// patient level
+	manifest = export("/Patient/$export?_type=Patient,Condition,Group")
+	c.Assert(manifest.Output, HasLen, 2)
+	c.Assert(manifest.Output[0].Type, Equals, "Patient")
+	c.Assert(download(manifest.Output[0]), DeepEquals, patientIDs)
+	c.Assert(manifest.Output[1].Type, Equals, "Condition")
+	c.Assert(download(manifest.Output[1]), HasLen, 2)
+
+	// group level
+	manifest = export("/Group/" + groupID + "/$export?_type=Patient,Condition")
+	c.Assert(manifest.Output, HasLen, 2)
+	c.Assert(download(manifest.Output[0]), DeepEquals, []string{s.FixtureID})
+	c.Assert(download(manifest.Output[1]), DeepEquals, []string{conditionID})
+
+	// _since excludes resources that haven't been updated since
+	manifest = export("/Group/" + groupID + "/$export?_type=Condition&_since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	c.Assert(manifest.Output, HasLen, 0)
+
+	// invalid parameters are rejected at kickoff
+	res, err := http.Get(server.URL + "/Patient/$export?_type=Organization")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	res, err = http.Get(server.URL + "/$export?_since=yesterday")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+
+	// as are databases that can't be used, rather than failing the background job
+	req, err := http.NewRequest("GET", server.URL+"/$export", nil)
+	util.CheckErr(err)
+	req.Header.Set("Db", "other")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusInternalServerError)
+	var outcome models.OperationOutcome
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&outcome))
+	c.Assert(outcome.Issue[0].Diagnostics, Matches, ".*doesn't end with suffix.*")
+}
+
+func (s *ServerSuite) TestBulkExportExpiry(c *C) {
+	config := DefaultConfig
+	config.BulkExportDir = c.MkDir()
+	config.BulkExportExpiry = 500 * time.Millisecond
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/$export?_type=Patient")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusAccepted)
+	statusURL := res.Header.Get("Content-Location")
+	jobDir := path.Join(config.BulkExportDir, path.Base(statusURL))
+	_, err = os.Stat(jobDir)
+	c.Assert(err, IsNil)
+
+	// once expired the job and its files are removed
+	time.Sleep(time.Second)
+	res, err = http.Get(statusURL)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	_, err = os.Stat(jobDir)
+	c.Assert(os.IsNotExist(err), Equals, true)
+}
+
+func (s *ServerSuite) TestCustomOperations(c *C) {
+	ping := func(level string) OperationHandler {
+		return func(c *gin.Context, session DataAccessSession, resourceType string, id string) {
+			c.JSON(http.StatusOK, gin.H{"level": level, "resourceType": resourceType, "id": id, "session": session != nil})
+		}
+	}
+	config := DefaultConfig
+	config.Operations = NewOperationRegistry()
+	config.Operations.Register("$ping", SystemLevel, ping("system"))
+	config.Operations.Register("ping", TypeLevel, ping("type"))
+	config.Operations.Register("ping", InstanceLevel, ping("instance"))
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	invoke := func(method, path string) map[string]interface{} {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		util.CheckErr(err)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, http.StatusOK)
+		var body map[string]interface{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(&body))
+		c.Assert(body["session"], Equals, true)
+		return body
+	}
+	for _, method := range []string{"GET", "POST"} {
+		c.Assert(invoke(method, "/$ping"), DeepEquals, map[string]interface{}{"level": "system", "resourceType": "", "id": "", "session": true})
+		c.Assert(invoke(method, "/Patient/$ping"), DeepEquals, map[string]interface{}{"level": "type", "resourceType": "Patient", "id": "", "session": true})
+		c.Assert(invoke(method, "/Observation/$ping"), DeepEquals, map[string]interface{}{"level": "type", "resourceType": "Observation", "id": "", "session": true})
+		c.Assert(invoke(method, "/Patient/123/$ping"), DeepEquals, map[string]interface{}{"level": "instance", "resourceType": "Patient", "id": "123", "session": true})
+		c.Assert(invoke(method, "/Encounter/456/$ping"), DeepEquals, map[string]interface{}{"level": "instance", "resourceType": "Encounter", "id": "456", "session": true})
+	}
+
+	// unregistered operations aren't found, while reads and compartment searches still work
+	for _, path := range []string{"/Patient/$pong", "/Patient/123/$pong", "/Encounter/$pong"} {
+		res, err := http.Get(server.URL + path)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusNotFound)
+	}
+	res, err := http.Get(server.URL + "/Patient/" + s.FixtureID)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, http.StatusOK)
+	assertBundleCount(c, server.URL+"/Patient/"+s.FixtureID+"/Condition", 0, 0)
+}
+
+func (s *ServerSuite) TestRequireExistingDb(c *C) {
+	config := DefaultConfig
+	config.EnableMultiDB = true
+	config.RequireExistingDb = true
+	e := gin.New()
+	RegisterRoutes(e, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "", nil, config), config)
+	get := func(db string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/Patient", nil)
+		if db != "" {
+			req.Header.Set("Db", db)
+		}
+		rw := httptest.NewRecorder()
+		e.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// the default database, which the fixtures have created, and another existing database
+	c.Assert(get("").Code, Equals, http.StatusOK)
+	c.Assert(get(s.dbname).Code, Equals, http.StatusOK)
+	c.Assert(get("admin").Code, Equals, http.StatusOK)
+
+	rw := get("notprovisioned_fhir")
+	c.Assert(rw.Code, Equals, http.StatusNotFound)
+	c.Assert(rw.Body.String(), Matches, `(?s).*"resourceType":"OperationOutcome".*Database \\"notprovisioned_fhir\\" not found.*`)
+
+	// nothing was created
+	names, err := s.client.ListDatabaseNames(context.TODO(), bson.M{"name": "notprovisioned_fhir"})
+	util.CheckErr(err)
+	c.Assert(names, HasLen, 0)
+}
+
+func (s *ServerSuite) TestCursorPaging(c *C) {
+	// 250 more patients, with only some of them having (often the same) birth dates
+	for i := 0; i < 250; i++ {
+		patient := loadFixture("Patient", "../fixtures/patient-example-a.json").(*models.Patient)
+		patient.Id = bson.NewObjectId().Hex()
+		if i%3 != 0 {
+			patient.BirthDate = &models.FHIRDateTime{Time: time.Date(1980+i%7, 1, 1, 0, 0, 0, 0, time.UTC), Precision: models.Date}
+		}
+		util.CheckErr(s.DB().C("patients").Insert(patient))
+	}
+	allIDs := make(map[string]bool)
+	var patient models.Patient
+	iter := s.DB().C("patients").Find(nil).Iter()
+	for iter.Next(&patient) {
+		allIDs[patient.Id] = true
+	}
+	util.CheckErr(iter.Close())
+	c.Assert(allIDs, HasLen, 251)
+
+	config := DefaultConfig
+	config.EnableCursorPaging = true
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	for _, sort := range []string{"", "&_sort=birthdate", "&_sort=-birthdate", "&_sort=_id"} {
+		seen := make(map[string]bool)
+		pages := 0
+		next := server.URL + "/Patient?_count=40" + sort
+		for next != "" {
+			bundle := performSearch(c, next)
+			c.Assert(*bundle.Total, Equals, uint32(251))
+			pages++
+
+			next = ""
+			for _, link := range bundle.Link {
+				c.Assert(link.Url, Not(Matches), ".*_offset.*")
+				if link.Relation == "next" {
+					next = link.Url
+				}
+			}
+			for _, entry := range bundle.Entry {
+				id := entry.Resource.(*models.Patient).Id
+				c.Assert(seen[id], Equals, false, Commentf("duplicate %s with sort %q", id, sort))
+				seen[id] = true
+			}
+		}
+		c.Assert(pages, Equals, 7, Commentf("sort %q", sort))
+		c.Assert(seen, DeepEquals, allIDs, Commentf("sort %q", sort))
+	}
+
+	// sorting by names, which can repeat, falls back to offset paging
+	bundle := performSearch(c, server.URL+"/Patient?_count=40&_sort=family")
+	c.Assert(hasLinkRelation(bundle.Link, "last"), Equals, true)
+	for _, link := range bundle.Link {
+		c.Assert(link.Url, Matches, ".*_offset.*")
+	}
+}
+
 func (s *ServerSuite) TestGetPatientSearchPagingPreservesSearchParams(c *C) {
 	// Add 39 more patients
 	for i := 0; i < 39; i++ {
@@ -272,65 +1206,380 @@ func (s *ServerSuite) TestGetPatientSearchPagingPreservesSearchParams(c *C) {
 	assertPagingLinkWithParams(c, bundle.Link[2], "next", v, 10, 10)
 	assertPagingLinkWithParams(c, bundle.Link[3], "last", v, 10, 30)
 
-	// More results than count, middle page
-	bundle = performSearch(c, s.Server.URL+"/Patient?gender=male&name=Donald&name=Duck&_count=10&_offset=20")
-	c.Assert(bundle.Link, HasLen, 5)
-	assertPagingLinkWithParams(c, bundle.Link[0], "self", v, 10, 20)
-	assertPagingLinkWithParams(c, bundle.Link[1], "first", v, 10, 0)
-	assertPagingLinkWithParams(c, bundle.Link[2], "previous", v, 10, 10)
-	assertPagingLinkWithParams(c, bundle.Link[3], "next", v, 10, 30)
-	assertPagingLinkWithParams(c, bundle.Link[4], "last", v, 10, 30)
+	// More results than count, middle page
+	bundle = performSearch(c, s.Server.URL+"/Patient?gender=male&name=Donald&name=Duck&_count=10&_offset=20")
+	c.Assert(bundle.Link, HasLen, 5)
+	assertPagingLinkWithParams(c, bundle.Link[0], "self", v, 10, 20)
+	assertPagingLinkWithParams(c, bundle.Link[1], "first", v, 10, 0)
+	assertPagingLinkWithParams(c, bundle.Link[2], "previous", v, 10, 10)
+	assertPagingLinkWithParams(c, bundle.Link[3], "next", v, 10, 30)
+	assertPagingLinkWithParams(c, bundle.Link[4], "last", v, 10, 30)
+}
+
+func (s *ServerSuite) TestGetPatient(c *C) {
+	url := s.Server.URL + "/Patient/" + s.FixtureID
+	res, err := http.Get(url)
+	util.CheckErr(err)
+
+	decoder := json.NewDecoder(res.Body)
+	patient := &models.Patient{}
+	err = decoder.Decode(patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donald")
+}
+
+func (s *ServerSuite) TestGetNonExistingPatient(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex())
+	util.CheckErr(err)
+	logBody(res)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *ServerSuite) TestShowPatient(c *C) {
+
+	res, err := http.Get(s.Server.URL + "/Patient")
+	util.CheckErr(err)
+
+	decoder := json.NewDecoder(res.Body)
+	patientBundle := &models.Bundle{}
+	err = decoder.Decode(patientBundle)
+	util.CheckErr(err)
+
+	var result []models.Patient
+	collection := s.DB().C("patients")
+	iter := collection.Find(nil).Iter()
+	err = iter.All(&result)
+	util.CheckErr(err)
+
+	c.Assert(int(*patientBundle.Total), Equals, len(result))
+}
+
+func (s *ServerSuite) TestCreatePatient(c *C) {
+	data, err := os.Open("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	defer data.Close()
+
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+	util.CheckErr(err)
+
+	c.Assert(res.StatusCode, Equals, 201)
+	createdPatientID := resourceIdFromLocation(res)
+	s.checkCreatedPatient(createdPatientID, c)
+}
+
+func (s *ServerSuite) TestCreateTooDeeplyNestedPatient(c *C) {
+	data := bytes.NewReader(deeplyNestedPatient(models2.DefaultMaxConversionDepth + 1))
+
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestCreatePatientWithoutMeta(c *C) {
+	// allowed by the suite's config, so stored with only the server's meta
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","gender":"other"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(resourceIdFromLocation(res)).One(&patient))
+	c.Assert(patient.Meta, NotNil)
+	c.Assert(patient.Meta.VersionId, Equals, "1")
+	c.Assert(patient.Meta.Profile, HasLen, 0)
+}
+
+func (s *ServerSuite) TestCreatePatientWithoutMetaInjected(c *C) {
+	config := DefaultConfig
+	config.AllowResourcesWithoutMeta = false
+	config.DefaultMetaProfiles = map[string][]string{"Patient": {"http://example.com/StructureDefinition/patient"}}
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","gender":"other"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(resourceIdFromLocation(res)).One(&patient))
+	c.Assert(patient.Meta, NotNil)
+	c.Assert(patient.Meta.VersionId, Equals, "1")
+	c.Assert(patient.Meta.Profile, DeepEquals, []string{"http://example.com/StructureDefinition/patient"})
+
+	// a meta sent by the client is kept as is
+	res, err = http.Post(server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","meta":{"tag":[{"code":"test"}]}}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+
+	patient = models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(resourceIdFromLocation(res)).One(&patient))
+	c.Assert(patient.Meta.Profile, HasLen, 0)
+	c.Assert(patient.Meta.Tag, HasLen, 1)
+}
+
+func (s *ServerSuite) TestCreatePatientWithoutMetaRejected(c *C) {
+	config := DefaultConfig
+	config.AllowResourcesWithoutMeta = false
+	config.MetaLessResources = "reject"
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	res, err := http.Post(server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","gender":"other"}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	res.Body.Close()
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, ErrMissingMeta.Error())
+
+	// updates too
+	req, err := http.NewRequest("PUT", server.URL+"/Patient/"+s.FixtureID, strings.NewReader(`{"resourceType":"Patient","id":"`+s.FixtureID+`"}`))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	// and patches removing the meta
+	req, err = http.NewRequest("PATCH", server.URL+"/Patient/"+s.FixtureID, strings.NewReader(`[{"op": "remove", "path": "/meta"}]`))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(s.FixtureID).One(&patient))
+	c.Assert(patient.Meta, NotNil)
+	c.Assert(patient.Meta.VersionId, Equals, "1")
+
+	res, err = http.Post(server.URL+"/Patient", "application/json", strings.NewReader(`{"resourceType":"Patient","meta":{"tag":[{"code":"test"}]}}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+}
+
+func (s *ServerSuite) TestClientAssignedStringIds(c *C) {
+	put := func(serverURL string) *http.Response {
+		req, err := http.NewRequest("PUT", serverURL+"/Patient/my-patient.1", strings.NewReader(`{"resourceType":"Patient","id":"my-patient.1","gender":"other"}`))
+		util.CheckErr(err)
+		req.Header.Add("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res
+	}
+
+	// ids have to be BSON ObjectIds by default
+	c.Assert(put(s.Server.URL).StatusCode, Not(Equals), 201)
+
+	config := DefaultConfig
+	config.AllowClientAssignedStringIds = true
+	engine := gin.New()
+	RegisterRoutes(engine, make(map[string][]gin.HandlerFunc), NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, config), config)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	c.Assert(put(server.URL).StatusCode, Equals, 201)
+
+	res, err := http.Get(server.URL + "/Patient/my-patient.1")
+	util.CheckErr(err)
+	patient := &models.Patient{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(patient))
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(patient.Id, Equals, "my-patient.1")
+
+	res, err = http.Get(server.URL + "/Patient?_id=my-patient.1")
+	util.CheckErr(err)
+	bundle := &models.Bundle{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(bundle))
+	res.Body.Close()
+	c.Assert(*bundle.Total, Equals, uint32(1))
+
+	// ids that FHIR doesn't allow are still rejected
+	req, err := http.NewRequest("PUT", server.URL+"/Patient/not_valid", strings.NewReader(`{"resourceType":"Patient","id":"not_valid"}`))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Not(Equals), 201)
 }
 
-func (s *ServerSuite) TestGetPatient(c *C) {
-	url := s.Server.URL + "/Patient/" + s.FixtureID
-	res, err := http.Get(url)
+func (s *ServerSuite) TestCreatePatientPreferMinimal(c *C) {
+	data, err := ioutil.ReadFile("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	req, err := http.NewRequest("POST", s.Server.URL+"/Patient", bytes.NewReader(data))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=minimal")
+	res, err := http.DefaultClient.Do(req)
 	util.CheckErr(err)
+	defer res.Body.Close()
 
-	decoder := json.NewDecoder(res.Body)
-	patient := &models.Patient{}
-	err = decoder.Decode(patient)
+	c.Assert(res.StatusCode, Equals, 201)
+	body, err := ioutil.ReadAll(res.Body)
 	util.CheckErr(err)
-	c.Assert(patient.Name[0].Given[0], Equals, "Donald")
+	c.Assert(body, HasLen, 0)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"1"`)
+	c.Assert(res.Header.Get("Last-Modified"), Not(Equals), "")
+	s.checkCreatedPatient(resourceIdFromLocation(res), c)
 }
 
-func (s *ServerSuite) TestGetNonExistingPatient(c *C) {
-	res, err := http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex())
+func (s *ServerSuite) TestUpdatePatientPreferOperationOutcome(c *C) {
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
 	util.CheckErr(err)
-	logBody(res)
-	c.Assert(res.StatusCode, Equals, 404)
+	req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+s.FixtureID, bytes.NewReader(data))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Prefer", "return=OperationOutcome")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	defer res.Body.Close()
+
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"2"`)
+	outcome := &models.OperationOutcome{}
+	err = json.NewDecoder(res.Body).Decode(outcome)
+	util.CheckErr(err)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Successfully updated Patient/"+s.FixtureID+" (version 2)")
 }
 
-func (s *ServerSuite) TestShowPatient(c *C) {
+func (s *ServerSuite) TestGraphQL(c *C) {
+	res, err := http.Post(s.Server.URL+"/Organization", "application/json", strings.NewReader(`{"resourceType": "Organization", "name": "Acme Hospital"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	organizationID := resourceIdFromLocation(res)
 
-	res, err := http.Get(s.Server.URL + "/Patient")
+	patient := `{"resourceType": "Patient", "name": [{"use": "official", "family": "Graph", "given": ["Quentin"]}, {"use": "nickname", "given": ["Q"]}],
+		"managingOrganization": {"reference": "Organization/` + organizationID + `"}}`
+	res, err = http.Post(s.Server.URL+"/Patient", "application/json", strings.NewReader(patient))
 	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusCreated)
+	patientID := resourceIdFromLocation(res)
 
-	decoder := json.NewDecoder(res.Body)
-	patientBundle := &models.Bundle{}
-	err = decoder.Decode(patientBundle)
+	graphQL := func(url string, contentType string, query string) string {
+		res, err := http.Post(url, contentType, strings.NewReader(query))
+		util.CheckErr(err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, http.StatusOK, Commentf("%s", body))
+		return string(body)
+	}
+
+	// the name of a Patient and of its managingOrganization
+	body := graphQL(s.Server.URL+"/Patient/"+patientID+"/$graphql", "application/graphql",
+		`{ name(use: "official") { family } managingOrganization { resource { name } } }`)
+	c.Assert(body, Equals, `{"data":{"name":[{"family":"Graph"}],"managingOrganization":{"resource":{"name":"Acme Hospital"}}}}`)
+
+	// reads and searches at the system level, with the query in a JSON object
+	query, err := json.Marshal(map[string]string{
+		"query": `{ org: Organization(id: "` + organizationID + `") { name } PatientList(family: "Graph") { id } }`,
+	})
 	util.CheckErr(err)
+	body = graphQL(s.Server.URL+"/$graphql", "application/json", string(query))
+	c.Assert(body, Equals, `{"data":{"org":{"name":"Acme Hospital"},"PatientList":[{"id":"`+patientID+`"}]}}`)
 
-	var result []models.Patient
-	collection := s.DB().C("patients")
-	iter := collection.Find(nil).Iter()
-	err = iter.All(&result)
+	// invalid queries
+	res, err = http.Post(s.Server.URL+"/$graphql", "application/graphql", strings.NewReader(`{ Patient(id: $id) { name } }`))
 	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	var errorResponse struct {
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&errorResponse))
+	c.Assert(errorResponse.Errors, HasLen, 1)
+	c.Assert(errorResponse.Errors[0].Message, Equals, "GraphQL variables are not supported")
 
-	c.Assert(int(*patientBundle.Total), Equals, len(result))
+	// deeply nested queries are rejected before they're parsed any further
+	res, err = http.Post(s.Server.URL+"/$graphql", "application/graphql", strings.NewReader(strings.Repeat("{ a ", 100000)))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusBadRequest)
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&errorResponse))
+	c.Assert(errorResponse.Errors[0].Message, Equals, "the query is nested more than 32 levels deep")
+
+	// as are large requests
+	res, err = http.Post(s.Server.URL+"/$graphql", "application/graphql", strings.NewReader("{ "+strings.Repeat("name ", 300000)+"}"))
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, http.StatusRequestEntityTooLarge)
 }
 
-func (s *ServerSuite) TestCreatePatient(c *C) {
-	data, err := os.Open("../fixtures/patient-example-b.json")
+func (s *ServerSuite) TestRequestID(c *C) {
+	req, err := http.NewRequest("GET", s.Server.URL+"/Patient/"+s.FixtureID, nil)
 	util.CheckErr(err)
-	defer data.Close()
+	req.Header.Set("X-Request-Id", "trace-42")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("X-Request-Id"), Equals, "trace-42")
 
-	res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+	// a request without one is given an ID, even if it fails
+	res, err = http.Get(s.Server.URL + "/Patient/unknown")
 	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+	c.Assert(res.Header.Get("X-Request-Id"), Matches, "[0-9a-f-]{36}")
+}
 
+func (s *ServerSuite) TestConditionalRead(c *C) {
+	data, err := ioutil.ReadFile("../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", bytes.NewReader(data))
+	util.CheckErr(err)
+	res.Body.Close()
 	c.Assert(res.StatusCode, Equals, 201)
-	createdPatientID := resourceIdFromLocation(res)
-	s.checkCreatedPatient(createdPatientID, c)
+	patientURL := s.Server.URL + "/Patient/" + resourceIdFromLocation(res)
+
+	res, err = http.Get(patientURL)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	etag := res.Header.Get("ETag")
+	lastModified := res.Header.Get("Last-Modified")
+	c.Assert(etag, Equals, `W/"1"`)
+	c.Assert(lastModified, Not(Equals), "")
+
+	conditionalGet := func(header, value string) *http.Response {
+		req, err := http.NewRequest("GET", patientURL, nil)
+		util.CheckErr(err)
+		req.Header.Set(header, value)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res
+	}
+
+	res = conditionalGet("If-None-Match", etag)
+	c.Assert(res.StatusCode, Equals, 304)
+	c.Assert(res.Header.Get("ETag"), Equals, etag)
+
+	res = conditionalGet("If-None-Match", `W/"0"`)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	res = conditionalGet("If-Modified-Since", lastModified)
+	c.Assert(res.StatusCode, Equals, 304)
+
+	res = conditionalGet("If-Modified-Since", "Mon, 01 Jan 2001 00:00:00 GMT")
+	c.Assert(res.StatusCode, Equals, 200)
 }
 
 func resourceIdFromLocation(res *http.Response) string {
@@ -426,6 +1675,71 @@ func (s *ServerSuite) TestCreatePatientConditionalExists(c *C) {
 	s.checkPatientCount(3, c)
 }
 
+func (s *ServerSuite) TestCreatePatientConditionalExistsReturnsExisting(c *C) {
+	data, err := ioutil.ReadFile("../fixtures/patient-example-MRN-987.json")
+	util.CheckErr(err)
+	res, err := http.Post(s.Server.URL+"/Patient", "application/json", bytes.NewReader(data))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+	existingID := resourceIdFromLocation(res)
+
+	// update the existing patient so that its current version isn't the first
+	update := strings.Replace(string(data), `"gender": "male"`, `"gender": "other"`, 1)
+	req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+existingID, strings.NewReader(update))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"2"`)
+
+	conditionalCreate := func(prefer string) *http.Response {
+		data, err := ioutil.ReadFile("../fixtures/patient-example-b.json")
+		util.CheckErr(err)
+		req, err := http.NewRequest("POST", s.Server.URL+"/Patient", bytes.NewReader(data))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("If-None-Exist", "identifier=urn:oid:0.1.2.3.4.5.6.7|987")
+		if prefer != "" {
+			req.Header.Set("Prefer", prefer)
+		}
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		return res
+	}
+
+	res = conditionalCreate("")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"2"`)
+	c.Assert(res.Header.Get("Location"), Equals, s.Server.URL+"/Patient/"+existingID+"/_history/2")
+	lastModified, err := http.ParseTime(res.Header.Get("Last-Modified"))
+	util.CheckErr(err)
+
+	// the body is the existing patient as it currently is, not the one posted
+	patient := &models.Patient{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(patient))
+	c.Assert(patient.Id, Equals, existingID)
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+	c.Assert(patient.Meta.LastUpdated.Time.Truncate(time.Second).Equal(lastModified), Equals, true)
+	c.Assert(patient.Gender, Equals, "other")
+	c.Assert(patient.Identifier[0].Value, Equals, "987")
+
+	res = conditionalCreate("return=OperationOutcome")
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, `W/"2"`)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "information")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Patient/"+existingID+" matching If-None-Exist already exists (version 2)")
+
+	s.checkPatientCount(2, c) // 1st patient from SetUpTest
+}
+
 func (s *ServerSuite) TestCreatePatientConditionalMultiple(c *C) {
 	s.TestCreatePatient987(c)
 	s.TestCreatePatient987(c)
@@ -444,6 +1758,10 @@ func (s *ServerSuite) TestCreatePatientConditionalMultiple(c *C) {
 
 	c.Assert(res.StatusCode, Equals, 412)
 	c.Assert(res.Header["Location"], IsNil)
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Code, Equals, "duplicate")
 	s.checkPatientCount(3, c)
 }
 
@@ -480,6 +1798,42 @@ func (s *ServerSuite) checkCreatedPatient(createdPatientID string, c *C) {
 	c.Assert(patient.Meta.LastUpdated.Precision, Equals, models.Precision(models.Timestamp))
 	c.Assert(time.Since(patient.Meta.LastUpdated.Time).Minutes() < float64(1), Equals, true)
 }
+func (s *ServerSuite) TestBulkInsert(c *C) {
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, DefaultConfig)
+	session := dal.StartSession(context.TODO(), s.dbname)
+	defer session.Finish()
+
+	resources := make([]*models2.Resource, 500)
+	for i := range resources {
+		resource, err := models2.NewResourceFromJsonBytes([]byte(fmt.Sprintf(`{"resourceType": "Patient", "name": [{"family": "Bulk%d"}]}`, i)))
+		util.CheckErr(err)
+		resources[i] = resource
+	}
+	ids, err := session.BulkInsert("Patient", resources)
+	util.CheckErr(err)
+	c.Assert(ids, HasLen, 500)
+	s.checkPatientCount(501, c)
+
+	patient, err := session.Get(ids[499], "Patient")
+	util.CheckErr(err)
+	c.Assert(patient.VersionId(), Equals, "1")
+	c.Assert(patient.LastUpdated(), Not(Equals), "")
+
+	// resources that can't be inserted are reported by their index while the others are inserted
+	patientResource, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Patient"}`))
+	util.CheckErr(err)
+	observation, err := models2.NewResourceFromJsonBytes([]byte(`{"resourceType": "Observation", "status": "final", "code": {"text": "Weight"}}`))
+	util.CheckErr(err)
+	ids, err = session.BulkInsert("Patient", []*models2.Resource{observation, patientResource})
+	bulkErr, ok := err.(*BulkInsertError)
+	c.Assert(ok, Equals, true)
+	c.Assert(bulkErr.Failures, HasLen, 1)
+	c.Assert(bulkErr.Failures[0], NotNil)
+	c.Assert(ids[0], Equals, "")
+	c.Assert(ids[1], Not(Equals), "")
+	s.checkPatientCount(502, c)
+}
+
 func (s *ServerSuite) checkPatientCount(expected int, c *C) {
 	patientCollection := s.DB().C("patients")
 	count, err := patientCollection.Count()
@@ -519,6 +1873,32 @@ func (s *ServerSuite) TestGetConditionsWithIncludes(c *C) {
 	c.Assert(b.Entry[1].Search.Mode, Equals, "include")
 }
 
+func (s *ServerSuite) TestGetConditionsWithMissingInclude(c *C) {
+	// Add a condition for a patient that doesn't exist
+	data, err := os.Open("../fixtures/condition.json")
+	util.CheckErr(err)
+	defer data.Close()
+	condition := &models.Condition{}
+	err = json.NewDecoder(data).Decode(condition)
+	util.CheckErr(err)
+	missingPatientID := bson.NewObjectId().Hex()
+	condition.Subject = &models.Reference{
+		Reference:    "Patient/" + missingPatientID,
+		Type:         "Patient",
+		ReferencedID: missingPatientID,
+		External:     new(bool),
+	}
+	condition.Id = bson.NewObjectId().Hex()
+	err = s.DB().C("conditions").Insert(condition)
+	util.CheckErr(err)
+
+	// the condition is still found, just without the patient
+	b := assertBundleCount(c, s.Server.URL+"/Condition?_include=Condition:patient", 1, 1)
+	c.Assert(b.Entry[0].Resource, FitsTypeOf, &models.Condition{})
+	c.Assert(b.Entry[0].Resource.(*models.Condition).Id, Equals, condition.Id)
+	c.Assert(b.Entry[0].Search.Mode, Equals, "match")
+}
+
 func (s *ServerSuite) TestWrongResource(c *C) {
 	data, err := os.Open("../fixtures/patient-wrong-type.json")
 	util.CheckErr(err)
@@ -715,14 +2095,260 @@ func (s *ServerSuite) TestVersionedUpdatePatientOneMatch409(c *C) {
 	c.Assert(res.StatusCode, Equals, 409)
 
 	patientCollection := s.DB().C("patients")
-	count, err := patientCollection.Count()
-	util.CheckErr(err)
-	c.Assert(count, Equals, 1)
+	count, err := patientCollection.Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 1)
+	patient := models.Patient{}
+	err = patientCollection.FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given[0], Equals, "Donald") // unchanged
+	c.Assert(patient.Meta, NotNil)
+}
+
+func (s *ServerSuite) TestPatchPatient(c *C) {
+
+	patch := `[
+		{"op": "add", "path": "/name/0/given/-", "value": "Fauntleroy"},
+		{"op": "replace", "path": "/gender", "value": "other"},
+		{"op": "remove", "path": "/identifier"}
+	]`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient/"+s.FixtureID, strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, "W/\"2\"")
+
+	patientCollection := s.DB().C("patients")
+	patient := models.Patient{}
+	err = patientCollection.FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Given, DeepEquals, []string{"Donald", "Fauntleroy"})
+	c.Assert(patient.Gender, Equals, "other")
+	c.Assert(patient.Identifier, HasLen, 0)
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+}
+
+func (s *ServerSuite) TestFhirPathPatchPatient(c *C) {
+
+	patch := `{
+		"resourceType": "Parameters",
+		"parameter": [{
+			"name": "operation",
+			"part": [
+				{"name": "type", "valueCode": "replace"},
+				{"name": "path", "valueString": "Patient.name[0].family"},
+				{"name": "value", "valueString": "McDuck"}
+			]
+		}]
+	}`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient/"+s.FixtureID, strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/fhir+json")
+	req.Header.Add("If-Match", "W/\"1\"")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 200)
+
+	patient := models.Patient{}
+	err = s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Name[0].Family, Equals, "McDuck")
+}
+
+func (s *ServerSuite) TestMetaOperations(c *C) {
+	metaOperation := func(operation string) *models.Meta {
+		parameters := `{"resourceType":"Parameters","parameter":[{"name":"meta","valueMeta":{` +
+			`"security":[{"system":"http://terminology.hl7.org/CodeSystem/v3-Confidentiality","code":"R"}]}}]}`
+		res, err := http.Post(s.Server.URL+"/Patient/"+s.FixtureID+"/$"+operation, "application/fhir+json", strings.NewReader(parameters))
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+
+		returned := &models.Parameters{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(returned))
+		c.Assert(returned.Parameter, HasLen, 1)
+		c.Assert(returned.Parameter[0].Name, Equals, "return")
+		c.Assert(res.Header.Get("ETag"), Equals, "W/\""+returned.Parameter[0].ValueMeta.VersionId+"\"")
+		return returned.Parameter[0].ValueMeta
+	}
+	storedPatient := func() *models.Patient {
+		patient := &models.Patient{}
+		util.CheckErr(s.DB().C("patients").FindId(s.FixtureID).One(patient))
+		return patient
+	}
+
+	meta := metaOperation("meta-add")
+	c.Assert(meta.VersionId, Equals, "2")
+	c.Assert(meta.Security, HasLen, 1)
+	c.Assert(meta.Security[0].Code, Equals, "R")
+	patient := storedPatient()
+	c.Assert(patient.Meta.Security, HasLen, 1)
+	c.Assert(patient.Name[0].Family, Equals, "Duck") // only meta changed
+
+	// adding it again doesn't duplicate it
+	meta = metaOperation("meta-add")
+	c.Assert(meta.VersionId, Equals, "3")
+	c.Assert(meta.Security, HasLen, 1)
+
+	res, err := http.Get(s.Server.URL + "/Patient/" + s.FixtureID + "/$meta")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+	returned := &models.Parameters{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(returned))
+	c.Assert(returned.Parameter[0].ValueMeta.VersionId, Equals, "3")
+	c.Assert(returned.Parameter[0].ValueMeta.Security, HasLen, 1)
+
+	meta = metaOperation("meta-delete")
+	c.Assert(meta.VersionId, Equals, "4")
+	c.Assert(meta.Security, HasLen, 0)
+	c.Assert(storedPatient().Meta.Security, HasLen, 0)
+
+	// the previous versions are in the history
+	count, err := s.DB().C("patients_prev").Find(bson.M{"_id._id": s.FixtureID}).Count()
+	util.CheckErr(err)
+	c.Assert(count, Equals, 3)
+
+	res, err = http.Post(s.Server.URL+"/Patient/"+s.FixtureID+"/$meta-add", "application/fhir+json", strings.NewReader(`{"resourceType":"Parameters"}`))
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestPatchPatient409(c *C) {
+
+	patch := `[{"op": "replace", "path": "/gender", "value": "other"}]`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient/"+s.FixtureID, strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	req.Header.Add("If-Match", "W/\"5\"")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 409)
+
+	patient := models.Patient{}
+	err = s.DB().C("patients").FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Gender, Equals, "male") // unchanged
+}
+
+func (s *ServerSuite) TestPatchPatientUnprocessable(c *C) {
+
+	patch := `[{"op": "replace", "path": "/id", "value": "123"}]`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient/"+s.FixtureID, strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 422)
+}
+
+func (s *ServerSuite) TestPatchMissingPatient(c *C) {
+
+	patch := `[{"op": "replace", "path": "/gender", "value": "other"}]`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient/5aa0a0a0a0a0a0a0a0a0a0a0", strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+// replaceGender returns a copy of a resource with a different gender
+func replaceGender(c *C, resource *models2.Resource, gender string) *models2.Resource {
+	patched, err := ApplyPatch("application/json-patch+json", resource.JsonBytes(), []byte(`[{"op": "replace", "path": "/gender", "value": "`+gender+`"}]`))
+	util.CheckErr(err)
+	patchedResource, err := models2.NewResourceFromJsonBytes(patched)
+	util.CheckErr(err)
+	return patchedResource
+}
+
+func (s *ServerSuite) TestSessionPatch(c *C) {
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, DefaultConfig)
+	session := dal.StartSession(context.TODO(), s.dbname)
+	defer session.Finish()
+
+	patched, err := session.Patch(s.FixtureID, "Patient", "1", func(resource *models2.Resource) (*models2.Resource, error) {
+		return replaceGender(c, resource, "other"), nil
+	})
+	util.CheckErr(err)
+	c.Assert(patched.VersionId(), Equals, "2")
+
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(s.FixtureID).One(&patient))
+	c.Assert(patient.Gender, Equals, "other")
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+
+	// the patched version is kept in the history
+	previous := models.Patient{}
+	util.CheckErr(s.DB().C("patients_prev").FindId(bson.D{{"_id", s.FixtureID}, {"_version", 1}}).One(&previous))
+	c.Assert(previous.Gender, Equals, "male")
+}
+
+func (s *ServerSuite) TestSessionPatchConcurrentUpdate(c *C) {
+	dal := NewMongoDataAccessLayer(s.client, s.dbname, true, "_fhir", nil, DefaultConfig)
+	session := dal.StartSession(context.TODO(), s.dbname)
+	defer session.Finish()
+	otherSession := dal.StartSession(context.TODO(), s.dbname)
+	defer otherSession.Finish()
+
+	_, err := session.Patch(s.FixtureID, "Patient", "", func(resource *models2.Resource) (*models2.Resource, error) {
+		// someone else updates the patient after it was read
+		_, err := otherSession.Put(s.FixtureID, "", replaceGender(c, resource, "female"))
+		util.CheckErr(err)
+
+		return replaceGender(c, resource, "other"), nil
+	})
+	_, isConflict := err.(ErrConflict)
+	c.Assert(isConflict, Equals, true)
+
+	// the other update wasn't lost
+	patient := models.Patient{}
+	util.CheckErr(s.DB().C("patients").FindId(s.FixtureID).One(&patient))
+	c.Assert(patient.Gender, Equals, "female")
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+}
+
+func (s *ServerSuite) conditionalPatch(c *C, query string) *http.Response {
+	patch := `[{"op": "replace", "path": "/gender", "value": "other"}]`
+	req, err := http.NewRequest("PATCH", s.Server.URL+"/Patient?"+query, strings.NewReader(patch))
+	util.CheckErr(err)
+	req.Header.Add("Content-Type", "application/json-patch+json")
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	return res
+}
+
+func (s *ServerSuite) TestConditionalPatchPatient(c *C) {
+	res := s.conditionalPatch(c, "name=Donald")
+	c.Assert(res.StatusCode, Equals, 200)
+	c.Assert(res.Header.Get("ETag"), Equals, "W/\"2\"")
+
+	patientCollection := s.DB().C("patients")
+	patient := models.Patient{}
+	err := patientCollection.FindId(s.FixtureID).One(&patient)
+	util.CheckErr(err)
+	c.Assert(patient.Gender, Equals, "other")
+	c.Assert(patient.Meta.VersionId, Equals, "2")
+}
+
+func (s *ServerSuite) TestConditionalPatchPatientNoMatch(c *C) {
+	res := s.conditionalPatch(c, "name=Donny")
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *ServerSuite) TestConditionalPatchPatientMultipleMatches(c *C) {
+	s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+
+	res := s.conditionalPatch(c, "name=Donald")
+	c.Assert(res.StatusCode, Equals, 412)
+
+	patientCollection := s.DB().C("patients")
 	patient := models.Patient{}
-	err = patientCollection.FindId(s.FixtureID).One(&patient)
+	err := patientCollection.FindId(s.FixtureID).One(&patient)
 	util.CheckErr(err)
-	c.Assert(patient.Name[0].Given[0], Equals, "Donald") // unchanged
-	c.Assert(patient.Meta, NotNil)
+	c.Assert(patient.Gender, Equals, "male")
 }
 
 func (s *ServerSuite) TestBatchConditionalUpdatePatientUUIDIdentifier(c *C) {
@@ -1028,6 +2654,331 @@ func (s *ServerSuite) TestDeletePatient(c *C) {
 	c.Assert(count, Equals, 0)
 }
 
+func (s *ServerSuite) TestDeleteWithIfMatch(c *C) {
+	deletePatient := func(url, ifMatch string) int {
+		req, err := http.NewRequest("DELETE", url, nil)
+		util.CheckErr(err)
+		req.Header.Set("If-Match", ifMatch)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	countFixture := func() int {
+		count, err := s.DB().C("patients").FindId(s.FixtureID).Count()
+		util.CheckErr(err)
+		return count
+	}
+
+	// the fixture is at version 1
+	c.Assert(deletePatient(s.Server.URL+"/Patient/"+s.FixtureID, `W/"2"`), Equals, http.StatusConflict)
+	c.Assert(countFixture(), Equals, 1)
+	c.Assert(deletePatient(s.Server.URL+"/Patient/"+s.FixtureID, `W/"1"`), Equals, http.StatusNoContent)
+	c.Assert(countFixture(), Equals, 0)
+	c.Assert(deletePatient(s.Server.URL+"/Patient/"+s.FixtureID, `not an etag`), Equals, http.StatusBadRequest)
+}
+
+func (s *ServerSuite) TestConditionalDeleteWithIfMatch(c *C) {
+	deletePatients := func(ifMatch string) int {
+		req, err := http.NewRequest("DELETE", s.Server.URL+"/Patient?family=Duck", nil)
+		util.CheckErr(err)
+		req.Header.Set("If-Match", ifMatch)
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		return res.StatusCode
+	}
+	countDucks := func() int {
+		count, err := s.DB().C("patients").Find(bson.M{"name.family": "Duck"}).Count()
+		util.CheckErr(err)
+		return count
+	}
+
+	// the fixture is the only Duck
+	c.Assert(deletePatients(`W/"2"`), Equals, http.StatusConflict)
+	c.Assert(countDucks(), Equals, 1)
+	c.Assert(deletePatients(`W/"1"`), Equals, http.StatusNoContent)
+	c.Assert(countDucks(), Equals, 0)
+
+	// a version can't be expected of several resources
+	s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	s.insertPatientFromFixture("../fixtures/patient-example-a.json")
+	c.Assert(deletePatients(`W/"1"`), Equals, http.StatusPreconditionFailed)
+	c.Assert(countDucks(), Equals, 2)
+}
+
+func (s *ServerSuite) TestTypeAndSystemHistory(c *C) {
+	since := url.QueryEscape(time.Now().UTC().Format(time.RFC3339Nano))
+
+	createPatient := func(fixture string) string {
+		data, err := os.Open(fixture)
+		util.CheckErr(err)
+		defer data.Close()
+		res, err := http.Post(s.Server.URL+"/Patient", "application/json", data)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 201)
+		time.Sleep(10 * time.Millisecond) // distinct lastUpdated times
+		return resourceIdFromLocation(res)
+	}
+	do := func(method string, url string, body io.Reader) {
+		req, err := http.NewRequest(method, url, body)
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode < 300, Equals, true)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	updatedID := createPatient("../fixtures/patient-example-b.json")
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	do("PUT", s.Server.URL+"/Patient/"+updatedID, bytes.NewReader(data))
+	deletedID := createPatient("../fixtures/patient-example-d.json")
+	do("DELETE", s.Server.URL+"/Patient/"+deletedID, nil)
+
+	bundle := assertBundleCount(c, s.Server.URL+"/Patient/_history?_since="+since, 4, 4)
+	c.Assert(bundle.Type, Equals, "history")
+
+	// most recent first with deletions recorded without a resource
+	c.Assert(bundle.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(bundle.Entry[0].Request.Url, Equals, "Patient/"+deletedID)
+	c.Assert(bundle.Entry[0].Resource, IsNil)
+	c.Assert(bundle.Entry[1].Request.Method, Equals, "POST")
+	c.Assert(bundle.Entry[1].Request.Url, Equals, "Patient")
+	c.Assert(bundle.Entry[1].FullUrl, Equals, s.Server.URL+"/Patient/"+deletedID)
+	c.Assert(bundle.Entry[2].Request.Method, Equals, "PUT")
+	c.Assert(bundle.Entry[2].Request.Url, Equals, "Patient/"+updatedID)
+	c.Assert(bundle.Entry[2].Resource.(*models.Patient).Meta.VersionId, Equals, "2")
+	c.Assert(bundle.Entry[3].Request.Method, Equals, "POST")
+	c.Assert(bundle.Entry[3].Resource.(*models.Patient).Id, Equals, updatedID)
+	c.Assert(bundle.Entry[3].Resource.(*models.Patient).Meta.VersionId, Equals, "1")
+
+	// paging
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient/_history?_count=3&_since="+since, 3, 4)
+	c.Assert(bundle.Entry[0].Request.Method, Equals, "DELETE")
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "next", 3, 3)
+	bundle = assertBundleCount(c, bundle.Link[2].Url, 1, 4)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Id, Equals, updatedID)
+	c.Assert(bundle.Entry[0].Request.Method, Equals, "POST")
+
+	// system-level history also includes other resource types
+	res, err := postFixture(s.Server.URL, "Condition", "../fixtures/condition.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	bundle = assertBundleCount(c, s.Server.URL+"/_history?_since="+since, 5, 5)
+	c.Assert(bundle.Entry[0].Request.Url, Equals, "Condition")
+	c.Assert(bundle.Entry[1].Request.Method, Equals, "DELETE")
+
+	// the versions of the collections are merged in the same order page by page
+	for i, entry := range bundle.Entry {
+		page := assertBundleCount(c, fmt.Sprintf("%s/_history?_count=1&_offset=%d&_since=%s", s.Server.URL, i, since), 1, 5)
+		c.Assert(page.Entry[0].Request.Method, Equals, entry.Request.Method)
+		c.Assert(page.Entry[0].FullUrl, Equals, entry.FullUrl)
+	}
+	assertBundleCount(c, s.Server.URL+"/_history?_offset=10000000&_since="+since, 0, 5)
+
+	res, err = http.Get(s.Server.URL + "/Patient/_history?_since=yesterday")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestVreadAdjacentVersionHeaders(c *C) {
+	res, err := postFixture(s.Server.URL, "Patient", "../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	id := resourceIdFromLocation(res)
+
+	for _, fixture := range []string{"../fixtures/patient-example-c.json", "../fixtures/patient-example-b.json"} {
+		data, err := ioutil.ReadFile(fixture)
+		util.CheckErr(err)
+		req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+id, bytes.NewReader(data))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+
+	vread := func(versionId string) (previous string, next string) {
+		res, err := http.Get(s.Server.URL + "/Patient/" + id + "/_history/" + versionId)
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+		return res.Header.Get("X-GoFHIR-Previous-Version"), res.Header.Get("X-GoFHIR-Next-Version")
+	}
+
+	previous, next := vread("2")
+	c.Assert(previous, Equals, "1")
+	c.Assert(next, Equals, "3")
+
+	previous, next = vread("1")
+	c.Assert(previous, Equals, "")
+	c.Assert(next, Equals, "2")
+
+	previous, next = vread("3")
+	c.Assert(previous, Equals, "2")
+	c.Assert(next, Equals, "")
+
+	// plain reads don't have the headers
+	res, err = http.Get(s.Server.URL + "/Patient/" + id)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.Header.Get("X-GoFHIR-Previous-Version"), Equals, "")
+}
+
+func (s *ServerSuite) TestInstanceHistorySinceAndAt(c *C) {
+	now := func() string {
+		time.Sleep(10 * time.Millisecond) // distinct lastUpdated times
+		instant := url.QueryEscape(time.Now().UTC().Format(time.RFC3339Nano))
+		time.Sleep(10 * time.Millisecond)
+		return instant
+	}
+	update := func(id string, fixture string) {
+		data, err := ioutil.ReadFile(fixture)
+		util.CheckErr(err)
+		req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+id, bytes.NewReader(data))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+
+	res, err := postFixture(s.Server.URL, "Patient", "../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	id := resourceIdFromLocation(res)
+	beforeV2 := now()
+	update(id, "../fixtures/patient-example-c.json")
+	beforeV3 := now()
+	update(id, "../fixtures/patient-example-b.json")
+
+	historyURL := s.Server.URL + "/Patient/" + id + "/_history"
+	bundle := assertBundleCount(c, historyURL, 3, 3)
+	c.Assert(bundle.Entry[2].Request.Method, Equals, "POST")
+
+	bundle = assertBundleCount(c, historyURL+"?_since="+beforeV2, 2, 2)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "3")
+	c.Assert(bundle.Entry[1].Resource.(*models.Patient).Meta.VersionId, Equals, "2")
+	c.Assert(bundle.Entry[1].Request.Method, Equals, "PUT")
+
+	bundle = assertBundleCount(c, historyURL+"?_since="+beforeV3, 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "3")
+
+	// combined with paging
+	bundle = assertBundleCount(c, historyURL+"?_count=1&_since="+beforeV2, 1, 2)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "3")
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "next", 1, 1)
+	c.Assert(bundle.Link[2].Url, Matches, ".*_since=.*")
+	bundle = assertBundleCount(c, bundle.Link[2].Url, 1, 2)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "2")
+
+	// _at returns the version that was current at the time
+	bundle = assertBundleCount(c, historyURL+"?_at="+beforeV3, 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "2")
+	bundle = assertBundleCount(c, historyURL+"?_at="+beforeV2, 1, 1)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "1")
+
+	res, err = http.Get(historyURL + "?_at=yesterday")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+	res, err = http.Get(s.Server.URL + "/Patient/_history?_at=" + beforeV2)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
+func (s *ServerSuite) TestInstanceHistoryPaging(c *C) {
+	res, err := postFixture(s.Server.URL, "Patient", "../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	id := resourceIdFromLocation(res)
+
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	for i := 2; i <= 25; i++ {
+		req, err := http.NewRequest("PUT", s.Server.URL+"/Patient/"+id, bytes.NewReader(data))
+		util.CheckErr(err)
+		req.Header.Set("Content-Type", "application/json")
+		res, err := http.DefaultClient.Do(req)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 200)
+	}
+
+	versionIds := func(bundle *models.Bundle) []string {
+		var ids []string
+		for _, entry := range bundle.Entry {
+			ids = append(ids, entry.Resource.(*models.Patient).Meta.VersionId)
+		}
+		return ids
+	}
+
+	historyURL := s.Server.URL + "/Patient/" + id + "/_history"
+	bundle := assertBundleCount(c, historyURL+"?_count=10", 10, 25)
+	c.Assert(versionIds(bundle), DeepEquals, []string{"25", "24", "23", "22", "21", "20", "19", "18", "17", "16"})
+	c.Assert(bundle.Entry[0].Request.Method, Equals, "PUT")
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[0], "self", 10, 0)
+	assertPagingLink(c, bundle.Link[2], "next", 10, 10)
+
+	bundle = assertBundleCount(c, bundle.Link[2].Url, 10, 25)
+	c.Assert(versionIds(bundle), DeepEquals, []string{"15", "14", "13", "12", "11", "10", "9", "8", "7", "6"})
+	c.Assert(bundle.Link, HasLen, 4)
+	assertPagingLink(c, bundle.Link[2], "previous", 10, 0)
+	assertPagingLink(c, bundle.Link[3], "next", 10, 20)
+
+	bundle = assertBundleCount(c, bundle.Link[3].Url, 5, 25)
+	c.Assert(versionIds(bundle), DeepEquals, []string{"5", "4", "3", "2", "1"})
+	c.Assert(bundle.Entry[3].Request.Method, Equals, "PUT")
+	c.Assert(bundle.Entry[4].Request.Method, Equals, "POST")
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "previous", 10, 10)
+
+	assertBundleCount(c, historyURL+"?_count=10&_offset=30", 0, 25)
+}
+
+func (s *ServerSuite) TestPutDeletedPatient(c *C) {
+	res, err := postFixture(s.Server.URL, "Patient", "../fixtures/patient-example-b.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	id := resourceIdFromLocation(res)
+
+	req, err := http.NewRequest("DELETE", s.Server.URL+"/Patient/"+id, nil)
+	util.CheckErr(err)
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 204)
+	c.Assert(res.Header.Get("ETag"), Equals, "W/\"2\"")
+
+	// updating the deleted patient brings it back as its next version
+	data, err := ioutil.ReadFile("../fixtures/patient-example-c.json")
+	util.CheckErr(err)
+	req, err = http.NewRequest("PUT", s.Server.URL+"/Patient/"+id, bytes.NewReader(data))
+	util.CheckErr(err)
+	req.Header.Set("Content-Type", "application/json")
+	res, err = http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+	c.Assert(res.Header.Get("ETag"), Equals, "W/\"3\"")
+
+	res, err = http.Get(s.Server.URL + "/Patient/" + id)
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// with the deletion in between in its history
+	bundle := assertBundleCount(c, s.Server.URL+"/Patient/"+id+"/_history", 3, 3)
+	c.Assert(bundle.Entry[0].Resource.(*models.Patient).Meta.VersionId, Equals, "3")
+	c.Assert(bundle.Entry[1].Request.Method, Equals, "DELETE")
+	c.Assert(bundle.Entry[1].Resource, IsNil)
+	c.Assert(bundle.Entry[2].Resource.(*models.Patient).Meta.VersionId, Equals, "1")
+	c.Assert(bundle.Entry[2].Request.Method, Equals, "POST")
+}
+
 func (s *ServerSuite) TestConditionalDelete(c *C) {
 
 	// Add 39 more patients (with total 32 male and 8 female)
@@ -1059,6 +3010,51 @@ func (s *ServerSuite) TestConditionalDelete(c *C) {
 	c.Assert(count, Equals, 8)
 }
 
+func (s *ServerSuite) TestConditionalDeleteDryRun(c *C) {
+	patientCollection := s.DB().C("patients")
+	var femaleIDs []string
+	for i := 0; i < 3; i++ {
+		fix := loadFixture("Patient", "../fixtures/patient-example-a.json")
+		patient := fix.(*models.Patient)
+		patient.Id = bson.NewObjectId().Hex()
+		patient.Gender = "female"
+		util.CheckErr(patientCollection.Insert(patient))
+		femaleIDs = append(femaleIDs, "Patient/"+patient.Id)
+	}
+	count, err := patientCollection.Count()
+	util.CheckErr(err)
+	prevCount, err := s.DB().C("patients_prev").Count()
+	util.CheckErr(err)
+
+	req, err := http.NewRequest("DELETE", s.Server.URL+"/Patient?gender=female&_dryRun=true", nil)
+	util.CheckErr(err)
+	res, err := http.DefaultClient.Do(req)
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	outcome := &models.OperationOutcome{}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(outcome))
+	c.Assert(outcome.Issue, HasLen, 4)
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, "Dry run: 3 Patient resources match and would be deleted")
+	var matchedIDs []string
+	for _, issue := range outcome.Issue[1:] {
+		c.Assert(issue.Severity, Equals, "information")
+		matchedIDs = append(matchedIDs, issue.Diagnostics)
+	}
+	sort.Strings(femaleIDs)
+	sort.Strings(matchedIDs)
+	c.Assert(matchedIDs, DeepEquals, femaleIDs)
+
+	// nothing was deleted nor added to the history
+	newCount, err := patientCollection.Count()
+	util.CheckErr(err)
+	c.Assert(newCount, Equals, count)
+	newPrevCount, err := s.DB().C("patients_prev").Count()
+	util.CheckErr(err)
+	c.Assert(newPrevCount, Equals, prevCount)
+}
+
 func (s *ServerSuite) TestUnescapedLinksInJSONResponse(c *C) {
 	req, err := http.NewRequest("GET", s.Server.URL+"/Bundle", nil)
 	util.CheckErr(err)
@@ -1103,6 +3099,33 @@ func (s *ServerSuite) TestEmbbeddedResourceIDsGetRetrievedCorrectly(c *C) {
 	c.Assert(resource["_id"], IsNil)
 }
 
+func (s *ServerSuite) TestDocumentBundleInternalReferences(c *C) {
+	res, err := postFixture(s.Server.URL, "Bundle", "../fixtures/document_bundle.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	bundleID := resourceIdFromLocation(res)
+
+	getComposition := func(query string) map[string]interface{} {
+		res, err := http.Get(s.Server.URL + "/Bundle/" + bundleID + query)
+		util.CheckErr(err)
+		c.Assert(res.StatusCode, Equals, 200)
+		body, err := ioutil.ReadAll(res.Body)
+		util.CheckErr(err)
+		var jsonBundle map[string]interface{}
+		util.CheckErr(json.Unmarshal(body, &jsonBundle))
+		c.Assert(jsonBundle["__fullUrls"], IsNil)
+		entry := jsonBundle["entry"].([]interface{})[0].(map[string]interface{})
+		return entry["resource"].(map[string]interface{})
+	}
+
+	composition := getComposition("")
+	c.Assert(composition["subject"].(map[string]interface{})["reference"], Equals, "urn:uuid:ae2eb9c2-5e26-4ee4-9bd1-3ce3f8e9d1f4")
+
+	composition = getComposition("?_resolveInternalReferences=true")
+	c.Assert(composition["subject"].(map[string]interface{})["reference"], Equals, "Patient/d1")
+	c.Assert(composition["encounter"].(map[string]interface{})["reference"], Equals, "Encounter/d2")
+}
+
 func (s *ServerSuite) TestContainedResources(c *C) {
 	res, err := postFixture(s.Server.URL, "Condition", "../fixtures/condition_with_contained_patient.json")
 	util.CheckErr(err)
@@ -1148,6 +3171,35 @@ func (s *ServerSuite) TestContainedResources(c *C) {
 	util.CheckErr(err)
 }
 
+func (s *ServerSuite) TestContainedSearch(c *C) {
+	res, err := postFixture(s.Server.URL, "Condition", "../fixtures/condition_with_contained_patient.json")
+	util.CheckErr(err)
+	c.Assert(res.StatusCode, Equals, 201)
+	conditionId := resourceIdFromLocation(res)
+	defer s.DB().C("conditions").RemoveId(conditionId)
+
+	// the contained patient isn't searched by default
+	bundle := performSearch(c, s.Server.URL+"/Patient?family=Abbott")
+	for _, entry := range bundle.Entry {
+		c.Assert(entry.FullUrl, Not(Matches), ".*/Condition/.*")
+	}
+
+	// with _contained=true the condition containing it is found
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient?family=Abbott&_contained=true", 1, 1)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Condition/"+conditionId)
+	c.Assert(bundle.Entry[0].Resource.(*models.Condition).Id, Equals, conditionId)
+
+	// or the contained patient itself with _containedType=contained
+	bundle = assertBundleCount(c, s.Server.URL+"/Patient?family=Abbott&_contained=true&_containedType=contained", 1, 1)
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Condition/"+conditionId+"#4954037118555241963")
+	patient := bundle.Entry[0].Resource.(*models.Patient)
+	c.Assert(patient.Id, Equals, "4954037118555241963")
+	c.Assert(patient.Gender, Equals, "male")
+
+	// the criteria apply to the contained patient
+	assertBundleCount(c, s.Server.URL+"/Patient?family=Abbott&gender=female&_contained=true", 0, 0)
+}
+
 func (s *ServerSuite) TestSummaryCount(c *C) {
 	req, err := http.NewRequest("GET", s.Server.URL+"/Patient?_summary=count", nil)
 	util.CheckErr(err)
@@ -1173,6 +3225,201 @@ func (s *ServerSuite) TestSummaryCount(c *C) {
 	c.Assert(self.Url, Equals, s.Server.URL+"/Patient?_summary=count")
 }
 
+func (s *ServerSuite) TestCountZero(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient?_count=0")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// Like _summary=count: a total, no entries and a single self link
+	bundle := &models.Bundle{}
+	err = json.NewDecoder(res.Body).Decode(bundle)
+	util.CheckErr(err)
+
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(bundle.Entry, HasLen, 0)
+	c.Assert(bundle.Link, HasLen, 1)
+	c.Assert(bundle.Link[0].Relation, Equals, "self")
+	c.Assert(bundle.Link[0].Url, Equals, s.Server.URL+"/Patient?_count=0")
+}
+
+func (s *ServerSuite) TestSummaryCountIgnoresCount(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient?_summary=count&_count=50")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	// _count is ignored: a total, no entries and a single self link without _count
+	bundle := &models.Bundle{}
+	err = json.NewDecoder(res.Body).Decode(bundle)
+	util.CheckErr(err)
+
+	c.Assert(*bundle.Total, Equals, uint32(1))
+	c.Assert(bundle.Entry, HasLen, 0)
+	c.Assert(bundle.Link, HasLen, 1)
+	c.Assert(bundle.Link[0].Relation, Equals, "self")
+	c.Assert(bundle.Link[0].Url, Equals, s.Server.URL+"/Patient?_summary=count")
+}
+
+func (s *ServerSuite) TestPatientCompartmentSearch(c *C) {
+	post := func(resourceType string, body string) string {
+		res, err := http.Post(s.Server.URL+"/"+resourceType, "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 201)
+		return resourceIdFromLocation(res)
+	}
+	condition := func(patientID, code string) string {
+		return post("Condition", `{"resourceType":"Condition","verificationStatus":"confirmed",`+
+			`"code":{"coding":[{"system":"http://snomed.info/sct","code":"`+code+`"}]},`+
+			`"subject":{"reference":"Patient/`+patientID+`"}}`)
+	}
+	otherPatientID := post("Patient", `{"resourceType":"Patient","gender":"male"}`)
+	diabetesID := condition(s.FixtureID, "44054006")
+	asthmaID := condition(s.FixtureID, "195967001")
+	condition(otherPatientID, "44054006")
+
+	ids := func(url string) []string {
+		bundle := performSearch(c, url)
+		var ids []string
+		for _, entry := range bundle.Entry {
+			ids = append(ids, entry.Resource.(*models.Condition).Id)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	expected := []string{diabetesID, asthmaID}
+	sort.Strings(expected)
+
+	c.Assert(ids(s.Server.URL+"/Patient/"+s.FixtureID+"/Condition"), DeepEquals, expected)
+	c.Assert(ids(s.Server.URL+"/Patient/"+s.FixtureID+"/Condition?code=http://snomed.info/sct|44054006"), DeepEquals, []string{diabetesID})
+	c.Assert(ids(s.Server.URL+"/Patient/"+otherPatientID+"/Condition?code=http://snomed.info/sct|195967001"), HasLen, 0)
+
+	res, err := http.Get(s.Server.URL + "/Patient/" + s.FixtureID + "/Organization")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+func (s *ServerSuite) TestSearchIterativeInclude(c *C) {
+	post := func(resourceType string, body string) string {
+		res, err := http.Post(s.Server.URL+"/"+resourceType, "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 201)
+		return resourceIdFromLocation(res)
+	}
+	organizationID := post("Organization", `{"resourceType":"Organization","name":"Acme Clinic"}`)
+	patientID := post("Patient", `{"resourceType":"Patient","managingOrganization":{"reference":"Organization/`+organizationID+`"}}`)
+	observationID := post("Observation", `{"resourceType":"Observation","status":"final","code":{"text":"weight"},"subject":{"reference":"Patient/`+patientID+`"}}`)
+
+	searchModes := func(query string) map[string]string {
+		bundle := performSearch(c, s.Server.URL+"/Observation?_id="+observationID+"&"+query)
+		modes := make(map[string]string)
+		for _, entry := range bundle.Entry {
+			parts := strings.Split(entry.FullUrl, "/")
+			modes[strings.Join(parts[len(parts)-2:], "/")] = entry.Search.Mode
+		}
+		return modes
+	}
+
+	c.Assert(searchModes("_include=Observation:subject"), DeepEquals, map[string]string{
+		"Observation/" + observationID: "match",
+		"Patient/" + patientID:         "include",
+	})
+	c.Assert(searchModes("_include=Observation:subject&_include:iterate=Patient:organization"), DeepEquals, map[string]string{
+		"Observation/" + observationID:   "match",
+		"Patient/" + patientID:           "include",
+		"Organization/" + organizationID: "include",
+	})
+}
+
+func (s *ServerSuite) TestSearchElements(c *C) {
+	res, err := http.Get(s.Server.URL + "/Patient?_elements=gender,name")
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var bundle struct {
+		Entry []struct {
+			Resource map[string]interface{} `json:"resource"`
+		} `json:"entry"`
+		Link []models.BundleLinkComponent `json:"link"`
+	}
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&bundle))
+	c.Assert(bundle.Entry, HasLen, 1)
+	c.Assert(bundle.Link[0].Url, Matches, `.*_elements=gender(%2C|,)name.*`)
+
+	patient := bundle.Entry[0].Resource
+	var elements []string
+	for element := range patient {
+		elements = append(elements, element)
+	}
+	sort.Strings(elements)
+	c.Assert(elements, DeepEquals, []string{"gender", "id", "meta", "name", "resourceType"})
+
+	meta := patient["meta"].(map[string]interface{})
+	c.Assert(meta["versionId"], NotNil)
+	c.Assert(meta["tag"], DeepEquals, []interface{}{
+		map[string]interface{}{"system": "http://hl7.org/fhir/v3/ObservationValue", "code": "SUBSETTED"},
+	})
+}
+
+func (s *ServerSuite) TestStatsGroupsEncountersByStatus(c *C) {
+	for _, status := range []string{"finished", "in-progress", "finished"} {
+		res, err := http.Post(s.Server.URL+"/Encounter", "application/fhir+json", strings.NewReader(`{"resourceType":"Encounter","status":"`+status+`"}`))
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 201)
+	}
+	res, err := http.Post(s.Server.URL+"/Encounter", "application/fhir+json", strings.NewReader(`{"resourceType":"Encounter"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 201)
+
+	getStats := func(query string) *models.Parameters {
+		res, err := http.Get(s.Server.URL + "/Encounter/$stats?" + query)
+		util.CheckErr(err)
+		defer res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 200)
+
+		parameters := &models.Parameters{}
+		util.CheckErr(json.NewDecoder(res.Body).Decode(parameters))
+		return parameters
+	}
+
+	parameters := getStats("field=status")
+	c.Assert(parameters.Parameter, HasLen, 4)
+	c.Assert(parameters.Parameter[0].Name, Equals, "total")
+	c.Assert(*parameters.Parameter[0].ValueInteger, Equals, int32(4))
+
+	counts := make(map[string]int32)
+	for _, group := range parameters.Parameter[1:] {
+		c.Assert(group.Name, Equals, "group")
+		value := "(missing)"
+		if len(group.Part) == 2 {
+			c.Assert(group.Part[0].Name, Equals, "value")
+			value = group.Part[0].ValueString
+		}
+		countPart := group.Part[len(group.Part)-1]
+		c.Assert(countPart.Name, Equals, "count")
+		counts[value] = *countPart.ValueInteger
+	}
+	c.Assert(counts, DeepEquals, map[string]int32{"finished": 2, "in-progress": 1, "(missing)": 1})
+	c.Assert(parameters.Parameter[1].Part[0].ValueString, Equals, "finished")
+
+	// other parameters restrict the resources that are counted
+	parameters = getStats("field=status&status=in-progress")
+	c.Assert(parameters.Parameter, HasLen, 2)
+	c.Assert(*parameters.Parameter[0].ValueInteger, Equals, int32(1))
+	c.Assert(parameters.Parameter[1].Part[0].ValueString, Equals, "in-progress")
+
+	res, err = http.Get(s.Server.URL + "/Encounter/$stats?field=$where")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+}
+
 func (s *ServerSuite) TestPatientEverything(c *C) {
 
 	data, err := os.Open("../fixtures/patient-example-d.json")
@@ -1200,11 +3447,104 @@ func (s *ServerSuite) TestPatientEverything(c *C) {
 	// The only resource referring to this patient is the Patient resource itself, so we expect only 1 entry
 	c.Assert(len(bundle.Entry), Equals, 1)
 
-	c.Assert(len(bundle.Link), Equals, 1)
-	self := bundle.Link[0]
-	c.Assert(self.Relation, Equals, "self")
-	// The self link should correctly show $everything as it's defined: _id=<id>&_include=*&_revinclude=*
-	c.Assert(self.Url, Equals, s.Server.URL+"/Patient?_id="+createdPatientID+"&_include=*&_revinclude=*")
+	c.Assert(len(bundle.Link), Equals, 2)
+	assertPagingLink(c, bundle.Link[0], "self", 100, 0)
+	assertPagingLink(c, bundle.Link[1], "first", 100, 0)
+	c.Assert(bundle.Link[0].Url, Matches, s.Server.URL+"/Patient/"+createdPatientID+`/\$everything\?.*`)
+}
+
+func (s *ServerSuite) TestPatientEverythingPagingAndTypes(c *C) {
+	res, err := http.Post(s.Server.URL+"/Patient", "application/fhir+json", strings.NewReader(`{"resourceType":"Patient","gender":"female"}`))
+	util.CheckErr(err)
+	res.Body.Close()
+	patientID := resourceIdFromLocation(res)
+
+	post := func(resourceType string, body string) {
+		res, err := http.Post(s.Server.URL+"/"+resourceType, "application/fhir+json", strings.NewReader(body))
+		util.CheckErr(err)
+		res.Body.Close()
+		c.Assert(res.StatusCode, Equals, 201)
+	}
+	for i := 0; i < 3; i++ {
+		post("Condition", `{"resourceType":"Condition","subject":{"reference":"Patient/`+patientID+`"}}`)
+	}
+	for i := 0; i < 2; i++ {
+		post("Encounter", `{"resourceType":"Encounter","status":"finished","subject":{"reference":"Patient/`+patientID+`"}}`)
+	}
+	// unrelated
+	post("Condition", `{"resourceType":"Condition","subject":{"reference":"Patient/`+s.FixtureID+`"}}`)
+
+	everythingURL := s.Server.URL + "/Patient/" + patientID + "/$everything"
+	resourceTypes := func(bundle *everythingBundle) map[string]int {
+		types := make(map[string]int)
+		for _, entry := range bundle.Entry {
+			types[entry.Resource["resourceType"].(string)]++
+		}
+		return types
+	}
+
+	bundle := performEverything(c, everythingURL)
+	c.Assert(*bundle.Total, Equals, uint32(6))
+	c.Assert(resourceTypes(bundle), DeepEquals, map[string]int{"Patient": 1, "Condition": 3, "Encounter": 2})
+	c.Assert(bundle.Entry[0].FullUrl, Equals, s.Server.URL+"/Patient/"+patientID)
+
+	// _type excludes the encounters (and the patient)
+	bundle = performEverything(c, everythingURL+"?_type=Condition")
+	c.Assert(*bundle.Total, Equals, uint32(3))
+	c.Assert(resourceTypes(bundle), DeepEquals, map[string]int{"Condition": 3})
+	c.Assert(bundle.Link[0].Url, Matches, `.*_type=Condition.*`)
+
+	// paging through everything with _count=4
+	bundle = performEverything(c, everythingURL+"?_count=4")
+	c.Assert(*bundle.Total, Equals, uint32(6))
+	c.Assert(bundle.Entry, HasLen, 4)
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "next", 4, 4)
+	seen := resourceTypes(bundle)
+
+	bundle = performEverything(c, bundle.Link[2].Url)
+	c.Assert(bundle.Entry, HasLen, 2)
+	c.Assert(bundle.Link, HasLen, 3)
+	assertPagingLink(c, bundle.Link[2], "previous", 4, 0)
+	for resourceType, count := range resourceTypes(bundle) {
+		seen[resourceType] += count
+	}
+	c.Assert(seen, DeepEquals, map[string]int{"Patient": 1, "Condition": 3, "Encounter": 2})
+
+	// _since
+	bundle = performEverything(c, everythingURL+"?_since="+url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339)))
+	c.Assert(*bundle.Total, Equals, uint32(0))
+	c.Assert(bundle.Entry, HasLen, 0)
+
+	res, err = http.Get(everythingURL + "?_type=Frobnicator")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 400)
+
+	res, err = http.Get(s.Server.URL + "/Patient/" + bson.NewObjectId().Hex() + "/$everything")
+	util.CheckErr(err)
+	res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 404)
+}
+
+type everythingBundle struct {
+	Total *uint32
+	Entry []struct {
+		FullUrl  string
+		Resource map[string]interface{}
+	}
+	Link []models.BundleLinkComponent
+}
+
+func performEverything(c *C, url string) *everythingBundle {
+	res, err := http.Get(url)
+	util.CheckErr(err)
+	defer res.Body.Close()
+	c.Assert(res.StatusCode, Equals, 200)
+
+	var bundle everythingBundle
+	util.CheckErr(json.NewDecoder(res.Body).Decode(&bundle))
+	return &bundle
 }
 
 func performSearch(c *C, url string) *models.Bundle {
@@ -1224,6 +3564,17 @@ func assertBundleCount(c *C, url string, expectedResults int, expectedTotal int)
 	return bundle
 }
 
+// assertSearchWarning checks that the last entry of a searchset is an OperationOutcome with the warning
+func assertSearchWarning(c *C, bundle *models.Bundle, diagnostics string) {
+	last := bundle.Entry[len(bundle.Entry)-1]
+	c.Assert(last.Search.Mode, Equals, "outcome")
+	outcome, ok := last.Resource.(*models.OperationOutcome)
+	c.Assert(ok, Equals, true)
+	c.Assert(outcome.Issue, HasLen, 1)
+	c.Assert(outcome.Issue[0].Severity, Equals, "warning")
+	c.Assert(outcome.Issue[0].Diagnostics, Equals, diagnostics)
+}
+
 func assertPagingLink(c *C, link models.BundleLinkComponent, relation string, count int, offset int) {
 	c.Assert(link.Relation, Equals, relation)
 
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"strings"
+
+	"github.com/golang/glog"
+	mongowrapper "github.com/opencensus-integrations/gomongowrapper"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ShardKey is the shard key given to resource collections when they are created on a sharded cluster
+type ShardKey struct {
+	// Field to shard on, e.g. "_id" (sharding is disabled if empty)
+	Field string
+	// Hashed selects hashed rather than ranged sharding
+	Hashed bool
+}
+
+// MongoDB error codes returned when sharding isn't available or was already set up
+const (
+	mongoCodeCommandNotFound             = 59
+	mongoCodeShardingStateNotInitialized = 203
+	mongoCodeAlreadyInitialized          = 23
+)
+
+func enableShardingCommand(dbName string) bson.D {
+	return bson.D{{"enableSharding", dbName}}
+}
+
+func shardCollectionCommand(dbName string, collectionName string, key ShardKey) bson.D {
+	var keyType interface{} = 1
+	if key.Hashed {
+		keyType = "hashed"
+	}
+	return bson.D{
+		{"shardCollection", dbName + "." + collectionName},
+		{"key", bson.D{{key.Field, keyType}}},
+	}
+}
+
+// isShardingUnavailable returns true for errors from running sharding commands against
+// a MongoDB server that isn't a mongos for a sharded cluster
+func isShardingUnavailable(err error) bool {
+	commandErr, ok := errors.Cause(err).(mongo.CommandError)
+	if !ok {
+		return false
+	}
+	return commandErr.Code == mongoCodeCommandNotFound || commandErr.Code == mongoCodeShardingStateNotInitialized
+}
+
+// isAlreadySharded returns true for errors from enabling sharding on a database or collection
+// that is already sharded
+func isAlreadySharded(err error) bool {
+	commandErr, ok := errors.Cause(err).(mongo.CommandError)
+	if !ok {
+		return false
+	}
+	return commandErr.Code == mongoCodeAlreadyInitialized || strings.Contains(commandErr.Message, "already")
+}
+
+// ShardCollections enables sharding on db and shards the given collections using key.
+// If the server isn't part of a sharded cluster a warning is logged and nothing is done.
+func ShardCollections(ctx context.Context, db *mongowrapper.WrappedDatabase, collectionNames []string, key ShardKey) error {
+	if key.Field == "" {
+		return nil
+	}
+	admin := db.Client().Database("admin")
+
+	err := admin.RunCommand(ctx, enableShardingCommand(db.Name())).Err()
+	if isShardingUnavailable(err) {
+		glog.Warningf("ShardCollections: not sharding collections in %s as MongoDB is not a sharded cluster (%s)", db.Name(), err)
+		return nil
+	} else if err != nil && !isAlreadySharded(err) {
+		return errors.Wrapf(err, "failed to enable sharding for database %s", db.Name())
+	}
+
+	for _, name := range collectionNames {
+		err = admin.RunCommand(ctx, shardCollectionCommand(db.Name(), name, key)).Err()
+		if err != nil && !isAlreadySharded(err) {
+			return errors.Wrapf(err, "failed to shard collection %s.%s", db.Name(), name)
+		}
+	}
+	return nil
+}
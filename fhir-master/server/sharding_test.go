@@ -0,0 +1,47 @@
+package server
+
+import (
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	. "gopkg.in/check.v1"
+)
+
+type ShardingSuite struct {
+}
+
+var _ = Suite(&ShardingSuite{})
+
+func (s *ShardingSuite) TestShardCollectionCommand(c *C) {
+	cmd := shardCollectionCommand("tenant1_fhir", "patients", ShardKey{Field: "_id"})
+	c.Assert(cmd, DeepEquals, bson.D{
+		{"shardCollection", "tenant1_fhir.patients"},
+		{"key", bson.D{{"_id", 1}}},
+	})
+
+	cmd = shardCollectionCommand("tenant1_fhir", "patients_prev", ShardKey{Field: "_id", Hashed: true})
+	c.Assert(cmd, DeepEquals, bson.D{
+		{"shardCollection", "tenant1_fhir.patients_prev"},
+		{"key", bson.D{{"_id", "hashed"}}},
+	})
+
+	c.Assert(enableShardingCommand("tenant1_fhir"), DeepEquals, bson.D{{"enableSharding", "tenant1_fhir"}})
+}
+
+func (s *ShardingSuite) TestShardingErrors(c *C) {
+	notMongos := mongo.CommandError{Code: 59, Message: "no such command: 'enableSharding'"}
+	c.Assert(isShardingUnavailable(notMongos), Equals, true)
+	c.Assert(isAlreadySharded(notMongos), Equals, false)
+
+	alreadySharded := mongo.CommandError{Code: 20, Message: "sharding already enabled for collection tenant1_fhir.patients"}
+	c.Assert(isShardingUnavailable(alreadySharded), Equals, false)
+	c.Assert(isAlreadySharded(alreadySharded), Equals, true)
+
+	c.Assert(isShardingUnavailable(nil), Equals, false)
+	c.Assert(isAlreadySharded(mongo.CommandError{Code: 13, Message: "not authorized on admin"}), Equals, false)
+}
+
+func (s *ShardingSuite) TestResourceCollectionNames(c *C) {
+	names := resourceCollectionNames()
+	c.Assert(names[0]+"_prev", Equals, names[1])
+	c.Assert(len(names)%2, Equals, 0)
+}
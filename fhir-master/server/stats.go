@@ -0,0 +1,74 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/search"
+)
+
+// statsFieldRegex matches the dot-separated element paths that can be grouped by,
+// keeping operators such as $where and internal fields such as _id out of the pipeline
+var statsFieldRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(\.[A-Za-z][A-Za-z0-9]*)*$`)
+
+// StatsHandler handles the $stats operation (e.g. GET /Encounter/$stats?field=status),
+// returning the number of resources for each value of the field as a Parameters resource.
+// Any other parameters are search parameters restricting the resources that are counted.
+func (rc *ResourceController) StatsHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Action", "stats")
+
+	values := c.Request.URL.Query()
+	field := values.Get("field")
+	if !statsFieldRegex.MatchString(field) {
+		outcome := models.NewOperationOutcome("error", "invalid", "The field parameter must be the path of an element, such as status or class.code")
+		c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+		return
+	}
+	values.Del("field")
+
+	session := rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+	defer session.Finish()
+
+	searchQuery := search.Query{Resource: rc.Name, Query: values.Encode()}
+	counts, err := session.GroupCounts(searchQuery, field)
+	if err != nil {
+		panic(errors.Wrap(err, "GroupCounts failed"))
+	}
+
+	c.Render(http.StatusOK, CustomFhirRenderer{statsParameters(counts), c})
+}
+
+// statsParameters has a total parameter followed by a group parameter for each value,
+// whose parts are the value (omitted for resources without the field) and its count
+func statsParameters(counts []search.GroupCount) *models.Parameters {
+	var total int32
+	groups := make([]models.ParametersParameterComponent, 0, len(counts))
+	for _, count := range counts {
+		n := int32(count.Count)
+		total += n
+
+		group := models.ParametersParameterComponent{Name: "group"}
+		if count.Value != nil {
+			value := models.ParametersParameterComponent{Name: "value"}
+			if s, ok := count.Value.(string); ok {
+				value.ValueString = s
+			} else {
+				value.ValueString = fmt.Sprint(count.Value)
+			}
+			group.Part = append(group.Part, value)
+		}
+		group.Part = append(group.Part, models.ParametersParameterComponent{Name: "count", ValueInteger: &n})
+		groups = append(groups, group)
+	}
+
+	parameters := &models.Parameters{}
+	parameters.Parameter = append(parameters.Parameter, models.ParametersParameterComponent{Name: "total", ValueInteger: &total})
+	parameters.Parameter = append(parameters.Parameter, groups...)
+	return parameters
+}
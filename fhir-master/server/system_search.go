@@ -0,0 +1,206 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	"github.com/eug48/fhir/search"
+)
+
+// SystemSearchHandler handles searches across the resource types listed in the _type parameter
+// (e.g. GET /?_type=Patient,Condition&_lastUpdated=gt2019-01-01 or POST /_search), running the search
+// for each type and merging the results into one searchset with the sum of their totals. The other
+// parameters have to be defined for all the types, such as _id, _lastUpdated and _tag. _count, _offset
+// and _sort apply to the results of each type, which follow one another in the order of _type.
+func SystemSearchHandler(dal DataAccessLayer, config Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer handlePanics(c)
+		c.Set("Action", "search")
+
+		rawQuery, ok := searchRawQuery(c)
+		if !ok {
+			return
+		}
+		resourceTypes, typeQuery, err := splitTypeParameter(rawQuery)
+		if err != nil {
+			outcome := models.NewOperationOutcome("error", "invalid", err.Error())
+			c.Render(http.StatusBadRequest, CustomFhirRenderer{outcome, c})
+			return
+		}
+
+		session := dal.StartSession(c.Request.Context(), c.GetHeader("Db"))
+		defer session.Finish()
+
+		bundles := make([]*models2.ShallowBundle, len(resourceTypes))
+		var defaultFilters []string
+		for i, resourceType := range resourceTypes {
+			searchQuery := search.Query{Resource: resourceType, Query: typeQuery}
+			if filters := NewResourceController(resourceType, dal, config).applyDefaultSearchFilters(&searchQuery); filters != "" {
+				defaultFilters = append(defaultFilters, resourceType+": "+filters)
+			}
+			bundles[i], err = session.Search(*config.responseURL(c.Request, resourceType), searchQuery)
+			if err != nil {
+				panic(errors.Wrapf(err, "Search of %s failed", resourceType))
+			}
+		}
+
+		bundle, err := mergeSearchBundles(bundles)
+		if err != nil {
+			panic(errors.Wrap(err, "failed to merge search results"))
+		}
+		if len(defaultFilters) > 0 {
+			issue := models.OperationOutcomeIssueComponent{
+				Severity:    "warning",
+				Code:        "informational",
+				Diagnostics: "Default search filters were applied: " + strings.Join(defaultFilters, "; "),
+			}
+			if err := addSearchOutcomeIssues(bundle, issue); err != nil {
+				panic(err)
+			}
+		}
+		// the search of each type had its _count reduced to the maximum, if larger
+		linksQuery := search.Query{Resource: resourceTypes[0], Query: typeQuery}
+		linksQuery.LimitCount(config.MaxResultCount)
+		bundle.Link = systemSearchLinks(*config.responseURL(c.Request), rawQuery, resourceTypes[0], linksQuery.Query, bundles)
+
+		c.Set("bundle", bundle)
+		c.Render(http.StatusOK, CustomFhirRenderer{bundle, c})
+	}
+}
+
+// splitTypeParameter separates the resource types of the _type parameters of a query from its other parameters
+func splitTypeParameter(rawQuery string) (resourceTypes []string, otherParams string, err error) {
+	params, err := search.ParseQuery(rawQuery)
+	if err != nil {
+		return nil, "", err
+	}
+	registered := make(map[string]bool)
+	for _, resourceType := range registeredResourceTypes() {
+		registered[resourceType] = true
+	}
+
+	var others search.URLQueryParameters
+	for _, param := range params.All() {
+		if param.Key != "_type" {
+			others.Add(param.Key, param.Value)
+			continue
+		}
+		for _, resourceType := range strings.Split(param.Value, ",") {
+			if !registered[resourceType] {
+				return nil, "", fmt.Errorf("Parameter \"_type\" content is invalid (%s isn't a resource type)", resourceType)
+			}
+			if !stringSliceContains(resourceTypes, resourceType) {
+				resourceTypes = append(resourceTypes, resourceType)
+			}
+		}
+	}
+	if len(resourceTypes) == 0 {
+		return nil, "", errors.New("Parameter \"_type\" is required to search across resource types")
+	}
+	return resourceTypes, others.Encode(), nil
+}
+
+// mergeSearchBundles merges the searchsets of several resource types: their matches one type after the
+// other, then the resources they include (each once) and then the issues of their OperationOutcome entries
+func mergeSearchBundles(bundles []*models2.ShallowBundle) (*models2.ShallowBundle, error) {
+	merged := &models2.ShallowBundle{
+		Id:   primitive.NewObjectID().Hex(),
+		Type: "searchset",
+	}
+	var total uint32
+	counted := true
+	inBundle := make(map[string]bool)
+	var includes []models2.ShallowBundleEntryComponent
+	var issues []models.OperationOutcomeIssueComponent
+
+	for _, bundle := range bundles {
+		if bundle.Total == nil {
+			counted = false
+		} else {
+			total += *bundle.Total
+		}
+		for _, entry := range bundle.Entry {
+			mode := ""
+			if entry.Search != nil {
+				mode = entry.Search.Mode
+			}
+			switch mode {
+			case "outcome":
+				outcome := &models.OperationOutcome{}
+				if err := json.Unmarshal(entry.Resource.JsonBytes(), outcome); err != nil {
+					return nil, errors.Wrap(err, "failed to unmarshal search OperationOutcome")
+				}
+				issues = append(issues, outcome.Issue...)
+			case "include":
+				includes = append(includes, entry)
+			default:
+				inBundle[entry.Resource.ResourceType()+"/"+entry.Resource.Id()] = true
+				merged.Entry = append(merged.Entry, entry)
+			}
+		}
+	}
+	for _, entry := range includes {
+		key := entry.Resource.ResourceType() + "/" + entry.Resource.Id()
+		if !inBundle[key] {
+			inBundle[key] = true
+			merged.Entry = append(merged.Entry, entry)
+		}
+	}
+
+	if counted {
+		merged.Total = &total
+	}
+	if err := addSearchOutcomeIssues(merged, issues...); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+// systemSearchLinks returns the links of a search across resource types: the self link with its query and,
+// as _count and _offset apply to each type, first, previous and next links paging all the types together.
+// There's a next page if there is for any type.
+func systemSearchLinks(baseURL url.URL, rawQuery string, firstType string, typeQuery string, bundles []*models2.ShallowBundle) []models.BundleLinkComponent {
+	params, _ := search.ParseQuery(rawQuery)
+	query := search.Query{Resource: firstType, Query: typeQuery}
+	options := query.Options()
+	if options.Summary == "count" {
+		return []models.BundleLinkComponent{newSummaryCountSelfLink(baseURL, search.Query{Query: rawQuery})}
+	}
+
+	links := []models.BundleLinkComponent{
+		newLink("self", baseURL, params, options.Offset, options.Count),
+		newLink("first", baseURL, params, 0, options.Count),
+	}
+	if options.Offset > 0 {
+		prevOffset := options.Offset - options.Count
+		if prevOffset < 0 {
+			prevOffset = 0
+		}
+		links = append(links, newLink("previous", baseURL, params, prevOffset, options.Offset-prevOffset))
+	}
+	for _, bundle := range bundles {
+		if hasLink(bundle.Link, "next") {
+			links = append(links, newLink("next", baseURL, params, options.Offset+options.Count, options.Count))
+			break
+		}
+	}
+	return links
+}
+
+func hasLink(links []models.BundleLinkComponent, relation string) bool {
+	for _, link := range links {
+		if link.Relation == relation {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// Severities of the issues a TerminologyInterceptor reports for codes outside of their value sets
+const (
+	TerminologySeverityError   = "error"
+	TerminologySeverityWarning = "warning"
+)
+
+// TerminologyValidator checks whether codes are members of value sets, e.g. with the $validate-code
+// operation of a terminology server
+type TerminologyValidator interface {
+	// ValidateCode returns whether a code of a system is in the value set with the URL valueSetUrl.
+	// system is empty for code elements, which have none.
+	ValidateCode(system, code, valueSetUrl string) (bool, error)
+}
+
+// NoTerminologyValidator is the default TerminologyValidator, accepting every code
+type NoTerminologyValidator struct{}
+
+func (NoTerminologyValidator) ValidateCode(system, code, valueSetUrl string) (bool, error) {
+	return true, nil
+}
+
+// TerminologyInterceptor is a ValidationInterceptor checking that the codes of the elements of resources
+// bound to value sets are in them (registered with AddValidationInterceptor, e.g. for all types with "*")
+type TerminologyInterceptor struct {
+	// Bindings are the URLs of the value sets, by element path (e.g. "Observation.code" or "Condition.category"),
+	// whose members the codes of those elements have to be. The elements can be codes, Codings or
+	// CodeableConcepts, which need one of their codings to be in the value set.
+	Bindings map[string]string
+	// Validator checks the codes of the elements in Bindings (default NoTerminologyValidator)
+	Validator TerminologyValidator
+	// Severity is TerminologySeverityError to reject resources with codes outside of their value sets, or
+	// TerminologySeverityWarning to store them and return the issues as warnings (default "error")
+	Severity string
+}
+
+// ValidateResource returns an issue for each element of a resource bound to a value set in the Bindings
+// whose codes aren't in it
+func (t *TerminologyInterceptor) ValidateResource(ctx context.Context, resource *models2.Resource) ([]models.OperationOutcomeIssueComponent, error) {
+	resourceType := resource.ResourceType()
+	var paths []string
+	for path := range t.Bindings {
+		if strings.HasPrefix(path, resourceType+".") {
+			paths = append(paths, path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	sort.Strings(paths)
+
+	var document map[string]interface{}
+	if err := resource.Unmarshal(&document); err != nil {
+		return nil, errors.Wrap(err, "TerminologyInterceptor: failed to unmarshal resource")
+	}
+
+	severity := t.Severity
+	if severity == "" {
+		severity = TerminologySeverityError
+	}
+	validator := t.Validator
+	if validator == nil {
+		validator = NoTerminologyValidator{}
+	}
+	var issues []models.OperationOutcomeIssueComponent
+	for _, path := range paths {
+		valueSetUrl := t.Bindings[path]
+		for _, value := range jsonValuesAtPath(document, strings.Split(strings.TrimPrefix(path, resourceType+"."), ".")) {
+			codes := codesOfValue(value)
+			if len(codes) == 0 {
+				continue
+			}
+			// a CodeableConcept is in the value set if any of its codings is
+			valid := false
+			for _, code := range codes {
+				inValueSet, err := validator.ValidateCode(code.system, code.code, valueSetUrl)
+				if err != nil {
+					return nil, errors.Wrapf(err, "failed to validate the codes of %s", path)
+				}
+				if inValueSet {
+					valid = true
+					break
+				}
+			}
+			if !valid {
+				codeStrings := make([]string, len(codes))
+				for i, code := range codes {
+					codeStrings[i] = code.String()
+				}
+				issues = append(issues, models.OperationOutcomeIssueComponent{
+					Severity:    severity,
+					Code:        "code-invalid",
+					Diagnostics: fmt.Sprintf("%s %s is not in the value set %s", path, strings.Join(codeStrings, ", "), valueSetUrl),
+					Expression:  []string{path},
+				})
+			}
+		}
+	}
+	return issues, nil
+}
+
+// systemCode is a code along with its system, if any
+type systemCode struct {
+	system string
+	code   string
+}
+
+func (c systemCode) String() string {
+	if c.system == "" {
+		return c.code
+	}
+	return c.system + "|" + c.code
+}
+
+// codesOfValue returns the codes of a code, Coding or CodeableConcept element
+func codesOfValue(value interface{}) []systemCode {
+	switch v := value.(type) {
+	case string:
+		return []systemCode{{code: v}}
+	case map[string]interface{}:
+		if codings, isCodeableConcept := v["coding"].([]interface{}); isCodeableConcept {
+			var codes []systemCode
+			for _, coding := range codings {
+				codes = append(codes, codesOfValue(coding)...)
+			}
+			return codes
+		}
+		code, _ := v["code"].(string)
+		if code == "" {
+			return nil
+		}
+		system, _ := v["system"].(string)
+		return []systemCode{{system, code}}
+	}
+	return nil
+}
+
+// jsonValuesAtPath returns the values of a decoded JSON object at a path of element names,
+// going through the elements of any arrays along the way
+func jsonValuesAtPath(value interface{}, path []string) []interface{} {
+	if array, isArray := value.([]interface{}); isArray {
+		var values []interface{}
+		for _, element := range array {
+			values = append(values, jsonValuesAtPath(element, path)...)
+		}
+		return values
+	}
+	if len(path) == 0 {
+		return []interface{}{value}
+	}
+	object, isObject := value.(map[string]interface{})
+	if !isObject {
+		return nil
+	}
+	child, found := object[path[0]]
+	if !found {
+		return nil
+	}
+	return jsonValuesAtPath(child, path[1:])
+}
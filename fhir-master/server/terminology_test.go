@@ -0,0 +1,145 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+	. "gopkg.in/check.v1"
+)
+
+type TerminologySuite struct{}
+
+var _ = Suite(&TerminologySuite{})
+
+const (
+	vitalSignsValueSet        = "http://example.com/ValueSet/vital-signs"
+	observationStatusValueSet = "http://hl7.org/fhir/ValueSet/observation-status"
+)
+
+// stubTerminologyValidator accepts the codes ("system|code", or just the code without a system)
+// it has for each value set and fails for value sets it doesn't have
+type stubTerminologyValidator map[string][]string
+
+func (v stubTerminologyValidator) ValidateCode(system, code, valueSetUrl string) (bool, error) {
+	codes, found := v[valueSetUrl]
+	if !found {
+		return false, errors.New("unknown value set " + valueSetUrl)
+	}
+	key := systemCode{system, code}.String()
+	for _, valid := range codes {
+		if valid == key {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+var testTerminologyValidator = stubTerminologyValidator{
+	vitalSignsValueSet:        {"http://loinc.org|8867-4", "http://loinc.org|8310-5"},
+	observationStatusValueSet: {"final", "preliminary"},
+}
+
+func testTerminologyInterceptor(severity string) *TerminologyInterceptor {
+	return &TerminologyInterceptor{
+		Bindings: map[string]string{
+			"Observation.code":           vitalSignsValueSet,
+			"Observation.component.code": vitalSignsValueSet,
+			"Observation.status":         observationStatusValueSet,
+		},
+		Validator: testTerminologyValidator,
+		Severity:  severity,
+	}
+}
+
+// terminologyTestDAL is a data access layer with only a TerminologyInterceptor for all types
+func terminologyTestDAL(severity string, logger Logger) *mongoDataAccessLayer {
+	return &mongoDataAccessLayer{
+		Interceptors: map[string]InterceptorList{
+			"Validate": {{ResourceType: "*", ValidationHandler: testTerminologyInterceptor(severity)}},
+		},
+		logger: logger,
+	}
+}
+
+func newTestObservation(c *C, json string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	c.Assert(err, IsNil)
+	return resource
+}
+
+func (s *TerminologySuite) TestCodesInValueSets(c *C) {
+	interceptor := testTerminologyInterceptor(TerminologySeverityError)
+	validate := func(json string) []models.OperationOutcomeIssueComponent {
+		issues, err := interceptor.ValidateResource(context.Background(), newTestObservation(c, json))
+		c.Assert(err, IsNil)
+		return issues
+	}
+
+	// one of the codings of a CodeableConcept is enough
+	c.Assert(validate(`{"resourceType":"Observation","status":"final",`+
+		`"code":{"coding":[{"system":"http://example.com/local","code":"hr"},{"system":"http://loinc.org","code":"8867-4"}]},`+
+		`"component":[{"code":{"coding":[{"system":"http://loinc.org","code":"8310-5"}]}}]}`), HasLen, 0)
+
+	// elements without codes and resources of other types aren't checked
+	c.Assert(validate(`{"resourceType":"Observation","code":{"text":"Heart rate"}}`), HasLen, 0)
+	c.Assert(validate(`{"resourceType":"Condition","code":{"coding":[{"code":"foo"}]}}`), HasLen, 0)
+}
+
+func (s *TerminologySuite) TestCodesNotInValueSets(c *C) {
+	dal := terminologyTestDAL(TerminologySeverityError, nil)
+	observation := newTestObservation(c, `{"resourceType":"Observation","status":"amended",`+
+		`"code":{"coding":[{"system":"http://loinc.org","code":"8867-4"}]},`+
+		`"component":[{"code":{"coding":[{"system":"http://loinc.org","code":"8310-5"}]}},`+
+		`{"code":{"coding":[{"system":"http://example.com/local","code":"hr"},{"system":"http://loinc.org","code":"1234-5"}]}}]}`)
+
+	warnings, err := dal.ValidateResource(context.Background(), observation)
+	c.Assert(warnings, HasLen, 0)
+	validationErr, ok := err.(*ValidationError)
+	c.Assert(ok, Equals, true)
+	c.Assert(validationErr.Issues, HasLen, 2)
+	c.Assert(validationErr.Issues[0].Severity, Equals, "error")
+	c.Assert(validationErr.Issues[0].Code, Equals, "code-invalid")
+	c.Assert(validationErr.Issues[0].Expression, DeepEquals, []string{"Observation.component.code"})
+	c.Assert(validationErr.Issues[0].Diagnostics, Equals,
+		"Observation.component.code http://example.com/local|hr, http://loinc.org|1234-5 is not in the value set "+vitalSignsValueSet)
+	c.Assert(validationErr.Issues[1].Diagnostics, Equals, "Observation.status amended is not in the value set "+observationStatusValueSet)
+
+	// reported as a 400 with the issues
+	status, outcome := ErrorToOpOutcome(err)
+	c.Assert(status, Equals, http.StatusBadRequest)
+	c.Assert(outcome.Issue, DeepEquals, validationErr.Issues)
+
+	// with the warning severity the issues are returned as warnings, and logged
+	logger := &capturingLogger{}
+	dal = terminologyTestDAL(TerminologySeverityWarning, logger)
+	warnings, err = dal.ValidateResource(context.Background(), observation)
+	c.Assert(err, IsNil)
+	c.Assert(warnings, HasLen, 2)
+	c.Assert(warnings[1].Severity, Equals, "warning")
+	c.Assert(warnings[1].Diagnostics, Equals, "Observation.status amended is not in the value set "+observationStatusValueSet)
+	c.Assert(logger.withLevel("warn"), HasLen, 2)
+}
+
+func (s *TerminologySuite) TestNoTerminologyValidator(c *C) {
+	interceptor := testTerminologyInterceptor(TerminologySeverityError)
+	interceptor.Validator = nil
+
+	issues, err := interceptor.ValidateResource(context.Background(), newTestObservation(c, `{"resourceType":"Observation","status":"amended",`+
+		`"code":{"coding":[{"system":"http://loinc.org","code":"1234-5"}]}}`))
+	c.Assert(err, IsNil)
+	c.Assert(issues, HasLen, 0)
+}
+
+func (s *TerminologySuite) TestTerminologyValidatorFailure(c *C) {
+	dal := terminologyTestDAL(TerminologySeverityError, nil)
+	interceptor := dal.Interceptors["Validate"][0].ValidationHandler.(*TerminologyInterceptor)
+	interceptor.Bindings = map[string]string{"Observation.code": "http://example.com/ValueSet/missing"}
+
+	_, err := dal.ValidateResource(context.Background(), newTestObservation(c, `{"resourceType":"Observation","code":{"coding":[{"code":"foo"}]}}`))
+	c.Assert(err, ErrorMatches, "validation interceptor failed on \\*: failed to validate the codes of Observation.code: unknown value set .*")
+	_, isValidationError := err.(*ValidationError)
+	c.Assert(isValidationError, Equals, false)
+}
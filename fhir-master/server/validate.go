@@ -0,0 +1,190 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// Modes of the $validate operation, selecting the rules that apply in addition
+// to the resource being valid on its own
+const (
+	ValidateModeCreate = "create"
+	ValidateModeUpdate = "update"
+	ValidateModeDelete = "delete"
+)
+
+// validationModeIssues checks the rules specific to a $validate mode:
+// resources being created must not have an id, resources being updated need one
+// (matching the id in the URL, if any) and resources being deleted must exist.
+// id is from the URL of an instance-level $validate and may be empty, as may
+// resource when validating a delete.
+func validationModeIssues(session DataAccessSession, mode string, resourceType string, id string, resource *models2.Resource) ([]models.OperationOutcomeIssueComponent, error) {
+	var issues []models.OperationOutcomeIssueComponent
+	addIssue := func(code string, format string, args ...interface{}) {
+		issues = append(issues, models.OperationOutcomeIssueComponent{
+			Severity:    "error",
+			Code:        code,
+			Diagnostics: fmt.Sprintf(format, args...),
+		})
+	}
+
+	switch mode {
+	case "":
+	case ValidateModeCreate:
+		if resource != nil && resource.Id() != "" {
+			addIssue("invalid", "Resources being created must not have an id (found %s)", resource.Id())
+		}
+	case ValidateModeUpdate:
+		if resource == nil || resource.Id() == "" {
+			addIssue("required", "Resources being updated must have an id")
+		} else if id != "" && resource.Id() != id {
+			addIssue("invalid", "Resource id (%s) does not match the id in the URL (%s)", resource.Id(), id)
+		}
+	case ValidateModeDelete:
+		if id == "" {
+			addIssue("required", "The id of the resource being deleted is required")
+			break
+		}
+		_, err := session.Get(id, resourceType)
+		switch err {
+		case nil:
+		case ErrNotFound, ErrDeleted:
+			addIssue("not-found", "Resource %s/%s does not exist", resourceType, id)
+		default:
+			return nil, errors.Wrap(err, "validationModeIssues: Get failed")
+		}
+	default:
+		addIssue("invalid", "Unknown mode: %s (should be create, update or delete)", mode)
+	}
+	return issues, nil
+}
+
+// ValidateHandler handles the $validate operation (POST /Patient/$validate or /Patient/123/$validate).
+// The resource is sent either as is or in the "resource" parameter of a Parameters resource
+// and goes through the same checks as a create or update without being stored. The issues
+// found (or "All OK") are returned in an OperationOutcome.
+func (rc *ResourceController) ValidateHandler(c *gin.Context) {
+	defer handlePanics(c)
+	c.Set("Action", "validate")
+
+	id := c.Param("id")
+	if id == "$validate" {
+		id = "" // type-level $validate
+	}
+	mode := c.Query("mode")
+
+	var issues []models.OperationOutcomeIssueComponent
+	addIssue := func(severity string, code string, diagnostics string) {
+		issues = append(issues, models.OperationOutcomeIssueComponent{
+			Severity:    severity,
+			Code:        code,
+			Diagnostics: diagnostics,
+		})
+	}
+
+	var resource *models2.Resource
+	var warnings []models.OperationOutcomeIssueComponent
+	if c.Request.ContentLength != 0 || mode != ValidateModeDelete {
+		var err error
+		resource, err = FHIRBind(c, rc.Config.ValidatorURL)
+		if err == nil && resource.ResourceType() == "Parameters" {
+			var paramMode string
+			resource, paramMode, err = unwrapValidateParameters(resource)
+			if paramMode != "" {
+				mode = paramMode
+			}
+		}
+		if err != nil {
+			addIssue("fatal", "structure", err.Error())
+			resource = nil
+		}
+	}
+
+	if resource != nil {
+		if resource.ResourceType() != rc.Name {
+			addIssue("error", "invalid", fmt.Sprintf("Expected a %s resource but got %s", rc.Name, resource.ResourceType()))
+		} else if err := checkResourceStructure(resource, rc.Config.MaxResourceDepth); err != nil {
+			addIssue("error", "structure", err.Error())
+		} else {
+			var err error
+			warnings, err = rc.DAL.ValidateResource(c.Request.Context(), resource)
+			if validationErr, isValidationError := errors.Cause(err).(*ValidationError); isValidationError {
+				issues = append(issues, validationErr.Issues...)
+			} else if err != nil {
+				panic(errors.Wrap(err, "ValidateHandler: ValidateResource failed"))
+			}
+		}
+	}
+
+	if mode == ValidateModeDelete || len(issues) == 0 {
+		var session DataAccessSession
+		if mode == ValidateModeDelete {
+			session = rc.DAL.StartSession(c.Request.Context(), c.GetHeader("Db"))
+			defer session.Finish()
+		}
+		modeIssues, err := validationModeIssues(session, mode, rc.Name, id, resource)
+		if err != nil {
+			panic(errors.Wrap(err, "ValidateHandler: validationModeIssues failed"))
+		}
+		issues = append(issues, modeIssues...)
+	}
+	issues = append(issues, warnings...)
+
+	if len(issues) == 0 {
+		addIssue("information", "informational", "All OK")
+	}
+	c.Render(http.StatusOK, CustomFhirRenderer{&models.OperationOutcome{Issue: issues}, c})
+}
+
+// unwrapValidateParameters returns the resource and mode in the Parameters of a $validate request
+func unwrapValidateParameters(parameters *models2.Resource) (resource *models2.Resource, mode string, err error) {
+	var params struct {
+		Parameter []struct {
+			Name      string          `json:"name"`
+			ValueCode string          `json:"valueCode"`
+			Resource  json.RawMessage `json:"resource"`
+		} `json:"parameter"`
+	}
+	err = json.Unmarshal(parameters.JsonBytes(), &params)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to parse Parameters")
+	}
+
+	for _, param := range params.Parameter {
+		switch param.Name {
+		case "resource":
+			resource, err = models2.NewResourceFromJsonBytes(param.Resource)
+			if err != nil {
+				return nil, "", errors.Wrap(err, "failed to parse the resource parameter")
+			}
+		case "mode":
+			mode = param.ValueCode
+		}
+	}
+	return resource, mode, nil
+}
+
+// checkResourceStructure converts a resource to BSON like when it's stored, which checks it against the
+// FHIR schema and the maximum depth. Schema errors are returned rather than panicking.
+func checkResourceStructure(resource *models2.Resource, maxDepth int) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			schemaError, isSchemaError := r.(models2.FhirSchemaError)
+			if !isSchemaError {
+				panic(r)
+			}
+			err = schemaError
+		}
+	}()
+
+	resource.SetMaxDepth(maxDepth)
+	_, err = resource.GetBSON()
+	return err
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/eug48/fhir/models"
+	"github.com/eug48/fhir/models2"
+)
+
+// getOnlySession is a DataAccessSession that only supports Get
+type getOnlySession struct {
+	DataAccessSession
+	resources map[string]*models2.Resource
+}
+
+func (s *getOnlySession) Finish() {
+}
+
+func (s *getOnlySession) StartSession(ctx context.Context, dbname string) DataAccessSession {
+	return s
+}
+
+func (s *getOnlySession) ValidateResource(ctx context.Context, resource *models2.Resource) ([]models.OperationOutcomeIssueComponent, error) {
+	return nil, nil
+}
+
+func (s *getOnlySession) Get(id, resourceType string) (*models2.Resource, error) {
+	resource, found := s.resources[resourceType+"/"+id]
+	if !found {
+		return nil, ErrNotFound
+	}
+	return resource, nil
+}
+
+func (m *MiddlewareTestSuite) validate(url string, body string) *models.OperationOutcome {
+	session := &getOnlySession{resources: map[string]*models2.Resource{
+		"Patient/123": m.patient(`{"resourceType": "Patient", "id": "123"}`),
+	}}
+	req := httptest.NewRequest("POST", url, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/fhir+json")
+	rw := m.serve(req, func(e *gin.Engine) {
+		RegisterController("Patient", e, nil, session, DefaultConfig)
+	})
+	m.Require().Equal(http.StatusOK, rw.Code)
+
+	outcome := &models.OperationOutcome{}
+	m.Require().NoError(json.Unmarshal(rw.Body.Bytes(), outcome))
+	m.Require().NotEmpty(outcome.Issue)
+	return outcome
+}
+
+func (m *MiddlewareTestSuite) TestValidateValidResource() {
+	outcome := m.validate("/Patient/$validate", `{"resourceType": "Patient", "gender": "male", "birthDate": "1934-06-09"}`)
+	m.Require().Len(outcome.Issue, 1)
+	m.Equal("information", outcome.Issue[0].Severity)
+	m.Equal("All OK", outcome.Issue[0].Diagnostics)
+}
+
+func (m *MiddlewareTestSuite) TestValidateStructurallyInvalidResource() {
+	outcome := m.validate("/Patient/$validate", `{"resourceType": "Patient", "frobnicate": true}`)
+	m.Require().Len(outcome.Issue, 1)
+	m.Equal("error", outcome.Issue[0].Severity)
+	m.Equal("structure", outcome.Issue[0].Code)
+
+	outcome = m.validate("/Patient/$validate", `{"resourceType": "Patient", "birthDate": "yesterday"}`)
+	m.Equal("error", outcome.Issue[0].Severity)
+
+	outcome = m.validate("/Patient/$validate", `{"resourceType": "Observation"}`)
+	m.Equal("error", outcome.Issue[0].Severity)
+	m.Equal("invalid", outcome.Issue[0].Code)
+
+	outcome = m.validate("/Patient/$validate", `{"gender": "male"}`)
+	m.Equal("fatal", outcome.Issue[0].Severity)
+}
+
+func (m *MiddlewareTestSuite) TestValidateModes() {
+	outcome := m.validate("/Patient/$validate?mode=create", `{"resourceType": "Patient", "id": "123"}`)
+	m.Equal("error", outcome.Issue[0].Severity)
+	m.Equal("invalid", outcome.Issue[0].Code)
+
+	outcome = m.validate("/Patient/123/$validate?mode=update", `{"resourceType": "Patient", "id": "123"}`)
+	m.Equal("All OK", outcome.Issue[0].Diagnostics)
+
+	outcome = m.validate("/Patient/123/$validate?mode=delete", ``)
+	m.Equal("All OK", outcome.Issue[0].Diagnostics)
+
+	outcome = m.validate("/Patient/456/$validate?mode=delete", ``)
+	m.Equal("not-found", outcome.Issue[0].Code)
+}
+
+func (m *MiddlewareTestSuite) TestValidateParameters() {
+	outcome := m.validate("/Patient/$validate", `{
+		"resourceType": "Parameters",
+		"parameter": [
+			{"name": "resource", "resource": {"resourceType": "Patient", "id": "123"}},
+			{"name": "mode", "valueCode": "create"}
+		]
+	}`)
+	m.Require().Len(outcome.Issue, 1)
+	m.Equal("error", outcome.Issue[0].Severity)
+	m.Equal("invalid", outcome.Issue[0].Code)
+}
+
+func (m *MiddlewareTestSuite) patient(json string) *models2.Resource {
+	resource, err := models2.NewResourceFromJsonBytes([]byte(json))
+	m.Require().NoError(err)
+	return resource
+}
+
+func (m *MiddlewareTestSuite) TestValidateCreateMode() {
+	session := &getOnlySession{}
+
+	issues, err := validationModeIssues(session, ValidateModeCreate, "Patient", "", m.patient(`{"resourceType": "Patient", "id": "123"}`))
+	m.NoError(err)
+	m.Require().Len(issues, 1)
+	m.Equal("error", issues[0].Severity)
+	m.Equal("invalid", issues[0].Code)
+
+	issues, err = validationModeIssues(session, ValidateModeCreate, "Patient", "", m.patient(`{"resourceType": "Patient"}`))
+	m.NoError(err)
+	m.Len(issues, 0)
+}
+
+func (m *MiddlewareTestSuite) TestValidateUpdateMode() {
+	session := &getOnlySession{}
+	patient := m.patient(`{"resourceType": "Patient", "id": "123"}`)
+
+	issues, err := validationModeIssues(session, ValidateModeUpdate, "Patient", "123", patient)
+	m.NoError(err)
+	m.Len(issues, 0)
+
+	issues, err = validationModeIssues(session, ValidateModeUpdate, "Patient", "456", patient)
+	m.NoError(err)
+	m.Len(issues, 1)
+
+	issues, err = validationModeIssues(session, ValidateModeUpdate, "Patient", "", m.patient(`{"resourceType": "Patient"}`))
+	m.NoError(err)
+	m.Require().Len(issues, 1)
+	m.Equal("required", issues[0].Code)
+}
+
+func (m *MiddlewareTestSuite) TestValidateDeleteMode() {
+	session := &getOnlySession{resources: map[string]*models2.Resource{
+		"Patient/123": m.patient(`{"resourceType": "Patient", "id": "123"}`),
+	}}
+
+	issues, err := validationModeIssues(session, ValidateModeDelete, "Patient", "123", nil)
+	m.NoError(err)
+	m.Len(issues, 0)
+
+	issues, err = validationModeIssues(session, ValidateModeDelete, "Patient", "456", nil)
+	m.NoError(err)
+	m.Require().Len(issues, 1)
+	m.Equal("not-found", issues[0].Code)
+	m.Equal("Resource Patient/456 does not exist", issues[0].Diagnostics)
+}
+
+func (m *MiddlewareTestSuite) TestValidateUnknownMode() {
+	issues, err := validationModeIssues(&getOnlySession{}, "frobnicate", "Patient", "", nil)
+	m.NoError(err)
+	m.Require().Len(issues, 1)
+	m.Equal("invalid", issues[0].Code)
+}
@@ -64,14 +64,17 @@ func MustParseDate(dateStr string) (out *Date) {
 	return
 }
 
+// dateRegex matches the whole of a FHIR date, dateTime or instant. Dates without a time may have a timezone
+// (e.g. 2013-01-02T-07:00 or 2013Z), which is ignored.
+var dateRegex = regexp.MustCompile("^([0-9]{4})(-(0[1-9]|1[0-2])(-(0[0-9]|[1-2][0-9]|3[0-1])(T([01][0-9]|2[0-3]):([0-5][0-9])(:([0-5][0-9])(\\.([0-9]+))?)?((Z)|(\\+|-)((0[0-9]|1[0-3]):([0-5][0-9])|(14):(00)))?)?)?)?(T?(Z|[+-][0-9]{2}:[0-9]{2}))?$")
+
 // ParseDate parses a FHIR date string (roughly ISO 8601) into a Date object,
 // maintaining the value and the precision supplied.
 func ParseDate(dateStr string) (*Date, error) {
 	dt := &Date{}
 
 	dateStr = strings.TrimSpace(dateStr)
-	dtRegex := regexp.MustCompile("([0-9]{4})(-(0[1-9]|1[0-2])(-(0[0-9]|[1-2][0-9]|3[0-1])(T([01][0-9]|2[0-3]):([0-5][0-9])(:([0-5][0-9])(\\.([0-9]+))?)?((Z)|(\\+|-)((0[0-9]|1[0-3]):([0-5][0-9])|(14):(00)))?)?)?)?")
-	if m := dtRegex.FindStringSubmatch(dateStr); m != nil {
+	if m := dateRegex.FindStringSubmatch(dateStr); m != nil {
 		y, mo, d, h, mi, s, ms, tzZu, tzOp, tzh, tzm := m[1], m[3], m[5], m[7], m[8], m[10], m[12], m[14], m[15], m[17], m[18]
 
 		switch {
@@ -136,6 +139,10 @@ func ParseDate(dateStr string) (*Date, error) {
 		msInt, _ := strconv.Atoi(ms)
 
 		dt.Value = time.Date(yInt, time.Month(moInt), dInt, hInt, miInt, sInt, msInt*1000*1000, loc)
+		if dt.Value.Day() != dInt {
+			// time.Date normalizes e.g. February 30 to March 1 or 2
+			return nil, fmt.Errorf("could not parse date/time: %s (day out of range)", dateStr)
+		}
 		return dt, nil
 	} else {
 		return nil, fmt.Errorf("could not parse date/time: %s", dateStr)